@@ -17,10 +17,15 @@ package api
 import (
 	"crypto/tls"
 	"crypto/x509"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"net"
 	"net/http"
+	"path/filepath"
+	"regexp"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/tylerb/graceful"
@@ -35,6 +40,11 @@ const timeoutResponse = `{"Error":{"Message":"Clair failed to respond within the
 
 var log = capnslog.NewPackageLogger("github.com/coreos/clair", "api")
 
+// healthGracePeriod is the time given to in-flight health checks when the health API stops.
+const healthGracePeriod = 10 * time.Second
+
+// Run serves the main API until st is stopped. It then stops accepting connections and lets the
+// in-flight requests finish during the configured grace period, after which they are aborted.
 func Run(config *config.APIConfig, ctx *context.RouteContext, st *utils.Stopper) {
 	defer st.End()
 
@@ -43,32 +53,51 @@ func Run(config *config.APIConfig, ctx *context.RouteContext, st *utils.Stopper)
 		log.Infof("main API service is disabled.")
 		return
 	}
-	log.Infof("starting main API on port %d.", config.Port)
+	log.Infof("starting main API on %s.", serverAddr(config.Addr, config.Port))
 
-	tlsConfig, err := tlsClientConfig(config.CAFile)
+	if err := context.ValidateAccessLogFormat(config.AccessLogFormat); err != nil {
+		log.Fatal(err)
+	}
+	if err := validateServerTimeouts(config); err != nil {
+		log.Fatal(err)
+	}
+	if err := validateLocalPaths(config); err != nil {
+		log.Fatal(err)
+	}
+	if _, err := regexp.Compile(config.LayerNamePattern); err != nil {
+		log.Fatalf("invalid layer name pattern: %s", err)
+	}
+	if config.LocalPathsAllowed {
+		log.Infof("main API allows layers to be read from %s", strings.Join(config.LocalPathPrefixes, ", "))
+	}
+
+	tlsConfig, err := tlsServerConfig(config)
 	if err != nil {
-		log.Fatalf("could not initialize client cert authentication: %s\n", err)
+		log.Fatalf("could not initialize TLS: %s\n", err)
 	}
-	if tlsConfig != nil {
+	if tlsConfig != nil && tlsConfig.ClientCAs != nil {
 		log.Info("main API configured with client certificate authentication")
 	}
 
+	listener, err := net.Listen("tcp", serverAddr(config.Addr, config.Port))
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	srv := &graceful.Server{
-		Timeout:          0,    // Already handled by our TimeOut middleware
 		NoSignalHandling: true, // We want to use our own Stopper
-		Server: &http.Server{
-			Addr:      ":" + strconv.Itoa(config.Port),
-			TLSConfig: tlsConfig,
-			Handler:   http.TimeoutHandler(newAPIHandler(ctx), config.Timeout, timeoutResponse),
-		},
+		Server:           newHTTPServer(config, newAPIHandler(ctx)),
 	}
+	srv.TLSConfig = tlsConfig
 
-	listenAndServeWithStopper(srv, st, config.CertFile, config.KeyFile)
+	serveWithStopper(srv, listener, st, config.ShutdownGracePeriod, tlsConfig)
 
 	log.Info("main API stopped")
 }
 
-func RunHealth(config *config.APIConfig, ctx *context.RouteContext, st *utils.Stopper) {
+// RunHealth serves the health API until st is stopped. Once draining is closed, the health check
+// reports Clair as stopping so that load balancers stop sending it requests.
+func RunHealth(config *config.APIConfig, ctx *context.RouteContext, st *utils.Stopper, draining <-chan struct{}) {
 	defer st.End()
 
 	// Do not run the API service if there is no config.
@@ -76,38 +105,82 @@ func RunHealth(config *config.APIConfig, ctx *context.RouteContext, st *utils.St
 		log.Infof("health API service is disabled.")
 		return
 	}
-	log.Infof("starting health API on port %d.", config.HealthPort)
+	log.Infof("starting health API on %s.", serverAddr(config.HealthAddr, config.HealthPort))
+
+	listener, err := net.Listen("tcp", serverAddr(config.HealthAddr, config.HealthPort))
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	srv := &graceful.Server{
-		Timeout:          10 * time.Second, // Interrupt health checks when stopping
-		NoSignalHandling: true,             // We want to use our own Stopper
-		Server: &http.Server{
-			Addr:    ":" + strconv.Itoa(config.HealthPort),
-			Handler: http.TimeoutHandler(newHealthHandler(ctx), config.Timeout, timeoutResponse),
-		},
+		NoSignalHandling: true, // We want to use our own Stopper
+		Server:           newHTTPServer(config, newHealthHandler(ctx, draining)),
 	}
 
-	listenAndServeWithStopper(srv, st, "", "")
+	serveWithStopper(srv, listener, st, healthGracePeriod, nil)
 
 	log.Info("health API stopped")
 }
 
-// listenAndServeWithStopper wraps graceful.Server's
-// ListenAndServe/ListenAndServeTLS and adds the ability to interrupt them with
-// the provided utils.Stopper
-func listenAndServeWithStopper(srv *graceful.Server, st *utils.Stopper, certFile, keyFile string) {
+// serverAddr returns the address to listen on. An empty host listens on every interface.
+func serverAddr(host string, port int) string {
+	return net.JoinHostPort(host, strconv.Itoa(port))
+}
+
+// newHTTPServer initializes an *http.Server serving handler with the configured timeouts and
+// maximum header size.
+func newHTTPServer(config *config.APIConfig, handler http.Handler) *http.Server {
+	return &http.Server{
+		Handler:        http.TimeoutHandler(handler, config.Timeout, timeoutResponse),
+		ReadTimeout:    config.ReadTimeout,
+		WriteTimeout:   config.WriteTimeout,
+		IdleTimeout:    config.IdleTimeout,
+		MaxHeaderBytes: config.MaxHeaderBytes,
+	}
+}
+
+// validateServerTimeouts ensures that the write timeout, when enabled, leaves enough time to the
+// requests to complete: the connection would otherwise be closed before the request timeout
+// responds, cutting layer POSTs that are still downloading and analyzing their layer.
+func validateServerTimeouts(config *config.APIConfig) error {
+	if config.WriteTimeout > 0 && config.WriteTimeout <= config.Timeout {
+		return fmt.Errorf("the write timeout (%s) must be greater than the request timeout (%s)", config.WriteTimeout, config.Timeout)
+	}
+	return nil
+}
+
+// validateLocalPaths ensures that, when layers may be read from the local filesystem, the
+// directories they are restricted to are listed and absolute.
+func validateLocalPaths(config *config.APIConfig) error {
+	if !config.LocalPathsAllowed {
+		return nil
+	}
+	if len(config.LocalPathPrefixes) == 0 {
+		return errors.New("local layer paths are allowed but no directory is listed in localpathprefixes")
+	}
+	for _, prefix := range config.LocalPathPrefixes {
+		if !filepath.IsAbs(prefix) {
+			return fmt.Errorf("the local path prefix %q must be absolute", prefix)
+		}
+	}
+	return nil
+}
+
+// serveWithStopper wraps graceful.Server's Serve and adds the ability to interrupt it with the
+// provided utils.Stopper. Once stopped, the listener is closed and the in-flight requests have
+// gracePeriod to finish before their connections are closed, which cancels their context. A zero
+// gracePeriod waits for them indefinitely. TLS is enabled when tlsConfig is not nil.
+func serveWithStopper(srv *graceful.Server, listener net.Listener, st *utils.Stopper, gracePeriod time.Duration, tlsConfig *tls.Config) {
 	go func() {
 		<-st.Chan()
-		srv.Stop(0)
+		srv.Stop(gracePeriod)
 	}()
 
-	var err error
-	if certFile != "" && keyFile != "" {
+	if tlsConfig != nil {
 		log.Info("API: TLS Enabled")
-		err = srv.ListenAndServeTLS(certFile, keyFile)
-	} else {
-		err = srv.ListenAndServe()
+		listener = tls.NewListener(listener, tlsConfig)
 	}
+	err := srv.Serve(listener)
 
 	if err != nil {
 		if opErr, ok := err.(*net.OpError); !ok || (ok && opErr.Op != "accept") {
@@ -116,28 +189,43 @@ func listenAndServeWithStopper(srv *graceful.Server, st *utils.Stopper, certFile
 	}
 }
 
-// tlsClientConfig initializes a *tls.Config using the given CA. The resulting
-// *tls.Config is meant to be used to configure an HTTP server to do client
+// tlsServerConfig initializes a *tls.Config serving the configured certificate. When a CA is
+// configured, clients have to present a certificate signed by it: the server does client
 // certificate authentication.
 //
-// If no CA is given, a nil *tls.Config is returned; no client certificate will
-// be required and verified. In other words, authentication will be disabled.
-func tlsClientConfig(caPath string) (*tls.Config, error) {
-	if caPath == "" {
+// If no certificate is configured, a nil *tls.Config is returned and the API is served over plain
+// HTTP. Configuring a CA without a certificate is an error, as it would silently disable
+// authentication.
+func tlsServerConfig(cfg *config.APIConfig) (*tls.Config, error) {
+	if cfg.CertFile == "" && cfg.KeyFile == "" {
+		if cfg.CAFile != "" {
+			return nil, errors.New("client certificate authentication requires a certfile and a keyfile")
+		}
 		return nil, nil
 	}
+	if cfg.CertFile == "" || cfg.KeyFile == "" {
+		return nil, errors.New("both a certfile and a keyfile are required to enable TLS")
+	}
 
-	caCert, err := ioutil.ReadFile(caPath)
+	cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
 	if err != nil {
 		return nil, err
 	}
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}}
+
+	if cfg.CAFile != "" {
+		caCert, err := ioutil.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, err
+		}
 
-	caCertPool := x509.NewCertPool()
-	caCertPool.AppendCertsFromPEM(caCert)
+		caCertPool := x509.NewCertPool()
+		if !caCertPool.AppendCertsFromPEM(caCert) {
+			return nil, fmt.Errorf("no certificate found in %s", cfg.CAFile)
+		}
 
-	tlsConfig := &tls.Config{
-		ClientCAs:  caCertPool,
-		ClientAuth: tls.RequireAndVerifyClientCert,
+		tlsConfig.ClientCAs = caCertPool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
 	}
 
 	return tlsConfig, nil
@@ -0,0 +1,384 @@
+// Copyright 2015 clair authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tylerb/graceful"
+
+	"github.com/coreos/clair/api/context"
+	"github.com/coreos/clair/config"
+	"github.com/coreos/clair/utils"
+)
+
+type testCertificate struct {
+	cert *x509.Certificate
+	key  *rsa.PrivateKey
+	der  []byte
+}
+
+// newTestCertificate generates a certificate signed by parent, or a self-signed CA if parent is
+// nil.
+func newTestCertificate(t *testing.T, commonName string, parent *testCertificate) *testCertificate {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+
+	signerCert, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		signerCert, signerKey = parent.cert, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, signerCert, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &testCertificate{cert: cert, key: key, der: der}
+}
+
+// writePEM writes the certificate and its key in dir and returns their paths.
+func (c *testCertificate) writePEM(t *testing.T, dir, name string) (certFile, keyFile string) {
+	certFile = filepath.Join(dir, name+".crt")
+	keyFile = filepath.Join(dir, name+".key")
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(c.key)})
+	if err := ioutil.WriteFile(certFile, certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return
+}
+
+func (c *testCertificate) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.der}, PrivateKey: c.key}
+}
+
+func TestTLSServerConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "clair-api-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := newTestCertificate(t, "clair-ca", nil)
+	caFile, _ := ca.writePEM(t, dir, "ca")
+	certFile, keyFile := newTestCertificate(t, "clair-server", ca).writePEM(t, dir, "server")
+	garbageFile := filepath.Join(dir, "garbage")
+	if err := ioutil.WriteFile(garbageFile, []byte("not a certificate"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// Plain HTTP.
+	tlsConfig, err := tlsServerConfig(&config.APIConfig{})
+	assert.Nil(t, err)
+	assert.Nil(t, tlsConfig)
+
+	// TLS without client certificate authentication.
+	tlsConfig, err = tlsServerConfig(&config.APIConfig{CertFile: certFile, KeyFile: keyFile})
+	if assert.Nil(t, err) && assert.NotNil(t, tlsConfig) {
+		assert.Equal(t, tls.NoClientCert, tlsConfig.ClientAuth)
+		assert.Nil(t, tlsConfig.ClientCAs)
+	}
+
+	// Invalid configurations.
+	for _, cfg := range []config.APIConfig{
+		{CAFile: caFile},
+		{CertFile: certFile},
+		{CertFile: certFile, KeyFile: keyFile, CAFile: garbageFile},
+		{CertFile: certFile, KeyFile: keyFile, CAFile: filepath.Join(dir, "missing")},
+	} {
+		cfg := cfg
+		_, err := tlsServerConfig(&cfg)
+		assert.NotNil(t, err, "%+v", cfg)
+	}
+
+	// Client certificate authentication.
+	tlsConfig, err = tlsServerConfig(&config.APIConfig{CertFile: certFile, KeyFile: keyFile, CAFile: caFile})
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Equal(t, tls.RequireAndVerifyClientCert, tlsConfig.ClientAuth)
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(context.ClientCommonName(r)))
+	}))
+	srv.TLS = tlsConfig
+	srv.StartTLS()
+	defer srv.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	newClient := func(certs ...tls.Certificate) *http.Client {
+		return &http.Client{Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{RootCAs: roots, Certificates: certs},
+		}}
+	}
+
+	// Without a client certificate, the handshake fails.
+	_, err = newClient().Get(srv.URL)
+	assert.NotNil(t, err)
+
+	// With a client certificate signed by an unknown CA, the handshake fails too.
+	rogue := newTestCertificate(t, "clair-rogue-ca", nil)
+	_, err = newClient(newTestCertificate(t, "clair-rogue", rogue).tlsCertificate()).Get(srv.URL)
+	assert.NotNil(t, err)
+
+	// With a valid client certificate, the handler sees the client's Common Name.
+	resp, err := newClient(newTestCertificate(t, "clair-client", ca).tlsCertificate()).Get(srv.URL)
+	if assert.Nil(t, err) {
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "clair-client", string(body))
+	}
+}
+
+func startServerForTest(t *testing.T, server *http.Server, gracePeriod time.Duration) (string, *utils.Stopper) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+
+	st := utils.NewStopper()
+	st.Begin()
+	go func() {
+		defer st.End()
+		srv := &graceful.Server{NoSignalHandling: true, Server: server}
+		serveWithStopper(srv, listener, st, gracePeriod, nil)
+	}()
+
+	return listener.Addr().String(), st
+}
+
+func TestServeWithStopperDrainsRequests(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	addr, st := startServerForTest(t, &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		w.Write([]byte("done"))
+	})}, time.Minute)
+
+	responses := make(chan *http.Response, 1)
+	go func() {
+		resp, err := http.Get("http://" + addr)
+		assert.Nil(t, err)
+		responses <- resp
+	}()
+	<-started
+
+	stopped := make(chan struct{})
+	go func() {
+		st.Stop()
+		close(stopped)
+	}()
+
+	// New connections are refused as soon as the shutdown begins.
+	refused := false
+	for i := 0; i < 100 && !refused; i++ {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			refused = true
+			break
+		}
+		conn.Close()
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.True(t, refused)
+
+	// The in-flight request is still being served.
+	select {
+	case <-stopped:
+		t.Fatal("the server stopped before its in-flight request finished")
+	default:
+	}
+
+	close(release)
+	if resp := <-responses; assert.NotNil(t, resp) {
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "done", string(body))
+	}
+
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the server did not stop once its in-flight request finished")
+	}
+}
+
+func TestServeWithStopperAbortsRequestsAfterGracePeriod(t *testing.T) {
+	started, aborted := make(chan struct{}), make(chan struct{})
+	addr, st := startServerForTest(t, &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-r.Context().Done()
+		close(aborted)
+	})}, 50*time.Millisecond)
+
+	errs := make(chan error, 1)
+	go func() {
+		_, err := http.Get("http://" + addr)
+		errs <- err
+	}()
+	<-started
+
+	st.Stop()
+	assert.NotNil(t, <-errs)
+
+	select {
+	case <-aborted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the context of the in-flight request was not canceled")
+	}
+}
+
+func TestReadTimeoutClosesStalledConnections(t *testing.T) {
+	cfg := &config.APIConfig{Timeout: time.Minute, ReadTimeout: 100 * time.Millisecond}
+	addr, st := startServerForTest(t, newHTTPServer(cfg, http.NotFoundHandler()), time.Second)
+	defer st.Stop()
+
+	conn, err := net.Dial("tcp", addr)
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer conn.Close()
+
+	// Send an incomplete request and stall.
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: clair\r\n"))
+	assert.Nil(t, err)
+
+	// The server closes the connection once the read timeout expires.
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	start := time.Now()
+	_, err = ioutil.ReadAll(conn)
+	assert.Nil(t, err)
+	assert.True(t, time.Since(start) < 5*time.Second)
+}
+
+func TestValidateServerTimeouts(t *testing.T) {
+	assert.Nil(t, validateServerTimeouts(&config.APIConfig{Timeout: time.Minute}))
+	assert.Nil(t, validateServerTimeouts(&config.APIConfig{Timeout: time.Minute, WriteTimeout: 2 * time.Minute}))
+	assert.NotNil(t, validateServerTimeouts(&config.APIConfig{Timeout: time.Minute, WriteTimeout: time.Minute}))
+}
+
+func TestValidateLocalPaths(t *testing.T) {
+	assert.Nil(t, validateLocalPaths(&config.APIConfig{}))
+	assert.Nil(t, validateLocalPaths(&config.APIConfig{LocalPathsAllowed: true, LocalPathPrefixes: []string{"/srv/layers"}}))
+	assert.NotNil(t, validateLocalPaths(&config.APIConfig{LocalPathsAllowed: true}))
+	assert.NotNil(t, validateLocalPaths(&config.APIConfig{LocalPathsAllowed: true, LocalPathPrefixes: []string{"layers"}}))
+}
+
+func TestRouteIsolation(t *testing.T) {
+	cfg := &config.APIConfig{Timeout: time.Minute}
+	ctx := &context.RouteContext{Store: newHealthDatastore(nil, time.Now()), Config: cfg}
+
+	apiAddr, apiSt := startServerForTest(t, newHTTPServer(cfg, newAPIHandler(ctx)), time.Second)
+	defer apiSt.Stop()
+	healthAddr, healthSt := startServerForTest(t, newHTTPServer(cfg, newHealthHandler(ctx, nil)), time.Second)
+	defer healthSt.Stop()
+
+	for _, test := range []struct {
+		addr, path string
+		status     int
+	}{
+		{apiAddr, "/", http.StatusOK},
+		{apiAddr, "/health", http.StatusNotFound},
+		{healthAddr, "/health", http.StatusOK},
+		{healthAddr, "/metrics", http.StatusOK},
+		{healthAddr, "/", http.StatusNotFound},
+		{healthAddr, "/v1/namespaces", http.StatusNotFound},
+		{healthAddr, "/debug/pprof/", http.StatusNotFound},
+	} {
+		resp, err := http.Get("http://" + test.addr + test.path)
+		if assert.Nil(t, err) {
+			resp.Body.Close()
+			assert.Equal(t, test.status, resp.StatusCode, "%s on %s", test.path, test.addr)
+		}
+	}
+}
+
+func TestProfiling(t *testing.T) {
+	cfg := &config.APIConfig{Timeout: time.Minute, Profiling: true}
+	ctx := &context.RouteContext{Store: newHealthDatastore(nil, time.Now()), Config: cfg}
+
+	apiAddr, apiSt := startServerForTest(t, newHTTPServer(cfg, newAPIHandler(ctx)), time.Second)
+	defer apiSt.Stop()
+	healthAddr, healthSt := startServerForTest(t, newHTTPServer(cfg, newHealthHandler(ctx, nil)), time.Second)
+	defer healthSt.Stop()
+
+	for _, test := range []struct {
+		addr, path string
+		status     int
+	}{
+		{healthAddr, "/debug/pprof/", http.StatusOK},
+		{healthAddr, "/debug/pprof/heap", http.StatusOK},
+		{healthAddr, "/debug/pprof/cmdline", http.StatusOK},
+		{healthAddr, "/health", http.StatusOK},
+		{apiAddr, "/debug/pprof/", http.StatusNotFound},
+		{apiAddr, "/debug/pprof/heap", http.StatusNotFound},
+	} {
+		resp, err := http.Get("http://" + test.addr + test.path)
+		if assert.Nil(t, err) {
+			resp.Body.Close()
+			assert.Equal(t, test.status, resp.StatusCode, "%s on %s", test.path, test.addr)
+		}
+	}
+}
+
+func TestServerAddr(t *testing.T) {
+	assert.Equal(t, ":6060", serverAddr("", 6060))
+	assert.Equal(t, "10.0.0.1:6061", serverAddr("10.0.0.1", 6061))
+	assert.Equal(t, "[::1]:6061", serverAddr("::1", 6061))
+}
@@ -0,0 +1,129 @@
+// Copyright 2015 clair authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package context
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// RequestIDHeader is the header in which the ID of a request is received and echoed.
+const RequestIDHeader = "X-Request-Id"
+
+// maxRequestIDLength is the length above which an incoming request ID is replaced.
+const maxRequestIDLength = 128
+
+// accessLogFormats maps the values of the accesslogformat setting to the functions that format
+// the access log lines. The empty value selects the text format.
+var accessLogFormats = map[string]func(*accessLogEntry) string{
+	"":     formatAccessLogText,
+	"text": formatAccessLogText,
+	"json": formatAccessLogJSON,
+}
+
+// accessLogEntry describes an API request once it has been handled.
+type accessLogEntry struct {
+	RequestID    string        `json:"request_id"`
+	Method       string        `json:"method"`
+	URI          string        `json:"uri"`
+	Route        string        `json:"route"`
+	Handler      string        `json:"handler"`
+	Status       int           `json:"status"`
+	Duration     time.Duration `json:"-"`
+	RemoteAddr   string        `json:"remote_addr"`
+	ClientCN     string        `json:"client_cn,omitempty"`
+	BytesWritten int           `json:"bytes_written"`
+}
+
+// ValidateAccessLogFormat returns an error if format is not a supported access log format.
+func ValidateAccessLogFormat(format string) error {
+	if _, ok := accessLogFormats[format]; ok {
+		return nil
+	}
+
+	var formats []string
+	for name := range accessLogFormats {
+		if name != "" {
+			formats = append(formats, name)
+		}
+	}
+	sort.Strings(formats)
+	return fmt.Errorf("unknown access log format %q, supported formats are: %s", format, strings.Join(formats, ", "))
+}
+
+func logAccess(format string, entry *accessLogEntry) {
+	formatter, ok := accessLogFormats[format]
+	if !ok {
+		formatter = formatAccessLogText
+	}
+	log.Info(formatter(entry))
+}
+
+func formatAccessLogText(entry *accessLogEntry) string {
+	client := entry.RemoteAddr
+	if entry.ClientCN != "" {
+		client += " (" + entry.ClientCN + ")"
+	}
+	return fmt.Sprintf("%s \"%s %s\" %s %dB (%s) route=%s request_id=%s", client, entry.Method, entry.URI,
+		statusLabel(entry.Status), entry.BytesWritten, entry.Duration, entry.Route, entry.RequestID)
+}
+
+func formatAccessLogJSON(entry *accessLogEntry) string {
+	line, _ := json.Marshal(struct {
+		*accessLogEntry
+		DurationMilliseconds float64 `json:"duration_ms"`
+	}{entry, float64(entry.Duration.Nanoseconds()) / float64(time.Millisecond)})
+	return string(line)
+}
+
+// validRequestID returns whether an incoming request ID can be trusted to be logged as is.
+func validRequestID(requestID string) bool {
+	if requestID == "" || len(requestID) > maxRequestIDLength {
+		return false
+	}
+	for _, c := range requestID {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("-_.:", c)) {
+			return false
+		}
+	}
+	return true
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		// The ID only serves to correlate logs: a time-based one is good enough.
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
+
+// countingResponseWriter counts the bytes of the response body.
+type countingResponseWriter struct {
+	http.ResponseWriter
+	written int
+}
+
+func (w *countingResponseWriter) Write(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+	w.written += n
+	return n, err
+}
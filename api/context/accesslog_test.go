@@ -0,0 +1,128 @@
+// Copyright 2015 clair authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package context
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/coreos/pkg/capnslog"
+	"github.com/julienschmidt/httprouter"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/coreos/clair/config"
+)
+
+// captureLogs returns the lines logged while calling f.
+func captureLogs(f func()) []string {
+	var buf bytes.Buffer
+	capnslog.SetFormatter(capnslog.NewStringFormatter(&buf))
+	defer capnslog.SetFormatter(capnslog.NewDefaultFormatter(os.Stderr))
+
+	f()
+	return strings.Split(strings.TrimSpace(buf.String()), "\n")
+}
+
+func newAccessLogRouter(format string, requestIDs *[]string) *httprouter.Router {
+	stub := func(w http.ResponseWriter, r *http.Request, p httprouter.Params, ctx *RouteContext) (string, int) {
+		*requestIDs = append(*requestIDs, RequestID(r))
+		w.Write([]byte("hello"))
+		return "test/stub", http.StatusOK
+	}
+
+	router := httprouter.New()
+	ctx := &RouteContext{Config: &config.APIConfig{AccessLogFormat: format}}
+	router.GET("/stubs/:name", HTTPHandler(Instrument("/stubs/:name", stub), ctx))
+	return router
+}
+
+func TestRequestID(t *testing.T) {
+	var requestIDs []string
+	router := newAccessLogRouter("", &requestIDs)
+
+	for _, test := range []struct {
+		incoming string
+		echoed   bool
+	}{
+		{"", false},
+		{"3f1e-49ab.client:7", true},
+		{"not a valid id", false},
+		{strings.Repeat("a", maxRequestIDLength+1), false},
+	} {
+		req := httptest.NewRequest("GET", "/stubs/name", nil)
+		if test.incoming != "" {
+			req.Header.Set(RequestIDHeader, test.incoming)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		requestID := w.Header().Get(RequestIDHeader)
+		assert.NotEmpty(t, requestID, test.incoming)
+		assert.Equal(t, test.echoed, requestID == test.incoming, test.incoming)
+		if assert.NotEmpty(t, requestIDs, test.incoming) {
+			assert.Equal(t, requestID, requestIDs[len(requestIDs)-1], test.incoming)
+		}
+	}
+
+	// Generated IDs are unique.
+	assert.NotEqual(t, requestIDs[0], requestIDs[2])
+}
+
+func TestAccessLog(t *testing.T) {
+	var requestIDs []string
+
+	serve := func(format string) []string {
+		return captureLogs(func() {
+			req := httptest.NewRequest("GET", "/stubs/first", nil)
+			req.Header.Set(RequestIDHeader, "request-"+format)
+			newAccessLogRouter(format, &requestIDs).ServeHTTP(httptest.NewRecorder(), req)
+		})
+	}
+
+	lines := serve("text")
+	if assert.Len(t, lines, 1) {
+		assert.Contains(t, lines[0], `"GET /stubs/first" 200 5B`)
+		assert.Contains(t, lines[0], "route=/stubs/:name")
+		assert.Contains(t, lines[0], "request_id=request-text")
+	}
+
+	lines = serve("json")
+	if assert.Len(t, lines, 1) {
+		var entry map[string]interface{}
+		line := lines[0][strings.Index(lines[0], "{"):]
+		if assert.Nil(t, json.Unmarshal([]byte(line), &entry), line) {
+			assert.Equal(t, "/stubs/:name", entry["route"])
+			assert.Equal(t, "/stubs/first", entry["uri"])
+			assert.Equal(t, "GET", entry["method"])
+			assert.Equal(t, float64(200), entry["status"])
+			assert.Equal(t, float64(5), entry["bytes_written"])
+			assert.Equal(t, "request-json", entry["request_id"])
+			assert.Contains(t, entry, "duration_ms")
+			assert.Contains(t, entry, "remote_addr")
+		}
+	}
+}
+
+func TestValidateAccessLogFormat(t *testing.T) {
+	assert.Nil(t, ValidateAccessLogFormat(""))
+	assert.Nil(t, ValidateAccessLogFormat("text"))
+	assert.Nil(t, ValidateAccessLogFormat("json"))
+	assert.NotNil(t, ValidateAccessLogFormat("xml"))
+}
@@ -35,27 +35,98 @@ var (
 		Name:    "clair_api_response_duration_milliseconds",
 		Help:    "The duration of time it takes to receieve and write a response to an API request",
 		Buckets: prometheus.ExponentialBuckets(9.375, 2, 10),
-	}, []string{"route", "code"})
+	}, []string{"route", "method", "code"})
+
+	promRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "clair_api_requests_total",
+		Help: "Number of API requests that have been handled",
+	}, []string{"route", "method", "code"})
+
+	promRequestsInFlight = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "clair_api_requests_in_flight",
+		Help: "Number of API requests that are currently being handled",
+	})
 )
 
 func init() {
 	prometheus.MustRegister(promResponseDurationMilliseconds)
+	prometheus.MustRegister(promRequestsTotal)
+	prometheus.MustRegister(promRequestsInFlight)
 }
 
 type Handler func(http.ResponseWriter, *http.Request, httprouter.Params, *RouteContext) (route string, status int)
 
+// HTTPHandler adapts a Handler to httprouter. The request's context identifies the API as the
+// source of the database changes and carries the request ID, which is echoed in the response.
 func HTTPHandler(handler Handler, ctx *RouteContext) httprouter.Handle {
 	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		requestID := r.Header.Get(RequestIDHeader)
+		if !validRequestID(requestID) {
+			requestID = newRequestID()
+		}
+		w.Header().Set(RequestIDHeader, requestID)
+
+		r = r.WithContext(utils.ContextWithRequestID(database.ContextWithSource(r.Context(), "api"), requestID))
+		handler(w, r, p, ctx)
+	}
+}
+
+// RequestID returns the ID of the given request, as set by HTTPHandler.
+func RequestID(r *http.Request) string {
+	return utils.RequestIDFromContext(r.Context())
+}
+
+// Instrument wraps a Handler so that its requests are counted, timed and logged, labeled by the
+// pattern the handler is registered on, the method and the status it returned. The pattern is used
+// rather than the requested path to keep the number of series bounded.
+func Instrument(pattern string, handler Handler) Handler {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params, ctx *RouteContext) (string, int) {
 		start := time.Now()
-		route, status := handler(w, r, p, ctx)
-		statusStr := strconv.Itoa(status)
-		if status == 0 {
-			statusStr = "???"
+		promRequestsInFlight.Inc()
+		defer promRequestsInFlight.Dec()
+
+		cw := &countingResponseWriter{ResponseWriter: w}
+		route, status := handler(cw, r, p, ctx)
+
+		code := statusLabel(status)
+		utils.PrometheusObserveTimeMilliseconds(promResponseDurationMilliseconds.WithLabelValues(pattern, r.Method, code), start)
+		promRequestsTotal.WithLabelValues(pattern, r.Method, code).Inc()
+
+		var format string
+		if ctx.Config != nil {
+			format = ctx.Config.AccessLogFormat
 		}
-		utils.PrometheusObserveTimeMilliseconds(promResponseDurationMilliseconds.WithLabelValues(route, statusStr), start)
+		logAccess(format, &accessLogEntry{
+			RequestID:    RequestID(r),
+			Method:       r.Method,
+			URI:          r.RequestURI,
+			Route:        pattern,
+			Handler:      route,
+			Status:       status,
+			Duration:     time.Since(start),
+			RemoteAddr:   r.RemoteAddr,
+			ClientCN:     ClientCommonName(r),
+			BytesWritten: cw.written,
+		})
+
+		return route, status
+	}
+}
+
+func statusLabel(status int) string {
+	if status == 0 {
+		return "???"
+	}
+	return strconv.Itoa(status)
+}
 
-		log.Infof("%s \"%s %s\" %s (%s)", r.RemoteAddr, r.Method, r.RequestURI, statusStr, time.Since(start))
+// ClientCommonName returns the Common Name of the certificate that the client authenticated
+// with, or an empty string if it did not present any.
+func ClientCommonName(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return ""
 	}
+	return r.TLS.PeerCertificates[0].Subject.CommonName
 }
 
 type RouteContext struct {
@@ -0,0 +1,62 @@
+// Copyright 2015 clair authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package context
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+)
+
+func readMetric(t *testing.T, m prometheus.Metric) *dto.Metric {
+	var metric dto.Metric
+	if err := m.Write(&metric); err != nil {
+		t.Fatal(err)
+	}
+	return &metric
+}
+
+func TestInstrument(t *testing.T) {
+	var inFlight float64
+	stub := func(w http.ResponseWriter, r *http.Request, p httprouter.Params, ctx *RouteContext) (string, int) {
+		inFlight = readMetric(t, promRequestsInFlight).GetGauge().GetValue()
+		w.WriteHeader(http.StatusTeapot)
+		return "test/stub", http.StatusTeapot
+	}
+
+	router := httprouter.New()
+	router.POST("/stubs/:name", HTTPHandler(Instrument("/stubs/:name", stub), &RouteContext{}))
+
+	for _, name := range []string{"first", "second"} {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("POST", "/stubs/"+name, nil))
+		assert.Equal(t, http.StatusTeapot, w.Code)
+	}
+
+	// Both requests are reported under the pattern of the route, not under the requested paths.
+	counter := readMetric(t, promRequestsTotal.WithLabelValues("/stubs/:name", "POST", "418"))
+	assert.Equal(t, float64(2), counter.GetCounter().GetValue())
+
+	histogram := readMetric(t, promResponseDurationMilliseconds.WithLabelValues("/stubs/:name", "POST", "418"))
+	assert.Equal(t, uint64(2), histogram.GetHistogram().GetSampleCount())
+
+	assert.Equal(t, float64(1), inFlight)
+	assert.Equal(t, float64(0), readMetric(t, promRequestsInFlight).GetGauge().GetValue())
+}
@@ -0,0 +1,119 @@
+// Copyright 2015 clair authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	stdcontext "context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+
+	"github.com/coreos/clair/api/context"
+	"github.com/coreos/clair/updater"
+)
+
+// healthCheckTimeout is the maximum amount of time the database has to answer a health check.
+const healthCheckTimeout = 5 * time.Second
+
+const (
+	healthStatusOK        = "ok"
+	healthStatusUnhealthy = "unhealthy"
+	healthStatusDegraded  = "degraded"
+	healthStatusStopping  = "stopping"
+)
+
+// healthResponse is the body of the health endpoint.
+type healthResponse struct {
+	Status string `json:"Status"`
+
+	// Failing names the dependency that makes Clair unhealthy or degraded, along with the reason.
+	Failing string `json:"Failing,omitempty"`
+	Error   string `json:"Error,omitempty"`
+
+	// LastVulnerabilityUpdate is the time of the last successful update of the vulnerability
+	// database, if any.
+	LastVulnerabilityUpdate *time.Time `json:"LastVulnerabilityUpdate,omitempty"`
+}
+
+func getHealth(w http.ResponseWriter, r *http.Request, p httprouter.Params, ctx *context.RouteContext) (string, int) {
+	checkCtx, cancel := stdcontext.WithTimeout(r.Context(), healthCheckTimeout)
+	defer cancel()
+
+	if err := ctx.Store.Ping(checkCtx); err != nil {
+		log.Warningf("health check failed: database is unreachable: %s", err)
+		return writeHealth(w, http.StatusServiceUnavailable, healthResponse{
+			Status:  healthStatusUnhealthy,
+			Failing: "database",
+			Error:   err.Error(),
+		})
+	}
+
+	lastUpdate, err := updater.LastUpdate(checkCtx, ctx.Store)
+	if err != nil {
+		log.Warningf("health check failed: could not get the last vulnerability update: %s", err)
+		return writeHealth(w, http.StatusServiceUnavailable, healthResponse{
+			Status:  healthStatusUnhealthy,
+			Failing: "database",
+			Error:   err.Error(),
+		})
+	}
+
+	resp := healthResponse{Status: healthStatusOK}
+	if !lastUpdate.IsZero() {
+		resp.LastVulnerabilityUpdate = &lastUpdate
+	}
+
+	// Stale vulnerability data makes Clair degraded, if the configuration asks for it.
+	if ctx.Config != nil && ctx.Config.HealthMaxUpdateAge > 0 && time.Since(lastUpdate) > ctx.Config.HealthMaxUpdateAge {
+		resp.Status = healthStatusDegraded
+		resp.Failing = "updater"
+		resp.Error = fmt.Sprintf("the vulnerability database has not been updated for more than %s", ctx.Config.HealthMaxUpdateAge)
+		return writeHealth(w, http.StatusServiceUnavailable, resp)
+	}
+
+	return writeHealth(w, http.StatusOK, resp)
+}
+
+// drainingHealth reports Clair as stopping once draining is closed, without checking its
+// dependencies, and defers to handler until then.
+func drainingHealth(draining <-chan struct{}, handler context.Handler) context.Handler {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params, ctx *context.RouteContext) (string, int) {
+		select {
+		case <-draining:
+			return writeHealth(w, http.StatusServiceUnavailable, healthResponse{
+				Status: healthStatusStopping,
+				Error:  "Clair is shutting down",
+			})
+		default:
+			return handler(w, r, p, ctx)
+		}
+	}
+}
+
+func writeHealth(w http.ResponseWriter, status int, resp healthResponse) (string, int) {
+	header := w.Header()
+	header.Set("Content-Type", "application/json;charset=utf-8")
+	header.Set("Server", "clair")
+
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Warningf("failed to write health response: %s", err)
+	}
+
+	return "health", status
+}
@@ -0,0 +1,140 @@
+// Copyright 2015 clair authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	stdcontext "context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/coreos/clair/api/context"
+	"github.com/coreos/clair/config"
+	"github.com/coreos/clair/database"
+	cerrors "github.com/coreos/clair/utils/errors"
+)
+
+func getHealthForTest(t *testing.T, store database.Datastore, maxUpdateAge time.Duration) (int, healthResponse) {
+	ctx := &context.RouteContext{
+		Store:  store,
+		Config: &config.APIConfig{HealthMaxUpdateAge: maxUpdateAge},
+	}
+
+	w := httptest.NewRecorder()
+	newHealthHandler(ctx, nil).ServeHTTP(w, httptest.NewRequest("GET", "/health", nil))
+
+	var resp healthResponse
+	assert.Nil(t, json.NewDecoder(w.Body).Decode(&resp))
+	return w.Code, resp
+}
+
+func newHealthDatastore(pingErr error, lastUpdate time.Time) *database.MockDatastore {
+	return &database.MockDatastore{
+		FctPing: func(ctx stdcontext.Context) error {
+			return pingErr
+		},
+		FctGetKeyValue: func(ctx stdcontext.Context, key string) (string, error) {
+			if lastUpdate.IsZero() {
+				return "", cerrors.ErrNotFound
+			}
+			return strconv.FormatInt(lastUpdate.Unix(), 10), nil
+		},
+	}
+}
+
+func TestHealthy(t *testing.T) {
+	lastUpdate := time.Now().Add(-time.Minute).Truncate(time.Second).UTC()
+
+	status, resp := getHealthForTest(t, newHealthDatastore(nil, lastUpdate), time.Hour)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, healthStatusOK, resp.Status)
+	assert.Empty(t, resp.Failing)
+	if assert.NotNil(t, resp.LastVulnerabilityUpdate) {
+		assert.True(t, lastUpdate.Equal(*resp.LastVulnerabilityUpdate))
+	}
+
+	// The age of the vulnerability data is not checked by default.
+	status, resp = getHealthForTest(t, newHealthDatastore(nil, time.Time{}), 0)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Nil(t, resp.LastVulnerabilityUpdate)
+}
+
+func TestHealthDatabaseDown(t *testing.T) {
+	status, resp := getHealthForTest(t, newHealthDatastore(sql.ErrConnDone, time.Now()), 0)
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+	assert.Equal(t, healthStatusUnhealthy, resp.Status)
+	assert.Equal(t, "database", resp.Failing)
+	assert.Equal(t, sql.ErrConnDone.Error(), resp.Error)
+}
+
+func TestHealthStaleUpdater(t *testing.T) {
+	status, resp := getHealthForTest(t, newHealthDatastore(nil, time.Now().Add(-2*time.Hour)), time.Hour)
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+	assert.Equal(t, healthStatusDegraded, resp.Status)
+	assert.Equal(t, "updater", resp.Failing)
+	assert.NotNil(t, resp.LastVulnerabilityUpdate)
+
+	// A vulnerability database that has never been updated is stale as well.
+	status, resp = getHealthForTest(t, newHealthDatastore(nil, time.Time{}), time.Hour)
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+	assert.Equal(t, healthStatusDegraded, resp.Status)
+}
+
+func TestHealthServesMetrics(t *testing.T) {
+	w := httptest.NewRecorder()
+	newHealthHandler(&context.RouteContext{}, nil).ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "go_goroutines")
+}
+
+func TestHealthIgnoresBearerTokens(t *testing.T) {
+	ctx := &context.RouteContext{
+		Store:  newHealthDatastore(nil, time.Now()),
+		Config: &config.APIConfig{BearerTokens: []string{"token"}},
+	}
+
+	w := httptest.NewRecorder()
+	newHealthHandler(ctx, nil).ServeHTTP(w, httptest.NewRequest("GET", "/health", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestHealthStopping(t *testing.T) {
+	draining := make(chan struct{})
+	ctx := &context.RouteContext{
+		Store:  newHealthDatastore(nil, time.Now()),
+		Config: &config.APIConfig{},
+	}
+	handler := newHealthHandler(ctx, draining)
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/health", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	close(draining)
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/health", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+
+	var resp healthResponse
+	assert.Nil(t, json.NewDecoder(w.Body).Decode(&resp))
+	assert.Equal(t, healthStatusStopping, resp.Status)
+}
@@ -15,62 +15,156 @@
 package api
 
 import (
+	"encoding/json"
+	"fmt"
 	"net/http"
+	"net/http/pprof"
+	"sort"
 	"strings"
+	"sync"
 
 	"github.com/julienschmidt/httprouter"
+	"github.com/prometheus/client_golang/prometheus"
 
 	"github.com/coreos/clair/api/context"
 	"github.com/coreos/clair/api/v1"
 )
 
+// VersionFactory creates the HTTP router that serves a version of the API.
+type VersionFactory func(*context.RouteContext) *httprouter.Router
+
+var (
+	versionsLock sync.Mutex
+	versions     = make(map[string]VersionFactory)
+)
+
+func init() {
+	RegisterVersion("v1", v1.NewRouter)
+}
+
+// RegisterVersion makes a version of the API available under /name.
+//
+// If RegisterVersion is called twice with the same name, if the factory is nil, or if the name is
+// blank or contains a slash, it panics.
+func RegisterVersion(name string, factory VersionFactory) {
+	if name == "" || strings.Contains(name, "/") {
+		panic(fmt.Sprintf("Could not register an API version with the invalid name '%s'", name))
+	}
+	if factory == nil {
+		panic("Could not register a nil API version factory")
+	}
+
+	versionsLock.Lock()
+	defer versionsLock.Unlock()
+
+	if _, alreadyExists := versions[name]; alreadyExists {
+		panic(fmt.Sprintf("API version '%s' is already registered", name))
+	}
+	versions[name] = factory
+}
+
 // router is an HTTP router that forwards requests to the appropriate sub-router
 // depending on the API version specified in the request URI.
 type router map[string]*httprouter.Router
 
-// Let's hope we never have more than 99 API versions.
-const apiVersionLength = len("v99")
+// versionsResponse is the response of the discovery endpoint.
+type versionsResponse struct {
+	Versions []string
+}
 
 func newAPIHandler(ctx *context.RouteContext) http.Handler {
+	versionsLock.Lock()
+	defer versionsLock.Unlock()
+
 	router := make(router)
-	router["/v1"] = v1.NewRouter(ctx)
+	for name, factory := range versions {
+		router[name] = factory(ctx)
+	}
 	return router
 }
 
 func (rtr router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	urlStr := r.URL.String()
-	var version string
-	if len(urlStr) >= apiVersionLength {
-		version = urlStr[:apiVersionLength]
-	}
+	// The version is the first segment of the path, e.g. "v1" in "/v1/layers". Only the path is
+	// inspected, so that the host and the query of the request don't matter.
+	segments := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
 
-	if router, _ := rtr[version]; router != nil {
-		// Remove the version number from the request path to let the router do its
-		// job but do not update the RequestURI
-		r.URL.Path = strings.Replace(r.URL.Path, version, "", 1)
+	if router, _ := rtr[segments[0]]; router != nil {
+		// Remove the version from the request path to let the router do its job but do not update
+		// the RequestURI. Both "/v1" and "/v1/" become "/".
+		r.URL.Path = "/"
+		if len(segments) == 2 {
+			r.URL.Path += segments[1]
+		}
+		r.URL.RawPath = ""
 		router.ServeHTTP(w, r)
 		return
 	}
 
-	log.Infof("%s %d %s %s", http.StatusNotFound, r.Method, r.RequestURI, r.RemoteAddr)
-	http.NotFound(w, r)
+	// The root lists the available versions.
+	if r.URL.Path == "/" {
+		if r.Method != "GET" {
+			writeRouterResponse(w, r, http.StatusMethodNotAllowed, v1.ErrorEnvelope{Error: &v1.Error{Message: r.Method + " is not allowed on /"}})
+			return
+		}
+		writeRouterResponse(w, r, http.StatusOK, versionsResponse{Versions: rtr.versions()})
+		return
+	}
+
+	writeRouterResponse(w, r, http.StatusNotFound, v1.ErrorEnvelope{Error: &v1.Error{
+		Message: "unknown API version, supported versions are: " + strings.Join(rtr.versions(), ", "),
+	}})
 }
 
-func newHealthHandler(ctx *context.RouteContext) http.Handler {
-	router := httprouter.New()
-	router.GET("/health", context.HTTPHandler(getHealth, ctx))
-	return router
+// versions returns the sorted names of the versions that the router serves.
+func (rtr router) versions() []string {
+	versions := make([]string, 0, len(rtr))
+	for version := range rtr {
+		versions = append(versions, version)
+	}
+	sort.Strings(versions)
+	return versions
+}
+
+func writeRouterResponse(w http.ResponseWriter, r *http.Request, status int, resp interface{}) {
+	log.Infof("%d %s %s %s", status, r.Method, r.RequestURI, r.RemoteAddr)
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	w.Header().Set("Server", "clair")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resp)
 }
 
-func getHealth(w http.ResponseWriter, r *http.Request, p httprouter.Params, ctx *context.RouteContext) (string, int) {
-	header := w.Header()
-	header.Set("Server", "clair")
+func newHealthHandler(ctx *context.RouteContext, draining <-chan struct{}) http.Handler {
+	router := httprouter.New()
+	router.GET("/health", context.HTTPHandler(context.Instrument("/health", drainingHealth(draining, getHealth)), ctx))
+
+	// The metrics are also served here, so that they can be scraped without a client certificate.
+	router.Handler("GET", "/metrics", prometheus.Handler())
 
-	status := http.StatusInternalServerError
-	if ctx.Store.Ping() {
-		status = http.StatusOK
+	// So are the profiles, when enabled. They are never served by the main API.
+	if ctx.Config != nil && ctx.Config.Profiling {
+		router.HandlerFunc("GET", "/debug/pprof/*profile", servePprof)
+		router.HandlerFunc("POST", "/debug/pprof/*profile", servePprof)
 	}
+	return router
+}
 
-	w.WriteHeader(status)
-	return "health", status
+// servePprof serves the net/http/pprof handlers under a single wildcard route, as httprouter does
+// not allow the named profiles served by pprof.Index to live next to the other routes.
+func servePprof(w http.ResponseWriter, r *http.Request) {
+	switch strings.TrimPrefix(r.URL.Path, "/debug/pprof/") {
+	case "cmdline":
+		pprof.Cmdline(w, r)
+	case "profile":
+		pprof.Profile(w, r)
+	case "symbol":
+		pprof.Symbol(w, r)
+	case "trace":
+		pprof.Trace(w, r)
+	default:
+		if r.Method != "GET" {
+			http.Error(w, r.Method+" is not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		pprof.Index(w, r)
+	}
 }
@@ -0,0 +1,135 @@
+// Copyright 2015 clair authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	stdcontext "context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/coreos/clair/api/context"
+	"github.com/coreos/clair/api/v1"
+	"github.com/coreos/clair/config"
+	"github.com/coreos/clair/database"
+	cerrors "github.com/coreos/clair/utils/errors"
+	"github.com/coreos/clair/utils/types"
+)
+
+func TestAPIRouter(t *testing.T) {
+	store := &database.MockDatastore{
+		FctFindLayer: func(ctx stdcontext.Context, name string, withFeatures, withVulnerabilities bool, minSeverity types.Priority) (database.Layer, error) {
+			if name != "x" {
+				return database.Layer{}, cerrors.ErrNotFound
+			}
+			return database.Layer{Name: name}, nil
+		},
+		FctGetKeyValue: func(ctx stdcontext.Context, key string) (string, error) {
+			return "", cerrors.ErrNotFound
+		},
+		FctListNamespaces: func(ctx stdcontext.Context) ([]database.Namespace, error) {
+			return nil, nil
+		},
+	}
+	handler := newAPIHandler(&context.RouteContext{Store: store, Config: &config.APIConfig{}})
+
+	for _, test := range []struct {
+		target   string
+		expected int
+		layer    string
+		message  string
+	}{
+		{"/v1/layers/x", http.StatusOK, "x", ""},
+		{"/v1/layers/x?features", http.StatusOK, "x", ""},
+		{"/v1/layers/y", http.StatusNotFound, "", cerrors.ErrNotFound.Error()},
+		// Proxied requests carry an absolute URI.
+		{"http://clair.example.com:6060/v1/layers/x", http.StatusOK, "x", ""},
+		// The version alone reaches the root of the v1 router, with or without a trailing slash.
+		{"/v1", http.StatusOK, "", ""},
+		{"/v1/", http.StatusOK, "", ""},
+		// Unknown versions.
+		{"/v2/anything", http.StatusNotFound, "", "unknown API version, supported versions are: v1"},
+		{"/v10/layers/x", http.StatusNotFound, "", "unknown API version, supported versions are: v1"},
+	} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", test.target, nil))
+
+		assert.Equal(t, test.expected, w.Code, test.target)
+		assert.Equal(t, "application/json;charset=utf-8", w.Header().Get("Content-Type"), test.target)
+
+		var envelope v1.LayerEnvelope
+		if !assert.Nil(t, json.NewDecoder(w.Body).Decode(&envelope), test.target) {
+			continue
+		}
+		if test.layer != "" && assert.NotNil(t, envelope.Layer, test.target) {
+			assert.Equal(t, test.layer, envelope.Layer.Name, test.target)
+		}
+		if test.message != "" && assert.NotNil(t, envelope.Error, test.target) {
+			assert.Equal(t, test.message, envelope.Error.Message, test.target)
+		}
+	}
+}
+
+func TestRegisterVersion(t *testing.T) {
+	RegisterVersion("v9", func(ctx *context.RouteContext) *httprouter.Router {
+		router := httprouter.New()
+		router.GET("/ping", func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+			w.Write([]byte("v9 pong"))
+		})
+		return router
+	})
+	defer func() {
+		versionsLock.Lock()
+		delete(versions, "v9")
+		versionsLock.Unlock()
+	}()
+
+	// Versions can't be registered twice, nor without a name or a factory.
+	assert.Panics(t, func() { RegisterVersion("v9", v1.NewRouter) })
+	assert.Panics(t, func() { RegisterVersion("v1", v1.NewRouter) })
+	assert.Panics(t, func() { RegisterVersion("", v1.NewRouter) })
+	assert.Panics(t, func() { RegisterVersion("v9/beta", v1.NewRouter) })
+	assert.Panics(t, func() { RegisterVersion("v10", nil) })
+
+	handler := newAPIHandler(&context.RouteContext{Store: &database.MockDatastore{}, Config: &config.APIConfig{}})
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/v9/ping", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "v9 pong", w.Body.String())
+
+	// The root lists every version.
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/json;charset=utf-8", w.Header().Get("Content-Type"))
+	var response versionsResponse
+	if assert.Nil(t, json.NewDecoder(w.Body).Decode(&response)) {
+		assert.Equal(t, []string{"v1", "v9"}, response.Versions)
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("POST", "/", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/v2/anything", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Contains(t, w.Body.String(), "supported versions are: v1, v9")
+}
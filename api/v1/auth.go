@@ -0,0 +1,88 @@
+// Copyright 2015 clair authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v1
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/coreos/clair/api/context"
+)
+
+const authenticateRoute = "v1/authenticate"
+
+var promRejectedRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "clair_api_rejected_requests_total",
+	Help: "Number of API requests rejected because of a missing or invalid bearer token.",
+}, []string{"reason"})
+
+func init() {
+	prometheus.MustRegister(promRejectedRequestsTotal)
+}
+
+// requireBearerToken wraps a context.Handler so that it is only called when the request carries
+// one of the configured bearer tokens in its Authorization header.
+//
+// When no token is configured, authentication is disabled and the handler is always called.
+func requireBearerToken(handler context.Handler) context.Handler {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params, ctx *context.RouteContext) (string, int) {
+		if ctx.Config == nil || len(ctx.Config.BearerTokens) == 0 {
+			return handler(w, r, p, ctx)
+		}
+
+		token, ok := bearerToken(r)
+		if !ok {
+			promRejectedRequestsTotal.WithLabelValues("missing").Inc()
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			return authenticateRoute, writeError(w, r, http.StatusUnauthorized, "a bearer token is required")
+		}
+
+		if !validBearerToken(token, ctx.Config.BearerTokens) {
+			promRejectedRequestsTotal.WithLabelValues("invalid").Inc()
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			return authenticateRoute, writeError(w, r, http.StatusUnauthorized, "invalid bearer token")
+		}
+
+		return handler(w, r, p, ctx)
+	}
+}
+
+// bearerToken extracts the token from the request's Authorization header.
+func bearerToken(r *http.Request) (string, bool) {
+	authorization := r.Header.Get("Authorization")
+	if len(authorization) < len("Bearer ") || !strings.EqualFold(authorization[:len("Bearer ")], "Bearer ") {
+		return "", false
+	}
+
+	token := strings.TrimSpace(authorization[len("Bearer "):])
+	return token, token != ""
+}
+
+// validBearerToken compares the token against every configured token in constant time, so that
+// neither the comparison nor the position of the matching token can be timed.
+func validBearerToken(token string, tokens []string) bool {
+	valid := 0
+	for _, t := range tokens {
+		if t == "" {
+			continue
+		}
+		valid |= subtle.ConstantTimeCompare([]byte(token), []byte(t))
+	}
+	return valid == 1
+}
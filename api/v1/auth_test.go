@@ -0,0 +1,91 @@
+// Copyright 2015 clair authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v1
+
+import (
+	stdcontext "context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/coreos/clair/api/context"
+	"github.com/coreos/clair/config"
+	"github.com/coreos/clair/database"
+)
+
+func TestBearerTokenAuthentication(t *testing.T) {
+	store := &database.MockDatastore{
+		FctListNamespaces: func(ctx stdcontext.Context) ([]database.Namespace, error) {
+			return []database.Namespace{{Name: "debian:8"}}, nil
+		},
+	}
+	tokens := []string{"first-token", "second-token"}
+
+	for _, test := range []struct {
+		publicMetrics bool
+		path          string
+		authorization string
+		expected      int
+	}{
+		{false, "/namespaces", "Bearer first-token", http.StatusOK},
+		{false, "/namespaces", "Bearer second-token", http.StatusOK},
+		{false, "/namespaces", "bearer second-token", http.StatusOK},
+		{false, "/namespaces", "Bearer third-token", http.StatusUnauthorized},
+		{false, "/namespaces", "Bearer first-tokenX", http.StatusUnauthorized},
+		{false, "/namespaces", "Basic Zmlyc3QtdG9rZW4=", http.StatusUnauthorized},
+		{false, "/namespaces", "Bearer ", http.StatusUnauthorized},
+		{false, "/namespaces", "", http.StatusUnauthorized},
+		{false, "/metrics", "", http.StatusUnauthorized},
+		{false, "/metrics", "Bearer first-token", http.StatusOK},
+		{true, "/metrics", "", http.StatusOK},
+		{true, "/namespaces", "", http.StatusUnauthorized},
+	} {
+		router := NewRouter(&context.RouteContext{
+			Store:  store,
+			Config: &config.APIConfig{BearerTokens: tokens, PublicMetrics: test.publicMetrics},
+		})
+
+		req := httptest.NewRequest("GET", test.path, nil)
+		if test.authorization != "" {
+			req.Header.Set("Authorization", test.authorization)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, test.expected, w.Code, "%+v", test)
+		if test.expected == http.StatusUnauthorized {
+			assert.NotEmpty(t, w.Header().Get("WWW-Authenticate"), "%+v", test)
+
+			var envelope ErrorEnvelope
+			if assert.Nil(t, json.NewDecoder(w.Body).Decode(&envelope)) && assert.NotNil(t, envelope.Error, "%+v", test) {
+				assert.NotEmpty(t, envelope.Error.Message)
+			}
+		}
+	}
+
+	// Without any configured token, authentication is disabled.
+	w := httptest.NewRecorder()
+	NewRouter(&context.RouteContext{Store: store, Config: &config.APIConfig{}}).ServeHTTP(w, httptest.NewRequest("GET", "/namespaces", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestValidBearerToken(t *testing.T) {
+	assert.True(t, validBearerToken("a", []string{"b", "a"}))
+	assert.False(t, validBearerToken("", []string{"", "a"}))
+	assert.False(t, validBearerToken("ab", []string{"a", "b"}))
+}
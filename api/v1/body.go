@@ -0,0 +1,71 @@
+// Copyright 2015 clair authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v1
+
+import (
+	"bytes"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strconv"
+
+	"github.com/julienschmidt/httprouter"
+
+	"github.com/coreos/clair/api/context"
+)
+
+const (
+	readBodyRoute = "v1/readBody"
+
+	// defaultMaxBodySize and defaultMaxImageBodySize restrict client request bodies, unless
+	// configured otherwise. Images carry a whole chain of layers and are allowed to be larger.
+	defaultMaxBodySize      int64 = 4 << 20
+	defaultMaxImageBodySize int64 = 32 << 20
+)
+
+// requireJSONBody wraps a context.Handler so that it is only called when the request body is
+// JSON and is at most maxSize bytes large. The body is read entirely before calling the handler,
+// so that an oversized body is answered with a 413 instead of failing in the middle of decoding.
+//
+// A request without Content-Type header is assumed to be JSON.
+func requireJSONBody(maxSize int64, handler context.Handler) context.Handler {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params, ctx *context.RouteContext) (string, int) {
+		if contentType := r.Header.Get("Content-Type"); contentType != "" {
+			if mediaType, _, err := mime.ParseMediaType(contentType); err != nil || mediaType != "application/json" {
+				return readBodyRoute, writeError(w, r, http.StatusUnsupportedMediaType, "unsupported content type '"+contentType+"', expected application/json")
+			}
+		}
+
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxSize))
+		r.Body.Close()
+		if err != nil {
+			if _, tooLarge := err.(*http.MaxBytesError); tooLarge {
+				return readBodyRoute, writeError(w, r, http.StatusRequestEntityTooLarge, "the request body exceeds "+strconv.FormatInt(maxSize, 10)+" bytes")
+			}
+			return readBodyRoute, writeError(w, r, http.StatusBadRequest, "failed to read the request body: "+err.Error())
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		return handler(w, r, p, ctx)
+	}
+}
+
+// maxBodySize returns the configured limit, or def if it is not configured.
+func maxBodySize(configured, def int64) int64 {
+	if configured > 0 {
+		return configured
+	}
+	return def
+}
@@ -0,0 +1,68 @@
+// Copyright 2015 clair authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v1
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/coreos/clair/api/context"
+	"github.com/coreos/clair/config"
+	"github.com/coreos/clair/database"
+)
+
+func TestRequireJSONBody(t *testing.T) {
+	router := NewRouter(&context.RouteContext{
+		Store:  &database.MockDatastore{},
+		Config: &config.APIConfig{MaxBodySize: 64, MaxImageBodySize: 256},
+	})
+	padding := strings.Repeat(" ", 100)
+
+	for _, test := range []struct {
+		path, contentType, body string
+		expected                int
+	}{
+		// The requests pass the checks, and fail because they don't describe anything.
+		{"/layers", "", `{}`, http.StatusBadRequest},
+		{"/layers", "application/json", `{}`, http.StatusBadRequest},
+		{"/layers", "application/json; charset=utf-8", `{}`, http.StatusBadRequest},
+		{"/images", "application/json", `{}` + padding, http.StatusBadRequest},
+
+		{"/layers", "text/plain", `{}`, http.StatusUnsupportedMediaType},
+		{"/layers", "application/json;;", `{}`, http.StatusUnsupportedMediaType},
+		{"/namespaces/debian:8/vulnerabilities", "application/x-www-form-urlencoded", `{}`, http.StatusUnsupportedMediaType},
+		{"/layers", "application/json", `{}` + padding, http.StatusRequestEntityTooLarge},
+		{"/images", "application/json", `{}` + padding + padding + padding, http.StatusRequestEntityTooLarge},
+	} {
+		req := httptest.NewRequest("POST", test.path, strings.NewReader(test.body))
+		if test.contentType != "" {
+			req.Header.Set("Content-Type", test.contentType)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, test.expected, w.Code, "%+v", test)
+
+		var resp ErrorEnvelope
+		if assert.Nil(t, json.NewDecoder(w.Body).Decode(&resp)) {
+			assert.NotNil(t, resp.Error)
+		}
+	}
+}
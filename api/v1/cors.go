@@ -0,0 +1,139 @@
+// Copyright 2015 clair authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v1
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+
+	"github.com/coreos/clair/api/context"
+	"github.com/coreos/clair/config"
+	"github.com/coreos/clair/utils"
+)
+
+const (
+	preflightRoute = "v1/preflight"
+
+	// corsAllowedHeaders are the request headers that browsers may send along with cross-origin
+	// requests, and corsExposedHeaders the response headers that they may read.
+	corsAllowedHeaders = "Authorization, Content-Type, If-None-Match, " + context.RequestIDHeader
+	corsExposedHeaders = "ETag, Retry-After, " + context.RequestIDHeader
+
+	// corsMaxAge is how long, in seconds, browsers may cache the result of a preflight request.
+	corsMaxAge = "600"
+)
+
+// corsPolicy decides which cross-origin requests are allowed, as configured by the allowed
+// origins and methods. An origin may contain a wildcard, such as "https://*.example.com", and
+// "*" allows any origin. Every method is allowed when none is configured.
+type corsPolicy struct {
+	origins []string
+	methods map[string]struct{}
+}
+
+// newCORSPolicy returns the CORS policy of the configuration, or nil if no origin is allowed.
+func newCORSPolicy(config *config.APIConfig) *corsPolicy {
+	if config == nil || len(config.CORSAllowedOrigins) == 0 {
+		return nil
+	}
+
+	policy := &corsPolicy{origins: config.CORSAllowedOrigins}
+	if len(config.CORSAllowedMethods) > 0 {
+		policy.methods = make(map[string]struct{}, len(config.CORSAllowedMethods))
+		for _, method := range config.CORSAllowedMethods {
+			policy.methods[strings.ToUpper(method)] = struct{}{}
+		}
+	}
+	return policy
+}
+
+// allowsOrigin returns whether the origin matches one of the allowed origins.
+func (c *corsPolicy) allowsOrigin(origin string) bool {
+	if origin == "" {
+		return false
+	}
+	for _, allowed := range c.origins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+		if i := strings.Index(allowed, "*"); i >= 0 {
+			prefix, suffix := strings.ToLower(allowed[:i]), strings.ToLower(allowed[i+1:])
+			lower := strings.ToLower(origin)
+			if len(lower) > len(prefix)+len(suffix) && strings.HasPrefix(lower, prefix) && strings.HasSuffix(lower, suffix) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// allowsMethod returns whether cross-origin requests may use the method.
+func (c *corsPolicy) allowsMethod(method string) bool {
+	if c.methods == nil {
+		return true
+	}
+	_, allowed := c.methods[method]
+	return allowed
+}
+
+// allowCORS wraps a context.Handler so that its responses to allowed cross-origin requests carry
+// the Access-Control-* headers that let browsers read them. Other requests are served unchanged.
+// A nil policy allows no cross-origin request.
+func allowCORS(policy *corsPolicy, handler context.Handler) context.Handler {
+	if policy == nil {
+		return handler
+	}
+
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params, ctx *context.RouteContext) (string, int) {
+		w.Header().Add("Vary", "Origin")
+		if origin := r.Header.Get("Origin"); policy.allowsOrigin(origin) && policy.allowsMethod(r.Method) {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Set("Access-Control-Expose-Headers", corsExposedHeaders)
+		}
+		return handler(w, r, p, ctx)
+	}
+}
+
+// newPreflightHandler returns the handler of the OPTIONS requests of a route accepting the given
+// methods. It answers preflight requests from allowed origins with the methods they may use,
+// and any other request with the methods of the route only.
+func newPreflightHandler(policy *corsPolicy, methods []string) context.Handler {
+	allow := strings.Join(append(methods, "OPTIONS"), ", ")
+	allowed := make([]string, 0, len(methods))
+	for _, method := range methods {
+		if policy.allowsMethod(method) {
+			allowed = append(allowed, method)
+		}
+	}
+
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params, ctx *context.RouteContext) (string, int) {
+		w.Header().Set("Allow", allow)
+		w.Header().Add("Vary", "Origin")
+
+		origin := r.Header.Get("Origin")
+		requested := r.Header.Get("Access-Control-Request-Method")
+		if len(allowed) > 0 && policy.allowsOrigin(origin) && (requested == "" || utils.Contains(requested, allowed)) {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Set("Access-Control-Allow-Methods", strings.Join(allowed, ", "))
+			w.Header().Set("Access-Control-Allow-Headers", corsAllowedHeaders)
+			w.Header().Set("Access-Control-Max-Age", corsMaxAge)
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+		return preflightRoute, http.StatusNoContent
+	}
+}
@@ -0,0 +1,102 @@
+// Copyright 2015 clair authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v1
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/coreos/clair/api/context"
+	"github.com/coreos/clair/config"
+	"github.com/coreos/clair/database"
+)
+
+func TestCORSPreflight(t *testing.T) {
+	router := NewRouter(&context.RouteContext{
+		Store: &database.MockDatastore{},
+		Config: &config.APIConfig{
+			BearerTokens:       []string{"token"},
+			CORSAllowedOrigins: []string{"https://dashboard.example.com", "https://*.example.org"},
+			CORSAllowedMethods: []string{"GET", "HEAD"},
+		},
+	})
+	preflight := func(path, origin, method string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("OPTIONS", path, nil)
+		r.Header.Set("Origin", origin)
+		r.Header.Set("Access-Control-Request-Method", method)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+
+	// Preflight requests carry no token and never reach the handlers.
+	for _, origin := range []string{"https://dashboard.example.com", "https://ui.example.org"} {
+		w := preflight("/layers/layer", origin, "GET")
+		assert.Equal(t, http.StatusNoContent, w.Code)
+		assert.Equal(t, origin, w.Header().Get("Access-Control-Allow-Origin"))
+		assert.Equal(t, "GET, HEAD", w.Header().Get("Access-Control-Allow-Methods"))
+		assert.Contains(t, w.Header().Get("Access-Control-Allow-Headers"), "Authorization")
+		assert.Equal(t, "GET, HEAD, DELETE, OPTIONS", w.Header().Get("Allow"))
+	}
+
+	// Other origins and methods get no CORS headers, without failing.
+	for _, test := range []struct{ path, origin, method string }{
+		{"/layers/layer", "https://evil.example.com", "GET"},
+		{"/layers/layer", "https://example.org", "GET"},
+		{"/layers/layer", "https://dashboard.example.com", "DELETE"},
+		{"/layers", "https://dashboard.example.com", "POST"},
+	} {
+		w := preflight(test.path, test.origin, test.method)
+		assert.Equal(t, http.StatusNoContent, w.Code, "%v", test)
+		assert.Empty(t, w.Header().Get("Access-Control-Allow-Origin"), "%v", test)
+		assert.Empty(t, w.Header().Get("Access-Control-Allow-Methods"), "%v", test)
+	}
+}
+
+func TestCORSSimpleRequests(t *testing.T) {
+	router := NewRouter(&context.RouteContext{
+		Store:  &database.MockDatastore{},
+		Config: &config.APIConfig{CORSAllowedOrigins: []string{"https://dashboard.example.com"}},
+	})
+	request := func(origin string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/spec", nil)
+		r.Header.Set("Origin", origin)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+
+	w := request("https://dashboard.example.com")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "https://dashboard.example.com", w.Header().Get("Access-Control-Allow-Origin"))
+	assert.Contains(t, w.Header().Get("Access-Control-Expose-Headers"), context.RequestIDHeader)
+	assert.Equal(t, "Origin", w.Header().Get("Vary"))
+
+	w = request("https://evil.example.com")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Empty(t, w.Header().Get("Access-Control-Allow-Origin"))
+
+	// Without allowed origins, CORS is disabled entirely.
+	router = NewRouter(&context.RouteContext{Store: &database.MockDatastore{}, Config: &config.APIConfig{}})
+	r := httptest.NewRequest("OPTIONS", "/spec", nil)
+	r.Header.Set("Origin", "https://dashboard.example.com")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	assert.NotEqual(t, http.StatusNoContent, w.Code)
+	assert.Empty(t, w.Header().Get("Access-Control-Allow-Origin"))
+}
@@ -0,0 +1,68 @@
+// Copyright 2015 clair authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v1
+
+import (
+	stdcontext "context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/coreos/clair/database"
+	"github.com/coreos/clair/updater"
+	"github.com/coreos/clair/utils/types"
+)
+
+// layerETag returns a weak entity tag of the report of a layer, as requested with the given
+// options. It changes when the layer is processed again, when the vulnerability database is
+// updated, and when a vulnerability of one of the namespaces of the layer changes.
+func layerETag(ctx stdcontext.Context, store database.Datastore, layer database.Layer, withFeatures, withVulnerabilities bool, minSeverity types.Priority) (string, error) {
+	lastUpdate, err := updater.LastUpdate(ctx, store)
+	if err != nil {
+		return "", err
+	}
+
+	var namespaceNames []string
+	var lastChange int64
+	for _, namespace := range layer.ListNamespaces() {
+		namespaceNames = append(namespaceNames, namespace.Name)
+		changed, err := store.GetLastVulnerabilityChange(ctx, namespace.Name)
+		if err != nil {
+			return "", err
+		}
+		if changed.UnixNano() > lastChange {
+			lastChange = changed.UnixNano()
+		}
+	}
+
+	hash := sha256.Sum256([]byte(fmt.Sprintf("%d/%d/%s/%s/%d/%d/%t/%t/%s",
+		layer.ID, layer.EngineVersion, strings.Join(layer.ProcessedBy, ","), strings.Join(namespaceNames, ","), lastChange,
+		lastUpdate.Unix(), withFeatures, withVulnerabilities, minSeverity)))
+	return `W/"` + hex.EncodeToString(hash[:16]) + `"`, nil
+}
+
+// etagMatches returns whether the If-None-Match header of the request matches etag, using the
+// weak comparison.
+func etagMatches(r *http.Request, etag string) bool {
+	for _, candidate := range strings.Split(r.Header.Get("If-None-Match"), ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
@@ -22,6 +22,7 @@ import (
 	"time"
 
 	"github.com/coreos/clair/database"
+	"github.com/coreos/clair/updater"
 	"github.com/coreos/clair/utils/types"
 	"github.com/coreos/pkg/capnslog"
 	"github.com/fernet/fernet-go"
@@ -30,17 +31,25 @@ import (
 var log = capnslog.NewPackageLogger("github.com/coreos/clair", "v1")
 
 type Error struct {
-	Message string `json:"Layer`
+	Message string `json:"Message"`
+}
+
+// ErrorEnvelope is the response body of every failed request.
+type ErrorEnvelope struct {
+	Error *Error `json:"Error"`
 }
 
 type Layer struct {
 	Name             string            `json:"Name,omitempty"`
 	NamespaceName    string            `json:"NamespaceName,omitempty"`
+	NamespaceNames   []string          `json:"NamespaceNames,omitempty"`
 	Path             string            `json:"Path,omitempty"`
 	Headers          map[string]string `json:"Headers,omitempty"`
 	ParentName       string            `json:"ParentName,omitempty"`
 	Format           string            `json:"Format,omitempty"`
 	IndexedByVersion int               `json:"IndexedByVersion,omitempty"`
+	ProcessedBy      []string          `json:"ProcessedBy,omitempty"`
+	Stale            bool              `json:"Stale,omitempty"`
 	Features         []Feature         `json:"Features,omitempty"`
 }
 
@@ -48,6 +57,8 @@ func LayerFromDatabaseModel(dbLayer database.Layer, withFeatures, withVulnerabil
 	layer := Layer{
 		Name:             dbLayer.Name,
 		IndexedByVersion: dbLayer.EngineVersion,
+		ProcessedBy:      dbLayer.ProcessedBy,
+		Stale:            dbLayer.Stale,
 	}
 
 	if dbLayer.Parent != nil {
@@ -57,13 +68,16 @@ func LayerFromDatabaseModel(dbLayer database.Layer, withFeatures, withVulnerabil
 	if dbLayer.Namespace != nil {
 		layer.NamespaceName = dbLayer.Namespace.Name
 	}
+	for _, dbNamespace := range dbLayer.ListNamespaces() {
+		layer.NamespaceNames = append(layer.NamespaceNames, dbNamespace.Name)
+	}
 
 	if withFeatures || withVulnerabilities && dbLayer.Features != nil {
 		for _, dbFeatureVersion := range dbLayer.Features {
 			feature := Feature{
 				Name:          dbFeatureVersion.Feature.Name,
 				NamespaceName: dbFeatureVersion.Feature.Namespace.Name,
-				Version:       dbFeatureVersion.Version.String(),
+				Version:       dbFeatureVersion.Version,
 				AddedBy:       dbFeatureVersion.AddedBy.Name,
 			}
 
@@ -73,6 +87,7 @@ func LayerFromDatabaseModel(dbLayer database.Layer, withFeatures, withVulnerabil
 					NamespaceName: dbVuln.Namespace.Name,
 					Description:   dbVuln.Description,
 					Link:          dbVuln.Link,
+					Links:         dbVuln.Links,
 					Severity:      string(dbVuln.Severity),
 					Metadata:      dbVuln.Metadata,
 				}
@@ -90,14 +105,23 @@ func LayerFromDatabaseModel(dbLayer database.Layer, withFeatures, withVulnerabil
 }
 
 type Namespace struct {
-	Name string `json:"Name,omitempty"`
+	Name               string `json:"Name,omitempty"`
+	VersionFormat      string `json:"VersionFormat,omitempty"`
+	VulnerabilityCount *int   `json:"VulnerabilityCount,omitempty"`
 }
 
+type namespacesByName []Namespace
+
+func (n namespacesByName) Len() int           { return len(n) }
+func (n namespacesByName) Swap(i, j int)      { n[i], n[j] = n[j], n[i] }
+func (n namespacesByName) Less(i, j int) bool { return n[i].Name < n[j].Name }
+
 type Vulnerability struct {
 	Name          string                 `json:"Name,omitempty"`
 	NamespaceName string                 `json:"NamespaceName,omitempty"`
 	Description   string                 `json:"Description,omitempty"`
 	Link          string                 `json:"Link,omitempty"`
+	Links         []string               `json:"Links,omitempty"`
 	Severity      string                 `json:"Severity,omitempty"`
 	Metadata      map[string]interface{} `json:"Metadata,omitempty"`
 	FixedBy       string                 `json:"FixedBy,omitempty"`
@@ -125,6 +149,7 @@ func (v Vulnerability) DatabaseModel() (database.Vulnerability, error) {
 		Namespace:   database.Namespace{Name: v.NamespaceName},
 		Description: v.Description,
 		Link:        v.Link,
+		Links:       v.Links,
 		Severity:    severity,
 		Metadata:    v.Metadata,
 		FixedIn:     dbFeatures,
@@ -137,6 +162,7 @@ func VulnerabilityFromDatabaseModel(dbVuln database.Vulnerability, withFixedIn b
 		NamespaceName: dbVuln.Namespace.Name,
 		Description:   dbVuln.Description,
 		Link:          dbVuln.Link,
+		Links:         dbVuln.Links,
 		Severity:      string(dbVuln.Severity),
 		Metadata:      dbVuln.Metadata,
 	}
@@ -150,38 +176,50 @@ func VulnerabilityFromDatabaseModel(dbVuln database.Vulnerability, withFixedIn b
 	return vuln
 }
 
+type LayerDiff struct {
+	Name            string    `json:"Name,omitempty"`
+	ParentName      string    `json:"ParentName,omitempty"`
+	AddedFeatures   []Feature `json:"AddedFeatures,omitempty"`
+	RemovedFeatures []Feature `json:"RemovedFeatures,omitempty"`
+}
+
+func LayerDiffFromDatabaseModel(dbLayer database.Layer, added, removed []database.FeatureVersion) LayerDiff {
+	diff := LayerDiff{Name: dbLayer.Name}
+	if dbLayer.Parent != nil {
+		diff.ParentName = dbLayer.Parent.Name
+	}
+
+	for _, dbFeatureVersion := range added {
+		diff.AddedFeatures = append(diff.AddedFeatures, FeatureFromDatabaseModel(dbFeatureVersion))
+	}
+	for _, dbFeatureVersion := range removed {
+		diff.RemovedFeatures = append(diff.RemovedFeatures, FeatureFromDatabaseModel(dbFeatureVersion))
+	}
+
+	return diff
+}
+
 type Feature struct {
 	Name            string          `json:"Name,omitempty"`
 	NamespaceName   string          `json:"NamespaceName,omitempty"`
-	Version         string          `json:"Version,omitempty"`
+	Version         types.Version   `json:"Version,omitempty"`
 	Vulnerabilities []Vulnerability `json:"Vulnerabilities,omitempty"`
 	AddedBy         string          `json:"AddedBy,omitempty"`
 }
 
 func FeatureFromDatabaseModel(dbFeatureVersion database.FeatureVersion) Feature {
-	versionStr := dbFeatureVersion.Version.String()
-	if versionStr == types.MaxVersion.String() {
-		versionStr = "None"
-	}
-
 	return Feature{
 		Name:          dbFeatureVersion.Feature.Name,
 		NamespaceName: dbFeatureVersion.Feature.Namespace.Name,
-		Version:       versionStr,
+		Version:       dbFeatureVersion.Version,
 		AddedBy:       dbFeatureVersion.AddedBy.Name,
 	}
 }
 
 func (f Feature) DatabaseModel() (database.FeatureVersion, error) {
-	var version types.Version
-	if f.Version == "None" {
-		version = types.MaxVersion
-	} else {
-		var err error
-		version, err = types.NewVersion(f.Version)
-		if err != nil {
-			return database.FeatureVersion{}, err
-		}
+	// The Version has been parsed when decoding the Feature, it is only missing.
+	if f.Version == (types.Version{}) {
+		return database.FeatureVersion{}, errors.New("Version string is empty")
 	}
 
 	return database.FeatureVersion{
@@ -189,7 +227,7 @@ func (f Feature) DatabaseModel() (database.FeatureVersion, error) {
 			Name:      f.Name,
 			Namespace: database.Namespace{Name: f.NamespaceName},
 		},
-		Version: version,
+		Version: f.Version,
 	}, nil
 }
 
@@ -236,7 +274,6 @@ func NotificationFromDatabaseModel(dbNotification database.VulnerabilityNotifica
 	}
 
 	// TODO(jzelinskie): implement "changed" key
-	fmt.Println(dbNotification.Deleted.IsZero())
 	return Notification{
 		Name:     dbNotification.Name,
 		Created:  created,
@@ -274,11 +311,71 @@ type LayerEnvelope struct {
 	Error *Error `json:"Error,omitempty"`
 }
 
+// ImageEnvelope is the body of the requests of the images route. The layers of the image are
+// ordered from the base layer to the leaf.
+type ImageEnvelope struct {
+	Layers []Layer `json:"Layers,omitempty"`
+}
+
+// ManifestEnvelope is the body of the requests of the image manifests route: an OCI image manifest
+// or a Docker image manifest, schema 2, whose layers are downloaded from the given repository of
+// the registry, such as "https://registry-1.docker.io" and "library/debian". The headers are
+// sent to the registry along with the requests.
+type ManifestEnvelope struct {
+	Manifest   json.RawMessage   `json:"Manifest,omitempty"`
+	Registry   string            `json:"Registry,omitempty"`
+	Repository string            `json:"Repository,omitempty"`
+	Headers    map[string]string `json:"Headers,omitempty"`
+}
+
+// ImageStatusEnvelope is the body of the responses of the images route. It reports the outcome of
+// every layer of the submitted image, in the same order.
+type ImageStatusEnvelope struct {
+	Layers []LayerStatus `json:"Layers,omitempty"`
+	Error  *Error        `json:"Error,omitempty"`
+}
+
+const (
+	// LayerStatusProcessed is the status of a layer that has been indexed, possibly with an error
+	// that did not prevent it from being stored.
+	LayerStatusProcessed = "Processed"
+	// LayerStatusFailed is the status of the layer whose processing failed.
+	LayerStatusFailed = "Failed"
+	// LayerStatusSkipped is the status of the layers following a failed one.
+	LayerStatusSkipped = "Skipped"
+)
+
+// LayerStatus is the outcome of the processing of a layer submitted as part of an image.
+type LayerStatus struct {
+	Name   string `json:"Name"`
+	Status string `json:"Status"`
+	Error  *Error `json:"Error,omitempty"`
+}
+
+type LayerDiffEnvelope struct {
+	LayerDiff *LayerDiff `json:"LayerDiff,omitempty"`
+	Error     *Error     `json:"Error,omitempty"`
+}
+
+// LayerAncestryEnvelope lists a layer followed by its parents, up to the base layer.
+type LayerAncestryEnvelope struct {
+	Ancestry *[]Layer `json:"Ancestry,omitempty"`
+	Error    *Error   `json:"Error,omitempty"`
+}
+
 type NamespaceEnvelope struct {
 	Namespaces *[]Namespace `json:"Namespaces,omitempty"`
 	Error      *Error       `json:"Error,omitempty"`
 }
 
+// AffectedLayersEnvelope lists the layers that introduce a vulnerability. Only their names are
+// set.
+type AffectedLayersEnvelope struct {
+	Layers   *[]Layer `json:"Layers,omitempty"`
+	NextPage string   `json:"NextPage,omitempty"`
+	Error    *Error   `json:"Error,omitempty"`
+}
+
 type VulnerabilityEnvelope struct {
 	Vulnerability   *Vulnerability   `json:"Vulnerability,omitempty"`
 	Vulnerabilities *[]Vulnerability `json:"Vulnerabilities,omitempty"`
@@ -291,6 +388,80 @@ type NotificationEnvelope struct {
 	Error        *Error        `json:"Error,omitempty"`
 }
 
+// UpdaterRun is an update of the vulnerability database. Its times are Unix timestamps, and Ended
+// is empty while it is running.
+type UpdaterRun struct {
+	ID       string                    `json:"ID"`
+	Started  string                    `json:"Started,omitempty"`
+	Ended    string                    `json:"Ended,omitempty"`
+	Error    string                    `json:"Error,omitempty"`
+	Fetchers map[string]UpdaterFetcher `json:"Fetchers,omitempty"`
+}
+
+// UpdaterFetcher is the outcome of a vulnerability fetcher during an update.
+type UpdaterFetcher struct {
+	Vulnerabilities int    `json:"Vulnerabilities"`
+	Error           string `json:"Error,omitempty"`
+}
+
+// UpdaterStatus reports the last update of the vulnerability database, the last one that
+// succeeded and the next scheduled one. Its times are Unix timestamps.
+type UpdaterStatus struct {
+	LastRun              *UpdaterRun `json:"LastRun,omitempty"`
+	LastSuccessfulUpdate string      `json:"LastSuccessfulUpdate,omitempty"`
+	NextScheduledUpdate  string      `json:"NextScheduledUpdate,omitempty"`
+}
+
+func UpdaterStatusFromModel(status updater.Status) UpdaterStatus {
+	var updaterStatus UpdaterStatus
+	if status.LastRun != nil {
+		run := UpdaterRun{
+			ID:      status.LastRun.ID,
+			Started: unixTimestamp(status.LastRun.Started),
+			Error:   status.LastRun.Error,
+		}
+		if status.LastRun.Ended != nil {
+			run.Ended = unixTimestamp(*status.LastRun.Ended)
+		}
+		if len(status.LastRun.Fetchers) > 0 {
+			run.Fetchers = make(map[string]UpdaterFetcher, len(status.LastRun.Fetchers))
+			for name, fetcher := range status.LastRun.Fetchers {
+				run.Fetchers[name] = UpdaterFetcher{Vulnerabilities: fetcher.Vulnerabilities, Error: fetcher.Error}
+			}
+		}
+		updaterStatus.LastRun = &run
+	}
+	updaterStatus.LastSuccessfulUpdate = unixTimestamp(status.LastSuccessfulUpdate)
+	updaterStatus.NextScheduledUpdate = unixTimestamp(status.NextScheduledUpdate)
+
+	return updaterStatus
+}
+
+// unixTimestamp formats t as a Unix timestamp, or returns an empty string if it is zero.
+func unixTimestamp(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return fmt.Sprintf("%d", t.Unix())
+}
+
+type UpdaterEnvelope struct {
+	Run    *UpdaterRun    `json:"Run,omitempty"`
+	Status *UpdaterStatus `json:"Status,omitempty"`
+	Error  *Error         `json:"Error,omitempty"`
+}
+
+// ServerInfo describes the Clair server. LastUpdate is the Unix timestamp of the last successful
+// update of the vulnerability database, and is empty if there was none. Detectors lists the
+// enabled detectors, which process the layers.
+type ServerInfo struct {
+	Version       string   `json:"Version"`
+	EngineVersion int      `json:"EngineVersion"`
+	LastUpdate    string   `json:"LastUpdate,omitempty"`
+	Namespaces    int      `json:"Namespaces"`
+	Detectors     []string `json:"Detectors"`
+}
+
 type FeatureEnvelope struct {
 	Feature  *Feature   `json:"Feature,omitempty"`
 	Features *[]Feature `json:"Features,omitempty"`
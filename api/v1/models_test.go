@@ -0,0 +1,106 @@
+// Copyright 2015 clair authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v1
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/coreos/clair/database"
+	"github.com/coreos/clair/utils/types"
+)
+
+func TestFeatureVersionJSON(t *testing.T) {
+	for version, expected := range map[types.Version]string{
+		types.NewVersionUnsafe("1.0-2"): `"1.0-2"`,
+		types.MaxVersion:                `"None"`,
+		types.MinVersion:                `"NotAffected"`,
+	} {
+		dbFeatureVersion := database.FeatureVersion{
+			Feature: database.Feature{Name: "openssl", Namespace: database.Namespace{Name: "debian:7"}},
+			Version: version,
+		}
+
+		j, err := json.Marshal(FeatureFromDatabaseModel(dbFeatureVersion))
+		if !assert.Nil(t, err) {
+			continue
+		}
+		assert.Contains(t, string(j), `"Version":`+expected)
+
+		var feature Feature
+		if assert.Nil(t, json.Unmarshal(j, &feature)) {
+			fv, err := feature.DatabaseModel()
+			assert.Nil(t, err)
+			assert.Equal(t, dbFeatureVersion, fv)
+		}
+	}
+
+	// The Version is mandatory and must be valid.
+	var feature Feature
+	if assert.Nil(t, json.Unmarshal([]byte(`{"Name":"openssl"}`), &feature)) {
+		_, err := feature.DatabaseModel()
+		assert.NotNil(t, err)
+	}
+	assert.NotNil(t, json.Unmarshal([]byte(`{"Name":"openssl","Version":"#invalid"}`), &feature))
+}
+
+func TestLayerAddedByJSON(t *testing.T) {
+	dbLayer := database.Layer{
+		Name: "top",
+		Features: []database.FeatureVersion{
+			{
+				Feature: database.Feature{Name: "openssl", Namespace: database.Namespace{Name: "debian:7"}},
+				Version: types.NewVersionUnsafe("1.0"),
+				AddedBy: database.Layer{Name: "middle"},
+				AffectedBy: []database.Vulnerability{
+					{Name: "CVE-OPENSSL-1-DEB7", Namespace: database.Namespace{Name: "debian:7"}, Severity: types.High},
+				},
+			},
+		},
+	}
+
+	layer := LayerFromDatabaseModel(dbLayer, true, true)
+	if assert.Len(t, layer.Features, 1) {
+		assert.Equal(t, "middle", layer.Features[0].AddedBy)
+		assert.Len(t, layer.Features[0].Vulnerabilities, 1)
+	}
+
+	j, err := json.Marshal(layer)
+	if assert.Nil(t, err) {
+		assert.Contains(t, string(j), `"AddedBy":"middle"`)
+	}
+}
+
+func TestLayerNamespacesJSON(t *testing.T) {
+	debian := database.Namespace{Name: "debian:8", VersionFormat: types.DpkgVersionFormat}
+	dbLayer := database.Layer{
+		Name:       "mixed",
+		Namespace:  &debian,
+		Namespaces: []database.Namespace{{Name: "npm"}, debian},
+	}
+
+	// The primary namespace stays in NamespaceName, and comes first in NamespaceNames.
+	layer := LayerFromDatabaseModel(dbLayer, false, false)
+	assert.Equal(t, "debian:8", layer.NamespaceName)
+	assert.Equal(t, []string{"debian:8", "npm"}, layer.NamespaceNames)
+
+	// Layers without any namespace omit both.
+	j, err := json.Marshal(LayerFromDatabaseModel(database.Layer{Name: "blank"}, false, false))
+	if assert.Nil(t, err) {
+		assert.NotContains(t, string(j), "Namespace")
+	}
+}
@@ -0,0 +1,64 @@
+// Copyright 2015 clair authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v1
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/coreos/clair/config"
+	"github.com/coreos/clair/database"
+)
+
+// defaultLayerNamePattern accepts digests, such as sha256:<hex>, and short names made of letters,
+// digits, '_', '.' and '-', which are safe in URLs, logs and shells.
+const defaultLayerNamePattern = `[a-z0-9]+(?:[+._-][a-z0-9]+)*:[a-fA-F0-9]{32,128}|[A-Za-z0-9_.-]{1,256}`
+
+// layerNamePolicy decides under which names the layers may be created. The layers stored before
+// remain readable and deletable whatever their name.
+type layerNamePolicy struct {
+	regexp      *regexp.Regexp
+	description string
+}
+
+// newLayerNamePolicy returns the policy of the configured pattern, which must match the whole
+// name, or the default one. It panics if the pattern doesn't compile, as it is verified when the
+// API starts.
+func newLayerNamePolicy(config *config.APIConfig) *layerNamePolicy {
+	if config == nil || config.LayerNamePattern == "" {
+		return &layerNamePolicy{
+			regexp:      regexp.MustCompile(`^(?:` + defaultLayerNamePattern + `)$`),
+			description: "a digest, such as sha256:<hex>, or 1 to 256 letters, digits, '_', '.' and '-'",
+		}
+	}
+
+	return &layerNamePolicy{
+		regexp:      regexp.MustCompile(`^(?:` + config.LayerNamePattern + `)$`),
+		description: "a name matching " + config.LayerNamePattern,
+	}
+}
+
+// validate returns an error if a layer may not be created under the given name.
+func (policy *layerNamePolicy) validate(name string) error {
+	if !policy.regexp.MatchString(name) {
+		return fmt.Errorf("invalid layer name %q: it must be %s", name, policy.description)
+	}
+
+	// The datastore rejects the names that would break the routes, whatever the pattern.
+	if err := database.ValidateLayerName(name); err != nil {
+		return fmt.Errorf("invalid layer name %q: %s", name, err)
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+// Copyright 2015 clair authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v1
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/coreos/clair/config"
+)
+
+func TestLayerNamePolicy(t *testing.T) {
+	digest := "sha256:" + strings.Repeat("0123456789abcdef", 4)
+
+	for _, test := range []struct {
+		pattern string
+		name    string
+		valid   bool
+	}{
+		{"", digest, true},
+		{"", strings.Repeat("0123456789abcdef", 4), true},
+		{"", "layer-1.0_base", true},
+		{"", strings.Repeat("a", 256), true},
+		{"", "", false},
+		{"", strings.Repeat("a", 300), false},
+		{"", "sha256:not-hex", false},
+		{"", "library/debian", false},
+		{"", "debian/../layer", false},
+		{"", "..", false},
+		{"", "layer name", false},
+		{"", "layer\n", false},
+		{"", "lāyer", false},
+		{"", "层", false},
+		// A pattern must match the whole name, and can't allow what would break the routes.
+		{"[a-z]+", "layer", true},
+		{"[a-z]+", "layer-1", false},
+		{"[a-z]+", "1-layer", false},
+		{"[a-z]+(/[a-z]+)?", "library/debian", false},
+		{".+", "lāyer", true},
+		{".+", "layer name", false},
+	} {
+		err := newLayerNamePolicy(&config.APIConfig{LayerNamePattern: test.pattern}).validate(test.name)
+		if test.valid {
+			assert.Nil(t, err, "%+v", test)
+		} else if assert.NotNil(t, err, "%+v", test) {
+			assert.Contains(t, err.Error(), "invalid layer name", "%+v", test)
+		}
+	}
+}
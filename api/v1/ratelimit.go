@@ -0,0 +1,175 @@
+// Copyright 2015 clair authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v1
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/coreos/clair/api/context"
+	"github.com/coreos/clair/config"
+)
+
+const (
+	rateLimitRoute = "v1/rateLimit"
+
+	// rateLimiterSweepInterval is how often the buckets that are full again are evicted.
+	rateLimiterSweepInterval = time.Minute
+)
+
+var promRateLimitedRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "clair_api_rate_limited_requests_total",
+	Help: "Number of API requests rejected because their client exceeded its rate limit.",
+}, []string{"group", "identity"})
+
+func init() {
+	prometheus.MustRegister(promRateLimitedRequestsTotal)
+}
+
+// rateLimiter is a set of token buckets, one per client, which are filled with rate tokens per
+// second, up to burst tokens. Every request takes a token from the bucket of its client.
+//
+// A bucket that is full again behaves as a new one, so these are evicted periodically and the
+// memory only grows with the number of clients active over the last sweep interval.
+type rateLimiter struct {
+	group string
+	rate  float64
+	burst float64
+
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// newRateLimiter returns a rateLimiter for the given group of routes, or nil if the configuration
+// disables rate limiting.
+func newRateLimiter(group string, config config.RateLimitConfig) *rateLimiter {
+	if config.Rate <= 0 {
+		return nil
+	}
+
+	burst := float64(config.Burst)
+	if burst < 1 {
+		burst = math.Max(1, math.Ceil(config.Rate))
+	}
+
+	return &rateLimiter{
+		group:   group,
+		rate:    config.Rate,
+		burst:   burst,
+		buckets: make(map[string]*tokenBucket),
+		now:     time.Now,
+	}
+}
+
+// allow takes a token from the bucket of the given client. When the bucket is empty, it returns
+// false along with the time after which a token will be available.
+func (l *rateLimiter) allow(key string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	if now.Sub(l.lastSweep) >= rateLimiterSweepInterval {
+		l.sweep(now)
+	}
+
+	b, exists := l.buckets[key]
+	if !exists {
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// sweep evicts the buckets that have been refilled entirely since their last use.
+func (l *rateLimiter) sweep(now time.Time) {
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+	l.lastSweep = now
+}
+
+// rateLimit wraps a context.Handler so that the requests of a client exceeding the limiter's rate
+// are rejected with a 429. A nil limiter never rejects any request.
+func rateLimit(limiter *rateLimiter, handler context.Handler) context.Handler {
+	if limiter == nil {
+		return handler
+	}
+
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params, ctx *context.RouteContext) (string, int) {
+		kind, identity := clientIdentity(r, ctx)
+		if allowed, retryAfter := limiter.allow(kind + ":" + identity); !allowed {
+			promRateLimitedRequestsTotal.WithLabelValues(limiter.group, kind).Inc()
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+			return rateLimitRoute, writeError(w, r, http.StatusTooManyRequests, "rate limit exceeded, retry later")
+		}
+
+		return handler(w, r, p, ctx)
+	}
+}
+
+// clientIdentity identifies the client of a request by the Common Name of its certificate, its
+// bearer token when tokens are configured, or else its IP address, and returns the kind of the
+// identity along with it. Tokens are hashed so that they are not kept in memory.
+func clientIdentity(r *http.Request, ctx *context.RouteContext) (string, string) {
+	if cn := context.ClientCommonName(r); cn != "" {
+		return "cn", cn
+	}
+
+	if ctx.Config != nil && len(ctx.Config.BearerTokens) > 0 {
+		if token, ok := bearerToken(r); ok {
+			sum := sha256.Sum256([]byte(token))
+			return "token", hex.EncodeToString(sum[:])
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip", host
+}
+
+// rateLimitGroup returns the group of routes the method belongs to: reads or mutations.
+func rateLimitGroup(method string) string {
+	if method == "GET" || method == "HEAD" {
+		return "read"
+	}
+	return "mutation"
+}
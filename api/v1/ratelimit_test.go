@@ -0,0 +1,111 @@
+// Copyright 2015 clair authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v1
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/coreos/clair/api/context"
+	"github.com/coreos/clair/config"
+	"github.com/coreos/clair/database"
+)
+
+func TestRateLimit(t *testing.T) {
+	router := NewRouter(&context.RouteContext{
+		Store: &database.MockDatastore{},
+		Config: &config.APIConfig{
+			ReadRateLimit:     config.RateLimitConfig{Rate: 10, Burst: 2},
+			MutationRateLimit: config.RateLimitConfig{Rate: 10, Burst: 1},
+		},
+	})
+	// Neither route reaches the datastore: the specification is static and the layer is invalid.
+	request := func(method, remoteAddr string) *httptest.ResponseRecorder {
+		path := "/spec"
+		if method == "POST" {
+			path = "/layers"
+		}
+		r := httptest.NewRequest(method, path, nil)
+		r.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+
+	// The burst goes through, the next requests are rejected.
+	for i := 0; i < 2; i++ {
+		assert.NotEqual(t, http.StatusTooManyRequests, request("GET", "192.0.2.1:1234").Code)
+	}
+	w := request("GET", "192.0.2.1:1235")
+	if assert.Equal(t, http.StatusTooManyRequests, w.Code) {
+		retryAfter, err := strconv.Atoi(w.Header().Get("Retry-After"))
+		assert.Nil(t, err)
+		assert.Equal(t, 1, retryAfter)
+	}
+
+	// Mutations, and other clients, have their own buckets.
+	assert.NotEqual(t, http.StatusTooManyRequests, request("POST", "192.0.2.1:1234").Code)
+	assert.Equal(t, http.StatusTooManyRequests, request("POST", "192.0.2.1:1234").Code)
+	assert.NotEqual(t, http.StatusTooManyRequests, request("GET", "192.0.2.2:1234").Code)
+
+	// The bucket refills over time.
+	time.Sleep(150 * time.Millisecond)
+	assert.NotEqual(t, http.StatusTooManyRequests, request("GET", "192.0.2.1:1234").Code)
+}
+
+func TestRateLimitIdentity(t *testing.T) {
+	ctx := &context.RouteContext{Config: &config.APIConfig{}}
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "192.0.2.1:1234"
+	r.Header.Set("Authorization", "Bearer token")
+
+	kind, identity := clientIdentity(r, ctx)
+	assert.Equal(t, "ip", kind)
+	assert.Equal(t, "192.0.2.1", identity)
+
+	// Bearer tokens only identify clients when they are required.
+	ctx.Config.BearerTokens = []string{"token"}
+	kind, identity = clientIdentity(r, ctx)
+	assert.Equal(t, "token", kind)
+	assert.NotContains(t, identity, "token")
+}
+
+func TestRateLimiterEviction(t *testing.T) {
+	limiter := newRateLimiter("read", config.RateLimitConfig{Rate: 1, Burst: 2})
+	now := time.Now()
+	limiter.now = func() time.Time { return now }
+
+	for i := 0; i < 2; i++ {
+		allowed, _ := limiter.allow("a")
+		assert.True(t, allowed)
+	}
+	allowed, retryAfter := limiter.allow("a")
+	assert.False(t, allowed)
+	assert.Equal(t, time.Second, retryAfter)
+	limiter.allow("b")
+
+	// Once refilled, the buckets are evicted by the next sweep.
+	now = now.Add(rateLimiterSweepInterval)
+	limiter.allow("c")
+	assert.Len(t, limiter.buckets, 1)
+
+	// Without configured rate, there is no limiter.
+	assert.Nil(t, newRateLimiter("read", config.RateLimitConfig{}))
+}
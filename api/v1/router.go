@@ -16,41 +16,157 @@
 package v1
 
 import (
+	"net/http"
+	"runtime/debug"
+
 	"github.com/julienschmidt/httprouter"
+	"github.com/prometheus/client_golang/prometheus"
 
 	"github.com/coreos/clair/api/context"
 )
 
+var promPanicsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "clair_api_panics_total",
+	Help: "Number of panics recovered while handling API requests.",
+})
+
+func init() {
+	prometheus.MustRegister(promPanicsTotal)
+}
+
 // NewRouter creates an HTTP router for version 1 of the Clair API.
 func NewRouter(ctx *context.RouteContext) *httprouter.Router {
 	router := httprouter.New()
 
-	// Layers
-	router.POST("/layers", context.HTTPHandler(postLayer, ctx))
-	router.GET("/layers/:layerName", context.HTTPHandler(getLayer, ctx))
-	router.DELETE("/layers/:layerName", context.HTTPHandler(deleteLayer, ctx))
+	// Unknown routes use the same error envelope as the handlers.
+	router.NotFound = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, r, http.StatusNotFound, "no route matches "+r.URL.Path)
+	})
+	router.MethodNotAllowed = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, r, http.StatusMethodNotAllowed, r.Method+" is not allowed on "+r.URL.Path)
+	})
+	router.PanicHandler = recoverPanic
+
+	// Every route is instrumented, and requires a bearer token when some are configured. The
+	// requests of each authenticated client are then rate limited, reads and mutations separately.
+	// Responses to allowed cross-origin requests carry the CORS headers, whatever their status.
+	// The registered routes are listed in the specification.
+	limiters := make(map[string]*rateLimiter)
+	if ctx.Config != nil {
+		limiters["read"] = newRateLimiter("read", ctx.Config.ReadRateLimit)
+		limiters["mutation"] = newRateLimiter("mutation", ctx.Config.MutationRateLimit)
+	}
+	cors := newCORSPolicy(ctx.Config)
+	var routes []route
+	register := func(method, pattern string, handler context.Handler) {
+		routes = append(routes, route{method, pattern})
+		router.Handle(method, pattern, context.HTTPHandler(context.Instrument("/v1"+pattern, allowCORS(cors, handler)), ctx))
+	}
+	handle := func(method, pattern string, handler context.Handler) {
+		register(method, pattern, requireBearerToken(rateLimit(limiters[rateLimitGroup(method)], handler)))
+	}
+
+	// Routes that read a body only accept JSON, up to a size limit.
+	bodySize, imageBodySize := defaultMaxBodySize, defaultMaxImageBodySize
+	if ctx.Config != nil {
+		bodySize = maxBodySize(ctx.Config.MaxBodySize, bodySize)
+		imageBodySize = maxBodySize(ctx.Config.MaxImageBodySize, imageBodySize)
+	}
+	handleBody := func(method, pattern string, maxSize int64, handler context.Handler) {
+		handle(method, pattern, requireJSONBody(maxSize, handler))
+	}
+
+	// Server info
+	handle("GET", "/", newGetInfo())
+
+	// Layers, which are only created under the names that the policy allows.
+	layerNames := newLayerNamePolicy(ctx.Config)
+	handleBody("POST", "/layers", bodySize, func(w http.ResponseWriter, r *http.Request, p httprouter.Params, ctx *context.RouteContext) (string, int) {
+		return postLayer(w, r, p, ctx, layerNames)
+	})
+	handle("GET", "/layers/:layerName", getLayer)
+	handle("HEAD", "/layers/:layerName", headLayer)
+	handle("GET", "/layers/:layerName/diff", getLayerDiff)
+	handle("GET", "/layers/:layerName/ancestry", getLayerAncestry)
+	handle("DELETE", "/layers/:layerName", deleteLayer)
+
+	// Images
+	handleBody("POST", "/images", imageBodySize, func(w http.ResponseWriter, r *http.Request, p httprouter.Params, ctx *context.RouteContext) (string, int) {
+		return postImage(w, r, p, ctx, layerNames)
+	})
+	handleBody("POST", "/images/manifest", imageBodySize, postImageManifest)
 
 	// Namespaces
-	router.GET("/namespaces", context.HTTPHandler(getNamespaces, ctx))
+	handle("GET", "/namespaces", getNamespaces)
 
 	// Vulnerabilities
-	router.GET("/namespaces/:namespaceName/vulnerabilities", context.HTTPHandler(getVulnerabilities, ctx))
-	router.POST("/namespaces/:namespaceName/vulnerabilities", context.HTTPHandler(postVulnerability, ctx))
-	router.GET("/namespaces/:namespaceName/vulnerabilities/:vulnerabilityName", context.HTTPHandler(getVulnerability, ctx))
-	router.PUT("/namespaces/:namespaceName/vulnerabilities/:vulnerabilityName", context.HTTPHandler(putVulnerability, ctx))
-	router.DELETE("/namespaces/:namespaceName/vulnerabilities/:vulnerabilityName", context.HTTPHandler(deleteVulnerability, ctx))
+	handle("GET", "/namespaces/:namespaceName/vulnerabilities", getVulnerabilities)
+	handleBody("POST", "/namespaces/:namespaceName/vulnerabilities", bodySize, postVulnerability)
+	handle("GET", "/namespaces/:namespaceName/vulnerabilities/:vulnerabilityName", getVulnerability)
+	handleBody("PUT", "/namespaces/:namespaceName/vulnerabilities/:vulnerabilityName", bodySize, putVulnerability)
+	handleBody("PATCH", "/namespaces/:namespaceName/vulnerabilities/:vulnerabilityName", bodySize, patchVulnerability)
+	handle("DELETE", "/namespaces/:namespaceName/vulnerabilities/:vulnerabilityName", deleteVulnerability)
+	handle("GET", "/namespaces/:namespaceName/vulnerabilities/:vulnerabilityName/affected-layers", getAffectedLayers)
 
 	// Fixes
-	router.GET("/namespaces/:namespaceName/vulnerabilities/:vulnerabilityName/fixes", context.HTTPHandler(getFixes, ctx))
-	router.PUT("/namespaces/:namespaceName/vulnerabilities/:vulnerabilityName/fixes/:fixName", context.HTTPHandler(putFix, ctx))
-	router.DELETE("/namespaces/:namespaceName/vulnerabilities/:vulnerabilityName/fixes/:fixName", context.HTTPHandler(deleteFix, ctx))
+	handle("GET", "/namespaces/:namespaceName/vulnerabilities/:vulnerabilityName/fixes", getFixes)
+	handleBody("PUT", "/namespaces/:namespaceName/vulnerabilities/:vulnerabilityName/fixes/:fixName", bodySize, putFix)
+	handle("DELETE", "/namespaces/:namespaceName/vulnerabilities/:vulnerabilityName/fixes/:fixName", deleteFix)
 
 	// Notifications
-	router.GET("/notifications/:notificationName", context.HTTPHandler(getNotification, ctx))
-	router.DELETE("/notifications/:notificationName", context.HTTPHandler(deleteNotification, ctx))
+	handle("GET", "/notifications/:notificationName", getNotification)
+	handle("DELETE", "/notifications/:notificationName", deleteNotification)
+
+	// Updater
+	handle("POST", "/updater/run", postUpdaterRun)
+	handle("GET", "/updater/status", getUpdaterStatus)
 
 	// Metrics
-	router.GET("/metrics", context.HTTPHandler(getMetrics, ctx))
+	if ctx.Config != nil && ctx.Config.PublicMetrics {
+		register("GET", "/metrics", getMetrics)
+	} else {
+		handle("GET", "/metrics", getMetrics)
+	}
+
+	// Specification, which is built once every route, including its own, is registered.
+	var spec map[string]interface{}
+	handle("GET", "/spec", func(w http.ResponseWriter, r *http.Request, p httprouter.Params, ctx *context.RouteContext) (string, int) {
+		writeResponse(w, r, http.StatusOK, spec)
+		return getSpecRoute, http.StatusOK
+	})
+	spec = newSpec(routes)
+
+	// Preflight requests are answered on every route when cross-origin requests are allowed. They
+	// carry no credentials and are not part of the specification.
+	if cors != nil {
+		var patterns []string
+		methods := make(map[string][]string)
+		for _, r := range routes {
+			if _, exists := methods[r.pattern]; !exists {
+				patterns = append(patterns, r.pattern)
+			}
+			methods[r.pattern] = append(methods[r.pattern], r.method)
+		}
+		for _, pattern := range patterns {
+			preflight := newPreflightHandler(cors, methods[pattern])
+			router.Handle("OPTIONS", pattern, context.HTTPHandler(context.Instrument("/v1"+pattern, preflight), ctx))
+		}
+	}
 
 	return router
 }
+
+// recoverPanic answers a request whose handler panicked with an internal server error, so that a
+// bug in a handler doesn't leave the client with an empty reply.
+//
+// http.ErrAbortHandler is panicked again, as it is the way handlers abort a response on purpose.
+func recoverPanic(w http.ResponseWriter, r *http.Request, rcv interface{}) {
+	if rcv == http.ErrAbortHandler {
+		panic(rcv)
+	}
+
+	promPanicsTotal.Inc()
+	log.Errorf("panic while handling \"%s %s\" from %s (request %s): %v\n%s", r.Method, r.RequestURI, r.RemoteAddr,
+		w.Header().Get(context.RequestIDHeader), rcv, debug.Stack())
+	writeError(w, r, http.StatusInternalServerError, "internal server error")
+}
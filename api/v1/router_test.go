@@ -0,0 +1,82 @@
+// Copyright 2015 clair authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v1
+
+import (
+	stdcontext "context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/coreos/clair/api/context"
+	"github.com/coreos/clair/config"
+	"github.com/coreos/clair/database"
+)
+
+func TestRecoverPanic(t *testing.T) {
+	store := &database.MockDatastore{
+		FctListNamespaces: func(ctx stdcontext.Context) ([]database.Namespace, error) {
+			return []database.Namespace{{Name: "debian:8"}}, nil
+		},
+	}
+	router := NewRouter(&context.RouteContext{Store: store, Config: &config.APIConfig{}})
+	router.GET("/panic", func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		var layer *Layer
+		w.Write([]byte(layer.Name))
+	})
+	router.GET("/abort", func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		panic(http.ErrAbortHandler)
+	})
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/panic", nil))
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	assert.Equal(t, "application/json;charset=utf-8", w.Header().Get("Content-Type"))
+	var envelope ErrorEnvelope
+	if assert.Nil(t, json.NewDecoder(w.Body).Decode(&envelope)) && assert.NotNil(t, envelope.Error) {
+		assert.NotEmpty(t, envelope.Error.Message)
+	}
+
+	// The router keeps serving.
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/namespaces", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// Aborted handlers are left to net/http.
+	assert.Panics(t, func() {
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/abort", nil))
+	})
+}
+
+func TestRecoverPanicOverHTTP(t *testing.T) {
+	router := NewRouter(&context.RouteContext{Store: &database.MockDatastore{}, Config: &config.APIConfig{}})
+	router.GET("/panic", func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		panic("deliberate panic")
+	})
+	srv := httptest.NewServer(router)
+	defer srv.Close()
+
+	for i := 0; i < 2; i++ {
+		resp, err := http.Get(srv.URL + "/panic")
+		if assert.Nil(t, err) {
+			assert.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+			resp.Body.Close()
+		}
+	}
+}
@@ -15,43 +15,73 @@
 package v1
 
 import (
+	"bytes"
 	"compress/gzip"
+	stdcontext "context"
 	"encoding/json"
-	"io"
+	"errors"
 	"net/http"
+	"net/url"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/julienschmidt/httprouter"
 	"github.com/prometheus/client_golang/prometheus"
 
 	"github.com/coreos/clair/api/context"
+	"github.com/coreos/clair/config"
 	"github.com/coreos/clair/database"
+	"github.com/coreos/clair/updater"
 	"github.com/coreos/clair/utils"
 	cerrors "github.com/coreos/clair/utils/errors"
+	"github.com/coreos/clair/utils/types"
 	"github.com/coreos/clair/worker"
 )
 
 const (
-	// These are the route identifiers for prometheus.
+	// These are the route identifiers reported in the logs.
 	postLayerRoute           = "v1/postLayer"
+	postImageRoute           = "v1/postImage"
+	postImageManifestRoute   = "v1/postImageManifest"
 	getLayerRoute            = "v1/getLayer"
+	headLayerRoute           = "v1/headLayer"
+	getLayerDiffRoute        = "v1/getLayerDiff"
+	getLayerAncestryRoute    = "v1/getLayerAncestry"
 	deleteLayerRoute         = "v1/deleteLayer"
 	getNamespacesRoute       = "v1/getNamespaces"
 	getVulnerabilitiesRoute  = "v1/getVulnerabilities"
 	postVulnerabilityRoute   = "v1/postVulnerability"
 	getVulnerabilityRoute    = "v1/getVulnerability"
 	putVulnerabilityRoute    = "v1/putVulnerability"
+	patchVulnerabilityRoute  = "v1/patchVulnerability"
 	deleteVulnerabilityRoute = "v1/deleteVulnerability"
+	getAffectedLayersRoute   = "v1/getAffectedLayers"
 	getFixesRoute            = "v1/getFixes"
 	putFixRoute              = "v1/putFix"
 	deleteFixRoute           = "v1/deleteFix"
 	getNotificationRoute     = "v1/getNotification"
 	deleteNotificationRoute  = "v1/deleteNotification"
+	postUpdaterRunRoute      = "v1/postUpdaterRun"
+	getUpdaterStatusRoute    = "v1/getUpdaterStatus"
 	getMetricsRoute          = "v1/getMetrics"
+	getSpecRoute             = "v1/getSpec"
+	getInfoRoute             = "v1/getInfo"
 
-	// maxBodySize restricts client request bodies to 1MiB.
-	maxBodySize int64 = 1048576
+	// totalCountHeader is the header in which paginated routes report the total number of results.
+	totalCountHeader = "X-Total-Count"
+
+	// defaultMaxAncestryDepth is the number of layers above which an ancestry is rejected, unless
+	// configured otherwise. It matches Docker's limit.
+	defaultMaxAncestryDepth = database.DefaultMaxLayerTreeDepth
+
+	// infoCacheDuration is how long the server info is cached, as every client may poll it.
+	infoCacheDuration = 5 * time.Second
+
+	// minGzipSize is the size under which responses are not worth compressing.
+	minGzipSize = 1024
 
 	// statusUnprocessableEntity represents the 422 (Unprocessable Entity) status code, which means
 	// the server understands the content type of the request entity
@@ -59,11 +89,16 @@ const (
 	// request entity is correct (thus a 400 (Bad Request) status code is inappropriate) but was
 	// unable to process the contained instructions.
 	statusUnprocessableEntity = 422
+
+	// queueFullRetryAfter is the number of seconds after which the clients should retry the
+	// layers that the worker refused because its queue was full.
+	queueFullRetryAfter = 10
 )
 
+// decodeJSON decodes the request body, whose size is already restricted by requireJSONBody.
 func decodeJSON(r *http.Request, v interface{}) error {
 	defer r.Body.Close()
-	return json.NewDecoder(io.LimitReader(r.Body, maxBodySize)).Decode(v)
+	return json.NewDecoder(r.Body).Decode(v)
 }
 
 func writeResponse(w http.ResponseWriter, r *http.Request, status int, resp interface{}) {
@@ -71,84 +106,345 @@ func writeResponse(w http.ResponseWriter, r *http.Request, status int, resp inte
 	header := w.Header()
 	header.Set("Content-Type", "application/json;charset=utf-8")
 	header.Set("Server", "clair")
+	header.Add("Vary", "Accept-Encoding")
 
-	// Gzip the response if the client supports it.
-	var writer io.Writer = w
-	if strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
-		gzipWriter := gzip.NewWriter(w)
-		defer gzipWriter.Close()
-		writer = gzipWriter
+	// Marshal the response before writing anything, so that the size of the response is known and
+	// a marshaling error can still be answered with an internal server error.
+	var body bytes.Buffer
+	if err := json.NewEncoder(&body).Encode(resp); err != nil {
+		panic("v1: failed to marshal response: " + err.Error())
+	}
 
+	// Gzip the response if the client supports it and it is large enough to be worth it.
+	var err error
+	if body.Len() >= minGzipSize && acceptsGzip(r) {
 		header.Set("Content-Encoding", "gzip")
+		w.WriteHeader(status)
+
+		gzipWriter := gzip.NewWriter(w)
+		if _, err = body.WriteTo(gzipWriter); err == nil {
+			err = gzipWriter.Close()
+		}
+	} else {
+		w.WriteHeader(status)
+		_, err = body.WriteTo(w)
+	}
+
+	if err != nil {
+		log.Warningf("failed to write response: %s", err.Error())
+	}
+}
+
+// acceptsGzip returns whether the Accept-Encoding header of the request allows a gzipped
+// response.
+func acceptsGzip(r *http.Request) bool {
+	for _, encoding := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		params := strings.Split(encoding, ";")
+		if name := strings.TrimSpace(params[0]); name != "gzip" && name != "*" {
+			continue
+		}
+
+		// A quality of 0 means that the encoding is not acceptable.
+		for _, param := range params[1:] {
+			if q := strings.TrimSpace(param); strings.HasPrefix(q, "q=") {
+				if quality, err := strconv.ParseFloat(q[2:], 64); err == nil && quality == 0 {
+					return false
+				}
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// writeError writes the common error envelope with the given status and message, and returns the
+// status so that handlers report what has actually been written.
+func writeError(w http.ResponseWriter, r *http.Request, status int, message string) int {
+	writeResponse(w, r, status, ErrorEnvelope{Error: &Error{message}})
+	return status
+}
+
+// errorStatus maps an error returned by the datastore or the worker to an HTTP status code.
+func errorStatus(err error) int {
+	switch err {
+	case cerrors.ErrNotFound:
+		return http.StatusNotFound
+	case database.ErrAlreadyExists, database.ErrLayerHasChildren:
+		return http.StatusConflict
+	case database.ErrBackendException, worker.ErrQueueFull:
+		return http.StatusServiceUnavailable
+	case utils.ErrLayerTooLarge:
+		return http.StatusRequestEntityTooLarge
+	case utils.ErrCouldNotExtract, utils.ErrExtractedFileTooBig, worker.ErrCouldNotFindNamespace:
+		return statusUnprocessableEntity
+	}
+
+	if _, downloadErr := err.(*worker.ErrCouldNotDownload); downloadErr {
+		return http.StatusBadGateway
 	}
 
-	// Write the response.
-	w.WriteHeader(status)
-	err := json.NewEncoder(writer).Encode(resp)
+	if _, tooDeep := err.(*database.ErrLayerTreeTooDeep); tooDeep {
+		return statusUnprocessableEntity
+	}
+
+	if _, badreq := err.(*cerrors.ErrBadRequest); badreq {
+		return http.StatusBadRequest
+	}
+
+	return http.StatusInternalServerError
+}
 
+// setRetryAfter tells the client when to retry a request that failed with the given error, if it
+// is only due to the load of the worker.
+func setRetryAfter(w http.ResponseWriter, err error) {
+	if err == worker.ErrQueueFull {
+		w.Header().Set("Retry-After", strconv.Itoa(queueFullRetryAfter))
+	}
+}
+
+// parseLimit parses the required "limit" query parameter of the paginated routes. Limits above
+// maxPageSize are lowered to it, unless maxPageSize is 0.
+func parseLimit(query url.Values, maxPageSize int) (int, error) {
+	limitStrs, limitExists := query["limit"]
+	if !limitExists {
+		return 0, errors.New("must provide limit query parameter")
+	}
+
+	limit, err := strconv.Atoi(limitStrs[0])
 	if err != nil {
-		switch err.(type) {
-		case *json.MarshalerError, *json.UnsupportedTypeError, *json.UnsupportedValueError:
-			panic("v1: failed to marshal response: " + err.Error())
-		default:
-			log.Warningf("failed to write response: %s", err.Error())
+		return 0, errors.New("invalid limit format: " + err.Error())
+	}
+	if limit <= 0 {
+		return 0, errors.New("limit must be positive")
+	}
+
+	if maxPageSize > 0 && limit > maxPageSize {
+		limit = maxPageSize
+	}
+	return limit, nil
+}
+
+// parseMinimumSeverity parses the optional "minimumSeverity" query parameter. It defaults to
+// types.Unknown, which does not filter out any vulnerability.
+func parseMinimumSeverity(query url.Values) (types.Priority, error) {
+	minSeverityStrs, exists := query["minimumSeverity"]
+	if !exists {
+		return types.Unknown, nil
+	}
+
+	minSeverity, valid := types.NormalizePriority(types.Priority(minSeverityStrs[0]))
+	if !valid {
+		validSeverities := make([]string, 0, len(types.Priorities))
+		for _, severity := range types.Priorities {
+			validSeverities = append(validSeverities, string(severity))
 		}
+		return "", errors.New("invalid minimumSeverity: " + minSeverityStrs[0] + ", must be one of " + strings.Join(validSeverities, ", "))
 	}
+
+	return minSeverity, nil
 }
 
-func postLayer(w http.ResponseWriter, r *http.Request, p httprouter.Params, ctx *context.RouteContext) (string, int) {
+// localPaths returns the directories from which the layers may be read on the local filesystem,
+// none unless the configuration allows it.
+func localPaths(config *config.APIConfig) []string {
+	if config == nil || !config.LocalPathsAllowed {
+		return nil
+	}
+	return config.LocalPathPrefixes
+}
+
+func postLayer(w http.ResponseWriter, r *http.Request, p httprouter.Params, ctx *context.RouteContext, layerNames *layerNamePolicy) (string, int) {
 	request := LayerEnvelope{}
 	err := decodeJSON(r, &request)
 	if err != nil {
-		writeResponse(w, r, http.StatusBadRequest, LayerEnvelope{Error: &Error{err.Error()}})
-		return postLayerRoute, http.StatusBadRequest
+		return postLayerRoute, writeError(w, r, http.StatusBadRequest, err.Error())
 	}
 
 	if request.Layer == nil {
-		writeResponse(w, r, http.StatusBadRequest, LayerEnvelope{Error: &Error{"failed to provide layer"}})
-		return postLayerRoute, http.StatusBadRequest
+		return postLayerRoute, writeError(w, r, http.StatusBadRequest, "failed to provide layer")
+	}
+	if err := layerNames.validate(request.Layer.Name); err != nil {
+		return postLayerRoute, writeError(w, r, http.StatusBadRequest, err.Error())
 	}
 
-	err = worker.Process(ctx.Store, request.Layer.Format, request.Layer.Name, request.Layer.ParentName, request.Layer.Path, request.Layer.Headers)
+	processErr := worker.Process(r.Context(), ctx.Store, request.Layer.Format, request.Layer.Name, request.Layer.ParentName, request.Layer.Path, request.Layer.Headers, localPaths(ctx.Config))
+	if processErr != nil && processErr != worker.ErrCouldNotFindNamespace {
+		setRetryAfter(w, processErr)
+		return postLayerRoute, writeError(w, r, errorStatus(processErr), processErr.Error())
+	}
+
+	// Respond with the layer as it is stored, which may have been indexed by a newer engine. A read
+	// replica may not have it yet.
+	dbLayer, err := ctx.Store.FindLayer(database.ContextWithPrimary(r.Context()), request.Layer.Name, false, false, types.Unknown)
 	if err != nil {
-		if err == utils.ErrCouldNotExtract ||
-			err == utils.ErrExtractedFileTooBig ||
-			err == worker.ErrUnsupported {
-			writeResponse(w, r, statusUnprocessableEntity, LayerEnvelope{Error: &Error{err.Error()}})
-			return postLayerRoute, statusUnprocessableEntity
+		return postLayerRoute, writeError(w, r, errorStatus(err), err.Error())
+	}
+
+	layer := LayerFromDatabaseModel(dbLayer, false, false)
+	layer.Path = request.Layer.Path
+	layer.Format = request.Layer.Format
+
+	// A layer whose namespace is unknown is stored, without the features that need one.
+	if processErr != nil {
+		writeResponse(w, r, statusUnprocessableEntity, LayerEnvelope{Layer: &layer, Error: &Error{processErr.Error()}})
+		return postLayerRoute, statusUnprocessableEntity
+	}
+
+	writeResponse(w, r, http.StatusCreated, LayerEnvelope{Layer: &layer})
+	return postLayerRoute, http.StatusCreated
+}
+
+func postImage(w http.ResponseWriter, r *http.Request, p httprouter.Params, ctx *context.RouteContext, layerNames *layerNamePolicy) (string, int) {
+	request := ImageEnvelope{}
+	err := decodeJSON(r, &request)
+	if err != nil {
+		return postImageRoute, writeError(w, r, http.StatusBadRequest, err.Error())
+	}
+
+	if len(request.Layers) == 0 {
+		return postImageRoute, writeError(w, r, http.StatusBadRequest, "failed to provide layers")
+	}
+	names := make(map[string]struct{}, len(request.Layers))
+	for i, layer := range request.Layers {
+		if layer.Name == "" {
+			return postImageRoute, writeError(w, r, http.StatusBadRequest, "layer "+strconv.Itoa(i)+" does not have a name")
+		}
+		if err := layerNames.validate(layer.Name); err != nil {
+			return postImageRoute, writeError(w, r, http.StatusBadRequest, err.Error())
+		}
+		if _, duplicate := names[layer.Name]; duplicate {
+			return postImageRoute, writeError(w, r, http.StatusBadRequest, "layer "+layer.Name+" is listed twice")
 		}
+		names[layer.Name] = struct{}{}
 
-		if _, badreq := err.(*cerrors.ErrBadRequest); badreq {
-			writeResponse(w, r, http.StatusBadRequest, LayerEnvelope{Error: &Error{err.Error()}})
-			return postLayerRoute, http.StatusBadRequest
+		// Every layer but the base one is the child of the previous one.
+		if i > 0 && layer.ParentName != "" && layer.ParentName != request.Layers[i-1].Name {
+			return postImageRoute, writeError(w, r, http.StatusBadRequest, "layer "+layer.Name+" is not the child of "+request.Layers[i-1].Name)
+		}
+	}
+
+	// Process the layers from the base to the leaf, stopping at the first failure.
+	statuses := make([]LayerStatus, len(request.Layers))
+	status := http.StatusCreated
+	var processErr error
+	for i, layer := range request.Layers {
+		statuses[i].Name = layer.Name
+		if processErr != nil {
+			statuses[i].Status = LayerStatusSkipped
+			continue
+		}
+
+		parentName := layer.ParentName
+		if i > 0 {
+			parentName = request.Layers[i-1].Name
 		}
 
-		writeResponse(w, r, http.StatusInternalServerError, LayerEnvelope{Error: &Error{err.Error()}})
-		return postLayerRoute, http.StatusInternalServerError
+		processErr = worker.Process(r.Context(), ctx.Store, layer.Format, layer.Name, parentName, layer.Path, layer.Headers, localPaths(ctx.Config))
+		if processErr == worker.ErrCouldNotFindNamespace {
+			// The layer is stored nonetheless, so that its children are processed.
+			log.Warningf("image: layer %d/%d (%s) processed without namespace (request %s)", i+1, len(request.Layers), layer.Name, context.RequestID(r))
+			statuses[i].Status = LayerStatusProcessed
+			statuses[i].Error = &Error{processErr.Error()}
+			processErr = nil
+			continue
+		}
+		if processErr != nil {
+			log.Warningf("image: layer %d/%d (%s) failed (request %s): %s", i+1, len(request.Layers), layer.Name, context.RequestID(r), processErr)
+			statuses[i].Status = LayerStatusFailed
+			statuses[i].Error = &Error{processErr.Error()}
+			status = errorStatus(processErr)
+			continue
+		}
+
+		log.Debugf("image: layer %d/%d (%s) processed (request %s)", i+1, len(request.Layers), layer.Name, context.RequestID(r))
+		statuses[i].Status = LayerStatusProcessed
 	}
 
-	writeResponse(w, r, http.StatusCreated, LayerEnvelope{Layer: &Layer{
-		Name:             request.Layer.Name,
-		ParentName:       request.Layer.ParentName,
-		Path:             request.Layer.Path,
-		Headers:          request.Layer.Headers,
-		Format:           request.Layer.Format,
-		IndexedByVersion: worker.Version,
-	}})
-	return postLayerRoute, http.StatusCreated
+	response := ImageStatusEnvelope{Layers: statuses}
+	if processErr != nil {
+		response.Error = &Error{processErr.Error()}
+		setRetryAfter(w, processErr)
+	}
+	writeResponse(w, r, status, response)
+	return postImageRoute, status
+}
+
+func postImageManifest(w http.ResponseWriter, r *http.Request, p httprouter.Params, ctx *context.RouteContext) (string, int) {
+	request := ManifestEnvelope{}
+	err := decodeJSON(r, &request)
+	if err != nil {
+		return postImageManifestRoute, writeError(w, r, http.StatusBadRequest, err.Error())
+	}
+
+	if len(request.Manifest) == 0 {
+		return postImageManifestRoute, writeError(w, r, http.StatusBadRequest, "failed to provide manifest")
+	}
+
+	names, err := worker.ProcessManifest(r.Context(), ctx.Store, request.Manifest, request.Registry, request.Repository, request.Headers)
+	layerErr, isLayerErr := err.(*worker.ManifestLayerError)
+	if err != nil && !isLayerErr {
+		return postImageManifestRoute, writeError(w, r, errorStatus(err), err.Error())
+	}
+
+	// Report the layers up to the failed one as processed, and the following ones as skipped.
+	statuses := make([]LayerStatus, len(names))
+	status := http.StatusCreated
+	failed := false
+	for i, name := range names {
+		statuses[i].Name = name
+		switch {
+		case failed:
+			statuses[i].Status = LayerStatusSkipped
+		case isLayerErr && name == layerErr.Name:
+			log.Warningf("image: layer %d/%d (%s) failed (request %s): %s", i+1, len(names), name, context.RequestID(r), layerErr.Err)
+			statuses[i].Status = LayerStatusFailed
+			statuses[i].Error = &Error{layerErr.Err.Error()}
+			status = errorStatus(layerErr.Err)
+			failed = true
+		default:
+			statuses[i].Status = LayerStatusProcessed
+		}
+	}
+
+	response := ImageStatusEnvelope{Layers: statuses}
+	if isLayerErr {
+		response.Error = &Error{layerErr.Err.Error()}
+		setRetryAfter(w, layerErr.Err)
+	}
+	writeResponse(w, r, status, response)
+	return postImageManifestRoute, status
 }
 
 func getLayer(w http.ResponseWriter, r *http.Request, p httprouter.Params, ctx *context.RouteContext) (string, int) {
 	_, withFeatures := r.URL.Query()["features"]
 	_, withVulnerabilities := r.URL.Query()["vulnerabilities"]
 
-	dbLayer, err := ctx.Store.FindLayer(p.ByName("layerName"), withFeatures, withVulnerabilities)
-	if err == cerrors.ErrNotFound {
-		writeResponse(w, r, http.StatusNotFound, LayerEnvelope{Error: &Error{err.Error()}})
-		return getLayerRoute, http.StatusNotFound
-	} else if err != nil {
-		writeResponse(w, r, http.StatusInternalServerError, LayerEnvelope{Error: &Error{err.Error()}})
-		return getLayerRoute, http.StatusInternalServerError
+	minSeverity, err := parseMinimumSeverity(r.URL.Query())
+	if err != nil {
+		return getLayerRoute, writeError(w, r, http.StatusBadRequest, err.Error())
+	}
+
+	// The layer alone is enough to tell whether the client already has the report.
+	dbLayer, err := ctx.Store.FindLayer(r.Context(), p.ByName("layerName"), false, false, types.Unknown)
+	if err != nil {
+		return getLayerRoute, writeError(w, r, errorStatus(err), err.Error())
+	}
+
+	etag, err := layerETag(r.Context(), ctx.Store, dbLayer, withFeatures, withVulnerabilities, minSeverity)
+	if err != nil {
+		return getLayerRoute, writeError(w, r, errorStatus(err), err.Error())
+	}
+	w.Header().Set("ETag", etag)
+	if etagMatches(r, etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return getLayerRoute, http.StatusNotModified
+	}
+
+	if withFeatures || withVulnerabilities {
+		dbLayer, err = ctx.Store.FindLayer(r.Context(), dbLayer.Name, withFeatures, withVulnerabilities, minSeverity)
+		if err != nil {
+			return getLayerRoute, writeError(w, r, errorStatus(err), err.Error())
+		}
 	}
 
 	layer := LayerFromDatabaseModel(dbLayer, withFeatures, withVulnerabilities)
@@ -157,14 +453,94 @@ func getLayer(w http.ResponseWriter, r *http.Request, p httprouter.Params, ctx *
 	return getLayerRoute, http.StatusOK
 }
 
+func headLayer(w http.ResponseWriter, r *http.Request, p httprouter.Params, ctx *context.RouteContext) (string, int) {
+	w.Header().Set("Server", "clair")
+
+	exists, err := ctx.Store.LayerExists(r.Context(), p.ByName("layerName"))
+	if err != nil {
+		w.WriteHeader(errorStatus(err))
+		return headLayerRoute, errorStatus(err)
+	}
+	if !exists {
+		w.WriteHeader(http.StatusNotFound)
+		return headLayerRoute, http.StatusNotFound
+	}
+
+	w.WriteHeader(http.StatusOK)
+	return headLayerRoute, http.StatusOK
+}
+
+func getLayerDiff(w http.ResponseWriter, r *http.Request, p httprouter.Params, ctx *context.RouteContext) (string, int) {
+	dbLayer, err := ctx.Store.FindLayer(r.Context(), p.ByName("layerName"), false, false, types.Unknown)
+	if err != nil {
+		return getLayerDiffRoute, writeError(w, r, errorStatus(err), err.Error())
+	}
+
+	added, removed, err := ctx.Store.GetLayerDiff(r.Context(), dbLayer.Name)
+	if err != nil {
+		return getLayerDiffRoute, writeError(w, r, errorStatus(err), err.Error())
+	}
+
+	diff := LayerDiffFromDatabaseModel(dbLayer, added, removed)
+
+	writeResponse(w, r, http.StatusOK, LayerDiffEnvelope{LayerDiff: &diff})
+	return getLayerDiffRoute, http.StatusOK
+}
+
+func getLayerAncestry(w http.ResponseWriter, r *http.Request, p httprouter.Params, ctx *context.RouteContext) (string, int) {
+	maxDepth := ctx.Config.MaxAncestryDepth
+	if maxDepth <= 0 {
+		maxDepth = defaultMaxAncestryDepth
+	}
+
+	dbLayer, err := ctx.Store.FindLayer(r.Context(), p.ByName("layerName"), false, false, types.Unknown)
+	if err != nil {
+		return getLayerAncestryRoute, writeError(w, r, errorStatus(err), err.Error())
+	}
+
+	// Walk the parents up to the base layer, as long as the chain isn't deeper than the maximum. A
+	// parent that cannot be found or a cycle mean that the database is inconsistent.
+	ancestry := []Layer{LayerFromDatabaseModel(dbLayer, false, false)}
+	seen := map[string]struct{}{dbLayer.Name: {}}
+	for dbLayer.Parent != nil {
+		if len(ancestry) >= maxDepth {
+			err = &database.ErrLayerTreeTooDeep{Layer: p.ByName("layerName"), MaxDepth: maxDepth}
+			return getLayerAncestryRoute, writeError(w, r, errorStatus(err), err.Error())
+		}
+		if _, cycle := seen[dbLayer.Parent.Name]; cycle {
+			log.Errorf("layer %s: ancestry has a cycle at %s", p.ByName("layerName"), dbLayer.Parent.Name)
+			return getLayerAncestryRoute, writeError(w, r, http.StatusInternalServerError, database.ErrInconsistent.Error())
+		}
+
+		dbLayer, err = ctx.Store.FindLayer(r.Context(), dbLayer.Parent.Name, false, false, types.Unknown)
+		if err == cerrors.ErrNotFound {
+			err = database.ErrInconsistent
+		}
+		if err != nil {
+			return getLayerAncestryRoute, writeError(w, r, errorStatus(err), err.Error())
+		}
+
+		ancestry = append(ancestry, LayerFromDatabaseModel(dbLayer, false, false))
+		seen[dbLayer.Name] = struct{}{}
+	}
+
+	writeResponse(w, r, http.StatusOK, LayerAncestryEnvelope{Ancestry: &ancestry})
+	return getLayerAncestryRoute, http.StatusOK
+}
+
 func deleteLayer(w http.ResponseWriter, r *http.Request, p httprouter.Params, ctx *context.RouteContext) (string, int) {
-	err := ctx.Store.DeleteLayer(p.ByName("layerName"))
-	if err == cerrors.ErrNotFound {
-		writeResponse(w, r, http.StatusNotFound, LayerEnvelope{Error: &Error{err.Error()}})
-		return deleteLayerRoute, http.StatusNotFound
-	} else if err != nil {
-		writeResponse(w, r, http.StatusInternalServerError, LayerEnvelope{Error: &Error{err.Error()}})
-		return deleteLayerRoute, http.StatusInternalServerError
+	recursive := false
+	if recursiveStrs, exists := r.URL.Query()["recursive"]; exists {
+		var err error
+		recursive, err = strconv.ParseBool(recursiveStrs[0])
+		if err != nil {
+			return deleteLayerRoute, writeError(w, r, http.StatusBadRequest, "invalid recursive format: "+err.Error())
+		}
+	}
+
+	err := ctx.Store.DeleteLayer(r.Context(), p.ByName("layerName"), recursive)
+	if err != nil {
+		return deleteLayerRoute, writeError(w, r, errorStatus(err), err.Error())
 	}
 
 	w.WriteHeader(http.StatusOK)
@@ -172,15 +548,39 @@ func deleteLayer(w http.ResponseWriter, r *http.Request, p httprouter.Params, ct
 }
 
 func getNamespaces(w http.ResponseWriter, r *http.Request, p httprouter.Params, ctx *context.RouteContext) (string, int) {
-	dbNamespaces, err := ctx.Store.ListNamespaces()
+	withVulnerabilityCounts := false
+	if countsStrs, exists := r.URL.Query()["vulnerabilityCounts"]; exists {
+		var err error
+		withVulnerabilityCounts, err = strconv.ParseBool(countsStrs[0])
+		if err != nil {
+			return getNamespacesRoute, writeError(w, r, http.StatusBadRequest, "invalid vulnerabilityCounts format: "+err.Error())
+		}
+	}
+
+	dbNamespaces, err := ctx.Store.ListNamespaces(r.Context())
 	if err != nil {
-		writeResponse(w, r, http.StatusInternalServerError, NamespaceEnvelope{Error: &Error{err.Error()}})
-		return getNamespacesRoute, http.StatusInternalServerError
+		return getNamespacesRoute, writeError(w, r, errorStatus(err), err.Error())
+	}
+
+	var counts map[string]int
+	if withVulnerabilityCounts {
+		counts, err = ctx.Store.CountVulnerabilitiesByNamespace(r.Context())
+		if err != nil {
+			return getNamespacesRoute, writeError(w, r, errorStatus(err), err.Error())
+		}
 	}
-	var namespaces []Namespace
+
+	// An empty list is returned rather than null when there is no namespace yet.
+	namespaces := make([]Namespace, 0, len(dbNamespaces))
 	for _, dbNamespace := range dbNamespaces {
-		namespaces = append(namespaces, Namespace{Name: dbNamespace.Name})
+		namespace := Namespace{Name: dbNamespace.Name, VersionFormat: string(dbNamespace.VersionFormat)}
+		if withVulnerabilityCounts {
+			count := counts[dbNamespace.Name]
+			namespace.VulnerabilityCount = &count
+		}
+		namespaces = append(namespaces, namespace)
 	}
+	sort.Sort(namespacesByName(namespaces))
 
 	writeResponse(w, r, http.StatusOK, NamespaceEnvelope{Namespaces: &namespaces})
 	return getNamespacesRoute, http.StatusOK
@@ -189,18 +589,9 @@ func getNamespaces(w http.ResponseWriter, r *http.Request, p httprouter.Params,
 func getVulnerabilities(w http.ResponseWriter, r *http.Request, p httprouter.Params, ctx *context.RouteContext) (string, int) {
 	query := r.URL.Query()
 
-	limitStrs, limitExists := query["limit"]
-	if !limitExists {
-		writeResponse(w, r, http.StatusBadRequest, VulnerabilityEnvelope{Error: &Error{"must provide limit query parameter"}})
-		return getVulnerabilitiesRoute, http.StatusBadRequest
-	}
-	limit, err := strconv.Atoi(limitStrs[0])
+	limit, err := parseLimit(query, ctx.Config.MaxPageSize)
 	if err != nil {
-		writeResponse(w, r, http.StatusBadRequest, VulnerabilityEnvelope{Error: &Error{"invalid limit format: " + err.Error()}})
-		return getVulnerabilitiesRoute, http.StatusBadRequest
-	} else if limit < 0 {
-		writeResponse(w, r, http.StatusBadRequest, VulnerabilityEnvelope{Error: &Error{"limit value should not be less than zero"}})
-		return getVulnerabilitiesRoute, http.StatusBadRequest
+		return getVulnerabilitiesRoute, writeError(w, r, http.StatusBadRequest, err.Error())
 	}
 
 	page := 0
@@ -208,27 +599,27 @@ func getVulnerabilities(w http.ResponseWriter, r *http.Request, p httprouter.Par
 	if pageExists {
 		err = tokenUnmarshal(pageStrs[0], ctx.Config.PaginationKey, &page)
 		if err != nil {
-			writeResponse(w, r, http.StatusBadRequest, VulnerabilityEnvelope{Error: &Error{"invalid page format: " + err.Error()}})
-			return getNotificationRoute, http.StatusBadRequest
+			return getVulnerabilitiesRoute, writeError(w, r, http.StatusBadRequest, "invalid page format: "+err.Error())
 		}
 	}
 
+	minSeverity, err := parseMinimumSeverity(query)
+	if err != nil {
+		return getVulnerabilitiesRoute, writeError(w, r, http.StatusBadRequest, err.Error())
+	}
+
 	namespace := p.ByName("namespaceName")
 	if namespace == "" {
-		writeResponse(w, r, http.StatusBadRequest, VulnerabilityEnvelope{Error: &Error{"namespace should not be empty"}})
-		return getNotificationRoute, http.StatusBadRequest
+		return getVulnerabilitiesRoute, writeError(w, r, http.StatusBadRequest, "namespace should not be empty")
 	}
 
-	dbVulns, nextPage, err := ctx.Store.ListVulnerabilities(namespace, limit, page)
-	if err == cerrors.ErrNotFound {
-		writeResponse(w, r, http.StatusNotFound, VulnerabilityEnvelope{Error: &Error{err.Error()}})
-		return getVulnerabilityRoute, http.StatusNotFound
-	} else if err != nil {
-		writeResponse(w, r, http.StatusInternalServerError, VulnerabilityEnvelope{Error: &Error{err.Error()}})
-		return getVulnerabilitiesRoute, http.StatusInternalServerError
+	dbVulns, nextPage, err := ctx.Store.ListVulnerabilities(r.Context(), namespace, minSeverity, limit, page)
+	if err != nil {
+		return getVulnerabilitiesRoute, writeError(w, r, errorStatus(err), err.Error())
 	}
 
-	var vulns []Vulnerability
+	// The last page may be empty, it is then listed as such rather than as null.
+	vulns := make([]Vulnerability, 0, len(dbVulns))
 	for _, dbVuln := range dbVulns {
 		vuln := VulnerabilityFromDatabaseModel(dbVuln, false)
 		vulns = append(vulns, vuln)
@@ -238,8 +629,7 @@ func getVulnerabilities(w http.ResponseWriter, r *http.Request, p httprouter.Par
 	if nextPage != -1 {
 		nextPageBytes, err := tokenMarshal(nextPage, ctx.Config.PaginationKey)
 		if err != nil {
-			writeResponse(w, r, http.StatusBadRequest, VulnerabilityEnvelope{Error: &Error{"failed to marshal token: " + err.Error()}})
-			return getNotificationRoute, http.StatusBadRequest
+			return getVulnerabilitiesRoute, writeError(w, r, http.StatusInternalServerError, "failed to marshal token: "+err.Error())
 		}
 		nextPageStr = string(nextPageBytes)
 	}
@@ -252,31 +642,37 @@ func postVulnerability(w http.ResponseWriter, r *http.Request, p httprouter.Para
 	request := VulnerabilityEnvelope{}
 	err := decodeJSON(r, &request)
 	if err != nil {
-		writeResponse(w, r, http.StatusBadRequest, VulnerabilityEnvelope{Error: &Error{err.Error()}})
-		return postVulnerabilityRoute, http.StatusBadRequest
+		return postVulnerabilityRoute, writeError(w, r, http.StatusBadRequest, err.Error())
 	}
 
 	if request.Vulnerability == nil {
-		writeResponse(w, r, http.StatusBadRequest, VulnerabilityEnvelope{Error: &Error{"failed to provide vulnerability"}})
-		return postVulnerabilityRoute, http.StatusBadRequest
+		return postVulnerabilityRoute, writeError(w, r, http.StatusBadRequest, "failed to provide vulnerability")
+	}
+
+	if request.Vulnerability.Name == "" {
+		return postVulnerabilityRoute, writeError(w, r, http.StatusBadRequest, "Vulnerability.Name must not be empty")
+	}
+
+	// The Namespace is taken from the URL when the body omits it, and must
+	// otherwise match it.
+	namespaceName := p.ByName("namespaceName")
+	if request.Vulnerability.NamespaceName == "" {
+		request.Vulnerability.NamespaceName = namespaceName
+	} else if request.Vulnerability.NamespaceName != namespaceName {
+		return postVulnerabilityRoute, writeError(w, r, http.StatusBadRequest, "Vulnerability.NamespaceName does not match the URL")
 	}
 
 	vuln, err := request.Vulnerability.DatabaseModel()
 	if err != nil {
-		writeResponse(w, r, http.StatusBadRequest, VulnerabilityEnvelope{Error: &Error{err.Error()}})
-		return postVulnerabilityRoute, http.StatusBadRequest
+		return postVulnerabilityRoute, writeError(w, r, http.StatusBadRequest, err.Error())
 	}
 
-	err = ctx.Store.InsertVulnerabilities([]database.Vulnerability{vuln}, true)
-	if err != nil {
-		switch err.(type) {
-		case *cerrors.ErrBadRequest:
-			writeResponse(w, r, http.StatusBadRequest, VulnerabilityEnvelope{Error: &Error{err.Error()}})
-			return postVulnerabilityRoute, http.StatusBadRequest
-		default:
-			writeResponse(w, r, http.StatusInternalServerError, VulnerabilityEnvelope{Error: &Error{err.Error()}})
-			return postVulnerabilityRoute, http.StatusInternalServerError
-		}
+	// The datastore refuses to create a vulnerability that exists, even concurrently.
+	err = ctx.Store.CreateVulnerability(r.Context(), vuln, true)
+	if err == database.ErrAlreadyExists {
+		return postVulnerabilityRoute, writeError(w, r, http.StatusConflict, "vulnerability already exists")
+	} else if err != nil {
+		return postVulnerabilityRoute, writeError(w, r, errorStatus(err), err.Error())
 	}
 
 	writeResponse(w, r, http.StatusCreated, VulnerabilityEnvelope{Vulnerability: request.Vulnerability})
@@ -284,15 +680,22 @@ func postVulnerability(w http.ResponseWriter, r *http.Request, p httprouter.Para
 }
 
 func getVulnerability(w http.ResponseWriter, r *http.Request, p httprouter.Params, ctx *context.RouteContext) (string, int) {
-	_, withFixedIn := r.URL.Query()["fixedIn"]
+	// A bare "?fixedIn" is kept working as an alias for "?fixedIn=true".
+	withFixedIn := false
+	if fixedInStrs, exists := r.URL.Query()["fixedIn"]; exists {
+		withFixedIn = true
+		if fixedInStrs[0] != "" {
+			var err error
+			withFixedIn, err = strconv.ParseBool(fixedInStrs[0])
+			if err != nil {
+				return getVulnerabilityRoute, writeError(w, r, http.StatusBadRequest, "invalid fixedIn format: "+err.Error())
+			}
+		}
+	}
 
-	dbVuln, err := ctx.Store.FindVulnerability(p.ByName("namespaceName"), p.ByName("vulnerabilityName"))
-	if err == cerrors.ErrNotFound {
-		writeResponse(w, r, http.StatusNotFound, VulnerabilityEnvelope{Error: &Error{err.Error()}})
-		return getVulnerabilityRoute, http.StatusNotFound
-	} else if err != nil {
-		writeResponse(w, r, http.StatusInternalServerError, VulnerabilityEnvelope{Error: &Error{err.Error()}})
-		return getVulnerabilityRoute, http.StatusInternalServerError
+	dbVuln, err := ctx.Store.FindVulnerability(r.Context(), p.ByName("namespaceName"), p.ByName("vulnerabilityName"))
+	if err != nil {
+		return getVulnerabilityRoute, writeError(w, r, errorStatus(err), err.Error())
 	}
 
 	vuln := VulnerabilityFromDatabaseModel(dbVuln, withFixedIn)
@@ -305,67 +708,151 @@ func putVulnerability(w http.ResponseWriter, r *http.Request, p httprouter.Param
 	request := VulnerabilityEnvelope{}
 	err := decodeJSON(r, &request)
 	if err != nil {
-		writeResponse(w, r, http.StatusBadRequest, VulnerabilityEnvelope{Error: &Error{err.Error()}})
-		return putVulnerabilityRoute, http.StatusBadRequest
+		return putVulnerabilityRoute, writeError(w, r, http.StatusBadRequest, err.Error())
 	}
 
 	if request.Vulnerability == nil {
-		writeResponse(w, r, http.StatusBadRequest, VulnerabilityEnvelope{Error: &Error{"failed to provide vulnerability"}})
-		return putVulnerabilityRoute, http.StatusBadRequest
+		return putVulnerabilityRoute, writeError(w, r, http.StatusBadRequest, "failed to provide vulnerability")
 	}
 
 	if len(request.Vulnerability.FixedIn) != 0 {
-		writeResponse(w, r, http.StatusBadRequest, VulnerabilityEnvelope{Error: &Error{"Vulnerability.FixedIn must be empty"}})
-		return putVulnerabilityRoute, http.StatusBadRequest
+		return putVulnerabilityRoute, writeError(w, r, http.StatusBadRequest, "Vulnerability.FixedIn must be empty")
 	}
 
 	vuln, err := request.Vulnerability.DatabaseModel()
 	if err != nil {
-		writeResponse(w, r, http.StatusBadRequest, VulnerabilityEnvelope{Error: &Error{err.Error()}})
-		return putVulnerabilityRoute, http.StatusBadRequest
+		return putVulnerabilityRoute, writeError(w, r, http.StatusBadRequest, err.Error())
 	}
 
 	vuln.Namespace.Name = p.ByName("namespaceName")
 	vuln.Name = p.ByName("vulnerabilityName")
 
-	err = ctx.Store.InsertVulnerabilities([]database.Vulnerability{vuln}, true)
+	err = ctx.Store.InsertVulnerabilities(r.Context(), []database.Vulnerability{vuln}, true)
 	if err != nil {
-		switch err.(type) {
-		case *cerrors.ErrBadRequest:
-			writeResponse(w, r, http.StatusBadRequest, VulnerabilityEnvelope{Error: &Error{err.Error()}})
-			return putVulnerabilityRoute, http.StatusBadRequest
-		default:
-			writeResponse(w, r, http.StatusInternalServerError, VulnerabilityEnvelope{Error: &Error{err.Error()}})
-			return putVulnerabilityRoute, http.StatusInternalServerError
-		}
+		return putVulnerabilityRoute, writeError(w, r, errorStatus(err), err.Error())
 	}
 
 	writeResponse(w, r, http.StatusOK, VulnerabilityEnvelope{Vulnerability: request.Vulnerability})
 	return putVulnerabilityRoute, http.StatusOK
 }
 
+func patchVulnerability(w http.ResponseWriter, r *http.Request, p httprouter.Params, ctx *context.RouteContext) (string, int) {
+	request := VulnerabilityEnvelope{}
+	err := decodeJSON(r, &request)
+	if err != nil {
+		return patchVulnerabilityRoute, writeError(w, r, http.StatusBadRequest, err.Error())
+	}
+
+	if request.Vulnerability == nil {
+		return patchVulnerabilityRoute, writeError(w, r, http.StatusBadRequest, "failed to provide vulnerability")
+	}
+
+	// A vulnerability is identified by its Name and Namespace, which can't be changed.
+	if request.Vulnerability.Name != "" && request.Vulnerability.Name != p.ByName("vulnerabilityName") {
+		return patchVulnerabilityRoute, writeError(w, r, http.StatusBadRequest, "Vulnerability.Name cannot be changed")
+	}
+	if request.Vulnerability.NamespaceName != "" && request.Vulnerability.NamespaceName != p.ByName("namespaceName") {
+		return patchVulnerabilityRoute, writeError(w, r, http.StatusBadRequest, "Vulnerability.NamespaceName cannot be changed")
+	}
+
+	// Only the fields that are present are updated, and FixedIn only lists the fixes that change.
+	var update database.VulnerabilityUpdate
+	if request.Vulnerability.Description != "" {
+		update.Description = &request.Vulnerability.Description
+	}
+	if request.Vulnerability.Link != "" {
+		update.Link = &request.Vulnerability.Link
+	}
+	if request.Vulnerability.Severity != "" {
+		severity := types.Priority(request.Vulnerability.Severity)
+		if !severity.IsValid() {
+			return patchVulnerabilityRoute, writeError(w, r, http.StatusBadRequest, "Invalid severity")
+		}
+		update.Severity = &severity
+	}
+	for _, fix := range request.Vulnerability.FixedIn {
+		// A fix always belongs to the Namespace of its Vulnerability.
+		if fix.NamespaceName == "" {
+			fix.NamespaceName = p.ByName("namespaceName")
+		}
+
+		dbFix, err := fix.DatabaseModel()
+		if err != nil {
+			return patchVulnerabilityRoute, writeError(w, r, http.StatusBadRequest, err.Error())
+		}
+		update.FixedIn = append(update.FixedIn, dbFix)
+	}
+
+	// Like the updater, the datastore links the affected features again and notifies the change.
+	dbVuln, err := ctx.Store.UpdateVulnerability(r.Context(), p.ByName("namespaceName"), p.ByName("vulnerabilityName"), update)
+	if err != nil {
+		return patchVulnerabilityRoute, writeError(w, r, errorStatus(err), err.Error())
+	}
+
+	vuln := VulnerabilityFromDatabaseModel(dbVuln, true)
+
+	writeResponse(w, r, http.StatusOK, VulnerabilityEnvelope{Vulnerability: &vuln})
+	return patchVulnerabilityRoute, http.StatusOK
+}
+
 func deleteVulnerability(w http.ResponseWriter, r *http.Request, p httprouter.Params, ctx *context.RouteContext) (string, int) {
-	err := ctx.Store.DeleteVulnerability(p.ByName("namespaceName"), p.ByName("vulnerabilityName"))
-	if err == cerrors.ErrNotFound {
-		writeResponse(w, r, http.StatusNotFound, VulnerabilityEnvelope{Error: &Error{err.Error()}})
-		return deleteVulnerabilityRoute, http.StatusNotFound
-	} else if err != nil {
-		writeResponse(w, r, http.StatusInternalServerError, VulnerabilityEnvelope{Error: &Error{err.Error()}})
-		return deleteVulnerabilityRoute, http.StatusInternalServerError
+	err := ctx.Store.DeleteVulnerability(r.Context(), p.ByName("namespaceName"), p.ByName("vulnerabilityName"))
+	if err != nil {
+		return deleteVulnerabilityRoute, writeError(w, r, errorStatus(err), err.Error())
 	}
 
 	w.WriteHeader(http.StatusOK)
 	return deleteVulnerabilityRoute, http.StatusOK
 }
 
+func getAffectedLayers(w http.ResponseWriter, r *http.Request, p httprouter.Params, ctx *context.RouteContext) (string, int) {
+	query := r.URL.Query()
+
+	limit, err := parseLimit(query, ctx.Config.MaxPageSize)
+	if err != nil {
+		return getAffectedLayersRoute, writeError(w, r, http.StatusBadRequest, err.Error())
+	}
+
+	// The page token is the ID of the last layer of the previous page.
+	startAfterID := 0
+	if pageStrs, pageExists := query["page"]; pageExists {
+		err = tokenUnmarshal(pageStrs[0], ctx.Config.PaginationKey, &startAfterID)
+		if err != nil {
+			return getAffectedLayersRoute, writeError(w, r, http.StatusBadRequest, "invalid page format: "+err.Error())
+		}
+	}
+
+	// Ask for one more layer to know whether there is a next page.
+	dbLayers, total, err := ctx.Store.GetAffectedLayers(r.Context(), p.ByName("namespaceName"), p.ByName("vulnerabilityName"), limit+1, startAfterID)
+	if err != nil {
+		return getAffectedLayersRoute, writeError(w, r, errorStatus(err), err.Error())
+	}
+
+	var nextPageStr string
+	if len(dbLayers) > limit {
+		dbLayers = dbLayers[:limit]
+
+		nextPageBytes, err := tokenMarshal(dbLayers[limit-1].ID, ctx.Config.PaginationKey)
+		if err != nil {
+			return getAffectedLayersRoute, writeError(w, r, http.StatusInternalServerError, "failed to marshal token: "+err.Error())
+		}
+		nextPageStr = string(nextPageBytes)
+	}
+
+	layers := make([]Layer, 0, len(dbLayers))
+	for _, dbLayer := range dbLayers {
+		layers = append(layers, Layer{Name: dbLayer.Name})
+	}
+
+	w.Header().Set(totalCountHeader, strconv.Itoa(total))
+	writeResponse(w, r, http.StatusOK, AffectedLayersEnvelope{Layers: &layers, NextPage: nextPageStr})
+	return getAffectedLayersRoute, http.StatusOK
+}
+
 func getFixes(w http.ResponseWriter, r *http.Request, p httprouter.Params, ctx *context.RouteContext) (string, int) {
-	dbVuln, err := ctx.Store.FindVulnerability(p.ByName("namespaceName"), p.ByName("vulnerabilityName"))
-	if err == cerrors.ErrNotFound {
-		writeResponse(w, r, http.StatusNotFound, FeatureEnvelope{Error: &Error{err.Error()}})
-		return getFixesRoute, http.StatusNotFound
-	} else if err != nil {
-		writeResponse(w, r, http.StatusInternalServerError, FeatureEnvelope{Error: &Error{err.Error()}})
-		return getFixesRoute, http.StatusInternalServerError
+	dbVuln, err := ctx.Store.FindVulnerability(r.Context(), p.ByName("namespaceName"), p.ByName("vulnerabilityName"))
+	if err != nil {
+		return getFixesRoute, writeError(w, r, errorStatus(err), err.Error())
 	}
 
 	vuln := VulnerabilityFromDatabaseModel(dbVuln, true)
@@ -377,40 +864,30 @@ func putFix(w http.ResponseWriter, r *http.Request, p httprouter.Params, ctx *co
 	request := FeatureEnvelope{}
 	err := decodeJSON(r, &request)
 	if err != nil {
-		writeResponse(w, r, http.StatusBadRequest, FeatureEnvelope{Error: &Error{err.Error()}})
-		return putFixRoute, http.StatusBadRequest
+		return putFixRoute, writeError(w, r, http.StatusBadRequest, err.Error())
 	}
 
 	if request.Feature == nil {
-		writeResponse(w, r, http.StatusBadRequest, FeatureEnvelope{Error: &Error{"failed to provide feature"}})
-		return putFixRoute, http.StatusBadRequest
+		return putFixRoute, writeError(w, r, http.StatusBadRequest, "failed to provide feature")
 	}
 
 	if request.Feature.Name != p.ByName("fixName") {
-		writeResponse(w, r, http.StatusBadRequest, FeatureEnvelope{Error: &Error{"feature name in URL and JSON do not match"}})
-		return putFixRoute, http.StatusBadRequest
+		return putFixRoute, writeError(w, r, http.StatusBadRequest, "feature name in URL and JSON do not match")
+	}
+
+	// A fix always belongs to the Namespace of its Vulnerability.
+	if request.Feature.NamespaceName == "" {
+		request.Feature.NamespaceName = p.ByName("namespaceName")
 	}
 
 	dbFix, err := request.Feature.DatabaseModel()
 	if err != nil {
-		writeResponse(w, r, http.StatusBadRequest, FeatureEnvelope{Error: &Error{err.Error()}})
-		return putFixRoute, http.StatusBadRequest
+		return putFixRoute, writeError(w, r, http.StatusBadRequest, err.Error())
 	}
 
-	err = ctx.Store.InsertVulnerabilityFixes(p.ByName("vulnerabilityNamespace"), p.ByName("vulnerabilityName"), []database.FeatureVersion{dbFix})
+	err = ctx.Store.InsertVulnerabilityFixes(r.Context(), p.ByName("namespaceName"), p.ByName("vulnerabilityName"), []database.FeatureVersion{dbFix})
 	if err != nil {
-		switch err.(type) {
-		case *cerrors.ErrBadRequest:
-			writeResponse(w, r, http.StatusBadRequest, FeatureEnvelope{Error: &Error{err.Error()}})
-			return putFixRoute, http.StatusBadRequest
-		default:
-			if err == cerrors.ErrNotFound {
-				writeResponse(w, r, http.StatusNotFound, FeatureEnvelope{Error: &Error{err.Error()}})
-				return putFixRoute, http.StatusNotFound
-			}
-			writeResponse(w, r, http.StatusInternalServerError, FeatureEnvelope{Error: &Error{err.Error()}})
-			return putFixRoute, http.StatusInternalServerError
-		}
+		return putFixRoute, writeError(w, r, errorStatus(err), err.Error())
 	}
 
 	writeResponse(w, r, http.StatusOK, FeatureEnvelope{Feature: request.Feature})
@@ -418,13 +895,26 @@ func putFix(w http.ResponseWriter, r *http.Request, p httprouter.Params, ctx *co
 }
 
 func deleteFix(w http.ResponseWriter, r *http.Request, p httprouter.Params, ctx *context.RouteContext) (string, int) {
-	err := ctx.Store.DeleteVulnerabilityFix(p.ByName("vulnerabilityNamespace"), p.ByName("vulnerabilityName"), p.ByName("fixName"))
-	if err == cerrors.ErrNotFound {
-		writeResponse(w, r, http.StatusNotFound, FeatureEnvelope{Error: &Error{err.Error()}})
-		return deleteFixRoute, http.StatusNotFound
-	} else if err != nil {
-		writeResponse(w, r, http.StatusInternalServerError, FeatureEnvelope{Error: &Error{err.Error()}})
-		return deleteFixRoute, http.StatusInternalServerError
+	dbVuln, err := ctx.Store.FindVulnerability(r.Context(), p.ByName("namespaceName"), p.ByName("vulnerabilityName"))
+	if err != nil {
+		return deleteFixRoute, writeError(w, r, errorStatus(err), err.Error())
+	}
+
+	// Removing a Feature that is not listed would silently succeed in the datastore.
+	var isFixed bool
+	for _, fix := range dbVuln.FixedIn {
+		if fix.Feature.Name == p.ByName("fixName") {
+			isFixed = true
+			break
+		}
+	}
+	if !isFixed {
+		return deleteFixRoute, writeError(w, r, http.StatusNotFound, cerrors.ErrNotFound.Error())
+	}
+
+	err = ctx.Store.DeleteVulnerabilityFix(r.Context(), p.ByName("namespaceName"), p.ByName("vulnerabilityName"), p.ByName("fixName"))
+	if err != nil {
+		return deleteFixRoute, writeError(w, r, errorStatus(err), err.Error())
 	}
 
 	w.WriteHeader(http.StatusOK)
@@ -434,15 +924,9 @@ func deleteFix(w http.ResponseWriter, r *http.Request, p httprouter.Params, ctx
 func getNotification(w http.ResponseWriter, r *http.Request, p httprouter.Params, ctx *context.RouteContext) (string, int) {
 	query := r.URL.Query()
 
-	limitStrs, limitExists := query["limit"]
-	if !limitExists {
-		writeResponse(w, r, http.StatusBadRequest, NotificationEnvelope{Error: &Error{"must provide limit query parameter"}})
-		return getNotificationRoute, http.StatusBadRequest
-	}
-	limit, err := strconv.Atoi(limitStrs[0])
+	limit, err := parseLimit(query, ctx.Config.MaxPageSize)
 	if err != nil {
-		writeResponse(w, r, http.StatusBadRequest, NotificationEnvelope{Error: &Error{"invalid limit format: " + err.Error()}})
-		return getNotificationRoute, http.StatusBadRequest
+		return getNotificationRoute, writeError(w, r, http.StatusBadRequest, err.Error())
 	}
 
 	var pageToken string
@@ -451,26 +935,20 @@ func getNotification(w http.ResponseWriter, r *http.Request, p httprouter.Params
 	if pageExists {
 		err := tokenUnmarshal(pageStrs[0], ctx.Config.PaginationKey, &page)
 		if err != nil {
-			writeResponse(w, r, http.StatusBadRequest, NotificationEnvelope{Error: &Error{"invalid page format: " + err.Error()}})
-			return getNotificationRoute, http.StatusBadRequest
+			return getNotificationRoute, writeError(w, r, http.StatusBadRequest, "invalid page format: "+err.Error())
 		}
 		pageToken = pageStrs[0]
 	} else {
 		pageTokenBytes, err := tokenMarshal(page, ctx.Config.PaginationKey)
 		if err != nil {
-			writeResponse(w, r, http.StatusBadRequest, NotificationEnvelope{Error: &Error{"failed to marshal token: " + err.Error()}})
-			return getNotificationRoute, http.StatusBadRequest
+			return getNotificationRoute, writeError(w, r, http.StatusInternalServerError, "failed to marshal token: "+err.Error())
 		}
 		pageToken = string(pageTokenBytes)
 	}
 
-	dbNotification, nextPage, err := ctx.Store.GetNotification(p.ByName("notificationName"), limit, page)
-	if err == cerrors.ErrNotFound {
-		writeResponse(w, r, http.StatusNotFound, NotificationEnvelope{Error: &Error{err.Error()}})
-		return deleteNotificationRoute, http.StatusNotFound
-	} else if err != nil {
-		writeResponse(w, r, http.StatusInternalServerError, NotificationEnvelope{Error: &Error{err.Error()}})
-		return getNotificationRoute, http.StatusInternalServerError
+	dbNotification, nextPage, err := ctx.Store.GetNotification(r.Context(), p.ByName("notificationName"), limit, page)
+	if err != nil {
+		return getNotificationRoute, writeError(w, r, errorStatus(err), err.Error())
 	}
 
 	notification := NotificationFromDatabaseModel(dbNotification, limit, pageToken, nextPage, ctx.Config.PaginationKey)
@@ -480,19 +958,86 @@ func getNotification(w http.ResponseWriter, r *http.Request, p httprouter.Params
 }
 
 func deleteNotification(w http.ResponseWriter, r *http.Request, p httprouter.Params, ctx *context.RouteContext) (string, int) {
-	err := ctx.Store.DeleteNotification(p.ByName("notificationName"))
-	if err == cerrors.ErrNotFound {
-		writeResponse(w, r, http.StatusNotFound, NotificationEnvelope{Error: &Error{err.Error()}})
-		return deleteNotificationRoute, http.StatusNotFound
-	} else if err != nil {
-		writeResponse(w, r, http.StatusInternalServerError, NotificationEnvelope{Error: &Error{err.Error()}})
-		return deleteNotificationRoute, http.StatusInternalServerError
+	err := ctx.Store.DeleteNotification(r.Context(), p.ByName("notificationName"))
+	if err != nil {
+		return deleteNotificationRoute, writeError(w, r, errorStatus(err), err.Error())
 	}
 
 	w.WriteHeader(http.StatusOK)
 	return deleteNotificationRoute, http.StatusOK
 }
 
+func postUpdaterRun(w http.ResponseWriter, r *http.Request, p httprouter.Params, ctx *context.RouteContext) (string, int) {
+	// The update outlives the request, but keeps its ID for the logs.
+	updateCtx := utils.ContextWithRequestID(stdcontext.Background(), context.RequestID(r))
+
+	runID, err := updater.Trigger(updateCtx, ctx.Store)
+	if err == updater.ErrUpdateInProgress {
+		return postUpdaterRunRoute, writeError(w, r, http.StatusConflict, err.Error())
+	}
+	if err != nil {
+		return postUpdaterRunRoute, writeError(w, r, errorStatus(err), err.Error())
+	}
+
+	writeResponse(w, r, http.StatusAccepted, UpdaterEnvelope{Run: &UpdaterRun{ID: runID}})
+	return postUpdaterRunRoute, http.StatusAccepted
+}
+
+func getUpdaterStatus(w http.ResponseWriter, r *http.Request, p httprouter.Params, ctx *context.RouteContext) (string, int) {
+	status, err := updater.GetStatus(r.Context(), ctx.Store)
+	if err != nil {
+		return getUpdaterStatusRoute, writeError(w, r, errorStatus(err), err.Error())
+	}
+
+	updaterStatus := UpdaterStatusFromModel(status)
+	writeResponse(w, r, http.StatusOK, UpdaterEnvelope{Status: &updaterStatus})
+	return getUpdaterStatusRoute, http.StatusOK
+}
+
+// newGetInfo creates the handler of the server info, which is cached for infoCacheDuration.
+func newGetInfo() context.Handler {
+	var (
+		lock    sync.Mutex
+		info    ServerInfo
+		expires time.Time
+	)
+
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params, ctx *context.RouteContext) (string, int) {
+		// The lock isn't held while the datastore is queried, so that a slow datastore doesn't hold
+		// back the other requests: they query it as well until the info is cached.
+		lock.Lock()
+		cached, expired := info, time.Now().After(expires)
+		lock.Unlock()
+
+		if expired {
+			lastUpdate, err := updater.LastUpdate(r.Context(), ctx.Store)
+			if err != nil {
+				return getInfoRoute, writeError(w, r, errorStatus(err), err.Error())
+			}
+
+			namespaces, err := ctx.Store.ListNamespaces(r.Context())
+			if err != nil {
+				return getInfoRoute, writeError(w, r, errorStatus(err), err.Error())
+			}
+
+			cached = ServerInfo{
+				Version:       utils.Version,
+				EngineVersion: worker.Version,
+				LastUpdate:    unixTimestamp(lastUpdate),
+				Namespaces:    len(namespaces),
+				Detectors:     worker.DetectorNames(),
+			}
+
+			lock.Lock()
+			info, expires = cached, time.Now().Add(infoCacheDuration)
+			lock.Unlock()
+		}
+
+		writeResponse(w, r, http.StatusOK, cached)
+		return getInfoRoute, http.StatusOK
+	}
+}
+
 func getMetrics(w http.ResponseWriter, r *http.Request, p httprouter.Params, ctx *context.RouteContext) (string, int) {
 	prometheus.Handler().ServeHTTP(w, r)
 	return getMetricsRoute, 0
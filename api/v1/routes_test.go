@@ -0,0 +1,1513 @@
+// Copyright 2015 clair authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v1
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	stdcontext "context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fernet/fernet-go"
+	"github.com/julienschmidt/httprouter"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/coreos/clair/api/context"
+	"github.com/coreos/clair/config"
+	"github.com/coreos/clair/database"
+	_ "github.com/coreos/clair/database/sqlite"
+	"github.com/coreos/clair/utils"
+	cerrors "github.com/coreos/clair/utils/errors"
+	"github.com/coreos/clair/utils/types"
+	"github.com/coreos/clair/worker"
+
+	// Register the detectors that index the test layers.
+	_ "github.com/coreos/clair/worker/detectors/data/docker"
+	_ "github.com/coreos/clair/worker/detectors/feature/dpkg"
+	_ "github.com/coreos/clair/worker/detectors/namespace/osrelease"
+)
+
+// newLayerServer serves tarballs containing the given files, by layer name.
+func newLayerServer(t *testing.T, layers map[string]map[string]string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		files, exists := layers[strings.TrimPrefix(r.URL.Path, "/")]
+		if !exists {
+			http.NotFound(w, r)
+			return
+		}
+
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		for name, content := range files {
+			assert.Nil(t, tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content))}))
+			_, err := tw.Write([]byte(content))
+			assert.Nil(t, err)
+		}
+		assert.Nil(t, tw.Close())
+		w.Write(buf.Bytes())
+	}))
+}
+
+// newLayerDatastore stores layers in memory, failing to insert them with insertErr if it is set.
+func newLayerDatastore(insertErr error) *database.MockDatastore {
+	layers := make(map[string]database.Layer)
+	return &database.MockDatastore{
+		FctFindLayer: func(ctx stdcontext.Context, name string, withFeatures, withVulnerabilities bool, minSeverity types.Priority) (database.Layer, error) {
+			if layer, exists := layers[name]; exists {
+				return layer, nil
+			}
+			return database.Layer{}, cerrors.ErrNotFound
+		},
+		FctInsertLayer: func(ctx stdcontext.Context, layer database.Layer) error {
+			if insertErr != nil {
+				return insertErr
+			}
+			layers[layer.Name] = layer
+			return nil
+		},
+	}
+}
+
+func postLayerForTest(t *testing.T, store database.Datastore, body string) (int, LayerEnvelope) {
+	ctx := &context.RouteContext{Store: store, Config: &config.APIConfig{}}
+
+	w := httptest.NewRecorder()
+	NewRouter(ctx).ServeHTTP(w, httptest.NewRequest("POST", "/layers", strings.NewReader(body)))
+
+	var envelope LayerEnvelope
+	assert.Nil(t, json.NewDecoder(w.Body).Decode(&envelope))
+	return w.Code, envelope
+}
+
+func TestPostLayer(t *testing.T) {
+	server := newLayerServer(t, map[string]map[string]string{
+		"debian": {
+			"etc/os-release": "ID=debian\nVERSION_ID=\"8\"\n",
+		},
+		"no-namespace": {
+			"var/lib/dpkg/status": "Package: openssl\nStatus: install ok installed\nVersion: 1.0.1\n",
+		},
+	})
+	defer server.Close()
+
+	layerBody := func(name, path, format string) string {
+		b, _ := json.Marshal(LayerEnvelope{Layer: &Layer{Name: name, Path: path, Format: format}})
+		return string(b)
+	}
+
+	// The layer is indexed and stored.
+	store := newLayerDatastore(nil)
+	status, envelope := postLayerForTest(t, store, layerBody("layer", server.URL+"/debian", "Docker"))
+	if assert.Equal(t, http.StatusCreated, status) && assert.NotNil(t, envelope.Layer) {
+		assert.Equal(t, "layer", envelope.Layer.Name)
+		assert.Equal(t, "debian:8", envelope.Layer.NamespaceName)
+		assert.Equal(t, worker.Version, envelope.Layer.IndexedByVersion)
+		assert.Equal(t, server.URL+"/debian", envelope.Layer.Path)
+	}
+	stored, err := store.FindLayer(stdcontext.Background(), "layer", false, false, types.Unknown)
+	if assert.Nil(t, err) && assert.NotNil(t, stored.Namespace) {
+		assert.Equal(t, "debian:8", stored.Namespace.Name)
+	}
+
+	// Features without namespace are reported, but the layer is stored so that its children can be
+	// processed.
+	status, envelope = postLayerForTest(t, store, layerBody("no-namespace", server.URL+"/no-namespace", "Docker"))
+	assert.Equal(t, statusUnprocessableEntity, status)
+	if assert.NotNil(t, envelope.Error) {
+		assert.Equal(t, worker.ErrCouldNotFindNamespace.Error(), envelope.Error.Message)
+	}
+	if assert.NotNil(t, envelope.Layer) {
+		assert.Equal(t, "no-namespace", envelope.Layer.Name)
+		assert.Empty(t, envelope.Layer.NamespaceName)
+	}
+	b, _ := json.Marshal(LayerEnvelope{Layer: &Layer{Name: "child", ParentName: "no-namespace", Path: server.URL + "/debian", Format: "Docker"}})
+	status, _ = postLayerForTest(t, store, string(b))
+	assert.Equal(t, http.StatusCreated, status)
+
+	for _, test := range []struct {
+		body     string
+		store    database.Datastore
+		expected int
+		message  string
+	}{
+		// Malformed requests.
+		{`{"Layer":`, newLayerDatastore(nil), http.StatusBadRequest, ""},
+		{`{}`, newLayerDatastore(nil), http.StatusBadRequest, ""},
+		{layerBody("", server.URL+"/debian", "Docker"), newLayerDatastore(nil), http.StatusBadRequest, ""},
+		{layerBody("layer", "", "Docker"), newLayerDatastore(nil), http.StatusBadRequest, ""},
+		// Invalid names.
+		{layerBody("library/debian", server.URL+"/debian", "Docker"), newLayerDatastore(nil), http.StatusBadRequest, `invalid layer name "library/debian": it must be a digest, such as sha256:<hex>, or 1 to 256 letters, digits, '_', '.' and '-'`},
+		{layerBody("débian", server.URL+"/debian", "Docker"), newLayerDatastore(nil), http.StatusBadRequest, ""},
+		{layerBody("layer name", server.URL+"/debian", "Docker"), newLayerDatastore(nil), http.StatusBadRequest, ""},
+		{layerBody(strings.Repeat("a", 300), server.URL+"/debian", "Docker"), newLayerDatastore(nil), http.StatusBadRequest, ""},
+		// Unsupported image format.
+		{layerBody("layer", server.URL+"/debian", "Unknown"), newLayerDatastore(nil), http.StatusBadRequest, worker.ErrUnsupportedImageFormat.Error()},
+		// Unknown parent.
+		{`{"Layer": {"Name": "layer", "ParentName": "unknown", "Path": "` + server.URL + `/debian", "Format": "Docker"}}`, newLayerDatastore(nil), http.StatusBadRequest, worker.ErrParentUnknown.Error()},
+		// Download failure, which reports the status of the server.
+		{layerBody("layer", server.URL+"/missing", "Docker"), newLayerDatastore(nil), http.StatusBadGateway, "could not download layer: the server answered 404 Not Found"},
+		// Datastore failure.
+		{layerBody("layer", server.URL+"/debian", "Docker"), newLayerDatastore(errors.New("database is down")), http.StatusInternalServerError, ""},
+	} {
+		status, envelope := postLayerForTest(t, test.store, test.body)
+		assert.Equal(t, test.expected, status, test.body)
+		if assert.NotNil(t, envelope.Error, test.body) {
+			assert.NotEmpty(t, envelope.Error.Message, test.body)
+			if test.message != "" {
+				assert.Equal(t, test.message, envelope.Error.Message, test.body)
+			}
+		}
+		assert.Nil(t, envelope.Layer, test.body)
+	}
+
+	// The layer is read back from the primary database, as a read replica may not have it yet.
+	store = newLayerDatastore(nil)
+	findLayer := store.FctFindLayer
+	store.FctFindLayer = func(ctx stdcontext.Context, name string, withFeatures, withVulnerabilities bool, minSeverity types.Priority) (database.Layer, error) {
+		if !database.PrimaryFromContext(ctx) {
+			return database.Layer{}, cerrors.ErrNotFound
+		}
+		return findLayer(ctx, name, withFeatures, withVulnerabilities, minSeverity)
+	}
+	status, envelope = postLayerForTest(t, store, layerBody("layer", server.URL+"/debian", "Docker"))
+	if assert.Equal(t, http.StatusCreated, status) && assert.NotNil(t, envelope.Layer) {
+		assert.Equal(t, "debian:8", envelope.Layer.NamespaceName)
+	}
+}
+
+func TestGetLayerWithLegacyName(t *testing.T) {
+	store, closeStore := openDatastoreForTest(t)
+	defer closeStore()
+
+	// The layers stored before the names were restricted remain readable and deletable.
+	assert.Nil(t, store.InsertLayer(stdcontext.Background(), database.Layer{Name: "légacy+layer", EngineVersion: worker.Version}))
+	router := NewRouter(&context.RouteContext{Store: store, Config: &config.APIConfig{}})
+
+	for _, method := range []string{"GET", "DELETE"} {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(method, "/layers/"+url.PathEscape("légacy+layer"), nil))
+		assert.Equal(t, http.StatusOK, w.Code, method)
+	}
+}
+
+func TestPostLocalLayer(t *testing.T) {
+	dir := t.TempDir()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	content := "ID=debian\nVERSION_ID=\"8\"\n"
+	assert.Nil(t, tw.WriteHeader(&tar.Header{Name: "etc/os-release", Mode: 0644, Size: int64(len(content))}))
+	tw.Write([]byte(content))
+	assert.Nil(t, tw.Close())
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "layer.tar"), buf.Bytes(), 0644))
+
+	post := func(config *config.APIConfig, path string) int {
+		b, _ := json.Marshal(LayerEnvelope{Layer: &Layer{Name: "layer", Path: path, Format: "Docker"}})
+		w := httptest.NewRecorder()
+		router := NewRouter(&context.RouteContext{Store: newLayerDatastore(nil), Config: config})
+		router.ServeHTTP(w, httptest.NewRequest("POST", "/layers", bytes.NewReader(b)))
+		return w.Code
+	}
+
+	allowed := &config.APIConfig{LocalPathsAllowed: true, LocalPathPrefixes: []string{dir}}
+	assert.Equal(t, http.StatusCreated, post(allowed, filepath.Join(dir, "layer.tar")))
+	assert.Equal(t, http.StatusCreated, post(allowed, "file://"+filepath.Join(dir, "layer.tar")))
+	assert.Equal(t, http.StatusBadRequest, post(allowed, dir+"/../../etc/passwd"))
+
+	// The directories are ignored unless local paths are allowed.
+	assert.Equal(t, http.StatusBadRequest, post(&config.APIConfig{LocalPathPrefixes: []string{dir}}, filepath.Join(dir, "layer.tar")))
+}
+
+func TestDeleteLayer(t *testing.T) {
+	type call struct {
+		name      string
+		recursive bool
+	}
+
+	for _, test := range []struct {
+		query    string
+		err      error
+		expected int
+		calls    []call
+	}{
+		{"", nil, http.StatusOK, []call{{"layer", false}}},
+		{"?recursive=true", nil, http.StatusOK, []call{{"layer", true}}},
+		{"?recursive=false", database.ErrLayerHasChildren, http.StatusConflict, []call{{"layer", false}}},
+		{"?recursive=maybe", nil, http.StatusBadRequest, nil},
+		{"", cerrors.ErrNotFound, http.StatusNotFound, []call{{"layer", false}}},
+		{"", errors.New("database is down"), http.StatusInternalServerError, []call{{"layer", false}}},
+	} {
+		var calls []call
+		store := &database.MockDatastore{
+			FctDeleteLayer: func(ctx stdcontext.Context, name string, recursive bool) error {
+				calls = append(calls, call{name, recursive})
+				return test.err
+			},
+		}
+		ctx := &context.RouteContext{Store: store, Config: &config.APIConfig{}}
+
+		w := httptest.NewRecorder()
+		NewRouter(ctx).ServeHTTP(w, httptest.NewRequest("DELETE", "/layers/layer"+test.query, nil))
+
+		assert.Equal(t, test.expected, w.Code, test.query)
+		assert.Equal(t, test.calls, calls, test.query)
+		if test.expected == http.StatusOK {
+			assert.Empty(t, w.Body.String(), test.query)
+			continue
+		}
+
+		var envelope LayerEnvelope
+		if assert.Nil(t, json.NewDecoder(w.Body).Decode(&envelope), test.query) && assert.NotNil(t, envelope.Error, test.query) {
+			assert.NotEmpty(t, envelope.Error.Message, test.query)
+		}
+	}
+}
+
+func TestGetInfo(t *testing.T) {
+	store, closeStore := openDatastoreForTest(t)
+	defer closeStore()
+
+	router := NewRouter(&context.RouteContext{Store: store, Config: &config.APIConfig{}})
+	getInfo := func() ServerInfo {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		var info ServerInfo
+		assert.Nil(t, json.NewDecoder(w.Body).Decode(&info))
+		return info
+	}
+
+	// The key-value table and the namespaces are empty.
+	assert.Equal(t, ServerInfo{Version: utils.Version, EngineVersion: worker.Version, Detectors: worker.DetectorNames()}, getInfo())
+
+	// The info is cached.
+	assert.Nil(t, store.InsertKeyValue(stdcontext.Background(), "updater/last", "1500000000"))
+	assert.Nil(t, store.InsertVulnerabilities(stdcontext.Background(), []database.Vulnerability{{
+		Name:      "CVE-INFO",
+		Namespace: database.Namespace{Name: "debian:8"},
+		Severity:  types.Low,
+	}}, false))
+	assert.Equal(t, ServerInfo{Version: utils.Version, EngineVersion: worker.Version, Detectors: worker.DetectorNames()}, getInfo())
+
+	router = NewRouter(&context.RouteContext{Store: store, Config: &config.APIConfig{}})
+	assert.Equal(t, ServerInfo{Version: utils.Version, EngineVersion: worker.Version, LastUpdate: "1500000000", Namespaces: 1, Detectors: worker.DetectorNames()}, getInfo())
+}
+
+func TestGetInfoSlowDatastore(t *testing.T) {
+	// The datastore answers once it is released, or once the request is canceled.
+	release := make(chan struct{})
+	queried := make(chan struct{}, 2)
+	var listed int
+	store := &database.MockDatastore{
+		FctGetKeyValue: func(ctx stdcontext.Context, key string) (string, error) {
+			return "", cerrors.ErrNotFound
+		},
+		FctListNamespaces: func(ctx stdcontext.Context) ([]database.Namespace, error) {
+			queried <- struct{}{}
+			select {
+			case <-release:
+				listed++
+				return []database.Namespace{{Name: "debian:8"}}, nil
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		},
+	}
+	router := NewRouter(&context.RouteContext{Store: store, Config: &config.APIConfig{}})
+
+	slow := make(chan int)
+	go func() {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+		slow <- w.Code
+	}()
+	<-queried
+
+	// A request doesn't wait for the one that queries the datastore, and honors its own context.
+	reqCtx, cancel := stdcontext.WithCancel(stdcontext.Background())
+	done := make(chan struct{})
+	go func() {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", "/", nil).WithContext(reqCtx))
+		assert.NotEqual(t, http.StatusOK, w.Code)
+		close(done)
+	}()
+	<-queried
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the request waited for the one that queries the datastore")
+	}
+
+	// Once the datastore answers, the info is cached.
+	close(release)
+	assert.Equal(t, http.StatusOK, <-slow)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	var info ServerInfo
+	if assert.Equal(t, http.StatusOK, w.Code) && assert.Nil(t, json.NewDecoder(w.Body).Decode(&info)) {
+		assert.Equal(t, 1, info.Namespaces)
+	}
+	assert.Equal(t, 1, listed)
+}
+
+func TestHeadLayer(t *testing.T) {
+	store, closeStore := openDatastoreForTest(t)
+	defer closeStore()
+
+	assert.Nil(t, store.InsertLayer(stdcontext.Background(), database.Layer{Name: "layer", EngineVersion: worker.Version}))
+	router := NewRouter(&context.RouteContext{Store: store, Config: &config.APIConfig{}})
+
+	for name, expected := range map[string]int{
+		"layer":   http.StatusOK,
+		"unknown": http.StatusNotFound,
+	} {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("HEAD", "/layers/"+name, nil))
+		assert.Equal(t, expected, w.Code, name)
+		assert.Equal(t, 0, w.Body.Len(), name)
+	}
+}
+
+func TestGetNamespaces(t *testing.T) {
+	getNamespaces := func(store database.Datastore, query string) (int, string) {
+		ctx := &context.RouteContext{Store: store, Config: &config.APIConfig{}}
+
+		w := httptest.NewRecorder()
+		NewRouter(ctx).ServeHTTP(w, httptest.NewRequest("GET", "/namespaces"+query, nil))
+		return w.Code, strings.TrimSpace(w.Body.String())
+	}
+
+	store := &database.MockDatastore{
+		FctListNamespaces: func(ctx stdcontext.Context) ([]database.Namespace, error) {
+			return []database.Namespace{{Name: "debian:9"}, {Name: "centos:7", VersionFormat: types.RpmVersionFormat}, {Name: "debian:8"}}, nil
+		},
+		FctCountVulnerabilitiesByNamespace: func(ctx stdcontext.Context) (map[string]int, error) {
+			return map[string]int{"debian:8": 12, "debian:9": 3}, nil
+		},
+	}
+
+	status, body := getNamespaces(store, "")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, `{"Namespaces":[{"Name":"centos:7","VersionFormat":"rpm"},{"Name":"debian:8"},{"Name":"debian:9"}]}`, body)
+
+	status, body = getNamespaces(store, "?vulnerabilityCounts=true")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, `{"Namespaces":[{"Name":"centos:7","VersionFormat":"rpm","VulnerabilityCount":0},{"Name":"debian:8","VulnerabilityCount":12},{"Name":"debian:9","VulnerabilityCount":3}]}`, body)
+
+	status, _ = getNamespaces(store, "?vulnerabilityCounts=lots")
+	assert.Equal(t, http.StatusBadRequest, status)
+
+	// A fresh database has no namespace.
+	empty := &database.MockDatastore{
+		FctListNamespaces: func(ctx stdcontext.Context) ([]database.Namespace, error) {
+			return nil, nil
+		},
+	}
+	status, body = getNamespaces(empty, "")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, `{"Namespaces":[]}`, body)
+
+	failing := &database.MockDatastore{
+		FctListNamespaces: func(ctx stdcontext.Context) ([]database.Namespace, error) {
+			return nil, errors.New("database is down")
+		},
+	}
+	status, body = getNamespaces(failing, "")
+	assert.Equal(t, http.StatusInternalServerError, status)
+	assert.Equal(t, `{"Error":{"Message":"database is down"}}`, body)
+}
+
+// openDatastoreForTest opens a SQLite datastore in a temporary directory, which is removed by the
+// returned function.
+func openDatastoreForTest(t *testing.T) (database.Datastore, func()) {
+	dir, err := ioutil.TempDir("", "clair-api")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := database.Open(config.RegistrableComponentConfig{
+		Type:    "sqlite",
+		Options: map[string]interface{}{"path": filepath.Join(dir, "clair.db")},
+	})
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+
+	return store, func() {
+		store.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestVulnerabilityLifecycle(t *testing.T) {
+	store, closeStore := openDatastoreForTest(t)
+	defer closeStore()
+
+	router := NewRouter(&context.RouteContext{Store: store, Config: &config.APIConfig{}})
+	do := func(method, path, body string) (int, VulnerabilityEnvelope) {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+
+		var envelope VulnerabilityEnvelope
+		if w.Body.Len() > 0 {
+			assert.Nil(t, json.NewDecoder(w.Body).Decode(&envelope), method+" "+path)
+		}
+		return w.Code, envelope
+	}
+
+	const (
+		collection = "/namespaces/debian:8/vulnerabilities"
+		resource   = collection + "/CVE-2014-9471"
+		created    = `{"Vulnerability":{"Name":"CVE-2014-9471","NamespaceName":"debian:8","Description":"coreutils crash","Link":"https://example.com/CVE-2014-9471","Severity":"Low","FixedIn":[{"Name":"coreutils","NamespaceName":"debian:8","Version":"8.23-1"}]}}`
+	)
+
+	// Invalid vulnerabilities are rejected before reaching the datastore.
+	for _, body := range []string{
+		`{"Vulnerability":`,
+		`{}`,
+		`{"Vulnerability":{"NamespaceName":"debian:8","Severity":"Low"}}`,
+		`{"Vulnerability":{"Name":"CVE-2014-9471","NamespaceName":"debian:9","Severity":"Low"}}`,
+		`{"Vulnerability":{"Name":"CVE-2014-9471","NamespaceName":"debian:8","Severity":"Dangerous"}}`,
+		`{"Vulnerability":{"Name":"CVE-2014-9471","NamespaceName":"debian:8","Severity":"Low","FixedIn":[{"Name":"coreutils","NamespaceName":"debian:8"}]}}`,
+	} {
+		status, envelope := do("POST", collection, body)
+		assert.Equal(t, http.StatusBadRequest, status, body)
+		assert.NotNil(t, envelope.Error, body)
+	}
+
+	status, envelope := do("GET", resource, "")
+	assert.Equal(t, http.StatusNotFound, status)
+	assert.NotNil(t, envelope.Error)
+
+	// Create.
+	status, envelope = do("POST", collection, created)
+	if assert.Equal(t, http.StatusCreated, status) && assert.NotNil(t, envelope.Vulnerability) {
+		assert.Equal(t, "CVE-2014-9471", envelope.Vulnerability.Name)
+	}
+	status, envelope = do("POST", collection, created)
+	assert.Equal(t, http.StatusConflict, status)
+	assert.NotNil(t, envelope.Error)
+
+	// A single one of the concurrent creations succeeds.
+	statuses := make(chan int, 4)
+	for i := 0; i < cap(statuses); i++ {
+		go func() {
+			status, _ := do("POST", collection, strings.Replace(created, "CVE-2014-9471", "CVE-2014-9472", 1))
+			statuses <- status
+		}()
+	}
+	counts := make(map[int]int)
+	for i := 0; i < cap(statuses); i++ {
+		counts[<-statuses]++
+	}
+	assert.Equal(t, map[int]int{http.StatusCreated: 1, http.StatusConflict: cap(statuses) - 1}, counts)
+
+	// Read, with and without the fixes.
+	status, envelope = do("GET", resource, "")
+	if assert.Equal(t, http.StatusOK, status) && assert.NotNil(t, envelope.Vulnerability) {
+		assert.Equal(t, "Low", envelope.Vulnerability.Severity)
+		assert.Empty(t, envelope.Vulnerability.FixedIn)
+	}
+	status, envelope = do("GET", resource+"?fixedIn=true", "")
+	if assert.Equal(t, http.StatusOK, status) && assert.NotNil(t, envelope.Vulnerability) && assert.Len(t, envelope.Vulnerability.FixedIn, 1) {
+		assert.Equal(t, "coreutils", envelope.Vulnerability.FixedIn[0].Name)
+	}
+	status, _ = do("GET", resource+"?fixedIn=maybe", "")
+	assert.Equal(t, http.StatusBadRequest, status)
+
+	// Partially update.
+	for _, body := range []string{
+		`{"Vulnerability":{"Severity":"Dangerous"}}`,
+		`{"Vulnerability":{"Name":"CVE-2014-9472","Severity":"High"}}`,
+		`{"Vulnerability":{"NamespaceName":"debian:9","Severity":"High"}}`,
+		`{"Vulnerability":{"FixedIn":[{"Name":"coreutils"}]}}`,
+	} {
+		status, _ = do("PATCH", resource, body)
+		assert.Equal(t, http.StatusBadRequest, status, body)
+	}
+	status, _ = do("PATCH", collection+"/CVE-0000-0000", `{"Vulnerability":{"Severity":"High"}}`)
+	assert.Equal(t, http.StatusNotFound, status)
+
+	status, envelope = do("PATCH", resource, `{"Vulnerability":{"Name":"CVE-2014-9471","Severity":"High"}}`)
+	if assert.Equal(t, http.StatusOK, status) && assert.NotNil(t, envelope.Vulnerability) {
+		assert.Equal(t, "High", envelope.Vulnerability.Severity)
+		assert.Equal(t, "coreutils crash", envelope.Vulnerability.Description)
+		assert.Len(t, envelope.Vulnerability.FixedIn, 1)
+	}
+	status, envelope = do("PATCH", resource, `{"Vulnerability":{"FixedIn":[{"Name":"coreutils","Version":"8.23-2"}]}}`)
+	if assert.Equal(t, http.StatusOK, status) && assert.NotNil(t, envelope.Vulnerability) && assert.Len(t, envelope.Vulnerability.FixedIn, 1) {
+		assert.Equal(t, "8.23-2", envelope.Vulnerability.FixedIn[0].Version.String())
+	}
+	status, envelope = do("GET", resource+"?fixedIn", "")
+	if assert.Equal(t, http.StatusOK, status) && assert.NotNil(t, envelope.Vulnerability) {
+		assert.Equal(t, "High", envelope.Vulnerability.Severity)
+		assert.Equal(t, "coreutils crash", envelope.Vulnerability.Description)
+		assert.Equal(t, "https://example.com/CVE-2014-9471", envelope.Vulnerability.Link)
+		assert.Len(t, envelope.Vulnerability.FixedIn, 1)
+	}
+
+	// Delete.
+	status, _ = do("DELETE", resource, "")
+	assert.Equal(t, http.StatusOK, status)
+	status, envelope = do("DELETE", resource, "")
+	assert.Equal(t, http.StatusNotFound, status)
+	assert.NotNil(t, envelope.Error)
+	status, _ = do("GET", resource, "")
+	assert.Equal(t, http.StatusNotFound, status)
+}
+
+func TestFixLifecycle(t *testing.T) {
+	store, closeStore := openDatastoreForTest(t)
+	defer closeStore()
+
+	debian8 := database.Namespace{Name: "debian:8"}
+	assert.Nil(t, store.InsertLayer(stdcontext.Background(), database.Layer{
+		Name:          "layer",
+		EngineVersion: worker.Version,
+		Namespace:     &debian8,
+		Features: []database.FeatureVersion{{
+			Feature: database.Feature{Name: "openssl", Namespace: debian8},
+			Version: types.NewVersionUnsafe("1.0-1"),
+		}},
+	}))
+
+	router := NewRouter(&context.RouteContext{Store: store, Config: &config.APIConfig{}})
+	do := func(method, path, body string) (int, FeatureEnvelope) {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+
+		var envelope FeatureEnvelope
+		if w.Body.Len() > 0 {
+			assert.Nil(t, json.NewDecoder(w.Body).Decode(&envelope), method+" "+path)
+		}
+		return w.Code, envelope
+	}
+	layerVulnerabilities := func() []string {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", "/layers/layer?vulnerabilities", nil))
+
+		var envelope LayerEnvelope
+		assert.Nil(t, json.NewDecoder(w.Body).Decode(&envelope))
+		var names []string
+		for _, feature := range envelope.Layer.Features {
+			for _, vuln := range feature.Vulnerabilities {
+				names = append(names, vuln.Name)
+			}
+		}
+		return names
+	}
+	pendingNotifications := func() int {
+		stats, err := store.GetStatistics(stdcontext.Background(), true)
+		assert.Nil(t, err)
+		return stats.PendingNotifications
+	}
+
+	const (
+		fixes = "/namespaces/debian:8/vulnerabilities/CVE-2016-0001/fixes"
+		fix   = fixes + "/openssl"
+	)
+
+	status, _ := do("GET", fixes, "")
+	assert.Equal(t, http.StatusNotFound, status)
+	status, _ = do("PUT", fix, `{"Feature":{"Name":"openssl","Version":"None"}}`)
+	assert.Equal(t, http.StatusNotFound, status)
+
+	// openssl is affected, without any fix yet.
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/namespaces/debian:8/vulnerabilities", strings.NewReader(
+		`{"Vulnerability":{"Name":"CVE-2016-0001","Severity":"High","FixedIn":[{"Name":"openssl","Version":"none"}]}}`,
+	)))
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assert.Equal(t, []string{"CVE-2016-0001"}, layerVulnerabilities())
+
+	// Invalid fixes.
+	for _, body := range []string{
+		`{"Feature":`,
+		`{}`,
+		`{"Feature":{"Name":"libssl","Version":"1.0-1"}}`,
+		`{"Feature":{"Name":"openssl"}}`,
+		`{"Feature":{"Name":"openssl","Version":"garbage"}}`,
+		`{"Feature":{"Name":"openssl","NamespaceName":"debian:9","Version":"1.0-1"}}`,
+	} {
+		status, envelope := do("PUT", fix, body)
+		assert.Equal(t, http.StatusBadRequest, status, body)
+		assert.NotNil(t, envelope.Error, body)
+	}
+
+	// Fixing the installed version cleans the layer up.
+	notifications := pendingNotifications()
+	status, envelope := do("PUT", fix, `{"Feature":{"Name":"openssl","Version":"1.0-1"}}`)
+	if assert.Equal(t, http.StatusOK, status) && assert.NotNil(t, envelope.Feature) {
+		assert.Equal(t, "debian:8", envelope.Feature.NamespaceName)
+		assert.Equal(t, "1.0-1", envelope.Feature.Version.String())
+	}
+	assert.Empty(t, layerVulnerabilities())
+	assert.Equal(t, notifications+1, pendingNotifications())
+
+	status, envelope = do("GET", fixes, "")
+	if assert.Equal(t, http.StatusOK, status) && assert.NotNil(t, envelope.Features) && assert.Len(t, *envelope.Features, 1) {
+		assert.Equal(t, "openssl", (*envelope.Features)[0].Name)
+		assert.Equal(t, "1.0-1", (*envelope.Features)[0].Version.String())
+	}
+
+	// Withdrawing the fix makes the layer vulnerable again.
+	notifications = pendingNotifications()
+	status, _ = do("PUT", fix, `{"Feature":{"Name":"openssl","Version":"None"}}`)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, []string{"CVE-2016-0001"}, layerVulnerabilities())
+	assert.Equal(t, notifications+1, pendingNotifications())
+
+	// Deleting the fix means that openssl is not affected anymore.
+	notifications = pendingNotifications()
+	status, _ = do("DELETE", fix, "")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Empty(t, layerVulnerabilities())
+	assert.Equal(t, notifications+1, pendingNotifications())
+
+	status, envelope = do("DELETE", fix, "")
+	assert.Equal(t, http.StatusNotFound, status)
+	assert.NotNil(t, envelope.Error)
+	status, _ = do("DELETE", "/namespaces/debian:8/vulnerabilities/CVE-0000-0000/fixes/openssl", "")
+	assert.Equal(t, http.StatusNotFound, status)
+}
+
+func TestGetNotification(t *testing.T) {
+	store, closeStore := openDatastoreForTest(t)
+	defer closeStore()
+
+	// Seven layers are affected by the vulnerability, walked three by three.
+	debian8 := database.Namespace{Name: "debian:8"}
+	var expectedLayers []string
+	for i := 0; i < 7; i++ {
+		name := fmt.Sprintf("layer-%d", i)
+		expectedLayers = append(expectedLayers, name)
+		assert.Nil(t, store.InsertLayer(stdcontext.Background(), database.Layer{
+			Name:          name,
+			EngineVersion: worker.Version,
+			Namespace:     &debian8,
+			Features: []database.FeatureVersion{{
+				Feature: database.Feature{Name: "openssl", Namespace: debian8},
+				Version: types.NewVersionUnsafe("1.0-1"),
+			}},
+		}))
+	}
+	assert.Nil(t, store.InsertVulnerabilities(stdcontext.Background(), []database.Vulnerability{{
+		Name:      "CVE-2016-0001",
+		Namespace: debian8,
+		Severity:  types.High,
+		FixedIn: []database.FeatureVersion{{
+			Feature: database.Feature{Name: "openssl", Namespace: debian8},
+			Version: types.MaxVersion,
+		}},
+	}}, true))
+	available, err := store.GetAvailableNotification(stdcontext.Background(), time.Hour)
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	var key fernet.Key
+	assert.Nil(t, key.Generate())
+	router := NewRouter(&context.RouteContext{Store: store, Config: &config.APIConfig{PaginationKey: key.Encode()}})
+	getNotification := func(path string) (int, NotificationEnvelope) {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+
+		var envelope NotificationEnvelope
+		assert.Nil(t, json.NewDecoder(w.Body).Decode(&envelope), path)
+		return w.Code, envelope
+	}
+
+	var layers []string
+	var pages int
+	path := "/notifications/" + available.Name + "?limit=3"
+	for {
+		status, envelope := getNotification(path)
+		if !assert.Equal(t, http.StatusOK, status, path) || !assert.NotNil(t, envelope.Notification, path) {
+			return
+		}
+		pages++
+
+		notification := envelope.Notification
+		assert.Equal(t, available.Name, notification.Name)
+		assert.Equal(t, 3, notification.Limit)
+		assert.NotEmpty(t, notification.Page)
+		assert.Nil(t, notification.Old)
+		if assert.NotNil(t, notification.New) && assert.NotNil(t, notification.New.Vulnerability) {
+			assert.Equal(t, "CVE-2016-0001", notification.New.Vulnerability.Name)
+			assert.True(t, len(notification.New.LayersIntroducingVulnerability) <= 3)
+			layers = append(layers, notification.New.LayersIntroducingVulnerability...)
+		}
+
+		if notification.NextPage == "" {
+			break
+		}
+		assert.True(t, pages < 7, "the pagination does not end")
+		path = "/notifications/" + available.Name + "?limit=3&page=" + url.QueryEscape(notification.NextPage)
+	}
+	assert.Equal(t, 3, pages)
+	sort.Strings(layers)
+	assert.Equal(t, expectedLayers, layers)
+
+	// Tokens are opaque and signed.
+	status, envelope := getNotification("/notifications/" + available.Name + "?limit=3")
+	if assert.Equal(t, http.StatusOK, status) {
+		token := envelope.Notification.NextPage
+		forged := token[:len(token)-2] + "AA"
+		if forged == token {
+			forged = token[:len(token)-2] + "BB"
+		}
+		for _, page := range []string{"garbage", forged} {
+			status, envelope := getNotification("/notifications/" + available.Name + "?limit=3&page=" + url.QueryEscape(page))
+			assert.Equal(t, http.StatusBadRequest, status, page)
+			assert.NotNil(t, envelope.Error, page)
+		}
+	}
+
+	for _, test := range []struct {
+		path     string
+		expected int
+	}{
+		{"/notifications/" + available.Name, http.StatusBadRequest},
+		{"/notifications/" + available.Name + "?limit=many", http.StatusBadRequest},
+		{"/notifications/" + available.Name + "?limit=0", http.StatusBadRequest},
+		{"/notifications/unknown?limit=3", http.StatusNotFound},
+	} {
+		status, envelope := getNotification(test.path)
+		assert.Equal(t, test.expected, status, test.path)
+		assert.NotNil(t, envelope.Error, test.path)
+	}
+}
+
+func TestDeleteNotification(t *testing.T) {
+	store, closeStore := openDatastoreForTest(t)
+	defer closeStore()
+
+	assert.Nil(t, store.InsertVulnerabilities(stdcontext.Background(), []database.Vulnerability{{
+		Name:      "CVE-2016-0001",
+		Namespace: database.Namespace{Name: "debian:8"},
+		Severity:  types.High,
+	}}, true))
+	available, err := store.GetAvailableNotification(stdcontext.Background(), time.Hour)
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	router := NewRouter(&context.RouteContext{Store: store, Config: &config.APIConfig{}})
+	deleteNotification := func(name string) int {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("DELETE", "/notifications/"+name, nil))
+		return w.Code
+	}
+
+	// Acknowledging is idempotent, and the notification is not available anymore.
+	assert.Equal(t, http.StatusOK, deleteNotification(available.Name))
+	assert.Equal(t, http.StatusOK, deleteNotification(available.Name))
+	_, err = store.GetAvailableNotification(stdcontext.Background(), -time.Hour)
+	assert.Equal(t, cerrors.ErrNotFound, err)
+
+	assert.Equal(t, http.StatusNotFound, deleteNotification("unknown"))
+}
+
+func TestGetLayerMinimumSeverity(t *testing.T) {
+	store, closeStore := openDatastoreForTest(t)
+	defer closeStore()
+
+	debian8 := database.Namespace{Name: "debian:8"}
+	var features []database.FeatureVersion
+	var vulnerabilities []database.Vulnerability
+	for _, severity := range []types.Priority{types.Low, types.Medium, types.High} {
+		feature := database.Feature{Name: "package-" + strings.ToLower(string(severity)), Namespace: debian8}
+		features = append(features, database.FeatureVersion{Feature: feature, Version: types.NewVersionUnsafe("1.0")})
+		vulnerabilities = append(vulnerabilities, database.Vulnerability{
+			Name:      "CVE-" + string(severity),
+			Namespace: debian8,
+			Severity:  severity,
+			FixedIn:   []database.FeatureVersion{{Feature: feature, Version: types.NewVersionUnsafe("2.0")}},
+		})
+	}
+	assert.Nil(t, store.InsertLayer(stdcontext.Background(), database.Layer{
+		Name:          "layer",
+		EngineVersion: worker.Version,
+		Namespace:     &debian8,
+		Features:      features,
+	}))
+	assert.Nil(t, store.InsertVulnerabilities(stdcontext.Background(), vulnerabilities, false))
+
+	router := NewRouter(&context.RouteContext{Store: store, Config: &config.APIConfig{}})
+	getLayer := func(query string) (int, LayerEnvelope) {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", "/layers/layer?vulnerabilities"+query, nil))
+
+		var envelope LayerEnvelope
+		assert.Nil(t, json.NewDecoder(w.Body).Decode(&envelope), query)
+		return w.Code, envelope
+	}
+
+	for query, expected := range map[string][]string{
+		"":                          {"CVE-High", "CVE-Low", "CVE-Medium"},
+		"&minimumSeverity=Unknown":  {"CVE-High", "CVE-Low", "CVE-Medium"},
+		"&minimumSeverity=Low":      {"CVE-High", "CVE-Low", "CVE-Medium"},
+		"&minimumSeverity=Medium":   {"CVE-High", "CVE-Medium"},
+		"&minimumSeverity=high":     {"CVE-High"},
+		"&minimumSeverity=Critical": nil,
+		"&minimumSeverity=Defcon1":  nil,
+	} {
+		status, envelope := getLayer(query)
+		if !assert.Equal(t, http.StatusOK, status, query) || !assert.NotNil(t, envelope.Layer, query) {
+			continue
+		}
+		// The features are listed even when none of their vulnerabilities is severe enough.
+		assert.Len(t, envelope.Layer.Features, 3, query)
+
+		var names []string
+		for _, feature := range envelope.Layer.Features {
+			for _, vulnerability := range feature.Vulnerabilities {
+				names = append(names, vulnerability.Name)
+			}
+		}
+		sort.Strings(names)
+		assert.Equal(t, expected, names, query)
+	}
+
+	// Invalid severities are rejected with the list of the valid ones.
+	status, envelope := getLayer("&minimumSeverity=Important")
+	assert.Equal(t, http.StatusBadRequest, status)
+	if assert.NotNil(t, envelope.Error) {
+		assert.Contains(t, envelope.Error.Message, "Unknown, Negligible, Low, Medium, High, Critical, Defcon1")
+	}
+}
+
+func TestGetLayerETag(t *testing.T) {
+	store, closeStore := openDatastoreForTest(t)
+	defer closeStore()
+
+	debian8 := database.Namespace{Name: "debian:8"}
+	openssl := database.Feature{Name: "openssl", Namespace: debian8}
+	assert.Nil(t, store.InsertLayer(stdcontext.Background(), database.Layer{
+		Name:          "layer",
+		EngineVersion: worker.Version,
+		Namespace:     &debian8,
+		Features:      []database.FeatureVersion{{Feature: openssl, Version: types.NewVersionUnsafe("1.0")}},
+	}))
+
+	router := NewRouter(&context.RouteContext{Store: store, Config: &config.APIConfig{}})
+	getLayer := func(path, ifNoneMatch string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		if ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := getLayer("/layers/layer?vulnerabilities", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	etag := w.Header().Get("ETag")
+	assert.True(t, strings.HasPrefix(etag, `W/"`), etag)
+
+	// The report did not change.
+	for _, ifNoneMatch := range []string{etag, strings.TrimPrefix(etag, "W/"), `W/"other", ` + etag, "*"} {
+		w = getLayer("/layers/layer?vulnerabilities", ifNoneMatch)
+		assert.Equal(t, http.StatusNotModified, w.Code, ifNoneMatch)
+		assert.Equal(t, etag, w.Header().Get("ETag"), ifNoneMatch)
+		assert.Equal(t, 0, w.Body.Len(), ifNoneMatch)
+	}
+
+	// Other representations of the layer have their own tag.
+	w = getLayer("/layers/layer", etag)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NotEqual(t, etag, w.Header().Get("ETag"))
+
+	// A new vulnerability of the namespace changes the report.
+	assert.Nil(t, store.InsertVulnerabilities(stdcontext.Background(), []database.Vulnerability{{
+		Name:      "CVE-OPENSSL",
+		Namespace: debian8,
+		Severity:  types.High,
+		FixedIn:   []database.FeatureVersion{{Feature: openssl, Version: types.NewVersionUnsafe("2.0")}},
+	}}, false))
+
+	w = getLayer("/layers/layer?vulnerabilities", etag)
+	assert.Equal(t, http.StatusOK, w.Code)
+	newETag := w.Header().Get("ETag")
+	assert.NotEqual(t, etag, newETag)
+
+	var envelope LayerEnvelope
+	if assert.Nil(t, json.NewDecoder(w.Body).Decode(&envelope)) && assert.NotNil(t, envelope.Layer) && assert.Len(t, envelope.Layer.Features, 1) {
+		assert.Len(t, envelope.Layer.Features[0].Vulnerabilities, 1)
+	}
+
+	// So does an update of the vulnerability database.
+	assert.Nil(t, store.InsertKeyValue(stdcontext.Background(), "updater/last", "1500000000"))
+	w = getLayer("/layers/layer?vulnerabilities", newETag)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NotEqual(t, newETag, w.Header().Get("ETag"))
+}
+
+func TestErrorEnvelope(t *testing.T) {
+	for _, test := range []struct {
+		err      error
+		expected int
+	}{
+		{cerrors.ErrNotFound, http.StatusNotFound},
+		{cerrors.NewBadRequestError("bad vulnerability"), http.StatusBadRequest},
+		{database.ErrAlreadyExists, http.StatusConflict},
+		{database.ErrLayerHasChildren, http.StatusConflict},
+		{database.ErrBackendException, http.StatusServiceUnavailable},
+		{worker.ErrQueueFull, http.StatusServiceUnavailable},
+		{worker.ErrCouldNotFindNamespace, statusUnprocessableEntity},
+		{worker.ErrUnsupportedImageFormat, http.StatusBadRequest},
+		{worker.ErrParentUnknown, http.StatusBadRequest},
+		{&worker.ErrCouldNotDownload{StatusCode: http.StatusNotFound}, http.StatusBadGateway},
+		{&database.ErrLayerTreeTooDeep{Layer: "layer", MaxDepth: 127}, statusUnprocessableEntity},
+		{utils.ErrExtractedFileTooBig, statusUnprocessableEntity},
+		{utils.ErrLayerTooLarge, http.StatusRequestEntityTooLarge},
+		{utils.ErrUnsafePath, http.StatusBadRequest},
+		{errors.New("unexpected"), http.StatusInternalServerError},
+	} {
+		store := &database.MockDatastore{
+			FctFindVulnerability: func(ctx stdcontext.Context, namespaceName, name string) (database.Vulnerability, error) {
+				return database.Vulnerability{}, test.err
+			},
+		}
+
+		var status int
+		handler := context.HTTPHandler(func(w http.ResponseWriter, r *http.Request, p httprouter.Params, ctx *context.RouteContext) (string, int) {
+			route, s := getVulnerability(w, r, p, ctx)
+			status = s
+			return route, s
+		}, &context.RouteContext{Store: store, Config: &config.APIConfig{}})
+
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest("GET", "/namespaces/debian:8/vulnerabilities/CVE-2016-0001", nil), nil)
+
+		// The status reported for the metrics is the one that has been written.
+		assert.Equal(t, test.expected, w.Code, test.err.Error())
+		assert.Equal(t, w.Code, status, test.err.Error())
+		assert.Equal(t, "application/json;charset=utf-8", w.Header().Get("Content-Type"), test.err.Error())
+		assert.JSONEq(t, `{"Error":{"Message":"`+test.err.Error()+`"}}`, w.Body.String(), test.err.Error())
+	}
+
+	// Requests that match no handler get the same envelope.
+	router := NewRouter(&context.RouteContext{Store: &database.MockDatastore{}, Config: &config.APIConfig{}})
+	for _, test := range []struct {
+		method, path string
+		expected     int
+	}{
+		{"GET", "/unknown", http.StatusNotFound},
+		{"POST", "/namespaces", http.StatusMethodNotAllowed},
+	} {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(test.method, test.path, nil))
+
+		assert.Equal(t, test.expected, w.Code, test.path)
+		assert.Equal(t, "application/json;charset=utf-8", w.Header().Get("Content-Type"), test.path)
+		var envelope ErrorEnvelope
+		if assert.Nil(t, json.NewDecoder(w.Body).Decode(&envelope), test.path) && assert.NotNil(t, envelope.Error, test.path) {
+			assert.NotEmpty(t, envelope.Error.Message, test.path)
+		}
+	}
+}
+
+func TestGzipResponse(t *testing.T) {
+	// A layer with enough features for its report to be compressed.
+	dbLayer := database.Layer{Name: "large", EngineVersion: 1, Namespace: &database.Namespace{Name: "debian:8"}}
+	for i := 0; i < 100; i++ {
+		dbLayer.Features = append(dbLayer.Features, database.FeatureVersion{
+			Feature: database.Feature{Name: fmt.Sprintf("package-%d", i), Namespace: database.Namespace{Name: "debian:8"}},
+			Version: types.NewVersionUnsafe("1.0"),
+			AddedBy: database.Layer{Name: "large"},
+		})
+	}
+	store := &database.MockDatastore{
+		FctFindLayer: func(ctx stdcontext.Context, name string, withFeatures, withVulnerabilities bool, minSeverity types.Priority) (database.Layer, error) {
+			if name != dbLayer.Name {
+				return database.Layer{}, cerrors.ErrNotFound
+			}
+			return dbLayer, nil
+		},
+		FctGetKeyValue: func(ctx stdcontext.Context, key string) (string, error) {
+			return "", cerrors.ErrNotFound
+		},
+		FctGetLastVulnerabilityChange: func(ctx stdcontext.Context, namespaceName string) (time.Time, error) {
+			return time.Time{}, nil
+		},
+	}
+	router := NewRouter(&context.RouteContext{Store: store, Config: &config.APIConfig{}})
+
+	get := func(path, acceptEncoding string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		if acceptEncoding != "" {
+			req.Header.Set("Accept-Encoding", acceptEncoding)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	plain := get("/layers/large?features", "")
+	assert.Equal(t, http.StatusOK, plain.Code)
+	assert.Empty(t, plain.Header().Get("Content-Encoding"))
+	assert.Equal(t, "Accept-Encoding", plain.Header().Get("Vary"))
+	assert.True(t, plain.Body.Len() >= minGzipSize)
+
+	for _, acceptEncoding := range []string{"gzip", "deflate, gzip;q=0.5", "*"} {
+		compressed := get("/layers/large?features", acceptEncoding)
+		assert.Equal(t, http.StatusOK, compressed.Code, acceptEncoding)
+		assert.Equal(t, "gzip", compressed.Header().Get("Content-Encoding"), acceptEncoding)
+		assert.True(t, compressed.Body.Len() < plain.Body.Len(), acceptEncoding)
+
+		// Once decompressed, the response is the same as the uncompressed one.
+		gzipReader, err := gzip.NewReader(compressed.Body)
+		if assert.Nil(t, err, acceptEncoding) {
+			body, err := ioutil.ReadAll(gzipReader)
+			assert.Nil(t, err, acceptEncoding)
+			assert.Equal(t, plain.Body.String(), string(body), acceptEncoding)
+		}
+	}
+
+	// Gzip is refused explicitly.
+	assert.Empty(t, get("/layers/large?features", "gzip;q=0").Header().Get("Content-Encoding"))
+
+	// Small responses are not worth compressing, whatever their status.
+	notFound := get("/layers/unknown", "gzip")
+	assert.Equal(t, http.StatusNotFound, notFound.Code)
+	assert.Empty(t, notFound.Header().Get("Content-Encoding"))
+	var envelope ErrorEnvelope
+	if assert.Nil(t, json.NewDecoder(notFound.Body).Decode(&envelope)) && assert.NotNil(t, envelope.Error) {
+		assert.NotEmpty(t, envelope.Error.Message)
+	}
+}
+
+func TestGetVulnerabilitiesPagination(t *testing.T) {
+	store, closeStore := openDatastoreForTest(t)
+	defer closeStore()
+
+	// Nine vulnerabilities, walked four by four.
+	debian8 := database.Namespace{Name: "debian:8"}
+	var dbVulns []database.Vulnerability
+	for i := 0; i < 9; i++ {
+		dbVulns = append(dbVulns, database.Vulnerability{
+			Name:      fmt.Sprintf("CVE-2016-%04d", i),
+			Namespace: debian8,
+			Severity:  types.Medium,
+		})
+	}
+	assert.Nil(t, store.InsertVulnerabilities(stdcontext.Background(), dbVulns, false))
+
+	var key fernet.Key
+	assert.Nil(t, key.Generate())
+	router := NewRouter(&context.RouteContext{Store: store, Config: &config.APIConfig{PaginationKey: key.Encode(), MaxPageSize: 4}})
+	getVulnerabilities := func(path string) (int, VulnerabilityEnvelope) {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+
+		var envelope VulnerabilityEnvelope
+		assert.Nil(t, json.NewDecoder(w.Body).Decode(&envelope), path)
+		return w.Code, envelope
+	}
+
+	// The limit is lowered to the maximum page size.
+	seen := make(map[string]bool)
+	var pageSizes []int
+	path := "/namespaces/debian:8/vulnerabilities?limit=100"
+	for {
+		status, envelope := getVulnerabilities(path)
+		if !assert.Equal(t, http.StatusOK, status, path) || !assert.NotNil(t, envelope.Vulnerabilities, path) {
+			return
+		}
+
+		pageSizes = append(pageSizes, len(*envelope.Vulnerabilities))
+		for _, vuln := range *envelope.Vulnerabilities {
+			assert.False(t, seen[vuln.Name], "%s is listed twice", vuln.Name)
+			seen[vuln.Name] = true
+		}
+
+		if envelope.NextPage == "" {
+			break
+		}
+		path = "/namespaces/debian:8/vulnerabilities?limit=100&page=" + url.QueryEscape(envelope.NextPage)
+	}
+	assert.Equal(t, []int{4, 4, 1}, pageSizes)
+	assert.Len(t, seen, 9)
+
+	for path, expected := range map[string]int{
+		"/namespaces/debian:8/vulnerabilities?limit=2&page=garbage": http.StatusBadRequest,
+		"/namespaces/debian:8/vulnerabilities?limit=0":              http.StatusBadRequest,
+		"/namespaces/debian:8/vulnerabilities":                      http.StatusBadRequest,
+		"/namespaces/debian:9/vulnerabilities?limit=2":              http.StatusNotFound,
+	} {
+		status, envelope := getVulnerabilities(path)
+		assert.Equal(t, expected, status, path)
+		assert.NotNil(t, envelope.Error, path)
+	}
+}
+
+func TestPostImage(t *testing.T) {
+	const (
+		osRelease = "ID=debian\nVERSION_ID=\"8\"\n"
+		openssl   = "Package: openssl\nStatus: install ok installed\nVersion: 1.0-1\n"
+		curl      = "Package: curl\nStatus: install ok installed\nVersion: 7.0-1\n"
+	)
+	server := newLayerServer(t, map[string]map[string]string{
+		"base":         {"etc/os-release": osRelease, "var/lib/dpkg/status": openssl},
+		"middle":       {"etc/os-release": osRelease},
+		"leaf":         {"var/lib/dpkg/status": openssl + "\n" + curl},
+		"no-namespace": {"var/lib/dpkg/status": openssl},
+	})
+	defer server.Close()
+
+	store, closeStore := openDatastoreForTest(t)
+	defer closeStore()
+	router := NewRouter(&context.RouteContext{Store: store, Config: &config.APIConfig{}})
+
+	postImage := func(names ...string) (int, ImageStatusEnvelope) {
+		var request ImageEnvelope
+		for _, name := range names {
+			request.Layers = append(request.Layers, Layer{Name: name, Path: server.URL + "/" + name, Format: "Docker"})
+		}
+		body, _ := json.Marshal(request)
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("POST", "/images", bytes.NewReader(body)))
+
+		var envelope ImageStatusEnvelope
+		assert.Nil(t, json.NewDecoder(w.Body).Decode(&envelope))
+		return w.Code, envelope
+	}
+
+	// Every layer of the chain is processed, with the previous one as its parent.
+	status, envelope := postImage("base", "middle", "leaf")
+	assert.Equal(t, http.StatusCreated, status)
+	assert.Nil(t, envelope.Error)
+	assert.Equal(t, []LayerStatus{
+		{Name: "base", Status: LayerStatusProcessed},
+		{Name: "middle", Status: LayerStatusProcessed},
+		{Name: "leaf", Status: LayerStatusProcessed},
+	}, envelope.Layers)
+
+	debian8 := database.Namespace{Name: "debian:8"}
+	assert.Nil(t, store.InsertVulnerabilities(stdcontext.Background(), []database.Vulnerability{{
+		Name:      "CVE-2016-0001",
+		Namespace: debian8,
+		Severity:  types.High,
+		FixedIn: []database.FeatureVersion{{
+			Feature: database.Feature{Name: "curl", Namespace: debian8},
+			Version: types.NewVersionUnsafe("7.1-1"),
+		}},
+	}}, false))
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/layers/leaf?vulnerabilities", nil))
+	var leaf LayerEnvelope
+	assert.Nil(t, json.NewDecoder(w.Body).Decode(&leaf))
+	if assert.Equal(t, http.StatusOK, w.Code) && assert.NotNil(t, leaf.Layer) {
+		assert.Equal(t, "middle", leaf.Layer.ParentName)
+		assert.Equal(t, "debian:8", leaf.Layer.NamespaceName)
+
+		vulnerable := make(map[string][]string)
+		for _, feature := range leaf.Layer.Features {
+			for _, vuln := range feature.Vulnerabilities {
+				vulnerable[feature.Name] = append(vulnerable[feature.Name], vuln.Name)
+			}
+			if feature.Name == "curl" {
+				assert.Equal(t, "leaf", feature.AddedBy)
+			}
+		}
+		assert.Equal(t, map[string][]string{"curl": {"CVE-2016-0001"}}, vulnerable)
+	}
+
+	// A layer whose namespace is unknown is stored nonetheless, and the first failure aborts the
+	// following layers.
+	status, envelope = postImage("no-namespace", "missing", "other-leaf")
+	assert.Equal(t, http.StatusBadGateway, status)
+	assert.NotNil(t, envelope.Error)
+	if assert.Len(t, envelope.Layers, 3) {
+		assert.Equal(t, LayerStatusProcessed, envelope.Layers[0].Status)
+		assert.NotNil(t, envelope.Layers[0].Error)
+		assert.Equal(t, LayerStatusFailed, envelope.Layers[1].Status)
+		assert.NotNil(t, envelope.Layers[1].Error)
+		assert.Equal(t, LayerStatusSkipped, envelope.Layers[2].Status)
+	}
+	_, err := store.FindLayer(stdcontext.Background(), "no-namespace", false, false, types.Unknown)
+	assert.Nil(t, err)
+	_, err = store.FindLayer(stdcontext.Background(), "other-leaf", false, false, types.Unknown)
+	assert.Equal(t, cerrors.ErrNotFound, err)
+
+	// Malformed batches.
+	for _, names := range [][]string{{}, {"base", "leaf", "base"}, {""}, {"base", "library/leaf"}} {
+		status, envelope := postImage(names...)
+		assert.Equal(t, http.StatusBadRequest, status, "%v", names)
+		assert.NotNil(t, envelope.Error, "%v", names)
+		assert.Empty(t, envelope.Layers, "%v", names)
+	}
+}
+
+func TestPostImageManifest(t *testing.T) {
+	// tarBlob returns an uncompressed layer holding a single file, and its digest.
+	tarBlob := func(name, content string) ([]byte, string) {
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		assert.Nil(t, tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content))}))
+		_, err := tw.Write([]byte(content))
+		assert.Nil(t, err)
+		assert.Nil(t, tw.Close())
+		return buf.Bytes(), fmt.Sprintf("sha256:%x", sha256.Sum256(buf.Bytes()))
+	}
+	base, baseDigest := tarBlob("etc/os-release", "ID=debian\nVERSION_ID=\"8\"\n")
+	leaf, leafDigest := tarBlob("var/lib/dpkg/status", "Package: curl\nStatus: install ok installed\nVersion: 7.0-1\n")
+	_, otherDigest := tarBlob("var/lib/dpkg/status", "")
+
+	// The registry serves the content of the leaf for the other digest too.
+	registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch strings.TrimPrefix(r.URL.Path, "/v2/library/app/blobs/") {
+		case baseDigest:
+			w.Write(base)
+		case leafDigest, otherDigest:
+			w.Write(leaf)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer registry.Close()
+
+	store, closeStore := openDatastoreForTest(t)
+	defer closeStore()
+	router := NewRouter(&context.RouteContext{Store: store, Config: &config.APIConfig{}})
+	postManifest := func(registryURL string, digests ...string) (int, ImageStatusEnvelope) {
+		var layers []string
+		for _, digest := range digests {
+			layers = append(layers, fmt.Sprintf(`{"mediaType": "application/vnd.oci.image.layer.v1.tar", "digest": %q, "size": 1024}`, digest))
+		}
+		body := fmt.Sprintf(`{"Registry": %q, "Repository": "library/app", "Manifest": {"schemaVersion": 2, "mediaType": %q, "layers": [%s]}}`,
+			registryURL, worker.MediaTypeOCIManifest, strings.Join(layers, ","))
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("POST", "/images/manifest", strings.NewReader(body)))
+
+		var envelope ImageStatusEnvelope
+		assert.Nil(t, json.NewDecoder(w.Body).Decode(&envelope))
+		return w.Code, envelope
+	}
+
+	// The layers are named by their digest.
+	status, envelope := postManifest(registry.URL, baseDigest, leafDigest)
+	assert.Equal(t, http.StatusCreated, status)
+	assert.Nil(t, envelope.Error)
+	assert.Equal(t, []LayerStatus{
+		{Name: baseDigest, Status: LayerStatusProcessed},
+		{Name: leafDigest, Status: LayerStatusProcessed},
+	}, envelope.Layers)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/layers/"+leafDigest, nil))
+	var envelopeLeaf LayerEnvelope
+	assert.Nil(t, json.NewDecoder(w.Body).Decode(&envelopeLeaf))
+	if assert.Equal(t, http.StatusOK, w.Code) && assert.NotNil(t, envelopeLeaf.Layer) {
+		assert.Equal(t, baseDigest, envelopeLeaf.Layer.ParentName)
+		assert.Equal(t, "debian:8", envelopeLeaf.Layer.NamespaceName)
+	}
+
+	// A blob that does not match its digest fails, and the following layers are skipped.
+	status, envelope = postManifest(registry.URL, baseDigest, otherDigest, leafDigest)
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.NotNil(t, envelope.Error)
+	if assert.Len(t, envelope.Layers, 3) {
+		assert.Equal(t, LayerStatusProcessed, envelope.Layers[0].Status)
+		assert.Equal(t, LayerStatusFailed, envelope.Layers[1].Status)
+		assert.Equal(t, LayerStatusSkipped, envelope.Layers[2].Status)
+	}
+
+	// Invalid manifests and registries don't report any layer.
+	for _, registryURL := range []string{"ftp://registry", registry.URL} {
+		status, envelope = postManifest(registryURL)
+		assert.Equal(t, http.StatusBadRequest, status, registryURL)
+		assert.NotNil(t, envelope.Error, registryURL)
+		assert.Empty(t, envelope.Layers, registryURL)
+	}
+}
+
+func TestGetLayerAncestry(t *testing.T) {
+	debian8 := &database.Namespace{Name: "debian:8"}
+	layers := make(map[string]database.Layer)
+	addLayer := func(name, parentName string) {
+		layer := database.Layer{Name: name, EngineVersion: worker.Version, Namespace: debian8}
+		if parentName != "" {
+			layer.Parent = &database.Layer{Name: parentName}
+		}
+		layers[name] = layer
+	}
+	addLayer("base", "")
+	addLayer("first", "base")
+	addLayer("second", "first")
+	addLayer("leaf", "second")
+	addLayer("orphan", "deleted")
+	addLayer("cycle-a", "cycle-b")
+	addLayer("cycle-b", "cycle-a")
+
+	store := &database.MockDatastore{
+		FctFindLayer: func(ctx stdcontext.Context, name string, withFeatures, withVulnerabilities bool, minSeverity types.Priority) (database.Layer, error) {
+			if layer, exists := layers[name]; exists {
+				return layer, nil
+			}
+			return database.Layer{}, cerrors.ErrNotFound
+		},
+	}
+	getAncestry := func(maxDepth int, name string) (int, LayerAncestryEnvelope) {
+		router := NewRouter(&context.RouteContext{Store: store, Config: &config.APIConfig{MaxAncestryDepth: maxDepth}})
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", "/layers/"+name+"/ancestry", nil))
+
+		var envelope LayerAncestryEnvelope
+		assert.Nil(t, json.NewDecoder(w.Body).Decode(&envelope), name)
+		return w.Code, envelope
+	}
+
+	status, envelope := getAncestry(0, "leaf")
+	if assert.Equal(t, http.StatusOK, status) && assert.NotNil(t, envelope.Ancestry) {
+		var names []string
+		for _, layer := range *envelope.Ancestry {
+			names = append(names, layer.Name)
+			assert.Equal(t, "debian:8", layer.NamespaceName)
+			assert.Equal(t, worker.Version, layer.IndexedByVersion)
+		}
+		assert.Equal(t, []string{"leaf", "second", "first", "base"}, names)
+		assert.Equal(t, "second", (*envelope.Ancestry)[0].ParentName)
+	}
+
+	status, envelope = getAncestry(0, "base")
+	if assert.Equal(t, http.StatusOK, status) && assert.NotNil(t, envelope.Ancestry) {
+		assert.Len(t, *envelope.Ancestry, 1)
+	}
+
+	for _, test := range []struct {
+		maxDepth int
+		name     string
+		expected int
+	}{
+		{0, "unknown", http.StatusNotFound},
+		{4, "leaf", http.StatusOK},
+		{3, "leaf", statusUnprocessableEntity},
+		{0, "orphan", http.StatusInternalServerError},
+		{0, "cycle-a", http.StatusInternalServerError},
+	} {
+		status, envelope := getAncestry(test.maxDepth, test.name)
+		assert.Equal(t, test.expected, status, "%+v", test)
+		if test.expected != http.StatusOK {
+			assert.Nil(t, envelope.Ancestry, "%+v", test)
+			assert.NotNil(t, envelope.Error, "%+v", test)
+		}
+	}
+}
+
+func TestGetAffectedLayers(t *testing.T) {
+	store, closeStore := openDatastoreForTest(t)
+	defer closeStore()
+
+	// "first" and "second" add the vulnerable openssl, but the only child of "first" upgrades it.
+	debian8 := database.Namespace{Name: "debian:8"}
+	openssl := func(version string) []database.FeatureVersion {
+		return []database.FeatureVersion{{
+			Feature: database.Feature{Name: "openssl", Namespace: debian8},
+			Version: types.NewVersionUnsafe(version),
+		}}
+	}
+	for _, layer := range []struct {
+		name, parentName string
+		features         []database.FeatureVersion
+	}{
+		{"base", "", nil},
+		{"first", "base", openssl("1.0-1")},
+		{"first-upgraded", "first", openssl("1.0-2")},
+		{"second", "base", openssl("1.0-1")},
+		{"third", "", openssl("1.0-1")},
+	} {
+		dbLayer := database.Layer{Name: layer.name, EngineVersion: worker.Version, Namespace: &debian8, Features: layer.features}
+		if layer.parentName != "" {
+			parent, err := store.FindLayer(stdcontext.Background(), layer.parentName, true, false, types.Unknown)
+			if !assert.Nil(t, err) {
+				return
+			}
+			dbLayer.Parent = &parent
+		}
+		assert.Nil(t, store.InsertLayer(stdcontext.Background(), dbLayer))
+	}
+	assert.Nil(t, store.InsertVulnerabilities(stdcontext.Background(), []database.Vulnerability{{
+		Name:      "CVE-2016-0001",
+		Namespace: debian8,
+		Severity:  types.High,
+		FixedIn:   openssl("1.0-2"),
+	}}, false))
+
+	var key fernet.Key
+	assert.Nil(t, key.Generate())
+	router := NewRouter(&context.RouteContext{Store: store, Config: &config.APIConfig{PaginationKey: key.Encode()}})
+	getAffectedLayers := func(path string) (*httptest.ResponseRecorder, AffectedLayersEnvelope) {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+
+		var envelope AffectedLayersEnvelope
+		assert.Nil(t, json.NewDecoder(w.Body).Decode(&envelope), path)
+		return w, envelope
+	}
+
+	const affectedLayers = "/namespaces/debian:8/vulnerabilities/CVE-2016-0001/affected-layers"
+	var names []string
+	path := affectedLayers + "?limit=1"
+	for i := 0; i < 3; i++ {
+		w, envelope := getAffectedLayers(path)
+		if !assert.Equal(t, http.StatusOK, w.Code, path) || !assert.NotNil(t, envelope.Layers, path) {
+			return
+		}
+		assert.Equal(t, "2", w.Header().Get(totalCountHeader))
+		for _, layer := range *envelope.Layers {
+			names = append(names, layer.Name)
+		}
+
+		if envelope.NextPage == "" {
+			break
+		}
+		path = affectedLayers + "?limit=1&page=" + url.QueryEscape(envelope.NextPage)
+	}
+	assert.Equal(t, []string{"second", "third"}, names)
+
+	for path, expected := range map[string]int{
+		"/namespaces/debian:8/vulnerabilities/CVE-2016-9999/affected-layers?limit=1": http.StatusNotFound,
+		affectedLayers + "?limit=1&page=garbage":                                     http.StatusBadRequest,
+		affectedLayers:                                                               http.StatusBadRequest,
+	} {
+		w, envelope := getAffectedLayers(path)
+		assert.Equal(t, expected, w.Code, path)
+		assert.NotNil(t, envelope.Error, path)
+	}
+}
@@ -0,0 +1,325 @@
+// Copyright 2015 clair authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v1
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// route identifies a route registered on the router.
+type route struct {
+	method, pattern string
+}
+
+// routeSpec describes a route in the specification of the API.
+type routeSpec struct {
+	summary string
+	query   []queryParameter
+	// request and response are the models of the bodies of the request and of the successful
+	// response, or nil if they have none.
+	request, response interface{}
+	// status is the status code of a successful response.
+	status int
+	// contentType is the content type of a successful response, when it is not JSON.
+	contentType string
+}
+
+type queryParameter struct {
+	name, typ, description string
+	required               bool
+}
+
+var (
+	limitParameter           = queryParameter{"limit", "integer", "Maximum number of results in the page.", true}
+	pageParameter            = queryParameter{"page", "string", "NextPage token of the previous page.", false}
+	minimumSeverityParameter = queryParameter{"minimumSeverity", "string", "Only includes the vulnerabilities whose severity is at least the given one.", false}
+)
+
+// routeSpecs describes every route of the API. NewRouter panics if a route is registered without
+// being described here, so that the specification can't drift from the router.
+var routeSpecs = map[route]routeSpec{
+	{"GET", "/"}: {
+		summary: "Get the versions of the server and the freshness of its vulnerability database.", response: ServerInfo{}, status: http.StatusOK,
+	},
+	{"POST", "/layers"}: {
+		summary: "Index a layer.", request: LayerEnvelope{}, response: LayerEnvelope{}, status: http.StatusCreated,
+	},
+	{"GET", "/layers/:layerName"}: {
+		summary: "Get a layer, optionally with its features and their vulnerabilities.",
+		query: []queryParameter{
+			{"features", "boolean", "Includes the features of the layer.", false},
+			{"vulnerabilities", "boolean", "Includes the features of the layer and their vulnerabilities.", false},
+			minimumSeverityParameter,
+		},
+		response: LayerEnvelope{}, status: http.StatusOK,
+	},
+	{"HEAD", "/layers/:layerName"}: {
+		summary: "Check whether a layer is indexed.", status: http.StatusOK,
+	},
+	{"GET", "/layers/:layerName/diff"}: {
+		summary: "Get the features that a layer adds and removes.", response: LayerDiffEnvelope{}, status: http.StatusOK,
+	},
+	{"GET", "/layers/:layerName/ancestry"}: {
+		summary: "List a layer and its parents.", response: LayerAncestryEnvelope{}, status: http.StatusOK,
+	},
+	{"DELETE", "/layers/:layerName"}: {
+		summary: "Delete a layer.",
+		query:   []queryParameter{{"recursive", "boolean", "Also deletes the descendants of the layer.", false}},
+		status:  http.StatusOK,
+	},
+	{"POST", "/images"}: {
+		summary: "Index the layers of an image, from the base layer to the leaf.",
+		request: ImageEnvelope{}, response: ImageStatusEnvelope{}, status: http.StatusCreated,
+	},
+	{"POST", "/images/manifest"}: {
+		summary: "Index the layers of an image described by an OCI or Docker image manifest, named by their digest.",
+		request: ManifestEnvelope{}, response: ImageStatusEnvelope{}, status: http.StatusCreated,
+	},
+	{"GET", "/namespaces"}: {
+		summary:  "List the namespaces.",
+		query:    []queryParameter{{"vulnerabilityCounts", "boolean", "Includes the number of vulnerabilities of each namespace.", false}},
+		response: NamespaceEnvelope{}, status: http.StatusOK,
+	},
+	{"GET", "/namespaces/:namespaceName/vulnerabilities"}: {
+		summary:  "List the vulnerabilities of a namespace.",
+		query:    []queryParameter{limitParameter, pageParameter, minimumSeverityParameter},
+		response: VulnerabilityEnvelope{}, status: http.StatusOK,
+	},
+	{"POST", "/namespaces/:namespaceName/vulnerabilities"}: {
+		summary: "Create a vulnerability.", request: VulnerabilityEnvelope{}, response: VulnerabilityEnvelope{}, status: http.StatusCreated,
+	},
+	{"GET", "/namespaces/:namespaceName/vulnerabilities/:vulnerabilityName"}: {
+		summary:  "Get a vulnerability.",
+		query:    []queryParameter{{"fixedIn", "boolean", "Includes the features that fix the vulnerability.", false}},
+		response: VulnerabilityEnvelope{}, status: http.StatusOK,
+	},
+	{"PUT", "/namespaces/:namespaceName/vulnerabilities/:vulnerabilityName"}: {
+		summary: "Replace a vulnerability.", request: VulnerabilityEnvelope{}, response: VulnerabilityEnvelope{}, status: http.StatusOK,
+	},
+	{"PATCH", "/namespaces/:namespaceName/vulnerabilities/:vulnerabilityName"}: {
+		summary: "Update the description, link or severity of a vulnerability.",
+		request: VulnerabilityEnvelope{}, response: VulnerabilityEnvelope{}, status: http.StatusOK,
+	},
+	{"DELETE", "/namespaces/:namespaceName/vulnerabilities/:vulnerabilityName"}: {
+		summary: "Delete a vulnerability.", status: http.StatusOK,
+	},
+	{"GET", "/namespaces/:namespaceName/vulnerabilities/:vulnerabilityName/affected-layers"}: {
+		summary:  "List the layers that introduce a vulnerability.",
+		query:    []queryParameter{limitParameter, pageParameter},
+		response: AffectedLayersEnvelope{}, status: http.StatusOK,
+	},
+	{"GET", "/namespaces/:namespaceName/vulnerabilities/:vulnerabilityName/fixes"}: {
+		summary: "List the features that fix a vulnerability.", response: FeatureEnvelope{}, status: http.StatusOK,
+	},
+	{"PUT", "/namespaces/:namespaceName/vulnerabilities/:vulnerabilityName/fixes/:fixName"}: {
+		summary: "Set the version of a feature that fixes a vulnerability.",
+		request: FeatureEnvelope{}, response: FeatureEnvelope{}, status: http.StatusOK,
+	},
+	{"DELETE", "/namespaces/:namespaceName/vulnerabilities/:vulnerabilityName/fixes/:fixName"}: {
+		summary: "Remove a feature from the fixes of a vulnerability.", status: http.StatusOK,
+	},
+	{"GET", "/notifications/:notificationName"}: {
+		summary:  "Get a page of a notification.",
+		query:    []queryParameter{limitParameter, pageParameter},
+		response: NotificationEnvelope{}, status: http.StatusOK,
+	},
+	{"DELETE", "/notifications/:notificationName"}: {
+		summary: "Mark a notification as read.", status: http.StatusOK,
+	},
+	{"POST", "/updater/run"}: {
+		summary: "Start an update of the vulnerability database, unless one is in progress.", response: UpdaterEnvelope{}, status: http.StatusAccepted,
+	},
+	{"GET", "/updater/status"}: {
+		summary: "Get the last, last successful and next updates of the vulnerability database.", response: UpdaterEnvelope{}, status: http.StatusOK,
+	},
+	{"GET", "/metrics"}: {
+		summary: "Get the Prometheus metrics.", status: http.StatusOK, contentType: "text/plain",
+	},
+	{"GET", "/spec"}: {
+		summary: "Get this OpenAPI description of the API.", status: http.StatusOK, contentType: "application/json",
+	},
+}
+
+// newSpec builds the OpenAPI 3 description of the given routes. The schemas of the bodies are
+// generated from the models that the handlers encode and decode.
+func newSpec(routes []route) map[string]interface{} {
+	schemas := make(map[string]interface{})
+	paths := make(map[string]map[string]interface{})
+
+	for _, r := range routes {
+		spec, ok := routeSpecs[r]
+		if !ok {
+			panic(fmt.Sprintf("v1: route %s %s is not described in the specification", r.method, r.pattern))
+		}
+
+		path, parameters := specPath(r.pattern)
+		for _, q := range spec.query {
+			parameters = append(parameters, map[string]interface{}{
+				"name":        q.name,
+				"in":          "query",
+				"description": q.description,
+				"required":    q.required,
+				"schema":      map[string]interface{}{"type": q.typ},
+			})
+		}
+
+		success := map[string]interface{}{"description": http.StatusText(spec.status)}
+		switch {
+		case spec.response != nil:
+			success["content"] = jsonContent(schemaOf(reflect.TypeOf(spec.response), schemas))
+		case spec.contentType != "":
+			success["content"] = map[string]interface{}{spec.contentType: map[string]interface{}{}}
+		}
+
+		operation := map[string]interface{}{
+			"summary":    spec.summary,
+			"parameters": parameters,
+			"responses": map[string]interface{}{
+				strconv.Itoa(spec.status): success,
+				"default": map[string]interface{}{
+					"description": "Error",
+					"content":     jsonContent(schemaOf(reflect.TypeOf(ErrorEnvelope{}), schemas)),
+				},
+			},
+		}
+		if spec.request != nil {
+			operation["requestBody"] = map[string]interface{}{
+				"required": true,
+				"content":  jsonContent(schemaOf(reflect.TypeOf(spec.request), schemas)),
+			}
+		}
+
+		if paths[path] == nil {
+			paths[path] = make(map[string]interface{})
+		}
+		paths[path][strings.ToLower(r.method)] = operation
+	}
+
+	return map[string]interface{}{
+		"openapi":    "3.0.0",
+		"info":       map[string]interface{}{"title": "Clair", "version": "v1"},
+		"servers":    []interface{}{map[string]interface{}{"url": "/v1"}},
+		"paths":      paths,
+		"components": map[string]interface{}{"schemas": schemas},
+	}
+}
+
+// specPath converts an httprouter pattern to an OpenAPI path, and returns its parameters.
+func specPath(pattern string) (string, []interface{}) {
+	parameters := []interface{}{}
+	segments := strings.Split(pattern, "/")
+	for i, segment := range segments {
+		if strings.HasPrefix(segment, ":") {
+			name := segment[1:]
+			segments[i] = "{" + name + "}"
+			parameters = append(parameters, map[string]interface{}{
+				"name":     name,
+				"in":       "path",
+				"required": true,
+				"schema":   map[string]interface{}{"type": "string"},
+			})
+		}
+	}
+	return strings.Join(segments, "/"), parameters
+}
+
+func jsonContent(schema map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{"application/json": map[string]interface{}{"schema": schema}}
+}
+
+var (
+	jsonMarshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+	rawMessageType    = reflect.TypeOf(json.RawMessage{})
+)
+
+// schemaOf returns the JSON schema of the values of type t as encoding/json marshals them. Structs
+// are added to schemas and referenced.
+func schemaOf(t reflect.Type, schemas map[string]interface{}) map[string]interface{} {
+	// Raw JSON documents, such as image manifests, are objects.
+	if t == rawMessageType {
+		return map[string]interface{}{"type": "object"}
+	}
+
+	// Types that marshal themselves, such as versions, are marshaled as strings in the models.
+	if t.Implements(jsonMarshalerType) {
+		return map[string]interface{}{"type": "string"}
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		return schemaOf(t.Elem(), schemas)
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": schemaOf(t.Elem(), schemas)}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": schemaOf(t.Elem(), schemas)}
+	case reflect.Struct:
+		ref := map[string]interface{}{"$ref": "#/components/schemas/" + t.Name()}
+		if _, exists := schemas[t.Name()]; exists {
+			return ref
+		}
+
+		// Register the schema before describing its fields, which may reference it.
+		schema := map[string]interface{}{"type": "object"}
+		schemas[t.Name()] = schema
+
+		properties := make(map[string]interface{})
+		var required []string
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			tag := field.Tag.Get("json")
+			if field.PkgPath != "" || tag == "-" {
+				continue
+			}
+
+			name, options := tag, ""
+			if comma := strings.Index(tag, ","); comma >= 0 {
+				name, options = tag[:comma], tag[comma:]
+			}
+			if name == "" {
+				name = field.Name
+			}
+
+			properties[name] = schemaOf(field.Type, schemas)
+			if !strings.Contains(options, ",omitempty") {
+				required = append(required, name)
+			}
+		}
+
+		schema["properties"] = properties
+		if len(required) > 0 {
+			sort.Strings(required)
+			schema["required"] = required
+		}
+		return ref
+	default:
+		// Interfaces can hold any value.
+		return map[string]interface{}{}
+	}
+}
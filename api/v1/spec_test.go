@@ -0,0 +1,126 @@
+// Copyright 2015 clair authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v1
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/coreos/clair/api/context"
+	"github.com/coreos/clair/config"
+	"github.com/coreos/clair/database"
+)
+
+// collectRefs returns every "$ref" found in the given JSON value.
+func collectRefs(v interface{}) (refs []string) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for key, value := range v {
+			if ref, ok := value.(string); ok && key == "$ref" {
+				refs = append(refs, ref)
+			}
+			refs = append(refs, collectRefs(value)...)
+		}
+	case []interface{}:
+		for _, value := range v {
+			refs = append(refs, collectRefs(value)...)
+		}
+	}
+	return
+}
+
+func TestSpec(t *testing.T) {
+	router := NewRouter(&context.RouteContext{Store: &database.MockDatastore{}, Config: &config.APIConfig{}})
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/spec", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var spec struct {
+		OpenAPI string `json:"openapi"`
+		Info    struct {
+			Title, Version string
+		} `json:"info"`
+		Paths map[string]map[string]struct {
+			Parameters []struct {
+				Name, In string
+				Required bool
+			} `json:"parameters"`
+			Responses map[string]interface{} `json:"responses"`
+		} `json:"paths"`
+		Components struct {
+			Schemas map[string]interface{} `json:"schemas"`
+		} `json:"components"`
+	}
+	body := w.Body.Bytes()
+	if !assert.Nil(t, json.Unmarshal(body, &spec)) {
+		return
+	}
+	assert.Equal(t, "3.0.0", spec.OpenAPI)
+	assert.Equal(t, "v1", spec.Info.Version)
+
+	// Every described route is in the specification and is registered on the router; NewRouter
+	// panics if a registered route is not described.
+	paramRegexp := regexp.MustCompile(`\{([^}]+)\}`)
+	for r := range routeSpecs {
+		path, _ := specPath(r.pattern)
+		operation, ok := spec.Paths[path][strings.ToLower(r.method)]
+		if !assert.True(t, ok, "%s %s", r.method, path) {
+			continue
+		}
+		assert.NotEmpty(t, operation.Responses, "%s %s", r.method, path)
+
+		// The path parameters are declared.
+		for _, match := range paramRegexp.FindAllStringSubmatch(path, -1) {
+			declared := false
+			for _, parameter := range operation.Parameters {
+				declared = declared || parameter.In == "path" && parameter.Name == match[1] && parameter.Required
+			}
+			assert.True(t, declared, "%s %s: %s", r.method, path, match[1])
+		}
+
+		handle, _, _ := router.Lookup(r.method, paramRegexp.ReplaceAllString(path, "x"))
+		assert.NotNil(t, handle, "%s %s is not registered", r.method, path)
+	}
+	paths := make(map[string]bool)
+	for r := range routeSpecs {
+		path, _ := specPath(r.pattern)
+		paths[path] = true
+	}
+	assert.Len(t, spec.Paths, len(paths))
+
+	// The models are described, and every reference resolves.
+	for _, model := range []string{"Layer", "Feature", "Vulnerability", "Namespace", "Notification", "Error", "ErrorEnvelope"} {
+		assert.Contains(t, spec.Components.Schemas, model)
+	}
+	var document interface{}
+	assert.Nil(t, json.Unmarshal(body, &document))
+	for _, ref := range collectRefs(document) {
+		assert.Contains(t, spec.Components.Schemas, strings.TrimPrefix(ref, "#/components/schemas/"), ref)
+	}
+
+	// The schemas follow the JSON encoding of the models.
+	layer := spec.Components.Schemas["Layer"].(map[string]interface{})
+	properties := layer["properties"].(map[string]interface{})
+	assert.Contains(t, properties, "IndexedByVersion")
+	assert.Equal(t, map[string]interface{}{"type": "array", "items": map[string]interface{}{"$ref": "#/components/schemas/Feature"}}, properties["Features"])
+	assert.Equal(t, []interface{}{"Message"}, spec.Components.Schemas["Error"].(map[string]interface{})["required"])
+}
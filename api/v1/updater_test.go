@@ -0,0 +1,115 @@
+// Copyright 2015 clair authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v1
+
+import (
+	stdcontext "context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/coreos/clair/api/context"
+	"github.com/coreos/clair/config"
+	"github.com/coreos/clair/database"
+	"github.com/coreos/clair/updater"
+	"github.com/coreos/clair/utils/types"
+)
+
+// testFetcher returns a single vulnerability once release is closed.
+type testFetcher struct {
+	release chan struct{}
+}
+
+func (f *testFetcher) FetchUpdate(database.Datastore) (updater.FetcherResponse, error) {
+	<-f.release
+
+	openssl := database.Feature{Name: "openssl", Namespace: database.Namespace{Name: "debian:8"}}
+	return updater.FetcherResponse{Vulnerabilities: []database.Vulnerability{{
+		Name:     "CVE-FETCHED",
+		Severity: types.High,
+		FixedIn:  []database.FeatureVersion{{Feature: openssl, Version: types.NewVersionUnsafe("2.0")}},
+	}}}, nil
+}
+
+func (f *testFetcher) Clean() {}
+
+var fetcherForTest = &testFetcher{}
+
+func init() {
+	updater.RegisterFetcher("test", fetcherForTest)
+}
+
+func TestUpdaterRun(t *testing.T) {
+	store, closeStore := openDatastoreForTest(t)
+	defer closeStore()
+
+	fetcherForTest.release = make(chan struct{})
+	router := NewRouter(&context.RouteContext{Store: store, Config: &config.APIConfig{}})
+	do := func(method, path string) (int, UpdaterEnvelope) {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(method, path, nil))
+
+		var envelope UpdaterEnvelope
+		assert.Nil(t, json.NewDecoder(w.Body).Decode(&envelope))
+		return w.Code, envelope
+	}
+	getStatus := func() *UpdaterStatus {
+		status, envelope := do("GET", "/updater/status")
+		if !assert.Equal(t, http.StatusOK, status) || !assert.NotNil(t, envelope.Status) {
+			t.FailNow()
+		}
+		return envelope.Status
+	}
+
+	// Nothing ran yet.
+	assert.Nil(t, getStatus().LastRun)
+
+	status, envelope := do("POST", "/updater/run")
+	if !assert.Equal(t, http.StatusAccepted, status) || !assert.NotNil(t, envelope.Run) {
+		return
+	}
+	runID := envelope.Run.ID
+	assert.NotEmpty(t, runID)
+
+	// The update holds the lock until its fetcher returns.
+	status, envelope = do("POST", "/updater/run")
+	assert.Equal(t, http.StatusConflict, status)
+	assert.NotNil(t, envelope.Error)
+
+	close(fetcherForTest.release)
+
+	var updaterStatus *UpdaterStatus
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if updaterStatus = getStatus(); updaterStatus.LastRun != nil && updaterStatus.LastRun.Ended != "" {
+			break
+		}
+	}
+	if assert.NotNil(t, updaterStatus.LastRun) {
+		assert.Equal(t, runID, updaterStatus.LastRun.ID)
+		assert.NotEmpty(t, updaterStatus.LastRun.Started)
+		assert.NotEmpty(t, updaterStatus.LastRun.Ended)
+		assert.Empty(t, updaterStatus.LastRun.Error)
+		assert.Equal(t, map[string]UpdaterFetcher{"test": {Vulnerabilities: 1}}, updaterStatus.LastRun.Fetchers)
+	}
+	assert.NotEmpty(t, updaterStatus.LastSuccessfulUpdate)
+	assert.Empty(t, updaterStatus.NextScheduledUpdate)
+
+	_, err := store.FindVulnerability(stdcontext.Background(), "debian:8", "CVE-FETCHED")
+	assert.Nil(t, err)
+}
@@ -20,6 +20,7 @@ import (
 	"math/rand"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
@@ -30,6 +31,8 @@ import (
 	"github.com/coreos/clair/notifier"
 	"github.com/coreos/clair/updater"
 	"github.com/coreos/clair/utils"
+	"github.com/coreos/clair/worker"
+	"github.com/coreos/clair/worker/detectors"
 	"github.com/coreos/pkg/capnslog"
 )
 
@@ -41,6 +44,34 @@ func Boot(config *config.Config) {
 	rand.Seed(time.Now().UnixNano())
 	st := utils.NewStopper()
 
+	// Disable the detectors that are not wanted, bound the extraction of the layers and their
+	// ancestry and set how they are downloaded, and how many are analyzed simultaneously.
+	if config.Worker != nil {
+		if err := detectors.DisableDetectors(config.Worker.DisabledDetectors); err != nil {
+			log.Fatal(err)
+		}
+		worker.SetExtractionLimits(utils.ExtractionLimits{
+			MaxFileSize:                 config.Worker.MaxFileSize,
+			MaxExtractedSize:            config.Worker.MaxExtractedSize,
+			MaxPatternMatches:           config.Worker.MaxPatternMatches,
+			MaxExecutableSize:           config.Worker.MaxExecutableSize,
+			MaxExtractedExecutablesSize: config.Worker.MaxExtractedExecutablesSize,
+		})
+		worker.SetMaxLayerTreeDepth(config.Worker.MaxLayerTreeDepth)
+
+		registries := make(map[string]detectors.RegistryCredentials, len(config.Worker.Registries))
+		for host, c := range config.Worker.Registries {
+			registries[host] = detectors.RegistryCredentials{Username: c.Username, Password: c.Password}
+		}
+		detectors.SetRegistryCredentials(registries)
+		detectors.SetDownloadPolicy(config.Worker.DownloadAttempts, config.Worker.DownloadTimeout)
+		if err := detectors.SetLayerCache(config.Worker.CacheDirectory, config.Worker.CacheMaxSize); err != nil {
+			log.Fatalf("could not open the layer cache: %s", err)
+		}
+		worker.SetConcurrency(config.Worker.Concurrency, config.Worker.QueueSize)
+	}
+	log.Infof("enabled detectors: %s", strings.Join(worker.DetectorNames(), ", "))
+
 	// Open database
 	db, err := database.Open(config.Database)
 	if err != nil {
@@ -53,18 +84,30 @@ func Boot(config *config.Config) {
 	go notifier.Run(config.Notifier, db, st)
 
 	// Start API
+	// The main API has its own stopper, so that it drains its in-flight requests while the health
+	// API, which is stopped afterwards, reports Clair as stopping to the load balancers.
+	apiSt := utils.NewStopper()
+	apiSt.Begin()
+	go api.Run(config.API, &context.RouteContext{db, config.API}, apiSt)
 	st.Begin()
-	go api.Run(config.API, &context.RouteContext{db, config.API}, st)
-	st.Begin()
-	go api.RunHealth(config.API, &context.RouteContext{db, config.API}, st)
+	go api.RunHealth(config.API, &context.RouteContext{db, config.API}, st, apiSt.Chan())
 
 	// Start updater
 	st.Begin()
 	go updater.Run(config.Updater, db, st)
 
+	// Start reindexer
+	var localPaths []string
+	if config.API != nil && config.API.LocalPathsAllowed {
+		localPaths = config.API.LocalPathPrefixes
+	}
+	st.Begin()
+	go worker.RunReindexer(config.Worker, localPaths, db, st)
+
 	// Wait for interruption and shutdown gracefully.
 	waitForSignals(syscall.SIGINT, syscall.SIGTERM)
 	log.Info("Received interruption, gracefully stopping ...")
+	apiSt.Stop()
 	st.Stop()
 }
 
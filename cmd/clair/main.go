@@ -15,6 +15,7 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"os"
 	"runtime/pprof"
@@ -24,6 +25,7 @@ import (
 
 	"github.com/coreos/clair"
 	"github.com/coreos/clair/config"
+	"github.com/coreos/clair/database"
 
 	// Register components
 	_ "github.com/coreos/clair/notifier/notifiers"
@@ -36,15 +38,24 @@ import (
 	_ "github.com/coreos/clair/worker/detectors/data/aci"
 	_ "github.com/coreos/clair/worker/detectors/data/docker"
 
+	_ "github.com/coreos/clair/worker/detectors/feature/apk"
 	_ "github.com/coreos/clair/worker/detectors/feature/dpkg"
+	_ "github.com/coreos/clair/worker/detectors/feature/gem"
+	_ "github.com/coreos/clair/worker/detectors/feature/gobinary"
+	_ "github.com/coreos/clair/worker/detectors/feature/npm"
+	_ "github.com/coreos/clair/worker/detectors/feature/pip"
 	_ "github.com/coreos/clair/worker/detectors/feature/rpm"
 
+	_ "github.com/coreos/clair/worker/detectors/namespace/alpinerelease"
+	_ "github.com/coreos/clair/worker/detectors/namespace/amazonrelease"
 	_ "github.com/coreos/clair/worker/detectors/namespace/aptsources"
 	_ "github.com/coreos/clair/worker/detectors/namespace/lsbrelease"
 	_ "github.com/coreos/clair/worker/detectors/namespace/osrelease"
 	_ "github.com/coreos/clair/worker/detectors/namespace/redhatrelease"
+	_ "github.com/coreos/clair/worker/detectors/namespace/suserelease"
 
 	_ "github.com/coreos/clair/database/pgsql"
+	_ "github.com/coreos/clair/database/sqlite"
 )
 
 var log = capnslog.NewPackageLogger("github.com/coreos/clair/cmd/clair", "main")
@@ -55,6 +66,8 @@ func main() {
 	flagConfigPath := flag.String("config", "/etc/clair/config.yaml", "Load configuration from the specified file.")
 	flagCPUProfilePath := flag.String("cpu-profile", "", "Write a CPU profile to the specified file before exiting.")
 	flagLogLevel := flag.String("log-level", "info", "Define the logging level.")
+	flagExportPath := flag.String("export-vulnerabilities", "", "Export the vulnerabilities to the specified file and exit.")
+	flagImportPath := flag.String("import-vulnerabilities", "", "Import the vulnerabilities from the specified file and exit.")
 	flag.Parse()
 	// Load configuration
 	config, err := config.Load(*flagConfigPath)
@@ -72,7 +85,71 @@ func main() {
 		defer stopCPUProfiling(startCPUProfiling(*flagCPUProfilePath))
 	}
 
-	clair.Boot(config)
+	switch {
+	case *flagExportPath != "":
+		exportVulnerabilities(config, *flagExportPath)
+	case *flagImportPath != "":
+		importVulnerabilities(config, *flagImportPath)
+	default:
+		clair.Boot(config)
+	}
+}
+
+// exportVulnerabilities dumps the vulnerabilities of the configured database to the specified
+// file, so they can be imported by instances that can't fetch them, e.g. in air-gapped
+// environments.
+func exportVulnerabilities(config *config.Config, path string) {
+	db, err := database.Open(config.Database)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	f, err := os.Create(path)
+	if err != nil {
+		log.Fatalf("failed to create export file: %s", err)
+	}
+
+	if err = database.ExportVulnerabilities(context.Background(), db, f); err == nil {
+		err = f.Close()
+	}
+	if err != nil {
+		f.Close()
+		log.Fatalf("failed to export vulnerabilities: %s", err)
+	}
+
+	log.Infof("exported vulnerabilities to %s", path)
+}
+
+// importVulnerabilities loads the vulnerabilities of the specified file, created by
+// exportVulnerabilities, into the configured database.
+func importVulnerabilities(config *config.Config, path string) {
+	db, err := database.Open(config.Database)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	f, err := os.Open(path)
+	if err != nil {
+		log.Fatalf("failed to open import file: %s", err)
+	}
+	defer f.Close()
+
+	ctx := database.ContextWithSource(context.Background(), "import")
+
+	// Like the updater on its first update, don't notify about every vulnerability when the
+	// database is empty: nothing can be affected yet.
+	namespaces, err := db.ListNamespaces(ctx)
+	if err != nil {
+		log.Fatalf("failed to import vulnerabilities: %s", err)
+	}
+
+	if err = database.ImportVulnerabilities(ctx, db, f, len(namespaces) > 0); err != nil {
+		log.Fatalf("failed to import vulnerabilities: %s", err)
+	}
+
+	log.Infof("imported vulnerabilities from %s", path)
 }
 
 func startCPUProfiling(path string) *os.File {
@@ -47,6 +47,7 @@ type Config struct {
 	Updater  *UpdaterConfig
 	Notifier *NotifierConfig
 	API      *APIConfig
+	Worker   *WorkerConfig
 }
 
 // UpdaterConfig is the configuration for the Updater service.
@@ -54,6 +55,66 @@ type UpdaterConfig struct {
 	Interval time.Duration
 }
 
+// WorkerConfig is the configuration of the layer analysis.
+type WorkerConfig struct {
+	// DisabledDetectors lists the names of the namespace and features detectors that must not run.
+	DisabledDetectors []string
+
+	// MaxFileSize is the maximum size, in bytes, of a file extracted from a layer. 0 means no limit.
+	MaxFileSize int64
+
+	// MaxExtractedSize is the maximum size, in bytes, of all the files extracted from a layer. 0
+	// means no limit.
+	MaxExtractedSize int64
+
+	// MaxPatternMatches is the maximum number of files extracted from a layer for a pattern of
+	// required files, such as the package.json files of node_modules. 0 means no limit.
+	MaxPatternMatches int
+
+	// MaxExecutableSize and MaxExtractedExecutablesSize are the maximum size of an executable
+	// scanned by the detectors of binaries, and of those executables together. The others are
+	// skipped. 0 means no limit.
+	MaxExecutableSize           int64
+	MaxExtractedExecutablesSize int64
+
+	// Concurrency is the number of layers analyzed simultaneously, and QueueSize the number of
+	// layers that may wait for their turn, beyond which the API refuses new layers. 0 means no
+	// limit.
+	Concurrency int
+	QueueSize   int
+
+	// MaxLayerTreeDepth is the maximum number of layers that can be stacked on top of each other.
+	// The layers whose parent is already that deep are rejected before being analyzed. 0 means no
+	// limit, other than the database's.
+	MaxLayerTreeDepth int
+
+	// ReindexRate is the number of layers per second that are analyzed again in the background
+	// after an upgrade of the engine. 0 disables the reindexing.
+	ReindexRate float64
+
+	// DownloadAttempts is the number of attempts to download a layer, which is retried after
+	// connection and server errors, and resumed when interrupted.
+	DownloadAttempts int
+
+	// DownloadTimeout is the time the download of a layer may take, retries included.
+	DownloadTimeout time.Duration
+
+	// CacheDirectory is the directory in which the layers downloaded along with their digest are
+	// cached, up to CacheMaxSize bytes. An empty directory disables the cache.
+	CacheDirectory string
+	CacheMaxSize   int64
+
+	// Registries holds the credentials of the Docker registries the layers are downloaded from,
+	// by host.
+	Registries map[string]RegistryCredentials
+}
+
+// RegistryCredentials are the credentials that authenticate Clair to a Docker registry.
+type RegistryCredentials struct {
+	Username string
+	Password string
+}
+
 // NotifierConfig is the configuration for the Notifier service and its registered notifiers.
 type NotifierConfig struct {
 	Attempts         int
@@ -63,11 +124,41 @@ type NotifierConfig struct {
 
 // APIConfig is the configuration for the API service.
 type APIConfig struct {
+	Addr                      string
 	Port                      int
+	HealthAddr                string
 	HealthPort                int
+	HealthMaxUpdateAge        time.Duration
 	Timeout                   time.Duration
+	ShutdownGracePeriod       time.Duration
+	ReadTimeout               time.Duration
+	WriteTimeout              time.Duration
+	IdleTimeout               time.Duration
+	MaxHeaderBytes            int
 	PaginationKey             string
+	MaxPageSize               int
+	MaxAncestryDepth          int
+	LayerNamePattern          string
+	MaxBodySize               int64
+	MaxImageBodySize          int64
+	ReadRateLimit             RateLimitConfig
+	MutationRateLimit         RateLimitConfig
+	CORSAllowedOrigins        []string
+	CORSAllowedMethods        []string
+	LocalPathsAllowed         bool
+	LocalPathPrefixes         []string
 	CertFile, KeyFile, CAFile string
+	BearerTokens              []string
+	PublicMetrics             bool
+	Profiling                 bool
+	AccessLogFormat           string
+}
+
+// RateLimitConfig limits the number of requests per second of each API client, allowing bursts
+// of up to Burst requests. A zero Rate disables the limit.
+type RateLimitConfig struct {
+	Rate  float64
+	Burst int
 }
 
 // DefaultConfig is a configuration that can be used as a fallback value.
@@ -80,14 +171,36 @@ func DefaultConfig() Config {
 			Interval: 1 * time.Hour,
 		},
 		API: &APIConfig{
-			Port:       6060,
-			HealthPort: 6061,
-			Timeout:    900 * time.Second,
+			Port:                6060,
+			HealthPort:          6061,
+			Timeout:             900 * time.Second,
+			ShutdownGracePeriod: 30 * time.Second,
+			ReadTimeout:         30 * time.Second,
+			IdleTimeout:         120 * time.Second,
+			MaxHeaderBytes:      1 << 20,
+			MaxPageSize:         1000,
+			MaxAncestryDepth:    127,
+			MaxBodySize:         4 << 20,
+			MaxImageBodySize:    32 << 20,
 		},
 		Notifier: &NotifierConfig{
 			Attempts:         5,
 			RenotifyInterval: 2 * time.Hour,
 		},
+		Worker: &WorkerConfig{
+			MaxFileSize:                 200 << 20,
+			MaxExtractedSize:            512 << 20,
+			MaxPatternMatches:           10000,
+			MaxExecutableSize:           64 << 20,
+			MaxExtractedExecutablesSize: 256 << 20,
+			Concurrency:                 4,
+			QueueSize:                   64,
+			MaxLayerTreeDepth:           127,
+			ReindexRate:                 1,
+			DownloadAttempts:            5,
+			DownloadTimeout:             30 * time.Minute,
+			CacheMaxSize:                10 << 30,
+		},
 	}
 }
 
@@ -16,11 +16,13 @@
 package database
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"time"
 
 	"github.com/coreos/clair/config"
+	"github.com/coreos/clair/utils/types"
 )
 
 var (
@@ -31,8 +33,50 @@ var (
 	// ErrInconsistent is an error that occurs when a database consistency check
 	// fails (ie. when an entity which is supposed to be unique is detected twice)
 	ErrInconsistent = errors.New("database: inconsistent database")
+
+	// ErrAlreadyExists is an error that occurs when an entity which is supposed to be unique is
+	// inserted twice.
+	ErrAlreadyExists = errors.New("database: already exists")
+
+	// ErrLayerHasChildren is an error that occurs when a Layer that other layers are based on is
+	// deleted non-recursively.
+	ErrLayerHasChildren = errors.New("database: layer has children")
+
+	// ErrCantOpen is an error that occurs when the database could not be opened.
+	ErrCantOpen = errors.New("database: could not open database")
 )
 
+// ErrIncompatibleSchema is an error that occurs when the database has been created or used by a
+// version of Clair whose schema is not compatible with the current one.
+type ErrIncompatibleSchema struct {
+	Found    int
+	Expected int
+}
+
+func (e *ErrIncompatibleSchema) Error() string {
+	return fmt.Sprintf("%s: incompatible schema version %d (expected %d)", ErrCantOpen, e.Found, e.Expected)
+}
+
+// Unwrap returns ErrCantOpen, which ErrIncompatibleSchema is a kind of.
+func (e *ErrIncompatibleSchema) Unwrap() error {
+	return ErrCantOpen
+}
+
+// DefaultMaxLayerTreeDepth is the default maximum number of layers that can be stacked on top of
+// each other. It matches Docker's limit.
+const DefaultMaxLayerTreeDepth = 127
+
+// ErrLayerTreeTooDeep is an error that occurs when the ancestry of a layer is made of more layers
+// than allowed.
+type ErrLayerTreeTooDeep struct {
+	Layer    string
+	MaxDepth int
+}
+
+func (e *ErrLayerTreeTooDeep) Error() string {
+	return fmt.Sprintf("database: layer %s has more than %d layers in its ancestry", e.Layer, e.MaxDepth)
+}
+
 var drivers = make(map[string]Driver)
 
 // Driver is a function that opens a Datastore specified by its database driver type and specific
@@ -62,38 +106,127 @@ func Open(cfg config.RegistrableComponentConfig) (Datastore, error) {
 	return driver(cfg)
 }
 
+type sourceContextKey struct{}
+
+// ContextWithSource returns a copy of the given context that specifies what is modifying the
+// database (e.g. the updater or the API), so implementations can record it.
+func ContextWithSource(ctx context.Context, source string) context.Context {
+	return context.WithValue(ctx, sourceContextKey{}, source)
+}
+
+// SourceFromContext returns the source specified with ContextWithSource, or an empty string.
+func SourceFromContext(ctx context.Context) string {
+	source, _ := ctx.Value(sourceContextKey{}).(string)
+	return source
+}
+
+type primaryContextKey struct{}
+
+// ContextWithPrimary returns a copy of the given context whose reads must see every previous
+// write, e.g. because they precede writes that depend on them: implementations with read replicas,
+// which lag behind, serve them from the primary database.
+func ContextWithPrimary(ctx context.Context) context.Context {
+	return context.WithValue(ctx, primaryContextKey{}, true)
+}
+
+// PrimaryFromContext returns whether the reads of the given context must be served by the primary
+// database, see ContextWithPrimary.
+func PrimaryFromContext(ctx context.Context) bool {
+	primary, _ := ctx.Value(primaryContextKey{}).(bool)
+	return primary
+}
+
 // Datastore is the interface that describes a database backend implementation.
+// Every method but Close takes a context: implementations should abort their queries and roll
+// back any pending transaction as soon as the context is canceled or its deadline is exceeded.
 type Datastore interface {
 	// # Namespace
 	// ListNamespaces returns the entire list of known Namespaces.
-	ListNamespaces() ([]Namespace, error)
+	ListNamespaces(ctx context.Context) ([]Namespace, error)
+
+	// CountVulnerabilitiesByNamespace returns the number of Vulnerabilities that haven't been
+	// deleted, by Namespace name. Namespaces without any Vulnerability may be omitted.
+	CountVulnerabilitiesByNamespace(ctx context.Context) (map[string]int, error)
+
+	// GetLastVulnerabilityChange returns the time at which a Vulnerability of the given Namespace
+	// was last inserted, modified or deleted, or the zero time if the Namespace never had any.
+	GetLastVulnerabilityChange(ctx context.Context, namespaceName string) (time.Time, error)
 
 	// # Layer
 	// InsertLayer stores a Layer in the database.
 	// A Layer is uniquely identified by its Name. The Name and EngineVersion fields are mandatory.
 	// If a Parent is specified, it is expected that it has been retrieved using FindLayer.
 	// If a Layer that already exists is inserted and the EngineVersion of the given Layer is higher
-	// than the stored one, the stored Layer should be updated.
+	// than the stored one, or equal but the given Layer has been processed by detectors that the
+	// stored one hasn't, the stored Layer should be updated: its Parent, Namespaces, Features and
+	// ProcessedBy are replaced by the given ones. The Layers that are based on it are not modified.
+	// The primary Namespace is stored among the Namespaces even if they don't list it. A Layer
+	// that has no Namespace inherits the Namespaces of its Parent.
 	// The function has to be idempotent, inserting a layer that already exists shouln'd return an
 	// error.
-	InsertLayer(Layer) error
+	InsertLayer(ctx context.Context, layer Layer) error
+
+	// InsertLayers stores the Layers of an image at once, atomically. They have to be ordered from
+	// the base Layer to the top one, and every Layer but the first must have the previous one as
+	// Parent, which doesn't have to be retrieved from the database. Each Layer is stored as
+	// InsertLayer would do.
+	InsertLayers(ctx context.Context, layers []Layer) error
 
-	// FindLayer retrieves a Layer from the database.
+	// FindLayer retrieves a Layer from the database, along with the detectors that processed it and
+	// its Namespaces, the primary one first.
 	// withFeatures specifies whether the Features field should be filled. When withVulnerabilities is
 	// true, the Features field should be filled and their AffectedBy fields should contain every
-	// vulnerabilities that affect them.
-	FindLayer(name string, withFeatures, withVulnerabilities bool) (Layer, error)
+	// vulnerabilities that affect them, as long as their Severity is at least minSeverity. Passing
+	// types.Unknown loads every vulnerability.
+	FindLayer(ctx context.Context, name string, withFeatures, withVulnerabilities bool, minSeverity types.Priority) (Layer, error)
+
+	// LayerExists returns whether a Layer is stored in the database, without loading it.
+	LayerExists(ctx context.Context, name string) (bool, error)
+
+	// GetLayerDiff retrieves the FeatureVersions that the specified Layer adds and removes compared
+	// to its parent, as detected when it was indexed. Unlike FindLayer, the parents of the Layer are
+	// not taken into account. The added FeatureVersions have AddedBy set to the Layer.
+	// ErrNotFound is returned if the Layer doesn't exist.
+	GetLayerDiff(ctx context.Context, name string) (added, removed []FeatureVersion, err error)
+
+	// FindLayerChildren retrieves the Layers that are directly based on the specified Layer.
+	// Only the ID and Name fields are filled.
+	FindLayerChildren(ctx context.Context, name string) ([]Layer, error)
+
+	// DeleteLayer deletes a Layer from the database.
+	// When recursive is true, every layers that are based on it are deleted as well, recursively.
+	// Otherwise, ErrLayerHasChildren is returned if any layer is based on it.
+	DeleteLayer(ctx context.Context, name string, recursive bool) error
+
+	// ListLayers returns at most limit Layers, ordered by Name, whose Name is strictly greater than
+	// startAfter. Only the ID, Name, EngineVersion fields and the Name of the Parent and Namespace
+	// are filled. An empty startAfter returns the first page; the Name of the last returned Layer
+	// should be given to retrieve the next one.
+	ListLayers(ctx context.Context, limit int, startAfter string) ([]Layer, error)
+
+	// ListLayersMissingDetector returns at most limit Layers that the given detector hasn't
+	// processed, paginated and filled like ListLayers, so they can be selectively indexed again.
+	ListLayersMissingDetector(ctx context.Context, detector string, limit int, startAfter string) ([]Layer, error)
 
-	// DeleteLayer deletes a Layer from the database and every layers that are based on it,
-	// recursively.
-	DeleteLayer(name string) error
+	// ListOutdatedLayers returns at most limit Layers, which are not stale, whose EngineVersion is
+	// lower than the given one, ordered by ID, whose ID is strictly greater than startAfterID. As
+	// the parents are stored before their children, they come first. The Path and Format are
+	// filled besides the fields of ListLayers.
+	ListOutdatedLayers(ctx context.Context, engineVersion, limit, startAfterID int) ([]Layer, error)
+
+	// MarkLayerStale flags the Layer as stale, see Layer.Stale.
+	MarkLayerStale(ctx context.Context, name string) error
+
+	// CountLayers returns the number of Layers stored in the database.
+	CountLayers(ctx context.Context) (int, error)
 
 	// # Vulnerability
-	// ListVulnerabilities returns the list of vulnerabilies of a certain Namespace.
+	// ListVulnerabilities returns the list of vulnerabilies of a certain Namespace whose Severity is
+	// at least minSeverity, following the order of types.Priorities.
 	// The Limit and page parameters are used to paginate the return list.
 	// The first given page should be 0. The function will then return the next available page.
 	// If there is no more page, -1 has to be returned.
-	ListVulnerabilities(namespaceName string, limit int, page int) ([]Vulnerability, int, error)
+	ListVulnerabilities(ctx context.Context, namespaceName string, minSeverity types.Priority, limit int, page int) ([]Vulnerability, int, error)
 
 	// InsertVulnerabilities stores the given Vulnerabilities in the database, updating them if
 	// necessary. A vulnerability is uniquely identified by its Namespace and its Name.
@@ -105,27 +238,54 @@ type Datastore interface {
 	// in the FixedIn list. For example, it doesn't make sense to have two `openssl` Feature listed as
 	// a Vulnerability can only be fixed in one Version. This is true because Vulnerabilities and
 	// Features are Namespaced (i.e. specific to one operating system).
+	// The Metadata field is keyed by source name (e.g. NVD) and is merged with the stored one: the
+	// data of each given source replaces the stored data of that source, a nil value removes it,
+	// and the sources that are not given are kept.
 	// Each vulnerability insertion or update has to create a Notification that will contain the
 	// old and the updated Vulnerability, unless createNotification equals to true.
-	InsertVulnerabilities(vulnerabilities []Vulnerability, createNotification bool) error
+	// Each update that modifies the Severity or the FixedIn list of a Vulnerability has to be
+	// recorded in its history, along with the source found in the context.
+	InsertVulnerabilities(ctx context.Context, vulnerabilities []Vulnerability, createNotification bool) error
+
+	// CreateVulnerability stores a new Vulnerability in the database, like InsertVulnerabilities.
+	// ErrAlreadyExists is returned if a Vulnerability with the same Namespace and Name exists,
+	// including when it is stored concurrently.
+	CreateVulnerability(ctx context.Context, vulnerability Vulnerability, createNotification bool) error
 
 	// FindVulnerability retrieves a Vulnerability from the database, including the FixedIn list.
-	FindVulnerability(namespaceName, name string) (Vulnerability, error)
+	FindVulnerability(ctx context.Context, namespaceName, name string) (Vulnerability, error)
+
+	// UpdateVulnerability applies the given changes to an existing Vulnerability and returns it as
+	// updated. Like an update of InsertVulnerabilities, the affected FeatureVersions are linked
+	// again and a Notification containing the old and the updated Vulnerability is created when
+	// anything changed, all at once. ErrNotFound is returned if the Vulnerability doesn't exist.
+	UpdateVulnerability(ctx context.Context, namespaceName, name string, update VulnerabilityUpdate) (Vulnerability, error)
 
 	// DeleteVulnerability removes a Vulnerability from the database.
 	// It has to create a Notification that will contain the old Vulnerability.
-	DeleteVulnerability(namespaceName, name string) error
+	DeleteVulnerability(ctx context.Context, namespaceName, name string) error
 
 	// InsertVulnerabilityFixes adds new FixedIn Feature or update the Versions of existing ones to
 	// the specified Vulnerability in the database.
 	// It has has to create a Notification that will contain the old and the updated Vulnerability.
-	InsertVulnerabilityFixes(vulnerabilityNamespace, vulnerabilityName string, fixes []FeatureVersion) error
+	InsertVulnerabilityFixes(ctx context.Context, vulnerabilityNamespace, vulnerabilityName string, fixes []FeatureVersion) error
 
 	// DeleteVulnerabilityFix removes a FixedIn Feature from the specified Vulnerability in the
 	// database. It can be used to store the fact that a Vulnerability no longer affects the given
 	// Feature in any Version.
 	// It has has to create a Notification that will contain the old and the updated Vulnerability.
-	DeleteVulnerabilityFix(vulnerabilityNamespace, vulnerabilityName, featureName string) error
+	DeleteVulnerabilityFix(ctx context.Context, vulnerabilityNamespace, vulnerabilityName, featureName string) error
+
+	// GetAffectedLayers returns at most limit Layers, ordered by ID, that introduce a FeatureVersion
+	// affected by the specified Vulnerability and whose ID is strictly greater than startAfterID,
+	// along with the total number of such Layers. Layers whose descendants all remove or upgrade
+	// the affected FeatureVersion are not returned. Only the ID and Name fields are filled.
+	// The ID of the last returned Layer should be given to retrieve the next page.
+	GetAffectedLayers(ctx context.Context, namespaceName, name string, limit, startAfterID int) ([]Layer, int, error)
+
+	// GetVulnerabilityHistory returns the recorded changes of the specified Vulnerability, the most
+	// recent first. Implementations may only keep a limited number of changes.
+	GetVulnerabilityHistory(ctx context.Context, namespaceName, name string) ([]VulnerabilityHistoryEntry, error)
 
 	// # Notification
 	// GetAvailableNotification returns the Name, Created, Notified and Deleted fields of a
@@ -133,7 +293,7 @@ type Datastore interface {
 	// marked as Notified by SetNotificationNotified, a Notification that hasn't been deleted should
 	// be returned again by this function. A Notification for which there is a valid Lock with the
 	// same Name should not be returned.
-	GetAvailableNotification(renotifyInterval time.Duration) (VulnerabilityNotification, error)
+	GetAvailableNotification(ctx context.Context, renotifyInterval time.Duration) (VulnerabilityNotification, error)
 
 	// GetNotification returns a Notification, including its OldVulnerability and NewVulnerability
 	// fields. On these Vulnerabilities, LayersIntroducingVulnerability should be filled with
@@ -141,23 +301,29 @@ type Datastore interface {
 	// The Limit and page parameters are used to paginate LayersIntroducingVulnerability. The first
 	// given page should be VulnerabilityNotificationFirstPage. The function will then return the next
 	// availage page. If there is no more page, NoVulnerabilityNotificationPage has to be returned.
-	GetNotification(name string, limit int, page VulnerabilityNotificationPageNumber) (VulnerabilityNotification, VulnerabilityNotificationPageNumber, error)
+	GetNotification(ctx context.Context, name string, limit int, page VulnerabilityNotificationPageNumber) (VulnerabilityNotification, VulnerabilityNotificationPageNumber, error)
 
 	// SetNotificationNotified marks a Notification as notified and thus, makes it unavailable for
 	// GetAvailableNotification, until the renotify duration is elapsed.
-	SetNotificationNotified(name string) error
+	SetNotificationNotified(ctx context.Context, name string) error
 
 	// DeleteNotification marks a Notification as deleted, and thus, makes it unavailable for
 	// GetAvailableNotification.
-	DeleteNotification(name string) error
+	DeleteNotification(ctx context.Context, name string) error
 
 	// # Key/Value
 	// InsertKeyValue stores or updates a simple key/value pair in the database.
-	InsertKeyValue(key, value string) error
+	// The key is mandatory, but the value may be empty.
+	InsertKeyValue(ctx context.Context, key, value string) error
 
 	// GetKeyValue retrieves a value from the database from the given key.
-	// It returns an empty string if there is no such key.
-	GetKeyValue(key string) (string, error)
+	// It returns ErrNotFound if there is no such key, which distinguishes it from an empty value.
+	GetKeyValue(ctx context.Context, key string) (string, error)
+
+	// CompareAndSwapKeyValue sets the value of the given key to new only if its current value is
+	// old, and returns whether the swap happened. An empty old value also matches a key that
+	// doesn't exist yet, in which case the key is created.
+	CompareAndSwapKeyValue(ctx context.Context, key, old, new string) (bool, error)
 
 	// # Lock
 	// Lock creates or renew a Lock in the database with the given name, owner and duration.
@@ -166,19 +332,35 @@ type Datastore interface {
 	// setting renew to true. Lock should not block, it should instead returns whether the Lock has
 	// been successfully acquired/renewed. If it's the case, the expiration time of that Lock is
 	// returned as well.
-	Lock(name string, owner string, duration time.Duration, renew bool) (bool, time.Time)
+	Lock(ctx context.Context, name string, owner string, duration time.Duration, renew bool) (bool, time.Time)
 
 	// Unlock releases an existing Lock.
-	Unlock(name, owner string)
+	Unlock(ctx context.Context, name, owner string)
 
 	// FindLock returns the owner of a Lock specified by the name, and its experation time if it
 	// exists.
-	FindLock(name string) (string, time.Time, error)
+	FindLock(ctx context.Context, name string) (string, time.Time, error)
 
 	// # Miscellaneous
-	// Ping returns the health status of the database.
-	Ping() bool
+	// Ping verifies that the database is reachable and able to serve queries, and returns the
+	// error that prevents it otherwise.
+	Ping(ctx context.Context) error
+
+	// GetStatistics returns the number of objects that the database holds. When exact is false,
+	// implementations may return cheaper estimates.
+	GetStatistics(ctx context.Context, exact bool) (Statistics, error)
 
 	// Close closes the database and free any allocated resource.
 	Close()
 }
+
+// NotificationListener is implemented by the Datastores that can signal that Notifications have
+// been created, so they can be sent without waiting for the next poll of
+// GetAvailableNotification.
+type NotificationListener interface {
+	// ListenNotifications returns a channel that receives a value when Notifications may have been
+	// created, until the given context is canceled. Signals may be coalesced or, if the
+	// connection to the database is lost, missed: a value is sent once the connection is
+	// re-established so the receiver catches up, but receivers should poll periodically anyway.
+	ListenNotifications(ctx context.Context) (<-chan struct{}, error)
+}
@@ -0,0 +1,1754 @@
+// Copyright 2015 clair authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package dbtest implements a behavioral test suite that every database.Datastore implementation
+// is expected to pass.
+package dbtest
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/coreos/clair/database"
+	cerrors "github.com/coreos/clair/utils/errors"
+	"github.com/coreos/clair/utils/types"
+)
+
+// Opener returns a new, empty, Datastore, which is distinct from the ones it returned before. It
+// should fail the test if the Datastore can't be opened.
+type Opener func(t *testing.T) database.Datastore
+
+// Run runs the test suite against the Datastores returned by open. Every test uses its own
+// Datastore, which is closed once the test is over.
+func Run(t *testing.T, open Opener) {
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, datastore database.Datastore)
+	}{
+		{"Namespace", testNamespace},
+		{"Layer", testLayer},
+		{"LayerUpdate", testLayerUpdate},
+		{"LayerAddedBy", testLayerAddedBy},
+		{"LayerDiff", testLayerDiff},
+		{"LayerRemovedFeatures", testLayerRemovedFeatures},
+		{"DeleteLayer", testDeleteLayer},
+		{"LayerExists", testLayerExists},
+		{"ListLayers", testListLayers},
+		{"LayerDetectors", testLayerDetectors},
+		{"OutdatedLayers", testOutdatedLayers},
+		{"LayerNamespaces", testLayerNamespaces},
+		{"InsertLayers", testInsertLayers},
+		{"LayerTreeDepth", testLayerTreeDepth},
+		{"LayerNames", testLayerNames},
+		{"Vulnerability", testVulnerability},
+		{"VulnerabilitySeverities", testVulnerabilitySeverities},
+		{"VulnerabilityCounts", testVulnerabilityCounts},
+		{"LastVulnerabilityChange", testLastVulnerabilityChange},
+		{"VulnerabilityFixes", testVulnerabilityFixes},
+		{"UpdateVulnerability", testUpdateVulnerability},
+		{"CreateVulnerability", testCreateVulnerability},
+		{"VersionSentinels", testVersionSentinels},
+		{"VersionFormats", testVersionFormats},
+		{"AffectedLayers", testAffectedLayers},
+		{"Notification", testNotification},
+		{"KeyValue", testKeyValue},
+		{"KeyValueCompareAndSwap", testKeyValueCompareAndSwap},
+		{"Lock", testLock},
+		{"Ping", testPing},
+		{"Statistics", testStatistics},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			datastore := open(t)
+			defer datastore.Close()
+
+			test.fn(t, datastore)
+		})
+	}
+
+	// Dumps are imported into a fresh datastore.
+	t.Run("VulnerabilityDump", func(t *testing.T) {
+		testVulnerabilityDump(t, open)
+	})
+}
+
+func newFeatureVersion(namespace, name, version string) database.FeatureVersion {
+	return database.FeatureVersion{
+		Feature: database.Feature{
+			Namespace: database.Namespace{Name: namespace},
+			Name:      name,
+		},
+		Version: types.NewVersionUnsafe(version),
+	}
+}
+
+func layerNames(layers []database.Layer) []string {
+	var names []string
+	for _, layer := range layers {
+		names = append(names, layer.Name)
+	}
+	return names
+}
+
+func featureVersions(layer database.Layer) map[string]database.FeatureVersion {
+	m := make(map[string]database.FeatureVersion)
+	for _, fv := range layer.Features {
+		m[fv.Feature.Name] = fv
+	}
+	return m
+}
+
+func testNamespace(t *testing.T, datastore database.Datastore) {
+	ctx := context.Background()
+
+	namespaces, err := datastore.ListNamespaces(ctx)
+	assert.Nil(t, err)
+	assert.Len(t, namespaces, 0)
+
+	for _, name := range []string{"debian:7", "debian:8"} {
+		layer := database.Layer{Name: "layer-" + name, EngineVersion: 1, Namespace: &database.Namespace{Name: name}}
+		assert.Nil(t, datastore.InsertLayer(ctx, layer))
+	}
+
+	namespaces, err = datastore.ListNamespaces(ctx)
+	if assert.Nil(t, err) && assert.Len(t, namespaces, 2) {
+		var names []string
+		for _, namespace := range namespaces {
+			names = append(names, namespace.Name)
+		}
+		assert.Contains(t, names, "debian:7")
+		assert.Contains(t, names, "debian:8")
+	}
+}
+
+func testLayer(t *testing.T, datastore database.Datastore) {
+	ctx := context.Background()
+
+	_, err := datastore.FindLayer(ctx, "unknown", true, true, types.Unknown)
+	assert.Equal(t, cerrors.ErrNotFound, err)
+
+	// A layer needs a name and an engine version.
+	assert.NotNil(t, datastore.InsertLayer(ctx, database.Layer{EngineVersion: 1}))
+
+	base := database.Layer{
+		Name:          "base",
+		EngineVersion: 1,
+		Namespace:     &database.Namespace{Name: "debian:7"},
+		Features: []database.FeatureVersion{
+			newFeatureVersion("debian:7", "openssl", "1.0"),
+			newFeatureVersion("debian:7", "wechat", "0.5"),
+		},
+	}
+	assert.Nil(t, datastore.InsertLayer(ctx, base))
+	// Inserting a layer is idempotent.
+	assert.Nil(t, datastore.InsertLayer(ctx, base))
+
+	parent, err := datastore.FindLayer(ctx, "base", true, false, types.Unknown)
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Equal(t, "base", parent.Name)
+	assert.Equal(t, 1, parent.EngineVersion)
+	assert.Nil(t, parent.Parent)
+	if assert.NotNil(t, parent.Namespace) {
+		assert.Equal(t, "debian:7", parent.Namespace.Name)
+	}
+	assert.Len(t, parent.Features, 2)
+
+	// The child upgrades openssl, removes wechat and inherits the namespace.
+	child := database.Layer{
+		Name:          "child",
+		EngineVersion: 1,
+		Parent:        &parent,
+		Features: []database.FeatureVersion{
+			newFeatureVersion("debian:7", "openssl", "2.0"),
+		},
+	}
+	assert.Nil(t, datastore.InsertLayer(ctx, child))
+
+	layer, err := datastore.FindLayer(ctx, "child", true, false, types.Unknown)
+	if !assert.Nil(t, err) {
+		return
+	}
+	if assert.NotNil(t, layer.Parent) {
+		assert.Equal(t, "base", layer.Parent.Name)
+	}
+	if assert.NotNil(t, layer.Namespace) {
+		assert.Equal(t, "debian:7", layer.Namespace.Name)
+	}
+	fvs := featureVersions(layer)
+	if assert.Len(t, fvs, 1) {
+		assert.Equal(t, types.NewVersionUnsafe("2.0"), fvs["openssl"].Version)
+		assert.Equal(t, "child", fvs["openssl"].AddedBy.Name)
+	}
+
+	// Without features.
+	layer, err = datastore.FindLayer(ctx, "child", false, false, types.Unknown)
+	if assert.Nil(t, err) {
+		assert.Len(t, layer.Features, 0)
+	}
+
+	children, err := datastore.FindLayerChildren(ctx, "base")
+	if assert.Nil(t, err) {
+		assert.Equal(t, []string{"child"}, layerNames(children))
+	}
+
+	count, err := datastore.CountLayers(ctx)
+	if assert.Nil(t, err) {
+		assert.Equal(t, 2, count)
+	}
+}
+
+func testLayerAddedBy(t *testing.T, datastore database.Datastore) {
+	ctx := context.Background()
+
+	// The middle layer removes openssl and adds wget, the top one adds openssl back.
+	assert.Nil(t, datastore.InsertLayers(ctx, []database.Layer{
+		{
+			Name:          "base",
+			EngineVersion: 1,
+			Namespace:     &database.Namespace{Name: "debian:7"},
+			Features: []database.FeatureVersion{
+				newFeatureVersion("debian:7", "openssl", "1.0"),
+				newFeatureVersion("debian:7", "curl", "7.0"),
+			},
+		},
+		{
+			Name:          "middle",
+			EngineVersion: 1,
+			Parent:        &database.Layer{Name: "base"},
+			Features: []database.FeatureVersion{
+				newFeatureVersion("debian:7", "curl", "7.0"),
+				newFeatureVersion("debian:7", "wget", "1.0"),
+			},
+		},
+		{
+			Name:          "top",
+			EngineVersion: 1,
+			Parent:        &database.Layer{Name: "middle"},
+			Features: []database.FeatureVersion{
+				newFeatureVersion("debian:7", "openssl", "1.0"),
+				newFeatureVersion("debian:7", "curl", "7.0"),
+				newFeatureVersion("debian:7", "wget", "1.0"),
+			},
+		},
+	}))
+
+	for name, expected := range map[string]map[string]string{
+		"base":   {"openssl": "base", "curl": "base"},
+		"middle": {"curl": "base", "wget": "middle"},
+		"top":    {"openssl": "top", "curl": "base", "wget": "middle"},
+	} {
+		layer, err := datastore.FindLayer(ctx, name, true, false, types.Unknown)
+		if !assert.Nil(t, err) {
+			continue
+		}
+
+		addedBy := make(map[string]string)
+		for _, fv := range layer.Features {
+			addedBy[fv.Feature.Name] = fv.AddedBy.Name
+		}
+		assert.Equal(t, expected, addedBy, "layer %s", name)
+	}
+}
+
+func testLayerDiff(t *testing.T, datastore database.Datastore) {
+	ctx := context.Background()
+
+	// The child upgrades openssl, which removes the version of the parent, and adds wget.
+	assert.Nil(t, datastore.InsertLayers(ctx, []database.Layer{
+		{
+			Name:          "parent",
+			EngineVersion: 1,
+			Namespace:     &database.Namespace{Name: "debian:7"},
+			Features: []database.FeatureVersion{
+				newFeatureVersion("debian:7", "openssl", "1.0"),
+				newFeatureVersion("debian:7", "curl", "7.0"),
+			},
+		},
+		{
+			Name:          "child",
+			EngineVersion: 1,
+			Parent:        &database.Layer{Name: "parent"},
+			Features: []database.FeatureVersion{
+				newFeatureVersion("debian:7", "openssl", "1.1"),
+				newFeatureVersion("debian:7", "curl", "7.0"),
+				newFeatureVersion("debian:7", "wget", "1.0"),
+			},
+		},
+	}))
+
+	versions := func(featureVersions []database.FeatureVersion, addedBy string) map[string]string {
+		m := make(map[string]string)
+		for _, fv := range featureVersions {
+			assert.Equal(t, addedBy, fv.AddedBy.Name)
+			m[fv.Feature.Name] = fv.Version.String()
+		}
+		return m
+	}
+
+	added, removed, err := datastore.GetLayerDiff(ctx, "child")
+	if assert.Nil(t, err) {
+		assert.Equal(t, map[string]string{"openssl": "1.1", "wget": "1.0"}, versions(added, "child"))
+		assert.Equal(t, map[string]string{"openssl": "1.0"}, versions(removed, ""))
+	}
+
+	added, removed, err = datastore.GetLayerDiff(ctx, "parent")
+	if assert.Nil(t, err) {
+		assert.Equal(t, map[string]string{"openssl": "1.0", "curl": "7.0"}, versions(added, "parent"))
+		assert.Len(t, removed, 0)
+	}
+
+	_, _, err = datastore.GetLayerDiff(ctx, "unknown")
+	assert.Equal(t, cerrors.ErrNotFound, err)
+}
+
+func testLayerRemovedFeatures(t *testing.T, datastore database.Datastore) {
+	ctx := context.Background()
+
+	// The child deletes the package database of its parent, e.g. with a whiteout file.
+	assert.Nil(t, datastore.InsertLayers(ctx, []database.Layer{
+		{
+			Name:          "parent",
+			EngineVersion: 1,
+			Namespace:     &database.Namespace{Name: "debian:7"},
+			Features: []database.FeatureVersion{
+				newFeatureVersion("debian:7", "openssl", "1.0"),
+				newFeatureVersion("debian:7", "curl", "7.0"),
+			},
+		},
+		{
+			Name:          "child",
+			EngineVersion: 1,
+			Parent:        &database.Layer{Name: "parent"},
+			Features:      []database.FeatureVersion{},
+		},
+	}))
+
+	child, err := datastore.FindLayer(ctx, "child", true, false, types.Unknown)
+	if assert.Nil(t, err) {
+		assert.Len(t, child.Features, 0)
+		if assert.NotNil(t, child.Namespace) {
+			assert.Equal(t, "debian:7", child.Namespace.Name)
+		}
+	}
+
+	added, removed, err := datastore.GetLayerDiff(ctx, "child")
+	if assert.Nil(t, err) {
+		assert.Len(t, added, 0)
+		assert.Len(t, removed, 2)
+	}
+
+	parent, err := datastore.FindLayer(ctx, "parent", true, false, types.Unknown)
+	if assert.Nil(t, err) {
+		assert.Len(t, parent.Features, 2)
+	}
+}
+
+func testLayerUpdate(t *testing.T, datastore database.Datastore) {
+	ctx := context.Background()
+
+	layer := database.Layer{
+		Name:          "layer",
+		EngineVersion: 1,
+		Namespace:     &database.Namespace{Name: "debian:7"},
+		Features:      []database.FeatureVersion{newFeatureVersion("debian:7", "openssl", "1.0")},
+	}
+	assert.Nil(t, datastore.InsertLayer(ctx, layer))
+
+	// A layer inserted with the same engine version is not modified.
+	layer.Namespace = &database.Namespace{Name: "debian:8"}
+	layer.Features = []database.FeatureVersion{newFeatureVersion("debian:8", "openssl", "1.1")}
+	assert.Nil(t, datastore.InsertLayer(ctx, layer))
+
+	stored, err := datastore.FindLayer(ctx, "layer", true, false, types.Unknown)
+	if assert.Nil(t, err) && assert.NotNil(t, stored.Namespace) {
+		assert.Equal(t, "debian:7", stored.Namespace.Name)
+	}
+
+	// A layer inserted with a higher engine version replaces the stored one.
+	layer.EngineVersion = 2
+	assert.Nil(t, datastore.InsertLayer(ctx, layer))
+
+	stored, err = datastore.FindLayer(ctx, "layer", true, false, types.Unknown)
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Equal(t, 2, stored.EngineVersion)
+	if assert.NotNil(t, stored.Namespace) {
+		assert.Equal(t, "debian:8", stored.Namespace.Name)
+	}
+	if assert.Len(t, stored.Features, 1) {
+		assert.Equal(t, "debian:8", stored.Features[0].Feature.Namespace.Name)
+		assert.Equal(t, types.NewVersionUnsafe("1.1"), stored.Features[0].Version)
+	}
+}
+
+func testDeleteLayer(t *testing.T, datastore database.Datastore) {
+	ctx := context.Background()
+
+	assert.Equal(t, cerrors.ErrNotFound, datastore.DeleteLayer(ctx, "unknown", false))
+
+	base := database.Layer{Name: "base", EngineVersion: 1}
+	child := database.Layer{Name: "child", EngineVersion: 1, Parent: &base}
+	grandchild := database.Layer{Name: "grandchild", EngineVersion: 1, Parent: &child}
+	assert.Nil(t, datastore.InsertLayers(ctx, []database.Layer{base, child, grandchild}))
+
+	assert.Equal(t, database.ErrLayerHasChildren, datastore.DeleteLayer(ctx, "base", false))
+
+	assert.Nil(t, datastore.DeleteLayer(ctx, "grandchild", false))
+	_, err := datastore.FindLayer(ctx, "grandchild", false, false, types.Unknown)
+	assert.Equal(t, cerrors.ErrNotFound, err)
+
+	child, err = datastore.FindLayer(ctx, "child", false, false, types.Unknown)
+	if assert.Nil(t, err) {
+		assert.Nil(t, datastore.InsertLayer(ctx, database.Layer{Name: "grandchild", EngineVersion: 1, Parent: &child}))
+	}
+	assert.Nil(t, datastore.DeleteLayer(ctx, "base", true))
+
+	count, err := datastore.CountLayers(ctx)
+	if assert.Nil(t, err) {
+		assert.Equal(t, 0, count)
+	}
+}
+
+func testLayerExists(t *testing.T, datastore database.Datastore) {
+	ctx := context.Background()
+
+	exists, err := datastore.LayerExists(ctx, "layer")
+	if assert.Nil(t, err) {
+		assert.False(t, exists)
+	}
+
+	assert.Nil(t, datastore.InsertLayer(ctx, database.Layer{Name: "layer", EngineVersion: 1}))
+	exists, err = datastore.LayerExists(ctx, "layer")
+	if assert.Nil(t, err) {
+		assert.True(t, exists)
+	}
+
+	assert.Nil(t, datastore.DeleteLayer(ctx, "layer", false))
+	exists, err = datastore.LayerExists(ctx, "layer")
+	if assert.Nil(t, err) {
+		assert.False(t, exists)
+	}
+}
+
+func testListLayers(t *testing.T, datastore database.Datastore) {
+	ctx := context.Background()
+
+	_, err := datastore.ListLayers(ctx, 0, "")
+	assert.NotNil(t, err)
+
+	for _, name := range []string{"c", "a", "b"} {
+		assert.Nil(t, datastore.InsertLayer(ctx, database.Layer{Name: name, EngineVersion: 1}))
+	}
+
+	layers, err := datastore.ListLayers(ctx, 2, "")
+	if assert.Nil(t, err) {
+		assert.Equal(t, []string{"a", "b"}, layerNames(layers))
+	}
+
+	layers, err = datastore.ListLayers(ctx, 2, "b")
+	if assert.Nil(t, err) {
+		assert.Equal(t, []string{"c"}, layerNames(layers))
+	}
+
+	layers, err = datastore.ListLayers(ctx, 2, "c")
+	if assert.Nil(t, err) {
+		assert.Len(t, layers, 0)
+	}
+}
+
+func testLayerDetectors(t *testing.T, datastore database.Datastore) {
+	ctx := context.Background()
+
+	_, err := datastore.ListLayersMissingDetector(ctx, "", 10, "")
+	assert.NotNil(t, err)
+	_, err = datastore.ListLayersMissingDetector(ctx, "apk", 0, "")
+	assert.NotNil(t, err)
+
+	layer := database.Layer{
+		Name:          "layer",
+		EngineVersion: 1,
+		Namespace:     &database.Namespace{Name: "debian:7"},
+		Features:      []database.FeatureVersion{newFeatureVersion("debian:7", "openssl", "1.0")},
+		ProcessedBy:   []string{"dpkg"},
+	}
+	assert.Nil(t, datastore.InsertLayer(ctx, layer))
+	assert.Nil(t, datastore.InsertLayer(ctx, database.Layer{Name: "other", EngineVersion: 1, ProcessedBy: []string{"apk", "dpkg"}}))
+
+	found, err := datastore.FindLayer(ctx, "layer", false, false, types.Unknown)
+	if assert.Nil(t, err) {
+		assert.Equal(t, []string{"dpkg"}, found.ProcessedBy)
+	}
+
+	// A new detector has been registered, which only processed the other layer.
+	layers, err := datastore.ListLayersMissingDetector(ctx, "apk", 10, "")
+	if assert.Nil(t, err) {
+		assert.Equal(t, []string{"layer"}, layerNames(layers))
+	}
+	layers, err = datastore.ListLayersMissingDetector(ctx, "dpkg", 10, "")
+	if assert.Nil(t, err) {
+		assert.Len(t, layers, 0)
+	}
+
+	// Inserting the layer again with the same engine version is a no-op, unless it has been
+	// processed by more detectors.
+	layer.Features = nil
+	assert.Nil(t, datastore.InsertLayer(ctx, layer))
+	found, err = datastore.FindLayer(ctx, "layer", true, false, types.Unknown)
+	if assert.Nil(t, err) {
+		assert.Len(t, found.Features, 1)
+	}
+
+	layer.Features = []database.FeatureVersion{newFeatureVersion("debian:7", "openssl", "1.1")}
+	layer.ProcessedBy = []string{"apk", "dpkg", "dpkg"}
+	assert.Nil(t, datastore.InsertLayer(ctx, layer))
+
+	found, err = datastore.FindLayer(ctx, "layer", true, false, types.Unknown)
+	if assert.Nil(t, err) {
+		assert.Equal(t, []string{"apk", "dpkg"}, found.ProcessedBy)
+		if assert.Len(t, found.Features, 1) {
+			assert.Equal(t, "1.1", found.Features[0].Version.String())
+		}
+	}
+
+	layers, err = datastore.ListLayersMissingDetector(ctx, "apk", 10, "")
+	if assert.Nil(t, err) {
+		assert.Len(t, layers, 0)
+	}
+}
+
+func testOutdatedLayers(t *testing.T, datastore database.Datastore) {
+	ctx := context.Background()
+
+	_, err := datastore.ListOutdatedLayers(ctx, 2, 0, 0)
+	assert.NotNil(t, err)
+
+	// Two layers have been analyzed by an older engine, and the other one by the current one.
+	assert.Nil(t, datastore.InsertLayer(ctx, database.Layer{Name: "base", EngineVersion: 1, Path: "https://registry/base", Format: "Docker"}))
+	base, err := datastore.FindLayer(ctx, "base", false, false, types.Unknown)
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Equal(t, "https://registry/base", base.Path)
+	assert.Equal(t, "Docker", base.Format)
+	assert.False(t, base.Stale)
+	assert.Nil(t, datastore.InsertLayer(ctx, database.Layer{Name: "current", EngineVersion: 2, Path: "https://registry/current", Format: "Docker"}))
+	assert.Nil(t, datastore.InsertLayer(ctx, database.Layer{Name: "child", EngineVersion: 1, Parent: &base}))
+
+	// The outdated layers are listed from the parents to the children.
+	layers, err := datastore.ListOutdatedLayers(ctx, 2, 10, 0)
+	if assert.Nil(t, err) && assert.Equal(t, []string{"base", "child"}, layerNames(layers)) {
+		assert.Equal(t, "https://registry/base", layers[0].Path)
+		assert.Equal(t, "Docker", layers[0].Format)
+		assert.Equal(t, "", layers[1].Path)
+		if assert.NotNil(t, layers[1].Parent) {
+			assert.Equal(t, "base", layers[1].Parent.Name)
+		}
+
+		layers, err = datastore.ListOutdatedLayers(ctx, 2, 10, layers[0].ID)
+		if assert.Nil(t, err) {
+			assert.Equal(t, []string{"child"}, layerNames(layers))
+		}
+	}
+
+	// The stale layers are not listed anymore, until they are analyzed again.
+	assert.Equal(t, cerrors.ErrNotFound, datastore.MarkLayerStale(ctx, "unknown"))
+	assert.Nil(t, datastore.MarkLayerStale(ctx, "child"))
+	child, err := datastore.FindLayer(ctx, "child", false, false, types.Unknown)
+	if assert.Nil(t, err) {
+		assert.True(t, child.Stale)
+	}
+	layers, err = datastore.ListOutdatedLayers(ctx, 2, 10, 0)
+	if assert.Nil(t, err) {
+		assert.Equal(t, []string{"base"}, layerNames(layers))
+	}
+
+	assert.Nil(t, datastore.InsertLayer(ctx, database.Layer{Name: "child", EngineVersion: 2, Parent: &base, Path: "https://registry/child", Format: "Docker"}))
+	child, err = datastore.FindLayer(ctx, "child", false, false, types.Unknown)
+	if assert.Nil(t, err) {
+		assert.False(t, child.Stale)
+		assert.Equal(t, "https://registry/child", child.Path)
+	}
+}
+
+func testLayerNamespaces(t *testing.T, datastore database.Datastore) {
+	ctx := context.Background()
+
+	namespaceNames := func(layer database.Layer) []string {
+		var names []string
+		for _, namespace := range layer.Namespaces {
+			names = append(names, namespace.Name)
+		}
+		return names
+	}
+
+	// The layer contains both OS and language packages, named alike. The primary namespace is
+	// stored even though Namespaces omits it.
+	assert.Nil(t, datastore.InsertLayer(ctx, database.Layer{
+		Name:          "mixed",
+		EngineVersion: 1,
+		Namespace:     &database.Namespace{Name: "debian:8", VersionFormat: types.DpkgVersionFormat},
+		Namespaces:    []database.Namespace{{Name: "testlang:1"}},
+		Features: []database.FeatureVersion{
+			newFeatureVersion("debian:8", "openssl", "1.0"),
+			newFeatureVersion("testlang:1", "openssl", "1.0"),
+			newFeatureVersion("testlang:1", "leftpad", "1.0"),
+		},
+	}))
+	assert.Nil(t, datastore.InsertVulnerabilities(ctx, []database.Vulnerability{
+		{
+			Name:      "CVE-OPENSSL",
+			Namespace: database.Namespace{Name: "debian:8"},
+			Severity:  types.High,
+			FixedIn:   []database.FeatureVersion{newFeatureVersion("debian:8", "openssl", "2.0")},
+		},
+		{
+			Name:      "CVE-LEFTPAD",
+			Namespace: database.Namespace{Name: "testlang:1"},
+			Severity:  types.Low,
+			FixedIn:   []database.FeatureVersion{newFeatureVersion("testlang:1", "leftpad", "2.0")},
+		},
+	}, false))
+
+	// Every FeatureVersion is matched against the vulnerabilities of its own namespace.
+	mixed, err := datastore.FindLayer(ctx, "mixed", true, true, types.Unknown)
+	if assert.Nil(t, err) {
+		if assert.NotNil(t, mixed.Namespace) {
+			assert.Equal(t, "debian:8", mixed.Namespace.Name)
+			assert.Equal(t, types.DpkgVersionFormat, mixed.Namespace.VersionFormat)
+		}
+		assert.Equal(t, []string{"debian:8", "testlang:1"}, namespaceNames(mixed))
+
+		affectedBy := make(map[string][]string)
+		for _, featureVersion := range mixed.Features {
+			key := featureVersion.Feature.Namespace.Name + "/" + featureVersion.Feature.Name
+			for _, vulnerability := range featureVersion.AffectedBy {
+				affectedBy[key] = append(affectedBy[key], vulnerability.Name)
+			}
+		}
+		assert.Equal(t, map[string][]string{
+			"debian:8/openssl":   {"CVE-OPENSSL"},
+			"testlang:1/leftpad": {"CVE-LEFTPAD"},
+		}, affectedBy)
+	}
+
+	// A layer without namespaces inherits the ones of its parent.
+	assert.Nil(t, datastore.InsertLayer(ctx, database.Layer{Name: "child", EngineVersion: 1, Parent: &mixed}))
+	child, err := datastore.FindLayer(ctx, "child", false, false, types.Unknown)
+	if assert.Nil(t, err) && assert.NotNil(t, child.Namespace) {
+		assert.Equal(t, "debian:8", child.Namespace.Name)
+		assert.Equal(t, []string{"debian:8", "testlang:1"}, namespaceNames(child))
+	}
+
+	// The namespaces are replaced when the layer is processed again.
+	assert.Nil(t, datastore.InsertLayer(ctx, database.Layer{
+		Name:          "mixed",
+		EngineVersion: 2,
+		Namespaces:    []database.Namespace{{Name: "testlang:1"}},
+	}))
+	mixed, err = datastore.FindLayer(ctx, "mixed", false, false, types.Unknown)
+	if assert.Nil(t, err) {
+		assert.Nil(t, mixed.Namespace)
+		assert.Equal(t, []string{"testlang:1"}, namespaceNames(mixed))
+	}
+}
+
+func testInsertLayers(t *testing.T, datastore database.Datastore) {
+	ctx := context.Background()
+
+	base := database.Layer{
+		Name:          "base",
+		EngineVersion: 1,
+		Namespace:     &database.Namespace{Name: "debian:7"},
+		Features:      []database.FeatureVersion{newFeatureVersion("debian:7", "openssl", "1.0")},
+	}
+	middle := database.Layer{
+		Name:          "middle",
+		EngineVersion: 1,
+		Parent:        &base,
+		Features:      base.Features,
+	}
+	top := database.Layer{
+		Name:          "top",
+		EngineVersion: 1,
+		Parent:        &middle,
+		Features: []database.FeatureVersion{
+			newFeatureVersion("debian:7", "openssl", "1.0"),
+			newFeatureVersion("debian:7", "curl", "7.0"),
+		},
+	}
+
+	// A chain that isn't ordered inserts nothing.
+	assert.NotNil(t, datastore.InsertLayers(ctx, []database.Layer{base, top}))
+	_, err := datastore.FindLayer(ctx, "base", false, false, types.Unknown)
+	assert.Equal(t, cerrors.ErrNotFound, err)
+
+	assert.Nil(t, datastore.InsertLayers(ctx, []database.Layer{base, middle, top}))
+
+	layer, err := datastore.FindLayer(ctx, "top", true, false, types.Unknown)
+	if !assert.Nil(t, err) {
+		return
+	}
+	if assert.NotNil(t, layer.Parent) {
+		assert.Equal(t, "middle", layer.Parent.Name)
+	}
+	if assert.NotNil(t, layer.Namespace) {
+		assert.Equal(t, "debian:7", layer.Namespace.Name)
+	}
+	fvs := featureVersions(layer)
+	if assert.Len(t, fvs, 2) {
+		assert.Equal(t, "base", fvs["openssl"].AddedBy.Name)
+		assert.Equal(t, "top", fvs["curl"].AddedBy.Name)
+	}
+}
+
+func testLayerTreeDepth(t *testing.T, datastore database.Datastore) {
+	ctx := context.Background()
+
+	layers := make([]database.Layer, database.DefaultMaxLayerTreeDepth)
+	for i := range layers {
+		layers[i] = database.Layer{Name: fmt.Sprintf("layer-%d", i), EngineVersion: 1}
+		if i > 0 {
+			layers[i].Parent = &layers[i-1]
+		}
+	}
+	if !assert.Nil(t, datastore.InsertLayers(ctx, layers)) {
+		return
+	}
+
+	top, err := datastore.FindLayer(ctx, layers[len(layers)-1].Name, true, false, types.Unknown)
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Equal(t, database.DefaultMaxLayerTreeDepth, top.Depth)
+
+	// Nothing can be stacked on top of it, whether the depth of the parent is known or not.
+	err = datastore.InsertLayer(ctx, database.Layer{Name: "too-deep", EngineVersion: 1, Parent: &top})
+	if assert.IsType(t, &database.ErrLayerTreeTooDeep{}, err) {
+		assert.Equal(t, "too-deep", err.(*database.ErrLayerTreeTooDeep).Layer)
+		assert.Equal(t, database.DefaultMaxLayerTreeDepth, err.(*database.ErrLayerTreeTooDeep).MaxDepth)
+	}
+
+	top, err = datastore.FindLayer(ctx, layers[len(layers)-1].Name, false, false, types.Unknown)
+	if assert.Nil(t, err) {
+		err = datastore.InsertLayer(ctx, database.Layer{Name: "too-deep", EngineVersion: 1, Parent: &top})
+		assert.IsType(t, &database.ErrLayerTreeTooDeep{}, err)
+	}
+
+	_, err = datastore.FindLayer(ctx, "too-deep", false, false, types.Unknown)
+	assert.Equal(t, cerrors.ErrNotFound, err)
+}
+
+func testLayerNames(t *testing.T, datastore database.Datastore) {
+	ctx := context.Background()
+
+	for _, name := range []string{"", "library/debian", "..", "layer name", "layer\x00", strings.Repeat("a", database.MaxLayerNameLength+1)} {
+		err := datastore.InsertLayer(ctx, database.Layer{Name: name, EngineVersion: 1})
+		assert.IsType(t, &cerrors.ErrBadRequest{}, err, "%q", name)
+
+		_, err = datastore.FindLayer(ctx, name, false, false, types.Unknown)
+		assert.Equal(t, cerrors.ErrNotFound, err, "%q", name)
+	}
+
+	for _, name := range []string{"sha256:0123456789abcdef", "lāyer+1", strings.Repeat("a", database.MaxLayerNameLength)} {
+		assert.Nil(t, datastore.InsertLayer(ctx, database.Layer{Name: name, EngineVersion: 1}), "%q", name)
+
+		layer, err := datastore.FindLayer(ctx, name, false, false, types.Unknown)
+		if assert.Nil(t, err, "%q", name) {
+			assert.Equal(t, name, layer.Name)
+		}
+	}
+}
+
+func testVulnerability(t *testing.T, datastore database.Datastore) {
+	ctx := database.ContextWithSource(context.Background(), "test")
+
+	_, err := datastore.FindVulnerability(ctx, "debian:7", "CVE-UNKNOWN")
+	assert.Equal(t, cerrors.ErrNotFound, err)
+
+	// A vulnerability needs a severity.
+	invalid := database.Vulnerability{Name: "CVE-INVALID", Namespace: database.Namespace{Name: "debian:7"}}
+	assert.NotNil(t, datastore.InsertVulnerabilities(ctx, []database.Vulnerability{invalid}, false))
+
+	layer := database.Layer{
+		Name:          "layer",
+		EngineVersion: 1,
+		Namespace:     &database.Namespace{Name: "debian:7"},
+		Features:      []database.FeatureVersion{newFeatureVersion("debian:7", "openssl", "1.0")},
+	}
+	assert.Nil(t, datastore.InsertLayer(ctx, layer))
+
+	vulnerability := database.Vulnerability{
+		Name:        "CVE-OPENSSL",
+		Namespace:   database.Namespace{Name: "debian:7"},
+		Description: "A vulnerability in openssl",
+		Link:        "https://example.com/CVE-OPENSSL",
+		Severity:    types.Low,
+		Metadata:    database.MetadataMap{"NVD": map[string]interface{}{"Score": 5.0}},
+		FixedIn:     []database.FeatureVersion{newFeatureVersion("debian:7", "openssl", "2.0")},
+	}
+	assert.Nil(t, datastore.InsertVulnerabilities(ctx, []database.Vulnerability{vulnerability}, false))
+
+	stored, err := datastore.FindVulnerability(ctx, "debian:7", "CVE-OPENSSL")
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Equal(t, vulnerability.Description, stored.Description)
+	assert.Equal(t, vulnerability.Link, stored.Link)
+	assert.Equal(t, []string{vulnerability.Link}, stored.Links)
+	assert.Equal(t, types.Low, stored.Severity)
+	assert.Equal(t, database.MetadataMap{"NVD": map[string]interface{}{"Score": 5.0}}, stored.Metadata)
+	if assert.Len(t, stored.FixedIn, 1) {
+		assert.Equal(t, "openssl", stored.FixedIn[0].Feature.Name)
+		assert.Equal(t, types.NewVersionUnsafe("2.0"), stored.FixedIn[0].Version)
+	}
+
+	// The vulnerability affects the feature of the layer.
+	found, err := datastore.FindLayer(ctx, "layer", true, true, types.Unknown)
+	if assert.Nil(t, err) && assert.Len(t, found.Features, 1) && assert.Len(t, found.Features[0].AffectedBy, 1) {
+		assert.Equal(t, "CVE-OPENSSL", found.Features[0].AffectedBy[0].Name)
+		assert.Equal(t, types.NewVersionUnsafe("2.0"), found.Features[0].AffectedBy[0].FixedBy)
+	}
+
+	// An update merges the metadata and the links, and is recorded in the history.
+	update := database.Vulnerability{
+		Name:      "CVE-OPENSSL",
+		Namespace: database.Namespace{Name: "debian:7"},
+		Severity:  types.High,
+		Links:     []string{"https://example.com/advisory"},
+		Metadata:  database.MetadataMap{"Vendor": map[string]interface{}{"Fixed": true}},
+		FixedIn:   []database.FeatureVersion{newFeatureVersion("debian:7", "openssl", "1.5")},
+	}
+	assert.Nil(t, datastore.InsertVulnerabilities(ctx, []database.Vulnerability{update}, false))
+
+	stored, err = datastore.FindVulnerability(ctx, "debian:7", "CVE-OPENSSL")
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Equal(t, types.High, stored.Severity)
+	assert.Equal(t, vulnerability.Link, stored.Link)
+	assert.Equal(t, []string{vulnerability.Link, "https://example.com/advisory"}, stored.Links)
+	assert.Len(t, stored.Metadata, 2)
+	if assert.Len(t, stored.FixedIn, 1) {
+		assert.Equal(t, types.NewVersionUnsafe("1.5"), stored.FixedIn[0].Version)
+	}
+
+	history, err := datastore.GetVulnerabilityHistory(ctx, "debian:7", "CVE-OPENSSL")
+	if assert.Nil(t, err) && assert.Len(t, history, 1) {
+		assert.Equal(t, "test", history[0].Source)
+		assert.Equal(t, types.Low, history[0].OldSeverity)
+		assert.Equal(t, types.High, history[0].NewSeverity)
+		assert.Equal(t, "openssl", history[0].FeatureName)
+		assert.Equal(t, "2.0", history[0].OldFixedBy)
+		assert.Equal(t, "1.5", history[0].NewFixedBy)
+	}
+
+	vulnerabilities, nextPage, err := datastore.ListVulnerabilities(ctx, "debian:7", types.Unknown, 10, 0)
+	if assert.Nil(t, err) && assert.Len(t, vulnerabilities, 1) {
+		assert.Equal(t, "CVE-OPENSSL", vulnerabilities[0].Name)
+		assert.Equal(t, -1, nextPage)
+	}
+
+	assert.Nil(t, datastore.DeleteVulnerability(ctx, "debian:7", "CVE-OPENSSL"))
+	assert.Equal(t, cerrors.ErrNotFound, datastore.DeleteVulnerability(ctx, "debian:7", "CVE-OPENSSL"))
+	_, err = datastore.FindVulnerability(ctx, "debian:7", "CVE-OPENSSL")
+	assert.Equal(t, cerrors.ErrNotFound, err)
+
+	found, err = datastore.FindLayer(ctx, "layer", true, true, types.Unknown)
+	if assert.Nil(t, err) && assert.Len(t, found.Features, 1) {
+		assert.Len(t, found.Features[0].AffectedBy, 0)
+	}
+}
+
+func testVulnerabilitySeverities(t *testing.T, datastore database.Datastore) {
+	ctx := context.Background()
+
+	newVulnerability := func(name string, severity types.Priority) database.Vulnerability {
+		return database.Vulnerability{
+			Name:      name,
+			Namespace: database.Namespace{Name: "debian:7"},
+			Severity:  severity,
+			FixedIn:   []database.FeatureVersion{newFeatureVersion("debian:7", "openssl", "2.0")},
+		}
+	}
+
+	// A missing severity is rejected, misspelled ones are coerced.
+	assert.NotNil(t, datastore.InsertVulnerabilities(ctx, []database.Vulnerability{newVulnerability("CVE-NONE", "")}, false))
+	assert.Nil(t, datastore.InsertVulnerabilities(ctx, []database.Vulnerability{
+		newVulnerability("CVE-LOW", types.Low),
+		newVulnerability("CVE-HIGH", "HIGH"),
+		newVulnerability("CVE-CRITICAL", types.Critical),
+		newVulnerability("CVE-IMPORTANT", "Important"),
+	}, false))
+
+	for name, expected := range map[string]types.Priority{"CVE-HIGH": types.High, "CVE-IMPORTANT": types.Unknown} {
+		stored, err := datastore.FindVulnerability(ctx, "debian:7", name)
+		if assert.Nil(t, err) {
+			assert.Equal(t, expected, stored.Severity)
+		}
+	}
+
+	// The severities are compared in the order of types.Priorities, not alphabetically.
+	for minSeverity, expected := range map[types.Priority][]string{
+		types.Unknown: {"CVE-LOW", "CVE-HIGH", "CVE-CRITICAL", "CVE-IMPORTANT"},
+		types.Medium:  {"CVE-HIGH", "CVE-CRITICAL"},
+		types.High:    {"CVE-HIGH", "CVE-CRITICAL"},
+		types.Defcon1: nil,
+	} {
+		vulnerabilities, _, err := datastore.ListVulnerabilities(ctx, "debian:7", minSeverity, 10, 0)
+		if !assert.Nil(t, err) {
+			continue
+		}
+
+		var names []string
+		for _, vulnerability := range vulnerabilities {
+			names = append(names, vulnerability.Name)
+		}
+		assert.Equal(t, expected, names, "minimum severity %s", minSeverity)
+	}
+
+	// The vulnerabilities affecting a layer are filtered the same way.
+	assert.Nil(t, datastore.InsertLayer(ctx, database.Layer{
+		Name:          "layer",
+		EngineVersion: 1,
+		Namespace:     &database.Namespace{Name: "debian:7"},
+		Features:      []database.FeatureVersion{newFeatureVersion("debian:7", "openssl", "1.0")},
+	}))
+	for minSeverity, expected := range map[types.Priority]int{
+		types.Unknown: 4,
+		types.Medium:  2,
+		types.Defcon1: 0,
+	} {
+		layer, err := datastore.FindLayer(ctx, "layer", false, true, minSeverity)
+		if assert.Nil(t, err) && assert.Len(t, layer.Features, 1) {
+			assert.Len(t, layer.Features[0].AffectedBy, expected, "minimum severity %s", minSeverity)
+		}
+	}
+}
+
+func testVulnerabilityCounts(t *testing.T, datastore database.Datastore) {
+	ctx := context.Background()
+
+	counts, err := datastore.CountVulnerabilitiesByNamespace(ctx)
+	if assert.Nil(t, err) {
+		assert.Len(t, counts, 0)
+	}
+
+	var vulnerabilities []database.Vulnerability
+	for _, v := range []struct{ namespace, name string }{
+		{"debian:7", "CVE-1"}, {"debian:7", "CVE-2"}, {"debian:8", "CVE-1"}, {"debian:8", "CVE-DELETED"},
+	} {
+		vulnerabilities = append(vulnerabilities, database.Vulnerability{
+			Name:      v.name,
+			Namespace: database.Namespace{Name: v.namespace},
+			Severity:  types.Low,
+		})
+	}
+	assert.Nil(t, datastore.InsertVulnerabilities(ctx, vulnerabilities, false))
+	assert.Nil(t, datastore.DeleteVulnerability(ctx, "debian:8", "CVE-DELETED"))
+
+	counts, err = datastore.CountVulnerabilitiesByNamespace(ctx)
+	if assert.Nil(t, err) {
+		assert.Equal(t, map[string]int{"debian:7": 2, "debian:8": 1}, counts)
+	}
+}
+
+func testLastVulnerabilityChange(t *testing.T, datastore database.Datastore) {
+	ctx := context.Background()
+
+	lastChange, err := datastore.GetLastVulnerabilityChange(ctx, "debian:7")
+	if assert.Nil(t, err) {
+		assert.True(t, lastChange.IsZero())
+	}
+
+	vulnerability := database.Vulnerability{
+		Name:      "CVE-CHANGE",
+		Namespace: database.Namespace{Name: "debian:7"},
+		Severity:  types.Low,
+	}
+	assert.Nil(t, datastore.InsertVulnerabilities(ctx, []database.Vulnerability{vulnerability}, false))
+
+	inserted, err := datastore.GetLastVulnerabilityChange(ctx, "debian:7")
+	if assert.Nil(t, err) {
+		assert.False(t, inserted.IsZero())
+	}
+
+	// Other namespaces are not affected.
+	lastChange, err = datastore.GetLastVulnerabilityChange(ctx, "debian:8")
+	if assert.Nil(t, err) {
+		assert.True(t, lastChange.IsZero())
+	}
+
+	// Modifications and deletions are changes too.
+	time.Sleep(10 * time.Millisecond)
+	vulnerability.Severity = types.High
+	assert.Nil(t, datastore.InsertVulnerabilities(ctx, []database.Vulnerability{vulnerability}, false))
+
+	modified, err := datastore.GetLastVulnerabilityChange(ctx, "debian:7")
+	if assert.Nil(t, err) {
+		assert.True(t, modified.After(inserted))
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	assert.Nil(t, datastore.DeleteVulnerability(ctx, "debian:7", "CVE-CHANGE"))
+
+	deleted, err := datastore.GetLastVulnerabilityChange(ctx, "debian:7")
+	if assert.Nil(t, err) {
+		assert.True(t, deleted.After(modified))
+	}
+}
+
+func testVulnerabilityFixes(t *testing.T, datastore database.Datastore) {
+	ctx := context.Background()
+
+	fixes := []database.FeatureVersion{newFeatureVersion("debian:7", "curl", "7.5")}
+	assert.Equal(t, cerrors.ErrNotFound, datastore.InsertVulnerabilityFixes(ctx, "debian:7", "CVE-UNKNOWN", fixes))
+
+	vulnerability := database.Vulnerability{
+		Name:      "CVE-FIXES",
+		Namespace: database.Namespace{Name: "debian:7"},
+		Severity:  types.Medium,
+		FixedIn:   []database.FeatureVersion{newFeatureVersion("debian:7", "openssl", "2.0")},
+	}
+	assert.Nil(t, datastore.InsertVulnerabilities(ctx, []database.Vulnerability{vulnerability}, false))
+
+	assert.Nil(t, datastore.InsertVulnerabilityFixes(ctx, "debian:7", "CVE-FIXES", fixes))
+	stored, err := datastore.FindVulnerability(ctx, "debian:7", "CVE-FIXES")
+	if assert.Nil(t, err) {
+		assert.Equal(t, types.Medium, stored.Severity)
+		assert.Len(t, stored.FixedIn, 2)
+	}
+
+	assert.Nil(t, datastore.DeleteVulnerabilityFix(ctx, "debian:7", "CVE-FIXES", "openssl"))
+	stored, err = datastore.FindVulnerability(ctx, "debian:7", "CVE-FIXES")
+	if assert.Nil(t, err) && assert.Len(t, stored.FixedIn, 1) {
+		assert.Equal(t, "curl", stored.FixedIn[0].Feature.Name)
+	}
+
+	history, err := datastore.GetVulnerabilityHistory(ctx, "debian:7", "CVE-FIXES")
+	if assert.Nil(t, err) && assert.Len(t, history, 2) {
+		// The most recent change comes first.
+		assert.Equal(t, "openssl", history[0].FeatureName)
+		assert.Equal(t, "", history[0].NewFixedBy)
+		assert.Equal(t, "curl", history[1].FeatureName)
+		assert.Equal(t, "", history[1].OldFixedBy)
+	}
+}
+
+func testCreateVulnerability(t *testing.T, datastore database.Datastore) {
+	ctx := context.Background()
+
+	vulnerability := database.Vulnerability{
+		Name:      "CVE-CREATE",
+		Namespace: database.Namespace{Name: "debian:7"},
+		Severity:  types.Low,
+		FixedIn:   []database.FeatureVersion{newFeatureVersion("debian:7", "openssl", "2.0")},
+	}
+	assert.Nil(t, datastore.CreateVulnerability(ctx, vulnerability, false))
+
+	// The existing vulnerability is neither created again nor updated.
+	update := vulnerability
+	update.Severity = types.High
+	assert.Equal(t, database.ErrAlreadyExists, datastore.CreateVulnerability(ctx, update, false))
+	if stored, err := datastore.FindVulnerability(ctx, "debian:7", "CVE-CREATE"); assert.Nil(t, err) {
+		assert.Equal(t, types.Low, stored.Severity)
+		assert.Len(t, stored.FixedIn, 1)
+	}
+
+	// A single one of the concurrent creations succeeds.
+	vulnerability.Name = "CVE-CREATE-CONCURRENTLY"
+	var wg sync.WaitGroup
+	errs := make(chan error, 5)
+	for i := 0; i < cap(errs); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- datastore.CreateVulnerability(ctx, vulnerability, false)
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	var created int
+	for err := range errs {
+		if err == nil {
+			created++
+		} else {
+			assert.Equal(t, database.ErrAlreadyExists, err)
+		}
+	}
+	assert.Equal(t, 1, created)
+}
+
+func testUpdateVulnerability(t *testing.T, datastore database.Datastore) {
+	ctx := context.Background()
+
+	severity := types.High
+	_, err := datastore.UpdateVulnerability(ctx, "debian:7", "CVE-UNKNOWN", database.VulnerabilityUpdate{Severity: &severity})
+	assert.Equal(t, cerrors.ErrNotFound, err)
+
+	layer := database.Layer{
+		Name:          "layer",
+		EngineVersion: 1,
+		Namespace:     &database.Namespace{Name: "debian:7"},
+		Features: []database.FeatureVersion{
+			newFeatureVersion("debian:7", "openssl", "1.0"),
+			newFeatureVersion("debian:7", "curl", "7.0"),
+		},
+	}
+	assert.Nil(t, datastore.InsertLayer(ctx, layer))
+
+	vulnerability := database.Vulnerability{
+		Name:        "CVE-UPDATED",
+		Namespace:   database.Namespace{Name: "debian:7"},
+		Description: "description",
+		Severity:    types.Medium,
+		FixedIn:     []database.FeatureVersion{newFeatureVersion("debian:7", "openssl", "2.0")},
+	}
+	assert.Nil(t, datastore.InsertVulnerabilities(ctx, []database.Vulnerability{vulnerability}, false))
+
+	// nextNotification returns the pending notification, which is then deleted.
+	nextNotification := func() (database.VulnerabilityNotification, bool) {
+		available, err := datastore.GetAvailableNotification(ctx, time.Hour)
+		if err == cerrors.ErrNotFound {
+			return database.VulnerabilityNotification{}, false
+		}
+		assert.Nil(t, err)
+		notification, _, err := datastore.GetNotification(ctx, available.Name, 10, database.VulnerabilityNotificationFirstPage)
+		assert.Nil(t, err)
+		assert.Nil(t, datastore.DeleteNotification(ctx, available.Name))
+		return notification, true
+	}
+
+	// Only the Severity changes.
+	updated, err := datastore.UpdateVulnerability(ctx, "debian:7", "CVE-UPDATED", database.VulnerabilityUpdate{Severity: &severity})
+	if assert.Nil(t, err) {
+		assert.Equal(t, types.High, updated.Severity)
+		assert.Equal(t, "description", updated.Description)
+		assert.Len(t, updated.FixedIn, 1)
+	}
+	notification, ok := nextNotification()
+	if assert.True(t, ok) && assert.NotNil(t, notification.OldVulnerability) && assert.NotNil(t, notification.NewVulnerability) {
+		assert.Equal(t, types.Medium, notification.OldVulnerability.Severity)
+		assert.Equal(t, types.High, notification.NewVulnerability.Severity)
+		assert.Equal(t, []string{"layer"}, layerNames(notification.NewVulnerability.LayersIntroducingVulnerability))
+	}
+
+	// A fix affects the layer's curl, which is linked to the vulnerability.
+	updated, err = datastore.UpdateVulnerability(ctx, "debian:7", "CVE-UPDATED", database.VulnerabilityUpdate{
+		FixedIn: []database.FeatureVersion{newFeatureVersion("debian:7", "curl", "7.5")},
+	})
+	if assert.Nil(t, err) {
+		assert.Equal(t, types.High, updated.Severity)
+		assert.Len(t, updated.FixedIn, 2)
+	}
+	notification, ok = nextNotification()
+	if assert.True(t, ok) && assert.NotNil(t, notification.OldVulnerability) && assert.NotNil(t, notification.NewVulnerability) {
+		assert.Len(t, notification.OldVulnerability.FixedIn, 1)
+		assert.Len(t, notification.NewVulnerability.FixedIn, 2)
+	}
+	stored, err := datastore.FindLayer(ctx, "layer", true, true, types.Unknown)
+	if assert.Nil(t, err) {
+		for _, fv := range stored.Features {
+			if assert.Len(t, fv.AffectedBy, 1, fv.Feature.Name) {
+				assert.Equal(t, "CVE-UPDATED", fv.AffectedBy[0].Name)
+			}
+		}
+	}
+
+	// An update that changes nothing creates no notification.
+	_, err = datastore.UpdateVulnerability(ctx, "debian:7", "CVE-UPDATED", database.VulnerabilityUpdate{Severity: &severity})
+	assert.Nil(t, err)
+	_, ok = nextNotification()
+	assert.False(t, ok)
+
+	invalid := types.Priority("Bogus")
+	_, err = datastore.UpdateVulnerability(ctx, "debian:7", "CVE-UPDATED", database.VulnerabilityUpdate{Severity: &invalid})
+	assert.IsType(t, &cerrors.ErrBadRequest{}, err)
+}
+
+func testVersionFormats(t *testing.T, datastore database.Datastore) {
+	ctx := context.Background()
+
+	// The separators don't matter to rpm, so 1.0-1.el7.1 is not older than 1.0-1.el7_1 in CentOS,
+	// unlike in Debian. The version format of debian:7 is only known once a layer records it.
+	insertLayer := func(name string, namespace database.Namespace, version string) {
+		featureVersion := newFeatureVersion(namespace.Name, "openssl", version)
+		featureVersion.Feature.Namespace = namespace
+		layer := database.Layer{Name: name, EngineVersion: 1, Namespace: &namespace, Features: []database.FeatureVersion{featureVersion}}
+		assert.Nil(t, datastore.InsertLayer(ctx, layer))
+	}
+	insertLayer("centos-before", database.Namespace{Name: "centos:7", VersionFormat: types.RpmVersionFormat}, "1.0-1.el7.1")
+	insertLayer("debian-before", database.Namespace{Name: "debian:7"}, "1.0-1.el7.1")
+	insertLayer("debian-format", database.Namespace{Name: "debian:7", VersionFormat: types.DpkgVersionFormat}, "1.0-1.el7.1")
+
+	var vulnerabilities []database.Vulnerability
+	for _, namespace := range []string{"centos:7", "debian:7"} {
+		vulnerabilities = append(vulnerabilities, database.Vulnerability{
+			Name:      "CVE-OPENSSL",
+			Namespace: database.Namespace{Name: namespace},
+			Severity:  types.High,
+			FixedIn:   []database.FeatureVersion{newFeatureVersion(namespace, "openssl", "1.0-1.el7_1")},
+		})
+	}
+	assert.Nil(t, datastore.InsertVulnerabilities(ctx, vulnerabilities, false))
+
+	// The epoch is compared in rpm as well.
+	insertLayer("centos-after", database.Namespace{Name: "centos:7"}, "1.0-1.el7")
+	insertLayer("centos-epoch", database.Namespace{Name: "centos:7"}, "1:0.9-1.el7")
+	insertLayer("debian-after", database.Namespace{Name: "debian:7"}, "1.0-1.el7.1")
+
+	for name, affected := range map[string]bool{
+		"centos-before": false,
+		"centos-after":  true,
+		"centos-epoch":  false,
+		"debian-before": true,
+		"debian-after":  true,
+	} {
+		layer, err := datastore.FindLayer(ctx, name, true, true, types.Unknown)
+		if assert.Nil(t, err, name) && assert.Len(t, layer.Features, 1, name) {
+			assert.Equal(t, affected, len(layer.Features[0].AffectedBy) > 0, name)
+		}
+	}
+
+	namespaces, err := datastore.ListNamespaces(ctx)
+	if assert.Nil(t, err) && assert.Len(t, namespaces, 2) {
+		for _, namespace := range namespaces {
+			assert.Equal(t, database.VersionFormatsMapping[strings.Split(namespace.Name, ":")[0]], namespace.VersionFormat, namespace.Name)
+		}
+	}
+
+	layer, err := datastore.FindLayer(ctx, "centos-after", false, false, types.Unknown)
+	if assert.Nil(t, err) && assert.NotNil(t, layer.Namespace) {
+		assert.Equal(t, types.RpmVersionFormat, layer.Namespace.VersionFormat)
+	}
+}
+
+func testVersionSentinels(t *testing.T, datastore database.Datastore) {
+	ctx := context.Background()
+
+	layer := database.Layer{
+		Name:          "layer",
+		EngineVersion: 1,
+		Namespace:     &database.Namespace{Name: "debian:7"},
+		Features: []database.FeatureVersion{
+			newFeatureVersion("debian:7", "openssl", "1.0"),
+			newFeatureVersion("debian:7", "curl", "7.0"),
+		},
+	}
+	assert.Nil(t, datastore.InsertLayer(ctx, layer))
+
+	// A vulnerability that isn't fixed affects every version, and a new vulnerability that doesn't
+	// affect a Feature doesn't store it.
+	unfixed := newFeatureVersion("debian:7", "openssl", "")
+	unfixed.Version = types.MaxVersion
+	notAffected := newFeatureVersion("debian:7", "curl", "")
+	notAffected.Version = types.MinVersion
+
+	vulnerability := database.Vulnerability{
+		Name:      "CVE-UNFIXED",
+		Namespace: database.Namespace{Name: "debian:7"},
+		Severity:  types.High,
+		FixedIn:   []database.FeatureVersion{unfixed, notAffected},
+	}
+	assert.Nil(t, datastore.InsertVulnerabilities(ctx, []database.Vulnerability{vulnerability}, false))
+
+	stored, err := datastore.FindVulnerability(ctx, "debian:7", "CVE-UNFIXED")
+	if assert.Nil(t, err) && assert.Len(t, stored.FixedIn, 1) {
+		assert.Equal(t, "openssl", stored.FixedIn[0].Feature.Name)
+		assert.Equal(t, types.MaxVersion, stored.FixedIn[0].Version)
+	}
+
+	found, err := datastore.FindLayer(ctx, "layer", true, true, types.Unknown)
+	if assert.Nil(t, err) {
+		fvs := featureVersions(found)
+		if assert.Len(t, fvs["openssl"].AffectedBy, 1) {
+			assert.Equal(t, types.MaxVersion, fvs["openssl"].AffectedBy[0].FixedBy)
+		}
+		assert.Len(t, fvs["curl"].AffectedBy, 0)
+	}
+
+	// MinVersion removes a Feature from an existing vulnerability.
+	notAffected.Feature.Name = "openssl"
+	assert.Nil(t, datastore.InsertVulnerabilityFixes(ctx, "debian:7", "CVE-UNFIXED", []database.FeatureVersion{notAffected}))
+
+	stored, err = datastore.FindVulnerability(ctx, "debian:7", "CVE-UNFIXED")
+	if assert.Nil(t, err) {
+		assert.Len(t, stored.FixedIn, 0)
+	}
+
+	found, err = datastore.FindLayer(ctx, "layer", true, true, types.Unknown)
+	if assert.Nil(t, err) {
+		assert.Len(t, featureVersions(found)["openssl"].AffectedBy, 0)
+	}
+}
+
+func testVulnerabilityDump(t *testing.T, open Opener) {
+	ctx := database.ContextWithSource(context.Background(), "test")
+
+	source := open(t)
+	defer source.Close()
+
+	layer := database.Layer{
+		Name:          "layer",
+		EngineVersion: 1,
+		Namespace:     &database.Namespace{Name: "debian:7"},
+		Features:      []database.FeatureVersion{newFeatureVersion("debian:7", "openssl", "1.0")},
+	}
+	assert.Nil(t, source.InsertLayer(ctx, layer))
+
+	// Enough vulnerabilities to be exported and imported in several pages.
+	vulnerabilities := []database.Vulnerability{
+		{
+			Name:        "CVE-OPENSSL",
+			Namespace:   database.Namespace{Name: "debian:7"},
+			Description: "A vulnerability in openssl",
+			Link:        "https://example.com/CVE-OPENSSL",
+			Links:       []string{"https://example.com/CVE-OPENSSL", "https://example.com/advisory"},
+			Severity:    types.High,
+			Metadata:    database.MetadataMap{"NVD": map[string]interface{}{"Score": 7.5}},
+			FixedIn: []database.FeatureVersion{
+				newFeatureVersion("debian:7", "openssl", "2.0"),
+				newFeatureVersion("debian:7", "libssl", types.MaxVersion.String()),
+			},
+		},
+		{
+			Name:      "CVE-CURL",
+			Namespace: database.Namespace{Name: "centos:7"},
+			Severity:  types.Low,
+			FixedIn:   []database.FeatureVersion{newFeatureVersion("centos:7", "curl", "7.1")},
+		},
+	}
+	for i := 0; i < 120; i++ {
+		vulnerabilities = append(vulnerabilities, database.Vulnerability{
+			Name:      fmt.Sprintf("CVE-%03d", i),
+			Namespace: database.Namespace{Name: "debian:8"},
+			Severity:  types.Medium,
+			FixedIn:   []database.FeatureVersion{newFeatureVersion("debian:8", fmt.Sprintf("package-%03d", i), "1.0")},
+		})
+	}
+	assert.Nil(t, source.InsertVulnerabilities(ctx, vulnerabilities, false))
+
+	var dump bytes.Buffer
+	if !assert.Nil(t, database.ExportVulnerabilities(ctx, source, &dump)) {
+		return
+	}
+
+	destination := open(t)
+	defer destination.Close()
+
+	// Importing is idempotent.
+	for i := 0; i < 2; i++ {
+		assert.Nil(t, database.ImportVulnerabilities(ctx, destination, bytes.NewReader(dump.Bytes()), false))
+	}
+
+	for _, v := range vulnerabilities {
+		expected, err := source.FindVulnerability(ctx, v.Namespace.Name, v.Name)
+		if !assert.Nil(t, err) {
+			continue
+		}
+		imported, err := destination.FindVulnerability(ctx, v.Namespace.Name, v.Name)
+		if !assert.Nil(t, err) {
+			continue
+		}
+		assert.Equal(t, withoutIDs(expected), withoutIDs(imported))
+	}
+
+	// Layers are not exported.
+	count, err := destination.CountLayers(ctx)
+	if assert.Nil(t, err) {
+		assert.Equal(t, 0, count)
+	}
+
+	assert.NotNil(t, database.ImportVulnerabilities(ctx, destination, bytes.NewBufferString("{\"Name\":\"CVE-NONE\"}\n"), false))
+	assert.NotNil(t, database.ImportVulnerabilities(ctx, destination, bytes.NewBufferString("not json\n"), false))
+}
+
+// byFeatureName sorts FeatureVersions by the name of their Feature.
+type byFeatureName []database.FeatureVersion
+
+func (s byFeatureName) Len() int           { return len(s) }
+func (s byFeatureName) Less(i, j int) bool { return s[i].Feature.Name < s[j].Feature.Name }
+func (s byFeatureName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// withoutIDs returns a copy of the given vulnerability without the database identifiers, so that
+// vulnerabilities of different datastores can be compared.
+func withoutIDs(v database.Vulnerability) database.Vulnerability {
+	v.ID = 0
+	v.Namespace.ID = 0
+
+	fixedIn := make([]database.FeatureVersion, 0, len(v.FixedIn))
+	for _, fv := range v.FixedIn {
+		fv.ID = 0
+		fv.Feature.ID = 0
+		fv.Feature.Namespace.ID = 0
+		fixedIn = append(fixedIn, fv)
+	}
+	sort.Sort(byFeatureName(fixedIn))
+	v.FixedIn = fixedIn
+
+	return v
+}
+
+func testAffectedLayers(t *testing.T, datastore database.Datastore) {
+	ctx := context.Background()
+
+	base := database.Layer{
+		Name:          "base",
+		EngineVersion: 1,
+		Namespace:     &database.Namespace{Name: "debian:7"},
+		Features:      []database.FeatureVersion{newFeatureVersion("debian:7", "openssl", "1.0")},
+	}
+	upgrading := database.Layer{
+		Name:          "upgrading",
+		EngineVersion: 1,
+		Parent:        &base,
+		Features:      []database.FeatureVersion{newFeatureVersion("debian:7", "openssl", "2.0")},
+	}
+	keeping := database.Layer{
+		Name:          "keeping",
+		EngineVersion: 1,
+		Parent:        &base,
+		Features:      []database.FeatureVersion{newFeatureVersion("debian:7", "openssl", "1.0")},
+	}
+	other := database.Layer{
+		Name:          "other",
+		EngineVersion: 1,
+		Namespace:     &database.Namespace{Name: "debian:7"},
+		Features:      []database.FeatureVersion{newFeatureVersion("debian:7", "openssl", "1.0")},
+	}
+	assert.Nil(t, datastore.InsertLayers(ctx, []database.Layer{base, upgrading}))
+	assert.Nil(t, datastore.InsertLayers(ctx, []database.Layer{base, keeping}))
+	assert.Nil(t, datastore.InsertLayer(ctx, other))
+
+	vulnerability := database.Vulnerability{
+		Name:      "CVE-AFFECTED",
+		Namespace: database.Namespace{Name: "debian:7"},
+		Severity:  types.High,
+		FixedIn:   []database.FeatureVersion{newFeatureVersion("debian:7", "openssl", "1.5")},
+	}
+	assert.Nil(t, datastore.InsertVulnerabilities(ctx, []database.Vulnerability{vulnerability}, false))
+
+	_, _, err := datastore.GetAffectedLayers(ctx, "debian:7", "CVE-UNKNOWN", 10, 0)
+	assert.Equal(t, cerrors.ErrNotFound, err)
+	_, _, err = datastore.GetAffectedLayers(ctx, "debian:7", "CVE-AFFECTED", 0, 0)
+	assert.NotNil(t, err)
+
+	layers, total, err := datastore.GetAffectedLayers(ctx, "debian:7", "CVE-AFFECTED", 10, 0)
+	if assert.Nil(t, err) {
+		assert.Equal(t, 2, total)
+		assert.Equal(t, []string{"base", "other"}, layerNames(layers))
+	}
+
+	layers, total, err = datastore.GetAffectedLayers(ctx, "debian:7", "CVE-AFFECTED", 1, 0)
+	if assert.Nil(t, err) && assert.Len(t, layers, 1) {
+		assert.Equal(t, 2, total)
+		assert.Equal(t, "base", layers[0].Name)
+
+		layers, _, err = datastore.GetAffectedLayers(ctx, "debian:7", "CVE-AFFECTED", 1, layers[0].ID)
+		if assert.Nil(t, err) {
+			assert.Equal(t, []string{"other"}, layerNames(layers))
+		}
+	}
+}
+
+func testNotification(t *testing.T, datastore database.Datastore) {
+	ctx := context.Background()
+
+	_, err := datastore.GetAvailableNotification(ctx, time.Hour)
+	assert.Equal(t, cerrors.ErrNotFound, err)
+	_, _, err = datastore.GetNotification(ctx, "unknown", 10, database.VulnerabilityNotificationFirstPage)
+	assert.Equal(t, cerrors.ErrNotFound, err)
+
+	layer := database.Layer{
+		Name:          "layer",
+		EngineVersion: 1,
+		Namespace:     &database.Namespace{Name: "debian:7"},
+		Features:      []database.FeatureVersion{newFeatureVersion("debian:7", "openssl", "1.0")},
+	}
+	assert.Nil(t, datastore.InsertLayer(ctx, layer))
+
+	vulnerability := database.Vulnerability{
+		Name:      "CVE-NOTIFIED",
+		Namespace: database.Namespace{Name: "debian:7"},
+		Severity:  types.High,
+		FixedIn:   []database.FeatureVersion{newFeatureVersion("debian:7", "openssl", "2.0")},
+	}
+	assert.Nil(t, datastore.InsertVulnerabilities(ctx, []database.Vulnerability{vulnerability}, true))
+
+	available, err := datastore.GetAvailableNotification(ctx, time.Hour)
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.NotEmpty(t, available.Name)
+	assert.Nil(t, available.OldVulnerability)
+	assert.Nil(t, available.NewVulnerability)
+
+	notification, page, err := datastore.GetNotification(ctx, available.Name, 10, database.VulnerabilityNotificationFirstPage)
+	if assert.Nil(t, err) {
+		assert.Equal(t, database.NoVulnerabilityNotificationPage, page)
+		assert.Nil(t, notification.OldVulnerability)
+		if assert.NotNil(t, notification.NewVulnerability) {
+			assert.Equal(t, "CVE-NOTIFIED", notification.NewVulnerability.Name)
+			assert.Equal(t, []string{"layer"}, layerNames(notification.NewVulnerability.LayersIntroducingVulnerability))
+		}
+	}
+
+	// A locked notification isn't available.
+	locked, _ := datastore.Lock(ctx, available.Name, "owner", time.Minute, false)
+	assert.True(t, locked)
+	_, err = datastore.GetAvailableNotification(ctx, time.Hour)
+	assert.Equal(t, cerrors.ErrNotFound, err)
+	datastore.Unlock(ctx, available.Name, "owner")
+
+	// A notified notification isn't available until the renotify interval is elapsed.
+	assert.Nil(t, datastore.SetNotificationNotified(ctx, available.Name))
+	_, err = datastore.GetAvailableNotification(ctx, time.Hour)
+	assert.Equal(t, cerrors.ErrNotFound, err)
+
+	assert.Nil(t, datastore.DeleteNotification(ctx, available.Name))
+	assert.Equal(t, cerrors.ErrNotFound, datastore.DeleteNotification(ctx, "unknown"))
+
+	// Deleting a notification again succeeds, and keeps the time of the first deletion.
+	deleted, _, err := datastore.GetNotification(ctx, available.Name, 1, database.NoVulnerabilityNotificationPage)
+	if assert.Nil(t, err) {
+		assert.False(t, deleted.Deleted.IsZero())
+		time.Sleep(time.Second)
+		assert.Nil(t, datastore.DeleteNotification(ctx, available.Name))
+		deletedAgain, _, err := datastore.GetNotification(ctx, available.Name, 1, database.NoVulnerabilityNotificationPage)
+		if assert.Nil(t, err) {
+			assert.Equal(t, deleted.Deleted.Unix(), deletedAgain.Deleted.Unix())
+		}
+	}
+	_, err = datastore.GetAvailableNotification(ctx, -time.Hour)
+	assert.Equal(t, cerrors.ErrNotFound, err)
+}
+
+func testKeyValue(t *testing.T, datastore database.Datastore) {
+	ctx := context.Background()
+
+	_, err := datastore.GetKeyValue(ctx, "key")
+	assert.Equal(t, cerrors.ErrNotFound, err)
+
+	// A key is mandatory, but a value may be empty.
+	assert.NotNil(t, datastore.InsertKeyValue(ctx, "", "value"))
+	assert.Nil(t, datastore.InsertKeyValue(ctx, "key", ""))
+
+	value, err := datastore.GetKeyValue(ctx, "key")
+	assert.Nil(t, err)
+	assert.Equal(t, "", value)
+
+	assert.Nil(t, datastore.InsertKeyValue(ctx, "key", "value"))
+	assert.Nil(t, datastore.InsertKeyValue(ctx, "key", "updated"))
+
+	value, err = datastore.GetKeyValue(ctx, "key")
+	assert.Nil(t, err)
+	assert.Equal(t, "updated", value)
+}
+
+func testKeyValueCompareAndSwap(t *testing.T, datastore database.Datastore) {
+	ctx := context.Background()
+
+	// The empty old value creates the key, but only once.
+	swapped, err := datastore.CompareAndSwapKeyValue(ctx, "key", "", "value")
+	assert.Nil(t, err)
+	assert.True(t, swapped)
+	swapped, err = datastore.CompareAndSwapKeyValue(ctx, "key", "", "value")
+	assert.Nil(t, err)
+	assert.False(t, swapped)
+
+	swapped, err = datastore.CompareAndSwapKeyValue(ctx, "key", "other", "updated")
+	assert.Nil(t, err)
+	assert.False(t, swapped)
+	swapped, err = datastore.CompareAndSwapKeyValue(ctx, "key", "value", "updated")
+	assert.Nil(t, err)
+	assert.True(t, swapped)
+
+	value, err := datastore.GetKeyValue(ctx, "key")
+	assert.Nil(t, err)
+	assert.Equal(t, "updated", value)
+
+	_, err = datastore.CompareAndSwapKeyValue(ctx, "", "", "value")
+	assert.NotNil(t, err)
+
+	// Concurrent increments of a counter must all be accounted for.
+	const (
+		workers    = 10
+		increments = 10
+	)
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for j := 0; j < increments; {
+				current, err := datastore.GetKeyValue(ctx, "counter")
+				if err != nil && err != cerrors.ErrNotFound {
+					t.Error(err)
+					return
+				}
+
+				next := 1
+				if current != "" {
+					n, err := strconv.Atoi(current)
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					next = n + 1
+				}
+
+				swapped, err := datastore.CompareAndSwapKeyValue(ctx, "counter", current, strconv.Itoa(next))
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if swapped {
+					j++
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	value, err = datastore.GetKeyValue(ctx, "counter")
+	assert.Nil(t, err)
+	assert.Equal(t, strconv.Itoa(workers*increments), value)
+}
+
+func testLock(t *testing.T, datastore database.Datastore) {
+	ctx := context.Background()
+
+	_, _, err := datastore.FindLock(ctx, "lock")
+	assert.Equal(t, cerrors.ErrNotFound, err)
+
+	locked, until := datastore.Lock(ctx, "lock", "owner1", time.Minute, false)
+	assert.True(t, locked)
+	assert.True(t, until.After(time.Now()))
+
+	owner, _, err := datastore.FindLock(ctx, "lock")
+	assert.Nil(t, err)
+	assert.Equal(t, "owner1", owner)
+
+	// Another owner can neither acquire nor renew the lock.
+	locked, _ = datastore.Lock(ctx, "lock", "owner2", time.Minute, false)
+	assert.False(t, locked)
+	locked, _ = datastore.Lock(ctx, "lock", "owner2", time.Minute, true)
+	assert.False(t, locked)
+
+	locked, _ = datastore.Lock(ctx, "lock", "owner1", time.Hour, true)
+	assert.True(t, locked)
+
+	// Only the owner can unlock.
+	datastore.Unlock(ctx, "lock", "owner2")
+	locked, _ = datastore.Lock(ctx, "lock", "owner2", time.Minute, false)
+	assert.False(t, locked)
+
+	datastore.Unlock(ctx, "lock", "owner1")
+	locked, _ = datastore.Lock(ctx, "lock", "owner2", time.Millisecond, false)
+	assert.True(t, locked)
+
+	// An expired lock can be acquired by another owner.
+	time.Sleep(10 * time.Millisecond)
+	locked, _ = datastore.Lock(ctx, "lock", "owner1", time.Minute, false)
+	assert.True(t, locked)
+}
+
+func testPing(t *testing.T, datastore database.Datastore) {
+	assert.Nil(t, datastore.Ping(context.Background()))
+}
+
+func testStatistics(t *testing.T, datastore database.Datastore) {
+	ctx := context.Background()
+
+	statistics, err := datastore.GetStatistics(ctx, true)
+	if assert.Nil(t, err) {
+		assert.Equal(t, database.Statistics{}, statistics)
+	}
+
+	base := database.Layer{
+		Name:          "base",
+		EngineVersion: 1,
+		Namespace:     &database.Namespace{Name: "debian:7"},
+		Features: []database.FeatureVersion{
+			newFeatureVersion("debian:7", "openssl", "1.0"),
+			newFeatureVersion("debian:7", "curl", "7.0"),
+		},
+	}
+	child := database.Layer{
+		Name:          "child",
+		EngineVersion: 1,
+		Parent:        &base,
+		Features: []database.FeatureVersion{
+			newFeatureVersion("debian:7", "openssl", "1.1"),
+			newFeatureVersion("debian:7", "curl", "7.0"),
+		},
+	}
+	assert.Nil(t, datastore.InsertLayers(ctx, []database.Layer{base, child}))
+
+	vulnerabilities := []database.Vulnerability{
+		{
+			Name:      "CVE-OPENSSL",
+			Namespace: database.Namespace{Name: "debian:7"},
+			Severity:  types.High,
+			FixedIn:   []database.FeatureVersion{newFeatureVersion("debian:7", "openssl", "1.1")},
+		},
+		{
+			Name:      "CVE-WGET",
+			Namespace: database.Namespace{Name: "debian:7"},
+			Severity:  types.Low,
+			FixedIn:   []database.FeatureVersion{newFeatureVersion("debian:7", "wget", "2.0")},
+		},
+	}
+	assert.Nil(t, datastore.InsertVulnerabilities(ctx, vulnerabilities, true))
+
+	// Deleted vulnerabilities and sent notifications are not counted.
+	assert.Nil(t, datastore.DeleteVulnerability(ctx, "debian:7", "CVE-WGET"))
+	notification, err := datastore.GetAvailableNotification(ctx, time.Hour)
+	if assert.Nil(t, err) {
+		assert.Nil(t, datastore.SetNotificationNotified(ctx, notification.Name))
+	}
+
+	statistics, err = datastore.GetStatistics(ctx, true)
+	if assert.Nil(t, err) {
+		assert.Equal(t, database.Statistics{
+			Layers:               2,
+			Features:             3,
+			FeatureVersions:      3,
+			Vulnerabilities:      1,
+			PendingNotifications: 2,
+		}, statistics)
+	}
+
+	// Estimates are only expected to be roughly right, but never negative.
+	statistics, err = datastore.GetStatistics(ctx, false)
+	if assert.Nil(t, err) {
+		assert.True(t, statistics.Layers >= 0 && statistics.Vulnerabilities >= 0)
+	}
+}
@@ -0,0 +1,169 @@
+// Copyright 2015 clair authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package database
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/coreos/clair/utils/types"
+)
+
+const (
+	// dumpPageSize is the number of vulnerabilities that are listed, or inserted, at once when
+	// exporting or importing vulnerabilities.
+	dumpPageSize = 100
+
+	// maxDumpLineSize is the maximum size of a single vulnerability in a dump.
+	maxDumpLineSize = 16 * 1024 * 1024
+)
+
+// dumpedVulnerability is a line of a vulnerability dump.
+type dumpedVulnerability struct {
+	Namespace   string
+	Name        string
+	Description string `json:",omitempty"`
+	Severity    types.Priority
+	Link        string          `json:",omitempty"`
+	Links       []string        `json:",omitempty"`
+	Metadata    MetadataMap     `json:",omitempty"`
+	FixedIn     []dumpedFixedIn `json:",omitempty"`
+}
+
+// dumpedFixedIn is a Feature affected by a dumped vulnerability, along with the version that
+// fixes it.
+type dumpedFixedIn struct {
+	Namespace string
+	Name      string
+	Version   types.Version
+}
+
+// ExportVulnerabilities writes every vulnerability of the datastore, along with its namespace,
+// metadata and FixedIn list, to w as a stream of JSON objects separated by newlines. Layers are not
+// exported.
+func ExportVulnerabilities(ctx context.Context, datastore Datastore, w io.Writer) error {
+	namespaces, err := datastore.ListNamespaces(ctx)
+	if err != nil {
+		return err
+	}
+
+	encoder := json.NewEncoder(w)
+	for _, namespace := range namespaces {
+		for page := 0; page != -1; {
+			var vulnerabilities []Vulnerability
+			vulnerabilities, page, err = datastore.ListVulnerabilities(ctx, namespace.Name, types.Unknown, dumpPageSize, page)
+			if err != nil {
+				return err
+			}
+
+			for _, v := range vulnerabilities {
+				// The FixedIn list is only retrieved by FindVulnerability.
+				v, err = datastore.FindVulnerability(ctx, v.Namespace.Name, v.Name)
+				if err != nil {
+					return err
+				}
+
+				dumped := dumpedVulnerability{
+					Namespace:   v.Namespace.Name,
+					Name:        v.Name,
+					Description: v.Description,
+					Severity:    v.Severity,
+					Link:        v.Link,
+					Links:       v.Links,
+					Metadata:    v.Metadata,
+				}
+				for _, fv := range v.FixedIn {
+					dumped.FixedIn = append(dumped.FixedIn, dumpedFixedIn{
+						Namespace: fv.Feature.Namespace.Name,
+						Name:      fv.Feature.Name,
+						Version:   fv.Version,
+					})
+				}
+
+				if err = encoder.Encode(dumped); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// ImportVulnerabilities reads vulnerabilities written by ExportVulnerabilities from r, and stores
+// them with InsertVulnerabilities, which makes the import idempotent and merges it with the stored
+// vulnerabilities.
+func ImportVulnerabilities(ctx context.Context, datastore Datastore, r io.Reader, createNotification bool) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, maxDumpLineSize)
+
+	var vulnerabilities []Vulnerability
+	flush := func() error {
+		if len(vulnerabilities) == 0 {
+			return nil
+		}
+		err := datastore.InsertVulnerabilities(ctx, vulnerabilities, createNotification)
+		vulnerabilities = nil
+		return err
+	}
+
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		var dumped dumpedVulnerability
+		if err := json.Unmarshal(scanner.Bytes(), &dumped); err != nil {
+			return fmt.Errorf("database: could not decode vulnerability on line %d: %v", line, err)
+		}
+		if dumped.Namespace == "" || dumped.Name == "" {
+			return fmt.Errorf("database: vulnerability on line %d has no namespace or name", line)
+		}
+
+		v := Vulnerability{
+			Name:        dumped.Name,
+			Namespace:   Namespace{Name: dumped.Namespace},
+			Description: dumped.Description,
+			Severity:    dumped.Severity,
+			Link:        dumped.Link,
+			Links:       dumped.Links,
+			Metadata:    dumped.Metadata,
+		}
+		for _, fixedIn := range dumped.FixedIn {
+			v.FixedIn = append(v.FixedIn, FeatureVersion{
+				Feature: Feature{
+					Name:      fixedIn.Name,
+					Namespace: Namespace{Name: fixedIn.Namespace},
+				},
+				Version: fixedIn.Version,
+			})
+		}
+
+		vulnerabilities = append(vulnerabilities, v)
+		if len(vulnerabilities) == dumpPageSize {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	return flush()
+}
@@ -14,170 +14,311 @@
 
 package database
 
-import "time"
+import (
+	"context"
+	"time"
+
+	"github.com/coreos/clair/utils/types"
+)
 
 // MockDatastore implements Datastore and enables overriding each available method.
 // The default behavior of each method is to simply panic.
 type MockDatastore struct {
-	FctListNamespaces           func() ([]Namespace, error)
-	FctInsertLayer              func(Layer) error
-	FctFindLayer                func(name string, withFeatures, withVulnerabilities bool) (Layer, error)
-	FctDeleteLayer              func(name string) error
-	FctListVulnerabilities      func(namespaceName string, limit int, page int) ([]Vulnerability, int, error)
-	FctInsertVulnerabilities    func(vulnerabilities []Vulnerability, createNotification bool) error
-	FctFindVulnerability        func(namespaceName, name string) (Vulnerability, error)
-	FctDeleteVulnerability      func(namespaceName, name string) error
-	FctInsertVulnerabilityFixes func(vulnerabilityNamespace, vulnerabilityName string, fixes []FeatureVersion) error
-	FctDeleteVulnerabilityFix   func(vulnerabilityNamespace, vulnerabilityName, featureName string) error
-	FctGetAvailableNotification func(renotifyInterval time.Duration) (VulnerabilityNotification, error)
-	FctGetNotification          func(name string, limit int, page VulnerabilityNotificationPageNumber) (VulnerabilityNotification, VulnerabilityNotificationPageNumber, error)
-	FctSetNotificationNotified  func(name string) error
-	FctDeleteNotification       func(name string) error
-	FctInsertKeyValue           func(key, value string) error
-	FctGetKeyValue              func(key string) (string, error)
-	FctLock                     func(name string, owner string, duration time.Duration, renew bool) (bool, time.Time)
-	FctUnlock                   func(name, owner string)
-	FctFindLock                 func(name string) (string, time.Time, error)
-	FctPing                     func() bool
-	FctClose                    func()
-}
-
-func (mds *MockDatastore) ListNamespaces() ([]Namespace, error) {
+	FctListNamespaces                  func(ctx context.Context) ([]Namespace, error)
+	FctCountVulnerabilitiesByNamespace func(ctx context.Context) (map[string]int, error)
+	FctGetLastVulnerabilityChange      func(ctx context.Context, namespaceName string) (time.Time, error)
+	FctInsertLayer                     func(ctx context.Context, layer Layer) error
+	FctInsertLayers                    func(ctx context.Context, layers []Layer) error
+	FctFindLayer                       func(ctx context.Context, name string, withFeatures, withVulnerabilities bool, minSeverity types.Priority) (Layer, error)
+	FctFindLayerChildren               func(ctx context.Context, name string) ([]Layer, error)
+	FctLayerExists                     func(ctx context.Context, name string) (bool, error)
+	FctGetLayerDiff                    func(ctx context.Context, name string) (added, removed []FeatureVersion, err error)
+	FctDeleteLayer                     func(ctx context.Context, name string, recursive bool) error
+	FctListLayers                      func(ctx context.Context, limit int, startAfter string) ([]Layer, error)
+	FctListLayersMissingDetector       func(ctx context.Context, detector string, limit int, startAfter string) ([]Layer, error)
+	FctListOutdatedLayers              func(ctx context.Context, engineVersion, limit, startAfterID int) ([]Layer, error)
+	FctMarkLayerStale                  func(ctx context.Context, name string) error
+	FctCountLayers                     func(ctx context.Context) (int, error)
+	FctListVulnerabilities             func(ctx context.Context, namespaceName string, minSeverity types.Priority, limit int, page int) ([]Vulnerability, int, error)
+	FctInsertVulnerabilities           func(ctx context.Context, vulnerabilities []Vulnerability, createNotification bool) error
+	FctCreateVulnerability             func(ctx context.Context, vulnerability Vulnerability, createNotification bool) error
+	FctFindVulnerability               func(ctx context.Context, namespaceName, name string) (Vulnerability, error)
+	FctDeleteVulnerability             func(ctx context.Context, namespaceName, name string) error
+	FctInsertVulnerabilityFixes        func(ctx context.Context, vulnerabilityNamespace, vulnerabilityName string, fixes []FeatureVersion) error
+	FctDeleteVulnerabilityFix          func(ctx context.Context, vulnerabilityNamespace, vulnerabilityName, featureName string) error
+	FctUpdateVulnerability             func(ctx context.Context, namespaceName, name string, update VulnerabilityUpdate) (Vulnerability, error)
+	FctGetAffectedLayers               func(ctx context.Context, namespaceName, name string, limit, startAfterID int) ([]Layer, int, error)
+	FctGetVulnerabilityHistory         func(ctx context.Context, namespaceName, name string) ([]VulnerabilityHistoryEntry, error)
+	FctGetAvailableNotification        func(ctx context.Context, renotifyInterval time.Duration) (VulnerabilityNotification, error)
+	FctGetNotification                 func(ctx context.Context, name string, limit int, page VulnerabilityNotificationPageNumber) (VulnerabilityNotification, VulnerabilityNotificationPageNumber, error)
+	FctSetNotificationNotified         func(ctx context.Context, name string) error
+	FctDeleteNotification              func(ctx context.Context, name string) error
+	FctInsertKeyValue                  func(ctx context.Context, key, value string) error
+	FctGetKeyValue                     func(ctx context.Context, key string) (string, error)
+	FctCompareAndSwapKeyValue          func(ctx context.Context, key, old, new string) (bool, error)
+	FctLock                            func(ctx context.Context, name string, owner string, duration time.Duration, renew bool) (bool, time.Time)
+	FctUnlock                          func(ctx context.Context, name, owner string)
+	FctFindLock                        func(ctx context.Context, name string) (string, time.Time, error)
+	FctPing                            func(ctx context.Context) error
+	FctGetStatistics                   func(ctx context.Context, exact bool) (Statistics, error)
+	FctClose                           func()
+}
+
+func (mds *MockDatastore) ListNamespaces(ctx context.Context) ([]Namespace, error) {
 	if mds.FctListNamespaces != nil {
-		return mds.FctListNamespaces()
+		return mds.FctListNamespaces(ctx)
+	}
+	panic("required mock function not implemented")
+}
+
+func (mds *MockDatastore) CountVulnerabilitiesByNamespace(ctx context.Context) (map[string]int, error) {
+	if mds.FctCountVulnerabilitiesByNamespace != nil {
+		return mds.FctCountVulnerabilitiesByNamespace(ctx)
+	}
+	panic("required mock function not implemented")
+}
+
+func (mds *MockDatastore) GetLastVulnerabilityChange(ctx context.Context, namespaceName string) (time.Time, error) {
+	if mds.FctGetLastVulnerabilityChange != nil {
+		return mds.FctGetLastVulnerabilityChange(ctx, namespaceName)
 	}
 	panic("required mock function not implemented")
 }
 
-func (mds *MockDatastore) InsertLayer(layer Layer) error {
+func (mds *MockDatastore) InsertLayer(ctx context.Context, layer Layer) error {
 	if mds.FctInsertLayer != nil {
-		return mds.FctInsertLayer(layer)
+		return mds.FctInsertLayer(ctx, layer)
 	}
 	panic("required mock function not implemented")
 }
 
-func (mds *MockDatastore) FindLayer(name string, withFeatures, withVulnerabilities bool) (Layer, error) {
+func (mds *MockDatastore) InsertLayers(ctx context.Context, layers []Layer) error {
+	if mds.FctInsertLayers != nil {
+		return mds.FctInsertLayers(ctx, layers)
+	}
+	panic("required mock function not implemented")
+}
+
+func (mds *MockDatastore) FindLayer(ctx context.Context, name string, withFeatures, withVulnerabilities bool, minSeverity types.Priority) (Layer, error) {
 	if mds.FctFindLayer != nil {
-		return mds.FctFindLayer(name, withFeatures, withVulnerabilities)
+		return mds.FctFindLayer(ctx, name, withFeatures, withVulnerabilities, minSeverity)
+	}
+	panic("required mock function not implemented")
+}
+
+func (mds *MockDatastore) GetLayerDiff(ctx context.Context, name string) (added, removed []FeatureVersion, err error) {
+	if mds.FctGetLayerDiff != nil {
+		return mds.FctGetLayerDiff(ctx, name)
+	}
+	panic("required mock function not implemented")
+}
+
+func (mds *MockDatastore) LayerExists(ctx context.Context, name string) (bool, error) {
+	if mds.FctLayerExists != nil {
+		return mds.FctLayerExists(ctx, name)
+	}
+	panic("required mock function not implemented")
+}
+
+func (mds *MockDatastore) FindLayerChildren(ctx context.Context, name string) ([]Layer, error) {
+	if mds.FctFindLayerChildren != nil {
+		return mds.FctFindLayerChildren(ctx, name)
 	}
 	panic("required mock function not implemented")
 }
 
-func (mds *MockDatastore) DeleteLayer(name string) error {
+func (mds *MockDatastore) DeleteLayer(ctx context.Context, name string, recursive bool) error {
 	if mds.FctDeleteLayer != nil {
-		return mds.FctDeleteLayer(name)
+		return mds.FctDeleteLayer(ctx, name, recursive)
 	}
 	panic("required mock function not implemented")
 }
 
-func (mds *MockDatastore) ListVulnerabilities(namespaceName string, limit int, page int) ([]Vulnerability, int, error) {
+func (mds *MockDatastore) ListLayers(ctx context.Context, limit int, startAfter string) ([]Layer, error) {
+	if mds.FctListLayers != nil {
+		return mds.FctListLayers(ctx, limit, startAfter)
+	}
+	panic("required mock function not implemented")
+}
+
+func (mds *MockDatastore) ListLayersMissingDetector(ctx context.Context, detector string, limit int, startAfter string) ([]Layer, error) {
+	if mds.FctListLayersMissingDetector != nil {
+		return mds.FctListLayersMissingDetector(ctx, detector, limit, startAfter)
+	}
+	panic("required mock function not implemented")
+}
+
+func (mds *MockDatastore) ListOutdatedLayers(ctx context.Context, engineVersion, limit, startAfterID int) ([]Layer, error) {
+	if mds.FctListOutdatedLayers != nil {
+		return mds.FctListOutdatedLayers(ctx, engineVersion, limit, startAfterID)
+	}
+	panic("required mock function not implemented")
+}
+
+func (mds *MockDatastore) MarkLayerStale(ctx context.Context, name string) error {
+	if mds.FctMarkLayerStale != nil {
+		return mds.FctMarkLayerStale(ctx, name)
+	}
+	panic("required mock function not implemented")
+}
+
+func (mds *MockDatastore) CountLayers(ctx context.Context) (int, error) {
+	if mds.FctCountLayers != nil {
+		return mds.FctCountLayers(ctx)
+	}
+	panic("required mock function not implemented")
+}
+
+func (mds *MockDatastore) ListVulnerabilities(ctx context.Context, namespaceName string, minSeverity types.Priority, limit int, page int) ([]Vulnerability, int, error) {
 	if mds.FctListVulnerabilities != nil {
-		return mds.FctListVulnerabilities(namespaceName, limit, page)
+		return mds.FctListVulnerabilities(ctx, namespaceName, minSeverity, limit, page)
 	}
 	panic("required mock function not implemented")
 }
 
-func (mds *MockDatastore) InsertVulnerabilities(vulnerabilities []Vulnerability, createNotification bool) error {
+func (mds *MockDatastore) InsertVulnerabilities(ctx context.Context, vulnerabilities []Vulnerability, createNotification bool) error {
 	if mds.FctInsertVulnerabilities != nil {
-		return mds.FctInsertVulnerabilities(vulnerabilities, createNotification)
+		return mds.FctInsertVulnerabilities(ctx, vulnerabilities, createNotification)
 	}
 	panic("required mock function not implemented")
 }
 
-func (mds *MockDatastore) FindVulnerability(namespaceName, name string) (Vulnerability, error) {
+func (mds *MockDatastore) CreateVulnerability(ctx context.Context, vulnerability Vulnerability, createNotification bool) error {
+	if mds.FctCreateVulnerability != nil {
+		return mds.FctCreateVulnerability(ctx, vulnerability, createNotification)
+	}
+	panic("required mock function not implemented")
+}
+
+func (mds *MockDatastore) FindVulnerability(ctx context.Context, namespaceName, name string) (Vulnerability, error) {
 	if mds.FctFindVulnerability != nil {
-		return mds.FctFindVulnerability(namespaceName, name)
+		return mds.FctFindVulnerability(ctx, namespaceName, name)
 	}
 	panic("required mock function not implemented")
 }
 
-func (mds *MockDatastore) DeleteVulnerability(namespaceName, name string) error {
+func (mds *MockDatastore) DeleteVulnerability(ctx context.Context, namespaceName, name string) error {
 	if mds.FctDeleteVulnerability != nil {
-		return mds.FctDeleteVulnerability(namespaceName, name)
+		return mds.FctDeleteVulnerability(ctx, namespaceName, name)
 	}
 	panic("required mock function not implemented")
 }
 
-func (mds *MockDatastore) InsertVulnerabilityFixes(vulnerabilityNamespace, vulnerabilityName string, fixes []FeatureVersion) error {
+func (mds *MockDatastore) InsertVulnerabilityFixes(ctx context.Context, vulnerabilityNamespace, vulnerabilityName string, fixes []FeatureVersion) error {
 	if mds.FctInsertVulnerabilityFixes != nil {
-		return mds.FctInsertVulnerabilityFixes(vulnerabilityNamespace, vulnerabilityName, fixes)
+		return mds.FctInsertVulnerabilityFixes(ctx, vulnerabilityNamespace, vulnerabilityName, fixes)
 	}
 	panic("required mock function not implemented")
 }
 
-func (mds *MockDatastore) DeleteVulnerabilityFix(vulnerabilityNamespace, vulnerabilityName, featureName string) error {
+func (mds *MockDatastore) DeleteVulnerabilityFix(ctx context.Context, vulnerabilityNamespace, vulnerabilityName, featureName string) error {
 	if mds.FctDeleteVulnerabilityFix != nil {
-		return mds.FctDeleteVulnerabilityFix(vulnerabilityNamespace, vulnerabilityName, featureName)
+		return mds.FctDeleteVulnerabilityFix(ctx, vulnerabilityNamespace, vulnerabilityName, featureName)
 	}
 	panic("required mock function not implemented")
 }
 
-func (mds *MockDatastore) GetAvailableNotification(renotifyInterval time.Duration) (VulnerabilityNotification, error) {
+func (mds *MockDatastore) UpdateVulnerability(ctx context.Context, namespaceName, name string, update VulnerabilityUpdate) (Vulnerability, error) {
+	if mds.FctUpdateVulnerability != nil {
+		return mds.FctUpdateVulnerability(ctx, namespaceName, name, update)
+	}
+	panic("required mock function not implemented")
+}
+
+func (mds *MockDatastore) GetAffectedLayers(ctx context.Context, namespaceName, name string, limit, startAfterID int) ([]Layer, int, error) {
+	if mds.FctGetAffectedLayers != nil {
+		return mds.FctGetAffectedLayers(ctx, namespaceName, name, limit, startAfterID)
+	}
+	panic("required mock function not implemented")
+}
+
+func (mds *MockDatastore) GetVulnerabilityHistory(ctx context.Context, namespaceName, name string) ([]VulnerabilityHistoryEntry, error) {
+	if mds.FctGetVulnerabilityHistory != nil {
+		return mds.FctGetVulnerabilityHistory(ctx, namespaceName, name)
+	}
+	panic("required mock function not implemented")
+}
+
+func (mds *MockDatastore) GetAvailableNotification(ctx context.Context, renotifyInterval time.Duration) (VulnerabilityNotification, error) {
 	if mds.FctGetAvailableNotification != nil {
-		return mds.FctGetAvailableNotification(renotifyInterval)
+		return mds.FctGetAvailableNotification(ctx, renotifyInterval)
 	}
 	panic("required mock function not implemented")
 }
 
-func (mds *MockDatastore) GetNotification(name string, limit int, page VulnerabilityNotificationPageNumber) (VulnerabilityNotification, VulnerabilityNotificationPageNumber, error) {
+func (mds *MockDatastore) GetNotification(ctx context.Context, name string, limit int, page VulnerabilityNotificationPageNumber) (VulnerabilityNotification, VulnerabilityNotificationPageNumber, error) {
 	if mds.FctGetNotification != nil {
-		return mds.FctGetNotification(name, limit, page)
+		return mds.FctGetNotification(ctx, name, limit, page)
 	}
 	panic("required mock function not implemented")
 }
 
-func (mds *MockDatastore) SetNotificationNotified(name string) error {
+func (mds *MockDatastore) SetNotificationNotified(ctx context.Context, name string) error {
 	if mds.FctSetNotificationNotified != nil {
-		return mds.FctSetNotificationNotified(name)
+		return mds.FctSetNotificationNotified(ctx, name)
 	}
 	panic("required mock function not implemented")
 }
 
-func (mds *MockDatastore) DeleteNotification(name string) error {
+func (mds *MockDatastore) DeleteNotification(ctx context.Context, name string) error {
 	if mds.FctDeleteNotification != nil {
-		return mds.FctDeleteNotification(name)
+		return mds.FctDeleteNotification(ctx, name)
 	}
 	panic("required mock function not implemented")
 }
-func (mds *MockDatastore) InsertKeyValue(key, value string) error {
+func (mds *MockDatastore) InsertKeyValue(ctx context.Context, key, value string) error {
 	if mds.FctInsertKeyValue != nil {
-		return mds.FctInsertKeyValue(key, value)
+		return mds.FctInsertKeyValue(ctx, key, value)
 	}
 	panic("required mock function not implemented")
 }
 
-func (mds *MockDatastore) GetKeyValue(key string) (string, error) {
+func (mds *MockDatastore) GetKeyValue(ctx context.Context, key string) (string, error) {
 	if mds.FctGetKeyValue != nil {
-		return mds.FctGetKeyValue(key)
+		return mds.FctGetKeyValue(ctx, key)
 	}
 	panic("required mock function not implemented")
 }
 
-func (mds *MockDatastore) Lock(name string, owner string, duration time.Duration, renew bool) (bool, time.Time) {
+func (mds *MockDatastore) CompareAndSwapKeyValue(ctx context.Context, key, old, new string) (bool, error) {
+	if mds.FctCompareAndSwapKeyValue != nil {
+		return mds.FctCompareAndSwapKeyValue(ctx, key, old, new)
+	}
+	panic("required mock function not implemented")
+}
+
+func (mds *MockDatastore) Lock(ctx context.Context, name string, owner string, duration time.Duration, renew bool) (bool, time.Time) {
 	if mds.FctLock != nil {
-		return mds.FctLock(name, owner, duration, renew)
+		return mds.FctLock(ctx, name, owner, duration, renew)
 	}
 	panic("required mock function not implemented")
 }
 
-func (mds *MockDatastore) Unlock(name, owner string) {
+func (mds *MockDatastore) Unlock(ctx context.Context, name, owner string) {
 	if mds.FctUnlock != nil {
-		mds.FctUnlock(name, owner)
+		mds.FctUnlock(ctx, name, owner)
 		return
 	}
 	panic("required mock function not implemented")
 }
 
-func (mds *MockDatastore) FindLock(name string) (string, time.Time, error) {
+func (mds *MockDatastore) FindLock(ctx context.Context, name string) (string, time.Time, error) {
 	if mds.FctFindLock != nil {
-		return mds.FctFindLock(name)
+		return mds.FctFindLock(ctx, name)
 	}
 	panic("required mock function not implemented")
 }
 
-func (mds *MockDatastore) Ping() bool {
+func (mds *MockDatastore) Ping(ctx context.Context) error {
 	if mds.FctPing != nil {
-		return mds.FctPing()
+		return mds.FctPing(ctx)
+	}
+	panic("required mock function not implemented")
+}
+
+func (mds *MockDatastore) GetStatistics(ctx context.Context, exact bool) (Statistics, error) {
+	if mds.FctGetStatistics != nil {
+		return mds.FctGetStatistics(ctx, exact)
 	}
 	panic("required mock function not implemented")
 }
@@ -17,8 +17,14 @@ package database
 import (
 	"database/sql/driver"
 	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
+	"github.com/coreos/clair/utils"
 	"github.com/coreos/clair/utils/types"
 )
 
@@ -33,14 +39,92 @@ type Layer struct {
 	Name          string
 	EngineVersion int
 	Parent        *Layer
-	Namespace     *Namespace
 	Features      []FeatureVersion
+
+	// Namespace is the primary namespace of the Layer, usually the one of its Operating System.
+	Namespace *Namespace
+	// Namespaces lists every namespace detected in the Layer, the primary one included, such as
+	// the namespaces of the language packages that it contains besides the Operating System ones.
+	Namespaces []Namespace
+
+	// ProcessedBy lists the names of the detectors that ran on the Layer.
+	ProcessedBy []string
+
+	// Path and Format are the location and the format of the archive of the Layer, as it was last
+	// analyzed, so that it can be analyzed again by a newer engine.
+	Path   string
+	Format string
+
+	// Stale is set when the Layer has been analyzed by an older engine and its archive could not
+	// be analyzed again. It is cleared once the Layer is analyzed by the current engine.
+	Stale bool
+
+	// Depth is the number of layers in the ancestry of the Layer, the Layer itself included. It is
+	// only set when the Features of the Layer are retrieved.
+	Depth int
+}
+
+// IsProcessedBy returns whether every one of the given detectors ran on the Layer.
+func (l Layer) IsProcessedBy(detectors []string) bool {
+	return len(utils.CompareStringLists(detectors, l.ProcessedBy)) == 0
+}
+
+// MaxLayerNameLength is the maximum length, in bytes, of the name of a Layer.
+const MaxLayerNameLength = 256
+
+// ValidateLayerName returns an error if the given name can't be the one of a new Layer, because
+// it is empty, too long, or would break the URLs and the logs it ends up in. The API restricts
+// the names further, the layers stored before remain readable whatever their name.
+func ValidateLayerName(name string) error {
+	switch {
+	case name == "":
+		return errors.New("the layer name is empty")
+	case len(name) > MaxLayerNameLength:
+		return errors.New("the layer name is longer than " + strconv.Itoa(MaxLayerNameLength) + " bytes")
+	case !utf8.ValidString(name):
+		return errors.New("the layer name is not valid UTF-8")
+	case strings.ContainsRune(name, '/'):
+		return errors.New("the layer name contains a slash")
+	case strings.Trim(name, ".") == "":
+		return errors.New("the layer name is only made of dots")
+	case strings.IndexFunc(name, func(r rune) bool { return unicode.IsSpace(r) || unicode.IsControl(r) }) >= 0:
+		return errors.New("the layer name contains whitespace or control characters")
+	}
+	return nil
+}
+
+// ListNamespaces returns every namespace of the Layer once, starting with the primary one, even
+// if the Namespaces field omits it.
+func (l Layer) ListNamespaces() []Namespace {
+	namespaces := l.Namespaces
+	if l.Namespace != nil {
+		namespaces = append([]Namespace{*l.Namespace}, l.Namespaces...)
+	}
+
+	var unique []Namespace
+	seen := make(map[string]struct{}, len(namespaces))
+	for _, namespace := range namespaces {
+		if _, ok := seen[namespace.Name]; !ok {
+			seen[namespace.Name] = struct{}{}
+			unique = append(unique, namespace)
+		}
+	}
+	return unique
 }
 
 type Namespace struct {
 	Model
 
 	Name string
+	// VersionFormat tells how the versions of the features of the namespace compare. It may be
+	// empty when unknown, in which case they compare like Debian versions.
+	VersionFormat types.VersionFormat
+}
+
+// Prefix returns the part of the Name that precedes its version, which names the Operating System
+// or the package ecosystem of the Namespace.
+func (n Namespace) Prefix() string {
+	return strings.SplitN(n.Name, ":", 2)[0]
 }
 
 type Feature struct {
@@ -68,9 +152,13 @@ type Vulnerability struct {
 	Namespace Namespace
 
 	Description string
-	Link        string
 	Severity    types.Priority
 
+	// Link is the primary reference about the vulnerability, while Links lists every known
+	// reference, including Link.
+	Link  string
+	Links []string
+
 	Metadata MetadataMap
 
 	FixedIn                        []FeatureVersion
@@ -81,6 +169,28 @@ type Vulnerability struct {
 	FixedBy types.Version `json:",omitempty"`
 }
 
+// VulnerabilityUpdate lists the changes to make to an existing Vulnerability. The nil fields are
+// left unchanged, and FixedIn is a partial list, as for Datastore.InsertVulnerabilities.
+type VulnerabilityUpdate struct {
+	Description *string
+	Link        *string
+	Severity    *types.Priority
+	FixedIn     []FeatureVersion
+}
+
+// Apply sets the updated fields, but FixedIn, on the given Vulnerability.
+func (u VulnerabilityUpdate) Apply(v *Vulnerability) {
+	if u.Description != nil {
+		v.Description = *u.Description
+	}
+	if u.Link != nil {
+		v.Link = *u.Link
+	}
+	if u.Severity != nil {
+		v.Severity = *u.Severity
+	}
+}
+
 type MetadataMap map[string]interface{}
 
 func (mm *MetadataMap) Scan(value interface{}) error {
@@ -96,6 +206,25 @@ func (mm *MetadataMap) Value() (driver.Value, error) {
 	return string(json), err
 }
 
+// VulnerabilityHistoryEntry records a change of the Severity of a Vulnerability, or of the Version
+// that fixes one of the Features it affects.
+type VulnerabilityHistoryEntry struct {
+	Created time.Time
+
+	// Source is what modified the Vulnerability (e.g. the updater or the API), if known.
+	Source string
+
+	OldSeverity types.Priority
+	NewSeverity types.Priority
+
+	// FeatureName is the name of the Feature whose fixing Version changed, and is empty when only
+	// the Severity changed. An empty OldFixedBy means that the Feature was not affected before the
+	// change, an empty NewFixedBy means that it is not affected anymore.
+	FeatureName string
+	OldFixedBy  string
+	NewFixedBy  string
+}
+
 type VulnerabilityNotification struct {
 	Model
 
@@ -115,5 +244,16 @@ type VulnerabilityNotificationPageNumber struct {
 	NewVulnerability int
 }
 
+// Statistics holds the number of objects stored in a Datastore.
+type Statistics struct {
+	Layers          int
+	Features        int
+	FeatureVersions int
+	Vulnerabilities int
+
+	// PendingNotifications is the number of Notifications that haven't been sent yet.
+	PendingNotifications int
+}
+
 var VulnerabilityNotificationFirstPage = VulnerabilityNotificationPageNumber{0, 0}
 var NoVulnerabilityNotificationPage = VulnerabilityNotificationPageNumber{-1, -1}
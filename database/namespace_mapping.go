@@ -14,6 +14,8 @@
 
 package database
 
+import "github.com/coreos/clair/utils/types"
+
 // DebianReleasesMapping translates Debian code names and class names to version numbers
 var DebianReleasesMapping = map[string]string{
 	// Code names
@@ -41,3 +43,23 @@ var UbuntuReleasesMapping = map[string]string{
 	"wily":    "15.10",
 	"xenial":  "16.04",
 }
+
+// VersionFormatsMapping translates the OS part of the namespace names to the format of their
+// package versions
+var VersionFormatsMapping = map[string]types.VersionFormat{
+	"debian": types.DpkgVersionFormat,
+	"ubuntu": types.DpkgVersionFormat,
+
+	"centos":     types.RpmVersionFormat,
+	"rhel":       types.RpmVersionFormat,
+	"fedora":     types.RpmVersionFormat,
+	"oracle":     types.RpmVersionFormat,
+	"scientific": types.RpmVersionFormat,
+	"amzn":       types.RpmVersionFormat,
+
+	"sles":          types.RpmVersionFormat,
+	"opensuse":      types.RpmVersionFormat,
+	"opensuse.leap": types.RpmVersionFormat,
+
+	"alpine": types.ApkVersionFormat,
+}
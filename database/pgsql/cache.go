@@ -0,0 +1,113 @@
+// Copyright 2015 clair authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pgsql
+
+import (
+	"time"
+
+	"github.com/coreos/clair/utils/types"
+)
+
+// cacheEntry is an ID stored in the cache, along with the time after which it must not be used.
+// A zero expiresAt means that the entry never expires.
+type cacheEntry struct {
+	id        int
+	expiresAt time.Time
+}
+
+// namespaceCacheKey includes the version format, so a namespace cached before its format was
+// known is still inserted again to record it.
+func namespaceCacheKey(name string, versionFormat types.VersionFormat) string {
+	return "namespace:" + string(versionFormat) + ":" + name
+}
+
+func featureCacheKey(namespaceName, name string) string {
+	return "feature:" + namespaceName + ":" + name
+}
+
+func featureVersionCacheKey(namespaceName, name, version string) string {
+	return "featureversion:" + namespaceName + ":" + name + ":" + version
+}
+
+// getCached returns the ID cached under the given key, if any and if it hasn't expired.
+// The object is only used to label the metrics.
+func (pgSQL *pgSQL) getCached(object, key string) (int, bool) {
+	if pgSQL.cache == nil {
+		return 0, false
+	}
+
+	promCacheQueriesTotal.WithLabelValues(object).Inc()
+	value, found := pgSQL.cache.Get(key)
+	if !found {
+		return 0, false
+	}
+
+	entry := value.(cacheEntry)
+	if !entry.expiresAt.IsZero() && time.Now().After(entry.expiresAt) {
+		pgSQL.cache.Remove(key)
+		promCacheEvictionsTotal.WithLabelValues("expired").Inc()
+		promCacheSize.Set(float64(pgSQL.cache.Len()))
+		return 0, false
+	}
+
+	promCacheHitsTotal.WithLabelValues(object).Inc()
+	return entry.id, true
+}
+
+// addCached caches the given ID under the given key, for CacheTTL if it is set.
+func (pgSQL *pgSQL) addCached(key string, id int) {
+	if pgSQL.cache == nil {
+		return
+	}
+
+	entry := cacheEntry{id: id}
+	if pgSQL.config.CacheTTL > 0 {
+		entry.expiresAt = time.Now().Add(pgSQL.config.CacheTTL)
+	}
+
+	if !pgSQL.cache.Contains(key) && pgSQL.cache.Len() >= pgSQL.config.CacheSize {
+		promCacheEvictionsTotal.WithLabelValues("capacity").Inc()
+	}
+	pgSQL.cache.Add(key, entry)
+	promCacheSize.Set(float64(pgSQL.cache.Len()))
+}
+
+// invalidateCache removes the given keys from the cache. It must be called by every write path
+// that renames or deletes the object a key refers to, otherwise stale IDs would be served.
+func (pgSQL *pgSQL) invalidateCache(keys ...string) {
+	if pgSQL.cache == nil {
+		return
+	}
+
+	for _, key := range keys {
+		if pgSQL.cache.Contains(key) {
+			pgSQL.cache.Remove(key)
+			promCacheEvictionsTotal.WithLabelValues("invalidated").Inc()
+		}
+	}
+	promCacheSize.Set(float64(pgSQL.cache.Len()))
+}
+
+// flushCache empties the cache. It must be called by the write paths that may make several
+// entries stale at once, such as deleting a namespace, which deletes its features as well.
+func (pgSQL *pgSQL) flushCache() {
+	if pgSQL.cache == nil {
+		return
+	}
+
+	promCacheEvictionsTotal.WithLabelValues("flushed").Add(float64(pgSQL.cache.Len()))
+	pgSQL.cache.Purge()
+	promCacheSize.Set(0)
+}
@@ -0,0 +1,131 @@
+// Copyright 2015 clair authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pgsql
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/golang-lru"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/coreos/clair/database"
+)
+
+func TestNamespaceCacheInvalidation(t *testing.T) {
+	datastore, err := openDatabaseForTest("NamespaceCacheInvalidation", false)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer datastore.Close()
+
+	datastore.config.CacheSize = 16
+	datastore.cache, _ = lru.NewARC(datastore.config.CacheSize)
+
+	ctx := context.Background()
+	namespace := database.Namespace{Name: "debian:7"}
+
+	id1, err := datastore.insertNamespace(ctx, namespace)
+	assert.Nil(t, err)
+
+	// Delete the namespace behind the cache's back: the stale ID is still served.
+	_, err = datastore.Exec("DELETE FROM Namespace WHERE id = $1", id1)
+	assert.Nil(t, err)
+	id2, err := datastore.insertNamespace(ctx, namespace)
+	assert.Nil(t, err)
+	assert.Equal(t, id1, id2)
+
+	// Once invalidated, a fresh row is created.
+	datastore.invalidateCache(namespaceCacheKey(namespace.Name, namespace.VersionFormat))
+	id3, err := datastore.insertNamespace(ctx, namespace)
+	assert.Nil(t, err)
+	assert.NotEqual(t, id1, id3)
+
+	var name string
+	err = datastore.QueryRow("SELECT name FROM Namespace WHERE id = $1", id3).Scan(&name)
+	assert.Nil(t, err)
+	assert.Equal(t, namespace.Name, name)
+
+	// Same after a flush.
+	_, err = datastore.Exec("DELETE FROM Namespace WHERE id = $1", id3)
+	assert.Nil(t, err)
+	datastore.flushCache()
+	id4, err := datastore.insertNamespace(ctx, namespace)
+	assert.Nil(t, err)
+	assert.NotEqual(t, id3, id4)
+}
+
+func TestCache(t *testing.T) {
+	evictions := func(reason string) float64 {
+		var metric dto.Metric
+		promCacheEvictionsTotal.WithLabelValues(reason).Write(&metric)
+		return metric.GetCounter().GetValue()
+	}
+	size := func() float64 {
+		var metric dto.Metric
+		promCacheSize.Write(&metric)
+		return metric.GetGauge().GetValue()
+	}
+
+	// A disabled cache never finds anything.
+	var datastore pgSQL
+	datastore.addCached("a", 1)
+	_, found := datastore.getCached("test", "a")
+	assert.False(t, found)
+
+	datastore.config.CacheSize = 2
+	datastore.cache, _ = lru.NewARC(datastore.config.CacheSize)
+
+	// Entries without TTL are kept until there's no room for them.
+	datastore.addCached("a", 1)
+	datastore.addCached("b", 2)
+	assert.Equal(t, float64(2), size())
+	id, found := datastore.getCached("test", "a")
+	assert.True(t, found)
+	assert.Equal(t, 1, id)
+
+	before := evictions("capacity")
+	datastore.addCached("c", 3)
+	assert.Equal(t, before+1, evictions("capacity"))
+	assert.Equal(t, float64(2), size())
+
+	// Invalidation and flushes.
+	before = evictions("invalidated")
+	datastore.invalidateCache("c", "unknown")
+	assert.Equal(t, before+1, evictions("invalidated"))
+	_, found = datastore.getCached("test", "c")
+	assert.False(t, found)
+
+	datastore.flushCache()
+	assert.Equal(t, float64(0), size())
+	_, found = datastore.getCached("test", "a")
+	assert.False(t, found)
+
+	// Expired entries are evicted when they are looked up.
+	datastore.config.CacheTTL = time.Hour
+	datastore.addCached("a", 1)
+	_, found = datastore.getCached("test", "a")
+	assert.True(t, found)
+
+	datastore.cache.Add("a", cacheEntry{id: 1, expiresAt: time.Now().Add(-time.Second)})
+	before = evictions("expired")
+	_, found = datastore.getCached("test", "a")
+	assert.False(t, found)
+	assert.Equal(t, before+1, evictions("expired"))
+	assert.Equal(t, float64(0), size())
+}
@@ -15,6 +15,7 @@
 package pgsql
 
 import (
+	"context"
 	"fmt"
 	"math/rand"
 	"runtime"
@@ -49,7 +50,7 @@ func TestRaceAffects(t *testing.T) {
 		Namespace: database.Namespace{Name: "TestRaceAffectsFeatureNamespace1"},
 		Name:      "TestRaceAffecturesFeature1",
 	}
-	_, err = datastore.insertFeature(feature)
+	_, err = datastore.insertFeature(context.Background(), feature)
 	if err != nil {
 		t.Error(err)
 		return
@@ -103,7 +104,7 @@ func TestRaceAffects(t *testing.T) {
 		defer wg.Done()
 		for _, vulnerabilitiesM := range vulnerabilities {
 			for _, vulnerability := range vulnerabilitiesM {
-				err = datastore.InsertVulnerabilities([]database.Vulnerability{vulnerability}, true)
+				err = datastore.InsertVulnerabilities(context.Background(), []database.Vulnerability{vulnerability}, true)
 				assert.Nil(t, err)
 			}
 		}
@@ -113,7 +114,7 @@ func TestRaceAffects(t *testing.T) {
 	go func() {
 		defer wg.Done()
 		for i := 0; i < len(featureVersions); i++ {
-			featureVersions[i].ID, err = datastore.insertFeatureVersion(featureVersions[i])
+			featureVersions[i].ID, err = datastore.insertFeatureVersion(context.Background(), featureVersions[i])
 			assert.Nil(t, err)
 		}
 		fmt.Println("finished to insert featureVersions")
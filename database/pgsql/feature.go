@@ -15,66 +15,58 @@
 package pgsql
 
 import (
+	"context"
 	"database/sql"
 	"time"
 
+	"github.com/guregu/null/zero"
+
 	"github.com/coreos/clair/database"
 	cerrors "github.com/coreos/clair/utils/errors"
 	"github.com/coreos/clair/utils/types"
 )
 
-func (pgSQL *pgSQL) insertFeature(feature database.Feature) (int, error) {
+func (pgSQL *pgSQL) insertFeature(ctx context.Context, feature database.Feature) (int, error) {
 	if feature.Name == "" {
 		return 0, cerrors.NewBadRequestError("could not find/insert invalid Feature")
 	}
 
 	// Do cache lookup.
-	if pgSQL.cache != nil {
-		promCacheQueriesTotal.WithLabelValues("feature").Inc()
-		id, found := pgSQL.cache.Get("feature:" + feature.Namespace.Name + ":" + feature.Name)
-		if found {
-			promCacheHitsTotal.WithLabelValues("feature").Inc()
-			return id.(int), nil
-		}
+	cacheIndex := featureCacheKey(feature.Namespace.Name, feature.Name)
+	if id, found := pgSQL.getCached("feature", cacheIndex); found {
+		return id, nil
 	}
 
 	// We do `defer observeQueryTime` here because we don't want to observe cached features.
 	defer observeQueryTime("insertFeature", "all", time.Now())
 
 	// Find or create Namespace.
-	namespaceID, err := pgSQL.insertNamespace(feature.Namespace)
+	namespaceID, err := pgSQL.insertNamespace(ctx, feature.Namespace)
 	if err != nil {
 		return 0, err
 	}
 
 	// Find or create Feature.
 	var id int
-	err = pgSQL.QueryRow(soiFeature, feature.Name, namespaceID).Scan(&id)
+	err = namedQueryRow(ctx, pgSQL, "soiFeature", soiFeature, feature.Name, namespaceID).Scan(&id)
 	if err != nil {
-		return 0, handleError("soiFeature", err)
+		return 0, handleError(ctx, "soiFeature", err)
 	}
 
-	if pgSQL.cache != nil {
-		pgSQL.cache.Add("feature:"+feature.Namespace.Name+":"+feature.Name, id)
-	}
+	pgSQL.addCached(cacheIndex, id)
 
 	return id, nil
 }
 
-func (pgSQL *pgSQL) insertFeatureVersion(featureVersion database.FeatureVersion) (id int, err error) {
+func (pgSQL *pgSQL) insertFeatureVersion(ctx context.Context, featureVersion database.FeatureVersion) (id int, err error) {
 	if featureVersion.Version.String() == "" {
 		return 0, cerrors.NewBadRequestError("could not find/insert invalid FeatureVersion")
 	}
 
 	// Do cache lookup.
-	cacheIndex := "featureversion:" + featureVersion.Feature.Namespace.Name + ":" + featureVersion.Feature.Name + ":" + featureVersion.Version.String()
-	if pgSQL.cache != nil {
-		promCacheQueriesTotal.WithLabelValues("featureversion").Inc()
-		id, found := pgSQL.cache.Get(cacheIndex)
-		if found {
-			promCacheHitsTotal.WithLabelValues("featureversion").Inc()
-			return id.(int), nil
-		}
+	cacheIndex := featureVersionCacheKey(featureVersion.Feature.Namespace.Name, featureVersion.Feature.Name, featureVersion.Version.String())
+	if id, found := pgSQL.getCached("featureversion", cacheIndex); found {
+		return id, nil
 	}
 
 	// We do `defer observeQueryTime` here because we don't want to observe cached featureversions.
@@ -82,7 +74,7 @@ func (pgSQL *pgSQL) insertFeatureVersion(featureVersion database.FeatureVersion)
 
 	// Find or create Feature first.
 	t := time.Now()
-	featureID, err := pgSQL.insertFeature(featureVersion.Feature)
+	featureID, err := pgSQL.insertFeature(ctx, featureVersion.Feature)
 	observeQueryTime("insertFeatureVersion", "insertFeature", t)
 
 	if err != nil {
@@ -95,24 +87,22 @@ func (pgSQL *pgSQL) insertFeatureVersion(featureVersion database.FeatureVersion)
 	//
 	// In a populated database, the likelihood of the FeatureVersion already being there is high.
 	// If we can find it here, we then avoid using a transaction and locking the database.
-	err = pgSQL.QueryRow(searchFeatureVersion, featureID, &featureVersion.Version).
+	err = namedQueryRow(ctx, pgSQL, "searchFeatureVersion", searchFeatureVersion, featureID, &featureVersion.Version).
 		Scan(&featureVersion.ID)
 	if err != nil && err != sql.ErrNoRows {
-		return 0, handleError("searchFeatureVersion", err)
+		return 0, handleError(ctx, "searchFeatureVersion", err)
 	}
 	if err == nil {
-		if pgSQL.cache != nil {
-			pgSQL.cache.Add(cacheIndex, featureVersion.ID)
-		}
+		pgSQL.addCached(cacheIndex, featureVersion.ID)
 
 		return featureVersion.ID, nil
 	}
 
 	// Begin transaction.
-	tx, err := pgSQL.Begin()
+	tx, err := pgSQL.BeginTx(ctx, nil)
 	if err != nil {
 		tx.Rollback()
-		return 0, handleError("insertFeatureVersion.Begin()", err)
+		return 0, handleError(ctx, "insertFeatureVersion.Begin()", err)
 	}
 
 	// Lock Vulnerability_Affects_FeatureVersion exclusively.
@@ -120,34 +110,32 @@ func (pgSQL *pgSQL) insertFeatureVersion(featureVersion database.FeatureVersion)
 	promConcurrentLockVAFV.Inc()
 	defer promConcurrentLockVAFV.Dec()
 	t = time.Now()
-	_, err = tx.Exec(lockVulnerabilityAffects)
+	_, err = namedExec(ctx, tx, "lockVulnerabilityAffects", lockVulnerabilityAffects)
 	observeQueryTime("insertFeatureVersion", "lock", t)
 
 	if err != nil {
 		tx.Rollback()
-		return 0, handleError("insertFeatureVersion.lockVulnerabilityAffects", err)
+		return 0, handleError(ctx, "insertFeatureVersion.lockVulnerabilityAffects", err)
 	}
 
 	// Find or create FeatureVersion.
 	var newOrExisting string
 
 	t = time.Now()
-	err = tx.QueryRow(soiFeatureVersion, featureID, &featureVersion.Version).
+	err = namedQueryRow(ctx, tx, "soiFeatureVersion", soiFeatureVersion, featureID, &featureVersion.Version).
 		Scan(&newOrExisting, &featureVersion.ID)
 	observeQueryTime("insertFeatureVersion", "soiFeatureVersion", t)
 
 	if err != nil {
 		tx.Rollback()
-		return 0, handleError("soiFeatureVersion", err)
+		return 0, handleError(ctx, "soiFeatureVersion", err)
 	}
 
 	if newOrExisting == "exi" {
 		// That featureVersion already exists, return its id.
 		tx.Commit()
 
-		if pgSQL.cache != nil {
-			pgSQL.cache.Add(cacheIndex, featureVersion.ID)
-		}
+		pgSQL.addCached(cacheIndex, featureVersion.ID)
 
 		return featureVersion.ID, nil
 	}
@@ -155,7 +143,7 @@ func (pgSQL *pgSQL) insertFeatureVersion(featureVersion database.FeatureVersion)
 	// Link the new FeatureVersion with every vulnerabilities that affect it, by inserting in
 	// Vulnerability_Affects_FeatureVersion.
 	t = time.Now()
-	err = linkFeatureVersionToVulnerabilities(tx, featureVersion)
+	err = linkFeatureVersionToVulnerabilities(ctx, tx, featureVersion)
 	observeQueryTime("insertFeatureVersion", "linkFeatureVersionToVulnerabilities", t)
 
 	if err != nil {
@@ -166,22 +154,20 @@ func (pgSQL *pgSQL) insertFeatureVersion(featureVersion database.FeatureVersion)
 	// Commit transaction.
 	err = tx.Commit()
 	if err != nil {
-		return 0, handleError("insertFeatureVersion.Commit()", err)
+		return 0, handleError(ctx, "insertFeatureVersion.Commit()", err)
 	}
 
-	if pgSQL.cache != nil {
-		pgSQL.cache.Add(cacheIndex, featureVersion.ID)
-	}
+	pgSQL.addCached(cacheIndex, featureVersion.ID)
 
 	return featureVersion.ID, nil
 }
 
 // TODO(Quentin-M): Batch me
-func (pgSQL *pgSQL) insertFeatureVersions(featureVersions []database.FeatureVersion) ([]int, error) {
+func (pgSQL *pgSQL) insertFeatureVersions(ctx context.Context, featureVersions []database.FeatureVersion) ([]int, error) {
 	IDs := make([]int, 0, len(featureVersions))
 
 	for i := 0; i < len(featureVersions); i++ {
-		id, err := pgSQL.insertFeatureVersion(featureVersions[i])
+		id, err := pgSQL.insertFeatureVersion(ctx, featureVersions[i])
 		if err != nil {
 			return IDs, err
 		}
@@ -195,14 +181,15 @@ type vulnerabilityAffectsFeatureVersion struct {
 	vulnerabilityID int
 	fixedInID       int
 	fixedInVersion  types.Version
+	versionFormat   zero.String
 }
 
-func linkFeatureVersionToVulnerabilities(tx *sql.Tx, featureVersion database.FeatureVersion) error {
+func linkFeatureVersionToVulnerabilities(ctx context.Context, tx *sql.Tx, featureVersion database.FeatureVersion) error {
 	// Select every vulnerability and the fixed version that affect this Feature.
 	// TODO(Quentin-M): LIMIT
-	rows, err := tx.Query(searchVulnerabilityFixedInFeature, featureVersion.Feature.ID)
+	rows, err := namedQuery(ctx, tx, "searchVulnerabilityFixedInFeature", searchVulnerabilityFixedInFeature, featureVersion.Feature.ID)
 	if err != nil {
-		return handleError("searchVulnerabilityFixedInFeature", err)
+		return handleError(ctx, "searchVulnerabilityFixedInFeature", err)
 	}
 	defer rows.Close()
 
@@ -210,29 +197,29 @@ func linkFeatureVersionToVulnerabilities(tx *sql.Tx, featureVersion database.Fea
 	for rows.Next() {
 		var affect vulnerabilityAffectsFeatureVersion
 
-		err := rows.Scan(&affect.fixedInID, &affect.vulnerabilityID, &affect.fixedInVersion)
+		err := rows.Scan(&affect.fixedInID, &affect.vulnerabilityID, &affect.fixedInVersion, &affect.versionFormat)
 		if err != nil {
-			return handleError("searchVulnerabilityFixedInFeature.Scan()", err)
+			return handleError(ctx, "searchVulnerabilityFixedInFeature.Scan()", err)
 		}
 
-		if featureVersion.Version.Compare(affect.fixedInVersion) < 0 {
+		if featureVersion.Version.CompareFormat(affect.fixedInVersion, types.VersionFormat(affect.versionFormat.String)) < 0 {
 			// The version of the FeatureVersion we are inserting is lower than the fixed version on this
 			// Vulnerability, thus, this FeatureVersion is affected by it.
 			affects = append(affects, affect)
 		}
 	}
 	if err = rows.Err(); err != nil {
-		return handleError("searchVulnerabilityFixedInFeature.Rows()", err)
+		return handleError(ctx, "searchVulnerabilityFixedInFeature.Rows()", err)
 	}
 	rows.Close()
 
 	// Insert into Vulnerability_Affects_FeatureVersion.
 	for _, affect := range affects {
 		// TODO(Quentin-M): Batch me.
-		_, err := tx.Exec(insertVulnerabilityAffectsFeatureVersion, affect.vulnerabilityID,
+		_, err := namedExec(ctx, tx, "insertVulnerabilityAffectsFeatureVersion", insertVulnerabilityAffectsFeatureVersion, affect.vulnerabilityID,
 			featureVersion.ID, affect.fixedInID)
 		if err != nil {
-			return handleError("insertVulnerabilityAffectsFeatureVersion", err)
+			return handleError(ctx, "insertVulnerabilityAffectsFeatureVersion", err)
 		}
 	}
 
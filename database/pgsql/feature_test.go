@@ -15,6 +15,7 @@
 package pgsql
 
 import (
+	"context"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -32,11 +33,11 @@ func TestInsertFeature(t *testing.T) {
 	defer datastore.Close()
 
 	// Invalid Feature.
-	id0, err := datastore.insertFeature(database.Feature{})
+	id0, err := datastore.insertFeature(context.Background(), database.Feature{})
 	assert.NotNil(t, err)
 	assert.Zero(t, id0)
 
-	id0, err = datastore.insertFeature(database.Feature{
+	id0, err = datastore.insertFeature(context.Background(), database.Feature{
 		Namespace: database.Namespace{},
 		Name:      "TestInsertFeature0",
 	})
@@ -48,9 +49,9 @@ func TestInsertFeature(t *testing.T) {
 		Namespace: database.Namespace{Name: "TestInsertFeatureNamespace1"},
 		Name:      "TestInsertFeature1",
 	}
-	id1, err := datastore.insertFeature(feature)
+	id1, err := datastore.insertFeature(context.Background(), feature)
 	assert.Nil(t, err)
-	id2, err := datastore.insertFeature(feature)
+	id2, err := datastore.insertFeature(context.Background(), feature)
 	assert.Nil(t, err)
 	assert.Equal(t, id1, id2)
 
@@ -82,7 +83,7 @@ func TestInsertFeature(t *testing.T) {
 			Version: types.NewVersionUnsafe("bad version"),
 		},
 	} {
-		id3, err := datastore.insertFeatureVersion(invalidFeatureVersion)
+		id3, err := datastore.insertFeatureVersion(context.Background(), invalidFeatureVersion)
 		assert.Error(t, err)
 		assert.Zero(t, id3)
 	}
@@ -95,9 +96,9 @@ func TestInsertFeature(t *testing.T) {
 		},
 		Version: types.NewVersionUnsafe("2:3.0-imba"),
 	}
-	id4, err := datastore.insertFeatureVersion(featureVersion)
+	id4, err := datastore.insertFeatureVersion(context.Background(), featureVersion)
 	assert.Nil(t, err)
-	id5, err := datastore.insertFeatureVersion(featureVersion)
+	id5, err := datastore.insertFeatureVersion(context.Background(), featureVersion)
 	assert.Nil(t, err)
 	assert.Equal(t, id4, id5)
 }
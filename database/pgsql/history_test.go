@@ -0,0 +1,132 @@
+// Copyright 2015 clair authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pgsql
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/coreos/clair/database"
+	"github.com/coreos/clair/utils/types"
+)
+
+func TestVulnerabilityHistory(t *testing.T) {
+	datastore, err := openDatabaseForTest("VulnerabilityHistory", false)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer datastore.Close()
+	ctx := database.ContextWithSource(context.Background(), "test")
+
+	n := database.Namespace{Name: "debian:8"}
+	openssl := database.Feature{Name: "openssl", Namespace: n}
+	v := database.Vulnerability{
+		Name:      "CVE-2014-0160",
+		Namespace: n,
+		Severity:  types.Medium,
+		FixedIn: []database.FeatureVersion{
+			{Feature: openssl, Version: types.NewVersionUnsafe("1.0.1f-1+deb8u1")},
+		},
+	}
+
+	// Inserting a new vulnerability doesn't create history.
+	assert.Nil(t, datastore.InsertVulnerabilities(ctx, []database.Vulnerability{v}, false))
+	history, err := datastore.GetVulnerabilityHistory(ctx, n.Name, v.Name)
+	if assert.Nil(t, err) {
+		assert.Len(t, history, 0)
+	}
+
+	// Severity-only change.
+	v.Severity = types.High
+	assert.Nil(t, datastore.InsertVulnerabilities(ctx, []database.Vulnerability{v}, false))
+	history, err = datastore.GetVulnerabilityHistory(ctx, n.Name, v.Name)
+	if assert.Nil(t, err) && assert.Len(t, history, 1) {
+		assert.Equal(t, "test", history[0].Source)
+		assert.Equal(t, types.Medium, history[0].OldSeverity)
+		assert.Equal(t, types.High, history[0].NewSeverity)
+		assert.Equal(t, "", history[0].FeatureName)
+		assert.False(t, history[0].Created.IsZero())
+	}
+
+	// FixedBy change.
+	v.FixedIn = []database.FeatureVersion{
+		{Feature: openssl, Version: types.NewVersionUnsafe("1.0.1f-1+deb8u2")},
+	}
+	assert.Nil(t, datastore.InsertVulnerabilities(ctx, []database.Vulnerability{v}, false))
+	history, err = datastore.GetVulnerabilityHistory(ctx, n.Name, v.Name)
+	if assert.Nil(t, err) && assert.Len(t, history, 2) {
+		assert.Equal(t, types.High, history[0].OldSeverity)
+		assert.Equal(t, types.High, history[0].NewSeverity)
+		assert.Equal(t, "openssl", history[0].FeatureName)
+		assert.Equal(t, "1.0.1f-1+deb8u1", history[0].OldFixedBy)
+		assert.Equal(t, "1.0.1f-1+deb8u2", history[0].NewFixedBy)
+	}
+
+	// No-op reinsert.
+	assert.Nil(t, datastore.InsertVulnerabilities(ctx, []database.Vulnerability{v}, false))
+	history, err = datastore.GetVulnerabilityHistory(ctx, n.Name, v.Name)
+	if assert.Nil(t, err) {
+		assert.Len(t, history, 2)
+	}
+
+	// The oldest entries are pruned.
+	for i := 0; i < maxVulnerabilityHistoryEntries; i++ {
+		if v.Severity == types.High {
+			v.Severity = types.Low
+		} else {
+			v.Severity = types.High
+		}
+		assert.Nil(t, datastore.InsertVulnerabilities(ctx, []database.Vulnerability{v}, false))
+	}
+	history, err = datastore.GetVulnerabilityHistory(ctx, n.Name, v.Name)
+	if assert.Nil(t, err) && assert.Len(t, history, maxVulnerabilityHistoryEntries) {
+		assert.Equal(t, "", history[len(history)-1].FeatureName)
+	}
+}
+
+func TestDiffVulnerability(t *testing.T) {
+	fixedIn := func(name, version string) database.FeatureVersion {
+		return database.FeatureVersion{
+			Feature: database.Feature{Name: name},
+			Version: types.NewVersionUnsafe(version),
+		}
+	}
+
+	existing := database.Vulnerability{
+		Severity: types.Low,
+		FixedIn:  []database.FeatureVersion{fixedIn("a", "1.0"), fixedIn("b", "2.0")},
+	}
+
+	// No change.
+	assert.Len(t, diffVulnerability(existing, existing), 0)
+
+	// Severity only.
+	updated := existing
+	updated.Severity = types.High
+	assert.Equal(t, []database.VulnerabilityHistoryEntry{
+		{OldSeverity: types.Low, NewSeverity: types.High},
+	}, diffVulnerability(existing, updated))
+
+	// A fixed version is updated, one is removed and one is added.
+	updated.FixedIn = []database.FeatureVersion{fixedIn("a", "1.1"), fixedIn("c", "3.0")}
+	assert.Equal(t, []database.VulnerabilityHistoryEntry{
+		{OldSeverity: types.Low, NewSeverity: types.High, FeatureName: "a", OldFixedBy: "1.0", NewFixedBy: "1.1"},
+		{OldSeverity: types.Low, NewSeverity: types.High, FeatureName: "b", OldFixedBy: "2.0"},
+		{OldSeverity: types.Low, NewSeverity: types.High, FeatureName: "c", NewFixedBy: "3.0"},
+	}, diffVulnerability(existing, updated))
+}
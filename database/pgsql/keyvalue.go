@@ -15,6 +15,7 @@
 package pgsql
 
 import (
+	"context"
 	"database/sql"
 	"time"
 
@@ -22,10 +23,10 @@ import (
 )
 
 // InsertKeyValue stores (or updates) a single key / value tuple.
-func (pgSQL *pgSQL) InsertKeyValue(key, value string) (err error) {
-	if key == "" || value == "" {
-		log.Warning("could not insert a flag which has an empty name or value")
-		return cerrors.NewBadRequestError("could not insert a flag which has an empty name or value")
+func (pgSQL *pgSQL) InsertKeyValue(ctx context.Context, key, value string) (err error) {
+	if key == "" {
+		log.Warning("could not insert a flag which has an empty name")
+		return cerrors.NewBadRequestError("could not insert a flag which has an empty name")
 	}
 
 	defer observeQueryTime("InsertKeyValue", "all", time.Now())
@@ -38,12 +39,11 @@ func (pgSQL *pgSQL) InsertKeyValue(key, value string) (err error) {
 	//       moment so we can just use a client-side solution with transactions, based on
 	//       http://postgresql.org/docs/current/static/plpgsql-control-structures.html.
 	// TODO(Quentin-M): Enable Upsert as soon as 9.5 is stable.
-
-	for {
+	err = pgSQL.withTransaction(ctx, "InsertKeyValue", func(tx *sql.Tx) error {
 		// First, try to update.
-		r, err := pgSQL.Exec(updateKeyValue, value, key)
+		r, err := namedExec(ctx, tx, "updateKeyValue", updateKeyValue, value, key)
 		if err != nil {
-			return handleError("updateKeyValue", err)
+			return err
 		}
 		if n, _ := r.RowsAffected(); n > 0 {
 			// Updated successfully.
@@ -51,33 +51,63 @@ func (pgSQL *pgSQL) InsertKeyValue(key, value string) (err error) {
 		}
 
 		// Try to insert the key.
-		// If someone else inserts the same key concurrently, we could get a unique-key violation error.
-		_, err = pgSQL.Exec(insertKeyValue, key, value)
-		if err != nil {
-			if isErrUniqueViolation(err) {
-				// Got unique constraint violation, retry.
-				continue
-			}
-			return handleError("insertKeyValue", err)
+		// If someone else inserts the same key concurrently, we could get a unique-key violation
+		// error, in which case we retry and update the key instead.
+		_, err = namedExec(ctx, tx, "insertKeyValue", insertKeyValue, key, value)
+		if isErrUniqueViolation(err) {
+			return errRetryTransaction
 		}
+		return err
+	})
 
-		return nil
-	}
+	return handleError(ctx, "InsertKeyValue", err)
 }
 
-// GetValue reads a single key / value tuple and returns an empty string if the key doesn't exist.
-func (pgSQL *pgSQL) GetKeyValue(key string) (string, error) {
+// GetKeyValue reads a single key / value tuple and returns cerrors.ErrNotFound if the key doesn't
+// exist.
+func (pgSQL *pgSQL) GetKeyValue(ctx context.Context, key string) (string, error) {
 	defer observeQueryTime("GetKeyValue", "all", time.Now())
 
 	var value string
-	err := pgSQL.QueryRow(searchKeyValue, key).Scan(&value)
+	err := namedQueryRow(ctx, pgSQL.readonly(ctx), "searchKeyValue", searchKeyValue, key).Scan(&value)
 
-	if err == sql.ErrNoRows {
-		return "", nil
-	}
 	if err != nil {
-		return "", handleError("searchKeyValue", err)
+		return "", handleError(ctx, "searchKeyValue", err)
 	}
 
 	return value, nil
 }
+
+// CompareAndSwapKeyValue sets the value of the given key to new only if its current value is old.
+//
+// Both the update and the insert are single statements, so a concurrent writer can only make them
+// match nothing, or fail on the unique constraint; the swap is then reported as unsuccessful
+// rather than retried, leaving it up to the caller to read the new value and try again.
+func (pgSQL *pgSQL) CompareAndSwapKeyValue(ctx context.Context, key, old, new string) (bool, error) {
+	if key == "" {
+		log.Warning("could not swap a flag which has an empty name")
+		return false, cerrors.NewBadRequestError("could not swap a flag which has an empty name")
+	}
+
+	defer observeQueryTime("CompareAndSwapKeyValue", "all", time.Now())
+
+	r, err := namedExec(ctx, pgSQL, "swapKeyValue", swapKeyValue, key, old, new)
+	if err != nil {
+		return false, handleError(ctx, "swapKeyValue", err)
+	}
+	if n, _ := r.RowsAffected(); n > 0 || old != "" {
+		return n > 0, nil
+	}
+
+	// The key may not exist yet, which the empty old value matches as well.
+	_, err = namedExec(ctx, pgSQL, "insertKeyValue", insertKeyValue, key, new)
+	if isErrUniqueViolation(err) {
+		// Someone else created the key in the meantime.
+		return false, nil
+	}
+	if err != nil {
+		return false, handleError(ctx, "insertKeyValue", err)
+	}
+
+	return true, nil
+}
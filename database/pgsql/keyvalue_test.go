@@ -15,9 +15,12 @@
 package pgsql
 
 import (
+	"context"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+
+	cerrors "github.com/coreos/clair/utils/errors"
 )
 
 func TestKeyValue(t *testing.T) {
@@ -29,24 +32,28 @@ func TestKeyValue(t *testing.T) {
 	defer datastore.Close()
 
 	// Get non-existing key/value
-	f, err := datastore.GetKeyValue("test")
-	assert.Nil(t, err)
-	assert.Empty(t, "", f)
+	_, err = datastore.GetKeyValue(context.Background(), "test")
+	assert.Equal(t, cerrors.ErrNotFound, err)
 
 	// Try to insert invalid key/value.
-	assert.Error(t, datastore.InsertKeyValue("test", ""))
-	assert.Error(t, datastore.InsertKeyValue("", "test"))
-	assert.Error(t, datastore.InsertKeyValue("", ""))
+	assert.Error(t, datastore.InsertKeyValue(context.Background(), "", "test"))
+	assert.Error(t, datastore.InsertKeyValue(context.Background(), "", ""))
+
+	// Insert an empty value and verify.
+	assert.Nil(t, datastore.InsertKeyValue(context.Background(), "test", ""))
+	f, err := datastore.GetKeyValue(context.Background(), "test")
+	assert.Nil(t, err)
+	assert.Equal(t, "", f)
 
 	// Insert and verify.
-	assert.Nil(t, datastore.InsertKeyValue("test", "test1"))
-	f, err = datastore.GetKeyValue("test")
+	assert.Nil(t, datastore.InsertKeyValue(context.Background(), "test", "test1"))
+	f, err = datastore.GetKeyValue(context.Background(), "test")
 	assert.Nil(t, err)
 	assert.Equal(t, "test1", f)
 
 	// Update and verify.
-	assert.Nil(t, datastore.InsertKeyValue("test", "test2"))
-	f, err = datastore.GetKeyValue("test")
+	assert.Nil(t, datastore.InsertKeyValue(context.Background(), "test", "test2"))
+	f, err = datastore.GetKeyValue(context.Background(), "test")
 	assert.Nil(t, err)
 	assert.Equal(t, "test2", f)
 }
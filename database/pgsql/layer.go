@@ -15,16 +15,22 @@
 package pgsql
 
 import (
+	"context"
 	"database/sql"
 	"time"
 
 	"github.com/coreos/clair/database"
 	"github.com/coreos/clair/utils"
 	cerrors "github.com/coreos/clair/utils/errors"
+	"github.com/coreos/clair/utils/types"
 	"github.com/guregu/null/zero"
 )
 
-func (pgSQL *pgSQL) FindLayer(name string, withFeatures, withVulnerabilities bool) (database.Layer, error) {
+func (pgSQL *pgSQL) FindLayer(ctx context.Context, name string, withFeatures, withVulnerabilities bool, minSeverity types.Priority) (database.Layer, error) {
+	return findLayer(ctx, pgSQL.readonly(ctx), name, withFeatures, withVulnerabilities, minSeverity, pgSQL.config.MaxLayerTreeDepth)
+}
+
+func findLayer(ctx context.Context, db *sql.DB, name string, withFeatures, withVulnerabilities bool, minSeverity types.Priority, maxDepth int) (database.Layer, error) {
 	subquery := "all"
 	if withFeatures {
 		subquery += "/features"
@@ -39,14 +45,17 @@ func (pgSQL *pgSQL) FindLayer(name string, withFeatures, withVulnerabilities boo
 	var parentName zero.String
 	var namespaceID zero.Int
 	var namespaceName sql.NullString
+	var namespaceVersionFormat zero.String
+	var path, format zero.String
 
 	t := time.Now()
-	err := pgSQL.QueryRow(searchLayer, name).Scan(&layer.ID, &layer.Name, &layer.EngineVersion, &parentID, &parentName, &namespaceID, &namespaceName)
+	err := namedQueryRow(ctx, db, "searchLayer", searchLayer, name).Scan(&layer.ID, &layer.Name, &layer.EngineVersion, &parentID, &parentName, &namespaceID, &namespaceName, &namespaceVersionFormat, &path, &format, &layer.Stale)
 	observeQueryTime("FindLayer", "searchLayer", t)
 
 	if err != nil {
-		return layer, handleError("searchLayer", err)
+		return layer, handleError(ctx, "searchLayer", err)
 	}
+	layer.Path, layer.Format = path.String, format.String
 
 	if !parentID.IsZero() {
 		layer.Parent = &database.Layer{
@@ -56,13 +65,42 @@ func (pgSQL *pgSQL) FindLayer(name string, withFeatures, withVulnerabilities boo
 	}
 	if !namespaceID.IsZero() {
 		layer.Namespace = &database.Namespace{
-			Model: database.Model{ID: int(namespaceID.Int64)},
-			Name:  namespaceName.String,
+			Model:         database.Model{ID: int(namespaceID.Int64)},
+			Name:          namespaceName.String,
+			VersionFormat: types.VersionFormat(namespaceVersionFormat.String),
 		}
 	}
 
+	// Find the detectors that processed it.
+	t = time.Now()
+	layer.ProcessedBy, err = findLayerDetectors(ctx, db, layer.ID)
+	observeQueryTime("FindLayer", "searchLayerDetector", t)
+
+	if err != nil {
+		return layer, err
+	}
+
+	// Find its namespaces.
+	t = time.Now()
+	namespaces, err := findLayerNamespaces(ctx, db, layer.ID)
+	observeQueryTime("FindLayer", "searchLayerNamespace", t)
+
+	if err != nil {
+		return layer, err
+	}
+	layer.Namespaces = namespaces
+	layer.Namespaces = layer.ListNamespaces()
+
 	// Find its features
 	if withFeatures || withVulnerabilities {
+		t = time.Now()
+		layer.Depth, err = findLayerDepth(ctx, db, layer.ID, layer.Name, maxDepth)
+		observeQueryTime("FindLayer", "searchLayerAncestry", t)
+
+		if err != nil {
+			return layer, err
+		}
+
 		// Create a transaction to disable hash/merge joins as our experiments have shown that
 		// PostgreSQL 9.4 makes bad planning decisions about:
 		// - joining the layer tree to feature versions and feature
@@ -70,23 +108,23 @@ func (pgSQL *pgSQL) FindLayer(name string, withFeatures, withVulnerabilities boo
 		// It would for instance do a merge join between affected feature versions (300 rows, estimated
 		// 3000 rows) and fixed in feature version (100k rows). In this case, it is much more
 		// preferred to use a nested loop.
-		tx, err := pgSQL.Begin()
+		tx, err := db.BeginTx(ctx, nil)
 		if err != nil {
-			return layer, handleError("FindLayer.Begin()", err)
+			return layer, handleError(ctx, "FindLayer.Begin()", err)
 		}
 		defer tx.Commit()
 
-		_, err = tx.Exec(disableHashJoin)
+		_, err = namedExec(ctx, tx, "disableHashJoin", disableHashJoin)
 		if err != nil {
 			log.Warningf("FindLayer: could not disable hash join: %s", err)
 		}
-		_, err = tx.Exec(disableMergeJoin)
+		_, err = namedExec(ctx, tx, "disableMergeJoin", disableMergeJoin)
 		if err != nil {
 			log.Warningf("FindLayer: could not disable merge join: %s", err)
 		}
 
 		t = time.Now()
-		featureVersions, err := getLayerFeatureVersions(tx, layer.ID)
+		featureVersions, err := getLayerFeatureVersions(ctx, tx, layer.ID, maxDepth)
 		observeQueryTime("FindLayer", "getLayerFeatureVersions", t)
 
 		if err != nil {
@@ -98,7 +136,7 @@ func (pgSQL *pgSQL) FindLayer(name string, withFeatures, withVulnerabilities boo
 		if withVulnerabilities {
 			// Load the vulnerabilities that affect the FeatureVersions.
 			t = time.Now()
-			err := loadAffectedBy(tx, layer.Features)
+			err := loadAffectedBy(ctx, tx, layer.Features, minSeverity)
 			observeQueryTime("FindLayer", "loadAffectedBy", t)
 
 			if err != nil {
@@ -110,20 +148,147 @@ func (pgSQL *pgSQL) FindLayer(name string, withFeatures, withVulnerabilities boo
 	return layer, nil
 }
 
+// findLayerDetectors returns the names of the detectors that processed the specified layer.
+func findLayerDetectors(ctx context.Context, queryer Queryer, layerID int) ([]string, error) {
+	rows, err := namedQuery(ctx, queryer, "searchLayerDetector", searchLayerDetector, layerID)
+	if err != nil {
+		return nil, handleError(ctx, "searchLayerDetector", err)
+	}
+	defer rows.Close()
+
+	var detectors []string
+	for rows.Next() {
+		var detector string
+		if err = rows.Scan(&detector); err != nil {
+			return nil, handleError(ctx, "searchLayerDetector.Scan()", err)
+		}
+		detectors = append(detectors, detector)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, handleError(ctx, "searchLayerDetector.Rows()", err)
+	}
+
+	return detectors, nil
+}
+
+// findLayerNamespaces returns the namespaces of the specified layer, in the order they were
+// inserted.
+func findLayerNamespaces(ctx context.Context, queryer Queryer, layerID int) ([]database.Namespace, error) {
+	rows, err := namedQuery(ctx, queryer, "searchLayerNamespace", searchLayerNamespace, layerID)
+	if err != nil {
+		return nil, handleError(ctx, "searchLayerNamespace", err)
+	}
+	defer rows.Close()
+
+	var namespaces []database.Namespace
+	for rows.Next() {
+		var namespace database.Namespace
+		var versionFormat zero.String
+		if err = rows.Scan(&namespace.ID, &namespace.Name, &versionFormat); err != nil {
+			return nil, handleError(ctx, "searchLayerNamespace.Scan()", err)
+		}
+		namespace.VersionFormat = types.VersionFormat(versionFormat.String)
+		namespaces = append(namespaces, namespace)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, handleError(ctx, "searchLayerNamespace.Rows()", err)
+	}
+
+	return namespaces, nil
+}
+
 // getLayerFeatureVersions returns list of database.FeatureVersion that a database.Layer has.
-func getLayerFeatureVersions(tx *sql.Tx, layerID int) ([]database.FeatureVersion, error) {
+func getLayerFeatureVersions(ctx context.Context, tx *sql.Tx, layerID, maxDepth int) ([]database.FeatureVersion, error) {
+	// Do transitive closure. The rows are ordered from the base layer, so a FeatureVersion
+	// that is removed and added again is attributed to the layer that added it last.
+	mapFeatureVersions := make(map[int]database.FeatureVersion)
+	err := scanLayerFeatureVersions(ctx, tx, layerID, maxDepth, func(modification string, featureVersion database.FeatureVersion) {
+		if modification == "add" {
+			mapFeatureVersions[featureVersion.ID] = featureVersion
+		} else {
+			delete(mapFeatureVersions, featureVersion.ID)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Build result by converting our map to a slice.
 	var featureVersions []database.FeatureVersion
+	for _, featureVersion := range mapFeatureVersions {
+		featureVersions = append(featureVersions, featureVersion)
+	}
+
+	return featureVersions, nil
+}
+
+// GetLayerDiff returns the FeatureVersions that the specified layer adds and removes, as stored,
+// without computing the transitive closure over its parents.
+func (pgSQL *pgSQL) GetLayerDiff(ctx context.Context, name string) (added, removed []database.FeatureVersion, err error) {
+	defer observeQueryTime("GetLayerDiff", "all", time.Now())
+
+	db := pgSQL.readonly(ctx)
+	layer, err := findLayer(ctx, db, name, false, false, types.Unknown, pgSQL.config.MaxLayerTreeDepth)
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, err = findLayerDepth(ctx, db, layer.ID, layer.Name, pgSQL.config.MaxLayerTreeDepth); err != nil {
+		return nil, nil, err
+	}
+
+	err = scanLayerFeatureVersions(ctx, db, layer.ID, pgSQL.config.MaxLayerTreeDepth, func(modification string, featureVersion database.FeatureVersion) {
+		// The rows of the parents are only needed by the transitive closure.
+		if featureVersion.AddedBy.ID != layer.ID {
+			return
+		}
+
+		if modification == "add" {
+			added = append(added, featureVersion)
+		} else {
+			featureVersion.AddedBy = database.Layer{}
+			removed = append(removed, featureVersion)
+		}
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return added, removed, nil
+}
+
+// findLayerDepth returns the number of layers in the ancestry of the specified layer, the layer
+// itself included. It returns ErrLayerTreeTooDeep beyond maxDepth layers, and ErrInconsistent if
+// the ancestry contains a cycle.
+func findLayerDepth(ctx context.Context, queryer Queryer, layerID int, name string, maxDepth int) (int, error) {
+	var depth int
+	var cycle bool
+	err := namedQueryRow(ctx, queryer, "searchLayerAncestry", searchLayerAncestry, layerID, maxDepth).Scan(&depth, &cycle)
+	if err != nil {
+		return 0, handleError(ctx, "searchLayerAncestry", err)
+	}
 
-	// Query.
-	rows, err := tx.Query(searchLayerFeatureVersion, layerID)
+	if cycle {
+		log.Warningf("the ancestry of layer %s contains a cycle", name)
+		return 0, database.ErrInconsistent
+	}
+	if depth > maxDepth {
+		return 0, &database.ErrLayerTreeTooDeep{Layer: name, MaxDepth: maxDepth}
+	}
+
+	return depth, nil
+}
+
+// scanLayerFeatureVersions calls fn with every "add" or "del" row of the specified layer and its
+// parents, ordered from the base layer, up to maxDepth layers. The AddedBy field of the given
+// FeatureVersions is the layer that the row belongs to.
+func scanLayerFeatureVersions(ctx context.Context, queryer Queryer, layerID, maxDepth int, fn func(modification string, featureVersion database.FeatureVersion)) error {
+	rows, err := namedQuery(ctx, queryer, "searchLayerFeatureVersion", searchLayerFeatureVersion, layerID, maxDepth)
 	if err != nil {
-		return featureVersions, handleError("searchLayerFeatureVersion", err)
+		return handleError(ctx, "searchLayerFeatureVersion", err)
 	}
 	defer rows.Close()
 
-	// Scan query.
 	var modification string
-	mapFeatureVersions := make(map[int]database.FeatureVersion)
 	for rows.Next() {
 		var featureVersion database.FeatureVersion
 
@@ -132,35 +297,26 @@ func getLayerFeatureVersions(tx *sql.Tx, layerID int) ([]database.FeatureVersion
 			&featureVersion.Feature.Name, &featureVersion.ID, &featureVersion.Version,
 			&featureVersion.AddedBy.ID, &featureVersion.AddedBy.Name)
 		if err != nil {
-			return featureVersions, handleError("searchLayerFeatureVersion.Scan()", err)
+			return handleError(ctx, "searchLayerFeatureVersion.Scan()", err)
 		}
 
-		// Do transitive closure.
-		switch modification {
-		case "add":
-			mapFeatureVersions[featureVersion.ID] = featureVersion
-		case "del":
-			delete(mapFeatureVersions, featureVersion.ID)
-		default:
+		if modification != "add" && modification != "del" {
 			log.Warningf("unknown Layer_diff_FeatureVersion's modification: %s", modification)
-			return featureVersions, database.ErrInconsistent
+			return database.ErrInconsistent
 		}
+
+		fn(modification, featureVersion)
 	}
 	if err = rows.Err(); err != nil {
-		return featureVersions, handleError("searchLayerFeatureVersion.Rows()", err)
+		return handleError(ctx, "searchLayerFeatureVersion.Rows()", err)
 	}
 
-	// Build result by converting our map to a slice.
-	for _, featureVersion := range mapFeatureVersions {
-		featureVersions = append(featureVersions, featureVersion)
-	}
-
-	return featureVersions, nil
+	return nil
 }
 
 // loadAffectedBy returns the list of database.Vulnerability that affect the given
 // FeatureVersion.
-func loadAffectedBy(tx *sql.Tx, featureVersions []database.FeatureVersion) error {
+func loadAffectedBy(ctx context.Context, tx *sql.Tx, featureVersions []database.FeatureVersion, minSeverity types.Priority) error {
 	if len(featureVersions) == 0 {
 		return nil
 	}
@@ -171,10 +327,10 @@ func loadAffectedBy(tx *sql.Tx, featureVersions []database.FeatureVersion) error
 		featureVersionIDs = append(featureVersionIDs, featureVersions[i].ID)
 	}
 
-	rows, err := tx.Query(searchFeatureVersionVulnerability,
-		buildInputArray(featureVersionIDs))
+	rows, err := namedQuery(ctx, tx, "searchFeatureVersionVulnerability", searchFeatureVersionVulnerability,
+		intArray(featureVersionIDs), minSeverity)
 	if err != nil && err != sql.ErrNoRows {
-		return handleError("searchFeatureVersionVulnerability", err)
+		return handleError(ctx, "searchFeatureVersionVulnerability", err)
 	}
 	defer rows.Close()
 
@@ -183,15 +339,15 @@ func loadAffectedBy(tx *sql.Tx, featureVersions []database.FeatureVersion) error
 	for rows.Next() {
 		var vulnerability database.Vulnerability
 		err := rows.Scan(&featureversionID, &vulnerability.ID, &vulnerability.Name,
-			&vulnerability.Description, &vulnerability.Link, &vulnerability.Severity,
-			&vulnerability.Metadata, &vulnerability.Namespace.Name, &vulnerability.FixedBy)
+			&vulnerability.Description, &vulnerability.Link, (*linkList)(&vulnerability.Links),
+			&vulnerability.Severity, &vulnerability.Metadata, &vulnerability.Namespace.Name, &vulnerability.FixedBy)
 		if err != nil {
-			return handleError("searchFeatureVersionVulnerability.Scan()", err)
+			return handleError(ctx, "searchFeatureVersionVulnerability.Scan()", err)
 		}
 		vulnerabilities[featureversionID] = append(vulnerabilities[featureversionID], vulnerability)
 	}
 	if err = rows.Err(); err != nil {
-		return handleError("searchFeatureVersionVulnerability.Rows()", err)
+		return handleError(ctx, "searchFeatureVersionVulnerability.Rows()", err)
 	}
 
 	// Assign vulnerabilities to every FeatureVersions
@@ -209,112 +365,256 @@ func loadAffectedBy(tx *sql.Tx, featureVersions []database.FeatureVersion) error
 // (happens when Feature detectors relies on the detected layer Namespace). However, if the listed
 // Feature has the same Name/Version as its parent, InsertLayer considers that the Feature hasn't
 // been modified.
-func (pgSQL *pgSQL) InsertLayer(layer database.Layer) error {
+func (pgSQL *pgSQL) InsertLayer(ctx context.Context, layer database.Layer) error {
 	tf := time.Now()
 
-	// Verify parameters
-	if layer.Name == "" {
-		log.Warning("could not insert a layer which has an empty Name")
-		return cerrors.NewBadRequestError("could not insert a layer which has an empty Name")
+	existingLayer, parentID, namespaceID, ok, err := pgSQL.prepareLayer(ctx, &layer)
+	if err != nil || !ok {
+		return err
 	}
 
-	// Get a potentially existing layer.
-	existingLayer, err := pgSQL.FindLayer(layer.Name, true, false)
-	if err != nil && err != cerrors.ErrNotFound {
-		return err
-	} else if err == nil {
-		if existingLayer.EngineVersion >= layer.EngineVersion {
-			// The layer exists and has an equal or higher engine version, do nothing.
-			return nil
+	// We do `defer observeQueryTime` here because we don't want to observe existing layers.
+	defer observeQueryTime("InsertLayer", "all", tf)
+
+	err = pgSQL.withTransaction(ctx, "InsertLayer", func(tx *sql.Tx) error {
+		// Work on a copy, so every attempt starts from the prepared layer.
+		l := layer
+		return pgSQL.insertLayer(ctx, tx, &l, &existingLayer, parentID, namespaceID)
+	})
+	if isErrUniqueViolation(err) {
+		// Ignore this error, another process collided.
+		log.Debug("Attempted to insert duplicate layer.")
+		return nil
+	}
+
+	return handleError(ctx, "InsertLayer", err)
+}
+
+// InsertLayers inserts the layers of an image at once, in a single transaction. The layers have
+// to be ordered from the base layer to the top one, and each layer but the first must have the
+// previous one as Parent, the Features of which are used for diffing. Only the first layer's
+// Parent must have been retrieved from the database, if it has one.
+func (pgSQL *pgSQL) InsertLayers(ctx context.Context, layers []database.Layer) error {
+	// Verify that the layers form a chain.
+	names := make(map[string]struct{}, len(layers))
+	for i, layer := range layers {
+		if _, dup := names[layer.Name]; dup {
+			return cerrors.NewBadRequestError("could not insert layers: " + layer.Name + " is present twice")
 		}
+		names[layer.Name] = struct{}{}
 
-		layer.ID = existingLayer.ID
+		if i > 0 && (layer.Parent == nil || layer.Parent.Name != layers[i-1].Name) {
+			return cerrors.NewBadRequestError("could not insert layers: the parent of " + layer.Name + " is not " + layers[i-1].Name)
+		}
 	}
 
-	// We do `defer observeQueryTime` here because we don't want to observe existing layers.
-	defer observeQueryTime("InsertLayer", "all", tf)
+	defer observeQueryTime("InsertLayers", "all", time.Now())
+
+	err := pgSQL.withTransaction(ctx, "InsertLayers", func(tx *sql.Tx) error {
+		inserted := make([]database.Layer, len(layers))
+		for i := range layers {
+			inserted[i] = layers[i]
+			if i > 0 {
+				inserted[i].Parent = &inserted[i-1]
+			}
+
+			existingLayer, parentID, namespaceID, ok, err := pgSQL.prepareLayer(ctx, &inserted[i])
+			if err != nil {
+				log.Warningf("could not insert layer %s: %s", inserted[i].Name, err)
+				return err
+			} else if !ok {
+				// The layer is up to date, its children only need its ID.
+				continue
+			}
+
+			err = pgSQL.insertLayer(ctx, tx, &inserted[i], &existingLayer, parentID, namespaceID)
+			if isErrUniqueViolation(err) {
+				// Another process collided, the layer will be found as existing when retrying.
+				return errRetryTransaction
+			} else if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	return handleError(ctx, "InsertLayers", err)
+}
+
+// prepareLayer verifies the given layer, looks for an existing layer with the same name and
+// resolves the IDs of its parent and namespace. The ID of the given layer is set if it exists.
+// It returns false if the layer doesn't need to be inserted, because the existing one has a higher
+// engine version, or an equal one and has already been processed by the same detectors.
+func (pgSQL *pgSQL) prepareLayer(ctx context.Context, layer *database.Layer) (existingLayer database.Layer, parentID, namespaceID zero.Int, ok bool, err error) {
+	// Get a potentially existing layer, from the primary as it is about to be written. The name of
+	// a new one is verified, the existing ones remain writable whatever their name.
+	existingLayer, err = findLayer(ctx, pgSQL.DB, layer.Name, true, false, types.Unknown, pgSQL.config.MaxLayerTreeDepth)
+	if err == cerrors.ErrNotFound {
+		if err = database.ValidateLayerName(layer.Name); err != nil {
+			log.Warningf("could not insert layer %q: %s", layer.Name, err)
+			err = cerrors.NewBadRequestError("could not insert layer: " + err.Error())
+			return
+		}
+	} else if err != nil {
+		return
+	} else {
+		layer.ID = existingLayer.ID
+
+		if existingLayer.EngineVersion > layer.EngineVersion ||
+			existingLayer.EngineVersion == layer.EngineVersion && existingLayer.IsProcessedBy(layer.ProcessedBy) {
+			// The layer exists and is up to date, do nothing.
+			layer.Depth = existingLayer.Depth
+			return
+		}
+	}
+	err = nil
 
 	// Get parent ID.
-	var parentID zero.Int
+	layer.Depth = 1
 	if layer.Parent != nil {
 		if layer.Parent.ID == 0 {
 			log.Warning("Parent is expected to be retrieved from database when inserting a layer.")
-			return cerrors.NewBadRequestError("Parent is expected to be retrieved from database when inserting a layer.")
+			err = cerrors.NewBadRequestError("Parent is expected to be retrieved from database when inserting a layer.")
+			return
 		}
 
 		parentID = zero.IntFrom(int64(layer.Parent.ID))
+
+		// The depth of the parent is only known if its features were retrieved.
+		parentDepth := layer.Parent.Depth
+		if parentDepth == 0 {
+			if parentDepth, err = findLayerDepth(ctx, pgSQL.DB, layer.Parent.ID, layer.Parent.Name, pgSQL.config.MaxLayerTreeDepth); err != nil {
+				return
+			}
+		}
+		if parentDepth >= pgSQL.config.MaxLayerTreeDepth {
+			log.Warningf("could not insert layer %s: its ancestry is too deep", layer.Name)
+			err = &database.ErrLayerTreeTooDeep{Layer: layer.Name, MaxDepth: pgSQL.config.MaxLayerTreeDepth}
+			return
+		}
+		layer.Depth = parentDepth + 1
+
+		// A layer which is re-indexed may be given a new parent, which must not be based on it.
+		if layer.ID != 0 && (existingLayer.Parent == nil || existingLayer.Parent.ID != layer.Parent.ID) {
+			if err = pgSQL.verifyNotDescendant(ctx, layer, layer.Parent.Name); err != nil {
+				return
+			}
+		}
 	}
 
-	// Find or insert namespace if provided.
-	var namespaceID zero.Int
-	if layer.Namespace != nil {
-		n, err := pgSQL.insertNamespace(*layer.Namespace)
-		if err != nil {
-			return err
+	// Find or insert the namespaces if provided.
+	namespaces := layer.ListNamespaces()
+	hasPrimary := layer.Namespace != nil
+	if len(namespaces) > 0 {
+		for i := range namespaces {
+			if namespaces[i].ID, err = pgSQL.insertNamespace(ctx, namespaces[i]); err != nil {
+				return
+			}
 		}
-		namespaceID = zero.IntFrom(int64(n))
-	} else if layer.Namespace == nil && layer.Parent != nil {
-		// Import the Namespace from the parent if it has one and this layer doesn't specify one.
-		if layer.Parent.Namespace != nil {
-			namespaceID = zero.IntFrom(int64(layer.Parent.Namespace.ID))
+	} else if layer.Parent != nil {
+		// Import the Namespaces from the parent if this layer doesn't specify any.
+		// The parent may not have been retrieved from the database when inserting several layers.
+		namespaces = layer.Parent.ListNamespaces()
+		hasPrimary = layer.Parent.Namespace != nil
+		for i := range namespaces {
+			if namespaces[i].ID == 0 {
+				if namespaces[i].ID, err = pgSQL.insertNamespace(ctx, namespaces[i]); err != nil {
+					return
+				}
+			}
 		}
 	}
 
-	// Begin transaction.
-	tx, err := pgSQL.Begin()
+	// Keep track of them, so the layers based on this one inherit them as well.
+	layer.Namespaces = namespaces
+	if hasPrimary {
+		layer.Namespace = &layer.Namespaces[0]
+		namespaceID = zero.IntFrom(int64(layer.Namespace.ID))
+	}
+
+	ok = true
+	return
+}
+
+// verifyNotDescendant returns an error if the specified layer is the given layer or one of its
+// descendants.
+func (pgSQL *pgSQL) verifyNotDescendant(ctx context.Context, layer *database.Layer, name string) error {
+	if name == layer.Name {
+		return cerrors.NewBadRequestError("could not insert a layer which is its own parent")
+	}
+
+	descendants, err := pgSQL.findLayerDescendants(ctx, pgSQL.DB, layer.Name, 0)
 	if err != nil {
-		tx.Rollback()
-		return handleError("InsertLayer.Begin()", err)
+		return err
+	}
+	for _, descendant := range descendants {
+		if descendant == name {
+			return cerrors.NewBadRequestError("could not insert a layer whose parent is based on it")
+		}
 	}
 
+	return nil
+}
+
+// insertLayer inserts or updates a layer prepared by prepareLayer in the given transaction. The
+// errors that come from the transaction are returned unmasked so the transaction may be retried.
+func (pgSQL *pgSQL) insertLayer(ctx context.Context, tx *sql.Tx, layer, existingLayer *database.Layer, parentID, namespaceID zero.Int) error {
 	if layer.ID == 0 {
 		// Insert a new layer.
-		err = tx.QueryRow(insertLayer, layer.Name, layer.EngineVersion, parentID, namespaceID).
+		err := namedQueryRow(ctx, tx, "insertLayer", insertLayer, layer.Name, layer.EngineVersion, parentID, namespaceID, zero.StringFrom(layer.Path), zero.StringFrom(layer.Format)).
 			Scan(&layer.ID)
 		if err != nil {
-			tx.Rollback()
-
-			if isErrUniqueViolation(err) {
-				// Ignore this error, another process collided.
-				log.Debug("Attempted to insert duplicate layer.")
-				return nil
-			}
-			return handleError("insertLayer", err)
+			return err
 		}
 	} else {
-		// Update an existing layer.
-		_, err = tx.Exec(updateLayer, layer.ID, layer.EngineVersion, namespaceID)
+		// Update an existing layer, which may be given a new parent and namespace, and is no
+		// longer stale.
+		_, err := namedExec(ctx, tx, "updateLayer", updateLayer, layer.ID, layer.EngineVersion, namespaceID, parentID, zero.StringFrom(layer.Path), zero.StringFrom(layer.Format))
 		if err != nil {
-			tx.Rollback()
-			return handleError("updateLayer", err)
+			return err
 		}
 
-		// Remove all existing Layer_diff_FeatureVersion.
-		_, err = tx.Exec(removeLayerDiffFeatureVersion, layer.ID)
+		// Remove all existing Layer_diff_FeatureVersion, they are computed again from scratch.
+		_, err = namedExec(ctx, tx, "removeLayerDiffFeatureVersion", removeLayerDiffFeatureVersion, layer.ID)
 		if err != nil {
-			tx.Rollback()
-			return handleError("removeLayerDiffFeatureVersion", err)
+			return err
+		}
+
+		// The detectors that processed the layer and its namespaces are replaced as well.
+		_, err = namedExec(ctx, tx, "removeLayerDetector", removeLayerDetector, layer.ID)
+		if err != nil {
+			return err
+		}
+		_, err = namedExec(ctx, tx, "removeLayerNamespace", removeLayerNamespace, layer.ID)
+		if err != nil {
+			return err
 		}
 	}
 
-	// Update Layer_diff_FeatureVersion now.
-	err = pgSQL.updateDiffFeatureVersions(tx, &layer, &existingLayer)
-	if err != nil {
-		tx.Rollback()
-		return err
+	// Record the namespaces of the layer, in order.
+	for _, namespace := range layer.Namespaces {
+		_, err := namedExec(ctx, tx, "insertLayerNamespace", insertLayerNamespace, layer.ID, namespace.ID)
+		if err != nil {
+			return err
+		}
 	}
 
-	// Commit transaction.
-	err = tx.Commit()
-	if err != nil {
-		tx.Rollback()
-		return handleError("InsertLayer.Commit()", err)
+	// Record the detectors that processed the layer, ignoring duplicates.
+	for _, detector := range utils.CompareStringLists(layer.ProcessedBy, nil) {
+		_, err := namedExec(ctx, tx, "insertLayerDetector", insertLayerDetector, layer.ID, detector)
+		if err != nil {
+			return err
+		}
 	}
 
-	return nil
+	// Update Layer_diff_FeatureVersion now.
+	return pgSQL.updateDiffFeatureVersions(ctx, tx, layer, existingLayer)
 }
 
-func (pgSQL *pgSQL) updateDiffFeatureVersions(tx *sql.Tx, layer, existingLayer *database.Layer) error {
+// updateDiffFeatureVersions inserts the FeatureVersions that the layer adds or removes compared
+// to its parent. The errors that come from the given transaction are returned unmasked so the
+// transaction may be retried.
+func (pgSQL *pgSQL) updateDiffFeatureVersions(ctx context.Context, tx *sql.Tx, layer, existingLayer *database.Layer) error {
 	// add and del are the FeatureVersion diff we should insert.
 	var add []database.FeatureVersion
 	var del []database.FeatureVersion
@@ -343,26 +643,26 @@ func (pgSQL *pgSQL) updateDiffFeatureVersions(tx *sql.Tx, layer, existingLayer *
 	}
 
 	// Insert FeatureVersions in the database.
-	addIDs, err := pgSQL.insertFeatureVersions(add)
+	addIDs, err := pgSQL.insertFeatureVersions(ctx, add)
 	if err != nil {
 		return err
 	}
-	delIDs, err := pgSQL.insertFeatureVersions(del)
+	delIDs, err := pgSQL.insertFeatureVersions(ctx, del)
 	if err != nil {
 		return err
 	}
 
 	// Insert diff in the database.
 	if len(addIDs) > 0 {
-		_, err = tx.Exec(insertLayerDiffFeatureVersion, layer.ID, "add", buildInputArray(addIDs))
+		_, err = namedExec(ctx, tx, "insertLayerDiffFeatureVersion", insertLayerDiffFeatureVersion, layer.ID, "add", intArray(addIDs))
 		if err != nil {
-			return handleError("insertLayerDiffFeatureVersion.Add", err)
+			return err
 		}
 	}
 	if len(delIDs) > 0 {
-		_, err = tx.Exec(insertLayerDiffFeatureVersion, layer.ID, "del", buildInputArray(delIDs))
+		_, err = namedExec(ctx, tx, "insertLayerDiffFeatureVersion", insertLayerDiffFeatureVersion, layer.ID, "del", intArray(delIDs))
 		if err != nil {
-			return handleError("insertLayerDiffFeatureVersion.Del", err)
+			return err
 		}
 	}
 
@@ -383,22 +683,244 @@ func createNV(features []database.FeatureVersion) (map[string]*database.FeatureV
 	return mapNV, sliceNV
 }
 
-func (pgSQL *pgSQL) DeleteLayer(name string) error {
+// LayerExists returns whether the specified layer is stored, with a single query that doesn't load
+// it.
+func (pgSQL *pgSQL) LayerExists(ctx context.Context, name string) (bool, error) {
+	defer observeQueryTime("LayerExists", "all", time.Now())
+
+	var exists bool
+	err := namedQueryRow(ctx, pgSQL.readonly(ctx), "searchLayerExists", searchLayerExists, name).Scan(&exists)
+	if err != nil {
+		return false, handleError(ctx, "searchLayerExists", err)
+	}
+	return exists, nil
+}
+
+// FindLayerChildren returns the layers whose parent is the specified layer.
+// It does not verify that the specified layer exists.
+func (pgSQL *pgSQL) FindLayerChildren(ctx context.Context, name string) ([]database.Layer, error) {
+	return findLayerChildren(ctx, pgSQL.readonly(ctx), name)
+}
+
+func findLayerChildren(ctx context.Context, queryer Queryer, name string) ([]database.Layer, error) {
+	defer observeQueryTime("FindLayerChildren", "all", time.Now())
+
+	rows, err := namedQuery(ctx, queryer, "searchLayerChildren", searchLayerChildren, name)
+	if err != nil {
+		return nil, handleError(ctx, "searchLayerChildren", err)
+	}
+	defer rows.Close()
+
+	var children []database.Layer
+	for rows.Next() {
+		var child database.Layer
+		if err = rows.Scan(&child.ID, &child.Name); err != nil {
+			return nil, handleError(ctx, "searchLayerChildren.Scan()", err)
+		}
+		children = append(children, child)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, handleError(ctx, "searchLayerChildren.Rows()", err)
+	}
+
+	return children, nil
+}
+
+func (pgSQL *pgSQL) DeleteLayer(ctx context.Context, name string, recursive bool) error {
 	defer observeQueryTime("DeleteLayer", "all", time.Now())
 
-	result, err := pgSQL.Exec(removeLayer, name)
+	tx, err := pgSQL.BeginTx(ctx, nil)
 	if err != nil {
-		return handleError("removeLayer", err)
+		return handleError(ctx, "DeleteLayer.Begin()", err)
 	}
 
-	affected, err := result.RowsAffected()
+	// Lock the layer until it is deleted, so that no child can be based on it in the meantime:
+	// inserting or reparenting a layer locks its parent.
+	var id int
+	if err = namedQueryRow(ctx, tx, "lockLayer", lockLayer, name).Scan(&id); err != nil {
+		tx.Rollback()
+		return handleError(ctx, "lockLayer", err)
+	}
+
+	// Find every layer of the subtree, the specified layer excluded.
+	var descendants []string
+	if recursive {
+		if descendants, err = pgSQL.findLayerDescendants(ctx, tx, name, 0); err != nil {
+			tx.Rollback()
+			return err
+		}
+	} else {
+		children, err := findLayerChildren(ctx, tx, name)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		if len(children) > 0 {
+			tx.Rollback()
+			return database.ErrLayerHasChildren
+		}
+	}
+
+	// Delete the subtree, children first, and the layer itself.
+	for i := len(descendants) - 1; i >= 0; i-- {
+		if _, err = namedExec(ctx, tx, "removeLayer", removeLayer, descendants[i]); err != nil {
+			tx.Rollback()
+			return handleError(ctx, "removeLayer", err)
+		}
+	}
+
+	if _, err = namedExec(ctx, tx, "removeLayer", removeLayer, name); err != nil {
+		tx.Rollback()
+		return handleError(ctx, "removeLayer", err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		tx.Rollback()
+		return handleError(ctx, "DeleteLayer.Commit()", err)
+	}
+
+	return nil
+}
+
+// findLayerDescendants returns the names of every layer that is based on the specified layer,
+// parents always coming before their children.
+// Cycles are not supposed to exist but the walk is bounded by MaxLayerTreeDepth anyway.
+func (pgSQL *pgSQL) findLayerDescendants(ctx context.Context, queryer Queryer, name string, depth int) ([]string, error) {
+	if depth >= pgSQL.config.MaxLayerTreeDepth {
+		log.Warningf("layer tree under %s is deeper than %d layers", name, pgSQL.config.MaxLayerTreeDepth)
+		return nil, database.ErrInconsistent
+	}
+
+	children, err := findLayerChildren(ctx, queryer, name)
 	if err != nil {
-		return handleError("removeLayer.RowsAffected()", err)
+		return nil, err
 	}
 
-	if affected <= 0 {
-		return cerrors.ErrNotFound
+	var descendants []string
+	for _, child := range children {
+		descendants = append(descendants, child.Name)
+
+		childDescendants, err := pgSQL.findLayerDescendants(ctx, queryer, child.Name, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		descendants = append(descendants, childDescendants...)
 	}
 
+	return descendants, nil
+}
+
+// ListLayers uses keyset pagination on the Layer's name so that listing stays cheap regardless of
+// the number of layers that have already been paged through.
+func (pgSQL *pgSQL) ListLayers(ctx context.Context, limit int, startAfter string) ([]database.Layer, error) {
+	if limit <= 0 {
+		return nil, cerrors.NewBadRequestError("could not list layers with a non-positive limit")
+	}
+
+	defer observeQueryTime("ListLayers", "all", time.Now())
+
+	return pgSQL.listLayers(ctx, "listLayer", listLayer, startAfter, limit)
+}
+
+// ListLayersMissingDetector lists the layers which don't have the given detector recorded, using
+// the same pagination as ListLayers.
+func (pgSQL *pgSQL) ListLayersMissingDetector(ctx context.Context, detector string, limit int, startAfter string) ([]database.Layer, error) {
+	if detector == "" {
+		return nil, cerrors.NewBadRequestError("could not list layers missing a detector which has an empty name")
+	}
+	if limit <= 0 {
+		return nil, cerrors.NewBadRequestError("could not list layers with a non-positive limit")
+	}
+
+	defer observeQueryTime("ListLayersMissingDetector", "all", time.Now())
+
+	return pgSQL.listLayers(ctx, "listLayerMissingDetector", listLayerMissingDetector, startAfter, limit, detector)
+}
+
+// ListOutdatedLayers lists the layers that an older engine analyzed, using keyset pagination on
+// their ID.
+func (pgSQL *pgSQL) ListOutdatedLayers(ctx context.Context, engineVersion, limit, startAfterID int) ([]database.Layer, error) {
+	if limit <= 0 {
+		return nil, cerrors.NewBadRequestError("could not list layers with a non-positive limit")
+	}
+
+	defer observeQueryTime("ListOutdatedLayers", "all", time.Now())
+
+	return pgSQL.listLayers(ctx, "listOutdatedLayer", listOutdatedLayer, startAfterID, limit, engineVersion)
+}
+
+// MarkLayerStale flags the layer as stale, until it is inserted again.
+func (pgSQL *pgSQL) MarkLayerStale(ctx context.Context, name string) error {
+	defer observeQueryTime("MarkLayerStale", "all", time.Now())
+
+	result, err := namedExec(ctx, pgSQL, "updateLayerStale", updateLayerStale, name)
+	if err != nil {
+		return handleError(ctx, "updateLayerStale", err)
+	}
+	if affected, err := result.RowsAffected(); err != nil {
+		return handleError(ctx, "updateLayerStale.RowsAffected()", err)
+	} else if affected <= 0 {
+		return cerrors.ErrNotFound
+	}
 	return nil
 }
+
+// listLayers runs the given query, which selects the same columns as listLayer, and scans the
+// layers it returns.
+func (pgSQL *pgSQL) listLayers(ctx context.Context, queryName, query string, args ...interface{}) ([]database.Layer, error) {
+	rows, err := namedQuery(ctx, pgSQL.readonly(ctx), queryName, query, args...)
+	if err != nil {
+		return nil, handleError(ctx, queryName, err)
+	}
+	defer rows.Close()
+
+	var layers []database.Layer
+	for rows.Next() {
+		var layer database.Layer
+		var parentID zero.Int
+		var parentName zero.String
+		var namespaceID zero.Int
+		var namespaceName zero.String
+		var namespaceVersionFormat zero.String
+		var path, format zero.String
+
+		err = rows.Scan(&layer.ID, &layer.Name, &layer.EngineVersion, &parentID, &parentName, &namespaceID, &namespaceName, &namespaceVersionFormat, &path, &format, &layer.Stale)
+		if err != nil {
+			return nil, handleError(ctx, queryName+".Scan()", err)
+		}
+		layer.Path, layer.Format = path.String, format.String
+
+		if !parentID.IsZero() {
+			layer.Parent = &database.Layer{
+				Model: database.Model{ID: int(parentID.Int64)},
+				Name:  parentName.String,
+			}
+		}
+		if !namespaceID.IsZero() {
+			layer.Namespace = &database.Namespace{
+				Model:         database.Model{ID: int(namespaceID.Int64)},
+				Name:          namespaceName.String,
+				VersionFormat: types.VersionFormat(namespaceVersionFormat.String),
+			}
+		}
+
+		layers = append(layers, layer)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, handleError(ctx, queryName+".Rows()", err)
+	}
+
+	return layers, nil
+}
+
+// CountLayers returns the total number of layers.
+func (pgSQL *pgSQL) CountLayers(ctx context.Context) (int, error) {
+	defer observeQueryTime("CountLayers", "all", time.Now())
+
+	var count int
+	if err := namedQueryRow(ctx, pgSQL.readonly(ctx), "countLayer", countLayer).Scan(&count); err != nil {
+		return 0, handleError(ctx, "countLayer", err)
+	}
+
+	return count, nil
+}
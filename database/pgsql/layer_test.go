@@ -15,9 +15,16 @@
 package pgsql
 
 import (
+	"context"
+	"database/sql/driver"
 	"fmt"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
 	"testing"
 
+	"github.com/lib/pq"
 	"github.com/stretchr/testify/assert"
 
 	"github.com/coreos/clair/database"
@@ -34,7 +41,7 @@ func TestFindLayer(t *testing.T) {
 	defer datastore.Close()
 
 	// Layer-0: no parent, no namespace, no feature, no vulnerability
-	layer, err := datastore.FindLayer("layer-0", false, false)
+	layer, err := datastore.FindLayer(context.Background(), "layer-0", false, false, types.Unknown)
 	if assert.Nil(t, err) && assert.NotNil(t, layer) {
 		assert.Equal(t, "layer-0", layer.Name)
 		assert.Nil(t, layer.Namespace)
@@ -43,13 +50,13 @@ func TestFindLayer(t *testing.T) {
 		assert.Len(t, layer.Features, 0)
 	}
 
-	layer, err = datastore.FindLayer("layer-0", true, false)
+	layer, err = datastore.FindLayer(context.Background(), "layer-0", true, false, types.Unknown)
 	if assert.Nil(t, err) && assert.NotNil(t, layer) {
 		assert.Len(t, layer.Features, 0)
 	}
 
 	// Layer-1: one parent, adds two features, one vulnerability
-	layer, err = datastore.FindLayer("layer-1", false, false)
+	layer, err = datastore.FindLayer(context.Background(), "layer-1", false, false, types.Unknown)
 	if assert.Nil(t, err) && assert.NotNil(t, layer) {
 		assert.Equal(t, layer.Name, "layer-1")
 		assert.Equal(t, "debian:7", layer.Namespace.Name)
@@ -60,7 +67,7 @@ func TestFindLayer(t *testing.T) {
 		assert.Len(t, layer.Features, 0)
 	}
 
-	layer, err = datastore.FindLayer("layer-1", true, false)
+	layer, err = datastore.FindLayer(context.Background(), "layer-1", true, false, types.Unknown)
 	if assert.Nil(t, err) && assert.NotNil(t, layer) && assert.Len(t, layer.Features, 2) {
 		for _, featureVersion := range layer.Features {
 			assert.Equal(t, "debian:7", featureVersion.Feature.Namespace.Name)
@@ -76,7 +83,7 @@ func TestFindLayer(t *testing.T) {
 		}
 	}
 
-	layer, err = datastore.FindLayer("layer-1", true, true)
+	layer, err = datastore.FindLayer(context.Background(), "layer-1", true, true, types.Unknown)
 	if assert.Nil(t, err) && assert.NotNil(t, layer) && assert.Len(t, layer.Features, 2) {
 		for _, featureVersion := range layer.Features {
 			assert.Equal(t, "debian:7", featureVersion.Feature.Namespace.Name)
@@ -123,6 +130,335 @@ func TestInsertLayer(t *testing.T) {
 	testInsertLayerDelete(t, datastore)
 }
 
+func TestListLayers(t *testing.T) {
+	datastore, err := openDatabaseForTest("ListLayers", false)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer datastore.Close()
+
+	for i := 0; i < 30; i++ {
+		err = datastore.InsertLayer(context.Background(), database.Layer{Name: fmt.Sprintf("TestListLayers%02d", i)})
+		assert.Nil(t, err)
+	}
+
+	count, err := datastore.CountLayers(context.Background())
+	if assert.Nil(t, err) {
+		assert.Equal(t, 30, count)
+	}
+
+	// Page through the layers and verify that every layer is returned exactly once, in order.
+	var startAfter string
+	var pageSizes []int
+	var names []string
+	for {
+		layers, err := datastore.ListLayers(context.Background(), 7, startAfter)
+		if !assert.Nil(t, err) || len(layers) == 0 {
+			break
+		}
+
+		pageSizes = append(pageSizes, len(layers))
+		for _, layer := range layers {
+			names = append(names, layer.Name)
+		}
+		startAfter = layers[len(layers)-1].Name
+	}
+
+	assert.Equal(t, []int{7, 7, 7, 7, 2}, pageSizes)
+	if assert.Len(t, names, 30) {
+		for i, name := range names {
+			assert.Equal(t, fmt.Sprintf("TestListLayers%02d", i), name)
+		}
+	}
+
+	_, err = datastore.ListLayers(context.Background(), 0, "")
+	assert.IsType(t, &cerrors.ErrBadRequest{}, err)
+}
+
+func TestDeleteLayerRecursive(t *testing.T) {
+	datastore, err := openDatabaseForTest("DeleteLayerRecursive", false)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer datastore.Close()
+
+	// Insert a three-level tree: l1 <- l2 <- (l3a, l3b).
+	fv := database.FeatureVersion{
+		Feature: database.Feature{
+			Namespace: database.Namespace{Name: "TestDeleteLayerRecursiveNamespace"},
+			Name:      "TestDeleteLayerRecursiveFeature",
+		},
+		Version: types.NewVersionUnsafe("1.0"),
+	}
+
+	l1 := database.Layer{Name: "TestDeleteLayerRecursive1", Features: []database.FeatureVersion{fv}}
+	l2 := database.Layer{Name: "TestDeleteLayerRecursive2", Parent: &database.Layer{Name: l1.Name}}
+	l3a := database.Layer{Name: "TestDeleteLayerRecursive3a", Parent: &database.Layer{Name: l2.Name}}
+	l3b := database.Layer{Name: "TestDeleteLayerRecursive3b", Parent: &database.Layer{Name: l2.Name}}
+	for _, layer := range []database.Layer{l1, l2, l3a, l3b} {
+		if layer.Parent != nil {
+			parent, err := datastore.FindLayer(context.Background(), layer.Parent.Name, true, false, types.Unknown)
+			if !assert.Nil(t, err) {
+				return
+			}
+			layer.Parent = &parent
+		}
+
+		err = datastore.InsertLayer(context.Background(), layer)
+		assert.Nil(t, err)
+	}
+
+	children, err := datastore.FindLayerChildren(context.Background(), l2.Name)
+	if assert.Nil(t, err) && assert.Len(t, children, 2) {
+		for _, child := range children {
+			assert.NotZero(t, child.ID)
+			assert.Contains(t, []string{l3a.Name, l3b.Name}, child.Name)
+		}
+	}
+
+	// Delete the whole tree.
+	err = datastore.DeleteLayer(context.Background(), l1.Name, false)
+	assert.Equal(t, database.ErrLayerHasChildren, err)
+
+	err = datastore.DeleteLayer(context.Background(), l1.Name, true)
+	assert.Nil(t, err)
+
+	for _, layer := range []database.Layer{l1, l2, l3a, l3b} {
+		_, err = datastore.FindLayer(context.Background(), layer.Name, false, false, types.Unknown)
+		assert.Equal(t, cerrors.ErrNotFound, err)
+	}
+
+	var count int
+	err = datastore.QueryRow("SELECT COUNT(*) FROM Layer_diff_FeatureVersion").Scan(&count)
+	if assert.Nil(t, err) {
+		assert.Zero(t, count)
+	}
+}
+
+func TestLayerTreeDepth(t *testing.T) {
+	datastore, err := openDatabaseForTest("LayerTreeDepth", false)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer datastore.Close()
+	ctx := context.Background()
+
+	// Store a chain that is deeper than the default limit.
+	datastore.config.MaxLayerTreeDepth = 200
+	layers := make([]database.Layer, 200)
+	for i := range layers {
+		layers[i] = database.Layer{Name: fmt.Sprintf("TestLayerTreeDepth%d", i), EngineVersion: 1}
+		if i > 0 {
+			layers[i].Parent = &layers[i-1]
+		}
+	}
+	err = datastore.InsertLayers(ctx, layers)
+	datastore.config.MaxLayerTreeDepth = database.DefaultMaxLayerTreeDepth
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	// The ancestry of the top layer isn't walked beyond the limit.
+	_, err = datastore.FindLayer(ctx, "TestLayerTreeDepth199", true, false, types.Unknown)
+	assert.IsType(t, &database.ErrLayerTreeTooDeep{}, err)
+	_, _, err = datastore.GetLayerDiff(ctx, "TestLayerTreeDepth199")
+	assert.IsType(t, &database.ErrLayerTreeTooDeep{}, err)
+
+	layer, err := datastore.FindLayer(ctx, "TestLayerTreeDepth126", true, false, types.Unknown)
+	if assert.Nil(t, err) {
+		assert.Equal(t, 127, layer.Depth)
+	}
+
+	// A cycle, which can only be manufactured, is an inconsistency.
+	_, err = datastore.Exec(`UPDATE Layer SET parent_id = (SELECT id FROM Layer WHERE name = 'TestLayerTreeDepth9') WHERE name = 'TestLayerTreeDepth0'`)
+	if !assert.Nil(t, err) {
+		return
+	}
+	_, err = datastore.FindLayer(ctx, "TestLayerTreeDepth5", true, false, types.Unknown)
+	assert.Equal(t, database.ErrInconsistent, err)
+}
+
+func TestInsertLayers(t *testing.T) {
+	datastore, err := openDatabaseForTest("InsertLayers", false)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer datastore.Close()
+	ctx := context.Background()
+
+	image := testInsertLayersImage("TestInsertLayers", 10)
+
+	// Parent links that don't form a chain are rejected.
+	brokenImage := testInsertLayersImage("TestInsertLayersBroken", 3)
+	brokenImage[2].Parent = &database.Layer{Name: brokenImage[0].Name}
+	_, isBadRequest := datastore.InsertLayers(ctx, brokenImage).(*cerrors.ErrBadRequest)
+	assert.True(t, isBadRequest)
+
+	// A failure on the 7th layer rolls back the entire batch.
+	failingImage := testInsertLayersImage("TestInsertLayers", 10)
+	failingImage[6].Features = append(failingImage[6].Features, database.FeatureVersion{
+		Feature: database.Feature{Namespace: database.Namespace{Name: "TestInsertLayersNamespace"}},
+		Version: types.NewVersionUnsafe("1.0"),
+	})
+	assert.NotNil(t, datastore.InsertLayers(ctx, failingImage))
+	for _, layer := range failingImage {
+		_, err = datastore.FindLayer(ctx, layer.Name, false, false, types.Unknown)
+		assert.Equal(t, cerrors.ErrNotFound, err)
+	}
+
+	// A 10-layer image is inserted in a single transaction.
+	if !assert.Nil(t, datastore.InsertLayers(ctx, image)) {
+		return
+	}
+
+	var names []string
+	for _, layer := range image {
+		names = append(names, layer.Name)
+	}
+	var transactions int
+	err = datastore.QueryRow("SELECT COUNT(DISTINCT xmin::text) FROM Layer WHERE name = ANY($1)", pq.Array(names)).Scan(&transactions)
+	if assert.Nil(t, err) {
+		assert.Equal(t, 1, transactions)
+	}
+
+	// The layers are stored as InsertLayer would do.
+	for i, layer := range image {
+		l, err := datastore.FindLayer(ctx, layer.Name, true, false, types.Unknown)
+		if assert.Nil(t, err) {
+			assert.Len(t, l.Features, i+1)
+			if i > 0 && assert.NotNil(t, l.Parent) {
+				assert.Equal(t, image[i-1].Name, l.Parent.Name)
+			}
+		}
+	}
+
+	// Inserting the same image again is a no-op.
+	assert.Nil(t, datastore.InsertLayers(ctx, image))
+}
+
+func BenchmarkInsertLayers(b *testing.B) {
+	datastore, err := openDatabaseForTest("BenchmarkInsertLayers", false)
+	if err != nil {
+		b.Error(err)
+		return
+	}
+	defer datastore.Close()
+
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		if err := datastore.InsertLayers(context.Background(), testInsertLayersImage(fmt.Sprintf("BenchmarkInsertLayers%d", n), 10)); err != nil {
+			b.Error(err)
+			return
+		}
+	}
+}
+
+// testInsertLayersImage returns an image of the given number of layers, each of them adding a
+// Feature.
+func testInsertLayersImage(name string, size int) []database.Layer {
+	image := make([]database.Layer, size)
+	var features []database.FeatureVersion
+	for i := range image {
+		features = append(features, database.FeatureVersion{
+			Feature: database.Feature{
+				Namespace: database.Namespace{Name: "TestInsertLayersNamespace"},
+				Name:      fmt.Sprintf("TestInsertLayersFeature%d", i),
+			},
+			Version: types.NewVersionUnsafe("1.0"),
+		})
+
+		image[i] = database.Layer{
+			Name:          fmt.Sprintf("%s-%d", name, i),
+			EngineVersion: 1,
+			Features:      append([]database.FeatureVersion(nil), features...),
+		}
+		if i > 0 {
+			image[i].Parent = &database.Layer{Name: image[i-1].Name}
+		}
+	}
+	return image
+}
+
+func TestInsertLayerReindex(t *testing.T) {
+	datastore, err := openDatabaseForTest("InsertLayerReindex", false)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer datastore.Close()
+	ctx := context.Background()
+
+	n1 := database.Namespace{Name: "TestInsertLayerReindexNamespace1"}
+	n2 := database.Namespace{Name: "TestInsertLayerReindexNamespace2"}
+	fv := func(name string) database.FeatureVersion {
+		return database.FeatureVersion{
+			Feature: database.Feature{Namespace: n1, Name: name},
+			Version: types.NewVersionUnsafe("1.0"),
+		}
+	}
+
+	// Insert two bases and a chain on top of the first one: a <- b <- c.
+	image := []database.Layer{
+		{Name: "TestInsertLayerReindexA", EngineVersion: 1, Namespace: &n1, Features: []database.FeatureVersion{fv("a")}},
+		{Name: "TestInsertLayerReindexB", EngineVersion: 1, Features: []database.FeatureVersion{fv("a"), fv("b")}},
+		{Name: "TestInsertLayerReindexC", EngineVersion: 1, Features: []database.FeatureVersion{fv("a"), fv("b"), fv("c")}},
+	}
+	image[1].Parent = &database.Layer{Name: image[0].Name}
+	image[2].Parent = &database.Layer{Name: image[1].Name}
+	assert.Nil(t, datastore.InsertLayers(ctx, image))
+	assert.Nil(t, datastore.InsertLayer(ctx, database.Layer{Name: "TestInsertLayerReindexA2", EngineVersion: 1, Features: []database.FeatureVersion{fv("a2")}}))
+
+	// Re-index b with a higher engine version, on top of a2 and in another namespace.
+	a2, err := datastore.FindLayer(ctx, "TestInsertLayerReindexA2", true, false, types.Unknown)
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Nil(t, datastore.InsertLayer(ctx, database.Layer{
+		Name:          "TestInsertLayerReindexB",
+		EngineVersion: 2,
+		Parent:        &a2,
+		Namespace:     &n2,
+		Features:      []database.FeatureVersion{fv("a2"), fv("b2")},
+	}))
+
+	b, err := datastore.FindLayer(ctx, "TestInsertLayerReindexB", true, false, types.Unknown)
+	if assert.Nil(t, err) {
+		assert.Equal(t, 2, b.EngineVersion)
+		if assert.NotNil(t, b.Parent) {
+			assert.Equal(t, a2.Name, b.Parent.Name)
+		}
+		if assert.NotNil(t, b.Namespace) {
+			assert.Equal(t, n2.Name, b.Namespace.Name)
+		}
+		assert.Len(t, b.Features, 2)
+	}
+
+	// The grandchild of a2 reflects the re-indexed b.
+	c, err := datastore.FindLayer(ctx, "TestInsertLayerReindexC", true, false, types.Unknown)
+	if assert.Nil(t, err) {
+		var names []string
+		for _, featureVersion := range c.Features {
+			names = append(names, featureVersion.Feature.Name)
+		}
+		assert.Len(t, names, 3)
+		assert.Contains(t, names, "a2")
+		assert.Contains(t, names, "b2")
+		assert.Contains(t, names, "c")
+	}
+
+	// A layer can't be re-indexed on top of one of its descendants.
+	_, isBadRequest := datastore.InsertLayer(ctx, database.Layer{
+		Name:          "TestInsertLayerReindexB",
+		EngineVersion: 3,
+		Parent:        &c,
+	}).(*cerrors.ErrBadRequest)
+	assert.True(t, isBadRequest)
+}
+
 func testInsertLayerInvalid(t *testing.T, datastore database.Datastore) {
 	invalidLayers := []database.Layer{
 		{},
@@ -131,7 +467,7 @@ func testInsertLayerInvalid(t *testing.T, datastore database.Datastore) {
 	}
 
 	for _, invalidLayer := range invalidLayers {
-		err := datastore.InsertLayer(invalidLayer)
+		err := datastore.InsertLayer(context.Background(), invalidLayer)
 		assert.Error(t, err)
 	}
 }
@@ -230,10 +566,10 @@ func testInsertLayerTree(t *testing.T, datastore database.Datastore) {
 			layer.Parent = &parent
 		}
 
-		err = datastore.InsertLayer(layer)
+		err = datastore.InsertLayer(context.Background(), layer)
 		assert.Nil(t, err)
 
-		retrievedLayers[layer.Name], err = datastore.FindLayer(layer.Name, true, false)
+		retrievedLayers[layer.Name], err = datastore.FindLayer(context.Background(), layer.Name, true, false, types.Unknown)
 		assert.Nil(t, err)
 	}
 
@@ -269,7 +605,7 @@ func testInsertLayerUpdate(t *testing.T, datastore database.Datastore) {
 		Version: types.NewVersionUnsafe("0.01"),
 	}
 
-	l3, _ := datastore.FindLayer("TestInsertLayer3", true, false)
+	l3, _ := datastore.FindLayer(context.Background(), "TestInsertLayer3", true, false, types.Unknown)
 	l3u := database.Layer{
 		Name:      l3.Name,
 		Parent:    l3.Parent,
@@ -285,10 +621,10 @@ func testInsertLayerUpdate(t *testing.T, datastore database.Datastore) {
 	}
 
 	// Try to re-insert without increasing the EngineVersion.
-	err := datastore.InsertLayer(l3u)
+	err := datastore.InsertLayer(context.Background(), l3u)
 	assert.Nil(t, err)
 
-	l3uf, err := datastore.FindLayer(l3u.Name, true, false)
+	l3uf, err := datastore.FindLayer(context.Background(), l3u.Name, true, false, types.Unknown)
 	if assert.Nil(t, err) {
 		assert.Equal(t, l3.Namespace.Name, l3uf.Namespace.Name)
 		assert.Equal(t, l3.EngineVersion, l3uf.EngineVersion)
@@ -298,10 +634,10 @@ func testInsertLayerUpdate(t *testing.T, datastore database.Datastore) {
 	// Update layer l3.
 	// Verify that the Namespace, EngineVersion and FeatureVersions got updated.
 	l3u.EngineVersion = 2
-	err = datastore.InsertLayer(l3u)
+	err = datastore.InsertLayer(context.Background(), l3u)
 	assert.Nil(t, err)
 
-	l3uf, err = datastore.FindLayer(l3u.Name, true, false)
+	l3uf, err = datastore.FindLayer(context.Background(), l3u.Name, true, false, types.Unknown)
 	if assert.Nil(t, err) {
 		assert.Equal(t, l3u.Namespace.Name, l3uf.Namespace.Name)
 		assert.Equal(t, l3u.EngineVersion, l3uf.EngineVersion)
@@ -314,10 +650,10 @@ func testInsertLayerUpdate(t *testing.T, datastore database.Datastore) {
 	// Verify that the Namespace got updated from its new Parent's, and also verify the
 	// EnginVersion and FeatureVersions.
 	l4u.Parent = &l3uf
-	err = datastore.InsertLayer(l4u)
+	err = datastore.InsertLayer(context.Background(), l4u)
 	assert.Nil(t, err)
 
-	l4uf, err := datastore.FindLayer(l3u.Name, true, false)
+	l4uf, err := datastore.FindLayer(context.Background(), l3u.Name, true, false, types.Unknown)
 	if assert.Nil(t, err) {
 		assert.Equal(t, l3u.Namespace.Name, l4uf.Namespace.Name)
 		assert.Equal(t, l4u.EngineVersion, l4uf.EngineVersion)
@@ -328,19 +664,22 @@ func testInsertLayerUpdate(t *testing.T, datastore database.Datastore) {
 }
 
 func testInsertLayerDelete(t *testing.T, datastore database.Datastore) {
-	err := datastore.DeleteLayer("TestInsertLayerX")
+	err := datastore.DeleteLayer(context.Background(), "TestInsertLayerX", true)
 	assert.Equal(t, cerrors.ErrNotFound, err)
 
-	err = datastore.DeleteLayer("TestInsertLayer3")
+	err = datastore.DeleteLayer(context.Background(), "TestInsertLayer3", false)
+	assert.Equal(t, database.ErrLayerHasChildren, err)
+
+	err = datastore.DeleteLayer(context.Background(), "TestInsertLayer3", true)
 	assert.Nil(t, err)
 
-	_, err = datastore.FindLayer("TestInsertLayer3", false, false)
+	_, err = datastore.FindLayer(context.Background(), "TestInsertLayer3", false, false, types.Unknown)
 	assert.Equal(t, cerrors.ErrNotFound, err)
 
-	_, err = datastore.FindLayer("TestInsertLayer4a", false, false)
+	_, err = datastore.FindLayer(context.Background(), "TestInsertLayer4a", false, false, types.Unknown)
 	assert.Equal(t, cerrors.ErrNotFound, err)
 
-	_, err = datastore.FindLayer("TestInsertLayer4b", true, false)
+	_, err = datastore.FindLayer(context.Background(), "TestInsertLayer4b", true, false, types.Unknown)
 	assert.Equal(t, cerrors.ErrNotFound, err)
 }
 
@@ -349,3 +688,67 @@ func cmpFV(a, b database.FeatureVersion) bool {
 		a.Feature.Namespace.Name == b.Feature.Namespace.Name &&
 		a.Version.String() == b.Version.String()
 }
+
+func TestIntArray(t *testing.T) {
+	inputs := [][]int{
+		{},
+		{0},
+		{0, 1, -1},
+		{math.MaxInt32, math.MinInt32},
+		{math.MaxInt64, math.MinInt64, 0},
+	}
+
+	// Add random inputs.
+	r := rand.New(rand.NewSource(0))
+	for i := 0; i < 100; i++ {
+		input := make([]int, r.Intn(16))
+		for j := range input {
+			input[j] = int(r.Int63()) - int(r.Int63())
+		}
+		inputs = append(inputs, input)
+	}
+
+	for _, input := range inputs {
+		expected := make([]string, 0, len(input))
+		for _, n := range input {
+			expected = append(expected, strconv.Itoa(n))
+		}
+
+		value, err := intArray(input).(driver.Valuer).Value()
+		if assert.Nil(t, err) {
+			assert.Equal(t, "{"+strings.Join(expected, ",")+"}", fmt.Sprintf("%s", value))
+		}
+	}
+}
+
+func TestLoadAffectedBy(t *testing.T) {
+	// No FeatureVersion doesn't query the database at all.
+	assert.Nil(t, loadAffectedBy(context.Background(), nil, nil, types.Unknown))
+
+	datastore, err := openDatabaseForTest("LoadAffectedBy", true)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer datastore.Close()
+
+	tx, err := datastore.Begin()
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer tx.Rollback()
+
+	// Unknown IDs, including 0 and the largest integer, are not affected by anything.
+	featureVersions := []database.FeatureVersion{
+		{Model: database.Model{ID: 0}},
+		{Model: database.Model{ID: 2}},
+		{Model: database.Model{ID: math.MaxInt32}},
+	}
+	if assert.Nil(t, loadAffectedBy(context.Background(), tx, featureVersions, types.Unknown)) {
+		assert.Len(t, featureVersions[0].AffectedBy, 0)
+		if assert.Len(t, featureVersions[1].AffectedBy, 1) {
+			assert.Equal(t, "CVE-OPENSSL-1-DEB7", featureVersions[1].AffectedBy[0].Name)
+		}
+		assert.Len(t, featureVersions[2].AffectedBy, 0)
+	}
+}
@@ -15,6 +15,7 @@
 package pgsql
 
 import (
+	"context"
 	"time"
 
 	cerrors "github.com/coreos/clair/utils/errors"
@@ -24,7 +25,7 @@ import (
 //
 // Lock does not block, instead, it returns true and its expiration time
 // is the lock has been successfully acquired or false otherwise
-func (pgSQL *pgSQL) Lock(name string, owner string, duration time.Duration, renew bool) (bool, time.Time) {
+func (pgSQL *pgSQL) Lock(ctx context.Context, name string, owner string, duration time.Duration, renew bool) (bool, time.Time) {
 	if name == "" || owner == "" || duration == 0 {
 		log.Warning("could not create an invalid lock")
 		return false, time.Time{}
@@ -37,9 +38,9 @@ func (pgSQL *pgSQL) Lock(name string, owner string, duration time.Duration, rene
 
 	if renew {
 		// Renew lock.
-		r, err := pgSQL.Exec(updateLock, name, owner, until)
+		r, err := namedExec(ctx, pgSQL, "updateLock", updateLock, name, owner, until)
 		if err != nil {
-			handleError("updateLock", err)
+			handleError(ctx, "updateLock", err)
 			return false, until
 		}
 		if n, _ := r.RowsAffected(); n > 0 {
@@ -48,14 +49,14 @@ func (pgSQL *pgSQL) Lock(name string, owner string, duration time.Duration, rene
 		}
 	} else {
 		// Prune locks.
-		pgSQL.pruneLocks()
+		pgSQL.pruneLocks(ctx)
 	}
 
 	// Lock.
-	_, err := pgSQL.Exec(insertLock, name, owner, until)
+	_, err := namedExec(ctx, pgSQL, "insertLock", insertLock, name, owner, until)
 	if err != nil {
 		if !isErrUniqueViolation(err) {
-			handleError("insertLock", err)
+			handleError(ctx, "insertLock", err)
 		}
 		return false, until
 	}
@@ -64,7 +65,7 @@ func (pgSQL *pgSQL) Lock(name string, owner string, duration time.Duration, rene
 }
 
 // Unlock unlocks a lock specified by its name if I own it
-func (pgSQL *pgSQL) Unlock(name, owner string) {
+func (pgSQL *pgSQL) Unlock(ctx context.Context, name, owner string) {
 	if name == "" || owner == "" {
 		log.Warning("could not delete an invalid lock")
 		return
@@ -72,12 +73,12 @@ func (pgSQL *pgSQL) Unlock(name, owner string) {
 
 	defer observeQueryTime("Unlock", "all", time.Now())
 
-	pgSQL.Exec(removeLock, name, owner)
+	namedExec(ctx, pgSQL, "removeLock", removeLock, name, owner)
 }
 
 // FindLock returns the owner of a lock specified by its name and its
 // expiration time.
-func (pgSQL *pgSQL) FindLock(name string) (string, time.Time, error) {
+func (pgSQL *pgSQL) FindLock(ctx context.Context, name string) (string, time.Time, error) {
 	if name == "" {
 		log.Warning("could not find an invalid lock")
 		return "", time.Time{}, cerrors.NewBadRequestError("could not find an invalid lock")
@@ -87,19 +88,19 @@ func (pgSQL *pgSQL) FindLock(name string) (string, time.Time, error) {
 
 	var owner string
 	var until time.Time
-	err := pgSQL.QueryRow(searchLock, name).Scan(&owner, &until)
+	err := namedQueryRow(ctx, pgSQL, "searchLock", searchLock, name).Scan(&owner, &until)
 	if err != nil {
-		return owner, until, handleError("searchLock", err)
+		return owner, until, handleError(ctx, "searchLock", err)
 	}
 
 	return owner, until, nil
 }
 
 // pruneLocks removes every expired locks from the database
-func (pgSQL *pgSQL) pruneLocks() {
+func (pgSQL *pgSQL) pruneLocks(ctx context.Context) {
 	defer observeQueryTime("pruneLocks", "all", time.Now())
 
-	if _, err := pgSQL.Exec(removeLockExpired); err != nil {
-		handleError("removeLockExpired", err)
+	if _, err := namedExec(ctx, pgSQL, "removeLockExpired", removeLockExpired); err != nil {
+		handleError(ctx, "removeLockExpired", err)
 	}
 }
@@ -15,6 +15,7 @@
 package pgsql
 
 import (
+	"context"
 	"testing"
 	"time"
 
@@ -33,37 +34,37 @@ func TestLock(t *testing.T) {
 	var et time.Time
 
 	// Create a first lock.
-	l, _ = datastore.Lock("test1", "owner1", time.Minute, false)
+	l, _ = datastore.Lock(context.Background(), "test1", "owner1", time.Minute, false)
 	assert.True(t, l)
 
 	// Try to lock the same lock with another owner.
-	l, _ = datastore.Lock("test1", "owner2", time.Minute, true)
+	l, _ = datastore.Lock(context.Background(), "test1", "owner2", time.Minute, true)
 	assert.False(t, l)
 
-	l, _ = datastore.Lock("test1", "owner2", time.Minute, false)
+	l, _ = datastore.Lock(context.Background(), "test1", "owner2", time.Minute, false)
 	assert.False(t, l)
 
 	// Renew the lock.
-	l, _ = datastore.Lock("test1", "owner1", 2*time.Minute, true)
+	l, _ = datastore.Lock(context.Background(), "test1", "owner1", 2*time.Minute, true)
 	assert.True(t, l)
 
 	// Unlock and then relock by someone else.
-	datastore.Unlock("test1", "owner1")
+	datastore.Unlock(context.Background(), "test1", "owner1")
 
-	l, et = datastore.Lock("test1", "owner2", time.Minute, false)
+	l, et = datastore.Lock(context.Background(), "test1", "owner2", time.Minute, false)
 	assert.True(t, l)
 
 	// LockInfo
-	o, et2, err := datastore.FindLock("test1")
+	o, et2, err := datastore.FindLock(context.Background(), "test1")
 	assert.Nil(t, err)
 	assert.Equal(t, "owner2", o)
 	assert.Equal(t, et.Second(), et2.Second())
 
 	// Create a second lock which is actually already expired ...
-	l, _ = datastore.Lock("test2", "owner1", -time.Minute, false)
+	l, _ = datastore.Lock(context.Background(), "test2", "owner1", -time.Minute, false)
 	assert.True(t, l)
 
 	// Take over the lock
-	l, _ = datastore.Lock("test2", "owner2", time.Minute, false)
+	l, _ = datastore.Lock(context.Background(), "test2", "owner2", time.Minute, false)
 	assert.True(t, l)
 }
@@ -0,0 +1,477 @@
+// Copyright 2015 clair authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pgsql
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/pborman/uuid"
+
+	"github.com/coreos/clair/database"
+)
+
+const (
+	// migrationLockName is the name of the Lock that guards the execution of migrations, so
+	// instances that boot together don't run them concurrently.
+	migrationLockName     = "pgsql-migrations"
+	migrationLockDuration = 10 * time.Minute
+	migrationLockRetry    = time.Second
+
+	// schemaCompatibilityVersion must be incremented every time the way data is stored changes in
+	// a way that prevents older binaries from reading it, or newer binaries from reading data
+	// written by older ones, and that can't be fixed by a migration.
+	schemaCompatibilityVersion = 1
+
+	// schemaCompatibilityKey is the KeyValue key that stores the schemaCompatibilityVersion of the
+	// binaries that use the database.
+	schemaCompatibilityKey = "pgsql-schema-compatibility"
+)
+
+// migration is a set of SQL statements that upgrades the schema to a given version.
+type migration struct {
+	version int
+	name    string
+	up      string
+}
+
+// migrations lists every schema migration, ordered by ascending version.
+// Migrations must never be modified once released: schema changes have to be added as new
+// entries at the end of the list.
+var migrations = []migration{
+	{version: 1, name: "Initial", up: migrationInitial},
+	{version: 2, name: "MetadataJSONB", up: migrationMetadataJSONB},
+	{version: 3, name: "VulnerabilityLinks", up: migrationVulnerabilityLinks},
+	{version: 4, name: "VulnerabilityHistory", up: migrationVulnerabilityHistory},
+	{version: 5, name: "LayerDetectors", up: migrationLayerDetectors},
+	{version: 6, name: "NamespaceVersionFormat", up: migrationNamespaceVersionFormat},
+	{version: 7, name: "LayerNamespaces", up: migrationLayerNamespaces},
+	{version: 8, name: "LayerReindexing", up: migrationLayerReindexing},
+	{version: 9, name: "LayerNameLength", up: migrationLayerNameLength},
+	{version: 10, name: "VulnerabilityUniqueName", up: migrationVulnerabilityUniqueName},
+}
+
+const (
+	// bootstrapMigrations creates the tables that are required to run and record migrations.
+	// The advisory lock serializes concurrent bootstraps, which could otherwise fail while
+	// creating the same table.
+	bootstrapMigrations = `
+		SELECT pg_advisory_xact_lock(1516224897);
+
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version INT PRIMARY KEY,
+			name VARCHAR(128) NOT NULL,
+			applied_at TIMESTAMP WITH TIME ZONE);
+
+		DO $$
+		BEGIN
+			IF NOT EXISTS (SELECT 1 FROM information_schema.tables WHERE table_name = 'lock') THEN
+				CREATE TABLE Lock (
+					id SERIAL PRIMARY KEY,
+					name VARCHAR(64) NOT NULL UNIQUE,
+					owner VARCHAR(64) NOT NULL,
+					until TIMESTAMP WITH TIME ZONE);
+
+				CREATE INDEX ON Lock (owner);
+			END IF;
+		END
+		$$;`
+
+	// adoptLegacyMigrations records the initial migration as applied when the schema was created
+	// by goose, which was previously used to run migrations and recorded the initial schema as
+	// version 20151222113213.
+	adoptLegacyMigrations = `
+		DO $$
+		BEGIN
+			IF EXISTS (SELECT 1 FROM information_schema.tables WHERE table_name = 'goose_db_version')
+			   AND NOT EXISTS (SELECT 1 FROM schema_migrations) THEN
+				INSERT INTO schema_migrations(version, name, applied_at)
+					SELECT 1, 'Initial', MAX(tstamp) FROM goose_db_version
+					WHERE version_id = 20151222113213 AND is_applied
+					HAVING COUNT(*) > 0;
+			END IF;
+		END
+		$$;`
+
+	disableStatementTimeout = `SET LOCAL statement_timeout = 0`
+	searchMigrationVersion  = `SELECT COALESCE(MAX(version), 0) FROM schema_migrations`
+	insertMigration         = `INSERT INTO schema_migrations(version, name, applied_at) VALUES($1, $2, CURRENT_TIMESTAMP)`
+)
+
+// migrate brings the database schema up to date by running every pending migration.
+// The execution is guarded by a Lock so several instances can start simultaneously.
+func (pgSQL *pgSQL) migrate(ctx context.Context) error {
+	log.Info("running database migrations")
+
+	if _, err := namedExec(ctx, pgSQL, "bootstrapMigrations", bootstrapMigrations); err != nil {
+		return fmt.Errorf("pgsql: could not bootstrap migrations: %v", err)
+	}
+	if _, err := namedExec(ctx, pgSQL, "adoptLegacyMigrations", adoptLegacyMigrations); err != nil {
+		return fmt.Errorf("pgsql: could not adopt legacy migrations: %v", err)
+	}
+
+	// Acquire the migration lock, waiting for any other instance to finish its migrations.
+	owner := uuid.New()
+	deadline := time.Now().Add(migrationLockDuration)
+	for {
+		if locked, _ := pgSQL.Lock(ctx, migrationLockName, owner, migrationLockDuration, false); locked {
+			break
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("pgsql: could not acquire the migration lock within %v", migrationLockDuration)
+		}
+		time.Sleep(migrationLockRetry)
+	}
+	defer pgSQL.Unlock(ctx, migrationLockName, owner)
+
+	// Determine the current schema version now that we hold the lock: another instance may have
+	// already run the migrations.
+	current, err := pgSQL.schemaVersion(ctx)
+	if err != nil {
+		return fmt.Errorf("pgsql: could not determine the current schema version: %v", err)
+	}
+
+	latest := migrations[len(migrations)-1].version
+	if current > latest {
+		return fmt.Errorf("pgsql: the database schema version (%d) is newer than the most recent version supported by this binary (%d), Clair must be upgraded", current, latest)
+	}
+
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+
+		log.Infof("running database migration %d (%s)", m.version, m.name)
+		if err := pgSQL.runMigration(ctx, m); err != nil {
+			return fmt.Errorf("pgsql: an error occured while running migration %d (%s): %v", m.version, m.name, err)
+		}
+	}
+
+	log.Info("database migration ran successfully")
+	return nil
+}
+
+// checkSchemaCompatibility verifies that the schema compatibility marker stored in the database
+// matches schemaCompatibilityVersion. Databases that don't have any marker yet are considered
+// compatible.
+func (pgSQL *pgSQL) checkSchemaCompatibility(ctx context.Context) error {
+	var marker string
+	err := namedQueryRow(ctx, pgSQL, "searchKeyValue", searchKeyValue, schemaCompatibilityKey).Scan(&marker)
+	if err == sql.ErrNoRows || isErrUndefinedTable(err) {
+		return nil
+	}
+	if err != nil {
+		return handleError(ctx, "searchKeyValue", err)
+	}
+
+	found, err := strconv.Atoi(marker)
+	if err != nil || found != schemaCompatibilityVersion {
+		return &database.ErrIncompatibleSchema{Found: found, Expected: schemaCompatibilityVersion}
+	}
+
+	return nil
+}
+
+// isErrUndefinedTable determines if the given error is due to a table that doesn't exist.
+func isErrUndefinedTable(err error) bool {
+	pqErr, ok := err.(*pq.Error)
+	return ok && pqErr.Code == "42P01"
+}
+
+// runMigration executes a migration and records it in a single transaction.
+func (pgSQL *pgSQL) runMigration(ctx context.Context, m migration) error {
+	tx, err := pgSQL.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	// Migrations may legitimately take longer than the configured statement timeout.
+	if _, err = namedExec(ctx, tx, "disableStatementTimeout", disableStatementTimeout); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if _, err = tx.ExecContext(ctx, m.up); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if _, err = namedExec(ctx, tx, "insertMigration", insertMigration, m.version, m.name); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// schemaVersion returns the version of the most recent migration applied on the database.
+func (pgSQL *pgSQL) schemaVersion(ctx context.Context) (int, error) {
+	var version int
+	if err := namedQueryRow(ctx, pgSQL, "searchMigrationVersion", searchMigrationVersion).Scan(&version); err != nil {
+		return 0, handleError(ctx, "searchMigrationVersion", err)
+	}
+	return version, nil
+}
+
+const migrationInitial = `
+-- -----------------------------------------------------
+-- Table Namespace
+-- -----------------------------------------------------
+CREATE TABLE IF NOT EXISTS Namespace (
+  id SERIAL PRIMARY KEY,
+  name VARCHAR(128) NULL);
+
+
+-- -----------------------------------------------------
+-- Table Layer
+-- -----------------------------------------------------
+CREATE TABLE IF NOT EXISTS Layer (
+  id SERIAL PRIMARY KEY,
+  name VARCHAR(128) NOT NULL UNIQUE,
+  engineversion SMALLINT NOT NULL,
+  parent_id INT NULL REFERENCES Layer ON DELETE CASCADE,
+  namespace_id INT NULL REFERENCES Namespace,
+  created_at TIMESTAMP WITH TIME ZONE);
+
+CREATE INDEX ON Layer (parent_id);
+CREATE INDEX ON Layer (namespace_id);
+
+
+-- -----------------------------------------------------
+-- Table Feature
+-- -----------------------------------------------------
+CREATE TABLE IF NOT EXISTS Feature (
+  id SERIAL PRIMARY KEY,
+  namespace_id INT NOT NULL REFERENCES Namespace,
+  name VARCHAR(128) NOT NULL,
+
+  UNIQUE (namespace_id, name));
+
+
+-- -----------------------------------------------------
+-- Table FeatureVersion
+-- -----------------------------------------------------
+CREATE TABLE IF NOT EXISTS FeatureVersion (
+  id SERIAL PRIMARY KEY,
+  feature_id INT NOT NULL REFERENCES Feature,
+  version VARCHAR(128) NOT NULL);
+
+CREATE INDEX ON FeatureVersion (feature_id);
+
+
+-- -----------------------------------------------------
+-- Table Layer_diff_FeatureVersion
+-- -----------------------------------------------------
+CREATE TYPE modification AS ENUM ('add', 'del');
+
+CREATE TABLE IF NOT EXISTS Layer_diff_FeatureVersion (
+  id SERIAL PRIMARY KEY,
+  layer_id INT NOT NULL REFERENCES Layer ON DELETE CASCADE,
+  featureversion_id INT NOT NULL REFERENCES FeatureVersion,
+  modification modification NOT NULL,
+
+  UNIQUE (layer_id, featureversion_id));
+
+CREATE INDEX ON Layer_diff_FeatureVersion (layer_id);
+CREATE INDEX ON Layer_diff_FeatureVersion (featureversion_id);
+CREATE INDEX ON Layer_diff_FeatureVersion (featureversion_id, layer_id);
+
+
+-- -----------------------------------------------------
+-- Table Vulnerability
+-- -----------------------------------------------------
+CREATE TYPE severity AS ENUM ('Unknown', 'Negligible', 'Low', 'Medium', 'High', 'Critical', 'Defcon1');
+
+CREATE TABLE IF NOT EXISTS Vulnerability (
+  id SERIAL PRIMARY KEY,
+  namespace_id INT NOT NULL REFERENCES Namespace,
+  name VARCHAR(128) NOT NULL,
+  description TEXT NULL,
+  link VARCHAR(128) NULL,
+  severity severity NOT NULL,
+  metadata TEXT NULL,
+  created_at TIMESTAMP WITH TIME ZONE,
+  deleted_at TIMESTAMP WITH TIME ZONE NULL);
+
+
+-- -----------------------------------------------------
+-- Table Vulnerability_FixedIn_Feature
+-- -----------------------------------------------------
+CREATE TABLE IF NOT EXISTS Vulnerability_FixedIn_Feature (
+  id SERIAL PRIMARY KEY,
+  vulnerability_id INT NOT NULL REFERENCES Vulnerability ON DELETE CASCADE,
+  feature_id INT NOT NULL REFERENCES Feature,
+  version VARCHAR(128) NOT NULL,
+
+  UNIQUE (vulnerability_id, feature_id));
+
+CREATE INDEX ON Vulnerability_FixedIn_Feature (feature_id, vulnerability_id);
+
+
+-- -----------------------------------------------------
+-- Table Vulnerability_Affects_FeatureVersion
+-- -----------------------------------------------------
+CREATE TABLE IF NOT EXISTS Vulnerability_Affects_FeatureVersion (
+  id SERIAL PRIMARY KEY,
+  vulnerability_id INT NOT NULL REFERENCES Vulnerability ON DELETE CASCADE,
+  featureversion_id INT NOT NULL REFERENCES FeatureVersion,
+  fixedin_id INT NOT NULL REFERENCES Vulnerability_FixedIn_Feature ON DELETE CASCADE,
+
+  UNIQUE (vulnerability_id, featureversion_id));
+
+CREATE INDEX ON Vulnerability_Affects_FeatureVersion (fixedin_id);
+CREATE INDEX ON Vulnerability_Affects_FeatureVersion (featureversion_id, vulnerability_id);
+
+
+-- -----------------------------------------------------
+-- Table KeyValue
+-- -----------------------------------------------------
+CREATE TABLE IF NOT EXISTS KeyValue (
+  id SERIAL PRIMARY KEY,
+  key VARCHAR(128) NOT NULL UNIQUE,
+  value TEXT);
+
+
+-- -----------------------------------------------------
+-- Table VulnerabilityNotification
+-- -----------------------------------------------------
+CREATE TABLE IF NOT EXISTS Vulnerability_Notification (
+  id SERIAL PRIMARY KEY,
+  name VARCHAR(64) NOT NULL UNIQUE,
+  created_at TIMESTAMP WITH TIME ZONE,
+  notified_at TIMESTAMP WITH TIME ZONE NULL,
+  deleted_at TIMESTAMP WITH TIME ZONE NULL,
+  old_vulnerability_id INT NULL REFERENCES Vulnerability ON DELETE CASCADE,
+  new_vulnerability_id INT NULL REFERENCES Vulnerability ON DELETE CASCADE);
+
+CREATE INDEX ON Vulnerability_Notification (notified_at);
+`
+
+// migrationMetadataJSONB stores the metadata of vulnerabilities as JSONB, so PostgreSQL validates
+// them and they can be queried.
+const migrationMetadataJSONB = `
+ALTER TABLE Vulnerability
+  ALTER COLUMN metadata TYPE JSONB USING NULLIF(metadata, '')::JSONB;
+`
+
+// migrationVulnerabilityLinks adds the list of references of vulnerabilities, which is initialized
+// with their primary link.
+const migrationVulnerabilityLinks = `
+ALTER TABLE Vulnerability
+  ADD COLUMN links JSONB NULL;
+
+UPDATE Vulnerability
+  SET links = array_to_json(ARRAY[link])::JSONB
+  WHERE link IS NOT NULL AND link <> '';
+`
+
+// migrationVulnerabilityHistory adds the table that records the changes of vulnerabilities.
+// Rows are not tied to a Vulnerability row, as a new one is created every time a vulnerability
+// is modified.
+const migrationVulnerabilityHistory = `
+CREATE TABLE IF NOT EXISTS Vulnerability_History (
+  id SERIAL PRIMARY KEY,
+  namespace_id INT NOT NULL REFERENCES Namespace,
+  name VARCHAR(128) NOT NULL,
+  created_at TIMESTAMP WITH TIME ZONE,
+  source VARCHAR(128) NOT NULL,
+  old_severity severity NOT NULL,
+  new_severity severity NOT NULL,
+  feature_name VARCHAR(128) NOT NULL,
+  old_fixedby VARCHAR(128) NOT NULL,
+  new_fixedby VARCHAR(128) NOT NULL);
+
+CREATE INDEX ON Vulnerability_History (namespace_id, name, id);
+`
+
+// migrationLayerDetectors adds the table that records the detectors that processed each layer.
+// Layers indexed before have no detectors, and are thus reported as missing all of them.
+const migrationLayerDetectors = `
+CREATE TABLE IF NOT EXISTS Layer_Detector (
+  id SERIAL PRIMARY KEY,
+  layer_id INT NOT NULL REFERENCES Layer ON DELETE CASCADE,
+  detector VARCHAR(128) NOT NULL,
+
+  UNIQUE (layer_id, detector));
+
+CREATE INDEX ON Layer_Detector (detector, layer_id);
+`
+
+// migrationNamespaceVersionFormat records the format of the package versions of each namespace,
+// which tells how they compare, and guesses it from the names of the existing namespaces.
+const migrationNamespaceVersionFormat = `
+ALTER TABLE Namespace ADD COLUMN version_format VARCHAR(16) NULL;
+
+UPDATE Namespace
+SET version_format = CASE split_part(name, ':', 1)
+  WHEN 'debian' THEN 'dpkg'
+  WHEN 'ubuntu' THEN 'dpkg'
+  WHEN 'centos' THEN 'rpm'
+  WHEN 'rhel' THEN 'rpm'
+  WHEN 'fedora' THEN 'rpm'
+  WHEN 'oracle' THEN 'rpm'
+  WHEN 'scientific' THEN 'rpm'
+  WHEN 'alpine' THEN 'apk'
+END;
+`
+
+// migrationLayerNamespaces adds the table that records every namespace of each layer, as a layer
+// may contain packages of several ecosystems. Layer.namespace_id remains the primary namespace,
+// and is recorded as the only namespace of the existing layers.
+const migrationLayerNamespaces = `
+CREATE TABLE IF NOT EXISTS Layer_Namespace (
+  id SERIAL PRIMARY KEY,
+  layer_id INT NOT NULL REFERENCES Layer ON DELETE CASCADE,
+  namespace_id INT NOT NULL REFERENCES Namespace,
+
+  UNIQUE (layer_id, namespace_id));
+
+CREATE INDEX ON Layer_Namespace (namespace_id);
+
+INSERT INTO Layer_Namespace(layer_id, namespace_id)
+  SELECT id, namespace_id FROM Layer WHERE namespace_id IS NOT NULL ORDER BY id;
+`
+
+// migrationLayerReindexing records where the archive of each layer comes from, so that a newer
+// engine can analyze it again, and flags the layers for which this is impossible. The existing
+// layers have no known archive.
+const migrationLayerReindexing = `
+ALTER TABLE Layer
+  ADD COLUMN path TEXT NULL,
+  ADD COLUMN format VARCHAR(64) NULL,
+  ADD COLUMN stale BOOLEAN NOT NULL DEFAULT false;
+`
+
+// migrationLayerNameLength lets the layer names be as long as database.MaxLayerNameLength.
+const migrationLayerNameLength = `
+ALTER TABLE Layer ALTER COLUMN name TYPE VARCHAR(256);
+`
+
+// migrationVulnerabilityUniqueName ensures that a single version of each vulnerability is the
+// latest one, so that concurrent creations can't both succeed. The older duplicates that such
+// creations may have stored are marked as deleted.
+const migrationVulnerabilityUniqueName = `
+UPDATE Vulnerability v SET deleted_at = CURRENT_TIMESTAMP
+  WHERE v.deleted_at IS NULL AND EXISTS (
+    SELECT 1 FROM Vulnerability newer
+    WHERE newer.namespace_id = v.namespace_id AND newer.name = v.name
+      AND newer.deleted_at IS NULL AND newer.id > v.id);
+
+CREATE UNIQUE INDEX vulnerability_latest_name ON Vulnerability (namespace_id, name) WHERE deleted_at IS NULL;
+`
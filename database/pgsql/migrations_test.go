@@ -0,0 +1,87 @@
+// Copyright 2015 clair authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pgsql
+
+import (
+	"context"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/coreos/clair/database"
+	cerrors "github.com/coreos/clair/utils/errors"
+)
+
+func TestMigrations(t *testing.T) {
+	datastore, err := openDatabaseForTest("Migrations", false)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer datastore.Close()
+
+	latest := migrations[len(migrations)-1].version
+
+	// Opening the database should have applied every migration.
+	version, err := datastore.schemaVersion(context.Background())
+	if assert.Nil(t, err) {
+		assert.Equal(t, latest, version)
+	}
+
+	// Running the migrations again should be a no-op.
+	assert.Nil(t, datastore.migrate(context.Background()))
+	var count int
+	err = datastore.QueryRow("SELECT COUNT(*) FROM schema_migrations").Scan(&count)
+	if assert.Nil(t, err) {
+		assert.Equal(t, len(migrations), count)
+	}
+
+	// The migration lock should have been released.
+	_, _, err = datastore.FindLock(context.Background(), migrationLockName)
+	assert.Equal(t, cerrors.ErrNotFound, err)
+
+	// A schema that is newer than the binary must be refused.
+	_, err = datastore.Exec(insertMigration, latest+1, "FromTheFuture")
+	assert.Nil(t, err)
+	assert.NotNil(t, datastore.migrate(context.Background()))
+}
+
+func TestSchemaCompatibility(t *testing.T) {
+	datastore, err := openDatabaseForTest("SchemaCompatibility", false)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer datastore.Close()
+
+	// Opening the database should have stored the marker.
+	marker, err := datastore.GetKeyValue(context.Background(), schemaCompatibilityKey)
+	if assert.Nil(t, err) {
+		assert.Equal(t, strconv.Itoa(schemaCompatibilityVersion), marker)
+	}
+	assert.Nil(t, datastore.checkSchemaCompatibility(context.Background()))
+
+	// Older and newer markers are refused.
+	for _, version := range []int{schemaCompatibilityVersion - 1, schemaCompatibilityVersion + 1} {
+		assert.Nil(t, datastore.InsertKeyValue(context.Background(), schemaCompatibilityKey, strconv.Itoa(version)))
+
+		err = datastore.checkSchemaCompatibility(context.Background())
+		if assert.IsType(t, &database.ErrIncompatibleSchema{}, err) {
+			assert.Equal(t, version, err.(*database.ErrIncompatibleSchema).Found)
+			assert.Equal(t, schemaCompatibilityVersion, err.(*database.ErrIncompatibleSchema).Expected)
+		}
+	}
+}
@@ -15,61 +15,105 @@
 package pgsql
 
 import (
+	"context"
+	"database/sql"
 	"time"
 
+	"github.com/guregu/null/zero"
+
 	"github.com/coreos/clair/database"
 	cerrors "github.com/coreos/clair/utils/errors"
+	"github.com/coreos/clair/utils/types"
 )
 
-func (pgSQL *pgSQL) insertNamespace(namespace database.Namespace) (int, error) {
+func (pgSQL *pgSQL) insertNamespace(ctx context.Context, namespace database.Namespace) (int, error) {
 	if namespace.Name == "" {
 		return 0, cerrors.NewBadRequestError("could not find/insert invalid Namespace")
 	}
 
-	if pgSQL.cache != nil {
-		promCacheQueriesTotal.WithLabelValues("namespace").Inc()
-		if id, found := pgSQL.cache.Get("namespace:" + namespace.Name); found {
-			promCacheHitsTotal.WithLabelValues("namespace").Inc()
-			return id.(int), nil
-		}
+	if id, found := pgSQL.getCached("namespace", namespaceCacheKey(namespace.Name, namespace.VersionFormat)); found {
+		return id, nil
 	}
 
 	// We do `defer observeQueryTime` here because we don't want to observe cached namespaces.
 	defer observeQueryTime("insertNamespace", "all", time.Now())
 
 	var id int
-	err := pgSQL.QueryRow(soiNamespace, namespace.Name).Scan(&id)
+	err := namedQueryRow(ctx, pgSQL, "soiNamespace", soiNamespace, namespace.Name, string(namespace.VersionFormat)).Scan(&id)
 	if err != nil {
-		return 0, handleError("soiNamespace", err)
+		return 0, handleError(ctx, "soiNamespace", err)
 	}
 
-	if pgSQL.cache != nil {
-		pgSQL.cache.Add("namespace:"+namespace.Name, id)
-	}
+	pgSQL.addCached(namespaceCacheKey(namespace.Name, namespace.VersionFormat), id)
 
 	return id, nil
 }
 
-func (pgSQL *pgSQL) ListNamespaces() (namespaces []database.Namespace, err error) {
-	rows, err := pgSQL.Query(listNamespace)
+func (pgSQL *pgSQL) ListNamespaces(ctx context.Context) (namespaces []database.Namespace, err error) {
+	rows, err := namedQuery(ctx, pgSQL.readonly(ctx), "listNamespace", listNamespace)
 	if err != nil {
-		return namespaces, handleError("listNamespace", err)
+		return namespaces, handleError(ctx, "listNamespace", err)
 	}
 	defer rows.Close()
 
 	for rows.Next() {
 		var namespace database.Namespace
+		var versionFormat zero.String
 
-		err = rows.Scan(&namespace.ID, &namespace.Name)
+		err = rows.Scan(&namespace.ID, &namespace.Name, &versionFormat)
 		if err != nil {
-			return namespaces, handleError("listNamespace.Scan()", err)
+			return namespaces, handleError(ctx, "listNamespace.Scan()", err)
 		}
 
+		namespace.VersionFormat = types.VersionFormat(versionFormat.String)
 		namespaces = append(namespaces, namespace)
 	}
 	if err = rows.Err(); err != nil {
-		return namespaces, handleError("listNamespace.Rows()", err)
+		return namespaces, handleError(ctx, "listNamespace.Rows()", err)
 	}
 
 	return namespaces, err
 }
+
+func (pgSQL *pgSQL) CountVulnerabilitiesByNamespace(ctx context.Context) (map[string]int, error) {
+	defer observeQueryTime("CountVulnerabilitiesByNamespace", "all", time.Now())
+
+	rows, err := namedQuery(ctx, pgSQL.readonly(ctx), "countVulnerabilityByNamespace", countVulnerabilityByNamespace)
+	if err != nil {
+		return nil, handleError(ctx, "countVulnerabilityByNamespace", err)
+	}
+	defer rows.Close()
+
+	counts := make(map[string]int)
+	for rows.Next() {
+		var name string
+		var count int
+		if err = rows.Scan(&name, &count); err != nil {
+			return nil, handleError(ctx, "countVulnerabilityByNamespace.Scan()", err)
+		}
+		counts[name] = count
+	}
+	if err = rows.Err(); err != nil {
+		return nil, handleError(ctx, "countVulnerabilityByNamespace.Rows()", err)
+	}
+
+	return counts, nil
+}
+
+func (pgSQL *pgSQL) GetLastVulnerabilityChange(ctx context.Context, namespaceName string) (time.Time, error) {
+	defer observeQueryTime("GetLastVulnerabilityChange", "all", time.Now())
+
+	var created, deleted zero.Time
+	err := namedQueryRow(ctx, pgSQL.readonly(ctx), "searchLastVulnerabilityChange", searchLastVulnerabilityChange, namespaceName).Scan(&created, &deleted)
+	if err == sql.ErrNoRows {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, handleError(ctx, "searchLastVulnerabilityChange", err)
+	}
+
+	if deleted.Time.After(created.Time) {
+		return deleted.Time, nil
+	}
+	return created.Time, nil
+}
@@ -15,6 +15,7 @@
 package pgsql
 
 import (
+	"context"
 	"fmt"
 	"testing"
 
@@ -32,14 +33,14 @@ func TestInsertNamespace(t *testing.T) {
 	defer datastore.Close()
 
 	// Invalid Namespace.
-	id0, err := datastore.insertNamespace(database.Namespace{})
+	id0, err := datastore.insertNamespace(context.Background(), database.Namespace{})
 	assert.NotNil(t, err)
 	assert.Zero(t, id0)
 
 	// Insert Namespace and ensure we can find it.
-	id1, err := datastore.insertNamespace(database.Namespace{Name: "TestInsertNamespace1"})
+	id1, err := datastore.insertNamespace(context.Background(), database.Namespace{Name: "TestInsertNamespace1"})
 	assert.Nil(t, err)
-	id2, err := datastore.insertNamespace(database.Namespace{Name: "TestInsertNamespace1"})
+	id2, err := datastore.insertNamespace(context.Background(), database.Namespace{Name: "TestInsertNamespace1"})
 	assert.Nil(t, err)
 	assert.Equal(t, id1, id2)
 }
@@ -52,7 +53,7 @@ func TestListNamespace(t *testing.T) {
 	}
 	defer datastore.Close()
 
-	namespaces, err := datastore.ListNamespaces()
+	namespaces, err := datastore.ListNamespaces(context.Background())
 	assert.Nil(t, err)
 	if assert.Len(t, namespaces, 2) {
 		for _, namespace := range namespaces {
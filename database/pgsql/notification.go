@@ -15,55 +15,129 @@
 package pgsql
 
 import (
+	"context"
 	"database/sql"
 	"time"
 
 	"github.com/coreos/clair/database"
 	cerrors "github.com/coreos/clair/utils/errors"
 	"github.com/guregu/null/zero"
+	"github.com/lib/pq"
 	"github.com/pborman/uuid"
 )
 
+const (
+	// notificationChannel is the PostgreSQL channel on which the name of every new Notification
+	// is sent.
+	notificationChannel = "clair_notification"
+
+	listenerMinReconnectInterval = time.Second
+	listenerMaxReconnectInterval = time.Minute
+	listenerPingInterval         = time.Minute
+)
+
 // do it in tx so we won't insert/update a vuln without notification and vice-versa.
 // name and created doesn't matter.
-func createNotification(tx *sql.Tx, oldVulnerabilityID, newVulnerabilityID int) error {
+func createNotification(ctx context.Context, tx *sql.Tx, oldVulnerabilityID, newVulnerabilityID int) error {
 	defer observeQueryTime("createNotification", "all", time.Now())
 
 	// Insert Notification.
 	oldVulnerabilityNullableID := sql.NullInt64{Int64: int64(oldVulnerabilityID), Valid: oldVulnerabilityID != 0}
 	newVulnerabilityNullableID := sql.NullInt64{Int64: int64(newVulnerabilityID), Valid: newVulnerabilityID != 0}
-	_, err := tx.Exec(insertNotification, uuid.New(), oldVulnerabilityNullableID, newVulnerabilityNullableID)
+	name := uuid.New()
+	_, err := namedExec(ctx, tx, "insertNotification", insertNotification, name, oldVulnerabilityNullableID, newVulnerabilityNullableID)
 	if err != nil {
 		tx.Rollback()
-		return handleError("insertNotification", err)
+		return handleError(ctx, "insertNotification", err)
+	}
+
+	// Wake up the listeners. PostgreSQL delivers it only if the transaction commits.
+	_, err = namedExec(ctx, tx, "notifyNotification", notifyNotification, name)
+	if err != nil {
+		tx.Rollback()
+		return handleError(ctx, "notifyNotification", err)
 	}
 
 	return nil
 }
 
+// ListenNotifications implements database.NotificationListener using a dedicated connection
+// that LISTENs on notificationChannel. The connection is re-established automatically when it is
+// lost.
+func (pgSQL *pgSQL) ListenNotifications(ctx context.Context) (<-chan struct{}, error) {
+	listener := pq.NewListener(pgSQL.config.Source, listenerMinReconnectInterval, listenerMaxReconnectInterval, func(event pq.ListenerEventType, err error) {
+		switch event {
+		case pq.ListenerEventDisconnected, pq.ListenerEventConnectionAttemptFailed:
+			log.Warningf("notification listener: connection lost: %s", err)
+		case pq.ListenerEventReconnected:
+			log.Info("notification listener: connection re-established")
+		}
+	})
+
+	// Listen blocks until the connection is established, which may never happen.
+	listening := make(chan error, 1)
+	go func() { listening <- listener.Listen(notificationChannel) }()
+	select {
+	case err := <-listening:
+		if err != nil {
+			listener.Close()
+			return nil, handleError(ctx, "ListenNotifications.Listen()", err)
+		}
+	case <-ctx.Done():
+		listener.Close()
+		return nil, ctx.Err()
+	}
+
+	wake := make(chan struct{}, 1)
+	go func() {
+		defer listener.Close()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-listener.Notify:
+				// A nil notification is received once the connection has been re-established and
+				// LISTEN issued again: notifications may have been missed in the meantime, so the
+				// receiver has to catch up anyway.
+				select {
+				case wake <- struct{}{}:
+				default:
+				}
+			case <-time.After(listenerPingInterval):
+				// Detect dead connections that haven't been closed properly.
+				go listener.Ping()
+			}
+		}
+	}()
+
+	return wake, nil
+}
+
 // Get one available notification name (!locked && !deleted && (!notified || notified_but_timed-out)).
 // Does not fill new/old vuln.
-func (pgSQL *pgSQL) GetAvailableNotification(renotifyInterval time.Duration) (database.VulnerabilityNotification, error) {
+func (pgSQL *pgSQL) GetAvailableNotification(ctx context.Context, renotifyInterval time.Duration) (database.VulnerabilityNotification, error) {
 	defer observeQueryTime("GetAvailableNotification", "all", time.Now())
 
 	before := time.Now().Add(-renotifyInterval)
-	row := pgSQL.QueryRow(searchNotificationAvailable, before)
-	notification, err := pgSQL.scanNotification(row, false)
+	row := namedQueryRow(ctx, pgSQL, "searchNotificationAvailable", searchNotificationAvailable, before)
+	notification, err := pgSQL.scanNotification(ctx, row, false)
 
-	return notification, handleError("searchNotificationAvailable", err)
+	return notification, handleError(ctx, "searchNotificationAvailable", err)
 }
 
-func (pgSQL *pgSQL) GetNotification(name string, limit int, page database.VulnerabilityNotificationPageNumber) (database.VulnerabilityNotification, database.VulnerabilityNotificationPageNumber, error) {
+func (pgSQL *pgSQL) GetNotification(ctx context.Context, name string, limit int, page database.VulnerabilityNotificationPageNumber) (database.VulnerabilityNotification, database.VulnerabilityNotificationPageNumber, error) {
 	defer observeQueryTime("GetNotification", "all", time.Now())
 
 	// Get Notification.
-	notification, err := pgSQL.scanNotification(pgSQL.QueryRow(searchNotification, name), true)
+	notification, err := pgSQL.scanNotification(ctx, namedQueryRow(ctx, pgSQL, "searchNotification", searchNotification, name), true)
 	if err != nil {
-		return notification, page, handleError("searchNotification", err)
+		return notification, page, handleError(ctx, "searchNotification", err)
 	}
 
 	// Load vulnerabilities' LayersIntroducingVulnerability.
 	page.OldVulnerability, err = pgSQL.loadLayerIntroducingVulnerability(
+		ctx,
 		notification.OldVulnerability,
 		limit,
 		page.OldVulnerability,
@@ -74,6 +148,7 @@ func (pgSQL *pgSQL) GetNotification(name string, limit int, page database.Vulner
 	}
 
 	page.NewVulnerability, err = pgSQL.loadLayerIntroducingVulnerability(
+		ctx,
 		notification.NewVulnerability,
 		limit,
 		page.NewVulnerability,
@@ -86,7 +161,7 @@ func (pgSQL *pgSQL) GetNotification(name string, limit int, page database.Vulner
 	return notification, page, nil
 }
 
-func (pgSQL *pgSQL) scanNotification(row *sql.Row, hasVulns bool) (database.VulnerabilityNotification, error) {
+func (pgSQL *pgSQL) scanNotification(ctx context.Context, row *sql.Row, hasVulns bool) (database.VulnerabilityNotification, error) {
 	var notification database.VulnerabilityNotification
 	var created zero.Time
 	var notified zero.Time
@@ -123,7 +198,7 @@ func (pgSQL *pgSQL) scanNotification(row *sql.Row, hasVulns bool) (database.Vuln
 
 	if hasVulns {
 		if oldVulnerabilityNullableID.Valid {
-			vulnerability, err := pgSQL.findVulnerabilityByIDWithDeleted(int(oldVulnerabilityNullableID.Int64))
+			vulnerability, err := pgSQL.findVulnerabilityByIDWithDeleted(ctx, int(oldVulnerabilityNullableID.Int64))
 			if err != nil {
 				return notification, err
 			}
@@ -132,7 +207,7 @@ func (pgSQL *pgSQL) scanNotification(row *sql.Row, hasVulns bool) (database.Vuln
 		}
 
 		if newVulnerabilityNullableID.Valid {
-			vulnerability, err := pgSQL.findVulnerabilityByIDWithDeleted(int(newVulnerabilityNullableID.Int64))
+			vulnerability, err := pgSQL.findVulnerabilityByIDWithDeleted(ctx, int(newVulnerabilityNullableID.Int64))
 			if err != nil {
 				return notification, err
 			}
@@ -147,7 +222,7 @@ func (pgSQL *pgSQL) scanNotification(row *sql.Row, hasVulns bool) (database.Vuln
 // Fills Vulnerability.LayersIntroducingVulnerability.
 // limit -1: won't do anything
 // limit 0: will just get the startID of the second page
-func (pgSQL *pgSQL) loadLayerIntroducingVulnerability(vulnerability *database.Vulnerability, limit, startID int) (int, error) {
+func (pgSQL *pgSQL) loadLayerIntroducingVulnerability(ctx context.Context, vulnerability *database.Vulnerability, limit, startID int) (int, error) {
 	tf := time.Now()
 
 	if vulnerability == nil {
@@ -163,10 +238,10 @@ func (pgSQL *pgSQL) loadLayerIntroducingVulnerability(vulnerability *database.Vu
 	defer observeQueryTime("loadLayerIntroducingVulnerability", "all", tf)
 
 	// Query with limit + 1, the last item will be used to know the next starting ID.
-	rows, err := pgSQL.Query(searchNotificationLayerIntroducingVulnerability,
+	rows, err := namedQuery(ctx, pgSQL, "searchNotificationLayerIntroducingVulnerability", searchNotificationLayerIntroducingVulnerability,
 		vulnerability.ID, startID, limit+1)
 	if err != nil {
-		return 0, handleError("searchNotificationLayerIntroducingVulnerability", err)
+		return 0, handleError(ctx, "searchNotificationLayerIntroducingVulnerability", err)
 	}
 	defer rows.Close()
 
@@ -175,13 +250,13 @@ func (pgSQL *pgSQL) loadLayerIntroducingVulnerability(vulnerability *database.Vu
 		var layer database.Layer
 
 		if err := rows.Scan(&layer.ID, &layer.Name); err != nil {
-			return -1, handleError("searchNotificationLayerIntroducingVulnerability.Scan()", err)
+			return -1, handleError(ctx, "searchNotificationLayerIntroducingVulnerability.Scan()", err)
 		}
 
 		layers = append(layers, layer)
 	}
 	if err = rows.Err(); err != nil {
-		return -1, handleError("searchNotificationLayerIntroducingVulnerability.Rows()", err)
+		return -1, handleError(ctx, "searchNotificationLayerIntroducingVulnerability.Rows()", err)
 	}
 
 	size := limit
@@ -198,26 +273,26 @@ func (pgSQL *pgSQL) loadLayerIntroducingVulnerability(vulnerability *database.Vu
 	return nextID, nil
 }
 
-func (pgSQL *pgSQL) SetNotificationNotified(name string) error {
+func (pgSQL *pgSQL) SetNotificationNotified(ctx context.Context, name string) error {
 	defer observeQueryTime("SetNotificationNotified", "all", time.Now())
 
-	if _, err := pgSQL.Exec(updatedNotificationNotified, name); err != nil {
-		return handleError("updatedNotificationNotified", err)
+	if _, err := namedExec(ctx, pgSQL, "updatedNotificationNotified", updatedNotificationNotified, name); err != nil {
+		return handleError(ctx, "updatedNotificationNotified", err)
 	}
 	return nil
 }
 
-func (pgSQL *pgSQL) DeleteNotification(name string) error {
+func (pgSQL *pgSQL) DeleteNotification(ctx context.Context, name string) error {
 	defer observeQueryTime("DeleteNotification", "all", time.Now())
 
-	result, err := pgSQL.Exec(removeNotification, name)
+	result, err := namedExec(ctx, pgSQL, "removeNotification", removeNotification, name)
 	if err != nil {
-		return handleError("removeNotification", err)
+		return handleError(ctx, "removeNotification", err)
 	}
 
 	affected, err := result.RowsAffected()
 	if err != nil {
-		return handleError("removeNotification.RowsAffected()", err)
+		return handleError(ctx, "removeNotification.RowsAffected()", err)
 	}
 
 	if affected <= 0 {
@@ -15,6 +15,7 @@
 package pgsql
 
 import (
+	"context"
 	"testing"
 	"time"
 
@@ -34,7 +35,7 @@ func TestNotification(t *testing.T) {
 	defer datastore.Close()
 
 	// Try to get a notification when there is none.
-	_, err = datastore.GetAvailableNotification(time.Second)
+	_, err = datastore.GetAvailableNotification(context.Background(), time.Second)
 	assert.Equal(t, cerrors.ErrNotFound, err)
 
 	// Create some data.
@@ -88,10 +89,10 @@ func TestNotification(t *testing.T) {
 		},
 	}
 
-	if !assert.Nil(t, datastore.InsertLayer(l1)) ||
-		!assert.Nil(t, datastore.InsertLayer(l2)) ||
-		!assert.Nil(t, datastore.InsertLayer(l3)) ||
-		!assert.Nil(t, datastore.InsertLayer(l4)) {
+	if !assert.Nil(t, datastore.InsertLayer(context.Background(), l1)) ||
+		!assert.Nil(t, datastore.InsertLayer(context.Background(), l2)) ||
+		!assert.Nil(t, datastore.InsertLayer(context.Background(), l3)) ||
+		!assert.Nil(t, datastore.InsertLayer(context.Background(), l4)) {
 		return
 	}
 
@@ -109,27 +110,27 @@ func TestNotification(t *testing.T) {
 			},
 		},
 	}
-	assert.Nil(t, datastore.insertVulnerability(v1, false, true))
+	assert.Nil(t, datastore.insertVulnerability(context.Background(), v1, nil, false, true))
 
 	// Get the notification associated to the previously inserted vulnerability.
-	notification, err := datastore.GetAvailableNotification(time.Second)
+	notification, err := datastore.GetAvailableNotification(context.Background(), time.Second)
 
 	if assert.Nil(t, err) && assert.NotEmpty(t, notification.Name) {
 		// Verify the renotify behaviour.
-		if assert.Nil(t, datastore.SetNotificationNotified(notification.Name)) {
-			_, err := datastore.GetAvailableNotification(time.Second)
+		if assert.Nil(t, datastore.SetNotificationNotified(context.Background(), notification.Name)) {
+			_, err := datastore.GetAvailableNotification(context.Background(), time.Second)
 			assert.Equal(t, cerrors.ErrNotFound, err)
 
 			time.Sleep(50 * time.Millisecond)
-			notificationB, err := datastore.GetAvailableNotification(20 * time.Millisecond)
+			notificationB, err := datastore.GetAvailableNotification(context.Background(), 20*time.Millisecond)
 			assert.Nil(t, err)
 			assert.Equal(t, notification.Name, notificationB.Name)
 
-			datastore.SetNotificationNotified(notification.Name)
+			datastore.SetNotificationNotified(context.Background(), notification.Name)
 		}
 
 		// Get notification.
-		filledNotification, nextPage, err := datastore.GetNotification(notification.Name, 2, database.VulnerabilityNotificationFirstPage)
+		filledNotification, nextPage, err := datastore.GetNotification(context.Background(), notification.Name, 2, database.VulnerabilityNotificationFirstPage)
 		if assert.Nil(t, err) {
 			assert.NotEqual(t, database.NoVulnerabilityNotificationPage, nextPage)
 			assert.Nil(t, filledNotification.OldVulnerability)
@@ -141,7 +142,7 @@ func TestNotification(t *testing.T) {
 		}
 
 		// Get second page.
-		filledNotification, nextPage, err = datastore.GetNotification(notification.Name, 2, nextPage)
+		filledNotification, nextPage, err = datastore.GetNotification(context.Background(), notification.Name, 2, nextPage)
 		if assert.Nil(t, err) {
 			assert.Equal(t, database.NoVulnerabilityNotificationPage, nextPage)
 			assert.Nil(t, filledNotification.OldVulnerability)
@@ -153,9 +154,9 @@ func TestNotification(t *testing.T) {
 		}
 
 		// Delete notification.
-		assert.Nil(t, datastore.DeleteNotification(notification.Name))
+		assert.Nil(t, datastore.DeleteNotification(context.Background(), notification.Name))
 
-		_, err = datastore.GetAvailableNotification(time.Millisecond)
+		_, err = datastore.GetAvailableNotification(context.Background(), time.Millisecond)
 		assert.Equal(t, cerrors.ErrNotFound, err)
 	}
 
@@ -173,13 +174,13 @@ func TestNotification(t *testing.T) {
 		},
 	}
 
-	if assert.Nil(t, datastore.insertVulnerability(v1b, false, true)) {
-		notification, err = datastore.GetAvailableNotification(time.Second)
+	if assert.Nil(t, datastore.insertVulnerability(context.Background(), v1b, nil, false, true)) {
+		notification, err = datastore.GetAvailableNotification(context.Background(), time.Second)
 		assert.Nil(t, err)
 		assert.NotEmpty(t, notification.Name)
 
 		if assert.Nil(t, err) && assert.NotEmpty(t, notification.Name) {
-			filledNotification, nextPage, err := datastore.GetNotification(notification.Name, 2, database.VulnerabilityNotificationFirstPage)
+			filledNotification, nextPage, err := datastore.GetNotification(context.Background(), notification.Name, 2, database.VulnerabilityNotificationFirstPage)
 			if assert.Nil(t, err) {
 				if assert.NotNil(t, filledNotification.OldVulnerability) {
 					assert.Equal(t, v1.Name, filledNotification.OldVulnerability.Name)
@@ -196,18 +197,18 @@ func TestNotification(t *testing.T) {
 				assert.Equal(t, -1, nextPage.NewVulnerability)
 			}
 
-			assert.Nil(t, datastore.DeleteNotification(notification.Name))
+			assert.Nil(t, datastore.DeleteNotification(context.Background(), notification.Name))
 		}
 	}
 
 	// Delete a vulnerability and verify the notification.
-	if assert.Nil(t, datastore.DeleteVulnerability(v1b.Namespace.Name, v1b.Name)) {
-		notification, err = datastore.GetAvailableNotification(time.Second)
+	if assert.Nil(t, datastore.DeleteVulnerability(context.Background(), v1b.Namespace.Name, v1b.Name)) {
+		notification, err = datastore.GetAvailableNotification(context.Background(), time.Second)
 		assert.Nil(t, err)
 		assert.NotEmpty(t, notification.Name)
 
 		if assert.Nil(t, err) && assert.NotEmpty(t, notification.Name) {
-			filledNotification, _, err := datastore.GetNotification(notification.Name, 2, database.VulnerabilityNotificationFirstPage)
+			filledNotification, _, err := datastore.GetNotification(context.Background(), notification.Name, 2, database.VulnerabilityNotificationFirstPage)
 			if assert.Nil(t, err) {
 				assert.Nil(t, filledNotification.NewVulnerability)
 
@@ -218,7 +219,44 @@ func TestNotification(t *testing.T) {
 				}
 			}
 
-			assert.Nil(t, datastore.DeleteNotification(notification.Name))
+			assert.Nil(t, datastore.DeleteNotification(context.Background(), notification.Name))
 		}
 	}
 }
+
+func TestListenNotifications(t *testing.T) {
+	datastore, err := openDatabaseForTest("ListenNotifications", false)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer datastore.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	wake, err := datastore.ListenNotifications(ctx)
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	// Nothing is signaled until a notification is created.
+	select {
+	case <-wake:
+		t.Error("ListenNotifications signaled before any notification was created")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	vulnerability := database.Vulnerability{
+		Name:      "TestListenNotificationsVulnerability",
+		Namespace: database.Namespace{Name: "TestListenNotificationsNamespace"},
+		Severity:  types.High,
+	}
+	assert.Nil(t, datastore.InsertVulnerabilities(ctx, []database.Vulnerability{vulnerability}, true))
+
+	select {
+	case <-wake:
+	case <-time.After(time.Second):
+		t.Error("ListenNotifications didn't signal the new notification within a second")
+	}
+}
@@ -16,16 +16,19 @@
 package pgsql
 
 import (
+	"context"
 	"database/sql"
+	"database/sql/driver"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/url"
-	"path/filepath"
-	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
-	"bitbucket.org/liamstask/goose/lib/goose"
 	"github.com/coreos/pkg/capnslog"
 	"github.com/hashicorp/golang-lru"
 	"github.com/lib/pq"
@@ -56,6 +59,21 @@ var (
 		Help: "Number of cache queries that the PostgreSQL backend did.",
 	}, []string{"object"})
 
+	promCacheEvictionsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "clair_pgsql_cache_evictions_total",
+		Help: "Number of elements that the PostgreSQL backend removed from its cache.",
+	}, []string{"reason"})
+
+	promCacheSize = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "clair_pgsql_cache_size",
+		Help: "Number of elements in the cache of the PostgreSQL backend.",
+	})
+
+	promUnknownSeveritiesTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "clair_pgsql_unknown_severities_total",
+		Help: "Number of vulnerabilities whose unknown Severity has been stored as Unknown.",
+	})
+
 	promQueryDurationMilliseconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
 		Name: "clair_pgsql_query_duration_milliseconds",
 		Help: "Time it takes to execute the database query.",
@@ -65,45 +83,132 @@ var (
 		Name: "clair_pgsql_concurrent_lock_vafv_total",
 		Help: "Number of transactions trying to hold the exclusive Vulnerability_Affects_FeatureVersion lock.",
 	})
+
+	promNamedQueryDurationMilliseconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "clair_pgsql_named_query_duration_milliseconds",
+		Help: "Time it takes to execute a single SQL query.",
+	}, []string{"query"})
+
+	promNamedQueryErrorsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "clair_pgsql_named_query_errors_total",
+		Help: "Number of errors that a single SQL query generated.",
+	}, []string{"query"})
+
+	promTransactionRetriesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "clair_pgsql_transaction_retries_total",
+		Help: "Number of times a transaction has been retried because of a serialization failure or a deadlock.",
+	}, []string{"transaction"})
+
+	promPoolOpenConnections = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "clair_pgsql_pool_open_connections",
+		Help: "Number of established connections to PostgreSQL, both in use and idle.",
+	}, func() float64 { return float64(poolStats().OpenConnections) })
+
+	promPoolInUseConnections = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "clair_pgsql_pool_in_use_connections",
+		Help: "Number of connections to PostgreSQL that are currently in use.",
+	}, func() float64 { return float64(poolStats().InUse) })
+
+	promPoolIdleConnections = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "clair_pgsql_pool_idle_connections",
+		Help: "Number of idle connections to PostgreSQL.",
+	}, func() float64 { return float64(poolStats().Idle) })
+
+	promPoolWaitCount = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "clair_pgsql_pool_wait_count",
+		Help: "Total number of times a query waited for a connection to PostgreSQL.",
+	}, func() float64 { return float64(poolStats().WaitCount) })
+
+	promPoolWaitDurationMilliseconds = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "clair_pgsql_pool_wait_duration_milliseconds",
+		Help: "Total time queries waited for a connection to PostgreSQL.",
+	}, func() float64 { return float64(poolStats().WaitDuration / time.Millisecond) })
+
+	// pooledDB is the connection pool whose statistics are exposed to Prometheus.
+	pooledDB     *sql.DB
+	pooledDBLock sync.Mutex
 )
 
 func init() {
 	prometheus.MustRegister(promErrorsTotal)
 	prometheus.MustRegister(promCacheHitsTotal)
 	prometheus.MustRegister(promCacheQueriesTotal)
+	prometheus.MustRegister(promCacheEvictionsTotal)
+	prometheus.MustRegister(promCacheSize)
+	prometheus.MustRegister(promUnknownSeveritiesTotal)
 	prometheus.MustRegister(promQueryDurationMilliseconds)
 	prometheus.MustRegister(promConcurrentLockVAFV)
+	prometheus.MustRegister(promNamedQueryDurationMilliseconds)
+	prometheus.MustRegister(promNamedQueryErrorsTotal)
+	prometheus.MustRegister(promTransactionRetriesTotal)
+	prometheus.MustRegister(promPoolOpenConnections)
+	prometheus.MustRegister(promPoolInUseConnections)
+	prometheus.MustRegister(promPoolIdleConnections)
+	prometheus.MustRegister(promPoolWaitCount)
+	prometheus.MustRegister(promPoolWaitDurationMilliseconds)
+	prometheus.MustRegister(promStatistics)
 
 	database.Register("pgsql", openDatabase)
 }
 
+// Queryer is implemented by both *sql.DB and *sql.Tx.
 type Queryer interface {
-	Query(query string, args ...interface{}) (*sql.Rows, error)
-	QueryRow(query string, args ...interface{}) *sql.Row
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
 }
 
 type pgSQL struct {
 	*sql.DB
-	cache  *lru.ARCCache
-	config Config
+	replica *replica
+	cache   *lru.ARCCache
+	config  Config
 }
 
 // Close closes the database and destroys if ManageDatabaseLifecycle has been specified in
 // the configuration.
 func (pgSQL *pgSQL) Close() {
 	if pgSQL.DB != nil {
+		promStatistics.unsetDatastore(pgSQL)
+
+		pooledDBLock.Lock()
+		if pooledDB == pgSQL.DB {
+			pooledDB = nil
+		}
+		pooledDBLock.Unlock()
+
 		pgSQL.DB.Close()
 	}
 
+	if pgSQL.replica != nil {
+		pgSQL.replica.Close()
+	}
+
 	if pgSQL.config.ManageDatabaseLifecycle {
 		dbName, pgSourceURL, _ := parseConnectionString(pgSQL.config.Source)
 		dropDatabase(pgSourceURL, dbName)
 	}
 }
 
-// Ping verifies that the database is accessible.
-func (pgSQL *pgSQL) Ping() bool {
-	return pgSQL.DB.Ping() == nil
+// poolStats returns the statistics of the connection pool that is currently in use.
+func poolStats() sql.DBStats {
+	pooledDBLock.Lock()
+	defer pooledDBLock.Unlock()
+
+	if pooledDB == nil {
+		return sql.DBStats{}
+	}
+	return pooledDB.Stats()
+}
+
+// Ping verifies that a connection to the database can be established and used.
+func (pgSQL *pgSQL) Ping(ctx context.Context) error {
+	if err := pgSQL.DB.PingContext(ctx); err != nil {
+		return err
+	}
+
+	var one int
+	return pgSQL.DB.QueryRowContext(ctx, "SELECT 1").Scan(&one)
 }
 
 // Config is the configuration that is used by openDatabase.
@@ -111,12 +216,45 @@ type Config struct {
 	Source    string
 	CacheSize int
 
+	// CacheTTL is the maximum amount of time an element is kept in the cache. A zero value keeps
+	// elements until they are evicted to make room for others or invalidated.
+	CacheTTL time.Duration
+
+	// ReadOnlySource is the connection string of an optional read replica, which serves the
+	// read-only methods while the primary is reachable through Source.
+	ReadOnlySource string
+
 	ManageDatabaseLifecycle bool
 	FixturePath             string
+
+	// ForceIncompatibleSchema allows opening a database whose schema is incompatible with this
+	// binary, without running any migration. It is only meant for emergency inspection and the
+	// database must not be written to.
+	ForceIncompatibleSchema bool
+
+	// MaxOpenConnections and MaxIdleConnections limit the number of connections, respectively
+	// open and idle, in the pool. ConnMaxLifetime is the maximum amount of time a connection may be
+	// reused. Zero values mean no limit.
+	MaxOpenConnections int
+	MaxIdleConnections int
+	ConnMaxLifetime    time.Duration
+
+	// StatementTimeout aborts any statement that takes more than the specified duration.
+	// A zero value disables the timeout.
+	StatementTimeout time.Duration
+
+	// ExactStatistics makes the statistics exposed to Prometheus exact counts rather than
+	// estimates. They are retrieved at most once per StatisticsTTL.
+	ExactStatistics bool
+	StatisticsTTL   time.Duration
+
+	// MaxLayerTreeDepth is the maximum number of layers that can be stacked on top of each other.
+	// The deeper layers are rejected, and so are the ancestries that are found to be deeper.
+	MaxLayerTreeDepth int
 }
 
 // openDatabase opens a PostgresSQL-backed Datastore using the given configuration.
-// It immediately every necessary migrations. If ManageDatabaseLifecycle is specified,
+// It immediately runs every necessary migrations. If ManageDatabaseLifecycle is specified,
 // the database will be created first. If FixturePath is specified, every SQL queries that are
 // present insides will be executed.
 func openDatabase(registrableComponentConfig config.RegistrableComponentConfig) (database.Datastore, error) {
@@ -125,7 +263,13 @@ func openDatabase(registrableComponentConfig config.RegistrableComponentConfig)
 
 	// Parse configuration.
 	pg.config = Config{
-		CacheSize: 16384,
+		CacheSize:          16384,
+		MaxOpenConnections: 64,
+		MaxIdleConnections: 16,
+		ConnMaxLifetime:    30 * time.Minute,
+		StatementTimeout:   10 * time.Minute,
+		StatisticsTTL:      time.Minute,
+		MaxLayerTreeDepth:  database.DefaultMaxLayerTreeDepth,
 	}
 	bytes, err := yaml.Marshal(registrableComponentConfig.Options)
 	if err != nil {
@@ -136,6 +280,10 @@ func openDatabase(registrableComponentConfig config.RegistrableComponentConfig)
 		return nil, fmt.Errorf("pgsql: could not load configuration: %v", err)
 	}
 
+	if pg.config.MaxLayerTreeDepth <= 0 {
+		return nil, cerrors.NewBadRequestError("pgsql: the maximum layer tree depth must be positive")
+	}
+
 	dbName, pgSourceURL, err := parseConnectionString(pg.config.Source)
 	if err != nil {
 		return nil, err
@@ -150,22 +298,75 @@ func openDatabase(registrableComponentConfig config.RegistrableComponentConfig)
 	}
 
 	// Open database.
-	pg.DB, err = sql.Open("postgres", pg.config.Source)
+	source, err := withStatementTimeout(pg.config.Source, pg.config.StatementTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	pg.DB, err = sql.Open("postgres", source)
 	if err != nil {
 		pg.Close()
 		return nil, fmt.Errorf("pgsql: could not open database: %v", err)
 	}
 
+	pg.DB.SetMaxOpenConns(pg.config.MaxOpenConnections)
+	pg.DB.SetMaxIdleConns(pg.config.MaxIdleConnections)
+	pg.DB.SetConnMaxLifetime(pg.config.ConnMaxLifetime)
+
+	pooledDBLock.Lock()
+	pooledDB = pg.DB
+	pooledDBLock.Unlock()
+
+	// Open read replica. It may be unreachable for now: the primary is used until it is not.
+	if pg.config.ReadOnlySource != "" {
+		replicaSource, err := withStatementTimeout(pg.config.ReadOnlySource, pg.config.StatementTimeout)
+		if err != nil {
+			pg.Close()
+			return nil, err
+		}
+
+		replicaDB, err := sql.Open("postgres", replicaSource)
+		if err != nil {
+			pg.Close()
+			return nil, fmt.Errorf("pgsql: could not open read replica: %v", err)
+		}
+
+		replicaDB.SetMaxOpenConns(pg.config.MaxOpenConnections)
+		replicaDB.SetMaxIdleConns(pg.config.MaxIdleConnections)
+		replicaDB.SetConnMaxLifetime(pg.config.ConnMaxLifetime)
+
+		pg.replica = newReplica(replicaDB)
+	}
+
 	// Verify database state.
 	if err := pg.DB.Ping(); err != nil {
 		pg.Close()
 		return nil, fmt.Errorf("pgsql: could not open database: %v", err)
 	}
 
-	// Run migrations.
-	if err := migrate(pg.config.Source); err != nil {
-		pg.Close()
-		return nil, err
+	// Verify schema compatibility and run migrations.
+	ctx := context.Background()
+	if err := pg.checkSchemaCompatibility(ctx); err != nil {
+		if _, incompatible := err.(*database.ErrIncompatibleSchema); !incompatible || !pg.config.ForceIncompatibleSchema {
+			pg.Close()
+			return nil, err
+		}
+		log.Warningf("pgsql: %s, forcing startup without running migrations: the database must not be written to", err)
+	} else {
+		if err := pg.migrate(ctx); err != nil {
+			pg.Close()
+			return nil, err
+		}
+
+		if err := pg.InsertKeyValue(ctx, schemaCompatibilityKey, strconv.Itoa(schemaCompatibilityVersion)); err != nil {
+			pg.Close()
+			return nil, fmt.Errorf("pgsql: could not store the schema compatibility version: %v", err)
+		}
+
+		if err := pg.validateQueries(ctx); err != nil {
+			pg.Close()
+			return nil, err
+		}
 	}
 
 	// Load fixture data.
@@ -191,9 +392,31 @@ func openDatabase(registrableComponentConfig config.RegistrableComponentConfig)
 		pg.cache, _ = lru.NewARC(pg.config.CacheSize)
 	}
 
+	promStatistics.setDatastore(&pg, pg.config.ExactStatistics, pg.config.StatisticsTTL)
+
 	return &pg, nil
 }
 
+// validateQueries prepares every named query against the database, failing on the first query
+// that PostgreSQL refuses.
+func (pgSQL *pgSQL) validateQueries(ctx context.Context) error {
+	names := make([]string, 0, len(namedQueries))
+	for name := range namedQueries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		stmt, err := pgSQL.PrepareContext(ctx, namedQueries[name])
+		if err != nil {
+			return fmt.Errorf("pgsql: query %s is invalid: %v", name, err)
+		}
+		stmt.Close()
+	}
+
+	return nil
+}
+
 func parseConnectionString(source string) (dbName string, pgSourceURL string, err error) {
 	if source == "" {
 		return "", "", cerrors.NewBadRequestError("pgsql: no database connection string specified")
@@ -213,36 +436,23 @@ func parseConnectionString(source string) (dbName string, pgSourceURL string, er
 	return
 }
 
-// migrate runs all available migrations on a pgSQL database.
-func migrate(source string) error {
-	log.Info("running database migrations")
-
-	_, filename, _, _ := runtime.Caller(1)
-	migrationDir := filepath.Join(filepath.Dir(filename), "/migrations/")
-	conf := &goose.DBConf{
-		MigrationsDir: migrationDir,
-		Driver: goose.DBDriver{
-			Name:    "postgres",
-			OpenStr: source,
-			Import:  "github.com/lib/pq",
-			Dialect: &goose.PostgresDialect{},
-		},
+// withStatementTimeout adds the statement_timeout run-time parameter to the connection string so
+// it applies to every connection of the pool.
+func withStatementTimeout(source string, timeout time.Duration) (string, error) {
+	if timeout <= 0 {
+		return source, nil
 	}
 
-	// Determine the most recent revision available from the migrations folder.
-	target, err := goose.GetMostRecentDBVersion(conf.MigrationsDir)
+	sourceURL, err := url.Parse(source)
 	if err != nil {
-		return fmt.Errorf("pgsql: could not get most recent migration: %v", err)
+		return "", cerrors.NewBadRequestError("pgsql: database connection string is not a valid URL")
 	}
 
-	// Run migrations.
-	err = goose.RunMigrations(conf, conf.MigrationsDir, target)
-	if err != nil {
-		return fmt.Errorf("pgsql: an error occured while running migrations: %v", err)
-	}
+	query := sourceURL.Query()
+	query.Set("statement_timeout", strconv.FormatInt(int64(timeout/time.Millisecond), 10))
+	sourceURL.RawQuery = query.Encode()
 
-	log.Info("database migration ran successfully")
-	return nil
+	return sourceURL.String(), nil
 }
 
 // createDatabase creates a new database.
@@ -256,7 +466,7 @@ func createDatabase(source, dbName string) error {
 	defer db.Close()
 
 	// Create database.
-	_, err = db.Exec("CREATE DATABASE " + dbName)
+	_, err = db.Exec("CREATE DATABASE " + pq.QuoteIdentifier(dbName))
 	if err != nil {
 		return fmt.Errorf("pgsql: could not create database: %v", err)
 	}
@@ -284,7 +494,7 @@ func dropDatabase(source, dbName string) error {
 	}
 
 	// Drop database.
-	if _, err = db.Exec("DROP DATABASE " + dbName); err != nil {
+	if _, err = db.Exec("DROP DATABASE " + pq.QuoteIdentifier(dbName)); err != nil {
 		return fmt.Errorf("could not drop database: %v", err)
 	}
 
@@ -293,19 +503,50 @@ func dropDatabase(source, dbName string) error {
 
 // handleError logs an error with an extra description and masks the error if it's an SQL one.
 // This ensures we never return plain SQL errors and leak anything.
-func handleError(desc string, err error) error {
+// PostgreSQL errors are translated into the database package's errors: unique violations
+// become ErrAlreadyExists, foreign key violations become ErrInconsistent and any other error,
+// including connection failures, becomes ErrBackendException.
+// If the context has been canceled or its deadline exceeded, the context's error is returned
+// instead as the query has most likely been aborted because of it.
+func handleError(ctx context.Context, desc string, err error) error {
 	if err == nil {
 		return nil
 	}
 
-	if err == sql.ErrNoRows {
+	switch err {
+	case sql.ErrNoRows:
 		return cerrors.ErrNotFound
+	case cerrors.ErrNotFound, database.ErrBackendException, database.ErrAlreadyExists, database.ErrInconsistent:
+		// The error has already been handled.
+		return err
+	}
+
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		log.Debugf("%s: %v (%v)", desc, ctxErr, err)
+		return ctxErr
+	}
+
+	if _, ok := err.(*database.ErrLayerTreeTooDeep); ok {
+		return err
 	}
 
 	log.Errorf("%s: %v", desc, err)
 	promErrorsTotal.WithLabelValues(desc).Inc()
 
-	if _, o := err.(*pq.Error); o || err == sql.ErrTxDone || strings.HasPrefix(err.Error(), "sql:") {
+	if pqErr, ok := err.(*pq.Error); ok {
+		switch pqErr.Code {
+		case "23505":
+			return database.ErrAlreadyExists
+		case "23503":
+			return database.ErrInconsistent
+		}
+		return database.ErrBackendException
+	}
+
+	if err == driver.ErrBadConn || err == sql.ErrTxDone || strings.HasPrefix(err.Error(), "sql:") {
+		return database.ErrBackendException
+	}
+	if _, ok := err.(net.Error); ok {
 		return database.ErrBackendException
 	}
 
@@ -321,3 +562,40 @@ func isErrUniqueViolation(err error) bool {
 func observeQueryTime(query, subquery string, start time.Time) {
 	utils.PrometheusObserveTimeMilliseconds(promQueryDurationMilliseconds.WithLabelValues(query, subquery), start)
 }
+
+// namedExec, namedQuery and namedQueryRow execute a query using the given Queryer, and record its
+// duration and whether it failed in Prometheus, under the specified name. The name should be the
+// name of the query's constant.
+func namedExec(ctx context.Context, queryer Queryer, name, query string, args ...interface{}) (sql.Result, error) {
+	defer observeNamedQueryTime(name, time.Now())
+
+	result, err := queryer.ExecContext(ctx, query, args...)
+	observeNamedQueryError(name, err)
+	return result, err
+}
+
+func namedQuery(ctx context.Context, queryer Queryer, name, query string, args ...interface{}) (*sql.Rows, error) {
+	defer observeNamedQueryTime(name, time.Now())
+
+	rows, err := queryer.QueryContext(ctx, query, args...)
+	observeNamedQueryError(name, err)
+	return rows, err
+}
+
+func namedQueryRow(ctx context.Context, queryer Queryer, name, query string, args ...interface{}) *sql.Row {
+	defer observeNamedQueryTime(name, time.Now())
+
+	row := queryer.QueryRowContext(ctx, query, args...)
+	observeNamedQueryError(name, row.Err())
+	return row
+}
+
+func observeNamedQueryTime(name string, start time.Time) {
+	utils.PrometheusObserveTimeMilliseconds(promNamedQueryDurationMilliseconds.WithLabelValues(name), start)
+}
+
+func observeNamedQueryError(name string, err error) {
+	if err != nil {
+		promNamedQueryErrorsTotal.WithLabelValues(name).Inc()
+	}
+}
@@ -15,14 +15,29 @@
 package pgsql
 
 import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
 	"runtime"
 	"strings"
+	"testing"
+	"time"
 
-	"github.com/coreos/clair/config"
+	"github.com/lib/pq"
 	"github.com/pborman/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/coreos/clair/config"
+	"github.com/coreos/clair/database"
+	"github.com/coreos/clair/database/dbtest"
+	cerrors "github.com/coreos/clair/utils/errors"
+	"github.com/coreos/clair/utils/types"
 )
 
 func openDatabaseForTest(testName string, loadFixture bool) (*pgSQL, error) {
@@ -57,3 +72,150 @@ func generateTestConfig(testName string, loadFixture bool) config.RegistrableCom
 		},
 	}
 }
+
+func TestDatastore(t *testing.T) {
+	dbtest.Run(t, func(t *testing.T) database.Datastore {
+		datastore, err := openDatabaseForTest("Datastore", false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return datastore
+	})
+}
+
+func TestPing(t *testing.T) {
+	datastore, err := openDatabaseForTest("Ping", false)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	assert.Nil(t, datastore.Ping(context.Background()))
+
+	datastore.Close()
+	assert.NotNil(t, datastore.Ping(context.Background()))
+}
+
+func TestOpenDatabasePoolConfiguration(t *testing.T) {
+	cfg := generateTestConfig("OpenDatabasePoolConfiguration", false)
+	cfg.Options["maxopenconnections"] = 3
+	cfg.Options["maxidleconnections"] = 2
+	cfg.Options["connmaxlifetime"] = "1m"
+	cfg.Options["statementtimeout"] = "2s"
+
+	ds, err := openDatabase(cfg)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	datastore := ds.(*pgSQL)
+	defer datastore.Close()
+
+	assert.Equal(t, 3, datastore.config.MaxOpenConnections)
+	assert.Equal(t, 2, datastore.config.MaxIdleConnections)
+	assert.Equal(t, time.Minute, datastore.config.ConnMaxLifetime)
+	assert.Equal(t, 3, datastore.Stats().MaxOpenConnections)
+	assert.Equal(t, datastore.Stats().OpenConnections, poolStats().OpenConnections)
+
+	var statementTimeout string
+	err = datastore.QueryRow("SHOW statement_timeout").Scan(&statementTimeout)
+	if assert.Nil(t, err) {
+		assert.Equal(t, "2s", statementTimeout)
+	}
+}
+
+func TestWithStatementTimeout(t *testing.T) {
+	source, err := withStatementTimeout("postgresql://postgres@127.0.0.1:5432/clair?sslmode=disable", 1500*time.Millisecond)
+	if assert.Nil(t, err) {
+		assert.Equal(t, "postgresql://postgres@127.0.0.1:5432/clair?sslmode=disable&statement_timeout=1500", source)
+	}
+
+	source, err = withStatementTimeout("postgresql://postgres@127.0.0.1:5432/clair", 0)
+	if assert.Nil(t, err) {
+		assert.Equal(t, "postgresql://postgres@127.0.0.1:5432/clair", source)
+	}
+}
+
+func TestContextCancellation(t *testing.T) {
+	datastore, err := openDatabaseForTest("ContextCancellation", false)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer datastore.Close()
+
+	// Hold an exclusive lock on the KeyValue table so reading from it blocks.
+	tx, err := datastore.Begin()
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec("LOCK TABLE KeyValue IN ACCESS EXCLUSIVE MODE")
+	assert.Nil(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+
+	start := time.Now()
+	_, err = datastore.GetKeyValue(ctx, "TestContextCancellation")
+	assert.Equal(t, context.Canceled, err)
+	assert.True(t, time.Since(start) < 5*time.Second, "GetKeyValue should return promptly once canceled")
+}
+
+func TestHandleError(t *testing.T) {
+	otherErr := errors.New("some error")
+	canceledCtx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	tests := []struct {
+		ctx      context.Context
+		err      error
+		expected error
+	}{
+		{context.Background(), nil, nil},
+		{context.Background(), sql.ErrNoRows, cerrors.ErrNotFound},
+		{context.Background(), cerrors.ErrNotFound, cerrors.ErrNotFound},
+		{context.Background(), &pq.Error{Code: "23505"}, database.ErrAlreadyExists},
+		{context.Background(), &pq.Error{Code: "23503"}, database.ErrInconsistent},
+		{context.Background(), &pq.Error{Code: "08006"}, database.ErrBackendException},
+		{context.Background(), &pq.Error{Code: "42P01"}, database.ErrBackendException},
+		{context.Background(), driver.ErrBadConn, database.ErrBackendException},
+		{context.Background(), sql.ErrTxDone, database.ErrBackendException},
+		{context.Background(), database.ErrBackendException, database.ErrBackendException},
+		{context.Background(), otherErr, otherErr},
+		{canceledCtx, &pq.Error{Code: "57014"}, context.Canceled},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.expected, handleError(test.ctx, "TestHandleError", test.err), "%v", test.err)
+	}
+}
+
+func TestNamedQueryMetrics(t *testing.T) {
+	datastore, err := openDatabaseForTest("NamedQueryMetrics", true)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer datastore.Close()
+
+	sampleCount := func(name string) uint64 {
+		var metric dto.Metric
+		promNamedQueryDurationMilliseconds.WithLabelValues(name).(prometheus.Histogram).Write(&metric)
+		return metric.GetHistogram().GetSampleCount()
+	}
+
+	before := sampleCount("searchLayer")
+	_, err = datastore.FindLayer(context.Background(), "layer-1", true, false, types.Unknown)
+	assert.Nil(t, err)
+	assert.True(t, sampleCount("searchLayer") > before, "searchLayer should have been observed")
+}
+
+func TestValidateQueries(t *testing.T) {
+	namedQueries["brokenQuery"] = `SELECT id FROM UnknownTable`
+	defer delete(namedQueries, "brokenQuery")
+
+	_, err := openDatabase(generateTestConfig("ValidateQueries", false))
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "brokenQuery")
+	}
+}
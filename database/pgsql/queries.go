@@ -14,7 +14,7 @@
 
 package pgsql
 
-import "strconv"
+import "github.com/lib/pq"
 
 const (
 	lockVulnerabilityAffects = `LOCK Vulnerability_Affects_FeatureVersion IN SHARE ROW EXCLUSIVE MODE`
@@ -25,21 +25,41 @@ const (
 	updateKeyValue = `UPDATE KeyValue SET value = $1 WHERE key = $2`
 	insertKeyValue = `INSERT INTO KeyValue(key, value) VALUES($1, $2)`
 	searchKeyValue = `SELECT value FROM KeyValue WHERE key = $1`
+	swapKeyValue   = `UPDATE KeyValue SET value = $3 WHERE key = $1 AND value = $2`
 
 	// namespace.go
+	// The version format of an existing namespace is only recorded if it wasn't known yet.
 	soiNamespace = `
 		WITH new_namespace AS (
-			INSERT INTO Namespace(name)
-			SELECT CAST($1 AS VARCHAR)
+			INSERT INTO Namespace(name, version_format)
+			SELECT CAST($1 AS VARCHAR), NULLIF(CAST($2 AS VARCHAR), '')
 			WHERE NOT EXISTS (SELECT name FROM Namespace WHERE name = $1)
 			RETURNING id
+		), updated_namespace AS (
+			UPDATE Namespace SET version_format = CAST($2 AS VARCHAR)
+			WHERE name = $1 AND version_format IS NULL AND $2 <> ''
 		)
 		SELECT id FROM Namespace WHERE name = $1
 		UNION
 		SELECT id FROM new_namespace`
 
 	searchNamespace = `SELECT id FROM Namespace WHERE name = $1`
-	listNamespace   = `SELECT id, name FROM Namespace`
+	listNamespace   = `SELECT id, name, version_format FROM Namespace`
+
+	countVulnerabilityByNamespace = `
+		SELECT n.name, COUNT(v.id)
+		FROM Vulnerability v JOIN Namespace n ON v.namespace_id = n.id
+		WHERE v.deleted_at IS NULL
+		GROUP BY n.name`
+
+	// A modified Vulnerability is deleted and inserted again, so its last change is the most
+	// recent insertion or deletion.
+	searchLastVulnerabilityChange = `
+		SELECT v.created_at, v.deleted_at
+		FROM Vulnerability v JOIN Namespace n ON v.namespace_id = n.id
+		WHERE n.name = $1
+		ORDER BY COALESCE(v.deleted_at, v.created_at) DESC
+		LIMIT 1`
 
 	// feature.go
 	soiFeature = `
@@ -68,8 +88,11 @@ const (
 		SELECT 'new', id FROM new_featureversion`
 
 	searchVulnerabilityFixedInFeature = `
-		SELECT id, vulnerability_id, version FROM Vulnerability_FixedIn_Feature
-    WHERE feature_id = $1`
+		SELECT vfif.id, vfif.vulnerability_id, vfif.version, n.version_format
+		FROM Vulnerability_FixedIn_Feature vfif
+			JOIN Feature f ON vfif.feature_id = f.id
+			JOIN Namespace n ON f.namespace_id = n.id
+		WHERE vfif.feature_id = $1`
 
 	insertVulnerabilityAffectsFeatureVersion = `
 		INSERT INTO Vulnerability_Affects_FeatureVersion(vulnerability_id,
@@ -77,21 +100,37 @@ const (
 
 	// layer.go
 	searchLayer = `
-		SELECT l.id, l.name, l.engineversion, p.id, p.name, n.id, n.name
+		SELECT l.id, l.name, l.engineversion, p.id, p.name, n.id, n.name, n.version_format, l.path, l.format, l.stale
 		FROM Layer l
 			LEFT JOIN Layer p ON l.parent_id = p.id
 			LEFT JOIN Namespace n ON l.namespace_id = n.id
 		WHERE l.name = $1;`
 
+	// searchLayerAncestry walks up the layer tree, for at most $2 + 1 levels, and returns the depth
+	// of the last layer it reached and whether that layer had already been seen.
+	searchLayerAncestry = `
+		WITH RECURSIVE layer_tree(id, parent_id, depth, path, cycle) AS(
+			SELECT l.id, l.parent_id, 1, ARRAY[l.id], false
+			FROM Layer l
+			WHERE l.id = $1
+		UNION ALL
+			SELECT l.id, l.parent_id, lt.depth + 1, lt.path || l.id, l.id = ANY(lt.path)
+			FROM Layer l, layer_tree lt
+			WHERE l.id = lt.parent_id AND NOT lt.cycle AND lt.depth <= $2
+		)
+		SELECT depth, cycle FROM layer_tree ORDER BY depth DESC LIMIT 1`
+
+	// searchLayerFeatureVersion walks up the layer tree, for at most $2 levels. The ancestry is
+	// verified by searchLayerAncestry first.
 	searchLayerFeatureVersion = `
 		WITH RECURSIVE layer_tree(id, name, parent_id, depth, path, cycle) AS(
 			SELECT l.id, l.name, l.parent_id, 1, ARRAY[l.id], false
 			FROM Layer l
 			WHERE l.id = $1
 		UNION ALL
-			SELECT l.id, l.name, l.parent_id, lt.depth + 1, path || l.id, l.id = ANY(path)
+			SELECT l.id, l.name, l.parent_id, lt.depth + 1, lt.path || l.id, l.id = ANY(lt.path)
 			FROM Layer l, layer_tree lt
-			WHERE l.id = lt.parent_id
+			WHERE l.id = lt.parent_id AND NOT lt.cycle AND lt.depth < $2
 		)
 		SELECT ldf.featureversion_id, ldf.modification, fn.id, fn.name, f.id, f.name, fv.id, fv.version, ltree.id, ltree.name
 		FROM Layer_diff_FeatureVersion ldf
@@ -102,22 +141,27 @@ const (
 		ORDER BY ltree.ordering`
 
 	searchFeatureVersionVulnerability = `
-			SELECT vafv.featureversion_id, v.id, v.name, v.description, v.link, v.severity, v.metadata,
-				vn.name, vfif.version
+			SELECT vafv.featureversion_id, v.id, v.name, v.description, v.link, v.links, v.severity,
+				v.metadata, vn.name, vfif.version
 			FROM Vulnerability_Affects_FeatureVersion vafv, Vulnerability v,
 					 Namespace vn, Vulnerability_FixedIn_Feature vfif
 			WHERE vafv.featureversion_id = ANY($1::integer[])
 						AND vfif.vulnerability_id = v.id
 						AND vafv.fixedin_id = vfif.id
 						AND v.namespace_id = vn.id
+						AND v.severity >= $2
 						AND v.deleted_at IS NULL`
 
 	insertLayer = `
-		INSERT INTO Layer(name, engineversion, parent_id, namespace_id, created_at)
-    VALUES($1, $2, $3, $4, CURRENT_TIMESTAMP)
+		INSERT INTO Layer(name, engineversion, parent_id, namespace_id, path, format, created_at)
+    VALUES($1, $2, $3, $4, $5, $6, CURRENT_TIMESTAMP)
     RETURNING id`
 
-	updateLayer = `UPDATE LAYER SET engineversion = $2, namespace_id = $3 WHERE id = $1`
+	updateLayer = `
+		UPDATE LAYER SET engineversion = $2, namespace_id = $3, parent_id = $4, path = $5, format = $6, stale = false
+		WHERE id = $1`
+
+	updateLayerStale = `UPDATE Layer SET stale = true WHERE name = $1`
 
 	removeLayerDiffFeatureVersion = `
 		DELETE FROM Layer_diff_FeatureVersion
@@ -129,8 +173,59 @@ const (
 			FROM FeatureVersion fv
 			WHERE fv.id = ANY($3::integer[])`
 
+	searchLayerExists = `SELECT EXISTS(SELECT 1 FROM Layer WHERE name = $1)`
+
+	searchLayerChildren = `
+		SELECT l.id, l.name
+		FROM Layer l, Layer p
+		WHERE l.parent_id = p.id AND p.name = $1`
+
+	lockLayer = `SELECT id FROM Layer WHERE name = $1 FOR UPDATE`
+
 	removeLayer = `DELETE FROM Layer WHERE name = $1`
 
+	listLayer = `
+		SELECT l.id, l.name, l.engineversion, p.id, p.name, n.id, n.name, n.version_format, l.path, l.format, l.stale
+		FROM Layer l
+			LEFT JOIN Layer p ON l.parent_id = p.id
+			LEFT JOIN Namespace n ON l.namespace_id = n.id
+		WHERE l.name > $1
+		ORDER BY l.name
+		LIMIT $2`
+
+	listLayerMissingDetector = `
+		SELECT l.id, l.name, l.engineversion, p.id, p.name, n.id, n.name, n.version_format, l.path, l.format, l.stale
+		FROM Layer l
+			LEFT JOIN Layer p ON l.parent_id = p.id
+			LEFT JOIN Namespace n ON l.namespace_id = n.id
+		WHERE l.name > $1
+			AND NOT EXISTS (SELECT 1 FROM Layer_Detector ld WHERE ld.layer_id = l.id AND ld.detector = $3)
+		ORDER BY l.name
+		LIMIT $2`
+
+	listOutdatedLayer = `
+		SELECT l.id, l.name, l.engineversion, p.id, p.name, n.id, n.name, n.version_format, l.path, l.format, l.stale
+		FROM Layer l
+			LEFT JOIN Layer p ON l.parent_id = p.id
+			LEFT JOIN Namespace n ON l.namespace_id = n.id
+		WHERE l.id > $1 AND l.engineversion < $3 AND NOT l.stale
+		ORDER BY l.id
+		LIMIT $2`
+
+	countLayer = `SELECT COUNT(*) FROM Layer`
+
+	searchLayerDetector = `SELECT detector FROM Layer_Detector WHERE layer_id = $1 ORDER BY detector`
+	insertLayerDetector = `INSERT INTO Layer_Detector(layer_id, detector) VALUES($1, $2)`
+	removeLayerDetector = `DELETE FROM Layer_Detector WHERE layer_id = $1`
+
+	searchLayerNamespace = `
+		SELECT n.id, n.name, n.version_format
+		FROM Layer_Namespace ln JOIN Namespace n ON ln.namespace_id = n.id
+		WHERE ln.layer_id = $1
+		ORDER BY ln.id`
+	insertLayerNamespace = `INSERT INTO Layer_Namespace(layer_id, namespace_id) VALUES($1, $2)`
+	removeLayerNamespace = `DELETE FROM Layer_Namespace WHERE layer_id = $1`
+
 	// lock.go
 	insertLock        = `INSERT INTO Lock(name, owner, until) VALUES($1, $2, $3)`
 	searchLock        = `SELECT owner, until FROM Lock WHERE name = $1`
@@ -140,13 +235,14 @@ const (
 
 	// vulnerability.go
 	searchVulnerabilityBase = `
-	  SELECT v.id, v.name, n.id, n.name, v.description, v.link, v.severity, v.metadata
+	  SELECT v.id, v.name, n.id, n.name, v.description, v.link, v.links, v.severity, v.metadata
 	  FROM Vulnerability v JOIN Namespace n ON v.namespace_id = n.id`
 	searchVulnerabilityForUpdate          = ` FOR UPDATE OF v`
 	searchVulnerabilityByNamespaceAndName = ` WHERE n.name = $1 AND v.name = $2 AND v.deleted_at IS NULL`
 	searchVulnerabilityByID               = ` WHERE v.id = $1`
 	searchVulnerabilityByNamespace        = ` WHERE n.name = $1 AND v.deleted_at IS NULL
 		  				  AND v.id >= $2
+						  AND v.severity >= $4
 						  ORDER BY v.id
 						  LIMIT $3`
 
@@ -156,8 +252,8 @@ const (
 		WHERE vfif.vulnerability_id = $1`
 
 	insertVulnerability = `
-		INSERT INTO Vulnerability(namespace_id, name, description, link, severity, metadata, created_at)
-		VALUES($1, $2, $3, $4, $5, $6, CURRENT_TIMESTAMP)
+		INSERT INTO Vulnerability(namespace_id, name, description, link, links, severity, metadata, created_at)
+		VALUES($1, $2, $3, $4, $5, $6, $7, CURRENT_TIMESTAMP)
 		RETURNING id`
 
 	insertVulnerabilityFixedInFeature = `
@@ -165,7 +261,12 @@ const (
 		VALUES($1, $2, $3)
 		RETURNING id`
 
-	searchFeatureVersionByFeature = `SELECT id, version FROM FeatureVersion WHERE feature_id = $1`
+	searchFeatureVersionByFeature = `
+		SELECT fv.id, fv.version, n.version_format
+		FROM FeatureVersion fv
+			JOIN Feature f ON fv.feature_id = f.id
+			JOIN Namespace n ON f.namespace_id = n.id
+		WHERE fv.feature_id = $1`
 
 	removeVulnerability = `
 		UPDATE Vulnerability
@@ -175,11 +276,75 @@ const (
           AND deleted_at IS NULL
     RETURNING id`
 
+	searchVulnerabilityID = `
+		SELECT v.id
+		FROM Vulnerability v JOIN Namespace n ON v.namespace_id = n.id
+		WHERE n.name = $1 AND v.name = $2 AND v.deleted_at IS NULL`
+
+	// affectedLayersBase finds the layers that introduce a FeatureVersion affected by the given
+	// vulnerability, and that are the root of at least one branch of the layer tree in which no
+	// layer removes (or upgrades) that FeatureVersion, i.e. which leads to an affected leaf layer.
+	affectedLayersBase = `
+		WITH RECURSIVE introducing(id, name, featureversion_id) AS (
+			SELECT DISTINCT l.id, l.name, vafv.featureversion_id
+			FROM Vulnerability_Affects_FeatureVersion vafv
+				JOIN Layer_diff_FeatureVersion ldf ON ldf.featureversion_id = vafv.featureversion_id
+				JOIN Layer l ON ldf.layer_id = l.id
+			WHERE vafv.vulnerability_id = $1 AND ldf.modification = 'add'
+		), holding(root_id, layer_id, featureversion_id) AS (
+			SELECT id, id, featureversion_id FROM introducing
+			UNION
+			SELECT h.root_id, c.id, h.featureversion_id
+			FROM holding h JOIN Layer c ON c.parent_id = h.layer_id
+			WHERE NOT EXISTS (
+				SELECT 1 FROM Layer_diff_FeatureVersion ldf
+				WHERE ldf.layer_id = c.id AND ldf.featureversion_id = h.featureversion_id
+					AND ldf.modification = 'del')
+		), affected(id, name) AS (
+			SELECT DISTINCT i.id, i.name
+			FROM introducing i
+			WHERE EXISTS (
+				SELECT 1 FROM holding h
+				WHERE h.root_id = i.id AND h.featureversion_id = i.featureversion_id
+					AND NOT EXISTS (SELECT 1 FROM Layer c WHERE c.parent_id = h.layer_id))
+		)`
+
+	searchAffectedLayers = `
+		SELECT id, name FROM affected
+		WHERE id > $2
+		ORDER BY id
+		LIMIT $3`
+
+	countAffectedLayers = ` SELECT COUNT(*) FROM affected`
+
+	insertVulnerabilityHistory = `
+		INSERT INTO Vulnerability_History(namespace_id, name, created_at, source, old_severity,
+			new_severity, feature_name, old_fixedby, new_fixedby)
+		VALUES($1, $2, CURRENT_TIMESTAMP, $3, $4, $5, $6, $7, $8)`
+
+	removeVulnerabilityHistoryOldest = `
+		DELETE FROM Vulnerability_History
+		WHERE namespace_id = $1 AND name = $2 AND id NOT IN (
+			SELECT id
+			FROM Vulnerability_History
+			WHERE namespace_id = $1 AND name = $2
+			ORDER BY id DESC
+			LIMIT $3)`
+
+	searchVulnerabilityHistory = `
+		SELECT vh.created_at, vh.source, vh.old_severity, vh.new_severity, vh.feature_name,
+			vh.old_fixedby, vh.new_fixedby
+		FROM Vulnerability_History vh JOIN Namespace n ON vh.namespace_id = n.id
+		WHERE n.name = $1 AND vh.name = $2
+		ORDER BY vh.id DESC`
+
 	// notification.go
 	insertNotification = `
 		INSERT INTO Vulnerability_Notification(name, created_at, old_vulnerability_id, new_vulnerability_id)
     VALUES($1, CURRENT_TIMESTAMP, $2, $3)`
 
+	notifyNotification = `SELECT pg_notify('` + notificationChannel + `', $1)`
+
 	updatedNotificationNotified = `
 		UPDATE Vulnerability_Notification
 		SET notified_at = CURRENT_TIMESTAMP
@@ -187,7 +352,7 @@ const (
 
 	removeNotification = `
 		UPDATE Vulnerability_Notification
-	  SET deleted_at = CURRENT_TIMESTAMP
+	  SET deleted_at = COALESCE(deleted_at, CURRENT_TIMESTAMP)
 	  WHERE name = $1`
 
 	searchNotificationAvailable = `
@@ -222,6 +387,26 @@ const (
 	LIMIT $3;
 `
 
+	// statistics.go
+	countStatistics = `
+		SELECT
+			(SELECT COUNT(*) FROM Layer),
+			(SELECT COUNT(*) FROM Feature),
+			(SELECT COUNT(*) FROM FeatureVersion),
+			(SELECT COUNT(*) FROM Vulnerability WHERE deleted_at IS NULL),
+			(SELECT COUNT(*) FROM Vulnerability_Notification WHERE notified_at IS NULL AND deleted_at IS NULL)`
+
+	// estimateStatistics reads the number of rows estimated by the planner, which is negative for
+	// tables that have never been analyzed. The estimation includes the deleted vulnerabilities.
+	// Pending notifications are counted exactly, as they are few and indexed.
+	estimateStatistics = `
+		SELECT
+			GREATEST((SELECT reltuples FROM pg_class WHERE oid = 'layer'::regclass), 0)::bigint,
+			GREATEST((SELECT reltuples FROM pg_class WHERE oid = 'feature'::regclass), 0)::bigint,
+			GREATEST((SELECT reltuples FROM pg_class WHERE oid = 'featureversion'::regclass), 0)::bigint,
+			GREATEST((SELECT reltuples FROM pg_class WHERE oid = 'vulnerability'::regclass), 0)::bigint,
+			(SELECT COUNT(*) FROM Vulnerability_Notification WHERE notified_at IS NULL AND deleted_at IS NULL)`
+
 	// complex_test.go
 	searchComplexTestFeatureVersionAffects = `
 		SELECT v.name
@@ -231,14 +416,86 @@ const (
     WHERE featureversion_id = $1`
 )
 
-// buildInputArray constructs a PostgreSQL input array from the specified integers.
+// namedQueries lists, by name, every statement that is prepared against the database when it is
+// opened, so invalid queries are detected at startup rather than the first time they are used.
+// Utility statements (e.g. SET, LOCK) and the migrations themselves are not listed.
+var namedQueries = map[string]string{
+	"affectedLayersBase+countAffectedLayers":  affectedLayersBase + countAffectedLayers,
+	"affectedLayersBase+searchAffectedLayers": affectedLayersBase + searchAffectedLayers,
+	"countLayer":                                      countLayer,
+	"countStatistics":                                 countStatistics,
+	"countVulnerabilityByNamespace":                   countVulnerabilityByNamespace,
+	"estimateStatistics":                              estimateStatistics,
+	"insertKeyValue":                                  insertKeyValue,
+	"insertLayer":                                     insertLayer,
+	"insertLayerDetector":                             insertLayerDetector,
+	"insertLayerDiffFeatureVersion":                   insertLayerDiffFeatureVersion,
+	"insertLayerNamespace":                            insertLayerNamespace,
+	"insertLock":                                      insertLock,
+	"insertMigration":                                 insertMigration,
+	"insertNotification":                              insertNotification,
+	"insertVulnerability":                             insertVulnerability,
+	"insertVulnerabilityAffectsFeatureVersion":        insertVulnerabilityAffectsFeatureVersion,
+	"insertVulnerabilityFixedInFeature":               insertVulnerabilityFixedInFeature,
+	"insertVulnerabilityHistory":                      insertVulnerabilityHistory,
+	"listLayer":                                       listLayer,
+	"listLayerMissingDetector":                        listLayerMissingDetector,
+	"listOutdatedLayer":                               listOutdatedLayer,
+	"listNamespace":                                   listNamespace,
+	"lockLayer":                                       lockLayer,
+	"notifyNotification":                              notifyNotification,
+	"removeLayer":                                     removeLayer,
+	"removeLayerDetector":                             removeLayerDetector,
+	"removeLayerDiffFeatureVersion":                   removeLayerDiffFeatureVersion,
+	"removeLayerNamespace":                            removeLayerNamespace,
+	"removeLock":                                      removeLock,
+	"removeLockExpired":                               removeLockExpired,
+	"removeNotification":                              removeNotification,
+	"removeVulnerability":                             removeVulnerability,
+	"removeVulnerabilityHistoryOldest":                removeVulnerabilityHistoryOldest,
+	"searchFeatureVersion":                            searchFeatureVersion,
+	"searchFeatureVersionByFeature":                   searchFeatureVersionByFeature,
+	"searchFeatureVersionVulnerability":               searchFeatureVersionVulnerability,
+	"searchKeyValue":                                  searchKeyValue,
+	"searchLastVulnerabilityChange":                   searchLastVulnerabilityChange,
+	"searchLayer":                                     searchLayer,
+	"searchLayerChildren":                             searchLayerChildren,
+	"searchLayerDetector":                             searchLayerDetector,
+	"searchLayerExists":                               searchLayerExists,
+	"searchLayerFeatureVersion":                       searchLayerFeatureVersion,
+	"searchLayerNamespace":                            searchLayerNamespace,
+	"searchLock":                                      searchLock,
+	"searchMigrationVersion":                          searchMigrationVersion,
+	"searchNamespace":                                 searchNamespace,
+	"searchNotification":                              searchNotification,
+	"searchNotificationAvailable":                     searchNotificationAvailable,
+	"searchNotificationLayerIntroducingVulnerability": searchNotificationLayerIntroducingVulnerability,
+	"searchVulnerabilityBase+searchVulnerabilityByID": searchVulnerabilityBase + searchVulnerabilityByID,
+	"searchVulnerabilityBase+searchVulnerabilityByNamespace":                                     searchVulnerabilityBase + searchVulnerabilityByNamespace,
+	"searchVulnerabilityBase+searchVulnerabilityByNamespaceAndName":                              searchVulnerabilityBase + searchVulnerabilityByNamespaceAndName,
+	"searchVulnerabilityBase+searchVulnerabilityByNamespaceAndName+searchVulnerabilityForUpdate": searchVulnerabilityBase + searchVulnerabilityByNamespaceAndName + searchVulnerabilityForUpdate,
+	"searchVulnerabilityFixedIn":                                                                 searchVulnerabilityFixedIn,
+	"searchVulnerabilityFixedInFeature":                                                          searchVulnerabilityFixedInFeature,
+	"searchVulnerabilityHistory":                                                                 searchVulnerabilityHistory,
+	"searchVulnerabilityID":                                                                      searchVulnerabilityID,
+	"soiFeature":                                                                                 soiFeature,
+	"soiFeatureVersion":                                                                          soiFeatureVersion,
+	"soiNamespace":                                                                               soiNamespace,
+	"swapKeyValue":                                                                               swapKeyValue,
+	"updateKeyValue":                                                                             updateKeyValue,
+	"updateLayer":                                                                                updateLayer,
+	"updateLayerStale":                                                                           updateLayerStale,
+	"updateLock":                                                                                 updateLock,
+	"updatedNotificationNotified":                                                                updatedNotificationNotified,
+}
+
+// intArray returns a parameter that binds the specified integers as a PostgreSQL array.
 // Useful to use the `= ANY($1::integer[])` syntax that let us use a IN clause while using
 // a single placeholder.
-func buildInputArray(ints []int) string {
-	str := "{"
-	for i := 0; i < len(ints)-1; i++ {
-		str = str + strconv.Itoa(ints[i]) + ","
+func intArray(ints []int) interface{} {
+	a := make([]int64, len(ints))
+	for i, n := range ints {
+		a[i] = int64(n)
 	}
-	str = str + strconv.Itoa(ints[len(ints)-1]) + "}"
-	return str
+	return pq.Array(a)
 }
@@ -0,0 +1,84 @@
+// Copyright 2015 clair authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pgsql
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+	"time"
+
+	"github.com/coreos/clair/database"
+)
+
+const (
+	// replicaCheckInterval is how long the outcome of a read replica health check is trusted.
+	replicaCheckInterval = 10 * time.Second
+
+	// replicaPingTimeout bounds the time a health check may take, so that an unreachable replica
+	// doesn't slow reads down.
+	replicaPingTimeout = time.Second
+)
+
+// replica is a read-only connection pool whose reachability is periodically verified.
+type replica struct {
+	*sql.DB
+
+	mu        sync.Mutex
+	checkedAt time.Time
+	healthy   bool
+}
+
+func newReplica(db *sql.DB) *replica {
+	return &replica{DB: db}
+}
+
+// isHealthy returns whether the replica was reachable the last time it was checked, checking it
+// again if the previous check is older than replicaCheckInterval.
+func (r *replica) isHealthy(ctx context.Context) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if time.Since(r.checkedAt) < replicaCheckInterval {
+		return r.healthy
+	}
+
+	pingCtx, cancel := context.WithTimeout(ctx, replicaPingTimeout)
+	defer cancel()
+	err := r.PingContext(pingCtx)
+
+	if err != nil && r.healthy {
+		log.Warningf("pgsql: read replica is unreachable, falling back to the primary: %s", err)
+	} else if err == nil && !r.healthy && !r.checkedAt.IsZero() {
+		log.Info("pgsql: read replica is reachable again")
+	}
+
+	r.checkedAt = time.Now()
+	r.healthy = err == nil
+	return r.healthy
+}
+
+// readonly returns the pool that queries which never write should use: the read replica if one is
+// configured and reachable, the primary otherwise, or if the context requires it with
+// database.ContextWithPrimary.
+//
+// Because replicas lag behind the primary, it must only be used by methods which tolerate slightly
+// stale data, and never to read something that is about to be written in the same operation.
+func (pgSQL *pgSQL) readonly(ctx context.Context) *sql.DB {
+	if pgSQL.replica != nil && !database.PrimaryFromContext(ctx) && pgSQL.replica.isHealthy(ctx) {
+		return pgSQL.replica.DB
+	}
+	return pgSQL.DB
+}
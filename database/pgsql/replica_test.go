@@ -0,0 +1,129 @@
+// Copyright 2015 clair authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pgsql
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"sync/atomic"
+	"testing"
+
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/coreos/clair/database"
+	"github.com/coreos/clair/utils/types"
+)
+
+// countingDriver is a PostgreSQL driver that counts the statements that go through it.
+type countingDriver struct {
+	statements int64
+}
+
+func (d *countingDriver) Open(name string) (driver.Conn, error) {
+	conn, err := pq.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return countingConn{Conn: conn, driver: d}, nil
+}
+
+func (d *countingDriver) count() int64 {
+	return atomic.LoadInt64(&d.statements)
+}
+
+// countingConn only exposes driver.Conn so that database/sql prepares every statement.
+type countingConn struct {
+	driver.Conn
+	driver *countingDriver
+}
+
+func (c countingConn) Prepare(query string) (driver.Stmt, error) {
+	atomic.AddInt64(&c.driver.statements, 1)
+	return c.Conn.Prepare(query)
+}
+
+var replicaDriver = &countingDriver{}
+
+func init() {
+	sql.Register("postgres-counting-replica", replicaDriver)
+}
+
+func TestReadReplica(t *testing.T) {
+	datastore, err := openDatabaseForTest("ReadReplica", true)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer datastore.Close()
+	ctx := context.Background()
+
+	// Use a second connection pool to the same database as the replica.
+	replicaDB, err := sql.Open("postgres-counting-replica", datastore.config.Source)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	datastore.replica = newReplica(replicaDB)
+
+	// Reads are served by the replica.
+	count := replicaDriver.count()
+	layer, err := datastore.FindLayer(ctx, "layer-1", true, false, types.Unknown)
+	if assert.Nil(t, err) {
+		assert.Equal(t, "layer-1", layer.Name)
+		assert.Len(t, layer.Features, 2)
+	}
+	assert.True(t, replicaDriver.count() > count)
+
+	count = replicaDriver.count()
+	_, err = datastore.ListNamespaces(ctx)
+	assert.Nil(t, err)
+	assert.True(t, replicaDriver.count() > count)
+
+	// Writes, and the reads that precede them, are served by the primary.
+	count = replicaDriver.count()
+	assert.Nil(t, datastore.InsertKeyValue(ctx, "replica", "value"))
+	assert.Nil(t, datastore.DeleteLayer(ctx, "layer-3b", false))
+	assert.Equal(t, count, replicaDriver.count())
+
+	value, err := datastore.GetKeyValue(ctx, "replica")
+	if assert.Nil(t, err) {
+		assert.Equal(t, "value", value)
+	}
+	assert.True(t, replicaDriver.count() > count)
+
+	// Reads that must see the latest writes are served by the primary.
+	count = replicaDriver.count()
+	layer, err = datastore.FindLayer(database.ContextWithPrimary(ctx), "layer-1", false, false, types.Unknown)
+	if assert.Nil(t, err) {
+		assert.Equal(t, "layer-1", layer.Name)
+	}
+	assert.Equal(t, count, replicaDriver.count())
+
+	// Reads fall back to the primary when the replica is unreachable.
+	unreachableDB, err := sql.Open("postgres", "postgresql://postgres@127.0.0.1:1/unreachable?sslmode=disable&connect_timeout=1")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	datastore.replica.Close()
+	datastore.replica = newReplica(unreachableDB)
+
+	layer, err = datastore.FindLayer(ctx, "layer-1", false, false, types.Unknown)
+	if assert.Nil(t, err) {
+		assert.Equal(t, "layer-1", layer.Name)
+	}
+}
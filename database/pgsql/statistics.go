@@ -0,0 +1,139 @@
+// Copyright 2015 clair authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pgsql
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/coreos/clair/database"
+)
+
+// statisticsTimeout is the maximum amount of time the statistics can take to be retrieved when
+// Prometheus scrapes them.
+const statisticsTimeout = 10 * time.Second
+
+var (
+	promLayersDesc = prometheus.NewDesc("clair_pgsql_layers",
+		"Number of layers stored in the database.", nil, nil)
+	promFeaturesDesc = prometheus.NewDesc("clair_pgsql_features",
+		"Number of features stored in the database.", nil, nil)
+	promFeatureVersionsDesc = prometheus.NewDesc("clair_pgsql_feature_versions",
+		"Number of feature versions stored in the database.", nil, nil)
+	promVulnerabilitiesDesc = prometheus.NewDesc("clair_pgsql_vulnerabilities",
+		"Number of vulnerabilities stored in the database.", nil, nil)
+	promPendingNotificationsDesc = prometheus.NewDesc("clair_pgsql_pending_notifications",
+		"Number of notifications that haven't been sent yet.", nil, nil)
+
+	// promStatistics exposes the statistics of the datastore that is currently open.
+	promStatistics = &statisticsCollector{}
+)
+
+// GetStatistics counts the objects stored in the database. Unless exact is true, the number of
+// layers, features, feature versions and vulnerabilities are estimated by PostgreSQL, which is
+// much cheaper than counting them on large databases.
+func (pgSQL *pgSQL) GetStatistics(ctx context.Context, exact bool) (database.Statistics, error) {
+	queryName, query := "estimateStatistics", estimateStatistics
+	if exact {
+		queryName, query = "countStatistics", countStatistics
+	}
+
+	defer observeQueryTime("GetStatistics", queryName, time.Now())
+
+	var s database.Statistics
+	err := namedQueryRow(ctx, pgSQL.readonly(ctx), queryName, query).
+		Scan(&s.Layers, &s.Features, &s.FeatureVersions, &s.Vulnerabilities, &s.PendingNotifications)
+	if err != nil {
+		return database.Statistics{}, handleError(ctx, queryName, err)
+	}
+
+	return s, nil
+}
+
+// statisticsCollector is a Prometheus collector that retrieves the statistics of a datastore
+// when it is scraped. The statistics are cached for the given TTL so frequent scrapes don't hammer
+// the database.
+type statisticsCollector struct {
+	mu sync.Mutex
+
+	datastore database.Datastore
+	exact     bool
+	ttl       time.Duration
+
+	statistics database.Statistics
+	refreshed  time.Time
+}
+
+// setDatastore makes the collector expose the statistics of the given datastore.
+func (c *statisticsCollector) setDatastore(datastore database.Datastore, exact bool, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.datastore, c.exact, c.ttl = datastore, exact, ttl
+	c.statistics, c.refreshed = database.Statistics{}, time.Time{}
+}
+
+// unsetDatastore stops exposing the statistics of the given datastore, if it is the exposed one.
+func (c *statisticsCollector) unsetDatastore(datastore database.Datastore) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.datastore == datastore {
+		c.datastore = nil
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (c *statisticsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- promLayersDesc
+	ch <- promFeaturesDesc
+	ch <- promFeatureVersionsDesc
+	ch <- promVulnerabilitiesDesc
+	ch <- promPendingNotificationsDesc
+}
+
+// Collect implements prometheus.Collector.
+func (c *statisticsCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.datastore == nil {
+		return
+	}
+
+	if c.refreshed.IsZero() || time.Since(c.refreshed) >= c.ttl {
+		ctx, cancel := context.WithTimeout(context.Background(), statisticsTimeout)
+		statistics, err := c.datastore.GetStatistics(ctx, c.exact)
+		cancel()
+
+		if err != nil {
+			log.Warningf("could not retrieve the database statistics: %s", err)
+			if c.refreshed.IsZero() {
+				return
+			}
+		} else {
+			c.statistics, c.refreshed = statistics, time.Now()
+		}
+	}
+
+	ch <- prometheus.MustNewConstMetric(promLayersDesc, prometheus.GaugeValue, float64(c.statistics.Layers))
+	ch <- prometheus.MustNewConstMetric(promFeaturesDesc, prometheus.GaugeValue, float64(c.statistics.Features))
+	ch <- prometheus.MustNewConstMetric(promFeatureVersionsDesc, prometheus.GaugeValue, float64(c.statistics.FeatureVersions))
+	ch <- prometheus.MustNewConstMetric(promVulnerabilitiesDesc, prometheus.GaugeValue, float64(c.statistics.Vulnerabilities))
+	ch <- prometheus.MustNewConstMetric(promPendingNotificationsDesc, prometheus.GaugeValue, float64(c.statistics.PendingNotifications))
+}
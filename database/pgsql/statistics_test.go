@@ -0,0 +1,95 @@
+// Copyright 2015 clair authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pgsql
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/coreos/clair/database"
+)
+
+func TestStatisticsCollector(t *testing.T) {
+	var (
+		calls      int
+		exactCalls int
+		err        error
+	)
+	datastore := &database.MockDatastore{
+		FctGetStatistics: func(ctx context.Context, exact bool) (database.Statistics, error) {
+			calls++
+			if exact {
+				exactCalls++
+			}
+			return database.Statistics{Layers: calls, PendingNotifications: 3}, err
+		},
+	}
+
+	collect := func(c *statisticsCollector) map[string]float64 {
+		ch := make(chan prometheus.Metric, 10)
+		c.Collect(ch)
+		close(ch)
+
+		values := make(map[string]float64)
+		for m := range ch {
+			var metric dto.Metric
+			m.Write(&metric)
+			values[m.Desc().String()] = metric.GetGauge().GetValue()
+		}
+		return values
+	}
+
+	c := &statisticsCollector{}
+
+	// Nothing is exposed until a datastore is set.
+	assert.Len(t, collect(c), 0)
+
+	// The statistics are retrieved once and cached for the TTL.
+	c.setDatastore(datastore, true, time.Hour)
+	values := collect(c)
+	assert.Len(t, values, 5)
+	assert.Equal(t, float64(1), values[promLayersDesc.String()])
+	assert.Equal(t, float64(3), values[promPendingNotificationsDesc.String()])
+	assert.Equal(t, float64(1), collect(c)[promLayersDesc.String()])
+	assert.Equal(t, 1, calls)
+	assert.Equal(t, 1, exactCalls)
+
+	// Expired statistics are refreshed.
+	c.setDatastore(datastore, false, 0)
+	assert.Equal(t, float64(2), collect(c)[promLayersDesc.String()])
+	assert.Equal(t, float64(3), collect(c)[promLayersDesc.String()])
+	assert.Equal(t, 1, exactCalls)
+
+	// The last known statistics are exposed when they can't be refreshed.
+	err = errors.New("database is down")
+	assert.Equal(t, float64(3), collect(c)[promLayersDesc.String()])
+
+	// Nothing is exposed when the statistics have never been retrieved.
+	c.setDatastore(datastore, false, 0)
+	assert.Len(t, collect(c), 0)
+
+	// Closing another datastore doesn't affect the collector.
+	err = nil
+	c.unsetDatastore(&database.MockDatastore{})
+	assert.Len(t, collect(c), 5)
+	c.unsetDatastore(datastore)
+	assert.Len(t, collect(c), 0)
+}
@@ -0,0 +1,99 @@
+// Copyright 2015 clair authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pgsql
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	// maxTransactionAttempts is the number of times a transaction is attempted before giving up
+	// on serialization failures and deadlocks.
+	maxTransactionAttempts = 5
+
+	// transactionBackoff and maxTransactionBackoff define the exponential backoff between
+	// transaction attempts.
+	transactionBackoff    = 10 * time.Millisecond
+	maxTransactionBackoff = 500 * time.Millisecond
+)
+
+// errRetryTransaction may be returned by a transaction function in order to have the transaction
+// rolled back and retried, for instance after losing an insertion race.
+var errRetryTransaction = errors.New("pgsql: transaction should be retried")
+
+// withTransaction runs fn in a transaction, which is committed if fn succeeds or rolled back
+// otherwise. The whole transaction is retried, with a capped exponential backoff, when PostgreSQL
+// reports a serialization failure or a deadlock.
+//
+// fn must not mask the errors it gets from the transaction using handleError, otherwise they can't
+// be recognized as retryable. Non-retryable errors are returned unchanged, and it is up to the
+// caller to handle them.
+func (pgSQL *pgSQL) withTransaction(ctx context.Context, name string, fn func(tx *sql.Tx) error) (err error) {
+	backoff := transactionBackoff
+
+	for attempt := 1; ; attempt++ {
+		if err = pgSQL.runTransaction(ctx, fn); err == nil || !isErrRetryable(err) {
+			return err
+		}
+
+		if attempt >= maxTransactionAttempts {
+			log.Warningf("%s: giving up after %d attempts: %v", name, attempt, err)
+			return err
+		}
+
+		log.Debugf("%s: retrying transaction after %v: %v", name, backoff, err)
+		promTransactionRetriesTotal.WithLabelValues(name).Inc()
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		if backoff *= 2; backoff > maxTransactionBackoff {
+			backoff = maxTransactionBackoff
+		}
+	}
+}
+
+func (pgSQL *pgSQL) runTransaction(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	tx, err := pgSQL.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	if err = fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// isErrRetryable determines if the given error means that the transaction that generated it could
+// succeed if it is run again: serialization failures and deadlocks.
+func isErrRetryable(err error) bool {
+	if err == errRetryTransaction {
+		return true
+	}
+
+	pqErr, ok := err.(*pq.Error)
+	return ok && (pqErr.Code == "40001" || pqErr.Code == "40P01")
+}
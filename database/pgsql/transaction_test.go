@@ -0,0 +1,83 @@
+// Copyright 2015 clair authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pgsql
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWithTransaction(t *testing.T) {
+	datastore, err := openDatabaseForTest("WithTransaction", false)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer datastore.Close()
+
+	ctx := context.Background()
+
+	// Serialization failures and deadlocks are retried until the transaction succeeds.
+	var attempts int
+	err = datastore.withTransaction(ctx, "TestWithTransaction", func(tx *sql.Tx) error {
+		attempts++
+		switch attempts {
+		case 1:
+			return &pq.Error{Code: "40001"}
+		case 2:
+			return &pq.Error{Code: "40P01"}
+		}
+		_, err := tx.Exec(insertKeyValue, "TestWithTransaction", "committed")
+		return err
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 3, attempts)
+
+	value, err := datastore.GetKeyValue(ctx, "TestWithTransaction")
+	if assert.Nil(t, err) {
+		assert.Equal(t, "committed", value)
+	}
+
+	// The number of attempts is capped.
+	attempts = 0
+	err = datastore.withTransaction(ctx, "TestWithTransaction", func(tx *sql.Tx) error {
+		attempts++
+		return &pq.Error{Code: "40P01"}
+	})
+	assert.Equal(t, &pq.Error{Code: "40P01"}, err)
+	assert.Equal(t, maxTransactionAttempts, attempts)
+
+	// Other errors are returned unchanged, without retrying, and the transaction is rolled back.
+	attempts = 0
+	nonRetryableErr := &pq.Error{Code: "23505"}
+	err = datastore.withTransaction(ctx, "TestWithTransaction", func(tx *sql.Tx) error {
+		attempts++
+		if _, err := tx.Exec(updateKeyValue, "rolled back", "TestWithTransaction"); err != nil {
+			return err
+		}
+		return nonRetryableErr
+	})
+	assert.Equal(t, nonRetryableErr, err)
+	assert.Equal(t, 1, attempts)
+
+	value, err = datastore.GetKeyValue(ctx, "TestWithTransaction")
+	if assert.Nil(t, err) {
+		assert.Equal(t, "committed", value)
+	}
+}
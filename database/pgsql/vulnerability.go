@@ -15,7 +15,9 @@
 package pgsql
 
 import (
+	"context"
 	"database/sql"
+	"database/sql/driver"
 	"encoding/json"
 	"fmt"
 	"reflect"
@@ -28,23 +30,25 @@ import (
 	"github.com/guregu/null/zero"
 )
 
-func (pgSQL *pgSQL) ListVulnerabilities(namespaceName string, limit int, startID int) ([]database.Vulnerability, int, error) {
+func (pgSQL *pgSQL) ListVulnerabilities(ctx context.Context, namespaceName string, minSeverity types.Priority, limit int, startID int) ([]database.Vulnerability, int, error) {
 	defer observeQueryTime("listVulnerabilities", "all", time.Now())
 
+	db := pgSQL.readonly(ctx)
+
 	// Query Namespace.
 	var id int
-	err := pgSQL.QueryRow(searchNamespace, namespaceName).Scan(&id)
+	err := namedQueryRow(ctx, db, "searchNamespace", searchNamespace, namespaceName).Scan(&id)
 	if err != nil {
-		return nil, -1, handleError("searchNamespace", err)
+		return nil, -1, handleError(ctx, "searchNamespace", err)
 	} else if id == 0 {
 		return nil, -1, cerrors.ErrNotFound
 	}
 
 	// Query.
 	query := searchVulnerabilityBase + searchVulnerabilityByNamespace
-	rows, err := pgSQL.Query(query, namespaceName, startID, limit+1)
+	rows, err := namedQuery(ctx, db, "searchVulnerabilityBase+searchVulnerabilityByNamespace", query, namespaceName, startID, limit+1, minSeverity)
 	if err != nil {
-		return nil, -1, handleError("searchVulnerabilityByNamespace", err)
+		return nil, -1, handleError(ctx, "searchVulnerabilityByNamespace", err)
 	}
 	defer rows.Close()
 
@@ -62,11 +66,12 @@ func (pgSQL *pgSQL) ListVulnerabilities(namespaceName string, limit int, startID
 			&vulnerability.Namespace.Name,
 			&vulnerability.Description,
 			&vulnerability.Link,
+			(*linkList)(&vulnerability.Links),
 			&vulnerability.Severity,
 			&vulnerability.Metadata,
 		)
 		if err != nil {
-			return nil, -1, handleError("searchVulnerabilityByNamespace.Scan()", err)
+			return nil, -1, handleError(ctx, "searchVulnerabilityByNamespace.Scan()", err)
 		}
 		size++
 		if size > limit {
@@ -77,17 +82,17 @@ func (pgSQL *pgSQL) ListVulnerabilities(namespaceName string, limit int, startID
 	}
 
 	if err := rows.Err(); err != nil {
-		return nil, -1, handleError("searchVulnerabilityByNamespace.Rows()", err)
+		return nil, -1, handleError(ctx, "searchVulnerabilityByNamespace.Rows()", err)
 	}
 
 	return vulns, nextID, nil
 }
 
-func (pgSQL *pgSQL) FindVulnerability(namespaceName, name string) (database.Vulnerability, error) {
-	return findVulnerability(pgSQL, namespaceName, name, false)
+func (pgSQL *pgSQL) FindVulnerability(ctx context.Context, namespaceName, name string) (database.Vulnerability, error) {
+	return findVulnerability(ctx, pgSQL.readonly(ctx), namespaceName, name, false)
 }
 
-func findVulnerability(queryer Queryer, namespaceName, name string, forUpdate bool) (database.Vulnerability, error) {
+func findVulnerability(ctx context.Context, queryer Queryer, namespaceName, name string, forUpdate bool) (database.Vulnerability, error) {
 	defer observeQueryTime("findVulnerability", "all", time.Now())
 
 	queryName := "searchVulnerabilityBase+searchVulnerabilityByNamespaceAndName"
@@ -97,19 +102,19 @@ func findVulnerability(queryer Queryer, namespaceName, name string, forUpdate bo
 		query = query + searchVulnerabilityForUpdate
 	}
 
-	return scanVulnerability(queryer, queryName, queryer.QueryRow(query, namespaceName, name))
+	return scanVulnerability(ctx, queryer, queryName, namedQueryRow(ctx, queryer, queryName, query, namespaceName, name))
 }
 
-func (pgSQL *pgSQL) findVulnerabilityByIDWithDeleted(id int) (database.Vulnerability, error) {
+func (pgSQL *pgSQL) findVulnerabilityByIDWithDeleted(ctx context.Context, id int) (database.Vulnerability, error) {
 	defer observeQueryTime("findVulnerabilityByIDWithDeleted", "all", time.Now())
 
 	queryName := "searchVulnerabilityBase+searchVulnerabilityByID"
 	query := searchVulnerabilityBase + searchVulnerabilityByID
 
-	return scanVulnerability(pgSQL, queryName, pgSQL.QueryRow(query, id))
+	return scanVulnerability(ctx, pgSQL, queryName, namedQueryRow(ctx, pgSQL, queryName, query, id))
 }
 
-func scanVulnerability(queryer Queryer, queryName string, vulnerabilityRow *sql.Row) (database.Vulnerability, error) {
+func scanVulnerability(ctx context.Context, queryer Queryer, queryName string, vulnerabilityRow *sql.Row) (database.Vulnerability, error) {
 	var vulnerability database.Vulnerability
 
 	err := vulnerabilityRow.Scan(
@@ -119,12 +124,13 @@ func scanVulnerability(queryer Queryer, queryName string, vulnerabilityRow *sql.
 		&vulnerability.Namespace.Name,
 		&vulnerability.Description,
 		&vulnerability.Link,
+		(*linkList)(&vulnerability.Links),
 		&vulnerability.Severity,
 		&vulnerability.Metadata,
 	)
 
 	if err != nil {
-		return vulnerability, handleError(queryName+".Scan()", err)
+		return vulnerability, handleError(ctx, queryName+".Scan()", err)
 	}
 
 	if vulnerability.ID == 0 {
@@ -132,15 +138,15 @@ func scanVulnerability(queryer Queryer, queryName string, vulnerabilityRow *sql.
 	}
 
 	// Query the FixedIn FeatureVersion now.
-	rows, err := queryer.Query(searchVulnerabilityFixedIn, vulnerability.ID)
+	rows, err := namedQuery(ctx, queryer, "searchVulnerabilityFixedIn", searchVulnerabilityFixedIn, vulnerability.ID)
 	if err != nil {
-		return vulnerability, handleError("searchVulnerabilityFixedIn.Scan()", err)
+		return vulnerability, handleError(ctx, "searchVulnerabilityFixedIn.Scan()", err)
 	}
 	defer rows.Close()
 
 	for rows.Next() {
 		var featureVersionID zero.Int
-		var featureVersionVersion zero.String
+		var featureVersionVersion types.Version
 		var featureVersionFeatureName zero.String
 
 		err := rows.Scan(
@@ -150,7 +156,7 @@ func scanVulnerability(queryer Queryer, queryName string, vulnerabilityRow *sql.
 		)
 
 		if err != nil {
-			return vulnerability, handleError("searchVulnerabilityFixedIn.Scan()", err)
+			return vulnerability, handleError(ctx, "searchVulnerabilityFixedIn.Scan()", err)
 		}
 
 		if !featureVersionID.IsZero() {
@@ -163,14 +169,14 @@ func scanVulnerability(queryer Queryer, queryName string, vulnerabilityRow *sql.
 					Namespace: vulnerability.Namespace,
 					Name:      featureVersionFeatureName.String,
 				},
-				Version: types.NewVersionUnsafe(featureVersionVersion.String),
+				Version: featureVersionVersion,
 			}
 			vulnerability.FixedIn = append(vulnerability.FixedIn, featureVersion)
 		}
 	}
 
 	if err := rows.Err(); err != nil {
-		return vulnerability, handleError("searchVulnerabilityFixedIn.Rows()", err)
+		return vulnerability, handleError(ctx, "searchVulnerabilityFixedIn.Rows()", err)
 	}
 
 	return vulnerability, nil
@@ -178,9 +184,9 @@ func scanVulnerability(queryer Queryer, queryName string, vulnerabilityRow *sql.
 
 // FixedIn.Namespace are not necessary, they are overwritten by the vuln.
 // By setting the fixed version to minVersion, we can say that the vuln does'nt affect anymore.
-func (pgSQL *pgSQL) InsertVulnerabilities(vulnerabilities []database.Vulnerability, generateNotifications bool) error {
+func (pgSQL *pgSQL) InsertVulnerabilities(ctx context.Context, vulnerabilities []database.Vulnerability, generateNotifications bool) error {
 	for _, vulnerability := range vulnerabilities {
-		err := pgSQL.insertVulnerability(vulnerability, false, generateNotifications)
+		err := pgSQL.insertVulnerability(ctx, vulnerability, nil, false, generateNotifications)
 		if err != nil {
 			fmt.Printf("%#v\n", vulnerability)
 			return err
@@ -189,17 +195,39 @@ func (pgSQL *pgSQL) InsertVulnerabilities(vulnerabilities []database.Vulnerabili
 	return nil
 }
 
-func (pgSQL *pgSQL) insertVulnerability(vulnerability database.Vulnerability, onlyFixedIn, generateNotification bool) error {
+// CreateVulnerability stores a new Vulnerability, or returns ErrAlreadyExists.
+func (pgSQL *pgSQL) CreateVulnerability(ctx context.Context, vulnerability database.Vulnerability, generateNotification bool) error {
+	return pgSQL.insertVulnerability(ctx, vulnerability, nil, true, generateNotification)
+}
+
+// insertVulnerability inserts or updates the given Vulnerability. With an update, the Vulnerability
+// must exist and the update is applied to it. With create, it must not exist.
+func (pgSQL *pgSQL) insertVulnerability(ctx context.Context, vulnerability database.Vulnerability, update *database.VulnerabilityUpdate, create, generateNotification bool) error {
 	tf := time.Now()
 
 	// Verify parameters
 	if vulnerability.Name == "" || vulnerability.Namespace.Name == "" {
 		return cerrors.NewBadRequestError("insertVulnerability needs at least the Name and the Namespace")
 	}
-	if !onlyFixedIn && !vulnerability.Severity.IsValid() {
-		msg := fmt.Sprintf("could not insert a vulnerability that has an invalid Severity: %s", vulnerability.Severity)
-		log.Warning(msg)
-		return cerrors.NewBadRequestError(msg)
+	if update != nil {
+		if update.Severity != nil && !update.Severity.IsValid() {
+			return cerrors.NewBadRequestError("could not update a vulnerability with an invalid Severity")
+		}
+	} else {
+		if vulnerability.Severity == "" {
+			msg := "could not insert a vulnerability that has no Severity"
+			log.Warning(msg)
+			return cerrors.NewBadRequestError(msg)
+		}
+
+		// Updaters may not spell the severities exactly like we do: unknown ones are stored as
+		// Unknown rather than failing the whole update.
+		severity, ok := types.NormalizePriority(vulnerability.Severity)
+		if !ok {
+			log.Warningf("vulnerability %s has an unknown Severity (%s), storing it as %s", vulnerability.Name, vulnerability.Severity, severity)
+			promUnknownSeveritiesTotal.Inc()
+		}
+		vulnerability.Severity = severity
 	}
 	for i := 0; i < len(vulnerability.FixedIn); i++ {
 		fifv := &vulnerability.FixedIn[i]
@@ -219,22 +247,26 @@ func (pgSQL *pgSQL) insertVulnerability(vulnerability database.Vulnerability, on
 	defer observeQueryTime("insertVulnerability", "all", tf)
 
 	// Begin transaction.
-	tx, err := pgSQL.Begin()
+	tx, err := pgSQL.BeginTx(ctx, nil)
 	if err != nil {
 		tx.Rollback()
-		return handleError("insertVulnerability.Begin()", err)
+		return handleError(ctx, "insertVulnerability.Begin()", err)
 	}
 
 	// Find existing vulnerability and its Vulnerability_FixedIn_Features (for update).
-	existingVulnerability, err := findVulnerability(tx, vulnerability.Namespace.Name, vulnerability.Name, true)
+	existingVulnerability, err := findVulnerability(ctx, tx, vulnerability.Namespace.Name, vulnerability.Name, true)
 	if err != nil && err != cerrors.ErrNotFound {
 		tx.Rollback()
 		return err
 	}
+	if create && existingVulnerability.ID != 0 {
+		tx.Rollback()
+		return database.ErrAlreadyExists
+	}
 
-	if onlyFixedIn {
-		// Because this call tries to update FixedIn FeatureVersion, import all other data from the
-		// existing one.
+	if update != nil {
+		// Because this call updates an existing vulnerability, import all the data that is not
+		// updated from the existing one.
 		if existingVulnerability.ID == 0 {
 			return cerrors.ErrNotFound
 		}
@@ -242,11 +274,22 @@ func (pgSQL *pgSQL) insertVulnerability(vulnerability database.Vulnerability, on
 		fixedIn := vulnerability.FixedIn
 		vulnerability = existingVulnerability
 		vulnerability.FixedIn = fixedIn
+		update.Apply(&vulnerability)
 	}
 
 	if existingVulnerability.ID != 0 {
+		// Merge the metadata, so the sources that are not specified keep their data.
+		vulnerability.Metadata = mergeMetadata(existingVulnerability.Metadata, vulnerability.Metadata)
+
+		// Merge the links, so the references given by every source are kept.
+		if vulnerability.Link == "" {
+			vulnerability.Link = existingVulnerability.Link
+		}
+		vulnerability.Links = mergeLinks(vulnerability.Link, existingVulnerability.Links, vulnerability.Links)
+
 		updateMetadata := vulnerability.Description != existingVulnerability.Description ||
 			vulnerability.Link != existingVulnerability.Link ||
+			!reflect.DeepEqual(vulnerability.Links, existingVulnerability.Links) ||
 			vulnerability.Severity != existingVulnerability.Severity ||
 			!reflect.DeepEqual(castMetadata(vulnerability.Metadata), existingVulnerability.Metadata)
 
@@ -264,10 +307,10 @@ func (pgSQL *pgSQL) insertVulnerability(vulnerability database.Vulnerability, on
 		}
 
 		// Mark the old vulnerability as non latest.
-		_, err = tx.Exec(removeVulnerability, vulnerability.Namespace.Name, vulnerability.Name)
+		_, err = namedExec(ctx, tx, "removeVulnerability", removeVulnerability, vulnerability.Namespace.Name, vulnerability.Name)
 		if err != nil {
 			tx.Rollback()
-			return handleError("removeVulnerability", err)
+			return handleError(ctx, "removeVulnerability", err)
 		}
 	} else {
 		// The vulnerability is new, we don't want to have any types.MinVersion as they are only used
@@ -279,40 +322,52 @@ func (pgSQL *pgSQL) insertVulnerability(vulnerability database.Vulnerability, on
 			}
 		}
 		vulnerability.FixedIn = fixedIn
+
+		vulnerability.Links = mergeLinks(vulnerability.Link, vulnerability.Links)
 	}
 
 	// Find or insert Vulnerability's Namespace.
-	namespaceID, err := pgSQL.insertNamespace(vulnerability.Namespace)
+	namespaceID, err := pgSQL.insertNamespace(ctx, vulnerability.Namespace)
 	if err != nil {
 		return err
 	}
 
 	// Insert vulnerability.
-	err = tx.QueryRow(
+	err = namedQueryRow(ctx, tx, "insertVulnerability",
 		insertVulnerability,
 		namespaceID,
 		vulnerability.Name,
 		vulnerability.Description,
 		vulnerability.Link,
+		linkList(vulnerability.Links),
 		&vulnerability.Severity,
 		&vulnerability.Metadata,
 	).Scan(&vulnerability.ID)
 
 	if err != nil {
 		tx.Rollback()
-		return handleError("insertVulnerability", err)
+		return handleError(ctx, "insertVulnerability", err)
 	}
 
 	// Update Vulnerability_FixedIn_Feature and Vulnerability_Affects_FeatureVersion now.
-	err = pgSQL.insertVulnerabilityFixedInFeatureVersions(tx, vulnerability.ID, vulnerability.FixedIn)
+	err = pgSQL.insertVulnerabilityFixedInFeatureVersions(ctx, tx, vulnerability.ID, vulnerability.FixedIn)
 	if err != nil {
 		tx.Rollback()
 		return err
 	}
 
+	// Record the changes in the history of the vulnerability.
+	if existingVulnerability.ID != 0 {
+		err = recordVulnerabilityHistory(ctx, tx, namespaceID, existingVulnerability, vulnerability)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
 	// Create a notification.
 	if generateNotification {
-		err = createNotification(tx, existingVulnerability.ID, vulnerability.ID)
+		err = createNotification(ctx, tx, existingVulnerability.ID, vulnerability.ID)
 		if err != nil {
 			return err
 		}
@@ -322,7 +377,7 @@ func (pgSQL *pgSQL) insertVulnerability(vulnerability database.Vulnerability, on
 	err = tx.Commit()
 	if err != nil {
 		tx.Rollback()
-		return handleError("insertVulnerability.Commit()", err)
+		return handleError(ctx, "insertVulnerability.Commit()", err)
 	}
 
 	return nil
@@ -339,6 +394,76 @@ func castMetadata(m database.MetadataMap) database.MetadataMap {
 	return c
 }
 
+// mergeMetadata returns the metadata that results from updating the given current metadata.
+// Metadata are keyed by source name: the update replaces entirely the data of the sources it
+// specifies, a nil value removing the source, and leaves the other sources untouched.
+func mergeMetadata(current, update database.MetadataMap) database.MetadataMap {
+	if len(update) == 0 {
+		return current
+	}
+
+	merged := make(database.MetadataMap, len(current)+len(update))
+	for source, data := range current {
+		merged[source] = data
+	}
+	for source, data := range update {
+		if data == nil {
+			delete(merged, source)
+		} else {
+			merged[source] = data
+		}
+	}
+
+	if len(merged) == 0 && current == nil {
+		return nil
+	}
+	return merged
+}
+
+// mergeLinks returns the union of the given lists of links, starting with the primary link.
+// Duplicates and empty links are removed.
+func mergeLinks(primary string, lists ...[]string) []string {
+	var merged []string
+	seen := make(map[string]struct{})
+
+	add := func(link string) {
+		if _, ok := seen[link]; link == "" || ok {
+			return
+		}
+		seen[link] = struct{}{}
+		merged = append(merged, link)
+	}
+
+	add(primary)
+	for _, list := range lists {
+		for _, link := range list {
+			add(link)
+		}
+	}
+
+	return merged
+}
+
+// linkList stores a list of links as a JSON array.
+type linkList []string
+
+func (l *linkList) Scan(value interface{}) error {
+	val, ok := value.([]byte)
+	if !ok {
+		*l = nil
+		return nil
+	}
+	return json.Unmarshal(val, l)
+}
+
+func (l linkList) Value() (driver.Value, error) {
+	if len(l) == 0 {
+		return nil, nil
+	}
+	j, err := json.Marshal([]string(l))
+	return string(j), err
+}
+
 // applyFixedInDiff applies a FeatureVersion diff on a FeatureVersion list and returns the result.
 func applyFixedInDiff(currentList, diff []database.FeatureVersion) ([]database.FeatureVersion, bool) {
 	currentMap, currentNames := createFeatureVersionNameMap(currentList)
@@ -400,7 +525,7 @@ func createFeatureVersionNameMap(features []database.FeatureVersion) (map[string
 // vulnerability with the specified database.FeatureVersion list and uses
 // linkVulnerabilityToFeatureVersions to propagate the changes on Vulnerability_FixedIn_Feature to
 // Vulnerability_Affects_FeatureVersion.
-func (pgSQL *pgSQL) insertVulnerabilityFixedInFeatureVersions(tx *sql.Tx, vulnerabilityID int, fixedIn []database.FeatureVersion) error {
+func (pgSQL *pgSQL) insertVulnerabilityFixedInFeatureVersions(ctx context.Context, tx *sql.Tx, vulnerabilityID int, fixedIn []database.FeatureVersion) error {
 	defer observeQueryTime("insertVulnerabilityFixedInFeatureVersions", "all", time.Now())
 
 	// Insert or find the Features.
@@ -412,7 +537,7 @@ func (pgSQL *pgSQL) insertVulnerabilityFixedInFeatureVersions(tx *sql.Tx, vulner
 	}
 	for _, feature := range features {
 		if feature.ID == 0 {
-			if feature.ID, err = pgSQL.insertFeature(*feature); err != nil {
+			if feature.ID, err = pgSQL.insertFeature(ctx, *feature); err != nil {
 				return err
 			}
 		}
@@ -423,30 +548,30 @@ func (pgSQL *pgSQL) insertVulnerabilityFixedInFeatureVersions(tx *sql.Tx, vulner
 	promConcurrentLockVAFV.Inc()
 	defer promConcurrentLockVAFV.Dec()
 	t := time.Now()
-	_, err = tx.Exec(lockVulnerabilityAffects)
+	_, err = namedExec(ctx, tx, "lockVulnerabilityAffects", lockVulnerabilityAffects)
 	observeQueryTime("insertVulnerability", "lock", t)
 
 	if err != nil {
 		tx.Rollback()
-		return handleError("insertVulnerability.lockVulnerabilityAffects", err)
+		return handleError(ctx, "insertVulnerability.lockVulnerabilityAffects", err)
 	}
 
 	for _, fv := range fixedIn {
 		var fixedInID int
 
 		// Insert Vulnerability_FixedIn_Feature.
-		err = tx.QueryRow(
+		err = namedQueryRow(ctx, tx, "insertVulnerabilityFixedInFeature",
 			insertVulnerabilityFixedInFeature,
 			vulnerabilityID, fv.Feature.ID,
 			&fv.Version,
 		).Scan(&fixedInID)
 
 		if err != nil {
-			return handleError("insertVulnerabilityFixedInFeature", err)
+			return handleError(ctx, "insertVulnerabilityFixedInFeature", err)
 		}
 
 		// Insert Vulnerability_Affects_FeatureVersion.
-		err = linkVulnerabilityToFeatureVersions(tx, fixedInID, vulnerabilityID, fv.Feature.ID, fv.Version)
+		err = linkVulnerabilityToFeatureVersions(ctx, tx, fixedInID, vulnerabilityID, fv.Feature.ID, fv.Version)
 		if err != nil {
 			return err
 		}
@@ -455,49 +580,50 @@ func (pgSQL *pgSQL) insertVulnerabilityFixedInFeatureVersions(tx *sql.Tx, vulner
 	return nil
 }
 
-func linkVulnerabilityToFeatureVersions(tx *sql.Tx, fixedInID, vulnerabilityID, featureID int, fixedInVersion types.Version) error {
+func linkVulnerabilityToFeatureVersions(ctx context.Context, tx *sql.Tx, fixedInID, vulnerabilityID, featureID int, fixedInVersion types.Version) error {
 	// Find every FeatureVersions of the Feature that the vulnerability affects.
 	// TODO(Quentin-M): LIMIT
-	rows, err := tx.Query(searchFeatureVersionByFeature, featureID)
+	rows, err := namedQuery(ctx, tx, "searchFeatureVersionByFeature", searchFeatureVersionByFeature, featureID)
 	if err != nil {
-		return handleError("searchFeatureVersionByFeature", err)
+		return handleError(ctx, "searchFeatureVersionByFeature", err)
 	}
 	defer rows.Close()
 
 	var affecteds []database.FeatureVersion
 	for rows.Next() {
 		var affected database.FeatureVersion
+		var versionFormat zero.String
 
-		err := rows.Scan(&affected.ID, &affected.Version)
+		err := rows.Scan(&affected.ID, &affected.Version, &versionFormat)
 		if err != nil {
-			return handleError("searchFeatureVersionByFeature.Scan()", err)
+			return handleError(ctx, "searchFeatureVersionByFeature.Scan()", err)
 		}
 
-		if affected.Version.Compare(fixedInVersion) < 0 {
+		if affected.Version.CompareFormat(fixedInVersion, types.VersionFormat(versionFormat.String)) < 0 {
 			// The version of the FeatureVersion is lower than the fixed version of this vulnerability,
 			// thus, this FeatureVersion is affected by it.
 			affecteds = append(affecteds, affected)
 		}
 	}
 	if err = rows.Err(); err != nil {
-		return handleError("searchFeatureVersionByFeature.Rows()", err)
+		return handleError(ctx, "searchFeatureVersionByFeature.Rows()", err)
 	}
 	rows.Close()
 
 	// Insert into Vulnerability_Affects_FeatureVersion.
 	for _, affected := range affecteds {
 		// TODO(Quentin-M): Batch me.
-		_, err := tx.Exec(insertVulnerabilityAffectsFeatureVersion, vulnerabilityID,
+		_, err := namedExec(ctx, tx, "insertVulnerabilityAffectsFeatureVersion", insertVulnerabilityAffectsFeatureVersion, vulnerabilityID,
 			affected.ID, fixedInID)
 		if err != nil {
-			return handleError("insertVulnerabilityAffectsFeatureVersion", err)
+			return handleError(ctx, "insertVulnerabilityAffectsFeatureVersion", err)
 		}
 	}
 
 	return nil
 }
 
-func (pgSQL *pgSQL) InsertVulnerabilityFixes(vulnerabilityNamespace, vulnerabilityName string, fixes []database.FeatureVersion) error {
+func (pgSQL *pgSQL) InsertVulnerabilityFixes(ctx context.Context, vulnerabilityNamespace, vulnerabilityName string, fixes []database.FeatureVersion) error {
 	defer observeQueryTime("InsertVulnerabilityFixes", "all", time.Now())
 
 	v := database.Vulnerability{
@@ -508,10 +634,27 @@ func (pgSQL *pgSQL) InsertVulnerabilityFixes(vulnerabilityNamespace, vulnerabili
 		FixedIn: fixes,
 	}
 
-	return pgSQL.insertVulnerability(v, true, true)
+	return pgSQL.insertVulnerability(ctx, v, &database.VulnerabilityUpdate{}, false, true)
+}
+
+func (pgSQL *pgSQL) UpdateVulnerability(ctx context.Context, namespaceName, name string, update database.VulnerabilityUpdate) (database.Vulnerability, error) {
+	defer observeQueryTime("UpdateVulnerability", "all", time.Now())
+
+	v := database.Vulnerability{
+		Name: name,
+		Namespace: database.Namespace{
+			Name: namespaceName,
+		},
+		FixedIn: update.FixedIn,
+	}
+
+	if err := pgSQL.insertVulnerability(ctx, v, &update, false, true); err != nil {
+		return database.Vulnerability{}, err
+	}
+	return pgSQL.FindVulnerability(ctx, namespaceName, name)
 }
 
-func (pgSQL *pgSQL) DeleteVulnerabilityFix(vulnerabilityNamespace, vulnerabilityName, featureName string) error {
+func (pgSQL *pgSQL) DeleteVulnerabilityFix(ctx context.Context, vulnerabilityNamespace, vulnerabilityName, featureName string) error {
 	defer observeQueryTime("DeleteVulnerabilityFix", "all", time.Now())
 
 	v := database.Vulnerability{
@@ -532,28 +675,28 @@ func (pgSQL *pgSQL) DeleteVulnerabilityFix(vulnerabilityNamespace, vulnerability
 		},
 	}
 
-	return pgSQL.insertVulnerability(v, true, true)
+	return pgSQL.insertVulnerability(ctx, v, &database.VulnerabilityUpdate{}, false, true)
 }
 
-func (pgSQL *pgSQL) DeleteVulnerability(namespaceName, name string) error {
+func (pgSQL *pgSQL) DeleteVulnerability(ctx context.Context, namespaceName, name string) error {
 	defer observeQueryTime("DeleteVulnerability", "all", time.Now())
 
 	// Begin transaction.
-	tx, err := pgSQL.Begin()
+	tx, err := pgSQL.BeginTx(ctx, nil)
 	if err != nil {
 		tx.Rollback()
-		return handleError("DeleteVulnerability.Begin()", err)
+		return handleError(ctx, "DeleteVulnerability.Begin()", err)
 	}
 
 	var vulnerabilityID int
-	err = tx.QueryRow(removeVulnerability, namespaceName, name).Scan(&vulnerabilityID)
+	err = namedQueryRow(ctx, tx, "removeVulnerability", removeVulnerability, namespaceName, name).Scan(&vulnerabilityID)
 	if err != nil {
 		tx.Rollback()
-		return handleError("removeVulnerability", err)
+		return handleError(ctx, "removeVulnerability", err)
 	}
 
 	// Create a notification.
-	err = createNotification(tx, vulnerabilityID, 0)
+	err = createNotification(ctx, tx, vulnerabilityID, 0)
 	if err != nil {
 		return err
 	}
@@ -562,8 +705,52 @@ func (pgSQL *pgSQL) DeleteVulnerability(namespaceName, name string) error {
 	err = tx.Commit()
 	if err != nil {
 		tx.Rollback()
-		return handleError("DeleteVulnerability.Commit()", err)
+		return handleError(ctx, "DeleteVulnerability.Commit()", err)
 	}
 
 	return nil
 }
+
+func (pgSQL *pgSQL) GetAffectedLayers(ctx context.Context, namespaceName, name string, limit, startAfterID int) ([]database.Layer, int, error) {
+	if limit <= 0 {
+		return nil, 0, cerrors.NewBadRequestError("could not list affected layers with a non-positive limit")
+	}
+
+	defer observeQueryTime("GetAffectedLayers", "all", time.Now())
+
+	db := pgSQL.readonly(ctx)
+
+	// Find the vulnerability.
+	var vulnerabilityID int
+	err := namedQueryRow(ctx, db, "searchVulnerabilityID", searchVulnerabilityID, namespaceName, name).Scan(&vulnerabilityID)
+	if err != nil {
+		return nil, 0, handleError(ctx, "searchVulnerabilityID", err)
+	}
+
+	// Count and list the affected layers.
+	var total int
+	err = namedQueryRow(ctx, db, "affectedLayersBase+countAffectedLayers", affectedLayersBase+countAffectedLayers, vulnerabilityID).Scan(&total)
+	if err != nil {
+		return nil, 0, handleError(ctx, "countAffectedLayers", err)
+	}
+
+	rows, err := namedQuery(ctx, db, "affectedLayersBase+searchAffectedLayers", affectedLayersBase+searchAffectedLayers, vulnerabilityID, startAfterID, limit)
+	if err != nil {
+		return nil, 0, handleError(ctx, "searchAffectedLayers", err)
+	}
+	defer rows.Close()
+
+	var layers []database.Layer
+	for rows.Next() {
+		var layer database.Layer
+		if err = rows.Scan(&layer.ID, &layer.Name); err != nil {
+			return nil, 0, handleError(ctx, "searchAffectedLayers.Scan()", err)
+		}
+		layers = append(layers, layer)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, 0, handleError(ctx, "searchAffectedLayers.Rows()", err)
+	}
+
+	return layers, total, nil
+}
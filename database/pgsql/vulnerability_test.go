@@ -15,6 +15,7 @@
 package pgsql
 
 import (
+	"context"
 	"reflect"
 	"testing"
 
@@ -34,7 +35,7 @@ func TestFindVulnerability(t *testing.T) {
 	defer datastore.Close()
 
 	// Find a vulnerability that does not exist.
-	_, err = datastore.FindVulnerability("", "")
+	_, err = datastore.FindVulnerability(context.Background(), "", "")
 	assert.Equal(t, cerrors.ErrNotFound, err)
 
 	// Find a normal vulnerability.
@@ -56,7 +57,7 @@ func TestFindVulnerability(t *testing.T) {
 		},
 	}
 
-	v1f, err := datastore.FindVulnerability("debian:7", "CVE-OPENSSL-1-DEB7")
+	v1f, err := datastore.FindVulnerability(context.Background(), "debian:7", "CVE-OPENSSL-1-DEB7")
 	if assert.Nil(t, err) {
 		equalsVuln(t, &v1, &v1f)
 	}
@@ -69,7 +70,7 @@ func TestFindVulnerability(t *testing.T) {
 		Severity:    types.Unknown,
 	}
 
-	v2f, err := datastore.FindVulnerability("debian:7", "CVE-NOPE")
+	v2f, err := datastore.FindVulnerability(context.Background(), "debian:7", "CVE-NOPE")
 	if assert.Nil(t, err) {
 		equalsVuln(t, &v2, &v2f)
 	}
@@ -84,15 +85,15 @@ func TestDeleteVulnerability(t *testing.T) {
 	defer datastore.Close()
 
 	// Delete non-existing Vulnerability.
-	err = datastore.DeleteVulnerability("TestDeleteVulnerabilityNamespace1", "CVE-OPENSSL-1-DEB7")
+	err = datastore.DeleteVulnerability(context.Background(), "TestDeleteVulnerabilityNamespace1", "CVE-OPENSSL-1-DEB7")
 	assert.Equal(t, cerrors.ErrNotFound, err)
-	err = datastore.DeleteVulnerability("debian:7", "TestDeleteVulnerabilityVulnerability1")
+	err = datastore.DeleteVulnerability(context.Background(), "debian:7", "TestDeleteVulnerabilityVulnerability1")
 	assert.Equal(t, cerrors.ErrNotFound, err)
 
 	// Delete Vulnerability.
-	err = datastore.DeleteVulnerability("debian:7", "CVE-OPENSSL-1-DEB7")
+	err = datastore.DeleteVulnerability(context.Background(), "debian:7", "CVE-OPENSSL-1-DEB7")
 	if assert.Nil(t, err) {
-		_, err := datastore.FindVulnerability("debian:7", "CVE-OPENSSL-1-DEB7")
+		_, err := datastore.FindVulnerability(context.Background(), "debian:7", "CVE-OPENSSL-1-DEB7")
 		assert.Equal(t, cerrors.ErrNotFound, err)
 	}
 }
@@ -192,7 +193,7 @@ func TestInsertVulnerability(t *testing.T) {
 			Severity:  types.Unknown,
 		},
 	} {
-		err := datastore.InsertVulnerabilities([]database.Vulnerability{vulnerability}, true)
+		err := datastore.InsertVulnerabilities(context.Background(), []database.Vulnerability{vulnerability}, true)
 		assert.Error(t, err)
 	}
 
@@ -214,9 +215,9 @@ func TestInsertVulnerability(t *testing.T) {
 		Link:        "TestInsertVulnerabilityLink1",
 		Metadata:    v1meta,
 	}
-	err = datastore.InsertVulnerabilities([]database.Vulnerability{v1}, true)
+	err = datastore.InsertVulnerabilities(context.Background(), []database.Vulnerability{v1}, true)
 	if assert.Nil(t, err) {
-		v1f, err := datastore.FindVulnerability(n1.Name, v1.Name)
+		v1f, err := datastore.FindVulnerability(context.Background(), n1.Name, v1.Name)
 		if assert.Nil(t, err) {
 			equalsVuln(t, &v1, &v1f)
 		}
@@ -230,9 +231,9 @@ func TestInsertVulnerability(t *testing.T) {
 	// adding f8 which is f7 but with MinVersion.
 	v1.FixedIn = []database.FeatureVersion{f4, f5, f6, f8}
 
-	err = datastore.InsertVulnerabilities([]database.Vulnerability{v1}, true)
+	err = datastore.InsertVulnerabilities(context.Background(), []database.Vulnerability{v1}, true)
 	if assert.Nil(t, err) {
-		v1f, err := datastore.FindVulnerability(n1.Name, v1.Name)
+		v1f, err := datastore.FindVulnerability(context.Background(), n1.Name, v1.Name)
 		if assert.Nil(t, err) {
 			// We already had f1 before the update.
 			// Add it to the struct for comparison.
@@ -275,3 +276,190 @@ func equalsVuln(t *testing.T, expected, actual *database.Vulnerability) {
 		}
 	}
 }
+
+func TestInsertVulnerabilityMetadata(t *testing.T) {
+	datastore, err := openDatabaseForTest("InsertVulnerabilityMetadata", true)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer datastore.Close()
+	ctx := context.Background()
+
+	v, err := datastore.FindVulnerability(ctx, "debian:7", "CVE-OPENSSL-1-DEB7")
+	if !assert.Nil(t, err) {
+		return
+	}
+	v.FixedIn = nil
+
+	// Insert nested metadata from two sources.
+	v.Metadata = database.MetadataMap{
+		"NVD": map[string]interface{}{
+			"CVSSv2": map[string]interface{}{
+				"Score":   7.5,
+				"Vectors": "AV:N/AC:L/Au:N/C:P/I:P/A:P",
+			},
+		},
+		"Debian": map[string]interface{}{
+			"Urgency": "high",
+		},
+	}
+	if assert.Nil(t, datastore.InsertVulnerabilities(ctx, []database.Vulnerability{v}, false)) {
+		vf, err := datastore.FindVulnerability(ctx, "debian:7", "CVE-OPENSSL-1-DEB7")
+		if assert.Nil(t, err) {
+			assert.Equal(t, castMetadata(v.Metadata), vf.Metadata)
+		}
+	}
+
+	// Updating a source only replaces its own data.
+	v.Metadata = database.MetadataMap{
+		"Debian": map[string]interface{}{
+			"Urgency": "low",
+		},
+	}
+	if assert.Nil(t, datastore.InsertVulnerabilities(ctx, []database.Vulnerability{v}, false)) {
+		vf, err := datastore.FindVulnerability(ctx, "debian:7", "CVE-OPENSSL-1-DEB7")
+		if assert.Nil(t, err) {
+			assert.Equal(t, "low", vf.Metadata["Debian"].(map[string]interface{})["Urgency"])
+			assert.Equal(t, 7.5, vf.Metadata["NVD"].(map[string]interface{})["CVSSv2"].(map[string]interface{})["Score"])
+		}
+	}
+
+	// The metadata are returned along with the vulnerabilities affecting a layer.
+	layer, err := datastore.FindLayer(ctx, "layer-1", false, true, types.Unknown)
+	if assert.Nil(t, err) {
+		found := false
+		for _, fv := range layer.Features {
+			for _, affectedBy := range fv.AffectedBy {
+				if affectedBy.Name == "CVE-OPENSSL-1-DEB7" {
+					found = true
+					assert.Contains(t, affectedBy.Metadata, "NVD")
+					assert.Contains(t, affectedBy.Metadata, "Debian")
+				}
+			}
+		}
+		assert.True(t, found)
+	}
+
+	// A nil value removes a source.
+	v.Metadata = database.MetadataMap{"NVD": nil}
+	if assert.Nil(t, datastore.InsertVulnerabilities(ctx, []database.Vulnerability{v}, false)) {
+		vf, err := datastore.FindVulnerability(ctx, "debian:7", "CVE-OPENSSL-1-DEB7")
+		if assert.Nil(t, err) {
+			assert.NotContains(t, vf.Metadata, "NVD")
+			assert.Contains(t, vf.Metadata, "Debian")
+		}
+	}
+}
+
+func TestMergeMetadata(t *testing.T) {
+	current := database.MetadataMap{"NVD": "nvd", "Debian": "debian"}
+
+	assert.Equal(t, current, mergeMetadata(current, nil))
+	assert.Equal(t, database.MetadataMap{"NVD": "nvd", "Debian": "updated"}, mergeMetadata(current, database.MetadataMap{"Debian": "updated"}))
+	assert.Equal(t, database.MetadataMap{"Debian": "debian"}, mergeMetadata(current, database.MetadataMap{"NVD": nil}))
+	assert.Equal(t, database.MetadataMap{"NVD": "nvd"}, mergeMetadata(nil, database.MetadataMap{"NVD": "nvd"}))
+	assert.Nil(t, mergeMetadata(nil, database.MetadataMap{"NVD": nil}))
+
+	// The current metadata must not be modified.
+	assert.Equal(t, database.MetadataMap{"NVD": "nvd", "Debian": "debian"}, current)
+}
+
+func TestInsertVulnerabilityLinks(t *testing.T) {
+	datastore, err := openDatabaseForTest("InsertVulnerabilityLinks", false)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer datastore.Close()
+	ctx := context.Background()
+
+	// Two sources insert the same vulnerability with different links.
+	debian := database.Vulnerability{
+		Name:      "CVE-2014-9471",
+		Namespace: database.Namespace{Name: "debian:8"},
+		Severity:  types.Low,
+		Link:      "https://security-tracker.debian.org/tracker/CVE-2014-9471",
+	}
+	nvd := database.Vulnerability{
+		Name:      "CVE-2014-9471",
+		Namespace: database.Namespace{Name: "debian:8"},
+		Severity:  types.Low,
+		Links: []string{
+			"https://nvd.nist.gov/vuln/detail/CVE-2014-9471",
+			"https://security-tracker.debian.org/tracker/CVE-2014-9471",
+		},
+	}
+	assert.Nil(t, datastore.InsertVulnerabilities(ctx, []database.Vulnerability{debian}, false))
+	assert.Nil(t, datastore.InsertVulnerabilities(ctx, []database.Vulnerability{nvd}, false))
+
+	// The result is the union of the links, the primary link being kept.
+	v, err := datastore.FindVulnerability(ctx, "debian:8", "CVE-2014-9471")
+	if assert.Nil(t, err) {
+		assert.Equal(t, debian.Link, v.Link)
+		assert.Equal(t, []string{debian.Link, nvd.Links[0]}, v.Links)
+	}
+}
+
+func TestMergeLinks(t *testing.T) {
+	assert.Nil(t, mergeLinks(""))
+	assert.Equal(t, []string{"a"}, mergeLinks("a"))
+	assert.Equal(t, []string{"a", "b", "c"}, mergeLinks("a", []string{"b", "a", ""}, []string{"c", "b"}))
+	assert.Equal(t, []string{"b", "c"}, mergeLinks("", []string{"b"}, nil, []string{"c"}))
+}
+
+func TestGetAffectedLayers(t *testing.T) {
+	datastore, err := openDatabaseForTest("GetAffectedLayers", true)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer datastore.Close()
+	ctx := context.Background()
+
+	// layer-1 introduces the affected OpenSSL 1.0 but its only child, layer-2, upgrades it past
+	// the fix.
+	layers, total, err := datastore.GetAffectedLayers(ctx, "debian:7", "CVE-OPENSSL-1-DEB7", 10, 0)
+	if assert.Nil(t, err) {
+		assert.Len(t, layers, 0)
+		assert.Equal(t, 0, total)
+	}
+
+	// A second child that keeps OpenSSL 1.0 makes layer-1 affected again, and an unrelated layer
+	// introduces it as well.
+	layer1, err := datastore.FindLayer(ctx, "layer-1", true, false, types.Unknown)
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Nil(t, datastore.InsertLayer(ctx, database.Layer{
+		Name:          "layer-2b",
+		EngineVersion: 1,
+		Parent:        &layer1,
+		Features:      layer1.Features,
+	}))
+	assert.Nil(t, datastore.InsertLayer(ctx, database.Layer{
+		Name:          "layer-x",
+		EngineVersion: 1,
+		Features:      layer1.Features,
+	}))
+
+	layers, total, err = datastore.GetAffectedLayers(ctx, "debian:7", "CVE-OPENSSL-1-DEB7", 1, 0)
+	if assert.Nil(t, err) && assert.Len(t, layers, 1) {
+		assert.Equal(t, 2, total)
+		assert.Equal(t, "layer-1", layers[0].Name)
+
+		layers, total, err = datastore.GetAffectedLayers(ctx, "debian:7", "CVE-OPENSSL-1-DEB7", 1, layers[0].ID)
+		if assert.Nil(t, err) && assert.Len(t, layers, 1) {
+			assert.Equal(t, 2, total)
+			assert.Equal(t, "layer-x", layers[0].Name)
+
+			layers, _, err = datastore.GetAffectedLayers(ctx, "debian:7", "CVE-OPENSSL-1-DEB7", 1, layers[0].ID)
+			assert.Nil(t, err)
+			assert.Len(t, layers, 0)
+		}
+	}
+
+	// Unknown vulnerability.
+	_, _, err = datastore.GetAffectedLayers(ctx, "debian:7", "CVE-UNKNOWN", 10, 0)
+	assert.Equal(t, cerrors.ErrNotFound, err)
+}
@@ -0,0 +1,159 @@
+// Copyright 2015 clair authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/guregu/null/zero"
+
+	"github.com/coreos/clair/database"
+	cerrors "github.com/coreos/clair/utils/errors"
+	"github.com/coreos/clair/utils/types"
+)
+
+// insertFeature finds or creates a feature, and its namespace, in the given transaction.
+func (sqlite *sqlite) insertFeature(ctx context.Context, tx *sql.Tx, feature database.Feature) (int, error) {
+	if feature.Name == "" {
+		return 0, cerrors.NewBadRequestError("could not find/insert invalid Feature")
+	}
+
+	defer observeQueryTime("insertFeature", "all", time.Now())
+
+	// Find or create Namespace.
+	namespaceID, err := sqlite.insertNamespace(ctx, tx, feature.Namespace)
+	if err != nil {
+		return 0, err
+	}
+
+	// Find or create Feature.
+	if _, err = namedExec(ctx, tx, "insertFeature", insertFeature, feature.Name, namespaceID); err != nil {
+		return 0, handleError(ctx, "insertFeature", err)
+	}
+
+	var id int
+	err = namedQueryRow(ctx, tx, "searchFeature", searchFeature, feature.Name, namespaceID).Scan(&id)
+	if err != nil {
+		return 0, handleError(ctx, "searchFeature", err)
+	}
+
+	return id, nil
+}
+
+// insertFeatureVersion finds or creates a feature version in the given transaction. New feature
+// versions are linked to the vulnerabilities that affect them.
+func (sqlite *sqlite) insertFeatureVersion(ctx context.Context, tx *sql.Tx, featureVersion database.FeatureVersion) (int, error) {
+	if featureVersion.Version.String() == "" {
+		return 0, cerrors.NewBadRequestError("could not find/insert invalid FeatureVersion")
+	}
+
+	defer observeQueryTime("insertFeatureVersion", "all", time.Now())
+
+	// Find or create Feature first.
+	featureID, err := sqlite.insertFeature(ctx, tx, featureVersion.Feature)
+	if err != nil {
+		return 0, err
+	}
+
+	featureVersion.Feature.ID = featureID
+
+	// Find or create FeatureVersion.
+	result, err := namedExec(ctx, tx, "insertFeatureVersion", insertFeatureVersion, featureID, &featureVersion.Version)
+	if err != nil {
+		return 0, handleError(ctx, "insertFeatureVersion", err)
+	}
+
+	err = namedQueryRow(ctx, tx, "searchFeatureVersion", searchFeatureVersion, featureID, &featureVersion.Version).
+		Scan(&featureVersion.ID)
+	if err != nil {
+		return 0, handleError(ctx, "searchFeatureVersion", err)
+	}
+
+	if n, _ := result.RowsAffected(); n == 0 {
+		// That featureVersion already exists, return its id.
+		return featureVersion.ID, nil
+	}
+
+	// Link the new FeatureVersion with every vulnerabilities that affect it, by inserting in
+	// Vulnerability_Affects_FeatureVersion.
+	if err = linkFeatureVersionToVulnerabilities(ctx, tx, featureVersion); err != nil {
+		return 0, err
+	}
+
+	return featureVersion.ID, nil
+}
+
+func (sqlite *sqlite) insertFeatureVersions(ctx context.Context, tx *sql.Tx, featureVersions []database.FeatureVersion) ([]int, error) {
+	IDs := make([]int, 0, len(featureVersions))
+
+	for i := 0; i < len(featureVersions); i++ {
+		id, err := sqlite.insertFeatureVersion(ctx, tx, featureVersions[i])
+		if err != nil {
+			return IDs, err
+		}
+		IDs = append(IDs, id)
+	}
+
+	return IDs, nil
+}
+
+type vulnerabilityAffectsFeatureVersion struct {
+	vulnerabilityID int
+	fixedInID       int
+	fixedInVersion  types.Version
+	versionFormat   zero.String
+}
+
+func linkFeatureVersionToVulnerabilities(ctx context.Context, tx *sql.Tx, featureVersion database.FeatureVersion) error {
+	// Select every vulnerability and the fixed version that affect this Feature.
+	rows, err := namedQuery(ctx, tx, "searchVulnerabilityFixedInFeature", searchVulnerabilityFixedInFeature, featureVersion.Feature.ID)
+	if err != nil {
+		return handleError(ctx, "searchVulnerabilityFixedInFeature", err)
+	}
+	defer rows.Close()
+
+	var affects []vulnerabilityAffectsFeatureVersion
+	for rows.Next() {
+		var affect vulnerabilityAffectsFeatureVersion
+
+		err := rows.Scan(&affect.fixedInID, &affect.vulnerabilityID, &affect.fixedInVersion, &affect.versionFormat)
+		if err != nil {
+			return handleError(ctx, "searchVulnerabilityFixedInFeature.Scan()", err)
+		}
+
+		if featureVersion.Version.CompareFormat(affect.fixedInVersion, types.VersionFormat(affect.versionFormat.String)) < 0 {
+			// The version of the FeatureVersion we are inserting is lower than the fixed version on this
+			// Vulnerability, thus, this FeatureVersion is affected by it.
+			affects = append(affects, affect)
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return handleError(ctx, "searchVulnerabilityFixedInFeature.Rows()", err)
+	}
+	rows.Close()
+
+	// Insert into Vulnerability_Affects_FeatureVersion.
+	for _, affect := range affects {
+		_, err := namedExec(ctx, tx, "insertVulnerabilityAffectsFeatureVersion", insertVulnerabilityAffectsFeatureVersion, affect.vulnerabilityID,
+			featureVersion.ID, affect.fixedInID)
+		if err != nil {
+			return handleError(ctx, "insertVulnerabilityAffectsFeatureVersion", err)
+		}
+	}
+
+	return nil
+}
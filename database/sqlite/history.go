@@ -0,0 +1,130 @@
+// Copyright 2015 clair authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"sort"
+	"time"
+
+	"github.com/coreos/clair/database"
+)
+
+// maxVulnerabilityHistoryEntries is the number of changes that are kept for each vulnerability,
+// the oldest ones being pruned.
+const maxVulnerabilityHistoryEntries = 50
+
+func (sqlite *sqlite) GetVulnerabilityHistory(ctx context.Context, namespaceName, name string) ([]database.VulnerabilityHistoryEntry, error) {
+	defer observeQueryTime("GetVulnerabilityHistory", "all", time.Now())
+
+	rows, err := namedQuery(ctx, sqlite, "searchVulnerabilityHistory", searchVulnerabilityHistory, namespaceName, name)
+	if err != nil {
+		return nil, handleError(ctx, "searchVulnerabilityHistory", err)
+	}
+	defer rows.Close()
+
+	var entries []database.VulnerabilityHistoryEntry
+	for rows.Next() {
+		var entry database.VulnerabilityHistoryEntry
+
+		err = rows.Scan(&entry.Created, &entry.Source, &entry.OldSeverity, &entry.NewSeverity,
+			&entry.FeatureName, &entry.OldFixedBy, &entry.NewFixedBy)
+		if err != nil {
+			return nil, handleError(ctx, "searchVulnerabilityHistory.Scan()", err)
+		}
+
+		entries = append(entries, entry)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, handleError(ctx, "searchVulnerabilityHistory.Rows()", err)
+	}
+
+	return entries, nil
+}
+
+// recordVulnerabilityHistory records the differences between the existing and the updated
+// vulnerability, and prunes the oldest entries of its history.
+func recordVulnerabilityHistory(ctx context.Context, tx *sql.Tx, namespaceID int, existingVulnerability, vulnerability database.Vulnerability) error {
+	entries := diffVulnerability(existingVulnerability, vulnerability)
+	if len(entries) == 0 {
+		return nil
+	}
+
+	source := database.SourceFromContext(ctx)
+	for _, entry := range entries {
+		_, err := namedExec(ctx, tx, "insertVulnerabilityHistory", insertVulnerabilityHistory,
+			namespaceID, vulnerability.Name, now(), source, &entry.OldSeverity, &entry.NewSeverity,
+			entry.FeatureName, entry.OldFixedBy, entry.NewFixedBy)
+		if err != nil {
+			return handleError(ctx, "insertVulnerabilityHistory", err)
+		}
+	}
+
+	_, err := namedExec(ctx, tx, "removeVulnerabilityHistoryOldest", removeVulnerabilityHistoryOldest,
+		namespaceID, vulnerability.Name, maxVulnerabilityHistoryEntries)
+	if err != nil {
+		return handleError(ctx, "removeVulnerabilityHistoryOldest", err)
+	}
+
+	return nil
+}
+
+// diffVulnerability returns the history entries that describe the changes of Severity and of
+// FixedIn versions between the existing and the updated vulnerability, ordered by Feature name.
+// If only the Severity changed, a single entry without FeatureName is returned.
+func diffVulnerability(existingVulnerability, vulnerability database.Vulnerability) []database.VulnerabilityHistoryEntry {
+	oldFixedBy := make(map[string]string, len(existingVulnerability.FixedIn))
+	for _, fv := range existingVulnerability.FixedIn {
+		oldFixedBy[fv.Feature.Name] = fv.Version.String()
+	}
+	newFixedBy := make(map[string]string, len(vulnerability.FixedIn))
+	for _, fv := range vulnerability.FixedIn {
+		newFixedBy[fv.Feature.Name] = fv.Version.String()
+	}
+
+	var featureNames []string
+	for name, version := range oldFixedBy {
+		if newFixedBy[name] != version {
+			featureNames = append(featureNames, name)
+		}
+	}
+	for name := range newFixedBy {
+		if _, ok := oldFixedBy[name]; !ok {
+			featureNames = append(featureNames, name)
+		}
+	}
+	sort.Strings(featureNames)
+
+	var entries []database.VulnerabilityHistoryEntry
+	for _, name := range featureNames {
+		entries = append(entries, database.VulnerabilityHistoryEntry{
+			OldSeverity: existingVulnerability.Severity,
+			NewSeverity: vulnerability.Severity,
+			FeatureName: name,
+			OldFixedBy:  oldFixedBy[name],
+			NewFixedBy:  newFixedBy[name],
+		})
+	}
+
+	if len(entries) == 0 && existingVulnerability.Severity != vulnerability.Severity {
+		entries = append(entries, database.VulnerabilityHistoryEntry{
+			OldSeverity: existingVulnerability.Severity,
+			NewSeverity: vulnerability.Severity,
+		})
+	}
+
+	return entries
+}
@@ -0,0 +1,91 @@
+// Copyright 2015 clair authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	cerrors "github.com/coreos/clair/utils/errors"
+)
+
+// InsertKeyValue stores (or updates) a single key / value tuple.
+func (sqlite *sqlite) InsertKeyValue(ctx context.Context, key, value string) error {
+	if key == "" {
+		log.Warning("could not insert a flag which has an empty name")
+		return cerrors.NewBadRequestError("could not insert a flag which has an empty name")
+	}
+
+	defer observeQueryTime("InsertKeyValue", "all", time.Now())
+
+	err := sqlite.withTransaction(ctx, func(tx *sql.Tx) error {
+		_, err := namedExec(ctx, tx, "upsertKeyValue", upsertKeyValue, key, value)
+		return err
+	})
+
+	return handleError(ctx, "InsertKeyValue", err)
+}
+
+// GetKeyValue reads a single key / value tuple and returns cerrors.ErrNotFound if the key doesn't
+// exist.
+func (sqlite *sqlite) GetKeyValue(ctx context.Context, key string) (string, error) {
+	defer observeQueryTime("GetKeyValue", "all", time.Now())
+
+	var value string
+	err := namedQueryRow(ctx, sqlite, "searchKeyValue", searchKeyValue, key).Scan(&value)
+
+	if err != nil {
+		return "", handleError(ctx, "searchKeyValue", err)
+	}
+
+	return value, nil
+}
+
+// CompareAndSwapKeyValue sets the value of the given key to new only if its current value is old.
+func (sqlite *sqlite) CompareAndSwapKeyValue(ctx context.Context, key, old, new string) (bool, error) {
+	if key == "" {
+		log.Warning("could not swap a flag which has an empty name")
+		return false, cerrors.NewBadRequestError("could not swap a flag which has an empty name")
+	}
+
+	defer observeQueryTime("CompareAndSwapKeyValue", "all", time.Now())
+
+	var swapped bool
+	err := sqlite.withTransaction(ctx, func(tx *sql.Tx) error {
+		r, err := namedExec(ctx, tx, "swapKeyValue", swapKeyValue, key, old, new)
+		if err != nil {
+			return err
+		}
+		if n, _ := r.RowsAffected(); n > 0 || old != "" {
+			swapped = n > 0
+			return nil
+		}
+
+		// The key may not exist yet, which the empty old value matches as well.
+		r, err = namedExec(ctx, tx, "insertKeyValue", insertKeyValue, key, new)
+		if err != nil {
+			return err
+		}
+		n, _ := r.RowsAffected()
+		swapped = n > 0
+		return nil
+	})
+	if err != nil {
+		return false, handleError(ctx, "CompareAndSwapKeyValue", err)
+	}
+
+	return swapped, nil
+}
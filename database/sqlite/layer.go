@@ -0,0 +1,813 @@
+// Copyright 2015 clair authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/coreos/clair/database"
+	"github.com/coreos/clair/utils"
+	cerrors "github.com/coreos/clair/utils/errors"
+	"github.com/coreos/clair/utils/types"
+	"github.com/guregu/null/zero"
+)
+
+func (sqlite *sqlite) FindLayer(ctx context.Context, name string, withFeatures, withVulnerabilities bool, minSeverity types.Priority) (database.Layer, error) {
+	return findLayer(ctx, sqlite, name, withFeatures, withVulnerabilities, minSeverity, sqlite.config.MaxLayerTreeDepth)
+}
+
+func findLayer(ctx context.Context, queryer Queryer, name string, withFeatures, withVulnerabilities bool, minSeverity types.Priority, maxDepth int) (database.Layer, error) {
+	subquery := "all"
+	if withFeatures {
+		subquery += "/features"
+	} else if withVulnerabilities {
+		subquery += "/features+vulnerabilities"
+	}
+	defer observeQueryTime("FindLayer", subquery, time.Now())
+
+	// Find the layer
+	var layer database.Layer
+	var parentID zero.Int
+	var parentName zero.String
+	var namespaceID zero.Int
+	var namespaceName sql.NullString
+	var namespaceVersionFormat zero.String
+	var path, format zero.String
+
+	err := namedQueryRow(ctx, queryer, "searchLayer", searchLayer, name).
+		Scan(&layer.ID, &layer.Name, &layer.EngineVersion, &parentID, &parentName, &namespaceID, &namespaceName, &namespaceVersionFormat, &path, &format, &layer.Stale)
+	if err != nil {
+		return layer, handleError(ctx, "searchLayer", err)
+	}
+	layer.Path, layer.Format = path.String, format.String
+
+	if !parentID.IsZero() {
+		layer.Parent = &database.Layer{
+			Model: database.Model{ID: int(parentID.Int64)},
+			Name:  parentName.String,
+		}
+	}
+	if !namespaceID.IsZero() {
+		layer.Namespace = &database.Namespace{
+			Model:         database.Model{ID: int(namespaceID.Int64)},
+			Name:          namespaceName.String,
+			VersionFormat: types.VersionFormat(namespaceVersionFormat.String),
+		}
+	}
+
+	// Find the detectors that processed it.
+	layer.ProcessedBy, err = findLayerDetectors(ctx, queryer, layer.ID)
+	if err != nil {
+		return layer, err
+	}
+
+	// Find its namespaces.
+	layer.Namespaces, err = findLayerNamespaces(ctx, queryer, layer.ID)
+	if err != nil {
+		return layer, err
+	}
+	layer.Namespaces = layer.ListNamespaces()
+
+	// Find its features
+	if withFeatures || withVulnerabilities {
+		layer.Depth, err = findLayerDepth(ctx, queryer, layer.ID, layer.Name, maxDepth)
+		if err != nil {
+			return layer, err
+		}
+
+		featureVersions, err := getLayerFeatureVersions(ctx, queryer, layer.ID, maxDepth)
+		if err != nil {
+			return layer, err
+		}
+
+		layer.Features = featureVersions
+
+		if withVulnerabilities {
+			// Load the vulnerabilities that affect the FeatureVersions.
+			if err := loadAffectedBy(ctx, queryer, layer.Features, minSeverity); err != nil {
+				return layer, err
+			}
+		}
+	}
+
+	return layer, nil
+}
+
+// findLayerDetectors returns the names of the detectors that processed the specified layer.
+func findLayerDetectors(ctx context.Context, queryer Queryer, layerID int) ([]string, error) {
+	rows, err := namedQuery(ctx, queryer, "searchLayerDetector", searchLayerDetector, layerID)
+	if err != nil {
+		return nil, handleError(ctx, "searchLayerDetector", err)
+	}
+	defer rows.Close()
+
+	var detectors []string
+	for rows.Next() {
+		var detector string
+		if err = rows.Scan(&detector); err != nil {
+			return nil, handleError(ctx, "searchLayerDetector.Scan()", err)
+		}
+		detectors = append(detectors, detector)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, handleError(ctx, "searchLayerDetector.Rows()", err)
+	}
+
+	return detectors, nil
+}
+
+// findLayerNamespaces returns the namespaces of the specified layer, in the order they were
+// inserted.
+func findLayerNamespaces(ctx context.Context, queryer Queryer, layerID int) ([]database.Namespace, error) {
+	rows, err := namedQuery(ctx, queryer, "searchLayerNamespace", searchLayerNamespace, layerID)
+	if err != nil {
+		return nil, handleError(ctx, "searchLayerNamespace", err)
+	}
+	defer rows.Close()
+
+	var namespaces []database.Namespace
+	for rows.Next() {
+		var namespace database.Namespace
+		var versionFormat zero.String
+		if err = rows.Scan(&namespace.ID, &namespace.Name, &versionFormat); err != nil {
+			return nil, handleError(ctx, "searchLayerNamespace.Scan()", err)
+		}
+		namespace.VersionFormat = types.VersionFormat(versionFormat.String)
+		namespaces = append(namespaces, namespace)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, handleError(ctx, "searchLayerNamespace.Rows()", err)
+	}
+
+	return namespaces, nil
+}
+
+// getLayerFeatureVersions returns list of database.FeatureVersion that a database.Layer has.
+func getLayerFeatureVersions(ctx context.Context, queryer Queryer, layerID, maxDepth int) ([]database.FeatureVersion, error) {
+	// Do transitive closure. The rows are ordered from the base layer, so a FeatureVersion
+	// that is removed and added again is attributed to the layer that added it last.
+	mapFeatureVersions := make(map[int]database.FeatureVersion)
+	err := scanLayerFeatureVersions(ctx, queryer, layerID, maxDepth, func(modification string, featureVersion database.FeatureVersion) {
+		if modification == "add" {
+			mapFeatureVersions[featureVersion.ID] = featureVersion
+		} else {
+			delete(mapFeatureVersions, featureVersion.ID)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Build result by converting our map to a slice.
+	var featureVersions []database.FeatureVersion
+	for _, featureVersion := range mapFeatureVersions {
+		featureVersions = append(featureVersions, featureVersion)
+	}
+
+	return featureVersions, nil
+}
+
+// GetLayerDiff returns the FeatureVersions that the specified layer adds and removes, as stored,
+// without computing the transitive closure over its parents.
+func (sqlite *sqlite) GetLayerDiff(ctx context.Context, name string) (added, removed []database.FeatureVersion, err error) {
+	defer observeQueryTime("GetLayerDiff", "all", time.Now())
+
+	layer, err := findLayer(ctx, sqlite, name, false, false, types.Unknown, sqlite.config.MaxLayerTreeDepth)
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, err = findLayerDepth(ctx, sqlite, layer.ID, layer.Name, sqlite.config.MaxLayerTreeDepth); err != nil {
+		return nil, nil, err
+	}
+
+	err = scanLayerFeatureVersions(ctx, sqlite, layer.ID, sqlite.config.MaxLayerTreeDepth, func(modification string, featureVersion database.FeatureVersion) {
+		// The rows of the parents are only needed by the transitive closure.
+		if featureVersion.AddedBy.ID != layer.ID {
+			return
+		}
+
+		if modification == "add" {
+			added = append(added, featureVersion)
+		} else {
+			featureVersion.AddedBy = database.Layer{}
+			removed = append(removed, featureVersion)
+		}
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return added, removed, nil
+}
+
+// findLayerDepth returns the number of layers in the ancestry of the specified layer, the layer
+// itself included. It returns ErrLayerTreeTooDeep beyond maxDepth layers, and ErrInconsistent if
+// the ancestry contains a cycle.
+func findLayerDepth(ctx context.Context, queryer Queryer, layerID int, name string, maxDepth int) (int, error) {
+	var depth int
+	var cycle bool
+	err := namedQueryRow(ctx, queryer, "searchLayerAncestry", searchLayerAncestry, layerID, maxDepth).Scan(&depth, &cycle)
+	if err != nil {
+		return 0, handleError(ctx, "searchLayerAncestry", err)
+	}
+
+	if cycle {
+		log.Warningf("the ancestry of layer %s contains a cycle", name)
+		return 0, database.ErrInconsistent
+	}
+	if depth > maxDepth {
+		return 0, &database.ErrLayerTreeTooDeep{Layer: name, MaxDepth: maxDepth}
+	}
+
+	return depth, nil
+}
+
+// scanLayerFeatureVersions calls fn with every "add" or "del" row of the specified layer and its
+// parents, ordered from the base layer, up to maxDepth layers. The AddedBy field of the given
+// FeatureVersions is the layer that the row belongs to.
+func scanLayerFeatureVersions(ctx context.Context, queryer Queryer, layerID, maxDepth int, fn func(modification string, featureVersion database.FeatureVersion)) error {
+	rows, err := namedQuery(ctx, queryer, "searchLayerFeatureVersion", searchLayerFeatureVersion, layerID, maxDepth)
+	if err != nil {
+		return handleError(ctx, "searchLayerFeatureVersion", err)
+	}
+	defer rows.Close()
+
+	var modification string
+	for rows.Next() {
+		var featureVersion database.FeatureVersion
+
+		err = rows.Scan(&featureVersion.ID, &modification, &featureVersion.Feature.Namespace.ID,
+			&featureVersion.Feature.Namespace.Name, &featureVersion.Feature.ID,
+			&featureVersion.Feature.Name, &featureVersion.ID, &featureVersion.Version,
+			&featureVersion.AddedBy.ID, &featureVersion.AddedBy.Name)
+		if err != nil {
+			return handleError(ctx, "searchLayerFeatureVersion.Scan()", err)
+		}
+
+		if modification != "add" && modification != "del" {
+			log.Warningf("unknown Layer_diff_FeatureVersion's modification: %s", modification)
+			return database.ErrInconsistent
+		}
+
+		fn(modification, featureVersion)
+	}
+	if err = rows.Err(); err != nil {
+		return handleError(ctx, "searchLayerFeatureVersion.Rows()", err)
+	}
+
+	return nil
+}
+
+// loadAffectedBy fills the AffectedBy field of the given FeatureVersions with the list of
+// database.Vulnerability that affect them and whose Severity is at least minSeverity.
+func loadAffectedBy(ctx context.Context, queryer Queryer, featureVersions []database.FeatureVersion, minSeverity types.Priority) error {
+	// Without arrays, the FeatureVersions are queried one by one, which is cheap with SQLite.
+	for i := range featureVersions {
+		vulnerabilities, err := findFeatureVersionVulnerabilities(ctx, queryer, featureVersions[i].ID, minSeverity)
+		if err != nil {
+			return err
+		}
+		featureVersions[i].AffectedBy = vulnerabilities
+	}
+
+	return nil
+}
+
+func findFeatureVersionVulnerabilities(ctx context.Context, queryer Queryer, featureVersionID int, minSeverity types.Priority) ([]database.Vulnerability, error) {
+	rows, err := namedQuery(ctx, queryer, "searchFeatureVersionVulnerability", searchFeatureVersionVulnerability, featureVersionID, minSeverity)
+	if err != nil {
+		return nil, handleError(ctx, "searchFeatureVersionVulnerability", err)
+	}
+	defer rows.Close()
+
+	var vulnerabilities []database.Vulnerability
+	for rows.Next() {
+		var vulnerability database.Vulnerability
+		err := rows.Scan(&vulnerability.ID, &vulnerability.Name, &vulnerability.Description,
+			&vulnerability.Link, (*linkList)(&vulnerability.Links), &vulnerability.Severity,
+			&vulnerability.Metadata, &vulnerability.Namespace.Name, &vulnerability.FixedBy)
+		if err != nil {
+			return nil, handleError(ctx, "searchFeatureVersionVulnerability.Scan()", err)
+		}
+		vulnerabilities = append(vulnerabilities, vulnerability)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, handleError(ctx, "searchFeatureVersionVulnerability.Rows()", err)
+	}
+
+	return vulnerabilities, nil
+}
+
+// Internally, only Feature additions/removals are stored for each layer. If a layer has a parent,
+// the Feature list will be compared to the parent's Feature list and the difference will be stored.
+// Note that when the Namespace of a layer differs from its parent, it is expected that several
+// Feature that were already included a parent will have their Namespace updated as well
+// (happens when Feature detectors relies on the detected layer Namespace). However, if the listed
+// Feature has the same Name/Version as its parent, InsertLayer considers that the Feature hasn't
+// been modified.
+func (sqlite *sqlite) InsertLayer(ctx context.Context, layer database.Layer) error {
+	defer observeQueryTime("InsertLayer", "all", time.Now())
+
+	err := sqlite.withTransaction(ctx, func(tx *sql.Tx) error {
+		return sqlite.insertLayer(ctx, tx, &layer)
+	})
+
+	return handleError(ctx, "InsertLayer", err)
+}
+
+// InsertLayers inserts the layers of an image at once, in a single transaction. The layers have
+// to be ordered from the base layer to the top one, and each layer but the first must have the
+// previous one as Parent, the Features of which are used for diffing. Only the first layer's
+// Parent must have been retrieved from the database, if it has one.
+func (sqlite *sqlite) InsertLayers(ctx context.Context, layers []database.Layer) error {
+	// Verify that the layers form a chain.
+	names := make(map[string]struct{}, len(layers))
+	for i, layer := range layers {
+		if _, dup := names[layer.Name]; dup {
+			return cerrors.NewBadRequestError("could not insert layers: " + layer.Name + " is present twice")
+		}
+		names[layer.Name] = struct{}{}
+
+		if i > 0 && (layer.Parent == nil || layer.Parent.Name != layers[i-1].Name) {
+			return cerrors.NewBadRequestError("could not insert layers: the parent of " + layer.Name + " is not " + layers[i-1].Name)
+		}
+	}
+
+	defer observeQueryTime("InsertLayers", "all", time.Now())
+
+	err := sqlite.withTransaction(ctx, func(tx *sql.Tx) error {
+		inserted := make([]database.Layer, len(layers))
+		for i := range layers {
+			inserted[i] = layers[i]
+			if i > 0 {
+				inserted[i].Parent = &inserted[i-1]
+			}
+
+			if err := sqlite.insertLayer(ctx, tx, &inserted[i]); err != nil {
+				log.Warningf("could not insert layer %s: %s", inserted[i].Name, err)
+				return err
+			}
+		}
+		return nil
+	})
+
+	return handleError(ctx, "InsertLayers", err)
+}
+
+// insertLayer inserts or updates a layer in the given transaction, unless the existing layer has a
+// higher engine version, or an equal one and has already been processed by the same detectors. The
+// ID of the given layer is set.
+func (sqlite *sqlite) insertLayer(ctx context.Context, tx *sql.Tx, layer *database.Layer) error {
+	// Get a potentially existing layer. The name of a new one is verified, the existing ones
+	// remain writable whatever their name.
+	existingLayer, err := findLayer(ctx, tx, layer.Name, true, false, types.Unknown, sqlite.config.MaxLayerTreeDepth)
+	if err == cerrors.ErrNotFound {
+		if err := database.ValidateLayerName(layer.Name); err != nil {
+			log.Warningf("could not insert layer %q: %s", layer.Name, err)
+			return cerrors.NewBadRequestError("could not insert layer: " + err.Error())
+		}
+	} else if err != nil {
+		return err
+	} else {
+		layer.ID = existingLayer.ID
+
+		if existingLayer.EngineVersion > layer.EngineVersion ||
+			existingLayer.EngineVersion == layer.EngineVersion && existingLayer.IsProcessedBy(layer.ProcessedBy) {
+			// The layer exists and is up to date, do nothing.
+			layer.Depth = existingLayer.Depth
+			return nil
+		}
+	}
+
+	// Get parent ID.
+	var parentID zero.Int
+	layer.Depth = 1
+	if layer.Parent != nil {
+		if layer.Parent.ID == 0 {
+			log.Warning("Parent is expected to be retrieved from database when inserting a layer.")
+			return cerrors.NewBadRequestError("Parent is expected to be retrieved from database when inserting a layer.")
+		}
+
+		parentID = zero.IntFrom(int64(layer.Parent.ID))
+
+		// The depth of the parent is only known if its features were retrieved.
+		parentDepth := layer.Parent.Depth
+		if parentDepth == 0 {
+			if parentDepth, err = findLayerDepth(ctx, tx, layer.Parent.ID, layer.Parent.Name, sqlite.config.MaxLayerTreeDepth); err != nil {
+				return err
+			}
+		}
+		if parentDepth >= sqlite.config.MaxLayerTreeDepth {
+			log.Warningf("could not insert layer %s: its ancestry is too deep", layer.Name)
+			return &database.ErrLayerTreeTooDeep{Layer: layer.Name, MaxDepth: sqlite.config.MaxLayerTreeDepth}
+		}
+		layer.Depth = parentDepth + 1
+
+		// A layer which is re-indexed may be given a new parent, which must not be based on it.
+		if layer.ID != 0 && (existingLayer.Parent == nil || existingLayer.Parent.ID != layer.Parent.ID) {
+			if err := verifyNotDescendant(ctx, tx, layer, layer.Parent.Name, sqlite.config.MaxLayerTreeDepth); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Find or insert the namespaces if provided.
+	namespaces := layer.ListNamespaces()
+	hasPrimary := layer.Namespace != nil
+	if len(namespaces) > 0 {
+		for i := range namespaces {
+			if namespaces[i].ID, err = sqlite.insertNamespace(ctx, tx, namespaces[i]); err != nil {
+				return err
+			}
+		}
+	} else if layer.Parent != nil {
+		// Import the Namespaces from the parent if this layer doesn't specify any.
+		// The parent may not have been retrieved from the database when inserting several layers.
+		namespaces = layer.Parent.ListNamespaces()
+		hasPrimary = layer.Parent.Namespace != nil
+		for i := range namespaces {
+			if namespaces[i].ID == 0 {
+				if namespaces[i].ID, err = sqlite.insertNamespace(ctx, tx, namespaces[i]); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	// Keep track of them, so the layers based on this one inherit them as well.
+	layer.Namespaces = namespaces
+	var namespaceID zero.Int
+	if hasPrimary {
+		layer.Namespace = &layer.Namespaces[0]
+		namespaceID = zero.IntFrom(int64(layer.Namespace.ID))
+	}
+
+	if layer.ID == 0 {
+		// Insert a new layer.
+		layer.ID, err = namedInsert(ctx, tx, "insertLayer", insertLayer, layer.Name, layer.EngineVersion, parentID, namespaceID, now(), zero.StringFrom(layer.Path), zero.StringFrom(layer.Format))
+		if err != nil {
+			return handleError(ctx, "insertLayer", err)
+		}
+	} else {
+		// Update an existing layer, which may be given a new parent and namespace, and is no
+		// longer stale.
+		_, err := namedExec(ctx, tx, "updateLayer", updateLayer, layer.ID, layer.EngineVersion, namespaceID, parentID, zero.StringFrom(layer.Path), zero.StringFrom(layer.Format))
+		if err != nil {
+			return handleError(ctx, "updateLayer", err)
+		}
+
+		// Remove all existing Layer_diff_FeatureVersion, they are computed again from scratch.
+		_, err = namedExec(ctx, tx, "removeLayerDiffFeatureVersion", removeLayerDiffFeatureVersion, layer.ID)
+		if err != nil {
+			return handleError(ctx, "removeLayerDiffFeatureVersion", err)
+		}
+
+		// The detectors that processed the layer and its namespaces are replaced as well.
+		_, err = namedExec(ctx, tx, "removeLayerDetector", removeLayerDetector, layer.ID)
+		if err != nil {
+			return handleError(ctx, "removeLayerDetector", err)
+		}
+		_, err = namedExec(ctx, tx, "removeLayerNamespace", removeLayerNamespace, layer.ID)
+		if err != nil {
+			return handleError(ctx, "removeLayerNamespace", err)
+		}
+	}
+
+	// Record the namespaces of the layer, in order.
+	for _, namespace := range layer.Namespaces {
+		_, err := namedExec(ctx, tx, "insertLayerNamespace", insertLayerNamespace, layer.ID, namespace.ID)
+		if err != nil {
+			return handleError(ctx, "insertLayerNamespace", err)
+		}
+	}
+
+	// Record the detectors that processed the layer.
+	for _, detector := range layer.ProcessedBy {
+		_, err := namedExec(ctx, tx, "insertLayerDetector", insertLayerDetector, layer.ID, detector)
+		if err != nil {
+			return handleError(ctx, "insertLayerDetector", err)
+		}
+	}
+
+	// Update Layer_diff_FeatureVersion now.
+	return sqlite.updateDiffFeatureVersions(ctx, tx, layer)
+}
+
+// verifyNotDescendant returns an error if the specified layer is the given layer or one of its
+// descendants.
+func verifyNotDescendant(ctx context.Context, queryer Queryer, layer *database.Layer, name string, maxDepth int) error {
+	if name == layer.Name {
+		return cerrors.NewBadRequestError("could not insert a layer which is its own parent")
+	}
+
+	descendants, err := findLayerDescendants(ctx, queryer, layer.Name, maxDepth)
+	if err != nil {
+		return err
+	}
+	for _, descendant := range descendants {
+		if descendant == name {
+			return cerrors.NewBadRequestError("could not insert a layer whose parent is based on it")
+		}
+	}
+
+	return nil
+}
+
+// updateDiffFeatureVersions inserts the FeatureVersions that the layer adds or removes compared
+// to its parent.
+func (sqlite *sqlite) updateDiffFeatureVersions(ctx context.Context, tx *sql.Tx, layer *database.Layer) error {
+	// add and del are the FeatureVersion diff we should insert.
+	var add []database.FeatureVersion
+	var del []database.FeatureVersion
+
+	if layer.Parent == nil {
+		// There is no parent, every Features are added.
+		add = append(add, layer.Features...)
+	} else {
+		// There is a parent, we need to diff the Features with it.
+
+		// Build name:version structures.
+		layerFeaturesMapNV, layerFeaturesNV := createNV(layer.Features)
+		parentLayerFeaturesMapNV, parentLayerFeaturesNV := createNV(layer.Parent.Features)
+
+		// Calculate the added and deleted FeatureVersions name:version.
+		addNV := utils.CompareStringLists(layerFeaturesNV, parentLayerFeaturesNV)
+		delNV := utils.CompareStringLists(parentLayerFeaturesNV, layerFeaturesNV)
+
+		// Fill the structures containing the added and deleted FeatureVersions.
+		for _, nv := range addNV {
+			add = append(add, *layerFeaturesMapNV[nv])
+		}
+		for _, nv := range delNV {
+			del = append(del, *parentLayerFeaturesMapNV[nv])
+		}
+	}
+
+	// Insert FeatureVersions in the database.
+	addIDs, err := sqlite.insertFeatureVersions(ctx, tx, add)
+	if err != nil {
+		return err
+	}
+	delIDs, err := sqlite.insertFeatureVersions(ctx, tx, del)
+	if err != nil {
+		return err
+	}
+
+	// Insert diff in the database.
+	for _, id := range addIDs {
+		if _, err = namedExec(ctx, tx, "insertLayerDiffFeatureVersion", insertLayerDiffFeatureVersion, layer.ID, id, "add"); err != nil {
+			return handleError(ctx, "insertLayerDiffFeatureVersion", err)
+		}
+	}
+	for _, id := range delIDs {
+		if _, err = namedExec(ctx, tx, "insertLayerDiffFeatureVersion", insertLayerDiffFeatureVersion, layer.ID, id, "del"); err != nil {
+			return handleError(ctx, "insertLayerDiffFeatureVersion", err)
+		}
+	}
+
+	return nil
+}
+
+func createNV(features []database.FeatureVersion) (map[string]*database.FeatureVersion, []string) {
+	mapNV := make(map[string]*database.FeatureVersion, 0)
+	sliceNV := make([]string, 0, len(features))
+
+	for i := 0; i < len(features); i++ {
+		featureVersion := &features[i]
+		nv := featureVersion.Feature.Namespace.Name + ":" + featureVersion.Feature.Name + ":" + featureVersion.Version.String()
+		mapNV[nv] = featureVersion
+		sliceNV = append(sliceNV, nv)
+	}
+
+	return mapNV, sliceNV
+}
+
+// LayerExists returns whether the specified layer is stored, with a single query that doesn't load
+// it.
+func (sqlite *sqlite) LayerExists(ctx context.Context, name string) (bool, error) {
+	defer observeQueryTime("LayerExists", "all", time.Now())
+
+	var exists bool
+	err := namedQueryRow(ctx, sqlite, "searchLayerExists", searchLayerExists, name).Scan(&exists)
+	if err != nil {
+		return false, handleError(ctx, "searchLayerExists", err)
+	}
+	return exists, nil
+}
+
+// FindLayerChildren returns the layers whose parent is the specified layer.
+// It does not verify that the specified layer exists.
+func (sqlite *sqlite) FindLayerChildren(ctx context.Context, name string) ([]database.Layer, error) {
+	defer observeQueryTime("FindLayerChildren", "all", time.Now())
+
+	rows, err := namedQuery(ctx, sqlite, "searchLayerChildren", searchLayerChildren, name)
+	if err != nil {
+		return nil, handleError(ctx, "searchLayerChildren", err)
+	}
+	defer rows.Close()
+
+	var children []database.Layer
+	for rows.Next() {
+		var child database.Layer
+		if err = rows.Scan(&child.ID, &child.Name); err != nil {
+			return nil, handleError(ctx, "searchLayerChildren.Scan()", err)
+		}
+		children = append(children, child)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, handleError(ctx, "searchLayerChildren.Rows()", err)
+	}
+
+	return children, nil
+}
+
+// DeleteLayer deletes a layer, its descendants being deleted by the foreign keys' cascade.
+func (sqlite *sqlite) DeleteLayer(ctx context.Context, name string, recursive bool) error {
+	defer observeQueryTime("DeleteLayer", "all", time.Now())
+
+	err := sqlite.withTransaction(ctx, func(tx *sql.Tx) error {
+		if !recursive {
+			descendants, err := findLayerDescendants(ctx, tx, name, sqlite.config.MaxLayerTreeDepth)
+			if err != nil {
+				return err
+			}
+			if len(descendants) > 0 {
+				return database.ErrLayerHasChildren
+			}
+		}
+
+		result, err := namedExec(ctx, tx, "removeLayer", removeLayer, name)
+		if err != nil {
+			return handleError(ctx, "removeLayer", err)
+		}
+
+		affected, err := result.RowsAffected()
+		if err != nil {
+			return handleError(ctx, "removeLayer.RowsAffected()", err)
+		}
+
+		if affected <= 0 {
+			return cerrors.ErrNotFound
+		}
+
+		return nil
+	})
+
+	return handleError(ctx, "DeleteLayer", err)
+}
+
+// findLayerDescendants returns the names of every layer that is based on the specified layer.
+// Cycles are not supposed to exist but the walk is bounded by maxDepth anyway.
+func findLayerDescendants(ctx context.Context, queryer Queryer, name string, maxDepth int) ([]string, error) {
+	rows, err := namedQuery(ctx, queryer, "searchLayerDescendants", searchLayerDescendants, name, maxDepth)
+	if err != nil {
+		return nil, handleError(ctx, "searchLayerDescendants", err)
+	}
+	defer rows.Close()
+
+	var descendants []string
+	for rows.Next() {
+		var descendant string
+		if err = rows.Scan(&descendant); err != nil {
+			return nil, handleError(ctx, "searchLayerDescendants.Scan()", err)
+		}
+		descendants = append(descendants, descendant)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, handleError(ctx, "searchLayerDescendants.Rows()", err)
+	}
+
+	return descendants, nil
+}
+
+// ListLayers uses keyset pagination on the Layer's name so that listing stays cheap regardless of
+// the number of layers that have already been paged through.
+func (sqlite *sqlite) ListLayers(ctx context.Context, limit int, startAfter string) ([]database.Layer, error) {
+	if limit <= 0 {
+		return nil, cerrors.NewBadRequestError("could not list layers with a non-positive limit")
+	}
+
+	defer observeQueryTime("ListLayers", "all", time.Now())
+
+	return sqlite.listLayers(ctx, "listLayer", listLayer, startAfter, limit)
+}
+
+// ListLayersMissingDetector lists the layers which don't have the given detector recorded, using
+// the same pagination as ListLayers.
+func (sqlite *sqlite) ListLayersMissingDetector(ctx context.Context, detector string, limit int, startAfter string) ([]database.Layer, error) {
+	if detector == "" {
+		return nil, cerrors.NewBadRequestError("could not list layers missing a detector which has an empty name")
+	}
+	if limit <= 0 {
+		return nil, cerrors.NewBadRequestError("could not list layers with a non-positive limit")
+	}
+
+	defer observeQueryTime("ListLayersMissingDetector", "all", time.Now())
+
+	return sqlite.listLayers(ctx, "listLayerMissingDetector", listLayerMissingDetector, startAfter, limit, detector)
+}
+
+// listLayers runs the given query, which selects the same columns as listLayer, and scans the
+// layers it returns.
+// ListOutdatedLayers lists the layers that an older engine analyzed, using keyset pagination on
+// their ID.
+func (sqlite *sqlite) ListOutdatedLayers(ctx context.Context, engineVersion, limit, startAfterID int) ([]database.Layer, error) {
+	if limit <= 0 {
+		return nil, cerrors.NewBadRequestError("could not list layers with a non-positive limit")
+	}
+
+	defer observeQueryTime("ListOutdatedLayers", "all", time.Now())
+
+	return sqlite.listLayers(ctx, "listOutdatedLayer", listOutdatedLayer, startAfterID, limit, engineVersion)
+}
+
+// MarkLayerStale flags the layer as stale, until it is inserted again.
+func (sqlite *sqlite) MarkLayerStale(ctx context.Context, name string) error {
+	defer observeQueryTime("MarkLayerStale", "all", time.Now())
+
+	err := sqlite.withTransaction(ctx, func(tx *sql.Tx) error {
+		result, err := namedExec(ctx, tx, "updateLayerStale", updateLayerStale, name)
+		if err != nil {
+			return err
+		}
+		if affected, err := result.RowsAffected(); err != nil {
+			return err
+		} else if affected <= 0 {
+			return cerrors.ErrNotFound
+		}
+		return nil
+	})
+	return handleError(ctx, "MarkLayerStale", err)
+}
+
+func (sqlite *sqlite) listLayers(ctx context.Context, queryName, query string, args ...interface{}) ([]database.Layer, error) {
+	rows, err := namedQuery(ctx, sqlite, queryName, query, args...)
+	if err != nil {
+		return nil, handleError(ctx, queryName, err)
+	}
+	defer rows.Close()
+
+	var layers []database.Layer
+	for rows.Next() {
+		var layer database.Layer
+		var parentID zero.Int
+		var parentName zero.String
+		var namespaceID zero.Int
+		var namespaceName zero.String
+		var namespaceVersionFormat zero.String
+		var path, format zero.String
+
+		err = rows.Scan(&layer.ID, &layer.Name, &layer.EngineVersion, &parentID, &parentName, &namespaceID, &namespaceName, &namespaceVersionFormat, &path, &format, &layer.Stale)
+		if err != nil {
+			return nil, handleError(ctx, queryName+".Scan()", err)
+		}
+		layer.Path, layer.Format = path.String, format.String
+
+		if !parentID.IsZero() {
+			layer.Parent = &database.Layer{
+				Model: database.Model{ID: int(parentID.Int64)},
+				Name:  parentName.String,
+			}
+		}
+		if !namespaceID.IsZero() {
+			layer.Namespace = &database.Namespace{
+				Model:         database.Model{ID: int(namespaceID.Int64)},
+				Name:          namespaceName.String,
+				VersionFormat: types.VersionFormat(namespaceVersionFormat.String),
+			}
+		}
+
+		layers = append(layers, layer)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, handleError(ctx, queryName+".Rows()", err)
+	}
+
+	return layers, nil
+}
+
+// CountLayers returns the total number of layers.
+func (sqlite *sqlite) CountLayers(ctx context.Context) (int, error) {
+	defer observeQueryTime("CountLayers", "all", time.Now())
+
+	var count int
+	if err := namedQueryRow(ctx, sqlite, "countLayer", countLayer).Scan(&count); err != nil {
+		return 0, handleError(ctx, "countLayer", err)
+	}
+
+	return count, nil
+}
@@ -0,0 +1,120 @@
+// Copyright 2015 clair authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite
+
+import (
+	"context"
+	"time"
+
+	cerrors "github.com/coreos/clair/utils/errors"
+)
+
+// lock is a process-local lock.
+type lock struct {
+	owner string
+	until time.Time
+}
+
+// Lock tries to set a temporary lock.
+//
+// Locks are not stored in the database but in memory, they are therefore only shared within the
+// current process.
+//
+// Lock does not block, instead, it returns true and its expiration time
+// is the lock has been successfully acquired or false otherwise
+func (sqlite *sqlite) Lock(ctx context.Context, name string, owner string, duration time.Duration, renew bool) (bool, time.Time) {
+	if name == "" || owner == "" || duration == 0 {
+		log.Warning("could not create an invalid lock")
+		return false, time.Time{}
+	}
+
+	sqlite.locksLock.Lock()
+	defer sqlite.locksLock.Unlock()
+
+	// Compute expiration.
+	until := time.Now().Add(duration)
+
+	if renew {
+		// Renew lock.
+		if l, ok := sqlite.locks[name]; ok && l.owner == owner {
+			sqlite.locks[name] = lock{owner: owner, until: until}
+			return true, until
+		}
+	} else {
+		// Prune locks.
+		sqlite.pruneLocks()
+	}
+
+	// Lock.
+	if _, ok := sqlite.locks[name]; ok {
+		return false, until
+	}
+	sqlite.locks[name] = lock{owner: owner, until: until}
+
+	return true, until
+}
+
+// Unlock unlocks a lock specified by its name if I own it
+func (sqlite *sqlite) Unlock(ctx context.Context, name, owner string) {
+	if name == "" || owner == "" {
+		log.Warning("could not delete an invalid lock")
+		return
+	}
+
+	sqlite.locksLock.Lock()
+	defer sqlite.locksLock.Unlock()
+
+	if l, ok := sqlite.locks[name]; ok && l.owner == owner {
+		delete(sqlite.locks, name)
+	}
+}
+
+// FindLock returns the owner of a lock specified by its name and its
+// expiration time.
+func (sqlite *sqlite) FindLock(ctx context.Context, name string) (string, time.Time, error) {
+	if name == "" {
+		log.Warning("could not find an invalid lock")
+		return "", time.Time{}, cerrors.NewBadRequestError("could not find an invalid lock")
+	}
+
+	sqlite.locksLock.Lock()
+	defer sqlite.locksLock.Unlock()
+
+	l, ok := sqlite.locks[name]
+	if !ok {
+		return "", time.Time{}, cerrors.ErrNotFound
+	}
+
+	return l.owner, l.until, nil
+}
+
+// isLocked returns whether a lock with the specified name exists.
+func (sqlite *sqlite) isLocked(name string) bool {
+	sqlite.locksLock.Lock()
+	defer sqlite.locksLock.Unlock()
+
+	_, ok := sqlite.locks[name]
+	return ok
+}
+
+// pruneLocks removes every expired locks. The caller must hold locksLock.
+func (sqlite *sqlite) pruneLocks() {
+	now := time.Now()
+	for name, l := range sqlite.locks {
+		if l.until.Before(now) {
+			delete(sqlite.locks, name)
+		}
+	}
+}
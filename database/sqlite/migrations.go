@@ -0,0 +1,345 @@
+// Copyright 2015 clair authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/coreos/clair/database"
+)
+
+// migration is a set of SQL statements that upgrades the schema to a given version.
+type migration struct {
+	version int
+	name    string
+	up      string
+}
+
+// migrations lists every schema migration, ordered by ascending version.
+// Migrations must never be modified once released: schema changes have to be added as new
+// entries at the end of the list.
+var migrations = []migration{
+	{version: 1, name: "Initial", up: migrationInitial},
+	{version: 2, name: "LayerDetectors", up: migrationLayerDetectors},
+	{version: 3, name: "SeverityOrdering", up: migrationSeverityOrdering},
+	{version: 4, name: "NamespaceVersionFormat", up: migrationNamespaceVersionFormat},
+	{version: 5, name: "LayerNamespaces", up: migrationLayerNamespaces},
+	{version: 6, name: "LayerReindexing", up: migrationLayerReindexing},
+}
+
+const (
+	// bootstrapMigrations creates the table that records migrations.
+	bootstrapMigrations = `
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version INTEGER PRIMARY KEY,
+			name VARCHAR(128) NOT NULL,
+			applied_at TIMESTAMP)`
+
+	searchMigrationVersion = `SELECT COALESCE(MAX(version), 0) FROM schema_migrations`
+	insertMigration        = `INSERT INTO schema_migrations(version, name, applied_at) VALUES(?1, ?2, ?3)`
+)
+
+// migrate brings the database schema up to date by running every pending migration.
+// As SQLite transactions are serialized, no other write can happen while the migrations run.
+func (sqlite *sqlite) migrate(ctx context.Context) error {
+	log.Info("running database migrations")
+
+	if _, err := namedExec(ctx, sqlite, "bootstrapMigrations", bootstrapMigrations); err != nil {
+		return fmt.Errorf("sqlite: could not bootstrap migrations: %v", err)
+	}
+
+	err := sqlite.withTransaction(ctx, func(tx *sql.Tx) error {
+		current, err := schemaVersion(ctx, tx)
+		if err != nil {
+			return fmt.Errorf("sqlite: could not determine the current schema version: %v", err)
+		}
+
+		// The schema of a newer binary may not be compatible, Clair must be upgraded.
+		latest := migrations[len(migrations)-1].version
+		if current > latest {
+			return &database.ErrIncompatibleSchema{Found: current, Expected: latest}
+		}
+
+		for _, m := range migrations {
+			if m.version <= current {
+				continue
+			}
+
+			log.Infof("running database migration %d (%s)", m.version, m.name)
+			if err := runMigration(ctx, tx, m); err != nil {
+				return fmt.Errorf("sqlite: an error occured while running migration %d (%s): %v", m.version, m.name, err)
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Info("database migration ran successfully")
+	return nil
+}
+
+// runMigration executes a migration and records it in the given transaction.
+func runMigration(ctx context.Context, tx *sql.Tx, m migration) error {
+	if _, err := tx.ExecContext(ctx, m.up); err != nil {
+		return err
+	}
+
+	_, err := namedExec(ctx, tx, "insertMigration", insertMigration, m.version, m.name, now())
+	return err
+}
+
+// schemaVersion returns the version of the most recent migration applied on the database.
+func schemaVersion(ctx context.Context, queryer Queryer) (int, error) {
+	var version int
+	if err := namedQueryRow(ctx, queryer, "searchMigrationVersion", searchMigrationVersion).Scan(&version); err != nil {
+		return 0, handleError(ctx, "searchMigrationVersion", err)
+	}
+	return version, nil
+}
+
+// migrationInitial creates the same schema as the PostgreSQL backend, except that there is no Lock
+// table as locks are process-local, and that the columns which are looked up by the upserts are
+// unique.
+const migrationInitial = `
+-- -----------------------------------------------------
+-- Table Namespace
+-- -----------------------------------------------------
+CREATE TABLE IF NOT EXISTS Namespace (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  name VARCHAR(128) NOT NULL UNIQUE);
+
+
+-- -----------------------------------------------------
+-- Table Layer
+-- -----------------------------------------------------
+CREATE TABLE IF NOT EXISTS Layer (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  name VARCHAR(128) NOT NULL UNIQUE,
+  engineversion SMALLINT NOT NULL,
+  parent_id INTEGER NULL REFERENCES Layer ON DELETE CASCADE,
+  namespace_id INTEGER NULL REFERENCES Namespace,
+  created_at TIMESTAMP);
+
+CREATE INDEX layer_parent_id ON Layer (parent_id);
+CREATE INDEX layer_namespace_id ON Layer (namespace_id);
+
+
+-- -----------------------------------------------------
+-- Table Feature
+-- -----------------------------------------------------
+CREATE TABLE IF NOT EXISTS Feature (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  namespace_id INTEGER NOT NULL REFERENCES Namespace,
+  name VARCHAR(128) NOT NULL,
+
+  UNIQUE (namespace_id, name));
+
+
+-- -----------------------------------------------------
+-- Table FeatureVersion
+-- -----------------------------------------------------
+CREATE TABLE IF NOT EXISTS FeatureVersion (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  feature_id INTEGER NOT NULL REFERENCES Feature,
+  version VARCHAR(128) NOT NULL,
+
+  UNIQUE (feature_id, version));
+
+
+-- -----------------------------------------------------
+-- Table Layer_diff_FeatureVersion
+-- -----------------------------------------------------
+CREATE TABLE IF NOT EXISTS Layer_diff_FeatureVersion (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  layer_id INTEGER NOT NULL REFERENCES Layer ON DELETE CASCADE,
+  featureversion_id INTEGER NOT NULL REFERENCES FeatureVersion,
+  modification VARCHAR(3) NOT NULL CHECK (modification IN ('add', 'del')),
+
+  UNIQUE (layer_id, featureversion_id));
+
+CREATE INDEX layer_diff_featureversion_featureversion_id
+  ON Layer_diff_FeatureVersion (featureversion_id, layer_id);
+
+
+-- -----------------------------------------------------
+-- Table Vulnerability
+-- -----------------------------------------------------
+CREATE TABLE IF NOT EXISTS Vulnerability (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  namespace_id INTEGER NOT NULL REFERENCES Namespace,
+  name VARCHAR(128) NOT NULL,
+  description TEXT NULL,
+  link VARCHAR(128) NULL,
+  links TEXT NULL,
+  severity VARCHAR(16) NOT NULL,
+  metadata TEXT NULL,
+  created_at TIMESTAMP,
+  deleted_at TIMESTAMP NULL);
+
+CREATE INDEX vulnerability_namespace_id_name ON Vulnerability (namespace_id, name);
+
+
+-- -----------------------------------------------------
+-- Table Vulnerability_FixedIn_Feature
+-- -----------------------------------------------------
+CREATE TABLE IF NOT EXISTS Vulnerability_FixedIn_Feature (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  vulnerability_id INTEGER NOT NULL REFERENCES Vulnerability ON DELETE CASCADE,
+  feature_id INTEGER NOT NULL REFERENCES Feature,
+  version VARCHAR(128) NOT NULL,
+
+  UNIQUE (vulnerability_id, feature_id));
+
+CREATE INDEX vulnerability_fixedin_feature_feature_id
+  ON Vulnerability_FixedIn_Feature (feature_id, vulnerability_id);
+
+
+-- -----------------------------------------------------
+-- Table Vulnerability_Affects_FeatureVersion
+-- -----------------------------------------------------
+CREATE TABLE IF NOT EXISTS Vulnerability_Affects_FeatureVersion (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  vulnerability_id INTEGER NOT NULL REFERENCES Vulnerability ON DELETE CASCADE,
+  featureversion_id INTEGER NOT NULL REFERENCES FeatureVersion,
+  fixedin_id INTEGER NOT NULL REFERENCES Vulnerability_FixedIn_Feature ON DELETE CASCADE,
+
+  UNIQUE (vulnerability_id, featureversion_id));
+
+CREATE INDEX vulnerability_affects_featureversion_fixedin_id
+  ON Vulnerability_Affects_FeatureVersion (fixedin_id);
+CREATE INDEX vulnerability_affects_featureversion_featureversion_id
+  ON Vulnerability_Affects_FeatureVersion (featureversion_id, vulnerability_id);
+
+
+-- -----------------------------------------------------
+-- Table Vulnerability_History
+-- -----------------------------------------------------
+CREATE TABLE IF NOT EXISTS Vulnerability_History (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  namespace_id INTEGER NOT NULL REFERENCES Namespace,
+  name VARCHAR(128) NOT NULL,
+  created_at TIMESTAMP,
+  source VARCHAR(128) NOT NULL,
+  old_severity VARCHAR(16) NOT NULL,
+  new_severity VARCHAR(16) NOT NULL,
+  feature_name VARCHAR(128) NOT NULL,
+  old_fixedby VARCHAR(128) NOT NULL,
+  new_fixedby VARCHAR(128) NOT NULL);
+
+CREATE INDEX vulnerability_history_namespace_id_name
+  ON Vulnerability_History (namespace_id, name, id);
+
+
+-- -----------------------------------------------------
+-- Table KeyValue
+-- -----------------------------------------------------
+CREATE TABLE IF NOT EXISTS KeyValue (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  key VARCHAR(128) NOT NULL UNIQUE,
+  value TEXT);
+
+
+-- -----------------------------------------------------
+-- Table VulnerabilityNotification
+-- -----------------------------------------------------
+CREATE TABLE IF NOT EXISTS Vulnerability_Notification (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  name VARCHAR(64) NOT NULL UNIQUE,
+  created_at TIMESTAMP,
+  notified_at TIMESTAMP NULL,
+  deleted_at TIMESTAMP NULL,
+  old_vulnerability_id INTEGER NULL REFERENCES Vulnerability ON DELETE CASCADE,
+  new_vulnerability_id INTEGER NULL REFERENCES Vulnerability ON DELETE CASCADE);
+
+CREATE INDEX vulnerability_notification_notified_at ON Vulnerability_Notification (notified_at);
+`
+
+// migrationLayerDetectors adds the table that records the detectors that processed each layer.
+const migrationLayerDetectors = `
+CREATE TABLE IF NOT EXISTS Layer_Detector (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  layer_id INTEGER NOT NULL REFERENCES Layer ON DELETE CASCADE,
+  detector VARCHAR(128) NOT NULL,
+
+  UNIQUE (layer_id, detector));
+
+CREATE INDEX layer_detector_detector ON Layer_Detector (detector, layer_id);
+`
+
+// migrationSeverityOrdering ranks the severities like types.Priorities, as SQLite has no enum type
+// to compare them, and converts the existing ones that are not spelled exactly like we do.
+const migrationSeverityOrdering = `
+CREATE TABLE IF NOT EXISTS Severity (
+  name VARCHAR(16) PRIMARY KEY,
+  rank INTEGER NOT NULL UNIQUE);
+
+INSERT INTO Severity(name, rank) VALUES
+  ('Unknown', 0), ('Negligible', 1), ('Low', 2), ('Medium', 3), ('High', 4), ('Critical', 5), ('Defcon1', 6);
+
+UPDATE Vulnerability
+SET severity = COALESCE((SELECT name FROM Severity WHERE lower(name) = lower(Vulnerability.severity)), 'Unknown');
+
+UPDATE Vulnerability_History
+SET old_severity = COALESCE((SELECT name FROM Severity WHERE lower(name) = lower(Vulnerability_History.old_severity)), 'Unknown'),
+    new_severity = COALESCE((SELECT name FROM Severity WHERE lower(name) = lower(Vulnerability_History.new_severity)), 'Unknown');
+`
+
+// migrationNamespaceVersionFormat records the format of the package versions of each namespace,
+// which tells how they compare, and guesses it from the names of the existing namespaces.
+const migrationNamespaceVersionFormat = `
+ALTER TABLE Namespace ADD COLUMN version_format VARCHAR(16) NULL;
+
+UPDATE Namespace
+SET version_format = CASE substr(name, 1, instr(name || ':', ':') - 1)
+  WHEN 'debian' THEN 'dpkg'
+  WHEN 'ubuntu' THEN 'dpkg'
+  WHEN 'centos' THEN 'rpm'
+  WHEN 'rhel' THEN 'rpm'
+  WHEN 'fedora' THEN 'rpm'
+  WHEN 'oracle' THEN 'rpm'
+  WHEN 'scientific' THEN 'rpm'
+  WHEN 'alpine' THEN 'apk'
+END;
+`
+
+// migrationLayerNamespaces adds the table that records every namespace of each layer. The primary
+// namespace of the existing layers becomes their only one.
+const migrationLayerNamespaces = `
+CREATE TABLE IF NOT EXISTS Layer_Namespace (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  layer_id INTEGER NOT NULL REFERENCES Layer ON DELETE CASCADE,
+  namespace_id INTEGER NOT NULL REFERENCES Namespace,
+
+  UNIQUE (layer_id, namespace_id));
+
+CREATE INDEX layer_namespace_namespace ON Layer_Namespace (namespace_id);
+
+INSERT INTO Layer_Namespace(layer_id, namespace_id)
+  SELECT id, namespace_id FROM Layer WHERE namespace_id IS NOT NULL ORDER BY id;
+`
+
+// migrationLayerReindexing records where the archive of each layer comes from, so that a newer
+// engine can analyze it again, and flags the layers for which this is impossible. The existing
+// layers have no known archive.
+const migrationLayerReindexing = `
+ALTER TABLE Layer ADD COLUMN path TEXT NULL;
+ALTER TABLE Layer ADD COLUMN format VARCHAR(64) NULL;
+ALTER TABLE Layer ADD COLUMN stale BOOLEAN NOT NULL DEFAULT 0;
+`
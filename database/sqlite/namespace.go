@@ -0,0 +1,122 @@
+// Copyright 2015 clair authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/guregu/null/zero"
+
+	"github.com/coreos/clair/database"
+	cerrors "github.com/coreos/clair/utils/errors"
+	"github.com/coreos/clair/utils/types"
+)
+
+// insertNamespace finds or creates a namespace in the given transaction.
+func (sqlite *sqlite) insertNamespace(ctx context.Context, queryer Queryer, namespace database.Namespace) (int, error) {
+	if namespace.Name == "" {
+		return 0, cerrors.NewBadRequestError("could not find/insert invalid Namespace")
+	}
+
+	defer observeQueryTime("insertNamespace", "all", time.Now())
+
+	if _, err := namedExec(ctx, queryer, "insertNamespace", insertNamespace, namespace.Name, string(namespace.VersionFormat)); err != nil {
+		return 0, handleError(ctx, "insertNamespace", err)
+	}
+	if namespace.VersionFormat != "" {
+		if _, err := namedExec(ctx, queryer, "updateNamespaceVersionFormat", updateNamespaceVersionFormat, namespace.Name, string(namespace.VersionFormat)); err != nil {
+			return 0, handleError(ctx, "updateNamespaceVersionFormat", err)
+		}
+	}
+
+	var id int
+	err := namedQueryRow(ctx, queryer, "searchNamespace", searchNamespace, namespace.Name).Scan(&id)
+	if err != nil {
+		return 0, handleError(ctx, "searchNamespace", err)
+	}
+
+	return id, nil
+}
+
+func (sqlite *sqlite) ListNamespaces(ctx context.Context) (namespaces []database.Namespace, err error) {
+	rows, err := namedQuery(ctx, sqlite, "listNamespace", listNamespace)
+	if err != nil {
+		return namespaces, handleError(ctx, "listNamespace", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var namespace database.Namespace
+		var versionFormat zero.String
+
+		err = rows.Scan(&namespace.ID, &namespace.Name, &versionFormat)
+		if err != nil {
+			return namespaces, handleError(ctx, "listNamespace.Scan()", err)
+		}
+
+		namespace.VersionFormat = types.VersionFormat(versionFormat.String)
+		namespaces = append(namespaces, namespace)
+	}
+	if err = rows.Err(); err != nil {
+		return namespaces, handleError(ctx, "listNamespace.Rows()", err)
+	}
+
+	return namespaces, err
+}
+
+func (sqlite *sqlite) CountVulnerabilitiesByNamespace(ctx context.Context) (map[string]int, error) {
+	defer observeQueryTime("CountVulnerabilitiesByNamespace", "all", time.Now())
+
+	rows, err := namedQuery(ctx, sqlite, "countVulnerabilityByNamespace", countVulnerabilityByNamespace)
+	if err != nil {
+		return nil, handleError(ctx, "countVulnerabilityByNamespace", err)
+	}
+	defer rows.Close()
+
+	counts := make(map[string]int)
+	for rows.Next() {
+		var name string
+		var count int
+		if err = rows.Scan(&name, &count); err != nil {
+			return nil, handleError(ctx, "countVulnerabilityByNamespace.Scan()", err)
+		}
+		counts[name] = count
+	}
+	if err = rows.Err(); err != nil {
+		return nil, handleError(ctx, "countVulnerabilityByNamespace.Rows()", err)
+	}
+
+	return counts, nil
+}
+
+func (sqlite *sqlite) GetLastVulnerabilityChange(ctx context.Context, namespaceName string) (time.Time, error) {
+	defer observeQueryTime("GetLastVulnerabilityChange", "all", time.Now())
+
+	var created, deleted zero.Time
+	err := namedQueryRow(ctx, sqlite, "searchLastVulnerabilityChange", searchLastVulnerabilityChange, namespaceName).Scan(&created, &deleted)
+	if err == sql.ErrNoRows {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, handleError(ctx, "searchLastVulnerabilityChange", err)
+	}
+
+	if deleted.Time.After(created.Time) {
+		return deleted.Time, nil
+	}
+	return created.Time, nil
+}
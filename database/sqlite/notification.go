@@ -0,0 +1,258 @@
+// Copyright 2015 clair authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/coreos/clair/database"
+	cerrors "github.com/coreos/clair/utils/errors"
+	"github.com/guregu/null/zero"
+	"github.com/pborman/uuid"
+)
+
+// do it in tx so we won't insert/update a vuln without notification and vice-versa.
+// name and created doesn't matter.
+func createNotification(ctx context.Context, tx *sql.Tx, oldVulnerabilityID, newVulnerabilityID int) error {
+	defer observeQueryTime("createNotification", "all", time.Now())
+
+	// Insert Notification.
+	oldVulnerabilityNullableID := sql.NullInt64{Int64: int64(oldVulnerabilityID), Valid: oldVulnerabilityID != 0}
+	newVulnerabilityNullableID := sql.NullInt64{Int64: int64(newVulnerabilityID), Valid: newVulnerabilityID != 0}
+	_, err := namedExec(ctx, tx, "insertNotification", insertNotification, uuid.New(), now(), oldVulnerabilityNullableID, newVulnerabilityNullableID)
+	if err != nil {
+		return handleError(ctx, "insertNotification", err)
+	}
+
+	return nil
+}
+
+// Get one available notification name (!locked && !deleted && (!notified || notified_but_timed-out)).
+// Does not fill new/old vuln.
+// As locks are process-local, the locked notifications are skipped here rather than in the query.
+func (sqlite *sqlite) GetAvailableNotification(ctx context.Context, renotifyInterval time.Duration) (database.VulnerabilityNotification, error) {
+	defer observeQueryTime("GetAvailableNotification", "all", time.Now())
+
+	before := now().Add(-renotifyInterval)
+	rows, err := namedQuery(ctx, sqlite, "searchNotificationAvailable", searchNotificationAvailable, before)
+	if err != nil {
+		return database.VulnerabilityNotification{}, handleError(ctx, "searchNotificationAvailable", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		notification, err := sqlite.scanNotification(ctx, rows, false)
+		if err != nil {
+			return notification, handleError(ctx, "searchNotificationAvailable.Scan()", err)
+		}
+
+		if !sqlite.isLocked(notification.Name) {
+			return notification, nil
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return database.VulnerabilityNotification{}, handleError(ctx, "searchNotificationAvailable.Rows()", err)
+	}
+
+	return database.VulnerabilityNotification{}, cerrors.ErrNotFound
+}
+
+func (sqlite *sqlite) GetNotification(ctx context.Context, name string, limit int, page database.VulnerabilityNotificationPageNumber) (database.VulnerabilityNotification, database.VulnerabilityNotificationPageNumber, error) {
+	defer observeQueryTime("GetNotification", "all", time.Now())
+
+	// Get Notification.
+	notification, err := sqlite.scanNotification(ctx, namedQueryRow(ctx, sqlite, "searchNotification", searchNotification, name), true)
+	if err != nil {
+		return notification, page, handleError(ctx, "searchNotification", err)
+	}
+
+	// Load vulnerabilities' LayersIntroducingVulnerability.
+	page.OldVulnerability, err = sqlite.loadLayerIntroducingVulnerability(
+		ctx,
+		notification.OldVulnerability,
+		limit,
+		page.OldVulnerability,
+	)
+
+	if err != nil {
+		return notification, page, err
+	}
+
+	page.NewVulnerability, err = sqlite.loadLayerIntroducingVulnerability(
+		ctx,
+		notification.NewVulnerability,
+		limit,
+		page.NewVulnerability,
+	)
+
+	if err != nil {
+		return notification, page, err
+	}
+
+	return notification, page, nil
+}
+
+// scanner is implemented by both *sql.Row and *sql.Rows.
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func (sqlite *sqlite) scanNotification(ctx context.Context, row scanner, hasVulns bool) (database.VulnerabilityNotification, error) {
+	var notification database.VulnerabilityNotification
+	var created zero.Time
+	var notified zero.Time
+	var deleted zero.Time
+	var oldVulnerabilityNullableID sql.NullInt64
+	var newVulnerabilityNullableID sql.NullInt64
+
+	// Scan notification.
+	if hasVulns {
+		err := row.Scan(
+			&notification.ID,
+			&notification.Name,
+			&created,
+			&notified,
+			&deleted,
+			&oldVulnerabilityNullableID,
+			&newVulnerabilityNullableID,
+		)
+
+		if err != nil {
+			return notification, err
+		}
+	} else {
+		err := row.Scan(&notification.ID, &notification.Name, &created, &notified, &deleted)
+
+		if err != nil {
+			return notification, err
+		}
+	}
+
+	notification.Created = created.Time
+	notification.Notified = notified.Time
+	notification.Deleted = deleted.Time
+
+	if hasVulns {
+		if oldVulnerabilityNullableID.Valid {
+			vulnerability, err := findVulnerabilityByIDWithDeleted(ctx, sqlite, int(oldVulnerabilityNullableID.Int64))
+			if err != nil {
+				return notification, err
+			}
+
+			notification.OldVulnerability = &vulnerability
+		}
+
+		if newVulnerabilityNullableID.Valid {
+			vulnerability, err := findVulnerabilityByIDWithDeleted(ctx, sqlite, int(newVulnerabilityNullableID.Int64))
+			if err != nil {
+				return notification, err
+			}
+
+			notification.NewVulnerability = &vulnerability
+		}
+	}
+
+	return notification, nil
+}
+
+// Fills Vulnerability.LayersIntroducingVulnerability.
+// limit -1: won't do anything
+// limit 0: will just get the startID of the second page
+func (sqlite *sqlite) loadLayerIntroducingVulnerability(ctx context.Context, vulnerability *database.Vulnerability, limit, startID int) (int, error) {
+	tf := time.Now()
+
+	if vulnerability == nil {
+		return -1, nil
+	}
+
+	// A startID equals to -1 means that we reached the end already.
+	if startID == -1 || limit == -1 {
+		return -1, nil
+	}
+
+	// We do `defer observeQueryTime` here because we don't want to observe invalid calls.
+	defer observeQueryTime("loadLayerIntroducingVulnerability", "all", tf)
+
+	// Query with limit + 1, the last item will be used to know the next starting ID.
+	rows, err := namedQuery(ctx, sqlite, "searchNotificationLayerIntroducingVulnerability", searchNotificationLayerIntroducingVulnerability,
+		vulnerability.ID, startID, limit+1)
+	if err != nil {
+		return 0, handleError(ctx, "searchNotificationLayerIntroducingVulnerability", err)
+	}
+	defer rows.Close()
+
+	var layers []database.Layer
+	for rows.Next() {
+		var layer database.Layer
+
+		if err := rows.Scan(&layer.ID, &layer.Name); err != nil {
+			return -1, handleError(ctx, "searchNotificationLayerIntroducingVulnerability.Scan()", err)
+		}
+
+		layers = append(layers, layer)
+	}
+	if err = rows.Err(); err != nil {
+		return -1, handleError(ctx, "searchNotificationLayerIntroducingVulnerability.Rows()", err)
+	}
+
+	size := limit
+	if len(layers) < limit {
+		size = len(layers)
+	}
+	vulnerability.LayersIntroducingVulnerability = layers[:size]
+
+	nextID := -1
+	if len(layers) > limit {
+		nextID = layers[limit].ID
+	}
+
+	return nextID, nil
+}
+
+func (sqlite *sqlite) SetNotificationNotified(ctx context.Context, name string) error {
+	defer observeQueryTime("SetNotificationNotified", "all", time.Now())
+
+	err := sqlite.withTransaction(ctx, func(tx *sql.Tx) error {
+		_, err := namedExec(ctx, tx, "updatedNotificationNotified", updatedNotificationNotified, name, now())
+		return err
+	})
+	return handleError(ctx, "updatedNotificationNotified", err)
+}
+
+func (sqlite *sqlite) DeleteNotification(ctx context.Context, name string) error {
+	defer observeQueryTime("DeleteNotification", "all", time.Now())
+
+	err := sqlite.withTransaction(ctx, func(tx *sql.Tx) error {
+		result, err := namedExec(ctx, tx, "removeNotification", removeNotification, name, now())
+		if err != nil {
+			return handleError(ctx, "removeNotification", err)
+		}
+
+		affected, err := result.RowsAffected()
+		if err != nil {
+			return handleError(ctx, "removeNotification.RowsAffected()", err)
+		}
+
+		if affected <= 0 {
+			return cerrors.ErrNotFound
+		}
+
+		return nil
+	})
+
+	return handleError(ctx, "DeleteNotification", err)
+}
@@ -0,0 +1,412 @@
+// Copyright 2015 clair authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite
+
+// SQLite has no arrays nor RETURNING clause, and its upserts are expressed as INSERT OR IGNORE /
+// INSERT OR REPLACE statements relying on unique constraints. Parameters are numbered (?NNN) so
+// they can be referenced several times.
+const (
+	// keyvalue.go
+	upsertKeyValue = `INSERT OR REPLACE INTO KeyValue(key, value) VALUES(?1, ?2)`
+	searchKeyValue = `SELECT value FROM KeyValue WHERE key = ?1`
+	swapKeyValue   = `UPDATE KeyValue SET value = ?3 WHERE key = ?1 AND value = ?2`
+	insertKeyValue = `INSERT OR IGNORE INTO KeyValue(key, value) VALUES(?1, ?2)`
+
+	// namespace.go
+	insertNamespace = `INSERT OR IGNORE INTO Namespace(name, version_format) VALUES(?1, NULLIF(?2, ''))`
+	// The version format of an existing namespace is only recorded if it wasn't known yet.
+	updateNamespaceVersionFormat = `
+		UPDATE Namespace SET version_format = ?2
+		WHERE name = ?1 AND version_format IS NULL AND ?2 <> ''`
+	searchNamespace = `SELECT id FROM Namespace WHERE name = ?1`
+	listNamespace   = `SELECT id, name, version_format FROM Namespace`
+
+	countVulnerabilityByNamespace = `
+		SELECT n.name, COUNT(v.id)
+		FROM Vulnerability v JOIN Namespace n ON v.namespace_id = n.id
+		WHERE v.deleted_at IS NULL
+		GROUP BY n.name`
+
+	// A modified Vulnerability is deleted and inserted again, so its last change is the most
+	// recent insertion or deletion.
+	searchLastVulnerabilityChange = `
+		SELECT v.created_at, v.deleted_at
+		FROM Vulnerability v JOIN Namespace n ON v.namespace_id = n.id
+		WHERE n.name = ?1
+		ORDER BY COALESCE(v.deleted_at, v.created_at) DESC
+		LIMIT 1`
+
+	// feature.go
+	insertFeature = `INSERT OR IGNORE INTO Feature(name, namespace_id) VALUES(?1, ?2)`
+	searchFeature = `SELECT id FROM Feature WHERE name = ?1 AND namespace_id = ?2`
+
+	insertFeatureVersion = `INSERT OR IGNORE INTO FeatureVersion(feature_id, version) VALUES(?1, ?2)`
+	searchFeatureVersion = `SELECT id FROM FeatureVersion WHERE feature_id = ?1 AND version = ?2`
+
+	searchVulnerabilityFixedInFeature = `
+		SELECT vfif.id, vfif.vulnerability_id, vfif.version, n.version_format
+		FROM Vulnerability_FixedIn_Feature vfif
+			JOIN Feature f ON vfif.feature_id = f.id
+			JOIN Namespace n ON f.namespace_id = n.id
+		WHERE vfif.feature_id = ?1`
+
+	insertVulnerabilityAffectsFeatureVersion = `
+		INSERT INTO Vulnerability_Affects_FeatureVersion(vulnerability_id, featureversion_id, fixedin_id)
+		VALUES(?1, ?2, ?3)`
+
+	// layer.go
+	searchLayer = `
+		SELECT l.id, l.name, l.engineversion, p.id, p.name, n.id, n.name, n.version_format, l.path, l.format, l.stale
+		FROM Layer l
+			LEFT JOIN Layer p ON l.parent_id = p.id
+			LEFT JOIN Namespace n ON l.namespace_id = n.id
+		WHERE l.name = ?1`
+
+	// searchLayerAncestry walks up the layer tree, for at most ?2 + 1 levels, and returns the depth
+	// of the last layer it reached and whether that layer had already been seen. The path of the
+	// walk is a comma-separated list of IDs, as there are no arrays.
+	searchLayerAncestry = `
+		WITH RECURSIVE layer_tree(id, parent_id, depth, path, cycle) AS (
+			SELECT l.id, l.parent_id, 1, ',' || l.id || ',', 0
+			FROM Layer l
+			WHERE l.id = ?1
+		UNION ALL
+			SELECT l.id, l.parent_id, lt.depth + 1, lt.path || l.id || ',', instr(lt.path, ',' || l.id || ',') > 0
+			FROM Layer l, layer_tree lt
+			WHERE l.id = lt.parent_id AND NOT lt.cycle AND lt.depth <= ?2
+		)
+		SELECT depth, cycle FROM layer_tree ORDER BY depth DESC LIMIT 1`
+
+	// searchLayerFeatureVersion walks up the layer tree, which is bounded by ?2 levels. The
+	// ancestry is verified by searchLayerAncestry first.
+	searchLayerFeatureVersion = `
+		WITH RECURSIVE layer_tree(id, name, parent_id, depth) AS (
+			SELECT l.id, l.name, l.parent_id, 1
+			FROM Layer l
+			WHERE l.id = ?1
+		UNION ALL
+			SELECT l.id, l.name, l.parent_id, lt.depth + 1
+			FROM Layer l, layer_tree lt
+			WHERE l.id = lt.parent_id AND lt.depth < ?2
+		)
+		SELECT ldf.featureversion_id, ldf.modification, fn.id, fn.name, f.id, f.name, fv.id, fv.version, lt.id, lt.name
+		FROM Layer_diff_FeatureVersion ldf
+			JOIN layer_tree lt ON ldf.layer_id = lt.id
+			JOIN FeatureVersion fv ON ldf.featureversion_id = fv.id
+			JOIN Feature f ON fv.feature_id = f.id
+			JOIN Namespace fn ON f.namespace_id = fn.id
+		ORDER BY lt.depth DESC`
+
+	searchFeatureVersionVulnerability = `
+		SELECT v.id, v.name, v.description, v.link, v.links, v.severity, v.metadata, vn.name, vfif.version
+		FROM Vulnerability_Affects_FeatureVersion vafv
+			JOIN Vulnerability_FixedIn_Feature vfif ON vafv.fixedin_id = vfif.id
+			JOIN Vulnerability v ON vfif.vulnerability_id = v.id
+			JOIN Namespace vn ON v.namespace_id = vn.id
+		WHERE vafv.featureversion_id = ?1 AND v.deleted_at IS NULL
+			AND (SELECT rank FROM Severity WHERE name = v.severity) >= (SELECT rank FROM Severity WHERE name = ?2)`
+
+	insertLayer = `
+		INSERT INTO Layer(name, engineversion, parent_id, namespace_id, created_at, path, format)
+		VALUES(?1, ?2, ?3, ?4, ?5, ?6, ?7)`
+
+	updateLayer = `
+		UPDATE Layer SET engineversion = ?2, namespace_id = ?3, parent_id = ?4, path = ?5, format = ?6, stale = 0
+		WHERE id = ?1`
+
+	updateLayerStale = `UPDATE Layer SET stale = 1 WHERE name = ?1`
+
+	removeLayerDiffFeatureVersion = `DELETE FROM Layer_diff_FeatureVersion WHERE layer_id = ?1`
+
+	insertLayerDiffFeatureVersion = `
+		INSERT OR IGNORE INTO Layer_diff_FeatureVersion(layer_id, featureversion_id, modification)
+		VALUES(?1, ?2, ?3)`
+
+	searchLayerExists = `SELECT EXISTS(SELECT 1 FROM Layer WHERE name = ?1)`
+
+	searchLayerChildren = `
+		SELECT l.id, l.name
+		FROM Layer l, Layer p
+		WHERE l.parent_id = p.id AND p.name = ?1`
+
+	// searchLayerDescendants is bounded by ?2 levels, like searchLayerFeatureVersion.
+	searchLayerDescendants = `
+		WITH RECURSIVE descendants(id, name, depth) AS (
+			SELECT l.id, l.name, 1
+			FROM Layer l, Layer p
+			WHERE l.parent_id = p.id AND p.name = ?1
+		UNION ALL
+			SELECT l.id, l.name, d.depth + 1
+			FROM Layer l, descendants d
+			WHERE l.parent_id = d.id AND d.depth < ?2
+		)
+		SELECT name FROM descendants`
+
+	removeLayer = `DELETE FROM Layer WHERE name = ?1`
+
+	listLayer = `
+		SELECT l.id, l.name, l.engineversion, p.id, p.name, n.id, n.name, n.version_format, l.path, l.format, l.stale
+		FROM Layer l
+			LEFT JOIN Layer p ON l.parent_id = p.id
+			LEFT JOIN Namespace n ON l.namespace_id = n.id
+		WHERE l.name > ?1
+		ORDER BY l.name
+		LIMIT ?2`
+
+	listLayerMissingDetector = `
+		SELECT l.id, l.name, l.engineversion, p.id, p.name, n.id, n.name, n.version_format, l.path, l.format, l.stale
+		FROM Layer l
+			LEFT JOIN Layer p ON l.parent_id = p.id
+			LEFT JOIN Namespace n ON l.namespace_id = n.id
+		WHERE l.name > ?1
+			AND NOT EXISTS (SELECT 1 FROM Layer_Detector ld WHERE ld.layer_id = l.id AND ld.detector = ?3)
+		ORDER BY l.name
+		LIMIT ?2`
+
+	listOutdatedLayer = `
+		SELECT l.id, l.name, l.engineversion, p.id, p.name, n.id, n.name, n.version_format, l.path, l.format, l.stale
+		FROM Layer l
+			LEFT JOIN Layer p ON l.parent_id = p.id
+			LEFT JOIN Namespace n ON l.namespace_id = n.id
+		WHERE l.id > ?1 AND l.engineversion < ?3 AND NOT l.stale
+		ORDER BY l.id
+		LIMIT ?2`
+
+	countLayer = `SELECT COUNT(*) FROM Layer`
+
+	searchLayerDetector = `SELECT detector FROM Layer_Detector WHERE layer_id = ?1 ORDER BY detector`
+	insertLayerDetector = `INSERT OR IGNORE INTO Layer_Detector(layer_id, detector) VALUES(?1, ?2)`
+	removeLayerDetector = `DELETE FROM Layer_Detector WHERE layer_id = ?1`
+
+	searchLayerNamespace = `
+		SELECT n.id, n.name, n.version_format
+		FROM Layer_Namespace ln JOIN Namespace n ON ln.namespace_id = n.id
+		WHERE ln.layer_id = ?1
+		ORDER BY ln.id`
+	insertLayerNamespace = `INSERT INTO Layer_Namespace(layer_id, namespace_id) VALUES(?1, ?2)`
+	removeLayerNamespace = `DELETE FROM Layer_Namespace WHERE layer_id = ?1`
+
+	// vulnerability.go
+	searchVulnerabilityBase = `
+		SELECT v.id, v.name, n.id, n.name, v.description, v.link, v.links, v.severity, v.metadata
+		FROM Vulnerability v JOIN Namespace n ON v.namespace_id = n.id`
+	searchVulnerabilityByNamespaceAndName = ` WHERE n.name = ?1 AND v.name = ?2 AND v.deleted_at IS NULL`
+	searchVulnerabilityByID               = ` WHERE v.id = ?1`
+	searchVulnerabilityByNamespace        = ` WHERE n.name = ?1 AND v.deleted_at IS NULL
+		AND v.id >= ?2
+		AND (SELECT rank FROM Severity WHERE name = v.severity) >= (SELECT rank FROM Severity WHERE name = ?4)
+		ORDER BY v.id
+		LIMIT ?3`
+
+	searchVulnerabilityFixedIn = `
+		SELECT vfif.version, f.id, f.name
+		FROM Vulnerability_FixedIn_Feature vfif JOIN Feature f ON vfif.feature_id = f.id
+		WHERE vfif.vulnerability_id = ?1`
+
+	insertVulnerability = `
+		INSERT INTO Vulnerability(namespace_id, name, description, link, links, severity, metadata, created_at)
+		VALUES(?1, ?2, ?3, ?4, ?5, ?6, ?7, ?8)`
+
+	insertVulnerabilityFixedInFeature = `
+		INSERT INTO Vulnerability_FixedIn_Feature(vulnerability_id, feature_id, version)
+		VALUES(?1, ?2, ?3)`
+
+	searchFeatureVersionByFeature = `
+		SELECT fv.id, fv.version, n.version_format
+		FROM FeatureVersion fv
+			JOIN Feature f ON fv.feature_id = f.id
+			JOIN Namespace n ON f.namespace_id = n.id
+		WHERE fv.feature_id = ?1`
+
+	searchVulnerabilityID = `
+		SELECT v.id
+		FROM Vulnerability v JOIN Namespace n ON v.namespace_id = n.id
+		WHERE n.name = ?1 AND v.name = ?2 AND v.deleted_at IS NULL`
+
+	removeVulnerability = `UPDATE Vulnerability SET deleted_at = ?2 WHERE id = ?1`
+
+	// affectedLayersBase finds the layers that introduce a FeatureVersion affected by the given
+	// vulnerability, and that are the root of at least one branch of the layer tree in which no
+	// layer removes (or upgrades) that FeatureVersion, i.e. which leads to an affected leaf layer.
+	affectedLayersBase = `
+		WITH RECURSIVE introducing(id, name, featureversion_id) AS (
+			SELECT DISTINCT l.id, l.name, vafv.featureversion_id
+			FROM Vulnerability_Affects_FeatureVersion vafv
+				JOIN Layer_diff_FeatureVersion ldf ON ldf.featureversion_id = vafv.featureversion_id
+				JOIN Layer l ON ldf.layer_id = l.id
+			WHERE vafv.vulnerability_id = ?1 AND ldf.modification = 'add'
+		), holding(root_id, layer_id, featureversion_id) AS (
+			SELECT id, id, featureversion_id FROM introducing
+			UNION
+			SELECT h.root_id, c.id, h.featureversion_id
+			FROM holding h JOIN Layer c ON c.parent_id = h.layer_id
+			WHERE NOT EXISTS (
+				SELECT 1 FROM Layer_diff_FeatureVersion ldf
+				WHERE ldf.layer_id = c.id AND ldf.featureversion_id = h.featureversion_id
+					AND ldf.modification = 'del')
+		), affected(id, name) AS (
+			SELECT DISTINCT i.id, i.name
+			FROM introducing i
+			WHERE EXISTS (
+				SELECT 1 FROM holding h
+				WHERE h.root_id = i.id AND h.featureversion_id = i.featureversion_id
+					AND NOT EXISTS (SELECT 1 FROM Layer c WHERE c.parent_id = h.layer_id))
+		)`
+
+	searchAffectedLayers = `
+		SELECT id, name FROM affected
+		WHERE id > ?2
+		ORDER BY id
+		LIMIT ?3`
+
+	countAffectedLayers = ` SELECT COUNT(*) FROM affected`
+
+	insertVulnerabilityHistory = `
+		INSERT INTO Vulnerability_History(namespace_id, name, created_at, source, old_severity,
+			new_severity, feature_name, old_fixedby, new_fixedby)
+		VALUES(?1, ?2, ?3, ?4, ?5, ?6, ?7, ?8, ?9)`
+
+	removeVulnerabilityHistoryOldest = `
+		DELETE FROM Vulnerability_History
+		WHERE namespace_id = ?1 AND name = ?2 AND id NOT IN (
+			SELECT id
+			FROM Vulnerability_History
+			WHERE namespace_id = ?1 AND name = ?2
+			ORDER BY id DESC
+			LIMIT ?3)`
+
+	searchVulnerabilityHistory = `
+		SELECT vh.created_at, vh.source, vh.old_severity, vh.new_severity, vh.feature_name,
+			vh.old_fixedby, vh.new_fixedby
+		FROM Vulnerability_History vh JOIN Namespace n ON vh.namespace_id = n.id
+		WHERE n.name = ?1 AND vh.name = ?2
+		ORDER BY vh.id DESC`
+
+	// notification.go
+	insertNotification = `
+		INSERT INTO Vulnerability_Notification(name, created_at, old_vulnerability_id, new_vulnerability_id)
+		VALUES(?1, ?2, ?3, ?4)`
+
+	updatedNotificationNotified = `
+		UPDATE Vulnerability_Notification
+		SET notified_at = ?2
+		WHERE name = ?1`
+
+	removeNotification = `
+		UPDATE Vulnerability_Notification
+		SET deleted_at = COALESCE(deleted_at, ?2)
+		WHERE name = ?1`
+
+	// searchNotificationAvailable doesn't exclude the locked notifications, as locks are not
+	// stored in the database.
+	searchNotificationAvailable = `
+		SELECT id, name, created_at, notified_at, deleted_at
+		FROM Vulnerability_Notification
+		WHERE (notified_at IS NULL OR notified_at < ?1)
+			AND deleted_at IS NULL
+		ORDER BY RANDOM()`
+
+	searchNotification = `
+		SELECT id, name, created_at, notified_at, deleted_at, old_vulnerability_id, new_vulnerability_id
+		FROM Vulnerability_Notification
+		WHERE name = ?1`
+
+	searchNotificationLayerIntroducingVulnerability = `
+		SELECT DISTINCT l.id, l.name
+		FROM Vulnerability_Affects_FeatureVersion vafv, Layer_diff_FeatureVersion ldfv, Layer l
+		WHERE l.id >= ?2
+			AND vafv.vulnerability_id = ?1
+			AND ldfv.featureversion_id = vafv.featureversion_id
+			AND ldfv.modification = 'add'
+			AND ldfv.layer_id = l.id
+		ORDER BY l.id
+		LIMIT ?3`
+
+	// statistics.go
+	countStatistics = `
+		SELECT
+			(SELECT COUNT(*) FROM Layer),
+			(SELECT COUNT(*) FROM Feature),
+			(SELECT COUNT(*) FROM FeatureVersion),
+			(SELECT COUNT(*) FROM Vulnerability WHERE deleted_at IS NULL),
+			(SELECT COUNT(*) FROM Vulnerability_Notification WHERE notified_at IS NULL AND deleted_at IS NULL)`
+)
+
+// namedQueries lists, by name, every statement that is prepared against the database when it is
+// opened, so invalid queries are detected at startup rather than the first time they are used.
+// The migrations themselves are not listed.
+var namedQueries = map[string]string{
+	"affectedLayersBase+countAffectedLayers":  affectedLayersBase + countAffectedLayers,
+	"affectedLayersBase+searchAffectedLayers": affectedLayersBase + searchAffectedLayers,
+	"countLayer":                                      countLayer,
+	"countStatistics":                                 countStatistics,
+	"countVulnerabilityByNamespace":                   countVulnerabilityByNamespace,
+	"insertFeature":                                   insertFeature,
+	"insertFeatureVersion":                            insertFeatureVersion,
+	"insertKeyValue":                                  insertKeyValue,
+	"insertLayer":                                     insertLayer,
+	"insertLayerDetector":                             insertLayerDetector,
+	"insertLayerDiffFeatureVersion":                   insertLayerDiffFeatureVersion,
+	"insertLayerNamespace":                            insertLayerNamespace,
+	"insertMigration":                                 insertMigration,
+	"insertNamespace":                                 insertNamespace,
+	"insertNotification":                              insertNotification,
+	"insertVulnerability":                             insertVulnerability,
+	"insertVulnerabilityAffectsFeatureVersion":        insertVulnerabilityAffectsFeatureVersion,
+	"insertVulnerabilityFixedInFeature":               insertVulnerabilityFixedInFeature,
+	"insertVulnerabilityHistory":                      insertVulnerabilityHistory,
+	"listLayer":                                       listLayer,
+	"listLayerMissingDetector":                        listLayerMissingDetector,
+	"listOutdatedLayer":                               listOutdatedLayer,
+	"listNamespace":                                   listNamespace,
+	"removeLayer":                                     removeLayer,
+	"removeLayerDetector":                             removeLayerDetector,
+	"removeLayerDiffFeatureVersion":                   removeLayerDiffFeatureVersion,
+	"removeLayerNamespace":                            removeLayerNamespace,
+	"removeNotification":                              removeNotification,
+	"removeVulnerability":                             removeVulnerability,
+	"removeVulnerabilityHistoryOldest":                removeVulnerabilityHistoryOldest,
+	"searchFeature":                                   searchFeature,
+	"searchFeatureVersion":                            searchFeatureVersion,
+	"searchFeatureVersionByFeature":                   searchFeatureVersionByFeature,
+	"searchFeatureVersionVulnerability":               searchFeatureVersionVulnerability,
+	"searchKeyValue":                                  searchKeyValue,
+	"searchLastVulnerabilityChange":                   searchLastVulnerabilityChange,
+	"searchLayer":                                     searchLayer,
+	"searchLayerChildren":                             searchLayerChildren,
+	"searchLayerDescendants":                          searchLayerDescendants,
+	"searchLayerDetector":                             searchLayerDetector,
+	"searchLayerExists":                               searchLayerExists,
+	"searchLayerFeatureVersion":                       searchLayerFeatureVersion,
+	"searchLayerNamespace":                            searchLayerNamespace,
+	"searchMigrationVersion":                          searchMigrationVersion,
+	"searchNamespace":                                 searchNamespace,
+	"searchNotification":                              searchNotification,
+	"searchNotificationAvailable":                     searchNotificationAvailable,
+	"searchNotificationLayerIntroducingVulnerability": searchNotificationLayerIntroducingVulnerability,
+	"searchVulnerabilityBase+searchVulnerabilityByID": searchVulnerabilityBase + searchVulnerabilityByID,
+	"searchVulnerabilityBase+searchVulnerabilityByNamespace":        searchVulnerabilityBase + searchVulnerabilityByNamespace,
+	"searchVulnerabilityBase+searchVulnerabilityByNamespaceAndName": searchVulnerabilityBase + searchVulnerabilityByNamespaceAndName,
+	"searchVulnerabilityFixedIn":                                    searchVulnerabilityFixedIn,
+	"searchVulnerabilityFixedInFeature":                             searchVulnerabilityFixedInFeature,
+	"searchVulnerabilityHistory":                                    searchVulnerabilityHistory,
+	"searchVulnerabilityID":                                         searchVulnerabilityID,
+	"swapKeyValue":                                                  swapKeyValue,
+	"upsertKeyValue":                                                upsertKeyValue,
+	"updateLayer":                                                   updateLayer,
+	"updateLayerStale":                                              updateLayerStale,
+	"updateNamespaceVersionFormat":                                  updateNamespaceVersionFormat,
+	"updatedNotificationNotified":                                   updatedNotificationNotified,
+}
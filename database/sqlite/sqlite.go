@@ -0,0 +1,384 @@
+// Copyright 2015 clair authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package sqlite implements database.Datastore with SQLite, for single-node and air-gapped
+// deployments.
+//
+// SQLite only allows a single writer at a time, thus every operation that writes to the database
+// is serialized behind a mutex, while reads may run concurrently. Locks are not stored in the
+// database but are kept in memory: they only guard against concurrent holders within the same
+// process, which is why a database must not be shared by several Clair instances.
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/pkg/capnslog"
+	"github.com/mattn/go-sqlite3"
+	"github.com/prometheus/client_golang/prometheus"
+	"gopkg.in/yaml.v2"
+
+	"github.com/coreos/clair/config"
+	"github.com/coreos/clair/database"
+	"github.com/coreos/clair/utils"
+	cerrors "github.com/coreos/clair/utils/errors"
+)
+
+const (
+	// driverName is the name of the database/sql driver that opens SQLite connections with
+	// foreign keys enforced.
+	driverName = "sqlite3_clair"
+
+	// busyTimeout is how long a statement waits for the database to be unlocked, e.g. by a
+	// checkpoint, before failing.
+	busyTimeout = 5 * time.Second
+)
+
+var (
+	log = capnslog.NewPackageLogger("github.com/coreos/clair", "sqlite")
+
+	promErrorsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "clair_sqlite_errors_total",
+		Help: "Number of errors that SQLite requests generated.",
+	}, []string{"request"})
+
+	promUnknownSeveritiesTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "clair_sqlite_unknown_severities_total",
+		Help: "Number of vulnerabilities whose unknown Severity has been stored as Unknown.",
+	})
+
+	promQueryDurationMilliseconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "clair_sqlite_query_duration_milliseconds",
+		Help: "Time it takes to execute the database query.",
+	}, []string{"query", "subquery"})
+
+	promNamedQueryDurationMilliseconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "clair_sqlite_named_query_duration_milliseconds",
+		Help: "Time it takes to execute a single SQL query.",
+	}, []string{"query"})
+
+	promNamedQueryErrorsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "clair_sqlite_named_query_errors_total",
+		Help: "Number of errors that a single SQL query generated.",
+	}, []string{"query"})
+
+	promWriteLockWaitMilliseconds = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name: "clair_sqlite_write_lock_wait_milliseconds",
+		Help: "Time writing operations wait for the previous ones to complete.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(promErrorsTotal)
+	prometheus.MustRegister(promUnknownSeveritiesTotal)
+	prometheus.MustRegister(promQueryDurationMilliseconds)
+	prometheus.MustRegister(promNamedQueryDurationMilliseconds)
+	prometheus.MustRegister(promNamedQueryErrorsTotal)
+	prometheus.MustRegister(promWriteLockWaitMilliseconds)
+
+	sql.Register(driverName, &sqlite3.SQLiteDriver{
+		ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+			// Foreign keys are disabled by default, for every new connection.
+			_, err := conn.Exec("PRAGMA foreign_keys = ON", nil)
+			return err
+		},
+	})
+
+	database.Register("sqlite", openDatabase)
+}
+
+// Queryer is implemented by both *sql.DB and *sql.Tx.
+type Queryer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+type sqlite struct {
+	*sql.DB
+	config Config
+
+	// writeLock serializes the operations that write to the database.
+	writeLock sync.Mutex
+
+	// locks holds the process-local locks, see Lock.
+	locks     map[string]lock
+	locksLock sync.Mutex
+}
+
+// Close closes the database.
+func (sqlite *sqlite) Close() {
+	if sqlite.DB != nil {
+		sqlite.DB.Close()
+	}
+}
+
+// Ping verifies that the database file can be opened and read.
+func (sqlite *sqlite) Ping(ctx context.Context) error {
+	if err := sqlite.DB.PingContext(ctx); err != nil {
+		return err
+	}
+
+	var one int
+	return sqlite.DB.QueryRowContext(ctx, "SELECT 1").Scan(&one)
+}
+
+// Config is the configuration that is used by openDatabase.
+type Config struct {
+	// Path is the path of the database file, which is created if it doesn't exist.
+	Path string
+
+	// ForceIncompatibleSchema allows opening a database whose schema is newer than the one of this
+	// binary, without running any migration. It is only meant for emergency inspection and the
+	// database must not be written to.
+	ForceIncompatibleSchema bool
+
+	// MaxLayerTreeDepth is the maximum number of layers that can be stacked on top of each other.
+	// The deeper layers are rejected, and so are the ancestries that are found to be deeper.
+	MaxLayerTreeDepth int
+}
+
+// openDatabase opens a SQLite-backed Datastore using the given configuration.
+// It immediately runs every necessary migrations.
+func openDatabase(registrableComponentConfig config.RegistrableComponentConfig) (database.Datastore, error) {
+	var sqlite sqlite
+	var err error
+
+	// Parse configuration.
+	sqlite.config = Config{MaxLayerTreeDepth: database.DefaultMaxLayerTreeDepth}
+	bytes, err := yaml.Marshal(registrableComponentConfig.Options)
+	if err != nil {
+		return nil, fmt.Errorf("sqlite: could not load configuration: %v", err)
+	}
+	err = yaml.Unmarshal(bytes, &sqlite.config)
+	if err != nil {
+		return nil, fmt.Errorf("sqlite: could not load configuration: %v", err)
+	}
+
+	if sqlite.config.Path == "" {
+		return nil, cerrors.NewBadRequestError("sqlite: no database path specified")
+	}
+	if sqlite.config.Path == ":memory:" || strings.ContainsRune(sqlite.config.Path, '?') {
+		// Every connection of the pool would get its own in-memory database, and the parameters
+		// of the connections are given after a question mark.
+		return nil, cerrors.NewBadRequestError("sqlite: the database path must be a file path")
+	}
+	if sqlite.config.MaxLayerTreeDepth <= 0 {
+		return nil, cerrors.NewBadRequestError("sqlite: the maximum layer tree depth must be positive")
+	}
+
+	// Open database.
+	// Every transaction writes, so it takes the write lock immediately instead of failing when
+	// trying to upgrade a read lock.
+	source := sqlite.config.Path + "?" + url.Values{
+		"_busy_timeout": {fmt.Sprint(int64(busyTimeout / time.Millisecond))},
+		"_txlock":       {"immediate"},
+	}.Encode()
+
+	sqlite.DB, err = sql.Open(driverName, source)
+	if err != nil {
+		return nil, fmt.Errorf("sqlite: could not open database: %v", err)
+	}
+
+	// Write-ahead logging lets reads proceed while a write is in progress.
+	if _, err := sqlite.DB.Exec("PRAGMA journal_mode = WAL"); err != nil {
+		sqlite.Close()
+		return nil, fmt.Errorf("sqlite: could not open database: %v", err)
+	}
+
+	// Run migrations, and verify that the queries match the schema.
+	ctx := context.Background()
+	if err := sqlite.migrate(ctx); err != nil {
+		if _, incompatible := err.(*database.ErrIncompatibleSchema); !incompatible || !sqlite.config.ForceIncompatibleSchema {
+			sqlite.Close()
+			return nil, err
+		}
+		log.Warningf("sqlite: %s, forcing startup without running migrations: the database must not be written to", err)
+	} else if err := sqlite.validateQueries(ctx); err != nil {
+		sqlite.Close()
+		return nil, err
+	}
+
+	sqlite.locks = make(map[string]lock)
+
+	return &sqlite, nil
+}
+
+// validateQueries prepares every named query against the database, failing on the first query
+// that SQLite refuses.
+func (sqlite *sqlite) validateQueries(ctx context.Context) error {
+	names := make([]string, 0, len(namedQueries))
+	for name := range namedQueries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		stmt, err := sqlite.PrepareContext(ctx, namedQueries[name])
+		if err != nil {
+			return fmt.Errorf("sqlite: query %s is invalid: %v", name, err)
+		}
+		stmt.Close()
+	}
+
+	return nil
+}
+
+// withTransaction runs fn in a transaction, which is committed if fn succeeds or rolled back
+// otherwise. Transactions are serialized, as SQLite only allows a single writer at a time.
+//
+// Errors are returned unchanged, and it is up to the caller to handle them.
+func (sqlite *sqlite) withTransaction(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	t := time.Now()
+	sqlite.writeLock.Lock()
+	defer sqlite.writeLock.Unlock()
+	utils.PrometheusObserveTimeMilliseconds(promWriteLockWaitMilliseconds, t)
+
+	tx, err := sqlite.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	if err = fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// now returns the current time in UTC. Timestamps are stored as text by SQLite, they must all use
+// the same time zone for comparisons to be meaningful.
+func now() time.Time {
+	return time.Now().UTC()
+}
+
+// handleError logs an error with an extra description and masks the error if it's an SQL one.
+// This ensures we never return plain SQL errors and leak anything.
+// SQLite errors are translated into the database package's errors: unique violations become
+// ErrAlreadyExists, foreign key violations become ErrInconsistent and any other error becomes
+// ErrBackendException.
+// If the context has been canceled or its deadline exceeded, the context's error is returned
+// instead as the query has most likely been aborted because of it.
+func handleError(ctx context.Context, desc string, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	switch err {
+	case sql.ErrNoRows:
+		return cerrors.ErrNotFound
+	case cerrors.ErrNotFound, database.ErrBackendException, database.ErrAlreadyExists, database.ErrInconsistent,
+		database.ErrLayerHasChildren:
+		// The error has already been handled.
+		return err
+	}
+
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		log.Debugf("%s: %v (%v)", desc, ctxErr, err)
+		return ctxErr
+	}
+
+	if _, ok := err.(*cerrors.ErrBadRequest); ok {
+		return err
+	}
+	if _, ok := err.(*database.ErrLayerTreeTooDeep); ok {
+		return err
+	}
+
+	log.Errorf("%s: %v", desc, err)
+	promErrorsTotal.WithLabelValues(desc).Inc()
+
+	if sqliteErr, ok := err.(sqlite3.Error); ok {
+		switch sqliteErr.ExtendedCode {
+		case sqlite3.ErrConstraintUnique, sqlite3.ErrConstraintPrimaryKey:
+			return database.ErrAlreadyExists
+		case sqlite3.ErrConstraintForeignKey:
+			return database.ErrInconsistent
+		}
+		return database.ErrBackendException
+	}
+
+	if err == driver.ErrBadConn || err == sql.ErrTxDone || strings.HasPrefix(err.Error(), "sql:") {
+		return database.ErrBackendException
+	}
+
+	return err
+}
+
+// isErrUniqueViolation determines is the given error is a unique contraint violation.
+func isErrUniqueViolation(err error) bool {
+	sqliteErr, ok := err.(sqlite3.Error)
+	return ok && sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique
+}
+
+func observeQueryTime(query, subquery string, start time.Time) {
+	utils.PrometheusObserveTimeMilliseconds(promQueryDurationMilliseconds.WithLabelValues(query, subquery), start)
+}
+
+// namedExec, namedQuery and namedQueryRow execute a query using the given Queryer, and record its
+// duration and whether it failed in Prometheus, under the specified name. The name should be the
+// name of the query's constant.
+func namedExec(ctx context.Context, queryer Queryer, name, query string, args ...interface{}) (sql.Result, error) {
+	defer observeNamedQueryTime(name, time.Now())
+
+	result, err := queryer.ExecContext(ctx, query, args...)
+	observeNamedQueryError(name, err)
+	return result, err
+}
+
+func namedQuery(ctx context.Context, queryer Queryer, name, query string, args ...interface{}) (*sql.Rows, error) {
+	defer observeNamedQueryTime(name, time.Now())
+
+	rows, err := queryer.QueryContext(ctx, query, args...)
+	observeNamedQueryError(name, err)
+	return rows, err
+}
+
+func namedQueryRow(ctx context.Context, queryer Queryer, name, query string, args ...interface{}) *sql.Row {
+	defer observeNamedQueryTime(name, time.Now())
+
+	row := queryer.QueryRowContext(ctx, query, args...)
+	observeNamedQueryError(name, row.Err())
+	return row
+}
+
+// namedInsert executes an INSERT query like namedExec and returns the ID of the inserted row.
+func namedInsert(ctx context.Context, queryer Queryer, name, query string, args ...interface{}) (int, error) {
+	result, err := namedExec(ctx, queryer, name, query, args...)
+	if err != nil {
+		return 0, err
+	}
+
+	id, err := result.LastInsertId()
+	return int(id), err
+}
+
+func observeNamedQueryTime(name string, start time.Time) {
+	utils.PrometheusObserveTimeMilliseconds(promNamedQueryDurationMilliseconds.WithLabelValues(name), start)
+}
+
+func observeNamedQueryError(name string, err error) {
+	if err != nil {
+		promNamedQueryErrorsTotal.WithLabelValues(name).Inc()
+	}
+}
@@ -0,0 +1,348 @@
+// Copyright 2015 clair authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/coreos/clair/config"
+	"github.com/coreos/clair/database"
+	"github.com/coreos/clair/database/dbtest"
+	"github.com/coreos/clair/utils/types"
+)
+
+func openDatabaseForTest(t *testing.T, path string) database.Datastore {
+	datastore, err := openDatabase(config.RegistrableComponentConfig{
+		Type:    "sqlite",
+		Options: map[string]interface{}{"path": path},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return datastore
+}
+
+// openDatabaseAtVersionForTest creates a database on which only the migrations up to the given
+// version ran, so that the following ones can be tested on existing data.
+func openDatabaseAtVersionForTest(t *testing.T, path string, version int) *sql.DB {
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	if _, err = db.ExecContext(ctx, bootstrapMigrations); err != nil {
+		t.Fatal(err)
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range migrations {
+		if m.version > version {
+			break
+		}
+		if err = runMigration(ctx, tx, m); err != nil {
+			tx.Rollback()
+			t.Fatal(err)
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	return db
+}
+
+func TestDatastore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "clair-sqlite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Every datastore gets its own file, even when a test opens several of them.
+	var opened int
+	dbtest.Run(t, func(t *testing.T) database.Datastore {
+		opened++
+		return openDatabaseForTest(t, filepath.Join(dir, fmt.Sprintf("%s-%d.db", filepath.Base(t.Name()), opened)))
+	})
+}
+
+func TestPing(t *testing.T) {
+	dir, err := ioutil.TempDir("", "clair-sqlite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	datastore := openDatabaseForTest(t, filepath.Join(dir, "clair.db"))
+	assert.Nil(t, datastore.Ping(context.Background()))
+
+	datastore.Close()
+	assert.NotNil(t, datastore.Ping(context.Background()))
+}
+
+func TestOpenDatabase(t *testing.T) {
+	for _, path := range []string{"", ":memory:", "clair.db?mode=ro"} {
+		_, err := openDatabase(config.RegistrableComponentConfig{
+			Type:    "sqlite",
+			Options: map[string]interface{}{"path": path},
+		})
+		assert.NotNil(t, err, "path %q should be rejected", path)
+	}
+
+	dir, err := ioutil.TempDir("", "clair-sqlite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Opening an existing database doesn't run the migrations again.
+	path := filepath.Join(dir, "clair.db")
+	openDatabaseForTest(t, path).Close()
+
+	datastore := openDatabaseForTest(t, path)
+	defer datastore.Close()
+
+	version, err := schemaVersion(context.Background(), datastore.(*sqlite))
+	assert.Nil(t, err)
+	assert.Equal(t, migrations[len(migrations)-1].version, version)
+}
+
+func TestOpenNewerDatabase(t *testing.T) {
+	dir, err := ioutil.TempDir("", "clair-sqlite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Simulate a database migrated by a newer binary.
+	path := filepath.Join(dir, "clair.db")
+	latest := migrations[len(migrations)-1].version
+	db := openDatabaseAtVersionForTest(t, path, latest)
+	_, err = db.Exec(insertMigration, latest+1, "Newer", now())
+	assert.Nil(t, err)
+	db.Close()
+
+	// It is refused, unless forced.
+	_, err = openDatabase(config.RegistrableComponentConfig{
+		Type:    "sqlite",
+		Options: map[string]interface{}{"path": path},
+	})
+	if assert.IsType(t, &database.ErrIncompatibleSchema{}, err) {
+		assert.Equal(t, latest+1, err.(*database.ErrIncompatibleSchema).Found)
+		assert.Equal(t, latest, err.(*database.ErrIncompatibleSchema).Expected)
+		assert.Equal(t, database.ErrCantOpen, err.(*database.ErrIncompatibleSchema).Unwrap())
+	}
+
+	datastore, err := openDatabase(config.RegistrableComponentConfig{
+		Type:    "sqlite",
+		Options: map[string]interface{}{"path": path, "forceincompatibleschema": true},
+	})
+	if assert.Nil(t, err) {
+		version, err := schemaVersion(context.Background(), datastore.(*sqlite))
+		assert.Nil(t, err)
+		assert.Equal(t, latest+1, version)
+		datastore.Close()
+	}
+}
+
+func TestLayerTreeDepth(t *testing.T) {
+	dir, err := ioutil.TempDir("", "clair-sqlite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Store a chain that is deeper than the default limit.
+	path := filepath.Join(dir, "clair.db")
+	deep, err := openDatabase(config.RegistrableComponentConfig{
+		Type:    "sqlite",
+		Options: map[string]interface{}{"path": path, "maxlayertreedepth": 200},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	layers := make([]database.Layer, 200)
+	for i := range layers {
+		layers[i] = database.Layer{Name: fmt.Sprintf("layer-%d", i), EngineVersion: 1}
+		if i > 0 {
+			layers[i].Parent = &layers[i-1]
+		}
+	}
+	err = deep.InsertLayers(context.Background(), layers)
+	deep.Close()
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	datastore := openDatabaseForTest(t, path).(*sqlite)
+	defer datastore.Close()
+	ctx := context.Background()
+
+	// The ancestry of the top layer isn't walked beyond the limit.
+	_, err = datastore.FindLayer(ctx, "layer-199", true, false, types.Unknown)
+	assert.IsType(t, &database.ErrLayerTreeTooDeep{}, err)
+	_, _, err = datastore.GetLayerDiff(ctx, "layer-199")
+	assert.IsType(t, &database.ErrLayerTreeTooDeep{}, err)
+	_, err = datastore.FindLayer(ctx, "layer-199", false, false, types.Unknown)
+	assert.Nil(t, err)
+
+	layer, err := datastore.FindLayer(ctx, "layer-126", true, false, types.Unknown)
+	if assert.Nil(t, err) {
+		assert.Equal(t, 127, layer.Depth)
+	}
+
+	// A cycle, which can only be manufactured, is an inconsistency.
+	_, err = datastore.Exec(`UPDATE Layer SET parent_id = (SELECT id FROM Layer WHERE name = 'layer-9') WHERE name = 'layer-0'`)
+	if !assert.Nil(t, err) {
+		return
+	}
+	_, err = datastore.FindLayer(ctx, "layer-5", true, false, types.Unknown)
+	assert.Equal(t, database.ErrInconsistent, err)
+	_, err = datastore.FindLayer(ctx, "layer-150", true, false, types.Unknown)
+	assert.IsType(t, &database.ErrLayerTreeTooDeep{}, err)
+}
+
+func TestLegacyLayerName(t *testing.T) {
+	dir, err := ioutil.TempDir("", "clair-sqlite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	datastore := openDatabaseForTest(t, filepath.Join(dir, "clair.db")).(*sqlite)
+	defer datastore.Close()
+	ctx := context.Background()
+
+	// A layer stored before the names were verified can still be read and analyzed again.
+	_, err = datastore.Exec(`INSERT INTO Layer(name, engineversion, created_at) VALUES('library/debian', 1, ?1)`, now())
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Nil(t, datastore.InsertLayer(ctx, database.Layer{Name: "library/debian", EngineVersion: 2}))
+
+	layer, err := datastore.FindLayer(ctx, "library/debian", false, false, types.Unknown)
+	if assert.Nil(t, err) {
+		assert.Equal(t, 2, layer.EngineVersion)
+	}
+}
+
+func TestMigrationSeverityOrdering(t *testing.T) {
+	dir, err := ioutil.TempDir("", "clair-sqlite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Store severities that are not spelled like types.Priorities, as before the migration.
+	path := filepath.Join(dir, "clair.db")
+	db := openDatabaseAtVersionForTest(t, path, 2)
+	for _, query := range []string{
+		`INSERT INTO Namespace(name) VALUES('debian:7')`,
+		`INSERT INTO Vulnerability(namespace_id, name, description, link, severity) VALUES(1, 'CVE-HIGH', '', '', 'HIGH'), (1, 'CVE-BOGUS', '', '', 'Bogus')`,
+	} {
+		_, err = db.Exec(query)
+		if !assert.Nil(t, err, query) {
+			return
+		}
+	}
+	db.Close()
+
+	datastore := openDatabaseForTest(t, path).(*sqlite)
+	defer datastore.Close()
+
+	for name, expected := range map[string]types.Priority{"CVE-HIGH": types.High, "CVE-BOGUS": types.Unknown} {
+		vulnerability, err := datastore.FindVulnerability(context.Background(), "debian:7", name)
+		if assert.Nil(t, err) {
+			assert.Equal(t, expected, vulnerability.Severity)
+		}
+	}
+}
+
+func TestMigrationNamespaceVersionFormat(t *testing.T) {
+	dir, err := ioutil.TempDir("", "clair-sqlite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Store namespaces without any version format, as before the migration.
+	path := filepath.Join(dir, "clair.db")
+	db := openDatabaseAtVersionForTest(t, path, 3)
+	_, err = db.Exec(`INSERT INTO Namespace(name) VALUES('debian:7'), ('centos:7'), ('alpine:v3.4'), ('unknown')`)
+	db.Close()
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	datastore := openDatabaseForTest(t, path).(*sqlite)
+	defer datastore.Close()
+
+	namespaces, err := datastore.ListNamespaces(context.Background())
+	if assert.Nil(t, err) {
+		assert.Len(t, namespaces, 4)
+		for _, namespace := range namespaces {
+			assert.Equal(t, database.VersionFormatsMapping[strings.Split(namespace.Name, ":")[0]], namespace.VersionFormat, namespace.Name)
+		}
+	}
+}
+
+func TestMigrationLayerNamespaces(t *testing.T) {
+	dir, err := ioutil.TempDir("", "clair-sqlite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Store a layer with a single namespace, as before the migration.
+	path := filepath.Join(dir, "clair.db")
+	db := openDatabaseAtVersionForTest(t, path, 4)
+	_, err = db.Exec(`INSERT INTO Namespace(id, name, version_format) VALUES(1, 'debian:7', 'dpkg')`)
+	if err == nil {
+		_, err = db.Exec(`INSERT INTO Layer(name, engineversion, namespace_id, created_at) VALUES('layer', 1, 1, ?1), ('blank', 1, NULL, ?1)`, now())
+	}
+	db.Close()
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	datastore := openDatabaseForTest(t, path).(*sqlite)
+	defer datastore.Close()
+
+	// The primary namespace of the layer has been recorded as its only one.
+	var layerName, namespaceName string
+	err = datastore.QueryRow(`SELECT l.name, n.name FROM Layer_Namespace ln JOIN Layer l ON ln.layer_id = l.id JOIN Namespace n ON ln.namespace_id = n.id`).
+		Scan(&layerName, &namespaceName)
+	if assert.Nil(t, err) {
+		assert.Equal(t, "layer", layerName)
+		assert.Equal(t, "debian:7", namespaceName)
+	}
+
+	layer, err := datastore.FindLayer(context.Background(), "layer", false, false, types.Unknown)
+	if assert.Nil(t, err) && assert.Len(t, layer.Namespaces, 1) {
+		assert.Equal(t, types.DpkgVersionFormat, layer.Namespaces[0].VersionFormat)
+	}
+}
@@ -0,0 +1,37 @@
+// Copyright 2015 clair authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite
+
+import (
+	"context"
+	"time"
+
+	"github.com/coreos/clair/database"
+)
+
+// GetStatistics counts the objects stored in the database. The counts are always exact, as SQLite
+// doesn't estimate the size of its tables.
+func (sqlite *sqlite) GetStatistics(ctx context.Context, exact bool) (database.Statistics, error) {
+	defer observeQueryTime("GetStatistics", "all", time.Now())
+
+	var s database.Statistics
+	err := namedQueryRow(ctx, sqlite, "countStatistics", countStatistics).
+		Scan(&s.Layers, &s.Features, &s.FeatureVersions, &s.Vulnerabilities, &s.PendingNotifications)
+	if err != nil {
+		return database.Statistics{}, handleError(ctx, "countStatistics", err)
+	}
+
+	return s, nil
+}
@@ -0,0 +1,676 @@
+// Copyright 2015 clair authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"reflect"
+	"time"
+
+	"github.com/coreos/clair/database"
+	"github.com/coreos/clair/utils"
+	cerrors "github.com/coreos/clair/utils/errors"
+	"github.com/coreos/clair/utils/types"
+	"github.com/guregu/null/zero"
+)
+
+func (sqlite *sqlite) ListVulnerabilities(ctx context.Context, namespaceName string, minSeverity types.Priority, limit int, startID int) ([]database.Vulnerability, int, error) {
+	defer observeQueryTime("listVulnerabilities", "all", time.Now())
+
+	// Query Namespace.
+	var id int
+	err := namedQueryRow(ctx, sqlite, "searchNamespace", searchNamespace, namespaceName).Scan(&id)
+	if err != nil {
+		return nil, -1, handleError(ctx, "searchNamespace", err)
+	}
+
+	// Query.
+	query := searchVulnerabilityBase + searchVulnerabilityByNamespace
+	rows, err := namedQuery(ctx, sqlite, "searchVulnerabilityBase+searchVulnerabilityByNamespace", query, namespaceName, startID, limit+1, minSeverity)
+	if err != nil {
+		return nil, -1, handleError(ctx, "searchVulnerabilityByNamespace", err)
+	}
+	defer rows.Close()
+
+	var vulns []database.Vulnerability
+	nextID := -1
+	size := 0
+	// Scan query.
+	for rows.Next() {
+		var vulnerability database.Vulnerability
+
+		err := rows.Scan(
+			&vulnerability.ID,
+			&vulnerability.Name,
+			&vulnerability.Namespace.ID,
+			&vulnerability.Namespace.Name,
+			&vulnerability.Description,
+			&vulnerability.Link,
+			(*linkList)(&vulnerability.Links),
+			&vulnerability.Severity,
+			&vulnerability.Metadata,
+		)
+		if err != nil {
+			return nil, -1, handleError(ctx, "searchVulnerabilityByNamespace.Scan()", err)
+		}
+		size++
+		if size > limit {
+			nextID = vulnerability.ID
+		} else {
+			vulns = append(vulns, vulnerability)
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, -1, handleError(ctx, "searchVulnerabilityByNamespace.Rows()", err)
+	}
+
+	return vulns, nextID, nil
+}
+
+func (sqlite *sqlite) FindVulnerability(ctx context.Context, namespaceName, name string) (database.Vulnerability, error) {
+	return findVulnerability(ctx, sqlite, namespaceName, name)
+}
+
+func findVulnerability(ctx context.Context, queryer Queryer, namespaceName, name string) (database.Vulnerability, error) {
+	defer observeQueryTime("findVulnerability", "all", time.Now())
+
+	queryName := "searchVulnerabilityBase+searchVulnerabilityByNamespaceAndName"
+	query := searchVulnerabilityBase + searchVulnerabilityByNamespaceAndName
+
+	return scanVulnerability(ctx, queryer, queryName, namedQueryRow(ctx, queryer, queryName, query, namespaceName, name))
+}
+
+func findVulnerabilityByIDWithDeleted(ctx context.Context, queryer Queryer, id int) (database.Vulnerability, error) {
+	defer observeQueryTime("findVulnerabilityByIDWithDeleted", "all", time.Now())
+
+	queryName := "searchVulnerabilityBase+searchVulnerabilityByID"
+	query := searchVulnerabilityBase + searchVulnerabilityByID
+
+	return scanVulnerability(ctx, queryer, queryName, namedQueryRow(ctx, queryer, queryName, query, id))
+}
+
+func scanVulnerability(ctx context.Context, queryer Queryer, queryName string, vulnerabilityRow *sql.Row) (database.Vulnerability, error) {
+	var vulnerability database.Vulnerability
+
+	err := vulnerabilityRow.Scan(
+		&vulnerability.ID,
+		&vulnerability.Name,
+		&vulnerability.Namespace.ID,
+		&vulnerability.Namespace.Name,
+		&vulnerability.Description,
+		&vulnerability.Link,
+		(*linkList)(&vulnerability.Links),
+		&vulnerability.Severity,
+		&vulnerability.Metadata,
+	)
+
+	if err != nil {
+		return vulnerability, handleError(ctx, queryName+".Scan()", err)
+	}
+
+	// Query the FixedIn FeatureVersion now.
+	rows, err := namedQuery(ctx, queryer, "searchVulnerabilityFixedIn", searchVulnerabilityFixedIn, vulnerability.ID)
+	if err != nil {
+		return vulnerability, handleError(ctx, "searchVulnerabilityFixedIn.Scan()", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var featureVersionID zero.Int
+		var featureVersionVersion types.Version
+		var featureVersionFeatureName zero.String
+
+		err := rows.Scan(
+			&featureVersionVersion,
+			&featureVersionID,
+			&featureVersionFeatureName,
+		)
+
+		if err != nil {
+			return vulnerability, handleError(ctx, "searchVulnerabilityFixedIn.Scan()", err)
+		}
+
+		if !featureVersionID.IsZero() {
+			// Note that the ID we fill in featureVersion is actually a Feature ID, and not
+			// a FeatureVersion ID.
+			featureVersion := database.FeatureVersion{
+				Model: database.Model{ID: int(featureVersionID.Int64)},
+				Feature: database.Feature{
+					Model:     database.Model{ID: int(featureVersionID.Int64)},
+					Namespace: vulnerability.Namespace,
+					Name:      featureVersionFeatureName.String,
+				},
+				Version: featureVersionVersion,
+			}
+			vulnerability.FixedIn = append(vulnerability.FixedIn, featureVersion)
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return vulnerability, handleError(ctx, "searchVulnerabilityFixedIn.Rows()", err)
+	}
+
+	return vulnerability, nil
+}
+
+// FixedIn.Namespace are not necessary, they are overwritten by the vuln.
+// By setting the fixed version to minVersion, we can say that the vuln does'nt affect anymore.
+func (sqlite *sqlite) InsertVulnerabilities(ctx context.Context, vulnerabilities []database.Vulnerability, generateNotifications bool) error {
+	for _, vulnerability := range vulnerabilities {
+		err := sqlite.insertVulnerability(ctx, vulnerability, nil, false, generateNotifications)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CreateVulnerability stores a new Vulnerability, or returns ErrAlreadyExists.
+func (sqlite *sqlite) CreateVulnerability(ctx context.Context, vulnerability database.Vulnerability, generateNotification bool) error {
+	return sqlite.insertVulnerability(ctx, vulnerability, nil, true, generateNotification)
+}
+
+// insertVulnerability inserts or updates the given Vulnerability. With an update, the Vulnerability
+// must exist and the update is applied to it. With create, it must not exist.
+func (sqlite *sqlite) insertVulnerability(ctx context.Context, vulnerability database.Vulnerability, update *database.VulnerabilityUpdate, create, generateNotification bool) error {
+	tf := time.Now()
+
+	// Verify parameters
+	if vulnerability.Name == "" || vulnerability.Namespace.Name == "" {
+		return cerrors.NewBadRequestError("insertVulnerability needs at least the Name and the Namespace")
+	}
+	if update != nil {
+		if update.Severity != nil && !update.Severity.IsValid() {
+			return cerrors.NewBadRequestError("could not update a vulnerability with an invalid Severity")
+		}
+	} else {
+		if vulnerability.Severity == "" {
+			msg := "could not insert a vulnerability that has no Severity"
+			log.Warning(msg)
+			return cerrors.NewBadRequestError(msg)
+		}
+
+		// Updaters may not spell the severities exactly like we do: unknown ones are stored as
+		// Unknown rather than failing the whole update.
+		severity, ok := types.NormalizePriority(vulnerability.Severity)
+		if !ok {
+			log.Warningf("vulnerability %s has an unknown Severity (%s), storing it as %s", vulnerability.Name, vulnerability.Severity, severity)
+			promUnknownSeveritiesTotal.Inc()
+		}
+		vulnerability.Severity = severity
+	}
+	for i := 0; i < len(vulnerability.FixedIn); i++ {
+		fifv := &vulnerability.FixedIn[i]
+
+		if fifv.Feature.Namespace.Name == "" {
+			// As there is no Namespace on that FixedIn FeatureVersion, set it to the Vulnerability's
+			// Namespace.
+			fifv.Feature.Namespace.Name = vulnerability.Namespace.Name
+		} else if fifv.Feature.Namespace.Name != vulnerability.Namespace.Name {
+			msg := "could not insert an invalid vulnerability that contains FixedIn FeatureVersion that are not in the same namespace as the Vulnerability"
+			log.Warning(msg)
+			return cerrors.NewBadRequestError(msg)
+		}
+	}
+
+	// We do `defer observeQueryTime` here because we don't want to observe invalid vulnerabilities.
+	defer observeQueryTime("insertVulnerability", "all", tf)
+
+	err := sqlite.withTransaction(ctx, func(tx *sql.Tx) error {
+		// Find existing vulnerability and its Vulnerability_FixedIn_Features.
+		existingVulnerability, err := findVulnerability(ctx, tx, vulnerability.Namespace.Name, vulnerability.Name)
+		if err != nil && err != cerrors.ErrNotFound {
+			return err
+		}
+		if create && existingVulnerability.ID != 0 {
+			return database.ErrAlreadyExists
+		}
+
+		if update != nil {
+			// Because this call updates an existing vulnerability, import all the data that is not
+			// updated from the existing one.
+			if existingVulnerability.ID == 0 {
+				return cerrors.ErrNotFound
+			}
+
+			fixedIn := vulnerability.FixedIn
+			vulnerability = existingVulnerability
+			vulnerability.FixedIn = fixedIn
+			update.Apply(&vulnerability)
+		}
+
+		if existingVulnerability.ID != 0 {
+			// Merge the metadata, so the sources that are not specified keep their data.
+			vulnerability.Metadata = mergeMetadata(existingVulnerability.Metadata, vulnerability.Metadata)
+
+			// Merge the links, so the references given by every source are kept.
+			if vulnerability.Link == "" {
+				vulnerability.Link = existingVulnerability.Link
+			}
+			vulnerability.Links = mergeLinks(vulnerability.Link, existingVulnerability.Links, vulnerability.Links)
+
+			updateMetadata := vulnerability.Description != existingVulnerability.Description ||
+				vulnerability.Link != existingVulnerability.Link ||
+				!reflect.DeepEqual(vulnerability.Links, existingVulnerability.Links) ||
+				vulnerability.Severity != existingVulnerability.Severity ||
+				!reflect.DeepEqual(castMetadata(vulnerability.Metadata), existingVulnerability.Metadata)
+
+			// Construct the entire list of FixedIn FeatureVersion, by using the
+			// the FixedIn list of the old vulnerability.
+			var updateFixedIn bool
+			vulnerability.FixedIn, updateFixedIn = applyFixedInDiff(existingVulnerability.FixedIn, vulnerability.FixedIn)
+
+			if !updateMetadata && !updateFixedIn {
+				return nil
+			}
+
+			// Mark the old vulnerability as non latest.
+			_, err = namedExec(ctx, tx, "removeVulnerability", removeVulnerability, existingVulnerability.ID, now())
+			if err != nil {
+				return handleError(ctx, "removeVulnerability", err)
+			}
+		} else {
+			// The vulnerability is new, we don't want to have any types.MinVersion as they are only used
+			// for diffing existing vulnerabilities.
+			var fixedIn []database.FeatureVersion
+			for _, fv := range vulnerability.FixedIn {
+				if fv.Version != types.MinVersion {
+					fixedIn = append(fixedIn, fv)
+				}
+			}
+			vulnerability.FixedIn = fixedIn
+
+			vulnerability.Links = mergeLinks(vulnerability.Link, vulnerability.Links)
+		}
+
+		// Find or insert Vulnerability's Namespace.
+		namespaceID, err := sqlite.insertNamespace(ctx, tx, vulnerability.Namespace)
+		if err != nil {
+			return err
+		}
+
+		// Insert vulnerability.
+		vulnerability.ID, err = namedInsert(ctx, tx, "insertVulnerability",
+			insertVulnerability,
+			namespaceID,
+			vulnerability.Name,
+			vulnerability.Description,
+			vulnerability.Link,
+			linkList(vulnerability.Links),
+			&vulnerability.Severity,
+			&vulnerability.Metadata,
+			now(),
+		)
+		if err != nil {
+			return handleError(ctx, "insertVulnerability", err)
+		}
+
+		// Update Vulnerability_FixedIn_Feature and Vulnerability_Affects_FeatureVersion now.
+		err = sqlite.insertVulnerabilityFixedInFeatureVersions(ctx, tx, vulnerability.ID, vulnerability.FixedIn)
+		if err != nil {
+			return err
+		}
+
+		// Record the changes in the history of the vulnerability.
+		if existingVulnerability.ID != 0 {
+			err = recordVulnerabilityHistory(ctx, tx, namespaceID, existingVulnerability, vulnerability)
+			if err != nil {
+				return err
+			}
+		}
+
+		// Create a notification.
+		if generateNotification {
+			return createNotification(ctx, tx, existingVulnerability.ID, vulnerability.ID)
+		}
+
+		return nil
+	})
+
+	return handleError(ctx, "insertVulnerability", err)
+}
+
+// castMetadata marshals the given database.MetadataMap and unmarshals it again to make sure that
+// everything has the interface{} type.
+// It is required when comparing crafted MetadataMap against MetadataMap that we get from the
+// database.
+func castMetadata(m database.MetadataMap) database.MetadataMap {
+	c := make(database.MetadataMap)
+	j, _ := json.Marshal(m)
+	json.Unmarshal(j, &c)
+	return c
+}
+
+// mergeMetadata returns the metadata that results from updating the given current metadata.
+// Metadata are keyed by source name: the update replaces entirely the data of the sources it
+// specifies, a nil value removing the source, and leaves the other sources untouched.
+func mergeMetadata(current, update database.MetadataMap) database.MetadataMap {
+	if len(update) == 0 {
+		return current
+	}
+
+	merged := make(database.MetadataMap, len(current)+len(update))
+	for source, data := range current {
+		merged[source] = data
+	}
+	for source, data := range update {
+		if data == nil {
+			delete(merged, source)
+		} else {
+			merged[source] = data
+		}
+	}
+
+	if len(merged) == 0 && current == nil {
+		return nil
+	}
+	return merged
+}
+
+// mergeLinks returns the union of the given lists of links, starting with the primary link.
+// Duplicates and empty links are removed.
+func mergeLinks(primary string, lists ...[]string) []string {
+	var merged []string
+	seen := make(map[string]struct{})
+
+	add := func(link string) {
+		if _, ok := seen[link]; link == "" || ok {
+			return
+		}
+		seen[link] = struct{}{}
+		merged = append(merged, link)
+	}
+
+	add(primary)
+	for _, list := range lists {
+		for _, link := range list {
+			add(link)
+		}
+	}
+
+	return merged
+}
+
+// linkList stores a list of links as a JSON array.
+type linkList []string
+
+func (l *linkList) Scan(value interface{}) error {
+	val, ok := value.([]byte)
+	if !ok {
+		*l = nil
+		return nil
+	}
+	return json.Unmarshal(val, l)
+}
+
+func (l linkList) Value() (driver.Value, error) {
+	if len(l) == 0 {
+		return nil, nil
+	}
+	j, err := json.Marshal([]string(l))
+	return string(j), err
+}
+
+// applyFixedInDiff applies a FeatureVersion diff on a FeatureVersion list and returns the result.
+func applyFixedInDiff(currentList, diff []database.FeatureVersion) ([]database.FeatureVersion, bool) {
+	currentMap, currentNames := createFeatureVersionNameMap(currentList)
+	diffMap, diffNames := createFeatureVersionNameMap(diff)
+
+	addedNames := utils.CompareStringLists(diffNames, currentNames)
+	inBothNames := utils.CompareStringListsInBoth(diffNames, currentNames)
+
+	different := false
+
+	for _, name := range addedNames {
+		if diffMap[name].Version == types.MinVersion {
+			// MinVersion only makes sense when a Feature is already fixed in some version,
+			// in which case we would be in the "inBothNames".
+			continue
+		}
+
+		currentMap[name] = diffMap[name]
+		different = true
+	}
+
+	for _, name := range inBothNames {
+		fv := diffMap[name]
+
+		if fv.Version == types.MinVersion {
+			// MinVersion means that the Feature doesn't affect the Vulnerability anymore.
+			delete(currentMap, name)
+			different = true
+		} else if fv.Version != currentMap[name].Version {
+			// The version got updated.
+			currentMap[name] = diffMap[name]
+			different = true
+		}
+	}
+
+	// Convert currentMap to a slice and return it.
+	var newList []database.FeatureVersion
+	for _, fv := range currentMap {
+		newList = append(newList, fv)
+	}
+
+	return newList, different
+}
+
+func createFeatureVersionNameMap(features []database.FeatureVersion) (map[string]database.FeatureVersion, []string) {
+	m := make(map[string]database.FeatureVersion, 0)
+	s := make([]string, 0, len(features))
+
+	for i := 0; i < len(features); i++ {
+		featureVersion := features[i]
+		m[featureVersion.Feature.Name] = featureVersion
+		s = append(s, featureVersion.Feature.Name)
+	}
+
+	return m, s
+}
+
+// insertVulnerabilityFixedInFeatureVersions populates Vulnerability_FixedIn_Feature for the given
+// vulnerability with the specified database.FeatureVersion list and uses
+// linkVulnerabilityToFeatureVersions to propagate the changes on Vulnerability_FixedIn_Feature to
+// Vulnerability_Affects_FeatureVersion.
+func (sqlite *sqlite) insertVulnerabilityFixedInFeatureVersions(ctx context.Context, tx *sql.Tx, vulnerabilityID int, fixedIn []database.FeatureVersion) error {
+	defer observeQueryTime("insertVulnerabilityFixedInFeatureVersions", "all", time.Now())
+
+	for _, fv := range fixedIn {
+		// Insert or find the Feature.
+		featureID, err := sqlite.insertFeature(ctx, tx, fv.Feature)
+		if err != nil {
+			return err
+		}
+
+		// Insert Vulnerability_FixedIn_Feature.
+		fixedInID, err := namedInsert(ctx, tx, "insertVulnerabilityFixedInFeature",
+			insertVulnerabilityFixedInFeature, vulnerabilityID, featureID, &fv.Version)
+		if err != nil {
+			return handleError(ctx, "insertVulnerabilityFixedInFeature", err)
+		}
+
+		// Insert Vulnerability_Affects_FeatureVersion.
+		err = linkVulnerabilityToFeatureVersions(ctx, tx, fixedInID, vulnerabilityID, featureID, fv.Version)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func linkVulnerabilityToFeatureVersions(ctx context.Context, tx *sql.Tx, fixedInID, vulnerabilityID, featureID int, fixedInVersion types.Version) error {
+	// Find every FeatureVersions of the Feature that the vulnerability affects.
+	rows, err := namedQuery(ctx, tx, "searchFeatureVersionByFeature", searchFeatureVersionByFeature, featureID)
+	if err != nil {
+		return handleError(ctx, "searchFeatureVersionByFeature", err)
+	}
+	defer rows.Close()
+
+	var affecteds []database.FeatureVersion
+	for rows.Next() {
+		var affected database.FeatureVersion
+		var versionFormat zero.String
+
+		err := rows.Scan(&affected.ID, &affected.Version, &versionFormat)
+		if err != nil {
+			return handleError(ctx, "searchFeatureVersionByFeature.Scan()", err)
+		}
+
+		if affected.Version.CompareFormat(fixedInVersion, types.VersionFormat(versionFormat.String)) < 0 {
+			// The version of the FeatureVersion is lower than the fixed version of this vulnerability,
+			// thus, this FeatureVersion is affected by it.
+			affecteds = append(affecteds, affected)
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return handleError(ctx, "searchFeatureVersionByFeature.Rows()", err)
+	}
+	rows.Close()
+
+	// Insert into Vulnerability_Affects_FeatureVersion.
+	for _, affected := range affecteds {
+		_, err := namedExec(ctx, tx, "insertVulnerabilityAffectsFeatureVersion", insertVulnerabilityAffectsFeatureVersion, vulnerabilityID,
+			affected.ID, fixedInID)
+		if err != nil {
+			return handleError(ctx, "insertVulnerabilityAffectsFeatureVersion", err)
+		}
+	}
+
+	return nil
+}
+
+func (sqlite *sqlite) InsertVulnerabilityFixes(ctx context.Context, vulnerabilityNamespace, vulnerabilityName string, fixes []database.FeatureVersion) error {
+	defer observeQueryTime("InsertVulnerabilityFixes", "all", time.Now())
+
+	v := database.Vulnerability{
+		Name: vulnerabilityName,
+		Namespace: database.Namespace{
+			Name: vulnerabilityNamespace,
+		},
+		FixedIn: fixes,
+	}
+
+	return sqlite.insertVulnerability(ctx, v, &database.VulnerabilityUpdate{}, false, true)
+}
+
+func (sqlite *sqlite) UpdateVulnerability(ctx context.Context, namespaceName, name string, update database.VulnerabilityUpdate) (database.Vulnerability, error) {
+	defer observeQueryTime("UpdateVulnerability", "all", time.Now())
+
+	v := database.Vulnerability{
+		Name: name,
+		Namespace: database.Namespace{
+			Name: namespaceName,
+		},
+		FixedIn: update.FixedIn,
+	}
+
+	if err := sqlite.insertVulnerability(ctx, v, &update, false, true); err != nil {
+		return database.Vulnerability{}, err
+	}
+	return sqlite.FindVulnerability(ctx, namespaceName, name)
+}
+
+func (sqlite *sqlite) DeleteVulnerabilityFix(ctx context.Context, vulnerabilityNamespace, vulnerabilityName, featureName string) error {
+	defer observeQueryTime("DeleteVulnerabilityFix", "all", time.Now())
+
+	v := database.Vulnerability{
+		Name: vulnerabilityName,
+		Namespace: database.Namespace{
+			Name: vulnerabilityNamespace,
+		},
+		FixedIn: []database.FeatureVersion{
+			{
+				Feature: database.Feature{
+					Name: featureName,
+					Namespace: database.Namespace{
+						Name: vulnerabilityNamespace,
+					},
+				},
+				Version: types.MinVersion,
+			},
+		},
+	}
+
+	return sqlite.insertVulnerability(ctx, v, &database.VulnerabilityUpdate{}, false, true)
+}
+
+func (sqlite *sqlite) DeleteVulnerability(ctx context.Context, namespaceName, name string) error {
+	defer observeQueryTime("DeleteVulnerability", "all", time.Now())
+
+	err := sqlite.withTransaction(ctx, func(tx *sql.Tx) error {
+		var vulnerabilityID int
+		err := namedQueryRow(ctx, tx, "searchVulnerabilityID", searchVulnerabilityID, namespaceName, name).Scan(&vulnerabilityID)
+		if err != nil {
+			return handleError(ctx, "searchVulnerabilityID", err)
+		}
+
+		_, err = namedExec(ctx, tx, "removeVulnerability", removeVulnerability, vulnerabilityID, now())
+		if err != nil {
+			return handleError(ctx, "removeVulnerability", err)
+		}
+
+		// Create a notification.
+		return createNotification(ctx, tx, vulnerabilityID, 0)
+	})
+
+	return handleError(ctx, "DeleteVulnerability", err)
+}
+
+func (sqlite *sqlite) GetAffectedLayers(ctx context.Context, namespaceName, name string, limit, startAfterID int) ([]database.Layer, int, error) {
+	if limit <= 0 {
+		return nil, 0, cerrors.NewBadRequestError("could not list affected layers with a non-positive limit")
+	}
+
+	defer observeQueryTime("GetAffectedLayers", "all", time.Now())
+
+	// Find the vulnerability.
+	var vulnerabilityID int
+	err := namedQueryRow(ctx, sqlite, "searchVulnerabilityID", searchVulnerabilityID, namespaceName, name).Scan(&vulnerabilityID)
+	if err != nil {
+		return nil, 0, handleError(ctx, "searchVulnerabilityID", err)
+	}
+
+	// Count and list the affected layers.
+	var total int
+	err = namedQueryRow(ctx, sqlite, "affectedLayersBase+countAffectedLayers", affectedLayersBase+countAffectedLayers, vulnerabilityID).Scan(&total)
+	if err != nil {
+		return nil, 0, handleError(ctx, "countAffectedLayers", err)
+	}
+
+	rows, err := namedQuery(ctx, sqlite, "affectedLayersBase+searchAffectedLayers", affectedLayersBase+searchAffectedLayers, vulnerabilityID, startAfterID, limit)
+	if err != nil {
+		return nil, 0, handleError(ctx, "searchAffectedLayers", err)
+	}
+	defer rows.Close()
+
+	var layers []database.Layer
+	for rows.Next() {
+		var layer database.Layer
+		if err = rows.Scan(&layer.ID, &layer.Name); err != nil {
+			return nil, 0, handleError(ctx, "searchAffectedLayers.Scan()", err)
+		}
+		layers = append(layers, layer)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, 0, handleError(ctx, "searchAffectedLayers.Rows()", err)
+	}
+
+	return layers, total, nil
+}
@@ -17,6 +17,7 @@
 package notifier
 
 import (
+	"context"
 	"time"
 
 	"github.com/coreos/pkg/capnslog"
@@ -108,12 +109,26 @@ func Run(config *config.NotifierConfig, datastore database.Datastore, stopper *u
 		return
 	}
 
+	ctx := context.Background()
 	whoAmI := uuid.New()
 	log.Infof("notifier service started. lock identifier: %s\n", whoAmI)
 
+	// Wake up as soon as notifications are created if the datastore can tell us, polling every
+	// checkInterval remains as a fallback. Listening stops with the service.
+	listenCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-stopper.Chan():
+			cancel()
+		case <-listenCtx.Done():
+		}
+	}()
+	wake := listenNotifications(listenCtx, datastore)
+
 	for running := true; running; {
 		// Find task.
-		notification := findTask(datastore, config.RenotifyInterval, whoAmI, stopper)
+		notification := findTask(ctx, datastore, config.RenotifyInterval, whoAmI, stopper, wake)
 		if notification == nil {
 			// Interrupted while finding a task, Clair is stopping.
 			break
@@ -122,15 +137,15 @@ func Run(config *config.NotifierConfig, datastore database.Datastore, stopper *u
 		// Handle task.
 		done := make(chan bool, 1)
 		go func() {
-			success, interrupted := handleTask(*notification, stopper, config.Attempts)
+			success, interrupted := handleTask(ctx, datastore, *notification, stopper, config.Attempts)
 			if success {
 				utils.PrometheusObserveTimeMilliseconds(promNotifierLatencyMilliseconds, notification.Created)
-				datastore.SetNotificationNotified(notification.Name)
+				datastore.SetNotificationNotified(ctx, notification.Name)
 			}
 			if interrupted {
 				running = false
 			}
-			datastore.Unlock(notification.Name, whoAmI)
+			datastore.Unlock(ctx, notification.Name, whoAmI)
 			done <- true
 		}()
 
@@ -141,7 +156,7 @@ func Run(config *config.NotifierConfig, datastore database.Datastore, stopper *u
 			case <-done:
 				break outer
 			case <-time.After(refreshLockDuration):
-				datastore.Lock(notification.Name, whoAmI, lockDuration, true)
+				datastore.Lock(ctx, notification.Name, whoAmI, lockDuration, true)
 			}
 		}
 	}
@@ -149,18 +164,55 @@ func Run(config *config.NotifierConfig, datastore database.Datastore, stopper *u
 	log.Info("notifier service stopped")
 }
 
-func findTask(datastore database.Datastore, renotifyInterval time.Duration, whoAmI string, stopper *utils.Stopper) *database.VulnerabilityNotification {
+// listenNotifications returns a channel that receives a value when notifications may have been
+// created, if the datastore can tell. The datastore is listened to in the background, as it may
+// take a while to connect to it: polling is used in the meantime, and if listening fails.
+func listenNotifications(ctx context.Context, datastore database.Datastore) <-chan struct{} {
+	listener, ok := datastore.(database.NotificationListener)
+	if !ok {
+		return nil
+	}
+
+	wake := make(chan struct{}, 1)
+	go func() {
+		notified, err := listener.ListenNotifications(ctx)
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Warningf("could not listen for new notifications, polling instead: %s", err)
+			}
+			return
+		}
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-notified:
+				select {
+				case wake <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}()
+	return wake
+}
+
+func findTask(ctx context.Context, datastore database.Datastore, renotifyInterval time.Duration, whoAmI string, stopper *utils.Stopper, wake <-chan struct{}) *database.VulnerabilityNotification {
 	for {
 		// Find a notification to send.
-		notification, err := datastore.GetAvailableNotification(renotifyInterval)
+		notification, err := datastore.GetAvailableNotification(ctx, renotifyInterval)
 		if err != nil {
 			// There is no notification or an error occurred.
 			if err != cerrors.ErrNotFound {
 				log.Warningf("could not get notification to send: %s", err)
 			}
 
-			// Wait.
-			if !stopper.Sleep(checkInterval) {
+			// Wait until notifications may have been created. A nil wake channel blocks forever.
+			select {
+			case <-wake:
+			case <-time.After(checkInterval):
+			case <-stopper.Chan():
 				return nil
 			}
 
@@ -168,14 +220,14 @@ func findTask(datastore database.Datastore, renotifyInterval time.Duration, whoA
 		}
 
 		// Lock the notification.
-		if hasLock, _ := datastore.Lock(notification.Name, whoAmI, lockDuration, false); hasLock {
+		if hasLock, _ := datastore.Lock(ctx, notification.Name, whoAmI, lockDuration, false); hasLock {
 			log.Infof("found and locked a notification: %s", notification.Name)
 			return &notification
 		}
 	}
 }
 
-func handleTask(notification database.VulnerabilityNotification, st *utils.Stopper, maxAttempts int) (bool, bool) {
+func handleTask(ctx context.Context, datastore database.Datastore, notification database.VulnerabilityNotification, st *utils.Stopper, maxAttempts int) (bool, bool) {
 	// Send notification.
 	for notifierName, notifier := range notifiers {
 		var attempts int
@@ -193,6 +245,12 @@ func handleTask(notification database.VulnerabilityNotification, st *utils.Stopp
 				if !st.Sleep(backOff) {
 					return false, true
 				}
+
+				// The notification may have been acknowledged in the meantime.
+				if isAcknowledged(ctx, datastore, notification.Name) {
+					log.Infof("stopped sending notification '%s': it has been acknowledged\n", notification.Name)
+					return false, false
+				}
 			}
 
 			// Send using the current notifier.
@@ -213,3 +271,18 @@ func handleTask(notification database.VulnerabilityNotification, st *utils.Stopp
 	log.Infof("successfully sent notification '%s'\n", notification.Name)
 	return true, false
 }
+
+// isAcknowledged returns whether the notification has been deleted, which is how consumers
+// acknowledge it.
+func isAcknowledged(ctx context.Context, datastore database.Datastore, name string) bool {
+	// The pages of affected layers are not needed.
+	notification, _, err := datastore.GetNotification(ctx, name, 1, database.NoVulnerabilityNotificationPage)
+	if err == cerrors.ErrNotFound {
+		return true
+	} else if err != nil {
+		log.Warningf("could not check whether notification '%s' has been acknowledged: %s", name, err)
+		return false
+	}
+
+	return !notification.Deleted.IsZero()
+}
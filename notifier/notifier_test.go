@@ -0,0 +1,124 @@
+// Copyright 2015 clair authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package notifier
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/coreos/clair/config"
+	"github.com/coreos/clair/database"
+	"github.com/coreos/clair/utils"
+	cerrors "github.com/coreos/clair/utils/errors"
+)
+
+// failingNotifier fails to send every notification, acknowledging it through ack after the first
+// attempt.
+type failingNotifier struct {
+	attempts int
+	ack      func()
+}
+
+func (n *failingNotifier) Configure(*config.NotifierConfig) (bool, error) { return true, nil }
+
+func (n *failingNotifier) Send(notification database.VulnerabilityNotification) error {
+	n.attempts++
+	if n.attempts == 1 {
+		n.ack()
+	}
+	return errors.New("webhook is down")
+}
+
+func TestHandleTaskStopsWhenAcknowledged(t *testing.T) {
+	var acknowledged bool
+	datastore := &database.MockDatastore{
+		FctGetNotification: func(ctx context.Context, name string, limit int, page database.VulnerabilityNotificationPageNumber) (database.VulnerabilityNotification, database.VulnerabilityNotificationPageNumber, error) {
+			notification := database.VulnerabilityNotification{Name: name}
+			if acknowledged {
+				notification.Deleted = time.Now()
+			}
+			return notification, page, nil
+		},
+	}
+
+	notifier := &failingNotifier{ack: func() { acknowledged = true }}
+	defer func(registered map[string]Notifier) { notifiers = registered }(notifiers)
+	notifiers = map[string]Notifier{"failing": notifier}
+
+	success, interrupted := handleTask(context.Background(), datastore, database.VulnerabilityNotification{Name: "notification"}, utils.NewStopper(), 5)
+	assert.False(t, success)
+	assert.False(t, interrupted)
+	assert.Equal(t, 1, notifier.attempts)
+}
+
+// unreachableListener is a datastore that never manages to listen for new notifications.
+type unreachableListener struct {
+	*database.MockDatastore
+	canceled chan struct{}
+}
+
+func (l unreachableListener) ListenNotifications(ctx context.Context) (<-chan struct{}, error) {
+	<-ctx.Done()
+	close(l.canceled)
+	return nil, ctx.Err()
+}
+
+func TestRunPollsAndStopsWhileListening(t *testing.T) {
+	polled := make(chan struct{}, 1)
+	datastore := unreachableListener{
+		MockDatastore: &database.MockDatastore{
+			FctGetAvailableNotification: func(ctx context.Context, renotifyInterval time.Duration) (database.VulnerabilityNotification, error) {
+				select {
+				case polled <- struct{}{}:
+				default:
+				}
+				return database.VulnerabilityNotification{}, cerrors.ErrNotFound
+			},
+		},
+		canceled: make(chan struct{}),
+	}
+
+	defer func(registered map[string]Notifier) { notifiers = registered }(notifiers)
+	notifiers = map[string]Notifier{"failing": &failingNotifier{}}
+
+	stopper := utils.NewStopper()
+	stopper.Begin()
+	go Run(&config.NotifierConfig{}, datastore, stopper)
+
+	// Notifications are polled while the datastore can't be listened to.
+	select {
+	case <-polled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the notifier didn't poll notifications")
+	}
+
+	// Stopping the service stops listening.
+	stopped := make(chan struct{})
+	go func() {
+		stopper.Stop()
+		close(stopped)
+	}()
+	for _, done := range []chan struct{}{stopped, datastore.canceled} {
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("the notifier didn't stop")
+		}
+	}
+}
@@ -15,6 +15,7 @@
 package debian
 
 import (
+	"context"
 	"crypto/sha1"
 	"encoding/hex"
 	"encoding/json"
@@ -69,10 +70,17 @@ func (fetcher *DebianFetcher) FetchUpdate(datastore database.Datastore) (resp up
 		log.Errorf("could not download Debian's update: %s", err)
 		return resp, cerrors.ErrCouldNotDownload
 	}
+	defer r.Body.Close()
+
+	// An error page would otherwise be reported as a JSON that can't be parsed.
+	if r.StatusCode != http.StatusOK {
+		log.Errorf("could not download Debian's update: the server answered %s", r.Status)
+		return resp, cerrors.ErrCouldNotDownload
+	}
 
 	// Get the SHA-1 of the latest update's JSON data
-	latestHash, err := datastore.GetKeyValue(updaterFlag)
-	if err != nil {
+	latestHash, err := datastore.GetKeyValue(context.Background(), updaterFlag)
+	if err != nil && err != cerrors.ErrNotFound {
 		return resp, err
 	}
 
@@ -192,7 +200,8 @@ func parseDebianJSON(data *jsonData) (vulnerabilities []database.Vulnerability,
 					Feature: database.Feature{
 						Name: pkgName,
 						Namespace: database.Namespace{
-							Name: "debian:" + database.DebianReleasesMapping[releaseName],
+							Name:          "debian:" + database.DebianReleasesMapping[releaseName],
+							VersionFormat: types.DpkgVersionFormat,
 						},
 					},
 					Version: version,
@@ -15,6 +15,7 @@
 package debian
 
 import (
+	"io"
 	"os"
 	"path/filepath"
 	"runtime"
@@ -30,8 +31,21 @@ func TestDebianParser(t *testing.T) {
 
 	// Test parsing testdata/fetcher_debian_test.json
 	testFile, _ := os.Open(filepath.Join(filepath.Dir(filename)) + "/testdata/fetcher_debian_test.json")
+	defer testFile.Close()
 	response, err := buildResponse(testFile, "")
-	if assert.Nil(t, err) && assert.Len(t, response.Vulnerabilities, 3) {
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	// The releases that are not mapped to a version are reported.
+	assert.Equal(t, updaterFlag, response.FlagName)
+	assert.NotEmpty(t, response.FlagValue)
+	if assert.Len(t, response.Notes, 1) {
+		assert.Contains(t, response.Notes[0], "buster")
+	}
+
+	// The temporary entries are skipped.
+	if assert.Len(t, response.Vulnerabilities, 4) {
 		for _, vulnerability := range response.Vulnerabilities {
 			if vulnerability.Name == "CVE-2015-1323" {
 				assert.Equal(t, "https://security-tracker.debian.org/tracker/CVE-2015-1323", vulnerability.Link)
@@ -41,14 +55,14 @@ func TestDebianParser(t *testing.T) {
 				expectedFeatureVersions := []database.FeatureVersion{
 					{
 						Feature: database.Feature{
-							Namespace: database.Namespace{Name: "debian:8"},
+							Namespace: database.Namespace{Name: "debian:8", VersionFormat: types.DpkgVersionFormat},
 							Name:      "aptdaemon",
 						},
 						Version: types.MaxVersion,
 					},
 					{
 						Feature: database.Feature{
-							Namespace: database.Namespace{Name: "debian:unstable"},
+							Namespace: database.Namespace{Name: "debian:unstable", VersionFormat: types.DpkgVersionFormat},
 
 							Name: "aptdaemon",
 						},
@@ -67,21 +81,21 @@ func TestDebianParser(t *testing.T) {
 				expectedFeatureVersions := []database.FeatureVersion{
 					{
 						Feature: database.Feature{
-							Namespace: database.Namespace{Name: "debian:8"},
+							Namespace: database.Namespace{Name: "debian:8", VersionFormat: types.DpkgVersionFormat},
 							Name:      "aptdaemon",
 						},
 						Version: types.NewVersionUnsafe("0.7.0"),
 					},
 					{
 						Feature: database.Feature{
-							Namespace: database.Namespace{Name: "debian:unstable"},
+							Namespace: database.Namespace{Name: "debian:unstable", VersionFormat: types.DpkgVersionFormat},
 							Name:      "aptdaemon",
 						},
 						Version: types.NewVersionUnsafe("0.7.0"),
 					},
 					{
 						Feature: database.Feature{
-							Namespace: database.Namespace{Name: "debian:8"},
+							Namespace: database.Namespace{Name: "debian:8", VersionFormat: types.DpkgVersionFormat},
 							Name:      "asterisk",
 						},
 						Version: types.NewVersionUnsafe("0.5.56"),
@@ -99,7 +113,7 @@ func TestDebianParser(t *testing.T) {
 				expectedFeatureVersions := []database.FeatureVersion{
 					{
 						Feature: database.Feature{
-							Namespace: database.Namespace{Name: "debian:8"},
+							Namespace: database.Namespace{Name: "debian:8", VersionFormat: types.DpkgVersionFormat},
 							Name:      "asterisk",
 						},
 						Version: types.MinVersion,
@@ -109,9 +123,32 @@ func TestDebianParser(t *testing.T) {
 				for _, expectedFeatureVersion := range expectedFeatureVersions {
 					assert.Contains(t, vulnerability.FixedIn, expectedFeatureVersion)
 				}
+			} else if vulnerability.Name == "CVE-2016-2105" {
+				assert.Equal(t, types.Medium, vulnerability.Severity)
+
+				// The release whose status is undetermined isn't reported as affected.
+				expectedFeatureVersions := []database.FeatureVersion{
+					{
+						Feature: database.Feature{
+							Namespace: database.Namespace{Name: "debian:8", VersionFormat: types.DpkgVersionFormat},
+							Name:      "openssl",
+						},
+						Version: types.NewVersionUnsafe("1.0.1t-1+deb8u1"),
+					},
+				}
+				assert.Equal(t, expectedFeatureVersions, vulnerability.FixedIn)
 			} else {
 				assert.Fail(t, "Wrong vulnerability name: ", vulnerability.ID)
 			}
 		}
 	}
+
+	// The same dump is not parsed again.
+	testFile.Seek(0, io.SeekStart)
+	unchanged, err := buildResponse(testFile, response.FlagValue)
+	if assert.Nil(t, err) {
+		assert.Equal(t, response.FlagValue, unchanged.FlagValue)
+		assert.Empty(t, unchanged.Vulnerabilities)
+		assert.Empty(t, unchanged.Notes)
+	}
 }
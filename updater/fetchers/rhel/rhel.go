@@ -16,6 +16,7 @@ package rhel
 
 import (
 	"bufio"
+	"context"
 	"encoding/xml"
 	"io"
 	"net/http"
@@ -92,8 +93,8 @@ func (f *RHELFetcher) FetchUpdate(datastore database.Datastore) (resp updater.Fe
 	log.Info("fetching Red Hat vulnerabilities")
 
 	// Get the first RHSA we have to manage.
-	flagValue, err := datastore.GetKeyValue(updaterFlag)
-	if err != nil {
+	flagValue, err := datastore.GetKeyValue(context.Background(), updaterFlag)
+	if err != nil && err != cerrors.ErrNotFound {
 		return resp, err
 	}
 	firstRHSA, err := strconv.Atoi(flagValue)
@@ -291,7 +292,10 @@ func toFeatureVersions(criteria criteria) []database.FeatureVersion {
 		}
 
 		if osVersion > firstConsideredRHEL {
-			featureVersion.Feature.Namespace.Name = "centos" + ":" + strconv.Itoa(osVersion)
+			featureVersion.Feature.Namespace = database.Namespace{
+				Name:          "centos" + ":" + strconv.Itoa(osVersion),
+				VersionFormat: types.RpmVersionFormat,
+			}
 		} else {
 			continue
 		}
@@ -350,7 +354,7 @@ func priority(def definition) types.Priority {
 	case "Critical":
 		return types.Critical
 	default:
-		log.Warning("could not determine vulnerability priority from: %s.", priority)
+		log.Warningf("could not determine vulnerability priority from: %s.", priority)
 		return types.Unknown
 	}
 }
@@ -17,6 +17,7 @@ package ubuntu
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -123,8 +124,8 @@ func (fetcher *UbuntuFetcher) FetchUpdate(datastore database.Datastore) (resp up
 	}
 
 	// Get the latest revision number we successfully applied in the database.
-	dbRevisionNumber, err := datastore.GetKeyValue("ubuntuUpdater")
-	if err != nil {
+	dbRevisionNumber, err := datastore.GetKeyValue(context.Background(), "ubuntuUpdater")
+	if err != nil && err != cerrors.ErrNotFound {
 		return resp, err
 	}
 
@@ -233,10 +234,19 @@ func collectModifiedVulnerabilities(revision int, dbRevision, repositoryLocalPat
 		return nil, cerrors.ErrCouldNotDownload
 	}
 
+	return parseModifiedVulnerabilities(out), nil
+}
+
+// parseModifiedVulnerabilities extracts the paths of the CVE files that have
+// been added, modified or renamed from the output of `bzr log --verbose`.
+func parseModifiedVulnerabilities(out []byte) map[string]struct{} {
+	modifiedCVE := make(map[string]struct{})
+
 	scanner := bufio.NewScanner(bytes.NewReader(out))
 	for scanner.Scan() {
 		text := strings.TrimSpace(scanner.Text())
 		if strings.Contains(text, "CVE-") && (strings.HasPrefix(text, "active/") || strings.HasPrefix(text, "retired/")) {
+			// A renamed file is only available at its new path.
 			if strings.Contains(text, " => ") {
 				text = text[strings.Index(text, " => ")+4:]
 			}
@@ -244,7 +254,7 @@ func collectModifiedVulnerabilities(revision int, dbRevision, repositoryLocalPat
 		}
 	}
 
-	return modifiedCVE, nil
+	return modifiedCVE
 }
 
 func createRepository(pathToRepo string) error {
@@ -376,7 +386,7 @@ func parseUbuntuCVE(fileContent io.Reader) (vulnerability database.Vulnerability
 				// Create and add the new package.
 				featureVersion := database.FeatureVersion{
 					Feature: database.Feature{
-						Namespace: database.Namespace{Name: "ubuntu:" + database.UbuntuReleasesMapping[md["release"]]},
+						Namespace: database.Namespace{Name: "ubuntu:" + database.UbuntuReleasesMapping[md["release"]], VersionFormat: types.DpkgVersionFormat},
 						Name:      md["package"],
 					},
 					Version: version,
@@ -418,7 +428,7 @@ func ubuntuPriorityToSeverity(priority string) types.Priority {
 		return types.Critical
 	}
 
-	log.Warning("Could not determine a vulnerability priority from: %s", priority)
+	log.Warningf("Could not determine a vulnerability priority from: %s", priority)
 	return types.Unknown
 }
 
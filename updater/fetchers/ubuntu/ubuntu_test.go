@@ -15,6 +15,7 @@
 package ubuntu
 
 import (
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"runtime"
@@ -45,21 +46,21 @@ func TestUbuntuParser(t *testing.T) {
 		expectedFeatureVersions := []database.FeatureVersion{
 			{
 				Feature: database.Feature{
-					Namespace: database.Namespace{Name: "ubuntu:14.04"},
+					Namespace: database.Namespace{Name: "ubuntu:14.04", VersionFormat: types.DpkgVersionFormat},
 					Name:      "libmspack",
 				},
 				Version: types.MaxVersion,
 			},
 			{
 				Feature: database.Feature{
-					Namespace: database.Namespace{Name: "ubuntu:15.04"},
+					Namespace: database.Namespace{Name: "ubuntu:15.04", VersionFormat: types.DpkgVersionFormat},
 					Name:      "libmspack",
 				},
 				Version: types.NewVersionUnsafe("0.4-3"),
 			},
 			{
 				Feature: database.Feature{
-					Namespace: database.Namespace{Name: "ubuntu:15.10"},
+					Namespace: database.Namespace{Name: "ubuntu:15.10", VersionFormat: types.DpkgVersionFormat},
 					Name:      "libmspack-anotherpkg",
 				},
 				Version: types.NewVersionUnsafe("0.1"),
@@ -71,3 +72,134 @@ func TestUbuntuParser(t *testing.T) {
 		}
 	}
 }
+
+func TestUbuntuParserStatuses(t *testing.T) {
+	_, filename, _, _ := runtime.Caller(0)
+	path := filepath.Join(filepath.Dir(filename))
+
+	testData, _ := os.Open(path + "/testdata/fetcher_ubuntu_statuses_test.txt")
+	defer testData.Close()
+	vulnerability, unknownReleases, err := parseUbuntuCVE(testData)
+	if assert.Nil(t, err) {
+		assert.Equal(t, "CVE-2016-0705", vulnerability.Name)
+		assert.Equal(t, "http://people.ubuntu.com/~ubuntu-security/cve/CVE-2016-0705", vulnerability.Link)
+		assert.Equal(t, types.High, vulnerability.Severity)
+		assert.Len(t, unknownReleases, 0)
+
+		// The DNE, ignored, needs-triage and pending statuses are skipped, as
+		// well as the ignored releases and the Linux kernels.
+		expectedFeatureVersions := []database.FeatureVersion{
+			{
+				Feature: database.Feature{
+					Namespace: database.Namespace{Name: "ubuntu:12.04", VersionFormat: types.DpkgVersionFormat},
+					Name:      "openssl",
+				},
+				Version: types.NewVersionUnsafe("1.0.1-4ubuntu5.34"),
+			},
+			{
+				Feature: database.Feature{
+					Namespace: database.Namespace{Name: "ubuntu:14.04", VersionFormat: types.DpkgVersionFormat},
+					Name:      "openssl",
+				},
+				Version: types.NewVersionUnsafe("1.0.1f-1ubuntu2.18"),
+			},
+			{
+				Feature: database.Feature{
+					Namespace: database.Namespace{Name: "ubuntu:15.10", VersionFormat: types.DpkgVersionFormat},
+					Name:      "openssl",
+				},
+				Version: types.MaxVersion,
+			},
+			{
+				Feature: database.Feature{
+					Namespace: database.Namespace{Name: "ubuntu:16.04", VersionFormat: types.DpkgVersionFormat},
+					Name:      "openssl",
+				},
+				Version: types.MinVersion,
+			},
+			{
+				Feature: database.Feature{
+					Namespace: database.Namespace{Name: "ubuntu:16.04", VersionFormat: types.DpkgVersionFormat},
+					Name:      "nodejs",
+				},
+				Version: types.MaxVersion,
+			},
+		}
+		assert.Equal(t, expectedFeatureVersions, vulnerability.FixedIn)
+	}
+}
+
+func TestUbuntuPriorityToSeverity(t *testing.T) {
+	for priority, severity := range map[string]types.Priority{
+		"untriaged":  types.Unknown,
+		"negligible": types.Negligible,
+		"low":        types.Low,
+		"medium":     types.Medium,
+		"high":       types.High,
+		"critical":   types.Critical,
+		"unknown":    types.Unknown,
+	} {
+		assert.Equal(t, severity, ubuntuPriorityToSeverity(priority), "priority: %s", priority)
+	}
+}
+
+func TestParseModifiedVulnerabilities(t *testing.T) {
+	out := []byte(`------------------------------------------------------------
+revno: 11702
+committer: Ubuntu Security Team
+message:
+  triage CVE-2016-0705
+modified:
+  active/CVE-2016-0705
+  active/CVE-2016-0797
+------------------------------------------------------------
+revno: 11701
+committer: Ubuntu Security Team
+message:
+  retire CVE-2015-4471
+renamed:
+  active/CVE-2015-4471 => retired/CVE-2015-4471
+added:
+  active/CVE-2016-2105
+modified:
+  README
+  scripts/check-syntax
+`)
+
+	assert.Equal(t, map[string]struct{}{
+		"active/CVE-2016-0705":  {},
+		"active/CVE-2016-0797":  {},
+		"retired/CVE-2015-4471": {},
+		"active/CVE-2016-2105":  {},
+	}, parseModifiedVulnerabilities(out))
+}
+
+func TestCollectModifiedVulnerabilities(t *testing.T) {
+	repository, err := ioutil.TempDir("", "ubuntu-cve-tracker")
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer os.RemoveAll(repository)
+
+	for _, name := range []string{"active/CVE-2016-0705", "active/README", "retired/CVE-2015-4471"} {
+		os.MkdirAll(filepath.Join(repository, filepath.Dir(name)), 0755)
+		if !assert.Nil(t, ioutil.WriteFile(filepath.Join(repository, name), nil, 0644)) {
+			return
+		}
+	}
+
+	// A brand new database gets every CVE.
+	modifiedCVE, err := collectModifiedVulnerabilities(42, "", repository)
+	if assert.Nil(t, err) {
+		assert.Equal(t, map[string]struct{}{
+			"active/CVE-2016-0705":  {},
+			"retired/CVE-2015-4471": {},
+		}, modifiedCVE)
+	}
+
+	// An up to date database gets nothing.
+	modifiedCVE, err = collectModifiedVulnerabilities(42, "42", repository)
+	if assert.Nil(t, err) {
+		assert.Len(t, modifiedCVE, 0)
+	}
+}
@@ -0,0 +1,104 @@
+// Copyright 2015 clair authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package updater
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/coreos/clair/database"
+	cerrors "github.com/coreos/clair/utils/errors"
+)
+
+// RunStatus describes an update of the vulnerability database.
+type RunStatus struct {
+	ID      string
+	Started time.Time
+	// Ended is nil while the update is running.
+	Ended *time.Time `json:",omitempty"`
+	// Error is set when the fetched vulnerabilities could not be stored.
+	Error string `json:",omitempty"`
+	// Fetchers holds the outcome of every fetcher, by name, once they all finished.
+	Fetchers map[string]FetcherStatus `json:",omitempty"`
+}
+
+// FetcherStatus is the outcome of a fetcher during an update.
+type FetcherStatus struct {
+	// Vulnerabilities is the number of vulnerabilities that the fetcher returned.
+	Vulnerabilities int
+	Error           string `json:",omitempty"`
+}
+
+// Status reports the state of the updater, as recorded in the database by every Clair instance.
+type Status struct {
+	// LastRun is the last update that started, or nil if none was recorded.
+	LastRun *RunStatus
+	// LastSuccessfulUpdate is the time of the last update during which every fetcher succeeded,
+	// or the zero time if there was none.
+	LastSuccessfulUpdate time.Time
+	// NextScheduledUpdate is the time of the next periodic update, or the zero time if none is
+	// scheduled.
+	NextScheduledUpdate time.Time
+}
+
+// GetStatus returns the state of the updater.
+func GetStatus(ctx context.Context, datastore database.Datastore) (Status, error) {
+	var status Status
+
+	lastUpdate, _, err := getLastUpdate(ctx, datastore)
+	if err != nil {
+		return status, err
+	}
+	status.LastSuccessfulUpdate = lastUpdate
+
+	value, err := datastore.GetKeyValue(ctx, runFlagName)
+	if err != nil && err != cerrors.ErrNotFound {
+		return status, err
+	}
+	if err == nil {
+		var run RunStatus
+		if err = json.Unmarshal([]byte(value), &run); err != nil {
+			return status, err
+		}
+		status.LastRun = &run
+	}
+
+	value, err = datastore.GetKeyValue(ctx, nextFlagName)
+	if err != nil && err != cerrors.ErrNotFound {
+		return status, err
+	}
+	if err == nil {
+		nextUpdate, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return status, err
+		}
+		status.NextScheduledUpdate = time.Unix(nextUpdate, 0).UTC()
+	}
+
+	return status, nil
+}
+
+// recordRun stores the status of an update, so that GetStatus can report it.
+func recordRun(ctx context.Context, datastore database.Datastore, run RunStatus) {
+	value, err := json.Marshal(run)
+	if err == nil {
+		err = datastore.InsertKeyValue(ctx, runFlagName, string(value))
+	}
+	if err != nil {
+		log.Warningf("could not record the status of update %s: %s", run.ID, err)
+	}
+}
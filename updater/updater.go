@@ -17,6 +17,8 @@
 package updater
 
 import (
+	"context"
+	"errors"
 	"math/rand"
 	"strconv"
 	"sync"
@@ -25,6 +27,7 @@ import (
 	"github.com/coreos/clair/config"
 	"github.com/coreos/clair/database"
 	"github.com/coreos/clair/utils"
+	cerrors "github.com/coreos/clair/utils/errors"
 	"github.com/coreos/pkg/capnslog"
 	"github.com/pborman/uuid"
 	"github.com/prometheus/client_golang/prometheus"
@@ -33,6 +36,8 @@ import (
 const (
 	flagName      = "updater/last"
 	notesFlagName = "updater/notes"
+	runFlagName   = "updater/run"
+	nextFlagName  = "updater/next"
 
 	lockName            = "updater"
 	lockDuration        = refreshLockDuration + time.Minute*2
@@ -42,6 +47,9 @@ const (
 var (
 	log = capnslog.NewPackageLogger("github.com/coreos/clair", "updater")
 
+	// ErrUpdateInProgress is returned by Trigger when another update holds the updater lock.
+	ErrUpdateInProgress = errors.New("updater: an update is already in progress")
+
 	promUpdaterErrorsTotal = prometheus.NewCounter(prometheus.CounterOpts{
 		Name: "clair_updater_errors_total",
 		Help: "Numbers of errors that the updater generated.",
@@ -74,6 +82,7 @@ func Run(config *config.UpdaterConfig, datastore database.Datastore, st *utils.S
 		return
 	}
 
+	ctx := context.Background()
 	whoAmI := uuid.New()
 	log.Infof("updater service started. lock identifier: %s", whoAmI)
 
@@ -83,7 +92,7 @@ func Run(config *config.UpdaterConfig, datastore database.Datastore, st *utils.S
 		// Determine if this is the first update and define the next update time.
 		// The next update time is (last update time + interval) or now if this is the first update.
 		nextUpdate := time.Now().UTC()
-		lastUpdate, firstUpdate, err := getLastUpdate(datastore)
+		lastUpdate, firstUpdate, err := getLastUpdate(ctx, datastore)
 		if err != nil {
 			log.Errorf("an error occured while getting the last update time")
 			nextUpdate = nextUpdate.Add(config.Interval)
@@ -95,36 +104,14 @@ func Run(config *config.UpdaterConfig, datastore database.Datastore, st *utils.S
 		if nextUpdate.Before(time.Now().UTC()) {
 			// Attempt to get a lock on the the update.
 			log.Debug("attempting to obtain update lock")
-			hasLock, hasLockUntil := datastore.Lock(lockName, whoAmI, lockDuration, false)
+			hasLock, hasLockUntil := datastore.Lock(ctx, lockName, whoAmI, lockDuration, false)
 			if hasLock {
-				// Launch update in a new go routine.
-				doneC := make(chan bool, 1)
-				go func() {
-					Update(datastore, firstUpdate)
-					doneC <- true
-				}()
-
-				for done := false; !done && !stop; {
-					select {
-					case <-doneC:
-						done = true
-					case <-time.After(refreshLockDuration):
-						// Refresh the lock until the update is done.
-						datastore.Lock(lockName, whoAmI, lockDuration, true)
-					case <-st.Chan():
-						stop = true
-					}
-				}
-
-				// Unlock the update.
-				datastore.Unlock(lockName, whoAmI)
-
-				if stop {
+				if stop = updateWithLock(ctx, datastore, whoAmI, uuid.New(), firstUpdate, st.Chan()); stop {
 					break
 				}
 				continue
 			} else {
-				lockOwner, lockExpiration, err := datastore.FindLock(lockName)
+				lockOwner, lockExpiration, err := datastore.FindLock(ctx, lockName)
 				if err != nil {
 					log.Debug("update lock is already taken")
 					nextUpdate = hasLockUntil
@@ -139,6 +126,7 @@ func Run(config *config.UpdaterConfig, datastore database.Datastore, st *utils.S
 		now := time.Now().UTC()
 		waitUntil := nextUpdate.Add(time.Duration(rand.ExpFloat64()/0.5) * time.Second)
 		log.Debugf("next update attempt scheduled for %v.", waitUntil)
+		datastore.InsertKeyValue(ctx, nextFlagName, strconv.FormatInt(waitUntil.Unix(), 10))
 		if !waitUntil.Before(now) {
 			if !st.Sleep(waitUntil.Sub(time.Now())) {
 				break
@@ -157,29 +145,93 @@ func Run(config *config.UpdaterConfig, datastore database.Datastore, st *utils.S
 	log.Info("updater service stopped")
 }
 
+// Trigger starts an update of the vulnerability database in the background, without waiting for
+// the next scheduled one, and returns the ID of the run. It returns ErrUpdateInProgress if another
+// update holds the updater lock.
+func Trigger(ctx context.Context, datastore database.Datastore) (string, error) {
+	runID := uuid.New()
+	if hasLock, _ := datastore.Lock(ctx, lockName, runID, lockDuration, false); !hasLock {
+		return "", ErrUpdateInProgress
+	}
+
+	_, firstUpdate, err := getLastUpdate(ctx, datastore)
+	if err != nil {
+		datastore.Unlock(ctx, lockName, runID)
+		return "", err
+	}
+
+	log.Infof("update %s triggered", runID)
+	go updateWithLock(ctx, datastore, runID, runID, firstUpdate, nil)
+	return runID, nil
+}
+
+// updateWithLock runs an update while refreshing the updater lock held by owner, and releases the
+// lock once the update is done. It returns early if stop is closed, and reports whether it did.
+func updateWithLock(ctx context.Context, datastore database.Datastore, owner, runID string, firstUpdate bool, stop <-chan struct{}) bool {
+	// Launch update in a new go routine.
+	doneC := make(chan bool, 1)
+	go func() {
+		update(ctx, datastore, runID, firstUpdate)
+		doneC <- true
+	}()
+
+	stopped := false
+	for done := false; !done && !stopped; {
+		select {
+		case <-doneC:
+			done = true
+		case <-time.After(refreshLockDuration):
+			// Refresh the lock until the update is done.
+			datastore.Lock(ctx, lockName, owner, lockDuration, true)
+		case <-stop:
+			stopped = true
+		}
+	}
+
+	// Unlock the update.
+	datastore.Unlock(ctx, lockName, owner)
+	return stopped
+}
+
 // Update fetches all the vulnerabilities from the registered fetchers, upserts
 // them into the database and then sends notifications.
-func Update(datastore database.Datastore, firstUpdate bool) {
+func Update(ctx context.Context, datastore database.Datastore, firstUpdate bool) {
+	update(ctx, datastore, uuid.New(), firstUpdate)
+}
+
+func update(ctx context.Context, datastore database.Datastore, runID string, firstUpdate bool) {
 	defer setUpdaterDuration(time.Now())
 
 	log.Info("updating vulnerabilities")
+	ctx = database.ContextWithSource(ctx, "updater")
+
+	// Record the run, so that its progress and outcome can be reported.
+	run := RunStatus{ID: runID, Started: time.Now().UTC()}
+	recordRun(ctx, datastore, run)
+	defer func() {
+		ended := time.Now().UTC()
+		run.Ended = &ended
+		recordRun(ctx, datastore, run)
+	}()
 
 	// Fetch updates.
-	status, vulnerabilities, flags, notes := fetch(datastore)
+	status, vulnerabilities, flags, notes, fetcherStatuses := fetch(datastore)
+	run.Fetchers = fetcherStatuses
 
 	// Insert vulnerabilities.
 	log.Tracef("inserting %d vulnerabilities for update", len(vulnerabilities))
-	err := datastore.InsertVulnerabilities(vulnerabilities, !firstUpdate)
+	err := datastore.InsertVulnerabilities(ctx, vulnerabilities, !firstUpdate)
 	if err != nil {
 		promUpdaterErrorsTotal.Inc()
 		log.Errorf("an error occured when inserting vulnerabilities for update: %s", err)
+		run.Error = err.Error()
 		return
 	}
 	vulnerabilities = nil
 
 	// Update flags.
 	for flagName, flagValue := range flags {
-		datastore.InsertKeyValue(flagName, flagValue)
+		datastore.InsertKeyValue(ctx, flagName, flagValue)
 	}
 
 	// Log notes.
@@ -190,7 +242,7 @@ func Update(datastore database.Datastore, firstUpdate bool) {
 
 	// Update last successful update if every fetchers worked properly.
 	if status {
-		datastore.InsertKeyValue(flagName, strconv.FormatInt(time.Now().UTC().Unix(), 10))
+		datastore.InsertKeyValue(ctx, flagName, strconv.FormatInt(time.Now().UTC().Unix(), 10))
 	}
 
 	log.Info("update finished")
@@ -200,45 +252,53 @@ func setUpdaterDuration(start time.Time) {
 	promUpdaterDurationSeconds.Set(time.Since(start).Seconds())
 }
 
+// fetcherResult is the outcome of a fetcher.
+type fetcherResult struct {
+	name     string
+	response FetcherResponse
+	err      error
+}
+
 // fetch get data from the registered fetchers, in parallel.
-func fetch(datastore database.Datastore) (bool, []database.Vulnerability, map[string]string, []string) {
+func fetch(datastore database.Datastore) (bool, []database.Vulnerability, map[string]string, []string, map[string]FetcherStatus) {
 	var vulnerabilities []database.Vulnerability
 	var notes []string
 	status := true
 	flags := make(map[string]string)
+	statuses := make(map[string]FetcherStatus, len(fetchers))
 
 	// Fetch updates in parallel.
 	log.Info("fetching vulnerability updates")
-	var responseC = make(chan *FetcherResponse, 0)
+	var resultC = make(chan fetcherResult, 0)
 	for n, f := range fetchers {
 		go func(name string, fetcher Fetcher) {
 			response, err := fetcher.FetchUpdate(datastore)
-			if err != nil {
-				promUpdaterErrorsTotal.Inc()
-				log.Errorf("an error occured when fetching update '%s': %s.", name, err)
-				status = false
-				responseC <- nil
-				return
-			}
-
-			responseC <- &response
+			resultC <- fetcherResult{name: name, response: response, err: err}
 		}(n, f)
 	}
 
 	// Collect results of updates.
 	for i := 0; i < len(fetchers); i++ {
-		resp := <-responseC
-		if resp != nil {
-			vulnerabilities = append(vulnerabilities, doVulnerabilitiesNamespacing(resp.Vulnerabilities)...)
-			notes = append(notes, resp.Notes...)
-			if resp.FlagName != "" && resp.FlagValue != "" {
-				flags[resp.FlagName] = resp.FlagValue
-			}
+		result := <-resultC
+		if result.err != nil {
+			promUpdaterErrorsTotal.Inc()
+			log.Errorf("an error occured when fetching update '%s': %s.", result.name, result.err)
+			status = false
+			statuses[result.name] = FetcherStatus{Error: result.err.Error()}
+			continue
+		}
+
+		resp := result.response
+		statuses[result.name] = FetcherStatus{Vulnerabilities: len(resp.Vulnerabilities)}
+		vulnerabilities = append(vulnerabilities, doVulnerabilitiesNamespacing(resp.Vulnerabilities)...)
+		notes = append(notes, resp.Notes...)
+		if resp.FlagName != "" && resp.FlagValue != "" {
+			flags[resp.FlagName] = resp.FlagValue
 		}
 	}
 
-	close(responseC)
-	return status, addMetadata(datastore, vulnerabilities), flags, notes
+	close(resultC)
+	return status, addMetadata(datastore, vulnerabilities), flags, notes, statuses
 }
 
 // Add metadata to the specified vulnerabilities using the registered MetadataFetchers, in parallel.
@@ -286,16 +346,22 @@ func addMetadata(datastore database.Datastore, vulnerabilities []database.Vulner
 	return vulnerabilities
 }
 
-func getLastUpdate(datastore database.Datastore) (time.Time, bool, error) {
-	lastUpdateTSS, err := datastore.GetKeyValue(flagName)
-	if err != nil {
-		return time.Time{}, false, err
-	}
+// LastUpdate returns the time of the last successful update of the vulnerability database, or the
+// zero time if it has never been updated.
+func LastUpdate(ctx context.Context, datastore database.Datastore) (time.Time, error) {
+	lastUpdate, _, err := getLastUpdate(ctx, datastore)
+	return lastUpdate, err
+}
 
-	if lastUpdateTSS == "" {
+func getLastUpdate(ctx context.Context, datastore database.Datastore) (time.Time, bool, error) {
+	lastUpdateTSS, err := datastore.GetKeyValue(ctx, flagName)
+	if err == cerrors.ErrNotFound {
 		// This is the first update.
 		return time.Time{}, true, nil
 	}
+	if err != nil {
+		return time.Time{}, false, err
+	}
 
 	lastUpdateTS, err := strconv.ParseInt(lastUpdateTSS, 10, 64)
 	if err != nil {
@@ -323,7 +389,7 @@ func doVulnerabilitiesNamespacing(vulnerabilities []database.Vulnerability) []da
 
 			if vulnerability, ok := vulnerabilitiesMap[index]; !ok {
 				newVulnerability := v
-				newVulnerability.Namespace.Name = fv.Feature.Namespace.Name
+				newVulnerability.Namespace = fv.Feature.Namespace
 				newVulnerability.FixedIn = []database.FeatureVersion{fv}
 
 				vulnerabilitiesMap[index] = &newVulnerability
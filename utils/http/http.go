@@ -19,11 +19,6 @@ import (
 	"encoding/json"
 	"io"
 	"net/http"
-
-	"github.com/coreos/clair/database"
-	"github.com/coreos/clair/utils"
-	cerrors "github.com/coreos/clair/utils/errors"
-	"github.com/coreos/clair/worker"
 )
 
 // MaxBodySize is the maximum number of bytes that ParseHTTPBody reads from an http.Request.Body.
@@ -40,31 +35,6 @@ func WriteHTTP(w http.ResponseWriter, httpStatus int, v interface{}) {
 	}
 }
 
-// WriteHTTPError writes an error, wrapped in the Message field of a JSON-encoded
-// object to a http.ResponseWriter, as well as a HTTP status code.
-// If the status code is 0, handleError tries to guess the proper HTTP status
-// code from the error type.
-func WriteHTTPError(w http.ResponseWriter, httpStatus int, err error) {
-	if httpStatus == 0 {
-		httpStatus = http.StatusInternalServerError
-		// Try to guess the http status code from the error type
-		if _, isBadRequestError := err.(*cerrors.ErrBadRequest); isBadRequestError {
-			httpStatus = http.StatusBadRequest
-		} else {
-			switch err {
-			case cerrors.ErrNotFound:
-				httpStatus = http.StatusNotFound
-			case database.ErrBackendException:
-				httpStatus = http.StatusServiceUnavailable
-			case worker.ErrParentUnknown, worker.ErrUnsupported, utils.ErrCouldNotExtract, utils.ErrExtractedFileTooBig:
-				httpStatus = http.StatusBadRequest
-			}
-		}
-	}
-
-	WriteHTTP(w, httpStatus, struct{ Message string }{Message: err.Error()})
-}
-
 // ParseHTTPBody reads a JSON-encoded body from a http.Request and unmarshals it
 // into the provided object.
 func ParseHTTPBody(r *http.Request, v interface{}) (int, error) {
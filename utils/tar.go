@@ -24,7 +24,25 @@ import (
 	"io"
 	"io/ioutil"
 	"os/exec"
+	"path"
+	"sort"
 	"strings"
+
+	cerrors "github.com/coreos/clair/utils/errors"
+)
+
+const (
+	// WhiteoutPrefix prefixes the name of the files of a layer that mark the deletion of the
+	// file of the same name, without the prefix, from the lower layers.
+	WhiteoutPrefix = ".wh."
+
+	// WhiteoutOpaqueDir is the name of the files of a layer that mark the deletion of the whole
+	// content that their directory had in the lower layers.
+	WhiteoutOpaqueDir = WhiteoutPrefix + WhiteoutPrefix + ".opq"
+
+	// ExecutablePrefix prefixes the patterns of the files to extract that only designate the
+	// executable regular files, such as "+x:**" for all of them.
+	ExecutablePrefix = "+x:"
 )
 
 var (
@@ -34,31 +52,46 @@ var (
 	// ErrExtractedFileTooBig occurs when a file to extract is too big.
 	ErrExtractedFileTooBig = errors.New("utils: could not extract one or more files from the archive: file too big")
 
+	// ErrLayerTooLarge occurs when the files to extract are, together, too big.
+	ErrLayerTooLarge = errors.New("utils: could not extract the archive: too much data to extract")
+
+	// ErrUnsafePath occurs when the archive contains an absolute path or a path that leaves the
+	// archive, or when a file to extract links to such a path.
+	ErrUnsafePath = cerrors.NewBadRequestError("utils: the archive contains a path that leaves the archive")
+
+	// ErrUnsupportedArchive occurs when the data is neither a tar archive nor a gzip, bzip2, xz
+	// or zstd compressed tar archive.
+	ErrUnsupportedArchive = cerrors.NewBadRequestError("utils: the archive is not a tar archive, optionally compressed with gzip, bzip2, xz or zstd")
+
 	readLen = 6 // max bytes to sniff
 
+	// opaqueXattr is the extended attribute that overlay sets on the directories whose content
+	// hides the content of the lower layers.
+	opaqueXattr = "trusted.overlay.opaque"
+
 	gzipHeader  = []byte{0x1f, 0x8b}
 	bzip2Header = []byte{0x42, 0x5a, 0x68}
 	xzHeader    = []byte{0xfd, 0x37, 0x7a, 0x58, 0x5a, 0x00}
+	zstdHeader  = []byte{0x28, 0xb5, 0x2f, 0xfd}
 )
 
-// XzReader is an io.ReadCloser which decompresses xz compressed data.
-type XzReader struct {
+// commandReader is an io.ReadCloser which streams the output of a command line executable that
+// decompresses its standard input.
+type commandReader struct {
 	io.ReadCloser
 	cmd     *exec.Cmd
 	closech chan error
 }
 
-// NewXzReader shells out to a command line xz executable (if
-// available) to decompress the given io.Reader using the xz
-// compression format and returns an *XzReader.
-// It is the caller's responsibility to call Close on the XzReader when done.
-func NewXzReader(r io.Reader) (*XzReader, error) {
+// newCommandReader runs the given executable, if available, with the given io.Reader as its
+// standard input and returns a *commandReader reading its standard output.
+func newCommandReader(r io.Reader, name string, args ...string) (*commandReader, error) {
 	rpipe, wpipe := io.Pipe()
-	ex, err := exec.LookPath("xz")
+	ex, err := exec.LookPath(name)
 	if err != nil {
 		return nil, err
 	}
-	cmd := exec.Command(ex, "--decompress", "--stdout")
+	cmd := exec.Command(ex, args...)
 
 	closech := make(chan error)
 
@@ -71,15 +104,48 @@ func NewXzReader(r io.Reader) (*XzReader, error) {
 		closech <- err
 	}()
 
-	return &XzReader{rpipe, cmd, closech}, nil
+	return &commandReader{rpipe, cmd, closech}, nil
 }
 
-func (r *XzReader) Close() error {
+func (r *commandReader) Close() error {
 	r.ReadCloser.Close()
 	r.cmd.Process.Kill()
 	return <-r.closech
 }
 
+// XzReader is an io.ReadCloser which decompresses xz compressed data.
+type XzReader struct {
+	*commandReader
+}
+
+// NewXzReader shells out to a command line xz executable (if
+// available) to decompress the given io.Reader using the xz
+// compression format and returns an *XzReader.
+// It is the caller's responsibility to call Close on the XzReader when done.
+func NewXzReader(r io.Reader) (*XzReader, error) {
+	cr, err := newCommandReader(r, "xz", "--decompress", "--stdout")
+	if err != nil {
+		return nil, err
+	}
+	return &XzReader{cr}, nil
+}
+
+// ZstdReader is an io.ReadCloser which decompresses zstd compressed data.
+type ZstdReader struct {
+	*commandReader
+}
+
+// NewZstdReader shells out to a command line zstd executable (if available) to decompress the
+// given io.Reader using the zstd compression format and returns a *ZstdReader.
+// It is the caller's responsibility to call Close on the ZstdReader when done.
+func NewZstdReader(r io.Reader) (*ZstdReader, error) {
+	cr, err := newCommandReader(r, "zstd", "--decompress", "--stdout")
+	if err != nil {
+		return nil, err
+	}
+	return &ZstdReader{cr}, nil
+}
+
 // TarReadCloser embeds a *tar.Reader and the related io.Closer
 // It is the caller's responsibility to call Close on TarReadCloser when
 // done.
@@ -92,12 +158,100 @@ func (r *TarReadCloser) Close() error {
 	return r.Closer.Close()
 }
 
+// ExtractionLimits bounds the memory that the extraction of an archive uses. A zero limit means
+// that there is no limit.
+type ExtractionLimits struct {
+	// MaxFileSize is the maximum size of a single extracted file.
+	MaxFileSize int64
+
+	// MaxExtractedSize is the maximum size of all the extracted files together.
+	MaxExtractedSize int64
+
+	// MaxPatternMatches is the maximum number of files that a pattern of the files to extract
+	// matches: the next files that only match full patterns are not extracted.
+	MaxPatternMatches int
+
+	// MaxExecutableSize is the maximum size of an executable that only the patterns prefixed with
+	// ExecutablePrefix designate. The bigger executables are skipped instead of failing the
+	// extraction.
+	MaxExecutableSize int64
+
+	// MaxExtractedExecutablesSize is the maximum size of those executables together, which don't
+	// count in MaxExtractedSize. The next executables are skipped.
+	MaxExtractedExecutablesSize int64
+}
+
+// MatchFile returns whether the given path of an archive is one of the files that the given
+// pattern designates. Patterns with the special characters of path.Match are matched with it,
+// except that their ** elements match any number of directories, whereas the other patterns
+// designate the paths that start with them, such as the files of a directory. The mode of the
+// files that the patterns prefixed with ExecutablePrefix designate isn't verified.
+func MatchFile(filename, pattern string) bool {
+	pattern = strings.TrimPrefix(pattern, ExecutablePrefix)
+	if !strings.ContainsAny(pattern, `*?[\`) {
+		return strings.HasPrefix(filename, pattern)
+	}
+	if !strings.Contains(pattern, "**") {
+		matched, err := path.Match(pattern, filename)
+		return err == nil && matched
+	}
+	return matchElements(strings.Split(filename, "/"), strings.Split(pattern, "/"))
+}
+
+// matchElements returns whether the elements of a path match the ones of a pattern, whose **
+// elements match any number of elements.
+func matchElements(elements, patterns []string) bool {
+	for len(patterns) > 0 {
+		if patterns[0] == "**" {
+			for i := 0; i <= len(elements); i++ {
+				if matchElements(elements[i:], patterns[1:]) {
+					return true
+				}
+			}
+			return false
+		}
+
+		if len(elements) == 0 {
+			return false
+		}
+		if matched, err := path.Match(patterns[0], elements[0]); err != nil || !matched {
+			return false
+		}
+		elements, patterns = elements[1:], patterns[1:]
+	}
+	return len(elements) == 0
+}
+
+// MatchingFiles returns the sorted paths of the files, as extracted by SelectivelyExtractArchive,
+// that the given pattern designates. The whiteouts are left out.
+func MatchingFiles(data map[string][]byte, pattern string) []string {
+	var files []string
+	for filename := range data {
+		if _, isWhiteout := whiteoutTarget(filename); !isWhiteout && MatchFile(filename, pattern) {
+			files = append(files, filename)
+		}
+	}
+	sort.Strings(files)
+	return files
+}
+
 // SelectivelyExtractArchive extracts the specified files and folders
-// from targz data read from the given reader and store them in a map indexed by file paths
-func SelectivelyExtractArchive(r io.Reader, prefix string, toExtract []string, maxFileSize int64) (map[string][]byte, error) {
+// from targz data read from the given reader and store them in a map indexed by file paths.
+// The files to extract are designated by patterns, see MatchFile.
+// The whiteouts that delete them, or one of their directories, are stored as well, with a nil
+// content, so that IsWhitedOut can tell they were deleted. The directories that overlay marks as
+// opaque are stored as if they contained a WhiteoutOpaqueDir file.
+//
+// Archives with absolute paths, or paths that leave the archive, are rejected, as well as the
+// files to extract that link outside of the archive. The links to the other extracted files are
+// stored with the content of their target.
+func SelectivelyExtractArchive(r io.Reader, prefix string, toExtract []string, limits ExtractionLimits) (map[string][]byte, error) {
 	data := make(map[string][]byte)
+	links := make(map[string]string)
+	matches := make([]int, len(toExtract))
+	var extracted, extractedExecutables int64
 
-	// Create a tar or tar/tar-gzip/tar-bzip2/tar-xz reader
+	// Create a tar or tar/tar-gzip/tar-bzip2/tar-xz/tar-zstd reader
 	tr, err := getTarReader(r)
 	if err != nil {
 		return data, ErrCouldNotExtract
@@ -105,15 +259,24 @@ func SelectivelyExtractArchive(r io.Reader, prefix string, toExtract []string, m
 	defer tr.Close()
 
 	// For each element in the archive
-	for {
+	for first := true; ; first = false {
 		hdr, err := tr.Next()
 		if err == io.EOF {
 			break
 		}
+		if first && (err == tar.ErrHeader || err == io.ErrUnexpectedEOF) {
+			// The data doesn't even start like a tar archive.
+			return data, ErrUnsupportedArchive
+		}
 		if err != nil {
 			return data, ErrCouldNotExtract
 		}
 
+		// Reject the elements that would be outside of the archive.
+		if !isSafePath(hdr.Name) {
+			return data, ErrUnsafePath
+		}
+
 		// Get element filename
 		filename := hdr.Name
 		filename = strings.TrimPrefix(filename, "./")
@@ -121,38 +284,271 @@ func SelectivelyExtractArchive(r io.Reader, prefix string, toExtract []string, m
 			filename = strings.TrimPrefix(filename, prefix)
 		}
 
+		// Record the whiteouts that delete the elements to extract.
+		if hdr.Typeflag == tar.TypeDir && hdr.Xattrs[opaqueXattr] == "y" {
+			filename = strings.TrimSuffix(filename, "/") + "/" + WhiteoutOpaqueDir
+		}
+		if deleted, ok := whiteoutTarget(filename); ok {
+			if isWhiteoutToExtract(deleted, toExtract) {
+				data[filename] = nil
+			}
+			continue
+		}
+
 		// Determine if we should extract the element
-		toBeExtracted := false
-		for _, s := range toExtract {
-			if strings.HasPrefix(filename, s) {
-				toBeExtracted = true
-				break
+		isExecutable := hdr.Typeflag == tar.TypeReg && hdr.Mode&0111 != 0
+		var patterns []int
+		onlyExecutable := true
+		for i, s := range toExtract {
+			if strings.HasPrefix(s, ExecutablePrefix) && !isExecutable {
+				continue
 			}
+			if MatchFile(filename, s) {
+				patterns = append(patterns, i)
+				onlyExecutable = onlyExecutable && strings.HasPrefix(s, ExecutablePrefix)
+			}
+		}
+		if len(patterns) == 0 {
+			continue
+		}
+		if hdr.Typeflag != tar.TypeSymlink && hdr.Typeflag != tar.TypeLink && hdr.Typeflag != tar.TypeReg {
+			continue
 		}
 
-		if toBeExtracted {
-			// File size limit
-			if maxFileSize > 0 && hdr.Size > maxFileSize {
-				return data, ErrExtractedFileTooBig
+		// The executables are extracted on a best-effort basis, within their own limits.
+		if onlyExecutable {
+			if limits.MaxExecutableSize > 0 && hdr.Size > limits.MaxExecutableSize {
+				continue
+			}
+			if limits.MaxExtractedExecutablesSize > 0 && extractedExecutables+hdr.Size > limits.MaxExtractedExecutablesSize {
+				continue
 			}
+		}
 
-			// Extract the element
-			if hdr.Typeflag == tar.TypeSymlink || hdr.Typeflag == tar.TypeLink || hdr.Typeflag == tar.TypeReg {
-				d, _ := ioutil.ReadAll(tr)
-				data[filename] = d
+		// Skip the element if the patterns it matches matched enough elements already.
+		if limits.MaxPatternMatches > 0 {
+			full := true
+			for _, i := range patterns {
+				full = full && matches[i] >= limits.MaxPatternMatches
+			}
+			if full {
+				continue
 			}
 		}
+		for _, i := range patterns {
+			matches[i]++
+		}
+
+		// Remember the links, which are resolved once every file is extracted.
+		switch hdr.Typeflag {
+		case tar.TypeSymlink, tar.TypeLink:
+			target, ok := linkTarget(filename, hdr, prefix)
+			if !ok {
+				return data, ErrUnsafePath
+			}
+			links[filename] = target
+			data[filename] = []byte{}
+			continue
+		}
+
+		if onlyExecutable {
+			d, err := ioutil.ReadAll(io.LimitReader(tr, hdr.Size))
+			if err != nil {
+				return data, ErrCouldNotExtract
+			}
+			extractedExecutables += int64(len(d))
+			data[filename] = d
+			continue
+		}
+
+		// Size limits, which are verified again while reading as the headers can't be trusted.
+		if limits.MaxFileSize > 0 && hdr.Size > limits.MaxFileSize {
+			return data, ErrExtractedFileTooBig
+		}
+		if limits.MaxExtractedSize > 0 && extracted+hdr.Size > limits.MaxExtractedSize {
+			return data, ErrLayerTooLarge
+		}
+
+		// Extract the element
+		var fr io.Reader = tr
+		if limits.MaxFileSize > 0 {
+			fr = io.LimitReader(fr, limits.MaxFileSize+1)
+		}
+		if limits.MaxExtractedSize > 0 {
+			fr = io.LimitReader(fr, limits.MaxExtractedSize-extracted+1)
+		}
+		d, err := ioutil.ReadAll(fr)
+		if err != nil {
+			return data, ErrCouldNotExtract
+		}
+		if limits.MaxFileSize > 0 && int64(len(d)) > limits.MaxFileSize {
+			return data, ErrExtractedFileTooBig
+		}
+		extracted += int64(len(d))
+		if limits.MaxExtractedSize > 0 && extracted > limits.MaxExtractedSize {
+			return data, ErrLayerTooLarge
+		}
+		data[filename] = d
 	}
 
+	resolveLinks(data, links)
+
 	return data, nil
 }
 
+// isSafePath returns whether the given path of an archive stays within the archive.
+func isSafePath(name string) bool {
+	if strings.HasPrefix(name, "/") {
+		return false
+	}
+	for _, element := range strings.Split(name, "/") {
+		if element == ".." {
+			return false
+		}
+	}
+	return true
+}
+
+// linkTarget returns the path, relative to the root of the archive, that the given link entry
+// points to, and whether this path stays within the archive.
+func linkTarget(filename string, hdr *tar.Header, prefix string) (string, bool) {
+	if hdr.Typeflag == tar.TypeLink {
+		// Hard links are relative to the root of the archive.
+		if !isSafePath(hdr.Linkname) {
+			return "", false
+		}
+		target := strings.TrimPrefix(hdr.Linkname, "./")
+		if prefix != "" {
+			target = strings.TrimPrefix(target, prefix)
+		}
+		return path.Clean(target), true
+	}
+
+	// Absolute symbolic links are relative to the root of the archive, which is the root of the
+	// filesystem it is a layer of, whereas the relative ones are relative to their directory.
+	if strings.HasPrefix(hdr.Linkname, "/") {
+		return path.Clean(strings.TrimPrefix(hdr.Linkname, "/")), true
+	}
+	target := path.Join(path.Dir(filename), hdr.Linkname)
+	if target == ".." || strings.HasPrefix(target, "../") {
+		return "", false
+	}
+	return target, true
+}
+
+// resolveLinks sets the content of the extracted links whose targets, possibly through other
+// links, have been extracted as well. The other links are left empty.
+func resolveLinks(data map[string][]byte, links map[string]string) {
+	for filename := range links {
+		target, ok := links[filename]
+		for hops := 0; ok && hops < len(links); hops++ {
+			if d, extracted := data[target]; extracted {
+				if _, isLink := links[target]; !isLink {
+					data[filename] = d
+					break
+				}
+			}
+			target, ok = links[target]
+		}
+	}
+}
+
+// whiteoutTarget returns the path that the given whiteout file deletes from the lower layers,
+// which ends with a slash for opaque directories, and whether the file is a whiteout.
+func whiteoutTarget(filename string) (string, bool) {
+	dir, base := path.Split(filename)
+	if base == WhiteoutOpaqueDir {
+		return dir, true
+	}
+	if strings.HasPrefix(base, WhiteoutPrefix) {
+		return dir + strings.TrimPrefix(base, WhiteoutPrefix), true
+	}
+	return "", false
+}
+
+// isWhiteoutToExtract returns whether the deletion of the given path, which ends with a slash for
+// the content of a directory, deletes some of the elements to extract.
+func isWhiteoutToExtract(deleted string, toExtract []string) bool {
+	for _, s := range toExtract {
+		if strings.HasPrefix(s, ExecutablePrefix) {
+			// Deleting an executable doesn't delete what its detectors found in lower layers.
+			continue
+		}
+		if MatchFile(deleted, s) || containsMatchingFiles(strings.TrimSuffix(deleted, "/"), s) {
+			return true
+		}
+	}
+	return false
+}
+
+// containsMatchingFiles returns whether the given directory contains some of the files that the
+// given pattern designates, see MatchFile. The directories that a ** element matches entirely
+// are not considered: deleting any directory would otherwise delete the files of such patterns.
+func containsMatchingFiles(dir, pattern string) bool {
+	if !strings.ContainsAny(pattern, `*?[\`) {
+		return strings.HasPrefix(pattern, dir+"/")
+	}
+
+	elements, patterns := strings.Split(dir, "/"), strings.Split(pattern, "/")
+	for i := 1; i <= len(patterns); i++ {
+		if patterns[i-1] != "**" && matchElements(elements, patterns[:i]) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsWhitedOut returns whether the given file, as extracted by SelectivelyExtractArchive, has been
+// deleted from the lower layers by a whiteout, either of itself or of one of its directories, and
+// has not been added back. The file may be a pattern, see MatchFile, in which case it is whited out
+// when some of the files it designates are.
+func IsWhitedOut(data map[string][]byte, filename string) bool {
+	if strings.ContainsAny(filename, `*?[\`) {
+		return len(DeletedPaths(data, filename)) > 0
+	}
+
+	filename = strings.TrimSuffix(filename, "/")
+	if _, ok := data[filename]; ok {
+		return false
+	}
+
+	for current := filename; current != "" && current != "."; current = path.Dir(current) {
+		dir, base := path.Split(current)
+		if _, ok := data[dir+WhiteoutPrefix+base]; ok {
+			return true
+		}
+		if _, ok := data[current+"/"+WhiteoutOpaqueDir]; ok {
+			return true
+		}
+		if dir == "" {
+			break
+		}
+	}
+	return false
+}
+
+// DeletedPaths returns the sorted paths, deleted by the whiteouts extracted by
+// SelectivelyExtractArchive, of the files that the given pattern designates or of one of their
+// directories. The paths of the directories whose content is deleted end with a slash.
+func DeletedPaths(data map[string][]byte, pattern string) []string {
+	var paths []string
+	for whiteout := range data {
+		if deleted, ok := whiteoutTarget(whiteout); ok && isWhiteoutToExtract(deleted, []string{pattern}) {
+			paths = append(paths, deleted)
+		}
+	}
+	sort.Strings(paths)
+	return paths
+}
+
 // getTarReader returns a TarReaderCloser associated with the specified io.Reader.
 //
-// Gzip/Bzip2/XZ detection is done by using the magic numbers:
+// Gzip/Bzip2/XZ/Zstd detection is done by using the magic numbers:
 // Gzip: the first two bytes should be 0x1f and 0x8b. Defined in the RFC1952.
 // Bzip2: the first three bytes should be 0x42, 0x5a and 0x68. No RFC.
 // XZ: the first three bytes should be 0xfd, 0x37, 0x7a, 0x58, 0x5a, 0x00. No RFC.
+// Zstd: the first four bytes should be 0x28, 0xb5, 0x2f and 0xfd. Defined in the RFC8478.
+// Other data is read as a plain tar archive. The data is decompressed as it is read.
 func getTarReader(r io.Reader) (*TarReadCloser, error) {
 	br := bufio.NewReader(r)
 	header, err := br.Peek(readLen)
@@ -173,6 +569,12 @@ func getTarReader(r io.Reader) (*TarReadCloser, error) {
 				return nil, err
 			}
 			return &TarReadCloser{tar.NewReader(xzr), xzr}, nil
+		case bytes.HasPrefix(header, zstdHeader):
+			zstdr, err := NewZstdReader(br)
+			if err != nil {
+				return nil, err
+			}
+			return &TarReadCloser{tar.NewReader(zstdr), zstdr}, nil
 		}
 	}
 
@@ -19,6 +19,7 @@ import (
 	"database/sql/driver"
 	"errors"
 	"fmt"
+	"strings"
 )
 
 // Priority defines a vulnerability priority
@@ -75,6 +76,18 @@ func (p Priority) IsValid() bool {
 	return false
 }
 
+// NormalizePriority returns the known priority that matches the given one case-insensitively
+// (e.g. "HIGH" gives High), or Unknown and false if there is none.
+func NormalizePriority(p Priority) (Priority, bool) {
+	for _, pp := range Priorities {
+		if strings.EqualFold(string(p), string(pp)) {
+			return pp, true
+		}
+	}
+
+	return Unknown, false
+}
+
 // Compare compares two priorities
 func (p Priority) Compare(p2 Priority) int {
 	var i1, i2 int
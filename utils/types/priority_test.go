@@ -30,3 +30,21 @@ func TestIsValid(t *testing.T) {
 	assert.False(t, Priority("Test").IsValid())
 	assert.True(t, Unknown.IsValid())
 }
+
+func TestNormalizePriority(t *testing.T) {
+	for _, test := range []struct {
+		priority Priority
+		expected Priority
+		valid    bool
+	}{
+		{High, High, true},
+		{"HIGH", High, true},
+		{"defcon1", Defcon1, true},
+		{"Important", Unknown, false},
+		{"", Unknown, false},
+	} {
+		priority, valid := NormalizePriority(test.priority)
+		assert.Equal(t, test.expected, priority, "%q", test.priority)
+		assert.Equal(t, test.valid, valid, "%q", test.priority)
+	}
+}
@@ -36,6 +36,12 @@ var (
 	// MaxVersion is a special package version which is always sorted last
 	MaxVersion = Version{version: "#MAXV#"}
 
+	// MaxVersionJSON is how MaxVersion is represented in JSON, as it means that no version is fixed.
+	MaxVersionJSON = "None"
+	// MinVersionJSON is how MinVersion is represented in JSON, as it means that no version is
+	// affected.
+	MinVersionJSON = "NotAffected"
+
 	versionAllowedSymbols  = []rune{'.', '-', '+', '~', ':', '_'}
 	revisionAllowedSymbols = []rune{'.', '+', '~', '_'}
 )
@@ -129,6 +135,26 @@ func NewVersionUnsafe(str string) Version {
 //
 // It uses the dpkg-1.17.25's algorithm  (lib/version.c)
 func (a Version) Compare(b Version) int {
+	return a.compare(b, func(a, b string) int { return signum(verrevcmp(a, b)) })
+}
+
+// CompareFormat compares two package versions using the rules of the given format. The versions
+// of an unknown format are compared like Debian versions, as Compare does.
+func (a Version) CompareFormat(b Version, format VersionFormat) int {
+	switch format {
+	case RpmVersionFormat:
+		return a.compare(b, rpmvercmp)
+	case ApkVersionFormat:
+		return a.compare(b, apkvercmp)
+	case Pep440VersionFormat:
+		return a.compare(b, pep440cmp)
+	}
+	return a.Compare(b)
+}
+
+// compare compares the epochs of the versions, and then their versions and revisions using the
+// given function.
+func (a Version) compare(b Version, cmp func(a, b string) int) int {
 	// Quick check
 	if a == b {
 		return 0
@@ -151,13 +177,13 @@ func (a Version) Compare(b Version) int {
 	}
 
 	// Compare version
-	rc := verrevcmp(a.version, b.version)
+	rc := cmp(a.version, b.version)
 	if rc != 0 {
-		return signum(rc)
+		return rc
 	}
 
 	// Compare revision
-	return signum(verrevcmp(a.revision, b.revision))
+	return cmp(a.revision, b.revision)
 }
 
 // String returns the string representation of a Version
@@ -172,28 +198,61 @@ func (v Version) String() (s string) {
 	return
 }
 
+// MarshalJSON represents MaxVersion and MinVersion by MaxVersionJSON and MinVersionJSON, and
+// any other Version by its string representation.
 func (v Version) MarshalJSON() ([]byte, error) {
+	switch v {
+	case MaxVersion:
+		return json.Marshal(MaxVersionJSON)
+	case MinVersion:
+		return json.Marshal(MinVersionJSON)
+	}
 	return json.Marshal(v.String())
 }
 
-func (v *Version) UnmarshalJSON(b []byte) (err error) {
+// UnmarshalJSON parses a Version, MaxVersionJSON or MinVersionJSON. The latter two are matched
+// case-insensitively.
+func (v *Version) UnmarshalJSON(b []byte) error {
 	var str string
-	json.Unmarshal(b, &str)
-	vp := NewVersionUnsafe(str)
+	if err := json.Unmarshal(b, &str); err != nil {
+		return err
+	}
+
+	switch {
+	case strings.EqualFold(str, MaxVersionJSON):
+		*v = MaxVersion
+		return nil
+	case strings.EqualFold(str, MinVersionJSON):
+		*v = MinVersion
+		return nil
+	}
+
+	vp, err := NewVersion(str)
+	if err != nil {
+		return err
+	}
 	*v = vp
-	return
+	return nil
 }
 
+// Scan parses a Version stored in a database, in which MaxVersion and MinVersion are stored as
+// their string representation. A NULL value is scanned as the zero Version.
 func (v *Version) Scan(value interface{}) (err error) {
-	val, ok := value.([]byte)
-	if !ok {
-		return errors.New("could not scan a Version from a non-string input")
+	switch val := value.(type) {
+	case nil:
+		*v = Version{}
+	case []byte:
+		*v, err = NewVersion(string(val))
+	case string:
+		*v, err = NewVersion(val)
+	default:
+		err = errors.New("could not scan a Version from a non-string input")
 	}
-	*v, err = NewVersion(string(val))
 	return
 }
 
-func (v *Version) Value() (driver.Value, error) {
+// Value returns the string representation of the Version, which Scan parses back.
+func (v Version) Value() (driver.Value, error) {
 	return v.String(), nil
 }
 
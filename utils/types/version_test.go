@@ -240,4 +240,46 @@ func TestVersionJson(t *testing.T) {
 	var v2 Version
 	v2.UnmarshalJSON(json)
 	assert.Equal(t, v, v2)
+
+	// Sentinels
+	for version, expected := range map[Version]string{MaxVersion: MaxVersionJSON, MinVersion: MinVersionJSON} {
+		json, err := version.MarshalJSON()
+		assert.Nil(t, err)
+		assert.Equal(t, "\""+expected+"\"", string(json))
+
+		var v3 Version
+		assert.Nil(t, v3.UnmarshalJSON(json))
+		assert.Equal(t, version, v3)
+	}
+	for str, expected := range map[string]Version{`"none"`: MaxVersion, `"NONE"`: MaxVersion, `"notaffected"`: MinVersion} {
+		var v3 Version
+		assert.Nil(t, v3.UnmarshalJSON([]byte(str)), str)
+		assert.Equal(t, expected, v3, str)
+	}
+
+	// Invalid versions
+	var v4 Version
+	assert.NotNil(t, v4.UnmarshalJSON([]byte(`""`)))
+	assert.NotNil(t, v4.UnmarshalJSON([]byte(`"abc"`)))
+	assert.NotNil(t, v4.UnmarshalJSON([]byte(`1`)))
+}
+
+func TestVersionSQL(t *testing.T) {
+	for _, version := range []Version{NewVersionUnsafe("57:1.2.3abYZ+~-4-5"), MaxVersion, MinVersion} {
+		value, err := version.Value()
+		assert.Nil(t, err)
+
+		var fromBytes, fromString Version
+		if assert.Nil(t, fromBytes.Scan([]byte(value.(string)))) {
+			assert.Equal(t, version, fromBytes)
+		}
+		if assert.Nil(t, fromString.Scan(value)) {
+			assert.Equal(t, version, fromString)
+		}
+	}
+
+	v := MaxVersion
+	assert.Nil(t, v.Scan(nil))
+	assert.Equal(t, Version{}, v)
+	assert.NotNil(t, v.Scan(42))
 }
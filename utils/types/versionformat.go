@@ -0,0 +1,331 @@
+// Copyright 2015 clair authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package types
+
+import (
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// VersionFormat is the format of the package versions of a Namespace, which tells how they are
+// compared.
+type VersionFormat string
+
+const (
+	// DpkgVersionFormat is the format of the Debian and Ubuntu package versions.
+	DpkgVersionFormat VersionFormat = "dpkg"
+	// RpmVersionFormat is the format of the CentOS, Red Hat and Fedora package versions.
+	RpmVersionFormat VersionFormat = "rpm"
+	// ApkVersionFormat is the format of the Alpine package versions.
+	ApkVersionFormat VersionFormat = "apk"
+	// Pep440VersionFormat is the format of the Python package versions, see NewPep440Version.
+	Pep440VersionFormat VersionFormat = "pep440"
+)
+
+// rpmvercmp compares two versions, or two releases, like rpm does (lib/rpmvercmp.c): they are made
+// of alphabetic and numeric segments, compared one by one, and of separators that don't matter.
+// Numeric segments are newer than alphabetic ones and tildes sort before anything.
+func rpmvercmp(a, b string) int {
+	if a == b {
+		return 0
+	}
+
+	for {
+		a = strings.TrimLeftFunc(a, isRpmSeparator)
+		b = strings.TrimLeftFunc(b, isRpmSeparator)
+
+		// Tildes sort before anything, even the end of the version.
+		if strings.HasPrefix(a, "~") || strings.HasPrefix(b, "~") {
+			if !strings.HasPrefix(a, "~") {
+				return 1
+			}
+			if !strings.HasPrefix(b, "~") {
+				return -1
+			}
+			a, b = a[1:], b[1:]
+			continue
+		}
+
+		if a == "" || b == "" {
+			break
+		}
+
+		// Grab the next segments, which are both numeric or alphabetic, depending on the first one.
+		isSegment := isRpmAlpha
+		numeric := isASCIIDigit(rune(a[0]))
+		if numeric {
+			isSegment = isASCIIDigit
+		}
+		segA, segB := span(a, isSegment), span(b, isSegment)
+		a, b = a[len(segA):], b[len(segB):]
+
+		// Segments of different types: the numeric one is newer.
+		if segB == "" {
+			if numeric {
+				return 1
+			}
+			return -1
+		}
+
+		if numeric {
+			// Without leading zeros, the longest number is the largest.
+			segA, segB = strings.TrimLeft(segA, "0"), strings.TrimLeft(segB, "0")
+			if len(segA) != len(segB) {
+				return signum(len(segA) - len(segB))
+			}
+		}
+		if rc := strings.Compare(segA, segB); rc != 0 {
+			return rc
+		}
+	}
+
+	// The version that has segments left is newer.
+	switch {
+	case a == b:
+		return 0
+	case a == "":
+		return -1
+	}
+	return 1
+}
+
+// apkPreReleaseSuffixes are the suffixes of the Alpine versions that sort before the release.
+var apkPreReleaseSuffixes = strings.NewReplacer("_alpha", "~alpha", "_beta", "~beta", "_pre", "~pre", "_rc", "~rc")
+
+// apkvercmp compares two Alpine versions, or two revisions: they compare like Debian versions,
+// except that the _alpha, _beta, _pre and _rc suffixes denote versions older than the release.
+func apkvercmp(a, b string) int {
+	return signum(verrevcmp(apkPreReleaseSuffixes.Replace(a), apkPreReleaseSuffixes.Replace(b)))
+}
+
+// pep440Regexp matches the versions of PEP 440, in any of the spellings it allows.
+var pep440Regexp = regexp.MustCompile(`^v?(?:([0-9]+)!)?([0-9]+(?:\.[0-9]+)*)` +
+	`(?:[-_.]?(a|b|c|rc|alpha|beta|pre|preview)[-_.]?([0-9]+)?)?` +
+	`(?:-([0-9]+)|[-_.]?(post|rev|r)[-_.]?([0-9]+)?)?` +
+	`(?:[-_.]?(dev)[-_.]?([0-9]+)?)?` +
+	`(?:\+([a-z0-9]+(?:[-_.][a-z0-9]+)*))?$`)
+
+// pep440Version holds the parts of a PEP 440 version that matter to comparisons. The numbers are
+// kept as strings without leading zeros, which compare like numbers of any size do.
+type pep440Version struct {
+	epoch   string
+	release []string
+	// pre is the kind of pre-release, "a", "b" or "rc", and preN its number.
+	pre, preN   string
+	post, dev   bool
+	postN, devN string
+	local       []string
+}
+
+// parsePep440 parses a PEP 440 version.
+func parsePep440(s string) (pep440Version, bool) {
+	m := pep440Regexp.FindStringSubmatch(strings.ToLower(strings.TrimSpace(s)))
+	if m == nil {
+		return pep440Version{}, false
+	}
+
+	number := func(n string) string {
+		if n = strings.TrimLeft(n, "0"); n == "" {
+			return "0"
+		}
+		return n
+	}
+
+	v := pep440Version{epoch: number(m[1])}
+	for _, r := range strings.Split(m[2], ".") {
+		v.release = append(v.release, number(r))
+	}
+	switch m[3] {
+	case "":
+	case "a", "alpha":
+		v.pre, v.preN = "a", number(m[4])
+	case "b", "beta":
+		v.pre, v.preN = "b", number(m[4])
+	default:
+		v.pre, v.preN = "rc", number(m[4])
+	}
+	if m[5] != "" {
+		v.post, v.postN = true, number(m[5])
+	} else if m[6] != "" {
+		v.post, v.postN = true, number(m[7])
+	}
+	if m[8] != "" {
+		v.dev, v.devN = true, number(m[9])
+	}
+	if m[10] != "" {
+		v.local = strings.FieldsFunc(m[10], func(r rune) bool { return r == '-' || r == '_' || r == '.' })
+	}
+	return v, true
+}
+
+// String returns the normalized form of the version, without its epoch.
+func (v pep440Version) String() string {
+	s := strings.Join(v.release, ".")
+	if v.pre != "" {
+		s += v.pre + v.preN
+	}
+	if v.post {
+		s += ".post" + v.postN
+	}
+	if v.dev {
+		s += ".dev" + v.devN
+	}
+	if len(v.local) > 0 {
+		s += "+" + strings.Join(v.local, ".")
+	}
+	return s
+}
+
+// NewPep440Version parses a Python package version, as specified by PEP 440, into a Version
+// whose epoch is the one of the PEP 440 version and whose version is its normalized form, e.g.
+// "1!2.0-RC1" gives "1:2.0rc1". Such Versions compare with Pep440VersionFormat.
+func NewPep440Version(str string) (Version, error) {
+	v, ok := parsePep440(str)
+	if !ok {
+		return Version{}, errors.New("invalid PEP 440 version")
+	}
+	epoch, err := strconv.Atoi(v.epoch)
+	if err != nil {
+		return Version{}, errors.New("invalid PEP 440 version epoch")
+	}
+	return Version{epoch: epoch, version: v.String()}, nil
+}
+
+// pep440cmp compares two PEP 440 versions, without epochs: the releases, whose missing segments
+// are zeros, and then the pre-releases, post-releases, development releases and local versions.
+// A development release sorts before the pre-releases of its release. The versions that are not
+// PEP 440 ones compare like Debian versions.
+func pep440cmp(a, b string) int {
+	if a == b {
+		return 0
+	}
+	va, okA := parsePep440(a)
+	vb, okB := parsePep440(b)
+	if !okA || !okB {
+		return signum(verrevcmp(a, b))
+	}
+
+	// Releases.
+	for i := 0; i < len(va.release) || i < len(vb.release); i++ {
+		ra, rb := "0", "0"
+		if i < len(va.release) {
+			ra = va.release[i]
+		}
+		if i < len(vb.release) {
+			rb = vb.release[i]
+		}
+		if rc := numcmp(ra, rb); rc != 0 {
+			return rc
+		}
+	}
+
+	// Pre-releases sort before the final release, and so do the development releases of the final
+	// release, before the pre-releases.
+	preRank := func(v pep440Version) int {
+		switch {
+		case v.pre == "" && !v.post && v.dev:
+			return -1
+		case v.pre == "":
+			return 1
+		}
+		return 0
+	}
+	if rc := signum(preRank(va) - preRank(vb)); rc != 0 {
+		return rc
+	}
+	if va.pre != "" {
+		if rc := strings.Compare(va.pre, vb.pre); rc != 0 {
+			return rc
+		}
+		if rc := numcmp(va.preN, vb.preN); rc != 0 {
+			return rc
+		}
+	}
+
+	// Post-releases sort after the release they follow.
+	if va.post != vb.post {
+		if va.post {
+			return 1
+		}
+		return -1
+	}
+	if rc := numcmp(va.postN, vb.postN); rc != 0 {
+		return rc
+	}
+
+	// Development releases sort before the release they precede.
+	if va.dev != vb.dev {
+		if va.dev {
+			return -1
+		}
+		return 1
+	}
+	if rc := numcmp(va.devN, vb.devN); rc != 0 {
+		return rc
+	}
+
+	// Local versions sort after the public version, their numeric segments after the alphanumeric
+	// ones.
+	for i := 0; i < len(va.local) && i < len(vb.local); i++ {
+		la, lb := va.local[i], vb.local[i]
+		numA, numB := span(la, isASCIIDigit) == la, span(lb, isASCIIDigit) == lb
+		switch {
+		case numA && numB:
+			if rc := numcmp(strings.TrimLeft(la, "0"), strings.TrimLeft(lb, "0")); rc != 0 {
+				return rc
+			}
+		case numA:
+			return 1
+		case numB:
+			return -1
+		default:
+			if rc := strings.Compare(la, lb); rc != 0 {
+				return rc
+			}
+		}
+	}
+	return signum(len(va.local) - len(vb.local))
+}
+
+// numcmp compares two numbers without leading zeros.
+func numcmp(a, b string) int {
+	if len(a) != len(b) {
+		return signum(len(a) - len(b))
+	}
+	return strings.Compare(a, b)
+}
+
+func isRpmSeparator(r rune) bool {
+	return r != '~' && !isASCIIDigit(r) && !isRpmAlpha(r)
+}
+
+func isRpmAlpha(r rune) bool {
+	return r < unicode.MaxASCII && unicode.IsLetter(r)
+}
+
+func isASCIIDigit(r rune) bool {
+	return r >= '0' && r <= '9'
+}
+
+// span returns the longest prefix of s whose runes satisfy f.
+func span(s string, f func(rune) bool) string {
+	if i := strings.IndexFunc(s, func(r rune) bool { return !f(r) }); i >= 0 {
+		return s[:i]
+	}
+	return s
+}
@@ -0,0 +1,149 @@
+// Copyright 2015 clair authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package types
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompareFormat(t *testing.T) {
+	cases := []struct {
+		v1       string
+		expected int
+		v2       string
+		format   VersionFormat
+	}{
+		// rpm, based on the tests of rpm (tests/rpmvercmp.at)
+		{"1.0", EQUAL, "1.0", RpmVersionFormat},
+		{"1.0", LESS, "2.0", RpmVersionFormat},
+		{"2.0.1", GREATER, "2.0", RpmVersionFormat},
+		{"2.0.1a", GREATER, "2.0.1", RpmVersionFormat},
+		{"5.5p1", LESS, "5.5p2", RpmVersionFormat},
+		{"5.5p10", GREATER, "5.5p1", RpmVersionFormat},
+		{"10xyz", LESS, "10.1xyz", RpmVersionFormat},
+		{"1.0010", GREATER, "1.9", RpmVersionFormat},
+		{"1.05", EQUAL, "1.5", RpmVersionFormat},
+		{"1.0", GREATER, "1", RpmVersionFormat},
+		{"2.0", EQUAL, "2_0", RpmVersionFormat},
+		{"1a+", EQUAL, "1a_", RpmVersionFormat},
+		{"1.0~rc1", LESS, "1.0", RpmVersionFormat},
+		{"1.0~rc1", LESS, "1.0~rc2", RpmVersionFormat},
+		{"1.0~rc1~git123", LESS, "1.0~rc1", RpmVersionFormat},
+		{"1.0-1.el7", EQUAL, "1.0-1.el7", RpmVersionFormat},
+		{"1.0.2k-8.el7", GREATER, "1.0.1e-42.el7", RpmVersionFormat},
+		{"1.0.2k-8.el7", LESS, "1.0.2k-8.el7_4", RpmVersionFormat},
+		// The separators don't matter to rpm, but they do to dpkg.
+		{"1.0-1.el7.1", EQUAL, "1.0-1.el7_1", RpmVersionFormat},
+		{"1.0-1.el7.1", LESS, "1.0-1.el7_1", DpkgVersionFormat},
+		// Numeric segments are newer than alphabetic ones in rpm, and letters sort before the
+		// other characters in dpkg.
+		{"1.0a", LESS, "1.0.1", RpmVersionFormat},
+		{"1.0-a", LESS, "1.0-1", RpmVersionFormat},
+		{"1.0-a", GREATER, "1.0-1", DpkgVersionFormat},
+		// Epochs
+		{"1:1.0.1e-42.el7", GREATER, "1.0.2k-8.el7", RpmVersionFormat},
+		{"0:1.0.2k-8.el7", EQUAL, "1.0.2k-8.el7", RpmVersionFormat},
+		{"1:1.0.1e-2+deb7u1", GREATER, "1.0.1e-2+deb7u2", DpkgVersionFormat},
+
+		// apk
+		{"1.0.2h-r1", LESS, "1.0.2h-r2", ApkVersionFormat},
+		{"1.24.2-r9", LESS, "1.24.2-r10", ApkVersionFormat},
+		{"3.5.0_alpha20161114-r0", LESS, "3.5.0-r0", ApkVersionFormat},
+		{"1.2_rc1-r0", LESS, "1.2-r0", ApkVersionFormat},
+		{"1.2_beta2-r0", LESS, "1.2_rc1-r0", ApkVersionFormat},
+		{"1.2_p1-r0", GREATER, "1.2-r0", ApkVersionFormat},
+		{"1.2_rc1-r0", GREATER, "1.2-r0", DpkgVersionFormat},
+
+		// pep440, based on the examples of PEP 440
+		{"1.0", EQUAL, "1.0.0", Pep440VersionFormat},
+		{"1.0", LESS, "1.0.1", Pep440VersionFormat},
+		{"1.9", LESS, "1.10", Pep440VersionFormat},
+		{"1.0.dev456", LESS, "1.0a1", Pep440VersionFormat},
+		{"1.0a1", LESS, "1.0a2.dev456", Pep440VersionFormat},
+		{"1.0a2.dev456", LESS, "1.0a12.dev456", Pep440VersionFormat},
+		{"1.0a12.dev456", LESS, "1.0a12", Pep440VersionFormat},
+		{"1.0a12", LESS, "1.0b1.dev456", Pep440VersionFormat},
+		{"1.0b2", LESS, "1.0b2.post345.dev456", Pep440VersionFormat},
+		{"1.0b2.post345.dev456", LESS, "1.0b2.post345", Pep440VersionFormat},
+		{"1.0b2.post345", LESS, "1.0rc1.dev456", Pep440VersionFormat},
+		{"1.0rc1", LESS, "1.0", Pep440VersionFormat},
+		{"1.0", LESS, "1.0+abc.5", Pep440VersionFormat},
+		{"1.0+abc.5", LESS, "1.0+abc.7", Pep440VersionFormat},
+		{"1.0+abc.7", LESS, "1.0+5", Pep440VersionFormat},
+		{"1.0+5", LESS, "1.0.post456.dev34", Pep440VersionFormat},
+		{"1.0.post456.dev34", LESS, "1.0.post456", Pep440VersionFormat},
+		{"1.0.post456", LESS, "1.1.dev1", Pep440VersionFormat},
+		{"1:1.0", GREATER, "2.0", Pep440VersionFormat},
+		// The alternative spellings are equivalent.
+		{"1.0RC1", EQUAL, "1.0rc1", Pep440VersionFormat},
+		{"1.0c1", EQUAL, "1.0rc1", Pep440VersionFormat},
+		{"1.0.alpha.1", EQUAL, "1.0a1", Pep440VersionFormat},
+		{"1.0.r2", EQUAL, "1.0.post2", Pep440VersionFormat},
+		{"1.0_dev", EQUAL, "1.0.dev0", Pep440VersionFormat},
+		// dpkg sorts letters before the end of the version.
+		{"1.0rc1", GREATER, "1.0", DpkgVersionFormat},
+
+		// Unknown formats compare like dpkg.
+		{"1.2_rc1-r0", GREATER, "1.2-r0", ""},
+		{"1.0-a", GREATER, "1.0-1", "unknown"},
+
+		// MinVersion and MaxVersion
+		{MinVersion.String(), LESS, "0:0", RpmVersionFormat},
+		{MaxVersion.String(), GREATER, "1:2.0", ApkVersionFormat},
+	}
+
+	for _, c := range cases {
+		v1, err := NewVersion(c.v1)
+		if assert.Nil(t, err, c.v1) {
+			v2, err := NewVersion(c.v2)
+			if assert.Nil(t, err, c.v2) {
+				assert.Equal(t, c.expected, v1.CompareFormat(v2, c.format), "%s vs. %s (%s)", c.v1, c.v2, c.format)
+				assert.Equal(t, -c.expected, v2.CompareFormat(v1, c.format), "%s vs. %s (%s)", c.v2, c.v1, c.format)
+			}
+		}
+	}
+}
+
+func TestNewPep440Version(t *testing.T) {
+	for str, expected := range map[string]string{
+		"1.0":              "1.0",
+		"v1.0":             "1.0",
+		"01.002":           "1.2",
+		"1!2.0-RC1":        "1:2.0rc1",
+		"1.0-1":            "1.0.post1",
+		"1.0.post":         "1.0.post0",
+		"1.0-beta.2-dev_3": "1.0b2.dev3",
+		"1.0+Ubuntu-1":     "1.0+ubuntu.1",
+		" 2.1.0 ":          "2.1.0",
+	} {
+		v, err := NewPep440Version(str)
+		if assert.Nil(t, err, str) {
+			assert.Equal(t, expected, v.String(), str)
+
+			// The normalized versions are valid versions.
+			parsed, err := NewVersion(v.String())
+			if assert.Nil(t, err, str) {
+				assert.Equal(t, 0, parsed.CompareFormat(v, Pep440VersionFormat), str)
+			}
+		}
+	}
+
+	for _, str := range []string{"", "dev", "1.0-", "1.0+", "1.0 2", "1.0.foo", "1.0!", "2.0.0-SNAPSHOT"} {
+		_, err := NewPep440Version(str)
+		assert.NotNil(t, err, str)
+	}
+}
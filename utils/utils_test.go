@@ -15,7 +15,10 @@
 package utils
 
 import (
+	"archive/tar"
 	"bytes"
+	"compress/gzip"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"runtime"
@@ -67,17 +70,17 @@ func TestTar(t *testing.T) {
 	var data map[string][]byte
 	_, path, _, _ := runtime.Caller(0)
 	testDataDir := "/testdata"
-	for _, filename := range []string{"utils_test.tar.gz", "utils_test.tar.bz2", "utils_test.tar.xz", "utils_test.tar"} {
+	for _, filename := range []string{"utils_test.tar.gz", "utils_test.tar.bz2", "utils_test.tar.xz", "utils_test.tar.zst", "utils_test.tar"} {
 		testArchivePath := filepath.Join(filepath.Dir(path), testDataDir, filename)
 
 		// Extract non compressed data
-		data, err = SelectivelyExtractArchive(bytes.NewReader([]byte("that string does not represent a tar or tar-gzip file")), "", []string{}, 0)
-		assert.Error(t, err, "Extracting non compressed data should return an error")
+		data, err = SelectivelyExtractArchive(bytes.NewReader([]byte("that string does not represent a tar or tar-gzip file")), "", []string{}, ExtractionLimits{})
+		assert.Equal(t, ErrUnsupportedArchive, err, "Extracting non compressed data should return an error")
 
 		// Extract an archive
 		f, _ := os.Open(testArchivePath)
 		defer f.Close()
-		data, err = SelectivelyExtractArchive(f, "", []string{"test/"}, 0)
+		data, err = SelectivelyExtractArchive(f, "", []string{"test/"}, ExtractionLimits{})
 		assert.Nil(t, err)
 
 		if c, n := data["test/test.txt"]; !n {
@@ -92,11 +95,271 @@ func TestTar(t *testing.T) {
 		// File size limit
 		f, _ = os.Open(testArchivePath)
 		defer f.Close()
-		data, err = SelectivelyExtractArchive(f, "", []string{"test"}, 50)
+		data, err = SelectivelyExtractArchive(f, "", []string{"test"}, ExtractionLimits{MaxFileSize: 50})
 		assert.Equal(t, ErrExtractedFileTooBig, err)
 	}
 }
 
+func TestTarUnsupported(t *testing.T) {
+	// Compressed data must be a tar archive as well.
+	var b bytes.Buffer
+	gw := gzip.NewWriter(&b)
+	gw.Write(bytes.Repeat([]byte("that string does not represent a tar file. "), 20))
+	gw.Close()
+	_, err := SelectivelyExtractArchive(&b, "", []string{}, ExtractionLimits{})
+	assert.Equal(t, ErrUnsupportedArchive, err)
+
+	// A truncated archive can't be extracted, but is an archive.
+	_, path, _, _ := runtime.Caller(0)
+	content, err := ioutil.ReadFile(filepath.Join(filepath.Dir(path), "testdata", "utils_test.tar"))
+	if assert.Nil(t, err) {
+		_, err = SelectivelyExtractArchive(bytes.NewReader(content[:1000]), "", []string{"test/"}, ExtractionLimits{})
+		assert.Equal(t, ErrCouldNotExtract, err)
+	}
+}
+
+func TestTarWhiteout(t *testing.T) {
+	var b bytes.Buffer
+	tw := tar.NewWriter(&b)
+	for _, hdr := range []*tar.Header{
+		{Name: "etc/.wh.os-release", Typeflag: tar.TypeReg},
+		{Name: "etc/.wh.hostname", Typeflag: tar.TypeReg},
+		{Name: "./var/lib/.wh.dpkg", Typeflag: tar.TypeReg},
+		{Name: "lib/apk/", Typeflag: tar.TypeDir, PAXRecords: map[string]string{"SCHILY.xattr." + opaqueXattr: "y"}},
+		{Name: "usr/lib/", Typeflag: tar.TypeDir},
+		{Name: "usr/lib/" + WhiteoutOpaqueDir, Typeflag: tar.TypeReg},
+		{Name: "usr/lib/os-release", Typeflag: tar.TypeReg, Size: 4},
+	} {
+		hdr.Mode = 0644
+		assert.Nil(t, tw.WriteHeader(hdr))
+		if hdr.Size > 0 {
+			tw.Write([]byte("test"))
+		}
+	}
+	assert.Nil(t, tw.Close())
+
+	toExtract := []string{"etc/os-release", "usr/lib/os-release", "var/lib/dpkg/status", "lib/apk/db/installed"}
+	data, err := SelectivelyExtractArchive(&b, "", toExtract, ExtractionLimits{})
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	// Only the whiteouts of the files to extract are recorded.
+	assert.Equal(t, map[string][]byte{
+		"etc/.wh.os-release":           nil,
+		"var/lib/.wh.dpkg":             nil,
+		"lib/apk/" + WhiteoutOpaqueDir: nil,
+		"usr/lib/" + WhiteoutOpaqueDir: nil,
+		"usr/lib/os-release":           []byte("test"),
+	}, data)
+
+	assert.True(t, IsWhitedOut(data, "etc/os-release"))
+	assert.True(t, IsWhitedOut(data, "var/lib/dpkg/status"))
+	assert.True(t, IsWhitedOut(data, "var/lib/dpkg/"))
+	assert.True(t, IsWhitedOut(data, "lib/apk/db/installed"))
+	assert.False(t, IsWhitedOut(data, "usr/lib/os-release"))
+	assert.False(t, IsWhitedOut(data, "etc/lsb-release"))
+	assert.False(t, IsWhitedOut(data, "var/lib/rpm/Packages"))
+}
+
+func TestTarPatterns(t *testing.T) {
+	b := newTestTar(t,
+		&tar.Header{Name: "var/lib/dpkg/status.d/", Typeflag: tar.TypeDir},
+		&tar.Header{Name: "var/lib/dpkg/status.d/libc6", Typeflag: tar.TypeReg, Size: 1},
+		&tar.Header{Name: "var/lib/dpkg/status.d/tzdata", Typeflag: tar.TypeReg, Size: 2},
+		&tar.Header{Name: "var/lib/dpkg/status.d/.wh.libssl1.1", Typeflag: tar.TypeReg},
+		&tar.Header{Name: "var/lib/dpkg/status.d/doc/README", Typeflag: tar.TypeReg, Size: 3},
+		&tar.Header{Name: "var/lib/rpm/Packages", Typeflag: tar.TypeReg, Size: 4},
+		&tar.Header{Name: "var/lib/rpm/Name", Typeflag: tar.TypeReg, Size: 5},
+		&tar.Header{Name: "etc/os-release", Typeflag: tar.TypeReg, Size: 6},
+	)
+
+	data, err := SelectivelyExtractArchive(b, "", []string{"var/lib/dpkg/status.d/*", "var/lib/rpm/", "etc/os-release"}, ExtractionLimits{})
+	if assert.Nil(t, err) {
+		assert.Equal(t, map[string][]byte{
+			"var/lib/dpkg/status.d/libc6":         make([]byte, 1),
+			"var/lib/dpkg/status.d/tzdata":        make([]byte, 2),
+			"var/lib/dpkg/status.d/.wh.libssl1.1": nil,
+			"var/lib/rpm/Packages":                make([]byte, 4),
+			"var/lib/rpm/Name":                    make([]byte, 5),
+			"etc/os-release":                      make([]byte, 6),
+		}, data)
+
+		assert.Equal(t, []string{"var/lib/dpkg/status.d/libc6", "var/lib/dpkg/status.d/tzdata"}, MatchingFiles(data, "var/lib/dpkg/status.d/*"))
+		assert.Equal(t, []string{"var/lib/rpm/Name", "var/lib/rpm/Packages"}, MatchingFiles(data, "var/lib/rpm/"))
+		assert.Empty(t, MatchingFiles(data, "lib/apk/db/installed"))
+	}
+
+	assert.True(t, MatchFile("var/lib/dpkg/status", "var/lib/dpkg/status"))
+	assert.True(t, MatchFile("var/lib/dpkg/status.d/libc6", "var/lib/dpkg/status.d/*"))
+	assert.False(t, MatchFile("var/lib/dpkg/status.d/doc/README", "var/lib/dpkg/status.d/*"))
+	assert.False(t, MatchFile("var/lib/dpkg/status.d/libc6", "var/lib/dpkg/status.d/[\\"))
+	assert.True(t, MatchFile("node_modules/debug/package.json", "**/node_modules/*/package.json"))
+	assert.True(t, MatchFile("app/node_modules/a/node_modules/debug/package.json", "**/node_modules/*/package.json"))
+	assert.False(t, MatchFile("app/node_modules/debug/lib/package.json", "**/node_modules/*/package.json"))
+}
+
+func TestTarWhiteoutPatterns(t *testing.T) {
+	b := newTestTar(t,
+		&tar.Header{Name: "usr/lib/python3/site-packages/.wh.flask-1.0.dist-info", Typeflag: tar.TypeReg},
+		&tar.Header{Name: "var/lib/gems/2.5.0/specifications/.wh.rack-2.0.gemspec", Typeflag: tar.TypeReg},
+		&tar.Header{Name: "app/.wh.tmp", Typeflag: tar.TypeReg},
+		&tar.Header{Name: "etc/.wh.hosts", Typeflag: tar.TypeReg},
+	)
+
+	toExtract := []string{
+		"usr/lib/python*/site-packages/*.dist-info/METADATA",
+		"var/lib/gems/*/specifications/*.gemspec",
+		"**/node_modules/*/package.json",
+	}
+	data, err := SelectivelyExtractArchive(b, "", toExtract, ExtractionLimits{})
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	// The whiteouts of the files that the patterns designate, or of one of their directories, are
+	// recorded, but not the ones of the directories that a ** element matches.
+	assert.Equal(t, map[string][]byte{
+		"usr/lib/python3/site-packages/.wh.flask-1.0.dist-info":  nil,
+		"var/lib/gems/2.5.0/specifications/.wh.rack-2.0.gemspec": nil,
+	}, data)
+
+	assert.True(t, IsWhitedOut(data, "usr/lib/python*/site-packages/*.dist-info/METADATA"))
+	assert.True(t, IsWhitedOut(data, "var/lib/gems/*/specifications/*.gemspec"))
+	assert.False(t, IsWhitedOut(data, "usr/local/lib/python*/site-packages/*.dist-info/METADATA"))
+	assert.False(t, IsWhitedOut(data, "**/node_modules/*/package.json"))
+	assert.Equal(t, []string{"var/lib/gems/2.5.0/specifications/rack-2.0.gemspec"}, DeletedPaths(data, "var/lib/gems/*/specifications/*.gemspec"))
+	assert.Equal(t, []string{"usr/lib/"}, DeletedPaths(map[string][]byte{"usr/lib/" + WhiteoutOpaqueDir: nil}, "usr/lib/python*/site-packages/*.dist-info/METADATA"))
+	assert.True(t, IsWhitedOut(map[string][]byte{"app/node_modules/.wh.debug": nil}, "**/node_modules/*/package.json"))
+	assert.True(t, IsWhitedOut(map[string][]byte{"usr/lib/" + WhiteoutOpaqueDir: nil}, "usr/lib/python*/site-packages/*.dist-info/METADATA"))
+}
+
+func TestTarPatternMatches(t *testing.T) {
+	b := newTestTar(t,
+		&tar.Header{Name: "app/node_modules/a/package.json", Typeflag: tar.TypeReg, Size: 1},
+		&tar.Header{Name: "app/node_modules/b/package.json", Typeflag: tar.TypeReg, Size: 2},
+		&tar.Header{Name: "app/node_modules/c/package.json", Typeflag: tar.TypeReg, Size: 3},
+		&tar.Header{Name: "etc/os-release", Typeflag: tar.TypeReg, Size: 4},
+	)
+
+	data, err := SelectivelyExtractArchive(b, "", []string{"**/node_modules/*/package.json", "etc/os-release"}, ExtractionLimits{MaxPatternMatches: 2})
+	if assert.Nil(t, err) {
+		assert.Equal(t, map[string][]byte{
+			"app/node_modules/a/package.json": make([]byte, 1),
+			"app/node_modules/b/package.json": make([]byte, 2),
+			"etc/os-release":                  make([]byte, 4),
+		}, data)
+	}
+}
+
+func TestTarExecutables(t *testing.T) {
+	b := newTestTar(t,
+		&tar.Header{Name: "bin/app", Typeflag: tar.TypeReg, Size: 1, Mode: 0755},
+		&tar.Header{Name: "bin/big", Typeflag: tar.TypeReg, Size: 5, Mode: 0755},
+		&tar.Header{Name: "bin/readme", Typeflag: tar.TypeReg, Size: 2},
+		&tar.Header{Name: "bin/link", Typeflag: tar.TypeSymlink, Linkname: "app", Mode: 0777},
+		&tar.Header{Name: "bin/.wh.old", Typeflag: tar.TypeReg},
+		&tar.Header{Name: "usr/bin/tool", Typeflag: tar.TypeReg, Size: 3, Mode: 0700},
+		&tar.Header{Name: "usr/bin/other", Typeflag: tar.TypeReg, Size: 2, Mode: 0755},
+		&tar.Header{Name: "etc/os-release", Typeflag: tar.TypeReg, Size: 4},
+	)
+
+	// The executables don't count in MaxExtractedSize, and are skipped when they exceed their own
+	// limits.
+	data, err := SelectivelyExtractArchive(b, "", []string{ExecutablePrefix + "**", "etc/os-release"}, ExtractionLimits{
+		MaxExtractedSize:            4,
+		MaxExecutableSize:           4,
+		MaxExtractedExecutablesSize: 5,
+	})
+	if assert.Nil(t, err) {
+		assert.Equal(t, map[string][]byte{
+			"bin/app":        make([]byte, 1),
+			"usr/bin/tool":   make([]byte, 3),
+			"etc/os-release": make([]byte, 4),
+		}, data)
+		assert.Equal(t, []string{"bin/app", "etc/os-release", "usr/bin/tool"}, MatchingFiles(data, ExecutablePrefix+"**"))
+	}
+}
+
+// newTestTar returns a tar archive made of the given headers, the regular files being filled with
+// zeros. The elements are readable, unless a mode is given.
+func newTestTar(t *testing.T, headers ...*tar.Header) *bytes.Buffer {
+	var b bytes.Buffer
+	tw := tar.NewWriter(&b)
+	for _, hdr := range headers {
+		if hdr.Mode == 0 {
+			hdr.Mode = 0644
+		}
+		assert.Nil(t, tw.WriteHeader(hdr))
+		if hdr.Typeflag == tar.TypeReg {
+			tw.Write(make([]byte, hdr.Size))
+		}
+	}
+	assert.Nil(t, tw.Close())
+	return &b
+}
+
+func TestTarLimits(t *testing.T) {
+	// A file that is much smaller once compressed.
+	var bomb bytes.Buffer
+	gw := gzip.NewWriter(&bomb)
+	gw.Write(newTestTar(t, &tar.Header{Name: "var/lib/dpkg/status", Typeflag: tar.TypeReg, Size: 10 << 20}).Bytes())
+	gw.Close()
+	assert.True(t, bomb.Len() < 64<<10)
+	_, err := SelectivelyExtractArchive(&bomb, "", []string{"var/lib/dpkg/status"}, ExtractionLimits{MaxFileSize: 1 << 20})
+	assert.Equal(t, ErrExtractedFileTooBig, err)
+
+	// Many files that are small enough on their own.
+	files := newTestTar(t,
+		&tar.Header{Name: "var/lib/dpkg/status", Typeflag: tar.TypeReg, Size: 600},
+		&tar.Header{Name: "var/lib/dpkg/status-old", Typeflag: tar.TypeReg, Size: 600},
+		&tar.Header{Name: "var/lib/dpkg/available", Typeflag: tar.TypeReg, Size: 600},
+	)
+	_, err = SelectivelyExtractArchive(bytes.NewReader(files.Bytes()), "", []string{"var/lib/dpkg/"}, ExtractionLimits{MaxFileSize: 1000, MaxExtractedSize: 1500})
+	assert.Equal(t, ErrLayerTooLarge, err)
+
+	// Only the files to extract count.
+	data, err := SelectivelyExtractArchive(bytes.NewReader(files.Bytes()), "", []string{"var/lib/dpkg/status"}, ExtractionLimits{MaxFileSize: 1000, MaxExtractedSize: 1500})
+	if assert.Nil(t, err) {
+		assert.Len(t, data["var/lib/dpkg/status"], 600)
+		assert.Len(t, data["var/lib/dpkg/status-old"], 600)
+		assert.NotContains(t, data, "var/lib/dpkg/available")
+	}
+}
+
+func TestTarUnsafePaths(t *testing.T) {
+	toExtract := []string{"etc/os-release", "var/lib/dpkg/status"}
+	for _, hdr := range []*tar.Header{
+		{Name: "../../etc/passwd", Typeflag: tar.TypeReg, Size: 4},
+		{Name: "var/lib/../../../etc/passwd", Typeflag: tar.TypeReg, Size: 4},
+		{Name: "/etc/passwd", Typeflag: tar.TypeReg, Size: 4},
+		{Name: "etc/os-release", Typeflag: tar.TypeSymlink, Linkname: "../../../etc/os-release"},
+		{Name: "etc/os-release", Typeflag: tar.TypeLink, Linkname: "../etc/passwd"},
+		{Name: "var/lib/dpkg/status", Typeflag: tar.TypeLink, Linkname: "/etc/passwd"},
+	} {
+		_, err := SelectivelyExtractArchive(newTestTar(t, hdr), "", toExtract, ExtractionLimits{})
+		assert.Equal(t, ErrUnsafePath, err, hdr.Name+" -> "+hdr.Linkname)
+	}
+
+	// The links of the files that are not extracted are not followed.
+	_, err := SelectivelyExtractArchive(newTestTar(t, &tar.Header{Name: "etc/passwd", Typeflag: tar.TypeSymlink, Linkname: "../../../etc/passwd"}), "", toExtract, ExtractionLimits{})
+	assert.Nil(t, err)
+
+	// The links that stay within the archive are resolved, when their target is extracted.
+	data, err := SelectivelyExtractArchive(newTestTar(t,
+		&tar.Header{Name: "usr/lib/os-release", Typeflag: tar.TypeReg, Size: 4},
+		&tar.Header{Name: "etc/os-release", Typeflag: tar.TypeSymlink, Linkname: "../usr/lib/os-release"},
+		&tar.Header{Name: "var/lib/dpkg/status", Typeflag: tar.TypeSymlink, Linkname: "/usr/share/status"},
+	), "", append(toExtract, "usr/lib/os-release"), ExtractionLimits{})
+	if assert.Nil(t, err) {
+		assert.Equal(t, map[string][]byte{
+			"usr/lib/os-release":  make([]byte, 4),
+			"etc/os-release":      make([]byte, 4),
+			"var/lib/dpkg/status": {},
+		}, data)
+	}
+}
+
 func TestCleanURL(t *testing.T) {
 	assert.Equal(t, "Test http://test.cn/test Test", CleanURL("Test http://test.cn/test?foo=bar&bar=foo Test"))
 }
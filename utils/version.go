@@ -12,23 +12,8 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-package namespace
+package utils
 
-import (
-	"testing"
-
-	"github.com/coreos/clair/database"
-	"github.com/coreos/clair/worker/detectors"
-	"github.com/stretchr/testify/assert"
-)
-
-type NamespaceTest struct {
-	Data              map[string][]byte
-	ExpectedNamespace database.Namespace
-}
-
-func TestNamespaceDetector(t *testing.T, detector detectors.NamespaceDetector, tests []NamespaceTest) {
-	for _, test := range tests {
-		assert.Equal(t, test.ExpectedNamespace, *detector.Detect(test.Data))
-	}
-}
+// Version is the version of Clair. It is set at build time with
+// -ldflags "-X github.com/coreos/clair/utils.Version=<version>".
+var Version = "dev"
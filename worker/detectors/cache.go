@@ -0,0 +1,279 @@
+// Copyright 2015 clair authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package detectors
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// cacheFilePrefix prefixes the names of the cached layers, followed by the hex of their sha256
+	// digest.
+	cacheFilePrefix = "sha256-"
+
+	// cacheTempPrefix prefixes the names of the layers being downloaded into the cache.
+	cacheTempPrefix = ".download-"
+)
+
+var (
+	// layerCache holds the layers downloaded by digest, see SetLayerCache. It is nil when the
+	// cache is disabled.
+	layerCache     *blobCache
+	layerCacheLock sync.Mutex
+
+	promLayerCacheHitsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "clair_worker_layer_cache_hits_total",
+		Help: "Number of layers read from the layer cache instead of being downloaded.",
+	})
+
+	promLayerCacheMissesTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "clair_worker_layer_cache_misses_total",
+		Help: "Number of layers downloaded because they were not in the layer cache.",
+	})
+
+	promLayerCacheEvictionsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "clair_worker_layer_cache_evictions_total",
+		Help: "Number of layers removed from the layer cache, by reason: size or corrupt.",
+	}, []string{"reason"})
+)
+
+func init() {
+	prometheus.MustRegister(promLayerCacheHitsTotal)
+	prometheus.MustRegister(promLayerCacheMissesTotal)
+	prometheus.MustRegister(promLayerCacheEvictionsTotal)
+}
+
+// SetLayerCache enables the cache of the layers that are downloaded along with their digest, such
+// as the layers of image manifests, in the given directory. The least recently used layers are
+// removed once the cache exceeds maxSize bytes. An empty directory disables the cache.
+//
+// The layers already in the directory are kept, and the downloads interrupted by a restart
+// removed. It must be called before any layer is processed.
+func SetLayerCache(directory string, maxSize int64) error {
+	layerCacheLock.Lock()
+	defer layerCacheLock.Unlock()
+
+	if directory == "" {
+		layerCache = nil
+		return nil
+	}
+
+	if err := os.MkdirAll(directory, 0700); err != nil {
+		return err
+	}
+	cache, err := openBlobCache(directory, maxSize)
+	if err != nil {
+		return err
+	}
+	layerCache = cache
+	return nil
+}
+
+func getLayerCache() *blobCache {
+	layerCacheLock.Lock()
+	defer layerCacheLock.Unlock()
+	return layerCache
+}
+
+// blobCache is a directory of blobs named by digest, bounded in size, from which the least
+// recently used blobs are evicted.
+type blobCache struct {
+	directory string
+	maxSize   int64
+
+	mu      sync.Mutex
+	size    int64
+	lru     *list.List // of *cacheEntry, the most recently used first
+	entries map[string]*list.Element
+}
+
+type cacheEntry struct {
+	digest string
+	size   int64
+}
+
+// openBlobCache indexes the blobs of the given directory, the least recently used being the ones
+// modified last the longest time ago.
+func openBlobCache(directory string, maxSize int64) (*blobCache, error) {
+	cache := &blobCache{directory: directory, maxSize: maxSize, lru: list.New(), entries: make(map[string]*list.Element)}
+
+	files, err := ioutil.ReadDir(directory)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].ModTime().After(files[j].ModTime()) })
+	for _, f := range files {
+		switch {
+		case strings.HasPrefix(f.Name(), cacheTempPrefix):
+			os.Remove(filepath.Join(directory, f.Name()))
+		case strings.HasPrefix(f.Name(), cacheFilePrefix) && f.Mode().IsRegular():
+			digest := "sha256:" + strings.TrimPrefix(f.Name(), cacheFilePrefix)
+			if ValidDigest(digest) {
+				cache.entries[digest] = cache.lru.PushBack(&cacheEntry{digest: digest, size: f.Size()})
+				cache.size += f.Size()
+			}
+		}
+	}
+
+	cache.mu.Lock()
+	cache.evictLocked()
+	cache.mu.Unlock()
+	return cache, nil
+}
+
+func (c *blobCache) path(digest string) string {
+	return filepath.Join(c.directory, cacheFilePrefix+strings.TrimPrefix(digest, "sha256:"))
+}
+
+// open returns the cached blob of the given digest, after verifying its content. A corrupt blob
+// is evicted.
+func (c *blobCache) open(digest string) (io.ReadCloser, bool) {
+	c.mu.Lock()
+	e, ok := c.entries[digest]
+	if ok {
+		c.lru.MoveToFront(e)
+	}
+	c.mu.Unlock()
+	if !ok {
+		return nil, false
+	}
+
+	f, err := os.Open(c.path(digest))
+	if err != nil {
+		c.remove(digest, "corrupt")
+		return nil, false
+	}
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil || "sha256:"+hex.EncodeToString(hash.Sum(nil)) != digest {
+		log.Warningf("cached layer %s is corrupt, downloading it again", digest)
+		f.Close()
+		c.remove(digest, "corrupt")
+		return nil, false
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		f.Close()
+		return nil, false
+	}
+
+	// Keep the order of use across restarts.
+	now := time.Now()
+	os.Chtimes(f.Name(), now, now)
+	return f, true
+}
+
+// create returns a reader that copies what is read from r into a new blob of the cache. The blob
+// is only added to the cache once it is committed.
+func (c *blobCache) create(digest string, r io.ReadCloser) (*cachingReader, error) {
+	f, err := ioutil.TempFile(c.directory, cacheTempPrefix)
+	if err != nil {
+		return nil, err
+	}
+	return &cachingReader{ReadCloser: r, cache: c, digest: digest, file: f}, nil
+}
+
+// add indexes the blob of the given digest, which has just been written, and evicts the least
+// recently used blobs if the cache is too large.
+func (c *blobCache) add(digest string, size int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.entries[digest]; ok {
+		c.size -= e.Value.(*cacheEntry).size
+		c.lru.Remove(e)
+	}
+	c.entries[digest] = c.lru.PushFront(&cacheEntry{digest: digest, size: size})
+	c.size += size
+	c.evictLocked()
+}
+
+// remove evicts the blob of the given digest for the given reason.
+func (c *blobCache) remove(digest, reason string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.entries[digest]; ok {
+		c.removeLocked(e, reason)
+	}
+}
+
+func (c *blobCache) evictLocked() {
+	for c.maxSize > 0 && c.size > c.maxSize && c.lru.Len() > 0 {
+		c.removeLocked(c.lru.Back(), "size")
+	}
+}
+
+func (c *blobCache) removeLocked(e *list.Element, reason string) {
+	entry := e.Value.(*cacheEntry)
+	c.lru.Remove(e)
+	delete(c.entries, entry.digest)
+	c.size -= entry.size
+	os.Remove(c.path(entry.digest))
+	promLayerCacheEvictionsTotal.WithLabelValues(reason).Inc()
+}
+
+// cachingReader writes the blob it reads into a temporary file of the cache. Failing to write it
+// only prevents the blob from being cached.
+type cachingReader struct {
+	io.ReadCloser
+	cache  *blobCache
+	digest string
+	file   *os.File
+	size   int64
+	err    error
+}
+
+func (r *cachingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if n > 0 && r.err == nil {
+		_, r.err = r.file.Write(p[:n])
+		r.size += int64(n)
+	}
+	return n, err
+}
+
+// commit adds the blob to the cache, once its content has been verified, unless it could not be
+// written or is larger than the cache.
+func (r *cachingReader) commit() {
+	err := r.file.Close()
+	if r.err != nil || err != nil || (r.cache.maxSize > 0 && r.size > r.cache.maxSize) {
+		os.Remove(r.file.Name())
+		return
+	}
+	if err := os.Rename(r.file.Name(), r.cache.path(r.digest)); err != nil {
+		log.Warningf("could not cache layer %s: %s", r.digest, err)
+		os.Remove(r.file.Name())
+		return
+	}
+	r.cache.add(r.digest, r.size)
+}
+
+// discard removes the blob, whose content could not be verified.
+func (r *cachingReader) discard() {
+	r.file.Close()
+	os.Remove(r.file.Name())
+}
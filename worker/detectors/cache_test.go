@@ -0,0 +1,182 @@
+// Copyright 2015 clair authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package detectors
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/coreos/clair/utils"
+)
+
+// blobServer serves the given blobs, by digest, and counts the requests.
+type blobServer struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	requests int
+}
+
+func newBlobServer(blobs map[string]string) *blobServer {
+	server := &blobServer{}
+	server.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		server.mu.Lock()
+		server.requests++
+		server.mu.Unlock()
+
+		blob, ok := blobs[strings.TrimPrefix(r.URL.Path, "/blobs/")]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(blob))
+	}))
+	return server
+}
+
+func (server *blobServer) requestCount() int {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	return server.requests
+}
+
+func blobDigest(blob string) string {
+	return fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(blob)))
+}
+
+func counterValue(c interface {
+	Write(*dto.Metric) error
+}) float64 {
+	var metric dto.Metric
+	c.Write(&metric)
+	return metric.GetCounter().GetValue()
+}
+
+// setTestLayerCache enables the layer cache in a temporary directory until the returned function
+// is called.
+func setTestLayerCache(t *testing.T, maxSize int64) (string, func()) {
+	dir, err := ioutil.TempDir("", "clair-layer-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := SetLayerCache(dir, maxSize); err != nil {
+		t.Fatal(err)
+	}
+	return dir, func() {
+		SetLayerCache("", 0)
+		os.RemoveAll(dir)
+	}
+}
+
+func TestLayerCache(t *testing.T) {
+	dir, restore := setTestLayerCache(t, 0)
+	defer restore()
+
+	layer := strings.Repeat("layer", 1000)
+	digest := blobDigest(layer)
+	server := newBlobServer(map[string]string{digest: layer})
+	defer server.Close()
+
+	detect := func() {
+		data, err := DetectVerifiedData("Test", server.URL+"/blobs/"+digest, digest, nil, nil, nil, utils.ExtractionLimits{})
+		if assert.Nil(t, err) {
+			assert.Equal(t, layer, string(data["layer"]))
+		}
+	}
+
+	// The second analysis of the layer reads it from the cache.
+	hits, misses := counterValue(promLayerCacheHitsTotal), counterValue(promLayerCacheMissesTotal)
+	detect()
+	detect()
+	assert.Equal(t, 1, server.requestCount())
+	assert.Equal(t, hits+1, counterValue(promLayerCacheHitsTotal))
+	assert.Equal(t, misses+1, counterValue(promLayerCacheMissesTotal))
+
+	// A corrupt cached layer is evicted and downloaded again.
+	path := filepath.Join(dir, cacheFilePrefix+strings.TrimPrefix(digest, "sha256:"))
+	assert.Nil(t, ioutil.WriteFile(path, []byte("corrupt"), 0600))
+	corrupt := counterValue(promLayerCacheEvictionsTotal.WithLabelValues("corrupt"))
+	detect()
+	assert.Equal(t, 2, server.requestCount())
+	assert.Equal(t, corrupt+1, counterValue(promLayerCacheEvictionsTotal.WithLabelValues("corrupt")))
+	detect()
+	assert.Equal(t, 2, server.requestCount())
+
+	// The cache is indexed again when Clair restarts.
+	assert.Nil(t, SetLayerCache(dir, 0))
+	detect()
+	assert.Equal(t, 2, server.requestCount())
+
+	// Layers that don't match their digest are not cached, nor are the layers without digest.
+	other := blobDigest("other")
+	mismatching := newBlobServer(map[string]string{other: layer})
+	defer mismatching.Close()
+	_, err := DetectVerifiedData("Test", mismatching.URL+"/blobs/"+other, other, nil, nil, nil, utils.ExtractionLimits{})
+	assert.Equal(t, ErrDigestMismatch, err)
+	_, err = DetectData("Test", server.URL+"/blobs/"+digest, nil, nil, nil, utils.ExtractionLimits{})
+	assert.Nil(t, err)
+	files, _ := ioutil.ReadDir(dir)
+	assert.Len(t, files, 1)
+}
+
+func TestLayerCacheEviction(t *testing.T) {
+	_, restore := setTestLayerCache(t, 25)
+	defer restore()
+
+	blobs := map[string]string{}
+	var digests []string
+	for _, blob := range []string{"first layer", "second layer", "third layer", strings.Repeat("large", 10)} {
+		digests = append(digests, blobDigest(blob))
+		blobs[blobDigest(blob)] = blob
+	}
+	server := newBlobServer(blobs)
+	defer server.Close()
+
+	detect := func(digest string) {
+		_, err := DetectVerifiedData("Test", server.URL+"/blobs/"+digest, digest, nil, nil, nil, utils.ExtractionLimits{})
+		assert.Nil(t, err)
+	}
+
+	// The first layer, used again, outlives the second one once the third one is cached.
+	evictions := counterValue(promLayerCacheEvictionsTotal.WithLabelValues("size"))
+	detect(digests[0])
+	detect(digests[1])
+	detect(digests[0])
+	detect(digests[2])
+	assert.Equal(t, 3, server.requestCount())
+	assert.Equal(t, evictions+1, counterValue(promLayerCacheEvictionsTotal.WithLabelValues("size")))
+
+	detect(digests[0])
+	detect(digests[2])
+	assert.Equal(t, 3, server.requestCount())
+	detect(digests[1])
+	assert.Equal(t, 4, server.requestCount())
+
+	// Layers larger than the cache are never cached.
+	detect(digests[3])
+	detect(digests[3])
+	assert.Equal(t, 6, server.requestCount())
+}
@@ -17,14 +17,18 @@
 package detectors
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"math"
 	"net/http"
+	"net/url"
 	"os"
+	"path/filepath"
 	"strings"
 	"sync"
 
+	"github.com/coreos/clair/utils"
 	cerrors "github.com/coreos/clair/utils/errors"
 	"github.com/coreos/pkg/capnslog"
 )
@@ -34,7 +38,7 @@ type DataDetector interface {
 	//Support check if the input path and format are supported by the underling detector
 	Supported(path string, format string) bool
 	// Detect detects the required data from input path
-	Detect(layerReader io.ReadCloser, toExtract []string, maxFileSize int64) (data map[string][]byte, err error)
+	Detect(layerReader io.ReadCloser, toExtract []string, limits utils.ExtractionLimits) (data map[string][]byte, err error)
 }
 
 var (
@@ -43,10 +47,52 @@ var (
 
 	log = capnslog.NewPackageLogger("github.com/coreos/clair", "detectors")
 
-	// ErrCouldNotFindLayer is returned when we could not download or open the layer file.
+	// ErrCouldNotFindLayer is returned when we could not open the layer file, or when its URL is
+	// invalid.
 	ErrCouldNotFindLayer = cerrors.NewBadRequestError("could not find layer")
+
+	// ErrLocalPathNotAllowed is returned when the path of a layer is neither an HTTP(S) URL nor a
+	// file within the directories layers may be read from.
+	ErrLocalPathNotAllowed = cerrors.NewBadRequestError("layer path is not an HTTP(S) URL or a file in an allowed directory")
+
+	// layerClient downloads layers. The headers provided along with a layer
+	// usually carry credentials, so they only follow redirects to the host
+	// the layer was requested from.
+	layerClient = &http.Client{CheckRedirect: stripHeadersOnRedirect}
 )
 
+// ErrCouldNotDownload is returned when a layer could not be downloaded. StatusCode is the status
+// of the last response of the server, 0 if the server could not be reached.
+type ErrCouldNotDownload struct {
+	StatusCode int
+}
+
+func (e *ErrCouldNotDownload) Error() string {
+	if e.StatusCode == 0 {
+		return "could not download layer: the server could not be reached"
+	}
+	return fmt.Sprintf("could not download layer: the server answered %d %s", e.StatusCode, http.StatusText(e.StatusCode))
+}
+
+// maxRedirects is the number of redirects followed when downloading a layer,
+// which is the default of net/http.
+const maxRedirects = 10
+
+// stripHeadersOnRedirect removes the headers set on the original request when
+// a redirect leads to another host.
+func stripHeadersOnRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= maxRedirects {
+		return fmt.Errorf("stopped after %d redirects", maxRedirects)
+	}
+
+	if !strings.EqualFold(req.URL.Host, via[0].URL.Host) {
+		for k := range via[0].Header {
+			req.Header.Del(k)
+		}
+	}
+	return nil
+}
+
 // RegisterDataDetector provides a way to dynamically register an implementation of a
 // DataDetector.
 //
@@ -70,53 +116,229 @@ func RegisterDataDetector(name string, f DataDetector) {
 }
 
 // DetectData finds the Data of the layer by using every registered DataDetector
-func DetectData(format, path string, headers map[string]string, toExtract []string, maxFileSize int64) (data map[string][]byte, err error) {
-	var layerReader io.ReadCloser
-	if strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://") {
-		// Create a new HTTP request object.
-		request, err := http.NewRequest("GET", path, nil)
-		if err != nil {
-			return nil, ErrCouldNotFindLayer
-		}
+//
+// The layer is downloaded when path is an HTTP(S) URL, the provided headers being set on the
+// request. Without an Authorization header, Clair authenticates itself to the registries it has
+// credentials for, see SetRegistryCredentials. Otherwise, path must be a file:// URL or an absolute path to a file within one of the
+// localPaths directories. Local layers are refused when localPaths is empty.
+func DetectData(format, path string, headers map[string]string, localPaths []string, toExtract []string, limits utils.ExtractionLimits) (data map[string][]byte, err error) {
+	return DetectVerifiedData(format, path, "", headers, localPaths, toExtract, limits)
+}
 
-		// Set any provided HTTP Headers.
-		if headers != nil {
-			for k, v := range headers {
-				request.Header.Set(k, v)
-			}
+// DetectVerifiedData is DetectData for a layer whose content must match the given sha256 digest,
+// such as the blobs listed by an image manifest. It returns ErrDigestMismatch if it doesn't. An
+// empty digest skips the verification.
+//
+// When the layer cache is enabled, see SetLayerCache, the downloaded layers are read from the
+// cache, and added to it once verified.
+func DetectVerifiedData(format, path, digest string, headers map[string]string, localPaths []string, toExtract []string, limits utils.ExtractionLimits) (data map[string][]byte, err error) {
+	if digest != "" && !ValidDigest(digest) {
+		return nil, ErrUnsupportedDigest
+	}
+
+	remote := strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://")
+	var cache *blobCache
+	if remote && digest != "" {
+		cache = getLayerCache()
+	}
+
+	// Read the layer from the cache, which verified its content already.
+	if cache != nil {
+		if cached, ok := cache.open(digest); ok {
+			promLayerCacheHitsTotal.Inc()
+			defer cached.Close()
+			return detectLayerData(format, path, cached, toExtract, limits)
 		}
+		promLayerCacheMissesTotal.Inc()
+	}
 
-		// Send the request and handle the response.
-		r, err := http.DefaultClient.Do(request)
-		if err != nil {
-			log.Warningf("could not download layer: %s", err)
-			return nil, ErrCouldNotFindLayer
+	var layerReader io.ReadCloser
+	if remote {
+		layerReader, err = openHTTPLayer(path, headers)
+	} else {
+		layerReader, err = openLocalLayer(path, localPaths)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer layerReader.Close()
+
+	var caching *cachingReader
+	if cache != nil {
+		if caching, err = cache.create(digest, layerReader); err != nil {
+			log.Warningf("could not cache layer %s: %s", digest, err)
+			caching = nil
+		} else {
+			layerReader = caching
 		}
+	}
+
+	var verifier *digestReader
+	if digest != "" {
+		verifier = newDigestReader(layerReader, digest)
+		layerReader = verifier
+	}
 
-		// Fail if we don't receive a 2xx HTTP status code.
-		if math.Floor(float64(r.StatusCode/100)) != 2 {
-			log.Warningf("could not download layer: got status code %d, expected 2XX", r.StatusCode)
-			return nil, ErrCouldNotFindLayer
+	data, err = detectLayerData(format, path, layerReader, toExtract, limits)
+	if err == nil && verifier != nil {
+		err = verifier.verify()
+	}
+	if caching != nil {
+		if err == nil {
+			caching.commit()
+		} else {
+			caching.discard()
 		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
 
-		layerReader = r.Body
-	} else {
-		layerReader, err = os.Open(path)
-		if err != nil {
-			return nil, ErrCouldNotFindLayer
+// SupportedFormat returns whether a DataDetector reads the layers of the given format, located at
+// the given path.
+func SupportedFormat(path, format string) bool {
+	for _, detector := range dataDetectors {
+		if detector.Supported(path, format) {
+			return true
 		}
 	}
-	defer layerReader.Close()
+	return false
+}
 
+// detectLayerData extracts the data of the layer with the DataDetector that supports its format.
+func detectLayerData(format, path string, layerReader io.ReadCloser, toExtract []string, limits utils.ExtractionLimits) (map[string][]byte, error) {
 	for _, detector := range dataDetectors {
 		if detector.Supported(path, format) {
-			data, err = detector.Detect(layerReader, toExtract, maxFileSize)
-			if err != nil {
-				return nil, err
-			}
-			return data, nil
+			return detector.Detect(layerReader, toExtract, limits)
 		}
 	}
 
 	return nil, cerrors.NewBadRequestError(fmt.Sprintf("unsupported image format '%s'", format))
 }
+
+// openHTTPLayer starts the download of the layer at the given URL. The download is retried, and
+// resumed when interrupted, according to the policy set by SetDownloadPolicy.
+func openHTTPLayer(path string, headers map[string]string) (io.ReadCloser, error) {
+	// Create a new HTTP request object.
+	request, err := http.NewRequest("GET", path, nil)
+	if err != nil {
+		return nil, ErrCouldNotFindLayer
+	}
+
+	// Set any provided HTTP Headers.
+	for k, v := range headers {
+		request.Header.Set(k, v)
+	}
+
+	// Authenticate with the credentials of the registry, unless the client did, reusing the
+	// token of a previous download when possible.
+	credentials, hasCredentials := getRegistryCredentials(request.URL.Host)
+	hasCredentials = hasCredentials && request.Header.Get("Authorization") == ""
+	scope := blobScope(request.URL)
+	cachedToken := false
+	if hasCredentials && scope != "" {
+		if token, ok := cachedRegistryToken(request.URL.Host, scope); ok {
+			request.Header.Set("Authorization", "Bearer "+token)
+			cachedToken = true
+		}
+	}
+
+	// Bound the whole download, retries included.
+	attempts, timeout := getDownloadPolicy()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	request = request.WithContext(ctx)
+
+	// Send the request and handle the response.
+	r, err := sendLayerRequest(request, attempts)
+	if err != nil {
+		log.Warningf("could not download layer: %s", err)
+		cancel()
+		return nil, &ErrCouldNotDownload{}
+	}
+
+	// Answer the authentication challenge of the registry, which also happens when the cached
+	// token has been revoked or has expired early.
+	if r.StatusCode == http.StatusUnauthorized && hasCredentials {
+		r.Body.Close()
+		if cachedToken {
+			cacheRegistryToken(request.URL.Host, scope, registryToken{})
+		}
+
+		request.Header.Del("Authorization")
+		if !authorizeRegistryRequest(request, r.Header.Get("WWW-Authenticate"), credentials) {
+			cancel()
+			return nil, &ErrCouldNotDownload{StatusCode: http.StatusUnauthorized}
+		}
+		if r, err = sendLayerRequest(request, attempts); err != nil {
+			log.Warningf("could not download layer: %s", err)
+			cancel()
+			return nil, &ErrCouldNotDownload{}
+		}
+	}
+
+	// Fail if we don't receive a 2xx HTTP status code.
+	if math.Floor(float64(r.StatusCode/100)) != 2 {
+		log.Warningf("could not download layer: got status code %d, expected 2XX", r.StatusCode)
+		r.Body.Close()
+		cancel()
+		return nil, &ErrCouldNotDownload{StatusCode: r.StatusCode}
+	}
+
+	return newLayerBody(request, r, attempts, cancel), nil
+}
+
+// openLocalLayer opens the layer at the given file:// URL or absolute path, provided that it lies
+// within one of the localPaths directories, symbolic links included.
+func openLocalLayer(path string, localPaths []string) (io.ReadCloser, error) {
+	if strings.HasPrefix(path, "file://") {
+		u, err := url.Parse(path)
+		if err != nil || (u.Host != "" && u.Host != "localhost") {
+			return nil, ErrLocalPathNotAllowed
+		}
+		path = u.Path
+	}
+	if !filepath.IsAbs(path) {
+		return nil, ErrLocalPathNotAllowed
+	}
+
+	// Check the path as written first, so that the existence of files outside of the allowed
+	// directories is not disclosed, and then once its symbolic links are resolved.
+	path = filepath.Clean(path)
+	if !withinDirectories(path, localPaths, false) {
+		return nil, ErrLocalPathNotAllowed
+	}
+	resolvedPath, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return nil, ErrCouldNotFindLayer
+	}
+	if !withinDirectories(resolvedPath, localPaths, true) {
+		return nil, ErrLocalPathNotAllowed
+	}
+
+	f, err := os.Open(resolvedPath)
+	if err != nil {
+		return nil, ErrCouldNotFindLayer
+	}
+	return f, nil
+}
+
+// withinDirectories returns whether the cleaned absolute path is located under one of the given
+// directories, whose symbolic links are first resolved if resolve is true.
+func withinDirectories(path string, directories []string, resolve bool) bool {
+	for _, directory := range directories {
+		directory = filepath.Clean(directory)
+		if resolve {
+			var err error
+			if directory, err = filepath.EvalSymlinks(directory); err != nil {
+				continue
+			}
+		}
+
+		if strings.HasPrefix(path, strings.TrimSuffix(directory, string(filepath.Separator))+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
@@ -36,6 +36,6 @@ func (detector *ACIDataDetector) Supported(path string, format string) bool {
 	return false
 }
 
-func (detector *ACIDataDetector) Detect(layerReader io.ReadCloser, toExtract []string, maxFileSize int64) (map[string][]byte, error) {
-	return utils.SelectivelyExtractArchive(layerReader, "rootfs/", toExtract, maxFileSize)
+func (detector *ACIDataDetector) Detect(layerReader io.ReadCloser, toExtract []string, limits utils.ExtractionLimits) (map[string][]byte, error) {
+	return utils.SelectivelyExtractArchive(layerReader, "rootfs/", toExtract, limits)
 }
@@ -36,6 +36,6 @@ func (detector *DockerDataDetector) Supported(path string, format string) bool {
 	return false
 }
 
-func (detector *DockerDataDetector) Detect(layerReader io.ReadCloser, toExtract []string, maxFileSize int64) (map[string][]byte, error) {
-	return utils.SelectivelyExtractArchive(layerReader, "", toExtract, maxFileSize)
+func (detector *DockerDataDetector) Detect(layerReader io.ReadCloser, toExtract []string, limits utils.ExtractionLimits) (map[string][]byte, error) {
+	return utils.SelectivelyExtractArchive(layerReader, "", toExtract, limits)
 }
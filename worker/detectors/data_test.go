@@ -0,0 +1,169 @@
+// Copyright 2015 clair authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package detectors
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/coreos/clair/utils"
+)
+
+const testToken = "Bearer secret"
+
+// testDataDetector returns the whole content of the layer.
+type testDataDetector struct{}
+
+func (testDataDetector) Supported(path, format string) bool {
+	return format == "Test"
+}
+
+func (testDataDetector) Detect(layerReader io.ReadCloser, toExtract []string, limits utils.ExtractionLimits) (map[string][]byte, error) {
+	content, err := ioutil.ReadAll(layerReader)
+	if err != nil {
+		return nil, err
+	}
+	return map[string][]byte{"layer": content}, nil
+}
+
+func init() {
+	RegisterDataDetector("test", testDataDetector{})
+}
+
+// newLayerServer serves a layer that requires testToken. Requests to
+// /redirect are sent to target instead.
+func newLayerServer(target string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/redirect" {
+			http.Redirect(w, r, target, http.StatusFound)
+			return
+		}
+		if r.Header.Get("Authorization") != testToken {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte("layer"))
+	}))
+}
+
+func TestDetectDataHeaders(t *testing.T) {
+	server := newLayerServer("")
+	defer server.Close()
+
+	data, err := DetectData("Test", server.URL+"/layer.tar", map[string]string{"Authorization": testToken}, nil, nil, utils.ExtractionLimits{})
+	if assert.Nil(t, err) {
+		assert.Equal(t, "layer", string(data["layer"]))
+	}
+
+	_, err = DetectData("Test", server.URL+"/layer.tar", nil, nil, nil, utils.ExtractionLimits{})
+	assert.Equal(t, &ErrCouldNotDownload{StatusCode: http.StatusUnauthorized}, err)
+}
+
+func TestDetectVerifiedData(t *testing.T) {
+	server := newLayerServer("")
+	defer server.Close()
+	headers := map[string]string{"Authorization": testToken}
+
+	digest := fmt.Sprintf("sha256:%x", sha256.Sum256([]byte("layer")))
+	data, err := DetectVerifiedData("Test", server.URL+"/layer.tar", digest, headers, nil, nil, utils.ExtractionLimits{})
+	if assert.Nil(t, err) {
+		assert.Equal(t, "layer", string(data["layer"]))
+	}
+
+	other := fmt.Sprintf("sha256:%x", sha256.Sum256([]byte("other")))
+	_, err = DetectVerifiedData("Test", server.URL+"/layer.tar", other, headers, nil, nil, utils.ExtractionLimits{})
+	assert.Equal(t, ErrDigestMismatch, err)
+
+	_, err = DetectVerifiedData("Test", server.URL+"/layer.tar", "md5:0123", headers, nil, nil, utils.ExtractionLimits{})
+	assert.Equal(t, ErrUnsupportedDigest, err)
+}
+
+func TestDetectDataRedirect(t *testing.T) {
+	// A redirect on the same host keeps the headers.
+	server := newLayerServer("/layer.tar")
+	defer server.Close()
+
+	data, err := DetectData("Test", server.URL+"/redirect", map[string]string{"Authorization": testToken}, nil, nil, utils.ExtractionLimits{})
+	if assert.Nil(t, err) {
+		assert.Equal(t, "layer", string(data["layer"]))
+	}
+
+	// A redirect to another host drops them, including the non-standard ones.
+	var received http.Header
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header
+		w.Write([]byte("layer"))
+	}))
+	defer other.Close()
+
+	redirecting := newLayerServer(other.URL + "/layer.tar")
+	defer redirecting.Close()
+
+	headers := map[string]string{"Authorization": testToken, "X-Registry-Token": "secret"}
+	_, err = DetectData("Test", redirecting.URL+"/redirect", headers, nil, nil, utils.ExtractionLimits{})
+	assert.Nil(t, err)
+	if assert.NotNil(t, received) {
+		assert.Empty(t, received.Get("Authorization"))
+		assert.Empty(t, received.Get("X-Registry-Token"))
+	}
+}
+
+func TestDetectDataLocalPaths(t *testing.T) {
+	root := t.TempDir()
+	allowed := filepath.Join(root, "layers")
+	assert.Nil(t, os.Mkdir(allowed, 0755))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(allowed, "layer.tar"), []byte("layer"), 0644))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(root, "secret"), []byte("secret"), 0644))
+	assert.Nil(t, os.Symlink(filepath.Join(root, "secret"), filepath.Join(allowed, "link.tar")))
+	localPaths := []string{allowed}
+
+	// Files within the allowed directories are read.
+	for _, path := range []string{filepath.Join(allowed, "layer.tar"), "file://" + filepath.Join(allowed, "layer.tar")} {
+		data, err := DetectData("Test", path, nil, localPaths, nil, utils.ExtractionLimits{})
+		if assert.Nil(t, err, path) {
+			assert.Equal(t, "layer", string(data["layer"]), path)
+		}
+	}
+	_, err := DetectData("Test", filepath.Join(allowed, "missing.tar"), nil, localPaths, nil, utils.ExtractionLimits{})
+	assert.Equal(t, ErrCouldNotFindLayer, err)
+
+	// Anything else is refused.
+	for _, path := range []string{
+		allowed + "/../../etc/passwd",
+		allowed + "/../secret",
+		"file://" + allowed + "/../secret",
+		filepath.Join(allowed, "link.tar"),
+		allowed + "-sibling/layer.tar",
+		allowed,
+		"layers/layer.tar",
+		"file://example.com" + filepath.Join(allowed, "layer.tar"),
+	} {
+		_, err := DetectData("Test", path, nil, localPaths, nil, utils.ExtractionLimits{})
+		assert.Equal(t, ErrLocalPathNotAllowed, err, path)
+	}
+
+	// Local paths are disabled without allowed directories.
+	_, err = DetectData("Test", filepath.Join(allowed, "layer.tar"), nil, nil, nil, utils.ExtractionLimits{})
+	assert.Equal(t, ErrLocalPathNotAllowed, err)
+}
@@ -0,0 +1,73 @@
+// Copyright 2015 clair authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package detectors
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io"
+	"io/ioutil"
+	"regexp"
+
+	cerrors "github.com/coreos/clair/utils/errors"
+)
+
+var (
+	// ErrDigestMismatch is returned when the content of a layer does not match its digest.
+	ErrDigestMismatch = cerrors.NewBadRequestError("layer content does not match its digest")
+
+	// ErrUnsupportedDigest is returned when the digest of a layer is not a sha256 digest.
+	ErrUnsupportedDigest = cerrors.NewBadRequestError("layer digest is not a sha256 digest")
+
+	digestRegexp = regexp.MustCompile(`^sha256:[a-f0-9]{64}$`)
+)
+
+// ValidDigest returns whether the given digest is a sha256 digest, such as "sha256:<hex>", which
+// is the only algorithm the layers can be verified with.
+func ValidDigest(digest string) bool {
+	return digestRegexp.MatchString(digest)
+}
+
+// digestReader hashes the content of a layer as it is read, in order to compare it with the
+// digest of the layer.
+type digestReader struct {
+	io.ReadCloser
+	hash   hash.Hash
+	digest string
+}
+
+func newDigestReader(r io.ReadCloser, digest string) *digestReader {
+	return &digestReader{ReadCloser: r, hash: sha256.New(), digest: digest}
+}
+
+func (r *digestReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.hash.Write(p[:n])
+	return n, err
+}
+
+// verify reads the rest of the layer, which the detectors may leave unread, such as the padding
+// following the end of a tar archive, and compares the content with the digest.
+func (r *digestReader) verify() error {
+	if _, err := io.Copy(ioutil.Discard, r); err != nil {
+		log.Warningf("could not read layer: %s", err)
+		return ErrCouldNotFindLayer
+	}
+	if "sha256:"+hex.EncodeToString(r.hash.Sum(nil)) != r.digest {
+		return ErrDigestMismatch
+	}
+	return nil
+}
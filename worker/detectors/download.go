@@ -0,0 +1,229 @@
+// Copyright 2015 clair authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package detectors
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// DefaultDownloadAttempts is the number of attempts to download a layer, unless
+	// SetDownloadPolicy is called.
+	DefaultDownloadAttempts = 5
+
+	// DefaultDownloadTimeout is the time a layer download may take, retries included, unless
+	// SetDownloadPolicy is called.
+	DefaultDownloadTimeout = 30 * time.Minute
+
+	// maxDownloadBackoff bounds the delay between two attempts.
+	maxDownloadBackoff = 30 * time.Second
+)
+
+var (
+	downloadPolicyLock sync.Mutex
+	downloadAttempts   = DefaultDownloadAttempts
+	downloadTimeout    = DefaultDownloadTimeout
+
+	// downloadBackoff is the delay before the second attempt, which doubles with every attempt.
+	downloadBackoff = 500 * time.Millisecond
+
+	promLayerDownloadRetriesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "clair_worker_layer_download_retries_total",
+		Help: "Number of layer download attempts that failed and were retried, by reason.",
+	}, []string{"reason"})
+
+	promLayerDownloadResumptionsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "clair_worker_layer_download_resumptions_total",
+		Help: "Number of interrupted layer downloads that were resumed from the data already received.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(promLayerDownloadRetriesTotal)
+	prometheus.MustRegister(promLayerDownloadResumptionsTotal)
+}
+
+// SetDownloadPolicy sets the number of attempts to download a layer, which are separated by a
+// jittered exponential backoff, and the time that a download, retries included, may take. Values
+// lower than 1 are ignored.
+func SetDownloadPolicy(attempts int, timeout time.Duration) {
+	downloadPolicyLock.Lock()
+	defer downloadPolicyLock.Unlock()
+
+	if attempts >= 1 {
+		downloadAttempts = attempts
+	}
+	if timeout >= 1 {
+		downloadTimeout = timeout
+	}
+}
+
+func getDownloadPolicy() (int, time.Duration) {
+	downloadPolicyLock.Lock()
+	defer downloadPolicyLock.Unlock()
+	return downloadAttempts, downloadTimeout
+}
+
+// sendLayerRequest sends the given request, retrying after connection errors, such as timeouts
+// and resets, and server errors. Once every attempt failed, the last response or error is
+// returned.
+func sendLayerRequest(request *http.Request, attempts int) (*http.Response, error) {
+	for attempt := 1; ; attempt++ {
+		r, err := layerClient.Do(request)
+
+		var reason string
+		switch {
+		case err != nil:
+			reason = "error"
+		case r.StatusCode >= 500:
+			reason = "status"
+		default:
+			return r, nil
+		}
+		if attempt >= attempts || request.Context().Err() != nil {
+			return r, err
+		}
+
+		if err != nil {
+			log.Warningf("could not download layer (attempt %d/%d): %s", attempt, attempts, err)
+		} else {
+			log.Warningf("could not download layer (attempt %d/%d): got status code %d", attempt, attempts, r.StatusCode)
+			r.Body.Close()
+		}
+		promLayerDownloadRetriesTotal.WithLabelValues(reason).Inc()
+
+		select {
+		case <-time.After(backoff(attempt)):
+		case <-request.Context().Done():
+			return nil, request.Context().Err()
+		}
+	}
+}
+
+// backoff returns the delay to wait after the given failed attempt: it doubles with every attempt
+// and is randomized, so that the downloads failing together are not retried together.
+func backoff(attempt int) time.Duration {
+	d := downloadBackoff << uint(attempt-1)
+	if d <= 0 || d > maxDownloadBackoff {
+		d = maxDownloadBackoff
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// layerBody reads the body of a layer download, and resumes the download when it is interrupted,
+// using a Range request if the server supports them. Closing it cancels the download.
+type layerBody struct {
+	body    io.ReadCloser
+	request *http.Request
+	cancel  context.CancelFunc
+
+	// offset is the number of bytes read so far.
+	offset int64
+	// resumable tells whether the server accepts Range requests.
+	resumable bool
+	// resumptions and attempts are the number of resumptions so far and the maximum.
+	resumptions, attempts int
+}
+
+// newLayerBody returns a layerBody reading the given response to the given request, which may be
+// resumed the given number of times.
+func newLayerBody(request *http.Request, r *http.Response, attempts int, cancel context.CancelFunc) *layerBody {
+	// Resume from the location the download may have been redirected to, with the headers that
+	// the redirects kept.
+	resumeRequest := request
+	if r.Request != nil {
+		resumeRequest = r.Request
+	}
+
+	return &layerBody{
+		body:      r.Body,
+		request:   resumeRequest,
+		cancel:    cancel,
+		resumable: r.Header.Get("Accept-Ranges") == "bytes",
+		attempts:  attempts,
+	}
+}
+
+func (b *layerBody) Read(p []byte) (int, error) {
+	for {
+		n, err := b.body.Read(p)
+		b.offset += int64(n)
+		if err == nil || err == io.EOF {
+			return n, err
+		}
+
+		if !b.resumable || b.resumptions >= b.attempts-1 || b.request.Context().Err() != nil {
+			return n, err
+		}
+		log.Warningf("layer download interrupted after %d bytes, resuming: %s", b.offset, err)
+		if rerr := b.resume(); rerr != nil {
+			log.Warningf("could not resume layer download: %s", rerr)
+			return n, err
+		}
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+// resume replaces the body with the one of a Range request that starts at the current offset.
+func (b *layerBody) resume() error {
+	b.body.Close()
+	b.resumptions++
+
+	request := new(http.Request)
+	*request = *b.request
+	request.Header = make(http.Header, len(b.request.Header)+1)
+	for k, v := range b.request.Header {
+		request.Header[k] = v
+	}
+	request.Header.Set("Range", fmt.Sprintf("bytes=%d-", b.offset))
+
+	r, err := sendLayerRequest(request, b.attempts-b.resumptions)
+	if err != nil {
+		return err
+	}
+	switch {
+	case r.StatusCode == http.StatusPartialContent && strings.HasPrefix(r.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-", b.offset)):
+	case r.StatusCode == http.StatusOK:
+		// The server ignored the range: skip what has been read already.
+		if _, err := io.CopyN(ioutil.Discard, r.Body, b.offset); err != nil {
+			r.Body.Close()
+			return err
+		}
+	default:
+		r.Body.Close()
+		return fmt.Errorf("got status code %d, expected 206", r.StatusCode)
+	}
+
+	promLayerDownloadResumptionsTotal.Inc()
+	b.body = r.Body
+	return nil
+}
+
+func (b *layerBody) Close() error {
+	defer b.cancel()
+	return b.body.Close()
+}
@@ -0,0 +1,194 @@
+// Copyright 2015 clair authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package detectors
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/coreos/clair/utils"
+)
+
+// flakyServer serves a layer, failing the first requests with a 503 and interrupting the first
+// download that gets past them.
+type flakyServer struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	content  []byte
+	failures int
+	cutAt    int
+	ranges   bool
+	requests []string
+}
+
+func newFlakyServer(failures, cutAt int, ranges bool) *flakyServer {
+	server := &flakyServer{
+		content:  bytes.Repeat([]byte("0123456789abcdef"), 8192),
+		failures: failures,
+		cutAt:    cutAt,
+		ranges:   ranges,
+	}
+	server.Server = httptest.NewServer(http.HandlerFunc(server.serveHTTP))
+	return server
+}
+
+func (server *flakyServer) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	server.mu.Lock()
+	server.requests = append(server.requests, r.Header.Get("Range"))
+	if len(server.requests) <= server.failures {
+		server.mu.Unlock()
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	cutAt := server.cutAt
+	server.cutAt = 0
+	server.mu.Unlock()
+
+	content, status := server.content, http.StatusOK
+	if server.ranges {
+		w.Header().Set("Accept-Ranges", "bytes")
+		if rng := r.Header.Get("Range"); strings.HasPrefix(rng, "bytes=") && strings.HasSuffix(rng, "-") {
+			start, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(rng, "bytes="), "-"))
+			if err != nil || start >= len(content) {
+				w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+				return
+			}
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, len(content)-1, len(content)))
+			content, status = content[start:], http.StatusPartialContent
+		}
+	}
+
+	w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+	w.WriteHeader(status)
+	if cutAt > 0 {
+		w.Write(content[:cutAt])
+		w.(http.Flusher).Flush()
+		panic(http.ErrAbortHandler)
+	}
+	w.Write(content)
+}
+
+func (server *flakyServer) rangeHeaders() []string {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	return append([]string(nil), server.requests...)
+}
+
+// setTestDownloadPolicy shortens the backoff and sets the download policy until the returned
+// function is called.
+func setTestDownloadPolicy(attempts int, timeout time.Duration) func() {
+	downloadBackoff = time.Millisecond
+	SetDownloadPolicy(attempts, timeout)
+	return func() {
+		downloadBackoff = 500 * time.Millisecond
+		SetDownloadPolicy(DefaultDownloadAttempts, DefaultDownloadTimeout)
+	}
+}
+
+func retries(reason string) float64 {
+	var metric dto.Metric
+	promLayerDownloadRetriesTotal.WithLabelValues(reason).Write(&metric)
+	return metric.GetCounter().GetValue()
+}
+
+func resumptions() float64 {
+	var metric dto.Metric
+	promLayerDownloadResumptionsTotal.Write(&metric)
+	return metric.GetCounter().GetValue()
+}
+
+func TestDetectDataRetries(t *testing.T) {
+	defer setTestDownloadPolicy(3, time.Minute)()
+
+	// The first two attempts fail.
+	server := newFlakyServer(2, 0, false)
+	defer server.Close()
+
+	before := retries("status")
+	data, err := DetectData("Test", server.URL+"/layer.tar", nil, nil, nil, utils.ExtractionLimits{})
+	if assert.Nil(t, err) {
+		assert.Equal(t, server.content, data["layer"])
+	}
+	assert.Len(t, server.rangeHeaders(), 3)
+	assert.Equal(t, before+2, retries("status"))
+
+	// The download fails once every attempt failed.
+	failing := newFlakyServer(10, 0, false)
+	defer failing.Close()
+
+	_, err = DetectData("Test", failing.URL+"/layer.tar", nil, nil, nil, utils.ExtractionLimits{})
+	assert.Equal(t, &ErrCouldNotDownload{StatusCode: http.StatusServiceUnavailable}, err)
+	assert.Len(t, failing.rangeHeaders(), 3)
+
+	// Connection errors are retried as well.
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+	before = retries("error")
+	_, err = DetectData("Test", closed.URL+"/layer.tar", nil, nil, nil, utils.ExtractionLimits{})
+	assert.Equal(t, &ErrCouldNotDownload{}, err)
+	assert.Equal(t, before+2, retries("error"))
+}
+
+func TestDetectDataResume(t *testing.T) {
+	defer setTestDownloadPolicy(3, time.Minute)()
+
+	// The first two attempts fail, and the third one is interrupted.
+	server := newFlakyServer(2, 40000, true)
+	defer server.Close()
+
+	before := resumptions()
+	data, err := DetectData("Test", server.URL+"/layer.tar", nil, nil, nil, utils.ExtractionLimits{})
+	if assert.Nil(t, err) {
+		assert.Equal(t, server.content, data["layer"])
+	}
+	assert.Equal(t, []string{"", "", "", "bytes=40000-"}, server.rangeHeaders())
+	assert.Equal(t, before+1, resumptions())
+
+	// Without Range requests, the download can't be resumed.
+	noRanges := newFlakyServer(0, 40000, false)
+	defer noRanges.Close()
+
+	_, err = DetectData("Test", noRanges.URL+"/layer.tar", nil, nil, nil, utils.ExtractionLimits{})
+	assert.NotNil(t, err)
+	assert.Equal(t, []string{""}, noRanges.rangeHeaders())
+}
+
+func TestDetectDataTimeout(t *testing.T) {
+	defer setTestDownloadPolicy(10, 100*time.Millisecond)()
+
+	hanging := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(10 * time.Second):
+		}
+	}))
+	defer hanging.Close()
+
+	start := time.Now()
+	_, err := DetectData("Test", hanging.URL+"/layer.tar", nil, nil, nil, utils.ExtractionLimits{})
+	assert.Equal(t, &ErrCouldNotDownload{}, err)
+	assert.True(t, time.Since(start) < 5*time.Second)
+}
@@ -0,0 +1,134 @@
+// Copyright 2015 clair authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"bufio"
+	"bytes"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/coreos/clair/database"
+	"github.com/coreos/clair/utils/types"
+	"github.com/coreos/clair/worker/detectors"
+	"github.com/coreos/pkg/capnslog"
+)
+
+const installedPath = "lib/apk/db/installed"
+
+var (
+	log = capnslog.NewPackageLogger("github.com/coreos/clair", "apk")
+
+	promInvalidVersionsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "clair_worker_apk_invalid_versions_total",
+		Help: "Number of apk packages skipped because their version could not be parsed.",
+	})
+)
+
+// ApkFeaturesDetector implements FeaturesDetector and detects apk packages
+type ApkFeaturesDetector struct{}
+
+func init() {
+	detectors.RegisterFeaturesDetector("apk", &ApkFeaturesDetector{})
+	prometheus.MustRegister(promInvalidVersionsTotal)
+}
+
+// apkEntry holds the fields of a package entry of the installed database that matter to the
+// detector.
+type apkEntry struct {
+	name, version, origin string
+}
+
+// Detect detects packages using lib/apk/db/installed from the input data
+//
+// Packages are named after their origin package, as the Alpine vulnerabilities are. The Namespace
+// of the packages is left for the worker to fill.
+func (detector *ApkFeaturesDetector) Detect(data map[string][]byte) ([]database.FeatureVersion, error) {
+	f, hasFile := data[installedPath]
+	if !hasFile {
+		return []database.FeatureVersion{}, nil
+	}
+
+	// Create a map to store packages and ensure their uniqueness: the packages built from the same
+	// origin appear once.
+	packagesMap := make(map[string]database.FeatureVersion)
+	addPackage := func(entry apkEntry) {
+		if pkg, ok := entry.featureVersion(); ok {
+			packagesMap[pkg.Feature.Name+"#"+pkg.Version.String()] = pkg
+		}
+	}
+
+	// The entries are separated by empty lines, and each of their lines is a single letter, a
+	// colon and a value.
+	var entry apkEntry
+	scanner := bufio.NewScanner(bytes.NewReader(f))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if len(line) < 2 || line[1] != ':' {
+			addPackage(entry)
+			entry = apkEntry{}
+			continue
+		}
+
+		switch line[0] {
+		case 'P':
+			entry.name = line[2:]
+		case 'V':
+			entry.version = line[2:]
+		case 'o':
+			entry.origin = line[2:]
+		}
+	}
+	addPackage(entry)
+
+	// Convert the map to a slice
+	packages := make([]database.FeatureVersion, 0, len(packagesMap))
+	for _, pkg := range packagesMap {
+		packages = append(packages, pkg)
+	}
+
+	return packages, nil
+}
+
+// featureVersion returns the FeatureVersion described by the entry, if it is complete and its
+// version is valid.
+func (e apkEntry) featureVersion() (database.FeatureVersion, bool) {
+	if e.name == "" || e.version == "" {
+		if e.name != "" {
+			log.Warningf("skipping package %s, which has no version", e.name)
+		}
+		return database.FeatureVersion{}, false
+	}
+
+	// The package revision, e.g. -r0, is kept as the revision of the version.
+	version, err := types.NewVersion(e.version)
+	if err != nil {
+		log.Warningf("could not parse version '%s' of package %s: %s", e.version, e.name, err)
+		promInvalidVersionsTotal.Inc()
+		return database.FeatureVersion{}, false
+	}
+
+	name := e.name
+	if e.origin != "" {
+		name = e.origin
+	}
+	return database.FeatureVersion{Feature: database.Feature{Name: name}, Version: version}, true
+}
+
+// GetRequiredFiles returns the list of files required for Detect, without
+// leading /
+func (detector *ApkFeaturesDetector) GetRequiredFiles() []string {
+	return []string{installedPath}
+}
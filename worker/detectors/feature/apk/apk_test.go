@@ -0,0 +1,46 @@
+// Copyright 2015 clair authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/coreos/clair/worker/detectors/testutil"
+)
+
+func TestApkFeaturesDetector(t *testing.T) {
+	testutil.RunFeaturesDetectorTests(t, &ApkFeaturesDetector{}, "testdata/layers")
+}
+
+func TestApkFeaturesDetectorTruncatedDatabase(t *testing.T) {
+	// The database is cut in the middle of the entry of busybox, before its version.
+	installed, err := ioutil.ReadFile("testdata/layers/alpine-3.4/lib/apk/db/installed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	truncated := installed[:bytes.Index(installed, []byte("V:1.24.2-r9"))]
+
+	featureVersions, err := (&ApkFeaturesDetector{}).Detect(map[string][]byte{
+		"lib/apk/db/installed": truncated,
+	})
+	if assert.Nil(t, err) && assert.Len(t, featureVersions, 1) {
+		assert.Equal(t, "musl", featureVersions[0].Feature.Name)
+		assert.Equal(t, "1.1.14-r10", featureVersions[0].Version.String())
+	}
+}
@@ -19,17 +19,34 @@ import (
 	"regexp"
 	"strings"
 
+	"github.com/prometheus/client_golang/prometheus"
+
 	"github.com/coreos/clair/database"
+	"github.com/coreos/clair/utils"
 	"github.com/coreos/clair/utils/types"
 	"github.com/coreos/clair/worker/detectors"
 	"github.com/coreos/pkg/capnslog"
 )
 
+const (
+	// statusPath is the database of the installed packages.
+	statusPath = "var/lib/dpkg/status"
+
+	// statusDPattern matches the files that list the installed packages in the distroless images,
+	// which have no statusPath.
+	statusDPattern = "var/lib/dpkg/status.d/*"
+)
+
 var (
 	log = capnslog.NewPackageLogger("github.com/coreos/clair", "worker/detectors/packages")
 
 	dpkgSrcCaptureRegexp      = regexp.MustCompile(`Source: (?P<name>[^\s]*)( \((?P<version>.*)\))?`)
 	dpkgSrcCaptureRegexpNames = dpkgSrcCaptureRegexp.SubexpNames()
+
+	promInvalidVersionsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "clair_worker_dpkg_invalid_versions_total",
+		Help: "Number of dpkg packages skipped because their version could not be parsed.",
+	})
 )
 
 // DpkgFeaturesDetector implements FeaturesDetector and detects dpkg packages
@@ -37,79 +54,139 @@ type DpkgFeaturesDetector struct{}
 
 func init() {
 	detectors.RegisterFeaturesDetector("dpkg", &DpkgFeaturesDetector{})
+	prometheus.MustRegister(promInvalidVersionsTotal)
+}
+
+// dpkgStanza holds the fields of a package entry of the status file that matter to the detector.
+type dpkgStanza struct {
+	name, architecture, version, source, sourceVersion, status string
 }
 
-// Detect detects packages using var/lib/dpkg/status from the input data
+// Detect detects packages using var/lib/dpkg/status from the input data, as well as the
+// var/lib/dpkg/status.d/* files that the distroless images have instead, one per package. When
+// both list a package for the same architecture, the entry of status.d wins.
+//
+// Packages are named after their source package, as the vulnerabilities are, and the packages
+// that are not installed anymore are ignored. The Namespace of the packages is left for the worker
+// to fill.
 func (detector *DpkgFeaturesDetector) Detect(data map[string][]byte) ([]database.FeatureVersion, error) {
-	f, hasFile := data["var/lib/dpkg/status"]
-	if !hasFile {
+	files := utils.MatchingFiles(data, statusDPattern)
+	if _, hasFile := data[statusPath]; hasFile {
+		files = append([]string{statusPath}, files...)
+	}
+	if len(files) == 0 {
 		return []database.FeatureVersion{}, nil
 	}
 
-	// Create a map to store packages and ensure their uniqueness
+	// Read the stanzas of the status file first, so that the ones of the status.d files replace
+	// them.
+	stanzas := make(map[string]dpkgStanza)
+	addStanza := func(stanza dpkgStanza) {
+		if stanza.name != "" {
+			stanzas[stanza.name+":"+stanza.architecture] = stanza
+		}
+	}
+	for _, file := range files {
+		parseStatus(data[file], addStanza)
+	}
+
+	// Create a map to store packages and ensure their uniqueness: the packages built from the same
+	// source, and the packages installed for several architectures, appear once.
 	packagesMap := make(map[string]database.FeatureVersion)
+	for _, stanza := range stanzas {
+		if pkg, ok := stanza.featureVersion(); ok {
+			packagesMap[pkg.Feature.Name+"#"+pkg.Version.String()] = pkg
+		}
+	}
+
+	// Convert the map to a slice
+	packages := make([]database.FeatureVersion, 0, len(packagesMap))
+	for _, pkg := range packagesMap {
+		packages = append(packages, pkg)
+	}
+
+	return packages, nil
+}
 
-	var pkg database.FeatureVersion
-	var err error
+// parseStatus calls addPackage with every stanza of the given status file.
+func parseStatus(f []byte, addPackage func(dpkgStanza)) {
+	// The stanzas are separated by empty lines.
+	var stanza dpkgStanza
 	scanner := bufio.NewScanner(strings.NewReader(string(f)))
 	for scanner.Scan() {
 		line := scanner.Text()
 
-		if strings.HasPrefix(line, "Package: ") {
-			// Package line
+		switch {
+		case strings.TrimSpace(line) == "":
+			addPackage(stanza)
+			stanza = dpkgStanza{}
+		case strings.HasPrefix(line, "Package: "):
 			// Defines the name of the package
-
-			pkg.Feature.Name = strings.TrimSpace(strings.TrimPrefix(line, "Package: "))
-			pkg.Version = types.Version{}
-		} else if strings.HasPrefix(line, "Source: ") {
-			// Source line (Optionnal)
-			// Gives the name of the source package
-			// May also specifies a version
-
-			srcCapture := dpkgSrcCaptureRegexp.FindAllStringSubmatch(line, -1)[0]
+			stanza.name = strings.TrimSpace(strings.TrimPrefix(line, "Package: "))
+		case strings.HasPrefix(line, "Architecture: "):
+			// Defines the architecture the package is installed for, e.g. "amd64" or "all"
+			stanza.architecture = strings.TrimSpace(strings.TrimPrefix(line, "Architecture: "))
+		case strings.HasPrefix(line, "Status: "):
+			// Defines whether the package is installed, e.g. "install ok installed"
+			stanza.status = strings.TrimSpace(strings.TrimPrefix(line, "Status: "))
+		case strings.HasPrefix(line, "Source: "):
+			// Optional, gives the name of the source package and may also specify its version
+			srcCapture := dpkgSrcCaptureRegexp.FindStringSubmatch(line)
 			md := map[string]string{}
 			for i, n := range srcCapture {
 				md[dpkgSrcCaptureRegexpNames[i]] = strings.TrimSpace(n)
 			}
-
-			pkg.Feature.Name = md["name"]
-			if md["version"] != "" {
-				pkg.Version, err = types.NewVersion(md["version"])
-				if err != nil {
-					log.Warningf("could not parse package version '%s': %s. skipping", line[1], err.Error())
-				}
-			}
-		} else if strings.HasPrefix(line, "Version: ") && pkg.Version.String() == "" {
-			// Version line
+			stanza.source = md["name"]
+			stanza.sourceVersion = md["version"]
+		case strings.HasPrefix(line, "Version: "):
 			// Defines the version of the package
-			// This version is less important than a version retrieved from a Source line
-			// because the Debian vulnerabilities often skips the epoch from the Version field
-			// which is not present in the Source version, and because +bX revisions don't matter
-			pkg.Version, err = types.NewVersion(strings.TrimPrefix(line, "Version: "))
-			if err != nil {
-				log.Warningf("could not parse package version '%s': %s. skipping", line[1], err.Error())
-			}
+			stanza.version = strings.TrimSpace(strings.TrimPrefix(line, "Version: "))
 		}
+	}
+	addPackage(stanza)
+}
 
-		// Add the package to the result array if we have all the informations
-		if pkg.Feature.Name != "" && pkg.Version.String() != "" {
-			packagesMap[pkg.Feature.Name+"#"+pkg.Version.String()] = pkg
-			pkg.Feature.Name = ""
-			pkg.Version = types.Version{}
-		}
+// featureVersion returns the FeatureVersion described by the stanza, if the package is installed
+// and its version is valid.
+func (s dpkgStanza) featureVersion() (database.FeatureVersion, bool) {
+	if s.name == "" {
+		return database.FeatureVersion{}, false
 	}
 
-	// Convert the map to a slice
-	packages := make([]database.FeatureVersion, 0, len(packagesMap))
-	for _, pkg := range packagesMap {
-		packages = append(packages, pkg)
+	// The desired action and the error flag don't matter, only the current state does.
+	if fields := strings.Fields(s.status); len(fields) == 3 && (fields[2] == "not-installed" || fields[2] == "config-files") {
+		return database.FeatureVersion{}, false
 	}
 
-	return packages, nil
+	name := s.name
+	if s.source != "" {
+		name = s.source
+	}
+
+	// The version of the source package is preferred, because the Debian vulnerabilities often
+	// skip the epoch from the Version field which is not present in the Source version, and
+	// because +bX revisions don't matter.
+	for _, v := range []string{s.sourceVersion, s.version} {
+		if v == "" {
+			continue
+		}
+		version, err := types.NewVersion(v)
+		if err != nil {
+			log.Warningf("could not parse version '%s' of package %s: %s", v, s.name, err)
+			continue
+		}
+		return database.FeatureVersion{Feature: database.Feature{Name: name}, Version: version}, true
+	}
+
+	if s.version != "" || s.sourceVersion != "" {
+		log.Warningf("skipping package %s, which has no valid version", s.name)
+		promInvalidVersionsTotal.Inc()
+	}
+	return database.FeatureVersion{}, false
 }
 
 // GetRequiredFiles returns the list of files required for Detect, without
 // leading /
 func (detector *DpkgFeaturesDetector) GetRequiredFiles() []string {
-	return []string{"var/lib/dpkg/status"}
+	return []string{statusPath, statusDPattern}
 }
@@ -0,0 +1,163 @@
+// Copyright 2015 clair authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gem
+
+import (
+	"path"
+	"regexp"
+	"strings"
+	"unicode"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/coreos/clair/database"
+	"github.com/coreos/clair/utils"
+	"github.com/coreos/clair/utils/types"
+	"github.com/coreos/clair/worker/detectors"
+	"github.com/coreos/pkg/capnslog"
+)
+
+var (
+	log = capnslog.NewPackageLogger("github.com/coreos/clair", "gem")
+
+	// Namespace is the Namespace of the Ruby gems.
+	Namespace = database.Namespace{Name: "ruby"}
+
+	// specificationFiles are the specifications of the installed gems: the ones of the gem homes
+	// of Ruby and of the distributions, of the official Docker images, and of the bundles
+	// vendored in the applications.
+	specificationFiles = []string{
+		"usr/lib/ruby/gems/*/specifications/*.gemspec",
+		"usr/local/lib/ruby/gems/*/specifications/*.gemspec",
+		"var/lib/gems/*/specifications/*.gemspec",
+		"usr/local/bundle/specifications/*.gemspec",
+		"**/vendor/bundle/ruby/*/specifications/*.gemspec",
+	}
+
+	// nameRegexp and versionRegexp match the attributes of the gems in their specifications,
+	// which RubyGems writes as string literals.
+	nameRegexp    = regexp.MustCompile(`(?m)^\s*s\.name\s*=\s*["']([^"']+)["']`)
+	versionRegexp = regexp.MustCompile(`(?m)^\s*s\.version\s*=\s*["']([^"']+)["']`)
+
+	promInvalidPackagesTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "clair_worker_gem_invalid_packages_total",
+		Help: "Number of Ruby gems skipped because their specification could not be parsed.",
+	})
+)
+
+// GemFeaturesDetector implements FeaturesDetector and detects the installed Ruby gems.
+type GemFeaturesDetector struct{}
+
+func init() {
+	detectors.RegisterFeaturesDetector("gem", &GemFeaturesDetector{})
+	prometheus.MustRegister(promInvalidPackagesTotal)
+}
+
+// Detect detects gems using the specification files of the gem homes from the input data.
+//
+// The specifications aren't evaluated: the name and the version of the gems are read from their
+// string literals, or from the name of the file when they are missing. Gems belong to the ruby
+// Namespace and their versions don't include their platform.
+func (detector *GemFeaturesDetector) Detect(data map[string][]byte) ([]database.FeatureVersion, error) {
+	packages := []database.FeatureVersion{}
+	seen := make(map[string]struct{})
+	for _, pattern := range specificationFiles {
+		for _, file := range utils.MatchingFiles(data, pattern) {
+			name, version := parseSpecification(data[file])
+			if name == "" || version == "" {
+				name, version = parseFilename(file)
+			}
+			if name == "" {
+				log.Warningf("skipping Ruby gem specification %s, which has no valid name", file)
+				promInvalidPackagesTotal.Inc()
+				continue
+			}
+
+			v, err := types.NewVersion(stripPlatform(version))
+			if err != nil {
+				log.Warningf("skipping Ruby gem %s of %s, which has no valid version: %s", name, file, err)
+				promInvalidPackagesTotal.Inc()
+				continue
+			}
+
+			// Ensure the uniqueness of the gems, which are installed in several gem homes.
+			key := name + "#" + v.String()
+			if _, ok := seen[key]; ok {
+				continue
+			}
+			seen[key] = struct{}{}
+
+			packages = append(packages, database.FeatureVersion{
+				Feature: database.Feature{Name: name, Namespace: Namespace},
+				Version: v,
+			})
+		}
+	}
+
+	return packages, nil
+}
+
+// parseSpecification returns the name and the version of a gem from its specification.
+func parseSpecification(spec []byte) (name, version string) {
+	if m := nameRegexp.FindSubmatch(spec); m != nil {
+		name = strings.TrimSpace(string(m[1]))
+	}
+	if m := versionRegexp.FindSubmatch(spec); m != nil {
+		version = strings.TrimSpace(string(m[1]))
+	}
+	return
+}
+
+// parseFilename returns the name and the version of a gem from the name of its specification,
+// which is <name>-<version>[-<platform>].gemspec. As versions can't contain dashes, the version
+// is the first element that starts with a digit.
+func parseFilename(file string) (name, version string) {
+	elements := strings.Split(strings.TrimSuffix(path.Base(file), ".gemspec"), "-")
+	for i := 1; i < len(elements); i++ {
+		if elements[i] != "" && unicode.IsDigit(rune(elements[i][0])) {
+			return strings.Join(elements[:i], "-"), strings.Join(elements[i:], "-")
+		}
+	}
+	return "", ""
+}
+
+// stripPlatform removes the platform of the gems built for a specific one, such as x86_64-linux,
+// from their version.
+func stripPlatform(version string) string {
+	if i := strings.Index(version, "-"); i > -1 {
+		return version[:i]
+	}
+	return version
+}
+
+// Namespace returns the Namespace of the Ruby gems.
+func (detector *GemFeaturesDetector) Namespace() database.Namespace {
+	return Namespace
+}
+
+// DeletedFeature returns the name of the gem whose specification is the given deleted path.
+func (detector *GemFeaturesDetector) DeletedFeature(path string) (string, bool) {
+	if !strings.HasSuffix(path, ".gemspec") {
+		return "", false
+	}
+	name, _ := parseFilename(path)
+	return name, name != ""
+}
+
+// GetRequiredFiles returns the list of files required for Detect, without
+// leading /
+func (detector *GemFeaturesDetector) GetRequiredFiles() []string {
+	return specificationFiles
+}
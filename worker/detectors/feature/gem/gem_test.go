@@ -0,0 +1,74 @@
+// Copyright 2015 clair authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gem
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/coreos/clair/utils"
+	"github.com/coreos/clair/worker/detectors/testutil"
+)
+
+func TestGemFeaturesDetector(t *testing.T) {
+	testutil.RunFeaturesDetectorTests(t, &GemFeaturesDetector{}, "testdata/layers")
+}
+
+func TestGemRequiredFiles(t *testing.T) {
+	for file, required := range map[string]bool{
+		"usr/lib/ruby/gems/2.5.0/specifications/rack-2.0.4.gemspec":               true,
+		"usr/local/lib/ruby/gems/2.5.0/specifications/rack-2.0.4.gemspec":         true,
+		"var/lib/gems/2.5.0/specifications/rack-2.0.4.gemspec":                    true,
+		"usr/local/bundle/specifications/rack-2.0.4.gemspec":                      true,
+		"srv/app/vendor/bundle/ruby/2.5.0/specifications/rack-2.0.4.gemspec":      true,
+		"usr/local/bundle/gems/rack-2.0.4/rack.gemspec":                           false,
+		"usr/lib/ruby/gems/2.5.0/specifications/default/bigdecimal-1.3.4.gemspec": false,
+		"srv/app/rack.gemspec": false,
+	} {
+		matched := false
+		for _, pattern := range (&GemFeaturesDetector{}).GetRequiredFiles() {
+			matched = matched || utils.MatchFile(file, pattern)
+		}
+		assert.Equal(t, required, matched, file)
+	}
+}
+
+func TestGemFilename(t *testing.T) {
+	for file, expected := range map[string][2]string{
+		"rack-2.0.4.gemspec":                  {"rack", "2.0.4"},
+		"rack-test-1.0.0.gemspec":             {"rack-test", "1.0.0"},
+		"nokogiri-1.8.2-x86_64-linux.gemspec": {"nokogiri", "1.8.2-x86_64-linux"},
+		"invalid.gemspec":                     {"", ""},
+	} {
+		name, version := parseFilename(file)
+		assert.Equal(t, expected, [2]string{name, version}, file)
+	}
+}
+
+func TestGemDeletedFeature(t *testing.T) {
+	for deleted, expected := range map[string]string{
+		"usr/local/bundle/specifications/rack-2.0.4.gemspec":                  "rack",
+		"usr/local/bundle/specifications/nokogiri-1.8.2-x86_64-linux.gemspec": "nokogiri",
+		"usr/local/bundle/specifications/invalid.gemspec":                     "",
+		"usr/local/bundle/specifications/":                                    "",
+		"usr/local/bundle/specifications":                                     "",
+		"usr/local/bundle":                                                    "",
+	} {
+		name, ok := (&GemFeaturesDetector{}).DeletedFeature(deleted)
+		assert.Equal(t, expected, name, deleted)
+		assert.Equal(t, expected != "", ok, deleted)
+	}
+}
@@ -0,0 +1,129 @@
+// Copyright 2015 clair authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gobinary
+
+import (
+	"bytes"
+	"debug/buildinfo"
+	"runtime/debug"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/coreos/clair/database"
+	"github.com/coreos/clair/utils"
+	"github.com/coreos/clair/utils/types"
+	"github.com/coreos/clair/worker/detectors"
+	"github.com/coreos/pkg/capnslog"
+)
+
+// stdlib is the name of the Feature of the standard library, whose version is the one of Go.
+const stdlib = "stdlib"
+
+var (
+	log = capnslog.NewPackageLogger("github.com/coreos/clair", "gobinary")
+
+	// Namespace is the Namespace of the Go modules.
+	Namespace = database.Namespace{Name: "go"}
+
+	// executableFiles are all the executables of the layers, whose build information tells the
+	// modules that were compiled in the Go ones.
+	executableFiles = []string{utils.ExecutablePrefix + "**"}
+
+	promInvalidModulesTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "clair_worker_gobinary_invalid_modules_total",
+		Help: "Number of Go modules skipped because their version could not be parsed.",
+	})
+)
+
+// GoBinaryFeaturesDetector implements FeaturesDetector and detects the Go modules compiled in the
+// executables.
+type GoBinaryFeaturesDetector struct{}
+
+func init() {
+	detectors.RegisterFeaturesDetector("gobinary", &GoBinaryFeaturesDetector{})
+	prometheus.MustRegister(promInvalidModulesTotal)
+}
+
+// Detect detects Go modules using the build information embedded in the executables from the
+// input data, which remains in the stripped executables. The executables without build
+// information, which weren't built by Go with module support, are skipped.
+//
+// Modules are named after their path and belong to the go Namespace. The replacements of the
+// modules appear instead of them, except the local ones, which have no version. The standard
+// library appears as the stdlib module, at the version of Go.
+func (detector *GoBinaryFeaturesDetector) Detect(data map[string][]byte) ([]database.FeatureVersion, error) {
+	packages := []database.FeatureVersion{}
+	seen := make(map[string]struct{})
+	for _, pattern := range executableFiles {
+		for _, file := range utils.MatchingFiles(data, pattern) {
+			info, err := buildinfo.Read(bytes.NewReader(data[file]))
+			if err != nil {
+				continue
+			}
+
+			modules := append([]*debug.Module{&info.Main, {Path: stdlib, Version: info.GoVersion}}, info.Deps...)
+			for _, module := range modules {
+				if module.Replace != nil {
+					module = module.Replace
+				}
+				if module.Path == "" || module.Version == "" || module.Version == "(devel)" {
+					continue
+				}
+
+				version, err := types.NewVersion(trimVersion(module.Version))
+				if err != nil {
+					log.Warningf("skipping Go module %s of %s, which has no valid version: %s", module.Path, file, err)
+					promInvalidModulesTotal.Inc()
+					continue
+				}
+
+				// Ensure the uniqueness of the modules, which are compiled in several executables.
+				key := module.Path + "#" + version.String()
+				if _, ok := seen[key]; ok {
+					continue
+				}
+				seen[key] = struct{}{}
+
+				packages = append(packages, database.FeatureVersion{
+					Feature: database.Feature{Name: module.Path, Namespace: Namespace},
+					Version: version,
+				})
+			}
+		}
+	}
+
+	return packages, nil
+}
+
+// trimVersion returns a version of a module, such as v1.2.3, or of Go, such as go1.10.2, without
+// its prefix and the experiments Go was built with.
+func trimVersion(version string) string {
+	if i := strings.Index(version, " "); i > -1 {
+		version = version[:i]
+	}
+	return strings.TrimPrefix(strings.TrimPrefix(version, "go"), "v")
+}
+
+// Namespace returns the Namespace of the Go modules.
+func (detector *GoBinaryFeaturesDetector) Namespace() database.Namespace {
+	return Namespace
+}
+
+// GetRequiredFiles returns the list of files required for Detect, without
+// leading /
+func (detector *GoBinaryFeaturesDetector) GetRequiredFiles() []string {
+	return executableFiles
+}
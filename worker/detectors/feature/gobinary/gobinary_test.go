@@ -0,0 +1,58 @@
+// Copyright 2015 clair authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gobinary
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/coreos/clair/worker/detectors/testutil"
+)
+
+// testdata/layers/executables/usr/local/bin/hello was built from a main module importing
+// github.com/example/greeting v1.2.3, with go build -mod=vendor -trimpath -ldflags="-s -w", and
+// bin/true with gcc -s.
+func TestGoBinaryFeaturesDetector(t *testing.T) {
+	testutil.RunFeaturesDetectorTests(t, &GoBinaryFeaturesDetector{}, "testdata/layers")
+}
+
+func TestGoBinaryFeaturesDetectorDuplicates(t *testing.T) {
+	hello, err := ioutil.ReadFile("testdata/layers/executables/usr/local/bin/hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The modules of an executable found twice in the layer are only reported once.
+	featureVersions, err := (&GoBinaryFeaturesDetector{}).Detect(map[string][]byte{
+		"usr/local/bin/hello": hello,
+		"opt/hello/hello":     hello,
+	})
+	if assert.Nil(t, err) {
+		assert.Len(t, featureVersions, 2)
+	}
+}
+
+func TestGoBinaryTrimVersion(t *testing.T) {
+	for version, expected := range map[string]string{
+		"v1.2.3":                             "1.2.3",
+		"v0.0.0-20180406214816-61147c48b25b": "0.0.0-20180406214816-61147c48b25b",
+		"go1.10.2":                           "1.10.2",
+		"go1.21.0 X:loopvar":                 "1.21.0",
+	} {
+		assert.Equal(t, expected, trimVersion(version), version)
+	}
+}
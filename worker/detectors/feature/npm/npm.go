@@ -0,0 +1,124 @@
+// Copyright 2015 clair authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package npm
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/coreos/clair/database"
+	"github.com/coreos/clair/utils"
+	"github.com/coreos/clair/utils/types"
+	"github.com/coreos/clair/worker/detectors"
+	"github.com/coreos/pkg/capnslog"
+)
+
+var (
+	log = capnslog.NewPackageLogger("github.com/coreos/clair", "npm")
+
+	// Namespace is the Namespace of the Node.js packages.
+	Namespace = database.Namespace{Name: "npm"}
+
+	// manifestFiles are the manifests of the packages of every node_modules directory, the scoped
+	// packages being in a subdirectory named after their scope.
+	manifestFiles = []string{
+		"**/node_modules/*/package.json",
+		"**/node_modules/@*/*/package.json",
+	}
+
+	promInvalidPackagesTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "clair_worker_npm_invalid_packages_total",
+		Help: "Number of Node.js packages skipped because their manifest could not be parsed.",
+	})
+)
+
+// NpmFeaturesDetector implements FeaturesDetector and detects the Node.js packages installed in
+// node_modules directories.
+type NpmFeaturesDetector struct{}
+
+func init() {
+	detectors.RegisterFeaturesDetector("npm", &NpmFeaturesDetector{})
+	prometheus.MustRegister(promInvalidPackagesTotal)
+}
+
+// Detect detects packages using the package.json files of the node_modules directories from the
+// input data.
+//
+// Packages belong to the npm Namespace. As node_modules directories are nested, a package may be
+// installed several times, with different versions, which all appear.
+func (detector *NpmFeaturesDetector) Detect(data map[string][]byte) ([]database.FeatureVersion, error) {
+	packages := []database.FeatureVersion{}
+	seen := make(map[string]struct{})
+	for _, pattern := range manifestFiles {
+		for _, file := range utils.MatchingFiles(data, pattern) {
+			var manifest struct {
+				Name    string `json:"name"`
+				Version string `json:"version"`
+			}
+			if err := json.Unmarshal(data[file], &manifest); err != nil || manifest.Name == "" {
+				log.Warningf("skipping Node.js package manifest %s, which has no valid name", file)
+				promInvalidPackagesTotal.Inc()
+				continue
+			}
+			version, err := types.NewVersion(manifest.Version)
+			if err != nil {
+				log.Warningf("skipping Node.js package %s of %s, which has no valid version: %s", manifest.Name, file, err)
+				promInvalidPackagesTotal.Inc()
+				continue
+			}
+
+			// Ensure the uniqueness of the packages, which are installed in several directories.
+			key := manifest.Name + "#" + version.String()
+			if _, ok := seen[key]; ok {
+				continue
+			}
+			seen[key] = struct{}{}
+
+			packages = append(packages, database.FeatureVersion{
+				Feature: database.Feature{Name: manifest.Name, Namespace: Namespace},
+				Version: version,
+			})
+		}
+	}
+
+	return packages, nil
+}
+
+// Namespace returns the Namespace of the Node.js packages.
+func (detector *NpmFeaturesDetector) Namespace() database.Namespace {
+	return Namespace
+}
+
+// DeletedFeature returns the name of the package whose directory, or manifest, is the given
+// deleted path, which is the name of the directory, prefixed by its scope if any.
+func (detector *NpmFeaturesDetector) DeletedFeature(deleted string) (string, bool) {
+	elements := strings.Split(strings.TrimSuffix(strings.TrimSuffix(deleted, "/"), "/package.json"), "/")
+	n := len(elements)
+	switch {
+	case n >= 2 && elements[n-2] == "node_modules" && !strings.HasPrefix(elements[n-1], "@"):
+		return elements[n-1], true
+	case n >= 3 && elements[n-3] == "node_modules" && strings.HasPrefix(elements[n-2], "@"):
+		return elements[n-2] + "/" + elements[n-1], true
+	}
+	return "", false
+}
+
+// GetRequiredFiles returns the list of files required for Detect, without
+// leading /
+func (detector *NpmFeaturesDetector) GetRequiredFiles() []string {
+	return manifestFiles
+}
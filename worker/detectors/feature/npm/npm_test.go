@@ -0,0 +1,67 @@
+// Copyright 2015 clair authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package npm
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/coreos/clair/utils"
+	"github.com/coreos/clair/worker/detectors/testutil"
+)
+
+func TestNpmFeaturesDetector(t *testing.T) {
+	testutil.RunFeaturesDetectorTests(t, &NpmFeaturesDetector{}, "testdata/layers")
+}
+
+func TestNpmRequiredFiles(t *testing.T) {
+	for file, required := range map[string]bool{
+		"usr/src/app/node_modules/express/package.json":                    true,
+		"usr/src/app/node_modules/@babel/core/package.json":                true,
+		"usr/src/app/node_modules/express/node_modules/debug/package.json": true,
+		"usr/lib/node_modules/npm/package.json":                            true,
+		"node_modules/left-pad/package.json":                               true,
+		"usr/src/app/package.json":                                         false,
+		"usr/src/app/node_modules/express/lib/package.json":                false,
+		"usr/src/app/node_modules/@babel/core/lib/package.json":            false,
+		"usr/src/app/node_modules/express/index.js":                        false,
+	} {
+		matched := false
+		for _, pattern := range (&NpmFeaturesDetector{}).GetRequiredFiles() {
+			matched = matched || utils.MatchFile(file, pattern)
+		}
+		assert.Equal(t, required, matched, file)
+	}
+}
+
+func TestNpmDeletedFeature(t *testing.T) {
+	for deleted, expected := range map[string]string{
+		"usr/src/app/node_modules/express/package.json":                    "express",
+		"usr/src/app/node_modules/express":                                 "express",
+		"usr/src/app/node_modules/express/":                                "express",
+		"usr/src/app/node_modules/@babel/core/package.json":                "@babel/core",
+		"usr/src/app/node_modules/@babel/core":                             "@babel/core",
+		"usr/src/app/node_modules/express/node_modules/debug/package.json": "debug",
+		"usr/src/app/node_modules/@babel":                                  "",
+		"usr/src/app/node_modules/":                                        "",
+		"usr/src/app/node_modules":                                         "",
+		"usr/src/app":                                                      "",
+	} {
+		name, ok := (&NpmFeaturesDetector{}).DeletedFeature(deleted)
+		assert.Equal(t, expected, name, deleted)
+		assert.Equal(t, expected != "", ok, deleted)
+	}
+}
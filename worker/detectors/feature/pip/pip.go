@@ -0,0 +1,180 @@
+// Copyright 2015 clair authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pip
+
+import (
+	"bufio"
+	"bytes"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/coreos/clair/database"
+	"github.com/coreos/clair/utils"
+	"github.com/coreos/clair/utils/types"
+	"github.com/coreos/clair/worker/detectors"
+	"github.com/coreos/pkg/capnslog"
+)
+
+var (
+	log = capnslog.NewPackageLogger("github.com/coreos/clair", "pip")
+
+	// Namespace is the Namespace of the Python packages.
+	Namespace = database.Namespace{Name: "python", VersionFormat: types.Pep440VersionFormat}
+
+	// sitePackagesDirs are the directories the packages are installed in, by decreasing
+	// precedence: the ones of /usr/local shadow the ones of the distribution.
+	sitePackagesDirs = []string{
+		"usr/local/lib/python*/site-packages/",
+		"usr/local/lib/python*/dist-packages/",
+		"usr/lib/python*/site-packages/",
+		"usr/lib/python*/dist-packages/",
+	}
+
+	// metadataFiles are the files, within the site-packages directories, that describe the
+	// installed packages: the metadata of the wheels, and of the eggs, in a directory or not.
+	metadataFiles = []string{"*.dist-info/METADATA", "*.egg-info/PKG-INFO", "*.egg-info"}
+
+	// nameSeparatorsRegexp matches the characters that don't matter in package names.
+	nameSeparatorsRegexp = regexp.MustCompile(`[-_.]+`)
+
+	promInvalidPackagesTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "clair_worker_pip_invalid_packages_total",
+		Help: "Number of Python packages skipped because their metadata could not be parsed.",
+	})
+)
+
+// PipFeaturesDetector implements FeaturesDetector and detects the Python packages installed with
+// pip.
+type PipFeaturesDetector struct{}
+
+func init() {
+	detectors.RegisterFeaturesDetector("pip", &PipFeaturesDetector{})
+	prometheus.MustRegister(promInvalidPackagesTotal)
+}
+
+// Detect detects packages using the metadata files of the site-packages directories from the
+// input data.
+//
+// Packages are named after their normalized name, as in PEP 503, and belong to the python
+// Namespace. A package installed in several directories appears once, with the version of the
+// directory that comes first in the search path of Python.
+func (detector *PipFeaturesDetector) Detect(data map[string][]byte) ([]database.FeatureVersion, error) {
+	packages := []database.FeatureVersion{}
+	seen := make(map[string]string)
+	for _, pattern := range requiredFiles() {
+		for _, file := range utils.MatchingFiles(data, pattern) {
+			pkg, ok := parseMetadata(data[file])
+			if !ok {
+				log.Warningf("skipping Python package metadata %s, which has no valid name and version", file)
+				promInvalidPackagesTotal.Inc()
+				continue
+			}
+
+			if previous, ok := seen[pkg.Feature.Name]; ok {
+				log.Debugf("skipping Python package metadata %s, shadowed by %s", file, previous)
+				continue
+			}
+			seen[pkg.Feature.Name] = file
+			packages = append(packages, pkg)
+		}
+	}
+
+	return packages, nil
+}
+
+// parseMetadata returns the package described by the given metadata file, whose headers are
+// formatted like the ones of an email, if it has a name and a valid version.
+func parseMetadata(f []byte) (database.FeatureVersion, bool) {
+	var name, version string
+	scanner := bufio.NewScanner(bytes.NewReader(f))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.TrimSpace(line) == "" {
+			// The headers end with the first empty line.
+			break
+		}
+
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 || strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t") {
+			continue
+		}
+		switch strings.ToLower(parts[0]) {
+		case "name":
+			name = strings.TrimSpace(parts[1])
+		case "version":
+			version = strings.TrimSpace(parts[1])
+		}
+	}
+
+	if name == "" {
+		return database.FeatureVersion{}, false
+	}
+	v, err := types.NewPep440Version(version)
+	if err != nil {
+		return database.FeatureVersion{}, false
+	}
+	return database.FeatureVersion{
+		Feature: database.Feature{Name: normalizeName(name), Namespace: Namespace},
+		Version: v,
+	}, true
+}
+
+// normalizeName normalizes a package name as in PEP 503.
+func normalizeName(name string) string {
+	return nameSeparatorsRegexp.ReplaceAllString(strings.ToLower(name), "-")
+}
+
+// requiredFiles returns the patterns of the metadata files, by decreasing precedence.
+func requiredFiles() []string {
+	var files []string
+	for _, dir := range sitePackagesDirs {
+		for _, file := range metadataFiles {
+			files = append(files, dir+file)
+		}
+	}
+	return files
+}
+
+// Namespace returns the Namespace of the Python packages.
+func (detector *PipFeaturesDetector) Namespace() database.Namespace {
+	return Namespace
+}
+
+// DeletedFeature returns the name of the package whose metadata, or metadata directory, is the
+// given deleted path. The metadata directories are named <name>-<version>.dist-info or
+// <name>-<version>[-<python version>].egg-info, where dashes of the name are escaped.
+func (detector *PipFeaturesDetector) DeletedFeature(deleted string) (string, bool) {
+	base := path.Base(deleted)
+	if base == "METADATA" || base == "PKG-INFO" {
+		base = path.Base(path.Dir(deleted))
+	}
+	if !strings.HasSuffix(base, ".dist-info") && !strings.HasSuffix(base, ".egg-info") {
+		return "", false
+	}
+	parts := strings.SplitN(base, "-", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return "", false
+	}
+	return normalizeName(parts[0]), true
+}
+
+// GetRequiredFiles returns the list of files required for Detect, without
+// leading /
+func (detector *PipFeaturesDetector) GetRequiredFiles() []string {
+	return requiredFiles()
+}
@@ -0,0 +1,63 @@
+// Copyright 2015 clair authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pip
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/coreos/clair/utils"
+	"github.com/coreos/clair/worker/detectors/testutil"
+)
+
+func TestPipFeaturesDetector(t *testing.T) {
+	testutil.RunFeaturesDetectorTests(t, &PipFeaturesDetector{}, "testdata/layers")
+}
+
+func TestPipRequiredFiles(t *testing.T) {
+	for file, required := range map[string]bool{
+		"usr/local/lib/python3.6/site-packages/requests-2.18.4.dist-info/METADATA": true,
+		"usr/lib/python2.7/dist-packages/PyYAML-3.12.egg-info":                     true,
+		"usr/lib/python3/dist-packages/six-1.10.0.egg-info/PKG-INFO":               true,
+		"usr/local/lib/python3.6/site-packages/requests-2.18.4.dist-info/RECORD":   false,
+		"usr/local/lib/python3.6/site-packages/requests/__init__.py":               false,
+		"opt/app/lib/python3.6/site-packages/flask-1.0.dist-info/METADATA":         false,
+	} {
+		matched := false
+		for _, pattern := range (&PipFeaturesDetector{}).GetRequiredFiles() {
+			matched = matched || utils.MatchFile(file, pattern)
+		}
+		assert.Equal(t, required, matched, file)
+	}
+}
+
+func TestPipDeletedFeature(t *testing.T) {
+	for deleted, expected := range map[string]string{
+		"usr/lib/python3/site-packages/Flask-1.0.dist-info":                     "flask",
+		"usr/lib/python3/site-packages/Flask-1.0.dist-info/":                    "flask",
+		"usr/lib/python3/site-packages/Flask-1.0.dist-info/METADATA":            "flask",
+		"usr/lib/python3/site-packages/zope.interface-4.5.0.dist-info":          "zope-interface",
+		"usr/lib/python3/site-packages/python_dateutil-2.7.0-py3.6.egg-info":    "python-dateutil",
+		"usr/lib/python3/site-packages/python_dateutil-2.7.0.egg-info/PKG-INFO": "python-dateutil",
+		"usr/lib/python3/site-packages/":                                        "",
+		"usr/lib/python3/site-packages":                                         "",
+		"usr/lib/python3":                                                       "",
+	} {
+		name, ok := (&PipFeaturesDetector{}).DeletedFeature(deleted)
+		assert.Equal(t, expected, name, deleted)
+		assert.Equal(t, expected != "", ok, deleted)
+	}
+}
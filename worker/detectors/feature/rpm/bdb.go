@@ -0,0 +1,182 @@
+// Copyright 2015 clair authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rpm
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// The layout of the Berkeley DB hash databases, such as var/lib/rpm/Packages, from db_page.h.
+const (
+	bdbHashMagic = 0x061561
+
+	bdbPageHeaderSize = 26
+
+	bdbPageTypeHashUnsorted = 2
+	bdbPageTypeOverflow     = 7
+	bdbPageTypeHashMeta     = 8
+	bdbPageTypeHash         = 13
+
+	bdbItemKeyData = 1
+	bdbItemOffPage = 3
+)
+
+// bdbPair is a key/value pair of a Berkeley DB database.
+type bdbPair struct {
+	key, value []byte
+}
+
+// readBDBPairs returns every key/value pair stored in the Berkeley DB hash database.
+//
+// Rather than walking the buckets, every hash page of the file is scanned: pages that are not used
+// anymore are marked invalid and skipped.
+func readBDBPairs(db []byte) ([]bdbPair, error) {
+	if len(db) < 72 {
+		return nil, errors.New("the file is too small to be a Berkeley DB database")
+	}
+
+	// The metadata page tells the byte order of the database along with its page size.
+	var order binary.ByteOrder
+	switch {
+	case binary.LittleEndian.Uint32(db[12:]) == bdbHashMagic:
+		order = binary.LittleEndian
+	case binary.BigEndian.Uint32(db[12:]) == bdbHashMagic:
+		order = binary.BigEndian
+	default:
+		return nil, errors.New("the file is not a Berkeley DB hash database")
+	}
+	if db[25] != bdbPageTypeHashMeta {
+		return nil, fmt.Errorf("unexpected Berkeley DB metadata page type %d", db[25])
+	}
+	pageSize := int(order.Uint32(db[20:]))
+	if pageSize < 512 || pageSize > 64*1024 || len(db)%pageSize != 0 {
+		return nil, fmt.Errorf("invalid Berkeley DB page size %d", pageSize)
+	}
+	if lastPgno := int(order.Uint32(db[32:])); (lastPgno+1)*pageSize > len(db) {
+		return nil, fmt.Errorf("the Berkeley DB database is truncated: %d pages expected", lastPgno+1)
+	}
+	r := bdbReader{db: db, order: order, pageSize: pageSize}
+
+	var pairs []bdbPair
+	for pgno := 1; pgno < len(db)/pageSize; pgno++ {
+		page := r.page(pgno)
+		if page[25] != bdbPageTypeHash && page[25] != bdbPageTypeHashUnsorted {
+			continue
+		}
+
+		// The entries alternate between keys and values, whose offsets follow the page header.
+		entries := int(order.Uint16(page[20:]))
+		if bdbPageHeaderSize+2*entries > pageSize {
+			return nil, fmt.Errorf("page %d of the Berkeley DB database has too many entries", pgno)
+		}
+		for i := 1; i < entries; i += 2 {
+			key, err := r.item(page, int(order.Uint16(page[bdbPageHeaderSize+2*(i-1):])))
+			if err != nil {
+				return nil, fmt.Errorf("page %d of the Berkeley DB database: %s", pgno, err)
+			}
+			value, err := r.item(page, int(order.Uint16(page[bdbPageHeaderSize+2*i:])))
+			if err != nil {
+				return nil, fmt.Errorf("page %d of the Berkeley DB database: %s", pgno, err)
+			}
+			if key != nil && value != nil {
+				pairs = append(pairs, bdbPair{key, value})
+			}
+		}
+	}
+
+	return pairs, nil
+}
+
+type bdbReader struct {
+	db       []byte
+	order    binary.ByteOrder
+	pageSize int
+}
+
+func (r bdbReader) page(pgno int) []byte {
+	return r.db[pgno*r.pageSize : (pgno+1)*r.pageSize]
+}
+
+// item returns the value of the hash item found at the given offset of the page: either stored
+// inline, up to the next item, or in a chain of overflow pages. Other kinds of items, such as
+// duplicates, are not used by rpm and are ignored.
+func (r bdbReader) item(page []byte, offset int) ([]byte, error) {
+	if offset < bdbPageHeaderSize || offset >= len(page) {
+		return nil, errors.New("item out of the page")
+	}
+
+	switch page[offset] {
+	case bdbItemKeyData:
+		// The items are stored from the end of the page, so the previous one ends this one.
+		end := len(page)
+		if index := r.itemIndex(page, offset); index > 0 {
+			end = int(r.order.Uint16(page[bdbPageHeaderSize+2*(index-1):]))
+		}
+		if end <= offset || end > len(page) {
+			return nil, errors.New("invalid item length")
+		}
+		return page[offset+1 : end], nil
+
+	case bdbItemOffPage:
+		if offset+12 > len(page) {
+			return nil, errors.New("item out of the page")
+		}
+		return r.overflow(int(r.order.Uint32(page[offset+4:])), int(r.order.Uint32(page[offset+8:])))
+	}
+
+	return nil, nil
+}
+
+// itemIndex returns the position, in the offsets array, of the item at the given offset.
+func (r bdbReader) itemIndex(page []byte, offset int) int {
+	entries := int(r.order.Uint16(page[20:]))
+	for i := 0; i < entries; i++ {
+		if int(r.order.Uint16(page[bdbPageHeaderSize+2*i:])) == offset {
+			return i
+		}
+	}
+	return -1
+}
+
+// overflow reads a value of the given length stored in the chain of overflow pages that starts at
+// pgno.
+func (r bdbReader) overflow(pgno, length int) ([]byte, error) {
+	pages := len(r.db) / r.pageSize
+	value := make([]byte, 0, length)
+	for visited := 0; len(value) < length; visited++ {
+		if pgno <= 0 || pgno >= pages || visited >= pages {
+			return nil, errors.New("broken overflow page chain")
+		}
+
+		page := r.page(pgno)
+		if page[25] != bdbPageTypeOverflow {
+			return nil, fmt.Errorf("page %d is not an overflow page", pgno)
+		}
+		// On overflow pages, the offset of the free space is the length of the data.
+		size := int(r.order.Uint16(page[22:]))
+		if bdbPageHeaderSize+size > len(page) {
+			return nil, fmt.Errorf("overflow page %d is too long", pgno)
+		}
+		value = append(value, page[bdbPageHeaderSize:bdbPageHeaderSize+size]...)
+		pgno = int(r.order.Uint32(page[16:]))
+	}
+
+	if len(value) != length {
+		return nil, errors.New("overflow value longer than expected")
+	}
+	return value, nil
+}
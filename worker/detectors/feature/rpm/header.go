@@ -0,0 +1,103 @@
+// Copyright 2015 clair authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rpm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+// The tags and types of the rpm header entries that the detector reads, from rpmtag.h.
+const (
+	rpmTagName    = 1000
+	rpmTagVersion = 1001
+	rpmTagRelease = 1002
+	rpmTagEpoch   = 1003
+
+	rpmTypeInt32  = 4
+	rpmTypeString = 6
+
+	// rpmMaxHeaderSize is the maximum size of a header, as enforced by rpm itself.
+	rpmMaxHeaderSize = 256 * 1024 * 1024
+)
+
+// rpmPackage is the identity of a package, as recorded in its header.
+type rpmPackage struct {
+	name, version, release string
+	epoch                  int
+	hasEpoch               bool
+}
+
+// evr returns the [epoch:]version-release of the package.
+func (p rpmPackage) evr() string {
+	if p.hasEpoch {
+		return strconv.Itoa(p.epoch) + ":" + p.version + "-" + p.release
+	}
+	return p.version + "-" + p.release
+}
+
+// parseHeader reads a package header as stored in the rpm databases: the number of entries and
+// the size of the data, both big-endian, followed by the entries and the data they point to.
+func parseHeader(blob []byte) (rpmPackage, error) {
+	if len(blob) < 8 {
+		return rpmPackage{}, errors.New("header too small")
+	}
+	entries, dataSize := int64(binary.BigEndian.Uint32(blob)), int64(binary.BigEndian.Uint32(blob[4:]))
+	if entries*16+dataSize > rpmMaxHeaderSize || int64(len(blob)) < 8+entries*16+dataSize {
+		return rpmPackage{}, errors.New("header too large for its data")
+	}
+	data := blob[8+entries*16 : 8+entries*16+dataSize]
+
+	var pkg rpmPackage
+	for i := int64(0); i < entries; i++ {
+		entry := blob[8+i*16:]
+		tag, typ := binary.BigEndian.Uint32(entry), binary.BigEndian.Uint32(entry[4:])
+		offset := int64(binary.BigEndian.Uint32(entry[8:]))
+		if offset >= dataSize {
+			continue
+		}
+
+		switch {
+		case typ == rpmTypeString && (tag == rpmTagName || tag == rpmTagVersion || tag == rpmTagRelease):
+			end := bytes.IndexByte(data[offset:], 0)
+			if end < 0 {
+				return rpmPackage{}, fmt.Errorf("unterminated string in tag %d", tag)
+			}
+			value := string(data[offset : offset+int64(end)])
+			switch tag {
+			case rpmTagName:
+				pkg.name = value
+			case rpmTagVersion:
+				pkg.version = value
+			case rpmTagRelease:
+				pkg.release = value
+			}
+		case typ == rpmTypeInt32 && tag == rpmTagEpoch:
+			if offset+4 > dataSize {
+				return rpmPackage{}, errors.New("truncated epoch")
+			}
+			pkg.epoch = int(int32(binary.BigEndian.Uint32(data[offset:])))
+			pkg.hasEpoch = true
+		}
+	}
+
+	if pkg.name == "" || pkg.version == "" {
+		return rpmPackage{}, errors.New("header without name or version")
+	}
+	return pkg, nil
+}
@@ -15,93 +15,87 @@
 package rpm
 
 import (
-	"bufio"
+	"bytes"
+	"database/sql"
 	"io/ioutil"
 	"os"
-	"strings"
+	"path/filepath"
+
+	// Register the "sqlite3" driver, which reads the rpmdb.sqlite databases.
+	_ "github.com/mattn/go-sqlite3"
 
 	"github.com/coreos/clair/database"
-	"github.com/coreos/clair/utils"
 	cerrors "github.com/coreos/clair/utils/errors"
 	"github.com/coreos/clair/utils/types"
 	"github.com/coreos/clair/worker/detectors"
 	"github.com/coreos/pkg/capnslog"
 )
 
+const (
+	// bdbPath is the Berkeley DB database of the packages, and sqlitePath the SQLite database that
+	// replaces it on newer releases.
+	bdbPath    = "var/lib/rpm/Packages"
+	sqlitePath = "var/lib/rpm/rpmdb.sqlite"
+)
+
 var log = capnslog.NewPackageLogger("github.com/coreos/clair", "rpm")
 
 // RpmFeaturesDetector implements FeaturesDetector and detects rpm packages
-// It requires the "rpm" binary to be in the PATH
+// It reads the rpm database, in the Berkeley DB or in the SQLite format, without requiring rpm.
 type RpmFeaturesDetector struct{}
 
 func init() {
 	detectors.RegisterFeaturesDetector("rpm", &RpmFeaturesDetector{})
 }
 
-// Detect detects packages using var/lib/rpm/Packages from the input data
+// Detect detects packages using var/lib/rpm/rpmdb.sqlite or var/lib/rpm/Packages from the input
+// data. A database that can't be read fails the detection rather than hiding every package.
 func (detector *RpmFeaturesDetector) Detect(data map[string][]byte) ([]database.FeatureVersion, error) {
-	f, hasFile := data["var/lib/rpm/Packages"]
-	if !hasFile {
+	var headers [][]byte
+	var err error
+	if f, hasFile := data[sqlitePath]; hasFile {
+		headers, err = readSQLiteHeaders(f)
+	} else if f, hasFile := data[bdbPath]; hasFile {
+		headers, err = readBDBHeaders(f)
+	} else {
 		return []database.FeatureVersion{}, nil
 	}
-
-	// Create a map to store packages and ensure their uniqueness
-	packagesMap := make(map[string]database.FeatureVersion)
-
-	// Write the required "Packages" file to disk
-	tmpDir, err := ioutil.TempDir(os.TempDir(), "rpm")
-	defer os.RemoveAll(tmpDir)
 	if err != nil {
-		log.Errorf("could not create temporary folder for RPM detection: %s", err)
-		return []database.FeatureVersion{}, cerrors.ErrFilesystem
+		log.Errorf("could not read the rpm database: %s", err)
+		return []database.FeatureVersion{}, cerrors.NewBadRequestError("could not read the rpm database: " + err.Error())
 	}
 
-	err = ioutil.WriteFile(tmpDir+"/Packages", f, 0700)
-	if err != nil {
-		log.Errorf("could not create temporary file for RPM detection: %s", err)
-		return []database.FeatureVersion{}, cerrors.ErrFilesystem
-	}
-
-	// Query RPM
-	// We actually extract binary package names instead of source package names here because RHSA refers to package names
-	// In the dpkg system, we extract the source instead
-	out, err := utils.Exec(tmpDir, "rpm", "--dbpath", tmpDir, "-qa", "--qf", "%{NAME} %{EPOCH}:%{VERSION}-%{RELEASE}\n")
-	if err != nil {
-		log.Errorf("could not query RPM: %s. output: %s", err, string(out))
-		// Do not bubble up because we probably won't be able to fix it,
-		// the database must be corrupted
-		return []database.FeatureVersion{}, nil
-	}
-
-	scanner := bufio.NewScanner(strings.NewReader(string(out)))
-	for scanner.Scan() {
-		line := strings.Split(scanner.Text(), " ")
-		if len(line) != 2 {
-			// We may see warnings on some RPM versions:
-			// "warning: Generating 12 missing index(es), please wait..."
-			continue
+	// Create a map to store packages and ensure their uniqueness
+	packagesMap := make(map[string]database.FeatureVersion)
+	for _, header := range headers {
+		pkg, err := parseHeader(header)
+		if err != nil {
+			log.Errorf("could not parse an rpm header: %s", err)
+			return []database.FeatureVersion{}, cerrors.NewBadRequestError("could not parse an rpm header: " + err.Error())
 		}
 
 		// Ignore gpg-pubkey packages which are fake packages used to store GPG keys - they are not versionned properly.
-		if line[0] == "gpg-pubkey" {
+		if pkg.name == "gpg-pubkey" {
 			continue
 		}
 
-		// Parse version
-		version, err := types.NewVersion(strings.Replace(line[1], "(none):", "", -1))
+		// We extract binary package names instead of source package names here because RHSA refers
+		// to package names. In the dpkg system, we extract the source instead.
+		// The epoch is kept, as the advisories compare against it.
+		version, err := types.NewVersion(pkg.evr())
 		if err != nil {
-			log.Warningf("could not parse package version '%s': %s. skipping", line[1], err.Error())
+			log.Warningf("could not parse package version '%s': %s. skipping", pkg.evr(), err.Error())
 			continue
 		}
 
 		// Add package
-		pkg := database.FeatureVersion{
+		fv := database.FeatureVersion{
 			Feature: database.Feature{
-				Name: line[0],
+				Name: pkg.name,
 			},
 			Version: version,
 		}
-		packagesMap[pkg.Feature.Name+"#"+pkg.Version.String()] = pkg
+		packagesMap[fv.Feature.Name+"#"+fv.Version.String()] = fv
 	}
 
 	// Convert the map to a slice
@@ -113,8 +107,65 @@ func (detector *RpmFeaturesDetector) Detect(data map[string][]byte) ([]database.
 	return packages, nil
 }
 
+// readBDBHeaders returns the package headers stored in a Packages Berkeley DB database. They are
+// keyed by their instance number, the instance 0 storing the next instance number instead.
+func readBDBHeaders(db []byte) ([][]byte, error) {
+	pairs, err := readBDBPairs(db)
+	if err != nil {
+		return nil, err
+	}
+
+	var headers [][]byte
+	for _, pair := range pairs {
+		if bytes.Equal(pair.key, []byte{0, 0, 0, 0}) {
+			continue
+		}
+		headers = append(headers, pair.value)
+	}
+	return headers, nil
+}
+
+// readSQLiteHeaders returns the package headers stored in an rpmdb.sqlite database, which is
+// written to a temporary file to be opened.
+func readSQLiteHeaders(db []byte) ([][]byte, error) {
+	tmpDir, err := ioutil.TempDir(os.TempDir(), "rpm")
+	if err != nil {
+		log.Errorf("could not create temporary folder for RPM detection: %s", err)
+		return nil, cerrors.ErrFilesystem
+	}
+	defer os.RemoveAll(tmpDir)
+
+	path := filepath.Join(tmpDir, "rpmdb.sqlite")
+	if err := ioutil.WriteFile(path, db, 0600); err != nil {
+		log.Errorf("could not create temporary file for RPM detection: %s", err)
+		return nil, cerrors.ErrFilesystem
+	}
+
+	conn, err := sql.Open("sqlite3", "file:"+path+"?mode=ro")
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	rows, err := conn.Query("SELECT blob FROM Packages")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var headers [][]byte
+	for rows.Next() {
+		var header []byte
+		if err := rows.Scan(&header); err != nil {
+			return nil, err
+		}
+		headers = append(headers, header)
+	}
+	return headers, rows.Err()
+}
+
 // GetRequiredFiles returns the list of files required for Detect, without
 // leading /
 func (detector *RpmFeaturesDetector) GetRequiredFiles() []string {
-	return []string{"var/lib/rpm/Packages"}
+	return []string{bdbPath, sqlitePath}
 }
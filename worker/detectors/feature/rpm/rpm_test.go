@@ -15,35 +15,88 @@
 package rpm
 
 import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
 	"testing"
 
-	"github.com/coreos/clair/database"
-	"github.com/coreos/clair/utils/types"
-	"github.com/coreos/clair/worker/detectors/feature"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/coreos/clair/worker/detectors/testutil"
 )
 
-var rpmPackagesTests = []feature.FeatureVersionTest{
-	// Test a CentOS 7 RPM database
-	// Memo: Use the following command on a RPM-based system to shrink a database: rpm -qa --qf "%{NAME}\n" |tail -n +3| xargs rpm -e --justdb
-	{
-		FeatureVersions: []database.FeatureVersion{
-			// Two packages from this source are installed, it should only appear once
-			{
-				Feature: database.Feature{Name: "centos-release"},
-				Version: types.NewVersionUnsafe("7-1.1503.el7.centos.2.8"),
-			},
-			// Two packages from this source are installed, it should only appear once
-			{
-				Feature: database.Feature{Name: "filesystem"},
-				Version: types.NewVersionUnsafe("3.2-18.el7"),
-			},
-		},
-		Data: map[string][]byte{
-			"var/lib/rpm/Packages": feature.LoadFileForTest("rpm/testdata/Packages"),
-		},
-	},
+// Memo: Use the following command on a RPM-based system to shrink a database: rpm -qa --qf "%{NAME}\n" |tail -n +3| xargs rpm -e --justdb
+func TestRpmFeaturesDetector(t *testing.T) {
+	testutil.RunFeaturesDetectorTests(t, &RpmFeaturesDetector{}, "testdata/layers")
 }
 
-func TestRpmFeaturesDetector(t *testing.T) {
-	feature.TestFeaturesDetector(t, &RpmFeaturesDetector{}, rpmPackagesTests)
+func TestRpmFeaturesDetectorCorruptDatabase(t *testing.T) {
+	packages, err := ioutil.ReadFile("testdata/layers/centos-7-bdb/var/lib/rpm/Packages")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlite, err := ioutil.ReadFile("testdata/layers/centos-7-sqlite/var/lib/rpm/rpmdb.sqlite")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, data := range []map[string][]byte{
+		{"var/lib/rpm/Packages": []byte("not a database")},
+		{"var/lib/rpm/Packages": packages[:len(packages)/2]},
+		{"var/lib/rpm/rpmdb.sqlite": []byte("not a database")},
+		{"var/lib/rpm/rpmdb.sqlite": sqlite[:4096]},
+	} {
+		_, err := (&RpmFeaturesDetector{}).Detect(data)
+		assert.NotNil(t, err)
+	}
+}
+
+// newHeaderForTest builds the header of a package, as stored in the rpm databases. A negative
+// epoch is left out.
+func newHeaderForTest(name string, epoch int, version, release string) []byte {
+	type entry struct {
+		tag, typ uint32
+		value    []byte
+	}
+	entries := []entry{
+		{rpmTagName, rpmTypeString, append([]byte(name), 0)},
+		{rpmTagVersion, rpmTypeString, append([]byte(version), 0)},
+		{rpmTagRelease, rpmTypeString, append([]byte(release), 0)},
+	}
+	if epoch >= 0 {
+		value := make([]byte, 4)
+		binary.BigEndian.PutUint32(value, uint32(epoch))
+		entries = append([]entry{{rpmTagEpoch, rpmTypeInt32, value}}, entries...)
+	}
+
+	var index, data bytes.Buffer
+	for _, e := range entries {
+		binary.Write(&index, binary.BigEndian, []uint32{e.tag, e.typ, uint32(data.Len()), 1})
+		data.Write(e.value)
+	}
+
+	var header bytes.Buffer
+	binary.Write(&header, binary.BigEndian, []uint32{uint32(len(entries)), uint32(data.Len())})
+	header.Write(index.Bytes())
+	header.Write(data.Bytes())
+	return header.Bytes()
+}
+
+func TestParseHeader(t *testing.T) {
+	// The epoch is preserved.
+	pkg, err := parseHeader(newHeaderForTest("openssl-libs", 1, "1.0.2k", "8.el7"))
+	if assert.Nil(t, err) {
+		assert.Equal(t, "openssl-libs", pkg.name)
+		assert.Equal(t, "1:1.0.2k-8.el7", pkg.evr())
+	}
+	pkg, err = parseHeader(newHeaderForTest("filesystem", -1, "3.2", "18.el7"))
+	if assert.Nil(t, err) {
+		assert.Equal(t, "3.2-18.el7", pkg.evr())
+	}
+
+	header := newHeaderForTest("filesystem", -1, "3.2", "18.el7")
+	for _, invalid := range [][]byte{nil, header[:6], header[:len(header)-1], append(header[:8:8], 0xff, 0xff)} {
+		_, err = parseHeader(invalid)
+		assert.NotNil(t, err)
+	}
 }
@@ -15,10 +15,14 @@
 package detectors
 
 import (
+	"errors"
 	"fmt"
+	"sort"
 	"sync"
 
 	"github.com/coreos/clair/database"
+	"github.com/coreos/clair/utils"
+	cerrors "github.com/coreos/clair/utils/errors"
 )
 
 // The FeaturesDetector interface defines a way to detect packages from input data.
@@ -26,10 +30,58 @@ type FeaturesDetector interface {
 	// Detect detects a list of FeatureVersion from the input data.
 	Detect(map[string][]byte) ([]database.FeatureVersion, error)
 	// GetRequiredFiles returns the list of files required for Detect, without
-	// leading /.
+	// leading /. They may be patterns, such as "var/lib/dpkg/status.d/*", that
+	// designate several files, see utils.MatchFile: Detect is given every
+	// matching file.
 	GetRequiredFiles() []string
 }
 
+// DefaultFeaturesPriority is the priority of the FeaturesDetectors that do not implement
+// PrioritizedFeaturesDetector.
+const DefaultFeaturesPriority = 0
+
+// PrioritizedFeaturesDetector is a FeaturesDetector that should run before, or after, the others.
+type PrioritizedFeaturesDetector interface {
+	FeaturesDetector
+	// Priority returns the priority of the detector: higher priorities run first.
+	Priority() int
+}
+
+// NamespacedFeaturesDetector is a FeaturesDetector whose FeatureVersions all belong to the same
+// Namespace, such as the one of a language ecosystem, whatever the OS of the layer is.
+type NamespacedFeaturesDetector interface {
+	FeaturesDetector
+	// Namespace returns the Namespace of the FeatureVersions that Detect returns.
+	Namespace() database.Namespace
+}
+
+// DeletedFeaturesDetector is a NamespacedFeaturesDetector that knows which package the files it
+// reads belong to, so that the deletion of a package by a layer doesn't remove the others.
+type DeletedFeaturesDetector interface {
+	NamespacedFeaturesDetector
+	// DeletedFeature returns the name of the package whose files are in the given deleted path,
+	// a file or a directory, or false if the path may hold the files of several packages.
+	DeletedFeature(path string) (string, bool)
+}
+
+// DetectedFeatures are the FeatureVersions that a FeaturesDetector detected in some data.
+type DetectedFeatures struct {
+	// Detector is the name of the FeaturesDetector.
+	Detector string
+	// Ecosystem is the name of the Namespace of the FeaturesDetector if it is a
+	// NamespacedFeaturesDetector, or empty for the ones whose FeatureVersions belong to the
+	// Namespace of the OS.
+	Ecosystem string
+	// FeatureVersions are the detected FeatureVersions.
+	FeatureVersions []database.FeatureVersion
+	// Deleted is true when the data deletes the files required for Detect, which may have
+	// listed any package: none of the packages previously detected remain.
+	Deleted bool
+	// DeletedFeatures are the names of the packages whose files the data deletes, when they
+	// are known.
+	DeletedFeatures []string
+}
+
 var (
 	featuresDetectorsLock sync.Mutex
 	featuresDetectors     = make(map[string]FeaturesDetector)
@@ -53,27 +105,186 @@ func RegisterFeaturesDetector(name string, f FeaturesDetector) {
 	featuresDetectors[name] = f
 }
 
-// DetectFeatures detects a list of FeatureVersion using every registered FeaturesDetector.
+// UnregisterFeaturesDetector removes the FeaturesDetector registered with the given name, if any.
+// It is meant for the tests that register detectors of their own.
+func UnregisterFeaturesDetector(name string) {
+	featuresDetectorsLock.Lock()
+	defer featuresDetectorsLock.Unlock()
+
+	delete(featuresDetectors, name)
+}
+
+// DetectFeatures detects a list of FeatureVersion using every enabled FeaturesDetector, by
+// decreasing priority and then by name, so that the FeatureVersions are always listed in the same
+// order. A FeatureVersion that several detectors report is only listed once. The error of a
+// detector is returned along with its name.
 func DetectFeatures(data map[string][]byte) ([]database.FeatureVersion, error) {
-	var packages []database.FeatureVersion
+	detections, err := DetectFeaturesByDetector(data)
+	if err != nil {
+		return []database.FeatureVersion{}, err
+	}
+	return MergeDetectedFeatures(detections), nil
+}
 
-	for _, detector := range featuresDetectors {
+// DetectFeaturesByDetector detects the FeatureVersions of every enabled FeaturesDetector, in the
+// order of DetectFeatures, and returns them along with the detector that found them. Every
+// enabled detector is listed, even if it didn't find anything.
+func DetectFeaturesByDetector(data map[string][]byte) ([]DetectedFeatures, error) {
+	detectors := sortedFeaturesDetectors()
+	detections := make([]DetectedFeatures, 0, len(detectors))
+
+	for _, detector := range detectors {
 		pkgs, err := detector.Detect(data)
 		if err != nil {
-			return []database.FeatureVersion{}, err
+			log.Warningf("features detector %s failed: %s", detector.name, err)
+			return nil, detectorError(detector.name, err)
+		}
+		if len(pkgs) > 0 {
+			log.Debugf("%d features detected by %s", len(pkgs), detector.name)
+		}
+
+		detection := DetectedFeatures{
+			Detector:        detector.name,
+			FeatureVersions: pkgs,
+		}
+		if namespaced, ok := detector.FeaturesDetector.(NamespacedFeaturesDetector); ok {
+			detection.Ecosystem = namespaced.Namespace().Name
 		}
-		packages = append(packages, pkgs...)
+		detectDeletedFeatures(data, detector, &detection)
+		detections = append(detections, detection)
 	}
 
-	return packages, nil
+	return detections, nil
+}
+
+// MergeDetectedFeatures returns the FeatureVersions of the given detections, in order. A
+// FeatureVersion that several detectors report is only listed once.
+func MergeDetectedFeatures(detections []DetectedFeatures) []database.FeatureVersion {
+	var packages []database.FeatureVersion
+	detected := make(map[string]struct{})
+
+	for _, detection := range detections {
+		for _, pkg := range detection.FeatureVersions {
+			key := pkg.Feature.Namespace.Name + ":" + pkg.Feature.Name + ":" + pkg.Version.String()
+			if _, ok := detected[key]; ok {
+				continue
+			}
+			detected[key] = struct{}{}
+			packages = append(packages, pkg)
+		}
+	}
+
+	return packages
+}
+
+// detectDeletedFeatures finds the files required by the given detector that the data deletes,
+// and the packages they belong to.
+func detectDeletedFeatures(data map[string][]byte, detector namedFeaturesDetector, detection *DetectedFeatures) {
+	deletedFeaturesDetector, _ := detector.FeaturesDetector.(DeletedFeaturesDetector)
+	deleted := make(map[string]struct{})
+
+	for _, file := range detector.GetRequiredFiles() {
+		if _, ok := data[file]; ok {
+			// The file has been added back.
+			continue
+		}
+		for _, path := range utils.DeletedPaths(data, file) {
+			if deletedFeaturesDetector != nil {
+				if name, ok := deletedFeaturesDetector.DeletedFeature(path); ok {
+					if _, ok := deleted[name]; !ok {
+						deleted[name] = struct{}{}
+						detection.DeletedFeatures = append(detection.DeletedFeatures, name)
+					}
+					continue
+				}
+			}
+			log.Debugf("%s has been deleted, none of the features previously detected by %s remain", path, detector.name)
+			detection.Deleted = true
+			detection.DeletedFeatures = nil
+			return
+		}
+	}
+}
+
+// detectorError prefixes the message of the given error with the name of the detector that
+// returned it. Bad requests, e.g. corrupted package databases, remain bad requests.
+func detectorError(name string, err error) error {
+	message := fmt.Sprintf("detector %s: %s", name, err)
+	if _, badreq := err.(*cerrors.ErrBadRequest); badreq {
+		return cerrors.NewBadRequestError(message)
+	}
+	return errors.New(message)
+}
+
+// namedFeaturesDetector is a registered FeaturesDetector, along with its name.
+type namedFeaturesDetector struct {
+	FeaturesDetector
+	name string
+}
+
+// sortedFeaturesDetectors returns the enabled FeaturesDetectors by decreasing priority, and
+// then by name.
+func sortedFeaturesDetectors() []namedFeaturesDetector {
+	names := ListEnabledFeaturesDetectors()
+
+	featuresDetectorsLock.Lock()
+	defer featuresDetectorsLock.Unlock()
+
+	detectors := make([]namedFeaturesDetector, 0, len(names))
+	for _, name := range names {
+		detectors = append(detectors, namedFeaturesDetector{featuresDetectors[name], name})
+	}
+	sort.Stable(byFeaturesDetectorPriority(detectors))
+
+	return detectors
+}
+
+type byFeaturesDetectorPriority []namedFeaturesDetector
+
+func (s byFeaturesDetectorPriority) Len() int      { return len(s) }
+func (s byFeaturesDetectorPriority) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s byFeaturesDetectorPriority) Less(i, j int) bool {
+	return featuresDetectorPriority(s[i].FeaturesDetector) > featuresDetectorPriority(s[j].FeaturesDetector)
+}
+
+func featuresDetectorPriority(detector FeaturesDetector) int {
+	if prioritized, ok := detector.(PrioritizedFeaturesDetector); ok {
+		return prioritized.Priority()
+	}
+	return DefaultFeaturesPriority
 }
 
 // GetRequiredFilesFeatures returns the list of files required for Detect for every
-// registered FeaturesDetector, without leading /.
+// enabled FeaturesDetector, without leading /.
 func GetRequiredFilesFeatures() (files []string) {
-	for _, detector := range featuresDetectors {
-		files = append(files, detector.GetRequiredFiles()...)
+	featuresDetectorsLock.Lock()
+	defer featuresDetectorsLock.Unlock()
+
+	for name, detector := range featuresDetectors {
+		if isDetectorEnabled(name) {
+			files = append(files, detector.GetRequiredFiles()...)
+		}
 	}
 
 	return
 }
+
+// ListFeaturesDetectors returns the sorted names of the registered FeaturesDetectors.
+func ListFeaturesDetectors() []string {
+	featuresDetectorsLock.Lock()
+	defer featuresDetectorsLock.Unlock()
+
+	names := make([]string, 0, len(featuresDetectors))
+	for name := range featuresDetectors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// ListEnabledFeaturesDetectors returns the sorted names of the registered FeaturesDetectors that are not
+// disabled.
+func ListEnabledFeaturesDetectors() []string {
+	return enabledDetectors(ListFeaturesDetectors())
+}
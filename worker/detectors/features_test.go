@@ -0,0 +1,225 @@
+// Copyright 2015 clair authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package detectors
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/coreos/clair/database"
+	"github.com/coreos/clair/utils"
+	cerrors "github.com/coreos/clair/utils/errors"
+	"github.com/coreos/clair/utils/types"
+)
+
+// testFeaturesDetector detects a single feature, named after the detector, when the "packages"
+// file is present.
+type testFeaturesDetector struct {
+	name string
+}
+
+func (d testFeaturesDetector) Detect(data map[string][]byte) ([]database.FeatureVersion, error) {
+	if _, ok := data["packages"]; !ok {
+		return nil, nil
+	}
+	return []database.FeatureVersion{{
+		Feature: database.Feature{Name: d.name},
+		Version: types.NewVersionUnsafe("1.0"),
+	}}, nil
+}
+
+func (d testFeaturesDetector) GetRequiredFiles() []string {
+	return []string{"packages"}
+}
+
+// testPrioritizedFeaturesDetector is a testFeaturesDetector with the given priority.
+type testPrioritizedFeaturesDetector struct {
+	testFeaturesDetector
+	priority int
+}
+
+func (d testPrioritizedFeaturesDetector) Priority() int {
+	return d.priority
+}
+
+func init() {
+	RegisterFeaturesDetector("a-test-low", testPrioritizedFeaturesDetector{testFeaturesDetector{"low"}, DefaultFeaturesPriority - 1})
+	RegisterFeaturesDetector("b-test-default", testFeaturesDetector{"default"})
+	RegisterFeaturesDetector("c-test-default", testFeaturesDetector{"other-default"})
+	RegisterFeaturesDetector("z-test-high", testPrioritizedFeaturesDetector{testFeaturesDetector{"high"}, DefaultFeaturesPriority + 1})
+}
+
+func TestDetectFeaturesPriority(t *testing.T) {
+	for i := 0; i < 10; i++ {
+		features, err := DetectFeatures(map[string][]byte{"packages": nil})
+		if assert.Nil(t, err) {
+			var names []string
+			for _, feature := range features {
+				names = append(names, feature.Feature.Name)
+			}
+			assert.Equal(t, []string{"high", "default", "other-default", "low"}, names)
+		}
+	}
+}
+
+// testFailingFeaturesDetector returns its error when the "packages" file is present.
+type testFailingFeaturesDetector struct {
+	err error
+}
+
+func (d testFailingFeaturesDetector) Detect(data map[string][]byte) ([]database.FeatureVersion, error) {
+	if _, ok := data["packages"]; !ok {
+		return nil, nil
+	}
+	return nil, d.err
+}
+
+func (testFailingFeaturesDetector) GetRequiredFiles() []string {
+	return []string{"packages"}
+}
+
+func TestDetectFeaturesDuplicates(t *testing.T) {
+	// The detector reports the same feature as b-test-default, which runs first.
+	RegisterFeaturesDetector("test-duplicate", testFeaturesDetector{"default"})
+	defer UnregisterFeaturesDetector("test-duplicate")
+
+	features, err := DetectFeatures(map[string][]byte{"packages": nil})
+	if assert.Nil(t, err) {
+		assert.Len(t, features, 4)
+	}
+}
+
+func TestDetectFeaturesError(t *testing.T) {
+	for _, test := range []struct {
+		err    error
+		badreq bool
+	}{
+		{errors.New("broken"), false},
+		{cerrors.NewBadRequestError("broken"), true},
+	} {
+		RegisterFeaturesDetector("test-failing", testFailingFeaturesDetector{test.err})
+
+		features, err := DetectFeatures(map[string][]byte{"packages": nil})
+		assert.Empty(t, features)
+		if assert.NotNil(t, err) {
+			assert.Equal(t, "detector test-failing: broken", err.Error())
+			_, badreq := err.(*cerrors.ErrBadRequest)
+			assert.Equal(t, test.badreq, badreq)
+		}
+
+		// The detector doesn't fail without its file.
+		_, err = DetectFeatures(map[string][]byte{})
+		assert.Nil(t, err)
+
+		UnregisterFeaturesDetector("test-failing")
+	}
+}
+
+// testNamespacedFeaturesDetector is a testFeaturesDetector whose features are in the given
+// Namespace.
+type testNamespacedFeaturesDetector struct {
+	testFeaturesDetector
+	namespace database.Namespace
+}
+
+func (d testNamespacedFeaturesDetector) Namespace() database.Namespace {
+	return d.namespace
+}
+
+func TestDetectFeaturesByDetector(t *testing.T) {
+	RegisterFeaturesDetector("test-namespaced", testNamespacedFeaturesDetector{testFeaturesDetector{"namespaced"}, database.Namespace{Name: "testlang"}})
+	defer UnregisterFeaturesDetector("test-namespaced")
+
+	// Every detector is listed, even when it finds nothing.
+	detections, err := DetectFeaturesByDetector(map[string][]byte{})
+	if assert.Nil(t, err) && assert.Len(t, detections, 5) {
+		for _, detection := range detections {
+			assert.Empty(t, detection.FeatureVersions, detection.Detector)
+			assert.False(t, detection.Deleted, detection.Detector)
+		}
+	}
+
+	detections, err = DetectFeaturesByDetector(map[string][]byte{"packages": nil})
+	if assert.Nil(t, err) {
+		ecosystems := make(map[string]string)
+		for _, detection := range detections {
+			assert.Len(t, detection.FeatureVersions, 1, detection.Detector)
+			ecosystems[detection.Detector] = detection.Ecosystem
+		}
+		assert.Equal(t, map[string]string{
+			"z-test-high":     "",
+			"b-test-default":  "",
+			"c-test-default":  "",
+			"test-namespaced": "testlang",
+			"a-test-low":      "",
+		}, ecosystems)
+		assert.Len(t, MergeDetectedFeatures(detections), 5)
+	}
+
+	// Deleting the required file deletes whatever the detectors found previously.
+	detections, err = DetectFeaturesByDetector(map[string][]byte{".wh.packages": nil})
+	if assert.Nil(t, err) {
+		for _, detection := range detections {
+			assert.True(t, detection.Deleted, detection.Detector)
+			assert.Empty(t, detection.DeletedFeatures, detection.Detector)
+		}
+	}
+}
+
+// testDeletedFeaturesDetector is a testNamespacedFeaturesDetector whose packages have their own
+// files, in the "packages" directory.
+type testDeletedFeaturesDetector struct {
+	testNamespacedFeaturesDetector
+}
+
+func (d testDeletedFeaturesDetector) GetRequiredFiles() []string {
+	return []string{"packages/*"}
+}
+
+func (d testDeletedFeaturesDetector) DeletedFeature(path string) (string, bool) {
+	if !strings.HasPrefix(path, "packages/") || path == "packages/" {
+		return "", false
+	}
+	return strings.TrimPrefix(path, "packages/"), true
+}
+
+func TestDetectDeletedFeatures(t *testing.T) {
+	RegisterFeaturesDetector("test-deleted", testDeletedFeaturesDetector{testNamespacedFeaturesDetector{testFeaturesDetector{"deleted"}, database.Namespace{Name: "testlang"}}})
+	defer UnregisterFeaturesDetector("test-deleted")
+
+	for _, test := range []struct {
+		data            map[string][]byte
+		deleted         bool
+		deletedFeatures []string
+	}{
+		{map[string][]byte{"packages/a": nil}, false, nil},
+		{map[string][]byte{"packages/.wh.a": nil, "packages/.wh.b": nil, "packages/c": nil}, false, []string{"a", "b"}},
+		{map[string][]byte{"packages/.wh.a": nil, "packages/" + utils.WhiteoutOpaqueDir: nil}, true, nil},
+		{map[string][]byte{".wh.packages": nil}, true, nil},
+	} {
+		detections, err := DetectFeaturesByDetector(test.data)
+		if assert.Nil(t, err) {
+			for _, detection := range detections {
+				if detection.Detector == "test-deleted" {
+					assert.Equal(t, test.deleted, detection.Deleted, "%v", test.data)
+					assert.Equal(t, test.deletedFeatures, detection.DeletedFeatures, "%v", test.data)
+				}
+			}
+		}
+	}
+}
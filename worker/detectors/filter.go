@@ -0,0 +1,72 @@
+// Copyright 2015 clair authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package detectors
+
+import (
+	"fmt"
+	"sync"
+)
+
+var (
+	disabledDetectorsLock sync.RWMutex
+	disabledDetectors     = make(map[string]struct{})
+)
+
+// DisableDetectors disables the NamespaceDetectors and FeaturesDetectors registered with the
+// given names, in place of the ones disabled before: they don't run anymore and are not listed as
+// enabled. Passing no names enables every detector again.
+//
+// An error is returned, and nothing is changed, if one of the names is not registered.
+func DisableDetectors(names []string) error {
+	registered := make(map[string]struct{})
+	for _, name := range append(ListNamespaceDetectors(), ListFeaturesDetectors()...) {
+		registered[name] = struct{}{}
+	}
+
+	disabled := make(map[string]struct{}, len(names))
+	for _, name := range names {
+		if _, ok := registered[name]; !ok {
+			return fmt.Errorf("could not disable detector '%s': it is not registered", name)
+		}
+		disabled[name] = struct{}{}
+	}
+
+	disabledDetectorsLock.Lock()
+	defer disabledDetectorsLock.Unlock()
+
+	disabledDetectors = disabled
+	return nil
+}
+
+// isDetectorEnabled returns whether the detector registered with the given name has not been
+// disabled.
+func isDetectorEnabled(name string) bool {
+	disabledDetectorsLock.RLock()
+	defer disabledDetectorsLock.RUnlock()
+
+	_, disabled := disabledDetectors[name]
+	return !disabled
+}
+
+// enabledDetectors returns the given names of detectors, without the disabled ones.
+func enabledDetectors(names []string) []string {
+	enabled := make([]string, 0, len(names))
+	for _, name := range names {
+		if isDetectorEnabled(name) {
+			enabled = append(enabled, name)
+		}
+	}
+	return enabled
+}
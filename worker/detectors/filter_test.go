@@ -0,0 +1,77 @@
+// Copyright 2015 clair authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package detectors
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/coreos/clair/database"
+)
+
+func TestDisableDetectors(t *testing.T) {
+	RegisterNamespaceDetector("test-filter", testNamespaceDetector{"filter-release", "filter:"})
+	RegisterFeaturesDetector("test-filter", testFeaturesDetector{"filter"})
+	defer UnregisterNamespaceDetector("test-filter")
+	defer UnregisterFeaturesDetector("test-filter")
+	defer DisableDetectors(nil)
+
+	data := map[string][]byte{"filter-release": []byte("1"), "packages": nil}
+	featureNames := func() []string {
+		features, err := DetectFeatures(data)
+		assert.Nil(t, err)
+
+		var names []string
+		for _, feature := range features {
+			names = append(names, feature.Feature.Name)
+		}
+		return names
+	}
+
+	// The registered detectors are listed and run.
+	assert.Contains(t, ListNamespaceDetectors(), "test-filter")
+	assert.Contains(t, ListEnabledNamespaceDetectors(), "test-filter")
+	assert.Contains(t, ListEnabledFeaturesDetectors(), "test-filter")
+	assert.Contains(t, DetectNamespaces(data), database.Namespace{Name: "filter:1"})
+	assert.Contains(t, featureNames(), "filter")
+	assert.Contains(t, GetRequiredFilesNamespace(), "filter-release")
+
+	// Unknown detectors can't be disabled.
+	assert.NotNil(t, DisableDetectors([]string{"test-filter", "unknown"}))
+	assert.Contains(t, ListEnabledNamespaceDetectors(), "test-filter")
+
+	// Once disabled, they are still registered but don't run anymore.
+	assert.Nil(t, DisableDetectors([]string{"test-filter", "a-test-low"}))
+	assert.Contains(t, ListNamespaceDetectors(), "test-filter")
+	assert.NotContains(t, ListEnabledNamespaceDetectors(), "test-filter")
+	assert.NotContains(t, ListEnabledFeaturesDetectors(), "test-filter")
+	assert.NotContains(t, DetectNamespaces(data), database.Namespace{Name: "filter:1"})
+	assert.Equal(t, []string{"high", "default", "other-default"}, featureNames())
+	assert.NotContains(t, GetRequiredFilesNamespace(), "filter-release")
+
+	// Every detector is enabled again.
+	assert.Nil(t, DisableDetectors(nil))
+	assert.Contains(t, DetectNamespaces(data), database.Namespace{Name: "filter:1"})
+	assert.Contains(t, featureNames(), "low")
+
+	// Unregistered detectors are neither listed nor run, and may be registered again.
+	UnregisterNamespaceDetector("test-filter")
+	UnregisterFeaturesDetector("test-filter")
+	assert.NotContains(t, ListNamespaceDetectors(), "test-filter")
+	assert.NotContains(t, DetectNamespaces(data), database.Namespace{Name: "filter:1"})
+	assert.NotContains(t, featureNames(), "filter")
+	assert.NotPanics(t, func() { RegisterNamespaceDetector("test-filter", testNamespaceDetector{"filter-release", "filter:"}) })
+}
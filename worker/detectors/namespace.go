@@ -18,6 +18,7 @@ package detectors
 
 import (
 	"fmt"
+	"sort"
 	"sync"
 
 	"github.com/coreos/clair/database"
@@ -29,10 +30,24 @@ type NamespaceDetector interface {
 	// Detect detects a Namespace and its version from input data.
 	Detect(map[string][]byte) *database.Namespace
 	// GetRequiredFiles returns the list of files required for Detect, without
-	// leading /.
+	// leading /. They may be patterns that designate several files, see
+	// utils.MatchFile.
 	GetRequiredFiles() []string
 }
 
+// DefaultNamespacePriority is the priority of the NamespaceDetectors that do not implement
+// PrioritizedNamespaceDetector.
+const DefaultNamespacePriority = 0
+
+// PrioritizedNamespaceDetector is a NamespaceDetector that should be tried before, or after, the
+// others. Generic detectors, which read files found on many distributions, use a lower priority
+// than DefaultNamespacePriority so that the more specific detectors win.
+type PrioritizedNamespaceDetector interface {
+	NamespaceDetector
+	// Priority returns the priority of the detector: higher priorities are tried first.
+	Priority() int
+}
+
 var (
 	namespaceDetectorsLock sync.Mutex
 	namespaceDetectors     = make(map[string]NamespaceDetector)
@@ -60,23 +75,108 @@ func RegisterNamespaceDetector(name string, f NamespaceDetector) {
 	namespaceDetectors[name] = f
 }
 
-// DetectNamespace finds the OS of the layer by using every registered NamespaceDetector.
-func DetectNamespace(data map[string][]byte) *database.Namespace {
-	for _, detector := range namespaceDetectors {
-		if namespace := detector.Detect(data); namespace != nil {
-			return namespace
+// UnregisterNamespaceDetector removes the NamespaceDetector registered with the given name, if any.
+// It is meant for the tests that register detectors of their own.
+func UnregisterNamespaceDetector(name string) {
+	namespaceDetectorsLock.Lock()
+	defer namespaceDetectorsLock.Unlock()
+
+	delete(namespaceDetectors, name)
+}
+
+// DetectNamespaces finds the namespaces of the layer, such as its OS and the ecosystems of the
+// language packages it contains, by using every enabled NamespaceDetector by decreasing
+// priority. A result whose prefix, which names the OS or the ecosystem, was already detected is
+// ignored, as it comes from a less specific detector.
+func DetectNamespaces(data map[string][]byte) (namespaces []database.Namespace) {
+	detected := make(map[string]string)
+	for _, detector := range sortedNamespaceDetectors() {
+		namespace := detector.Detect(data)
+		if namespace == nil {
+			continue
 		}
+		if winner, ok := detected[namespace.Prefix()]; ok {
+			log.Debugf("namespace %q detected by %s ignored in favor of %s", namespace.Name, detector.name, winner)
+			continue
+		}
+
+		log.Debugf("namespace %q detected by %s", namespace.Name, detector.name)
+		detected[namespace.Prefix()] = detector.name
+		namespaces = append(namespaces, *namespace)
+	}
+
+	return
+}
+
+// namedNamespaceDetector is a registered NamespaceDetector, along with its name.
+type namedNamespaceDetector struct {
+	NamespaceDetector
+	name string
+}
+
+// sortedNamespaceDetectors returns the enabled NamespaceDetectors by decreasing priority, and
+// then by name so that the detection is deterministic.
+func sortedNamespaceDetectors() []namedNamespaceDetector {
+	names := ListEnabledNamespaceDetectors()
+
+	namespaceDetectorsLock.Lock()
+	defer namespaceDetectorsLock.Unlock()
+
+	detectors := make([]namedNamespaceDetector, 0, len(names))
+	for _, name := range names {
+		detectors = append(detectors, namedNamespaceDetector{namespaceDetectors[name], name})
 	}
+	sort.Stable(byNamespaceDetectorPriority(detectors))
+
+	return detectors
+}
+
+type byNamespaceDetectorPriority []namedNamespaceDetector
+
+func (s byNamespaceDetectorPriority) Len() int      { return len(s) }
+func (s byNamespaceDetectorPriority) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s byNamespaceDetectorPriority) Less(i, j int) bool {
+	return namespaceDetectorPriority(s[i].NamespaceDetector) > namespaceDetectorPriority(s[j].NamespaceDetector)
+}
 
-	return nil
+func namespaceDetectorPriority(detector NamespaceDetector) int {
+	if prioritized, ok := detector.(PrioritizedNamespaceDetector); ok {
+		return prioritized.Priority()
+	}
+	return DefaultNamespacePriority
 }
 
-// GetRequiredFilesNamespace returns the list of files required for DetectNamespace for every
-// registered NamespaceDetector, without leading /.
+// GetRequiredFilesNamespace returns the list of files required for DetectNamespaces for every
+// enabled NamespaceDetector, without leading /.
 func GetRequiredFilesNamespace() (files []string) {
-	for _, detector := range namespaceDetectors {
-		files = append(files, detector.GetRequiredFiles()...)
+	namespaceDetectorsLock.Lock()
+	defer namespaceDetectorsLock.Unlock()
+
+	for name, detector := range namespaceDetectors {
+		if isDetectorEnabled(name) {
+			files = append(files, detector.GetRequiredFiles()...)
+		}
 	}
 
 	return
 }
+
+// ListNamespaceDetectors returns the sorted names of the registered NamespaceDetectors.
+func ListNamespaceDetectors() []string {
+	namespaceDetectorsLock.Lock()
+	defer namespaceDetectorsLock.Unlock()
+
+	names := make([]string, 0, len(namespaceDetectors))
+	for name := range namespaceDetectors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// ListEnabledNamespaceDetectors returns the sorted names of the registered NamespaceDetectors that are not
+// disabled.
+func ListEnabledNamespaceDetectors() []string {
+	return enabledDetectors(ListNamespaceDetectors())
+}
@@ -0,0 +1,62 @@
+// Copyright 2015 clair authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpinerelease
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/coreos/clair/database"
+	"github.com/coreos/clair/utils/types"
+	"github.com/coreos/clair/worker/detectors"
+)
+
+// alpineReleaseRegexp matches the releases, such as 3.4.6, and the snapshots of the edge branch,
+// such as 3.5.0_alpha20161114.
+var alpineReleaseRegexp = regexp.MustCompile(`^(\d+)\.(\d+)\.\d+(_alpha\d+)?$`)
+
+// AlpineReleaseNamespaceDetector implements NamespaceDetector and detects the OS from the
+// /etc/alpine-release file.
+//
+// The Alpine vulnerabilities are published per branch, so the namespace only holds the major and
+// minor versions of the release, e.g. alpine:v3.4 for 3.4.6.
+type AlpineReleaseNamespaceDetector struct{}
+
+func init() {
+	detectors.RegisterNamespaceDetector("alpine-release", &AlpineReleaseNamespaceDetector{})
+}
+
+// Detect tries to detect the Alpine branch using "/etc/alpine-release". The snapshots of the edge
+// branch are named after the next release with an alpha suffix, and are detected as alpine:edge.
+func (detector *AlpineReleaseNamespaceDetector) Detect(data map[string][]byte) *database.Namespace {
+	f, hasFile := data["etc/alpine-release"]
+	if !hasFile {
+		return nil
+	}
+
+	r := alpineReleaseRegexp.FindStringSubmatch(strings.TrimSpace(string(f)))
+	if r == nil {
+		return nil
+	}
+	if r[3] != "" {
+		return &database.Namespace{Name: "alpine:edge", VersionFormat: types.ApkVersionFormat}
+	}
+	return &database.Namespace{Name: "alpine:v" + r[1] + "." + r[2], VersionFormat: types.ApkVersionFormat}
+}
+
+// GetRequiredFiles returns the list of files that are required for Detect()
+func (detector *AlpineReleaseNamespaceDetector) GetRequiredFiles() []string {
+	return []string{"etc/alpine-release"}
+}
@@ -0,0 +1,45 @@
+// Copyright 2015 clair authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alpinerelease
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/coreos/clair/worker/detectors"
+	_ "github.com/coreos/clair/worker/detectors/namespace/osrelease"
+	"github.com/coreos/clair/worker/detectors/testutil"
+)
+
+func TestAlpineReleaseNamespaceDetector(t *testing.T) {
+	testutil.RunNamespaceDetectorTests(t, &AlpineReleaseNamespaceDetector{}, "testdata/layers")
+}
+
+func TestAlpineReleaseBeforeOsRelease(t *testing.T) {
+	namespaces := detectors.DetectNamespaces(map[string][]byte{
+		"etc/alpine-release": []byte("3.4.6\n"),
+		"etc/os-release": []byte(`NAME="Alpine Linux"
+ID=alpine
+VERSION_ID=3.4.6
+PRETTY_NAME="Alpine Linux v3.4"
+HOME_URL="http://alpinelinux.org"
+BUG_REPORT_URL="http://bugs.alpinelinux.org"`),
+	})
+	// The os-release namespace names the same OS and is thus ignored.
+	if assert.Len(t, namespaces, 1) {
+		assert.Equal(t, "alpine:v3.4", namespaces[0].Name)
+	}
+}
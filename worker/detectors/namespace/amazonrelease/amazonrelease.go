@@ -0,0 +1,90 @@
+// Copyright 2015 clair authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package amazonrelease
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/coreos/clair/database"
+	"github.com/coreos/clair/utils/types"
+	"github.com/coreos/clair/worker/detectors"
+)
+
+// amazonReleaseRegexp matches the releases of Amazon Linux 1, such as 2018.03, and the ones of
+// Amazon Linux 2 and later, such as 2.
+var amazonReleaseRegexp = regexp.MustCompile(`^\s*Amazon Linux (?:AMI )?release (\d+(?:\.\d+)?)\b`)
+
+// amazonVersionRegexp matches the versions found in the CPE names.
+var amazonVersionRegexp = regexp.MustCompile(`^\d+(?:\.\d+)?$`)
+
+// AmazonReleaseNamespaceDetector implements NamespaceDetector and detects the OS from the
+// /etc/system-release-cpe and /etc/system-release files.
+//
+// eg. cpe:/o:amazon:linux:2018.03:ga
+// eg. cpe:2.3:o:amazon:amazon_linux:2
+// eg. Amazon Linux AMI release 2018.03
+// eg. Amazon Linux release 2 (Karoo)
+type AmazonReleaseNamespaceDetector struct{}
+
+func init() {
+	detectors.RegisterNamespaceDetector("amazon-release", &AmazonReleaseNamespaceDetector{})
+}
+
+// Detect tries to detect the Amazon Linux release. The CPE name is preferred, as it holds the
+// exact version, and the release string is only used when it is absent or malformed.
+func (detector *AmazonReleaseNamespaceDetector) Detect(data map[string][]byte) *database.Namespace {
+	if f, hasFile := data["etc/system-release-cpe"]; hasFile {
+		if version := parseCPE(strings.TrimSpace(string(f))); version != "" {
+			return &database.Namespace{Name: "amzn:" + version, VersionFormat: types.RpmVersionFormat}
+		}
+	}
+
+	if f, hasFile := data["etc/system-release"]; hasFile {
+		if r := amazonReleaseRegexp.FindStringSubmatch(string(f)); r != nil {
+			return &database.Namespace{Name: "amzn:" + r[1], VersionFormat: types.RpmVersionFormat}
+		}
+	}
+
+	return nil
+}
+
+// GetRequiredFiles returns the list of files that are required for Detect()
+func (detector *AmazonReleaseNamespaceDetector) GetRequiredFiles() []string {
+	return []string{"etc/system-release-cpe", "etc/system-release"}
+}
+
+// parseCPE returns the version of an Amazon Linux CPE name, written either as a URI
+// (cpe:/o:amazon:linux:2018.03:ga) or as a formatted string (cpe:2.3:o:amazon:amazon_linux:2).
+func parseCPE(cpe string) string {
+	var fields []string
+	switch {
+	case strings.HasPrefix(cpe, "cpe:2.3:"):
+		fields = strings.Split(strings.TrimPrefix(cpe, "cpe:2.3:"), ":")
+	case strings.HasPrefix(cpe, "cpe:/"):
+		fields = strings.Split(strings.TrimPrefix(cpe, "cpe:/"), ":")
+	default:
+		return ""
+	}
+
+	// The fields are the part, the vendor, the product and the version.
+	if len(fields) < 4 || fields[0] != "o" || fields[1] != "amazon" {
+		return ""
+	}
+	if !amazonVersionRegexp.MatchString(fields[3]) {
+		return ""
+	}
+	return fields[3]
+}
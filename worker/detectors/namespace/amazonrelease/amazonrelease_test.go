@@ -0,0 +1,52 @@
+// Copyright 2015 clair authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package amazonrelease
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/coreos/clair/database"
+	"github.com/coreos/clair/utils/types"
+	"github.com/coreos/clair/worker/detectors"
+	_ "github.com/coreos/clair/worker/detectors/namespace/osrelease"
+	_ "github.com/coreos/clair/worker/detectors/namespace/redhatrelease"
+	"github.com/coreos/clair/worker/detectors/testutil"
+)
+
+func TestAmazonReleaseNamespaceDetector(t *testing.T) {
+	testutil.RunNamespaceDetectorTests(t, &AmazonReleaseNamespaceDetector{}, "testdata/layers")
+}
+
+func TestAmazonReleaseBeforeOsRelease(t *testing.T) {
+	namespaces := detectors.DetectNamespaces(map[string][]byte{
+		"etc/system-release":     []byte("Amazon Linux release 2 (Karoo)\n"),
+		"etc/system-release-cpe": []byte("cpe:2.3:o:amazon:amazon_linux:2\n"),
+		"etc/os-release": []byte(`NAME="Amazon Linux"
+VERSION="2"
+ID="amzn"
+ID_LIKE="centos rhel fedora"
+VERSION_ID="2"
+PRETTY_NAME="Amazon Linux 2"
+ANSI_COLOR="0;33"
+CPE_NAME="cpe:2.3:o:amazon:amazon_linux:2"
+HOME_URL="https://amazonlinux.com/"`),
+	})
+	// The os-release namespace names the same OS and is thus ignored.
+	if assert.Len(t, namespaces, 1) {
+		assert.Equal(t, database.Namespace{Name: "amzn:2", VersionFormat: types.RpmVersionFormat}, namespaces[0])
+	}
+}
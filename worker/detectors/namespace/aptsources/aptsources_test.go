@@ -17,26 +17,9 @@ package aptsources
 import (
 	"testing"
 
-	"github.com/coreos/clair/database"
-	"github.com/coreos/clair/worker/detectors/namespace"
+	"github.com/coreos/clair/worker/detectors/testutil"
 )
 
-var aptSourcesOSTests = []namespace.NamespaceTest{
-	{
-		ExpectedNamespace: database.Namespace{Name: "debian:unstable"},
-		Data: map[string][]byte{
-			"etc/os-release": []byte(
-				`PRETTY_NAME="Debian GNU/Linux stretch/sid"
-NAME="Debian GNU/Linux"
-ID=debian
-HOME_URL="https://www.debian.org/"
-SUPPORT_URL="https://www.debian.org/support/"
-BUG_REPORT_URL="https://bugs.debian.org/"`),
-			"etc/apt/sources.list": []byte(`deb http://httpredir.debian.org/debian unstable main`),
-		},
-	},
-}
-
 func TestAptSourcesNamespaceDetector(t *testing.T) {
-	namespace.TestNamespaceDetector(t, &AptSourcesNamespaceDetector{}, aptSourcesOSTests)
+	testutil.RunNamespaceDetectorTests(t, &AptSourcesNamespaceDetector{}, "testdata/layers")
 }
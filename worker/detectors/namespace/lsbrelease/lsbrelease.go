@@ -16,19 +16,13 @@ package lsbrelease
 
 import (
 	"bufio"
-	"regexp"
 	"strings"
 
 	"github.com/coreos/clair/database"
 	"github.com/coreos/clair/worker/detectors"
 )
 
-var (
-	lsbReleaseOSRegexp      = regexp.MustCompile(`^DISTRIB_ID=(.*)`)
-	lsbReleaseVersionRegexp = regexp.MustCompile(`^DISTRIB_RELEASE=(.*)`)
-)
-
-// AptSourcesNamespaceDetector implements NamespaceDetector and detects the Namespace from the
+// LsbReleaseNamespaceDetector implements NamespaceDetector and detects the Namespace from the
 // /etc/lsb-release file.
 //
 // This detector is necessary for Ubuntu Precise.
@@ -38,6 +32,8 @@ func init() {
 	detectors.RegisterNamespaceDetector("lsb-release", &LsbReleaseNamespaceDetector{})
 }
 
+// Detect tries to detect OS/Version using the DISTRIB_ID and DISTRIB_RELEASE fields of
+// "/etc/lsb-release".
 func (detector *LsbReleaseNamespaceDetector) Detect(data map[string][]byte) *database.Namespace {
 	f, hasFile := data["etc/lsb-release"]
 	if !hasFile {
@@ -46,31 +42,37 @@ func (detector *LsbReleaseNamespaceDetector) Detect(data map[string][]byte) *dat
 
 	var OS, version string
 
+	// The file is made of KEY=value lines, whose values may be quoted, and of comments.
 	scanner := bufio.NewScanner(strings.NewReader(string(f)))
 	for scanner.Scan() {
-		line := scanner.Text()
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
 
-		r := lsbReleaseOSRegexp.FindStringSubmatch(line)
-		if len(r) == 2 {
-			OS = strings.Replace(strings.ToLower(r[1]), "\"", "", -1)
+		fields := strings.SplitN(line, "=", 2)
+		if len(fields) != 2 {
+			continue
 		}
+		value := strings.ToLower(strings.Trim(strings.TrimSpace(fields[1]), `"'`))
 
-		r = lsbReleaseVersionRegexp.FindStringSubmatch(line)
-		if len(r) == 2 {
-			version = strings.Replace(strings.ToLower(r[1]), "\"", "", -1)
+		switch strings.TrimSpace(fields[0]) {
+		case "DISTRIB_ID":
+			OS = value
+		case "DISTRIB_RELEASE":
+			version = value
+		}
+	}
 
-			// We care about the .04 for Ubuntu but not for Debian / CentOS
-			if OS == "centos" || OS == "debian" {
-				i := strings.Index(version, ".")
-				if i >= 0 {
-					version = version[:i]
-				}
-			}
+	// We care about the .04 for Ubuntu but not for Debian / CentOS
+	if OS == "centos" || OS == "debian" {
+		if i := strings.Index(version, "."); i >= 0 {
+			version = version[:i]
 		}
 	}
 
 	if OS != "" && version != "" {
-		return &database.Namespace{Name: OS + ":" + version}
+		return &database.Namespace{Name: OS + ":" + version, VersionFormat: database.VersionFormatsMapping[OS]}
 	}
 	return nil
 }
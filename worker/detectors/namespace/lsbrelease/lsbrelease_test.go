@@ -17,33 +17,9 @@ package lsbrelease
 import (
 	"testing"
 
-	"github.com/coreos/clair/database"
-	"github.com/coreos/clair/worker/detectors/namespace"
+	"github.com/coreos/clair/worker/detectors/testutil"
 )
 
-var lsbReleaseOSTests = []namespace.NamespaceTest{
-	{
-		ExpectedNamespace: database.Namespace{Name: "ubuntu:12.04"},
-		Data: map[string][]byte{
-			"etc/lsb-release": []byte(
-				`DISTRIB_ID=Ubuntu
-DISTRIB_RELEASE=12.04
-DISTRIB_CODENAME=precise
-DISTRIB_DESCRIPTION="Ubuntu 12.04 LTS"`),
-		},
-	},
-	{ // We don't care about the minor version of Debian
-		ExpectedNamespace: database.Namespace{Name: "debian:7"},
-		Data: map[string][]byte{
-			"etc/lsb-release": []byte(
-				`DISTRIB_ID=Debian
-DISTRIB_RELEASE=7.1
-DISTRIB_CODENAME=wheezy
-DISTRIB_DESCRIPTION="Debian 7.1"`),
-		},
-	},
-}
-
 func TestLsbReleaseNamespaceDetector(t *testing.T) {
-	namespace.TestNamespaceDetector(t, &LsbReleaseNamespaceDetector{}, lsbReleaseOSTests)
+	testutil.RunNamespaceDetectorTests(t, &LsbReleaseNamespaceDetector{}, "testdata/layers")
 }
@@ -16,20 +16,17 @@ package osrelease
 
 import (
 	"bufio"
-	"regexp"
 	"strings"
 
 	"github.com/coreos/clair/database"
 	"github.com/coreos/clair/worker/detectors"
 )
 
-var (
-	osReleaseOSRegexp      = regexp.MustCompile(`^ID=(.*)`)
-	osReleaseVersionRegexp = regexp.MustCompile(`^VERSION_ID=(.*)`)
-)
-
 // OsReleaseNamespaceDetector implements NamespaceDetector and detects the OS from the
 // /etc/os-release and usr/lib/os-release files.
+//
+// As these files are present on most distributions, the detector has a lower priority than the
+// others, which are more specific.
 type OsReleaseNamespaceDetector struct{}
 
 func init() {
@@ -39,34 +36,29 @@ func init() {
 // Detect tries to detect OS/Version using "/etc/os-release" and "/usr/lib/os-release"
 // Typically for Debian / Ubuntu
 // /etc/debian_version can't be used, it does not make any difference between testing and unstable, it returns stretch/sid
+//
+// The first file found is used, as /etc/os-release overrides /usr/lib/os-release. Rolling
+// distributions, such as Debian unstable or Arch Linux, have no VERSION_ID and are left for the
+// other detectors.
 func (detector *OsReleaseNamespaceDetector) Detect(data map[string][]byte) *database.Namespace {
-	var OS, version string
-
 	for _, filePath := range detector.GetRequiredFiles() {
 		f, hasFile := data[filePath]
 		if !hasFile {
 			continue
 		}
 
-		scanner := bufio.NewScanner(strings.NewReader(string(f)))
-		for scanner.Scan() {
-			line := scanner.Text()
-
-			r := osReleaseOSRegexp.FindStringSubmatch(line)
-			if len(r) == 2 {
-				OS = strings.Replace(strings.ToLower(r[1]), "\"", "", -1)
-			}
-
-			r = osReleaseVersionRegexp.FindStringSubmatch(line)
-			if len(r) == 2 {
-				version = strings.Replace(strings.ToLower(r[1]), "\"", "", -1)
+		fields := parseOsRelease(string(f))
+		OS, version := osName(fields), strings.ToLower(fields["VERSION_ID"])
+		if OS != "" && version != "" {
+			if OS == "oracle" {
+				// Oracle Linux publishes its advisories per major version.
+				version = strings.SplitN(version, ".", 2)[0]
 			}
+			return &database.Namespace{Name: OS + ":" + version, VersionFormat: database.VersionFormatsMapping[OS]}
 		}
+		return nil
 	}
 
-	if OS != "" && version != "" {
-		return &database.Namespace{Name: OS + ":" + version}
-	}
 	return nil
 }
 
@@ -74,3 +66,74 @@ func (detector *OsReleaseNamespaceDetector) Detect(data map[string][]byte) *data
 func (detector *OsReleaseNamespaceDetector) GetRequiredFiles() []string {
 	return []string{"etc/os-release", "usr/lib/os-release"}
 }
+
+// Priority returns a priority lower than the default one.
+func (detector *OsReleaseNamespaceDetector) Priority() int {
+	return detectors.DefaultNamespacePriority - 1
+}
+
+// osName returns the OS part of the namespace from the ID of an os-release file. The IDs of
+// Oracle Linux and openSUSE Leap are translated to the names used by the other detectors; openSUSE
+// Leap 42 still used the opensuse ID, and is recognized by its NAME.
+func osName(fields map[string]string) string {
+	switch OS := strings.ToLower(fields["ID"]); OS {
+	case "ol":
+		return "oracle"
+	case "opensuse-leap":
+		return "opensuse.leap"
+	case "opensuse":
+		if strings.Contains(fields["NAME"], "Leap") {
+			return "opensuse.leap"
+		}
+		return OS
+	default:
+		return OS
+	}
+}
+
+// parseOsRelease returns the variables assigned in an os-release file, which uses a subset of the
+// shell syntax: blank lines and comments are ignored, and values may be quoted.
+func parseOsRelease(content string) map[string]string {
+	fields := make(map[string]string)
+
+	scanner := bufio.NewScanner(strings.NewReader(content))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		i := strings.Index(line, "=")
+		if i <= 0 {
+			continue
+		}
+		fields[line[:i]] = unquote(line[i+1:])
+	}
+
+	return fields
+}
+
+// unquote returns the value of a shell word: the content of single quotes is kept as is, while
+// backslashes escape the next character inside double quotes and outside of quotes. An unquoted
+// comment ends the value.
+func unquote(word string) string {
+	var value []byte
+	var quote byte
+	for i := 0; i < len(word); i++ {
+		c := word[i]
+		switch {
+		case quote == 0 && (c == '"' || c == '\''):
+			quote = c
+		case c == quote:
+			quote = 0
+		case c == '\\' && quote != '\'' && i+1 < len(word):
+			i++
+			value = append(value, word[i])
+		case quote == 0 && c == '#' && (i == 0 || word[i-1] == ' ' || word[i-1] == '\t'):
+			return strings.TrimSpace(string(value))
+		default:
+			value = append(value, c)
+		}
+	}
+	return strings.TrimSpace(string(value))
+}
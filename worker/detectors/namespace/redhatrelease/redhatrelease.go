@@ -19,24 +19,44 @@ import (
 	"strings"
 
 	"github.com/coreos/clair/database"
+	"github.com/coreos/clair/utils/types"
 	"github.com/coreos/clair/worker/detectors"
 )
 
-var redhatReleaseRegexp = regexp.MustCompile(`(?P<os>[^\s]*) (Linux release|release) (?P<version>[\d]+)`)
+var redhatReleaseRegexp = regexp.MustCompile(`^\s*(?P<name>.+?)\s+release\s+(?P<version>\d+)`)
+
+// redhatReleaseOSes maps the beginning of the distribution names found in the release files to
+// the OS part of the namespaces.
+var redhatReleaseOSes = []struct {
+	prefix, os string
+}{
+	{"CentOS", "centos"},
+	{"Red Hat Enterprise Linux", "rhel"},
+	{"Fedora", "fedora"},
+	{"Oracle Linux", "oracle"},
+	{"Scientific Linux", "scientific"},
+}
 
 // RedhatReleaseNamespaceDetector implements NamespaceDetector and detects the OS from the
-// /etc/centos-release, /etc/redhat-release and /etc/system-release files.
+// /etc/oracle-release, /etc/centos-release, /etc/redhat-release and /etc/system-release files.
+//
+// Oracle Linux ships an /etc/redhat-release file naming Red Hat Enterprise Linux, so
+// /etc/oracle-release is read first.
 //
 // Typically for CentOS and Red-Hat like systems
 // eg. CentOS release 5.11 (Final)
 // eg. CentOS release 6.6 (Final)
 // eg. CentOS Linux release 7.1.1503 (Core)
+// eg. Red Hat Enterprise Linux Server release 6.8 (Santiago)
+// eg. Oracle Linux Server release 7.3
 type RedhatReleaseNamespaceDetector struct{}
 
 func init() {
 	detectors.RegisterNamespaceDetector("redhat-release", &RedhatReleaseNamespaceDetector{})
 }
 
+// Detect tries to detect the OS and its major version using the first release file that names a
+// known distribution.
 func (detector *RedhatReleaseNamespaceDetector) Detect(data map[string][]byte) *database.Namespace {
 	for _, filePath := range detector.GetRequiredFiles() {
 		f, hasFile := data[filePath]
@@ -45,8 +65,13 @@ func (detector *RedhatReleaseNamespaceDetector) Detect(data map[string][]byte) *
 		}
 
 		r := redhatReleaseRegexp.FindStringSubmatch(string(f))
-		if len(r) == 4 {
-			return &database.Namespace{Name: strings.ToLower(r[1]) + ":" + r[3]}
+		if len(r) != 3 {
+			continue
+		}
+		for _, o := range redhatReleaseOSes {
+			if strings.HasPrefix(r[1], o.prefix) {
+				return &database.Namespace{Name: o.os + ":" + r[2], VersionFormat: types.RpmVersionFormat}
+			}
 		}
 	}
 
@@ -55,5 +80,5 @@ func (detector *RedhatReleaseNamespaceDetector) Detect(data map[string][]byte) *
 
 // GetRequiredFiles returns the list of files that are required for Detect()
 func (detector *RedhatReleaseNamespaceDetector) GetRequiredFiles() []string {
-	return []string{"etc/centos-release", "etc/redhat-release", "etc/system-release"}
+	return []string{"etc/oracle-release", "etc/centos-release", "etc/redhat-release", "etc/system-release"}
 }
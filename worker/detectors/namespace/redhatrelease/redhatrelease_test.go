@@ -17,25 +17,37 @@ package redhatrelease
 import (
 	"testing"
 
-	"github.com/coreos/clair/database"
-	"github.com/coreos/clair/worker/detectors/namespace"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/coreos/clair/worker/detectors/testutil"
 )
 
-var redhatReleaseTests = []namespace.NamespaceTest{
-	{
-		ExpectedNamespace: database.Namespace{Name: "centos:6"},
-		Data: map[string][]byte{
-			"etc/centos-release": []byte(`CentOS release 6.6 (Final)`),
-		},
-	},
-	{
-		ExpectedNamespace: database.Namespace{Name: "centos:7"},
-		Data: map[string][]byte{
-			"etc/system-release": []byte(`CentOS Linux release 7.1.1503 (Core)`),
-		},
-	},
+func TestRedhatReleaseNamespaceDetector(t *testing.T) {
+	testutil.RunNamespaceDetectorTests(t, &RedhatReleaseNamespaceDetector{}, "testdata/layers")
 }
 
-func TestRedhatReleaseNamespaceDetector(t *testing.T) {
-	namespace.TestNamespaceDetector(t, &RedhatReleaseNamespaceDetector{}, redhatReleaseTests)
+func TestRedhatReleaseStrings(t *testing.T) {
+	// Release strings found in the official images of the distributions.
+	releases := map[string]string{
+		"CentOS release 5.11 (Final)":                                   "centos:5",
+		"CentOS release 6.8 (Final)":                                    "centos:6",
+		"CentOS Linux release 7.2.1511 (Core)":                          "centos:7",
+		"CentOS Linux release 7.3.1611 (Core)":                          "centos:7",
+		"Red Hat Enterprise Linux Server release 5.11 (Tikanga)":        "rhel:5",
+		"Red Hat Enterprise Linux Server release 6.8 (Santiago)":        "rhel:6",
+		"Red Hat Enterprise Linux Server release 7.2 (Maipo)":           "rhel:7",
+		"Red Hat Enterprise Linux Workstation release 7.3 (Maipo)":      "rhel:7",
+		"Red Hat Enterprise Linux Atomic Host release 7.2":              "rhel:7",
+		"Oracle Linux Server release 7.2":                               "oracle:7",
+		"Scientific Linux release 6.7 (Carbon)":                         "scientific:6",
+		"Fedora release 24 (Twenty Four)":                               "fedora:24",
+		"Red Hat Enterprise Linux Server release 6.8 Beta (Santiago)\n": "rhel:6",
+	}
+
+	for release, expected := range releases {
+		ns := (&RedhatReleaseNamespaceDetector{}).Detect(map[string][]byte{"etc/redhat-release": []byte(release)})
+		if assert.NotNil(t, ns, release) {
+			assert.Equal(t, expected, ns.Name, release)
+		}
+	}
 }
@@ -0,0 +1,89 @@
+// Copyright 2015 clair authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package suserelease
+
+import (
+	"bufio"
+	"regexp"
+	"strings"
+
+	"github.com/coreos/clair/database"
+	"github.com/coreos/clair/utils/types"
+	"github.com/coreos/clair/worker/detectors"
+)
+
+var (
+	slesReleaseRegexp     = regexp.MustCompile(`^SUSE Linux Enterprise Server (\d+)\b`)
+	openSUSEReleaseRegexp = regexp.MustCompile(`^openSUSE (\d+\.\d+)\b`)
+	patchLevelRegexp      = regexp.MustCompile(`^PATCHLEVEL\s*=\s*(\d+)\s*$`)
+)
+
+// SuseReleaseNamespaceDetector implements NamespaceDetector and detects the OS from the
+// /etc/SuSE-release file, which SLES and openSUSE shipped until their versions 15.
+//
+// eg. SUSE Linux Enterprise Server 12 (x86_64), with PATCHLEVEL = 3
+// eg. openSUSE 42.3 (x86_64)
+// eg. openSUSE 13.2 (x86_64)
+//
+// The releases of openSUSE Leap, starting with 42.1, are named opensuse.leap, while the older ones
+// are named opensuse, as the os-release detector does.
+type SuseReleaseNamespaceDetector struct{}
+
+func init() {
+	detectors.RegisterNamespaceDetector("suse-release", &SuseReleaseNamespaceDetector{})
+}
+
+// Detect tries to detect the OS and its version using the first line of "/etc/SuSE-release" and,
+// for SLES, the service pack found in its PATCHLEVEL variable, e.g. sles:12.3.
+func (detector *SuseReleaseNamespaceDetector) Detect(data map[string][]byte) *database.Namespace {
+	f, hasFile := data["etc/SuSE-release"]
+	if !hasFile {
+		return nil
+	}
+
+	scanner := bufio.NewScanner(strings.NewReader(string(f)))
+	if !scanner.Scan() {
+		return nil
+	}
+	name := strings.TrimSpace(scanner.Text())
+
+	if r := openSUSEReleaseRegexp.FindStringSubmatch(name); r != nil {
+		OS := "opensuse"
+		if strings.HasPrefix(r[1], "42.") {
+			OS = "opensuse.leap"
+		}
+		return &database.Namespace{Name: OS + ":" + r[1], VersionFormat: types.RpmVersionFormat}
+	}
+
+	r := slesReleaseRegexp.FindStringSubmatch(name)
+	if r == nil {
+		return nil
+	}
+	version := r[1]
+	for scanner.Scan() {
+		if p := patchLevelRegexp.FindStringSubmatch(strings.TrimSpace(scanner.Text())); p != nil {
+			if p[1] != "0" {
+				version += "." + p[1]
+			}
+			break
+		}
+	}
+	return &database.Namespace{Name: "sles:" + version, VersionFormat: types.RpmVersionFormat}
+}
+
+// GetRequiredFiles returns the list of files that are required for Detect()
+func (detector *SuseReleaseNamespaceDetector) GetRequiredFiles() []string {
+	return []string{"etc/SuSE-release"}
+}
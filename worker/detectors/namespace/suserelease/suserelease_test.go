@@ -0,0 +1,51 @@
+// Copyright 2015 clair authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package suserelease
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/coreos/clair/database"
+	"github.com/coreos/clair/utils/types"
+	"github.com/coreos/clair/worker/detectors"
+	_ "github.com/coreos/clair/worker/detectors/namespace/osrelease"
+	"github.com/coreos/clair/worker/detectors/testutil"
+)
+
+func TestSuseReleaseNamespaceDetector(t *testing.T) {
+	testutil.RunNamespaceDetectorTests(t, &SuseReleaseNamespaceDetector{}, "testdata/layers")
+}
+
+func TestSuseReleaseBeforeOsRelease(t *testing.T) {
+	namespaces := detectors.DetectNamespaces(map[string][]byte{
+		"etc/SuSE-release": []byte(`SUSE Linux Enterprise Server 12 (x86_64)
+VERSION = 12
+PATCHLEVEL = 3
+`),
+		"etc/os-release": []byte(`NAME="SLES"
+VERSION="12-SP3"
+VERSION_ID="12.3"
+PRETTY_NAME="SUSE Linux Enterprise Server 12 SP3"
+ID="sles"
+ANSI_COLOR="0;32"
+CPE_NAME="cpe:/o:suse:sles:12:sp3"`),
+	})
+	// The os-release namespace names the same OS and is thus ignored.
+	if assert.Len(t, namespaces, 1) {
+		assert.Equal(t, database.Namespace{Name: "sles:12.3", VersionFormat: types.RpmVersionFormat}, namespaces[0])
+	}
+}
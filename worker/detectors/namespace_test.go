@@ -0,0 +1,73 @@
+// Copyright 2015 clair authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package detectors
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/coreos/clair/database"
+)
+
+// testNamespaceDetector detects the namespace written in its file.
+type testNamespaceDetector struct {
+	file   string
+	prefix string
+}
+
+func (d testNamespaceDetector) Detect(data map[string][]byte) *database.Namespace {
+	if release, ok := data[d.file]; ok {
+		return &database.Namespace{Name: d.prefix + string(release)}
+	}
+	return nil
+}
+
+func (d testNamespaceDetector) GetRequiredFiles() []string {
+	return []string{d.file}
+}
+
+// testGenericNamespaceDetector is a testNamespaceDetector with a low priority.
+type testGenericNamespaceDetector struct {
+	testNamespaceDetector
+}
+
+func (testGenericNamespaceDetector) Priority() int {
+	return DefaultNamespacePriority - 1
+}
+
+func init() {
+	// The generic detector is registered with the name that sorts first, and detects the same
+	// prefix as the specific one.
+	RegisterNamespaceDetector("a-test-generic", testGenericNamespaceDetector{testNamespaceDetector{"release", "specific:generic-"}})
+	RegisterNamespaceDetector("m-test-language", testNamespaceDetector{"lockfile", "language:"})
+	RegisterNamespaceDetector("z-test-specific", testNamespaceDetector{"release", "specific:"})
+}
+
+func TestDetectNamespacesPriority(t *testing.T) {
+	for i := 0; i < 10; i++ {
+		namespaces := DetectNamespaces(map[string][]byte{"release": []byte("1")})
+		assert.Equal(t, []database.Namespace{{Name: "specific:1"}}, namespaces)
+	}
+	assert.Empty(t, DetectNamespaces(map[string][]byte{}))
+}
+
+func TestDetectNamespacesSeveral(t *testing.T) {
+	namespaces := DetectNamespaces(map[string][]byte{"release": []byte("1"), "lockfile": []byte("1")})
+	assert.Equal(t, []database.Namespace{{Name: "language:1"}, {Name: "specific:1"}}, namespaces)
+
+	namespaces = DetectNamespaces(map[string][]byte{"lockfile": []byte("1")})
+	assert.Equal(t, []database.Namespace{{Name: "language:1"}}, namespaces)
+}
@@ -0,0 +1,223 @@
+// Copyright 2015 clair authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package detectors
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RegistryCredentials are the credentials Clair uses to authenticate itself to a Docker registry.
+type RegistryCredentials struct {
+	Username string
+	Password string
+}
+
+// defaultTokenExpiration is the lifetime of the registry tokens whose response has no expires_in,
+// as specified by the Docker Registry v2 token authentication.
+const defaultTokenExpiration = 60 * time.Second
+
+var (
+	registryCredentialsLock sync.Mutex
+	registryCredentials     = make(map[string]RegistryCredentials)
+
+	// registryTokens caches the bearer tokens, by registry host and scope.
+	registryTokensLock sync.Mutex
+	registryTokens     = make(map[string]registryToken)
+
+	// blobPathRegexp extracts the repository name from the path of a blob.
+	blobPathRegexp = regexp.MustCompile(`^/v2/(.+)/blobs/[^/]+$`)
+
+	// challengeParamRegexp matches the parameters of a WWW-Authenticate challenge.
+	challengeParamRegexp = regexp.MustCompile(`([a-zA-Z_]+)="([^"]*)"`)
+
+	// timeNow returns the current time, it is replaced by the tests.
+	timeNow = time.Now
+)
+
+// registryToken is a bearer token issued by the token endpoint of a registry.
+type registryToken struct {
+	token   string
+	expires time.Time
+}
+
+// SetRegistryCredentials sets the credentials used when a registry, identified by its host (and
+// port, if any) in the layer URLs, requests the authentication of Clair. The credentials are only
+// used when the layer is requested without an Authorization header.
+func SetRegistryCredentials(credentials map[string]RegistryCredentials) {
+	registryCredentialsLock.Lock()
+	defer registryCredentialsLock.Unlock()
+
+	registryCredentials = make(map[string]RegistryCredentials, len(credentials))
+	for host, c := range credentials {
+		registryCredentials[strings.ToLower(host)] = c
+	}
+
+	registryTokensLock.Lock()
+	defer registryTokensLock.Unlock()
+	registryTokens = make(map[string]registryToken)
+}
+
+// getRegistryCredentials returns the credentials of the registry at the given host, if any.
+func getRegistryCredentials(host string) (RegistryCredentials, bool) {
+	registryCredentialsLock.Lock()
+	defer registryCredentialsLock.Unlock()
+
+	c, ok := registryCredentials[strings.ToLower(host)]
+	return c, ok
+}
+
+// blobScope returns the scope of the token needed to pull the blob at the given URL, or an empty
+// string if the URL is not the one of a blob.
+func blobScope(u *url.URL) string {
+	if m := blobPathRegexp.FindStringSubmatch(u.Path); m != nil {
+		return "repository:" + m[1] + ":pull"
+	}
+	return ""
+}
+
+// cachedRegistryToken returns the cached token of the given host and scope, unless it expired.
+func cachedRegistryToken(host, scope string) (string, bool) {
+	registryTokensLock.Lock()
+	defer registryTokensLock.Unlock()
+
+	t, ok := registryTokens[strings.ToLower(host)+" "+scope]
+	if !ok || !timeNow().Before(t.expires) {
+		return "", false
+	}
+	return t.token, true
+}
+
+// cacheRegistryToken caches the given token of the given host and scope, or forgets the token of
+// the host and scope when it is empty.
+func cacheRegistryToken(host, scope string, t registryToken) {
+	registryTokensLock.Lock()
+	defer registryTokensLock.Unlock()
+
+	key := strings.ToLower(host) + " " + scope
+	if t.token == "" {
+		delete(registryTokens, key)
+		return
+	}
+	registryTokens[key] = t
+}
+
+// parseChallenge returns the scheme and the parameters of a WWW-Authenticate header.
+func parseChallenge(header string) (string, map[string]string) {
+	parts := strings.SplitN(strings.TrimSpace(header), " ", 2)
+	params := make(map[string]string)
+	if len(parts) == 2 {
+		for _, m := range challengeParamRegexp.FindAllStringSubmatch(parts[1], -1) {
+			params[strings.ToLower(m[1])] = m[2]
+		}
+	}
+	return strings.ToLower(parts[0]), params
+}
+
+// authorizeRegistryRequest answers the given challenge of the registry the request is sent to,
+// by setting the Authorization header of the request. It returns false if the challenge can't be
+// answered.
+//
+// Basic challenges are answered with the credentials, whereas bearer challenges require a token
+// from the token endpoint that the challenge designates.
+func authorizeRegistryRequest(request *http.Request, challenge string, credentials RegistryCredentials) bool {
+	scheme, params := parseChallenge(challenge)
+	switch scheme {
+	case "basic":
+		request.SetBasicAuth(credentials.Username, credentials.Password)
+		return true
+	case "bearer":
+	default:
+		log.Warningf("could not authenticate to registry %s: unsupported challenge scheme '%s'", request.URL.Host, scheme)
+		return false
+	}
+
+	scope := params["scope"]
+	if scope == "" {
+		scope = blobScope(request.URL)
+	}
+	t, err := requestRegistryToken(params["realm"], params["service"], scope, credentials)
+	if err != nil {
+		log.Warningf("could not authenticate to registry %s: %s", request.URL.Host, err)
+		return false
+	}
+	cacheRegistryToken(request.URL.Host, scope, t)
+
+	request.Header.Set("Authorization", "Bearer "+t.token)
+	return true
+}
+
+// requestRegistryToken requests a token for the given scope to the token endpoint at realm.
+//
+// The errors never contain the credentials.
+func requestRegistryToken(realm, service, scope string, credentials RegistryCredentials) (registryToken, error) {
+	u, err := url.Parse(realm)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return registryToken{}, errors.New("invalid token realm")
+	}
+	query := u.Query()
+	if service != "" {
+		query.Set("service", service)
+	}
+	if scope != "" {
+		query.Set("scope", scope)
+	}
+	u.RawQuery = query.Encode()
+
+	request, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return registryToken{}, errors.New("invalid token realm")
+	}
+	if credentials.Username != "" || credentials.Password != "" {
+		request.SetBasicAuth(credentials.Username, credentials.Password)
+	}
+
+	r, err := layerClient.Do(request)
+	if err != nil {
+		return registryToken{}, fmt.Errorf("could not request a token to %s", u.Host)
+	}
+	defer r.Body.Close()
+	if r.StatusCode != http.StatusOK {
+		return registryToken{}, fmt.Errorf("got status code %d from %s, expected 200", r.StatusCode, u.Host)
+	}
+
+	var response struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&response); err != nil {
+		return registryToken{}, fmt.Errorf("could not decode the token response of %s", u.Host)
+	}
+
+	t := registryToken{token: response.Token, expires: timeNow().Add(defaultTokenExpiration)}
+	if t.token == "" {
+		t.token = response.AccessToken
+	}
+	if t.token == "" {
+		return registryToken{}, fmt.Errorf("got no token from %s", u.Host)
+	}
+	if response.ExpiresIn > 0 {
+		t.expires = timeNow().Add(time.Duration(response.ExpiresIn) * time.Second)
+	}
+	return t, nil
+}
@@ -0,0 +1,419 @@
+// Copyright 2015 clair authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package testutil runs the namespace and features detectors over fixture layers and compares
+// what they detect with golden outputs.
+//
+// A directory of fixtures holds one layer per fixture, either as a directory, whose content is the
+// root of the layer, or as a tar archive, possibly compressed, named <fixture>.tar or
+// <fixture>.tar.gz. The golden output of each fixture is stored next to it, in <fixture>.json.
+// Running the tests of a detector with -update, e.g.
+// go test ./worker/detectors/feature/dpkg -update, rewrites its golden outputs with what it
+// detects.
+package testutil
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/coreos/clair/database"
+	"github.com/coreos/clair/utils"
+	"github.com/coreos/clair/worker/detectors"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden outputs of the detector fixtures")
+
+// fixture is a layer to run the detectors over.
+type fixture struct {
+	name string
+	// layer is the directory or the archive that holds the layer.
+	layer string
+	// golden is the path of the JSON file that holds the expected output.
+	golden string
+}
+
+// Namespace is the golden output of a namespace detector. A fixture where the detector should not
+// find any namespace has a null golden output.
+type Namespace struct {
+	Name          string
+	VersionFormat string `json:",omitempty"`
+}
+
+// Feature is an entry of the golden output of a features detector, which is a list of them.
+type Feature struct {
+	Name          string
+	Version       string
+	Namespace     string `json:",omitempty"`
+	VersionFormat string `json:",omitempty"`
+}
+
+func (f Feature) String() string {
+	if f.Namespace == "" {
+		return f.Name + " " + f.Version
+	}
+	return fmt.Sprintf("%s %s (%s)", f.Name, f.Version, f.Namespace)
+}
+
+// RunNamespaceDetectorTests runs the detector over each fixture of the directory and compares the
+// namespace it detects with the golden output. It also verifies that the detector only depends on
+// the files designated by GetRequiredFiles.
+func RunNamespaceDetectorTests(t *testing.T, detector detectors.NamespaceDetector, dir string) {
+	fixtures, err := loadFixtures(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, f := range fixtures {
+		f := f
+		t.Run(f.name, func(t *testing.T) {
+			detected, problems := checkNamespaceDetector(detector, f)
+			if *update {
+				writeGolden(t, f, detected)
+			} else {
+				var expected *Namespace
+				if err := readGolden(f, &expected); err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(expected, detected) {
+					problems = append(problems, fmt.Sprintf("detected namespace %s, expected %s", describeNamespace(detected), describeNamespace(expected)))
+				}
+			}
+			for _, problem := range problems {
+				t.Error(problem)
+			}
+		})
+	}
+}
+
+// RunFeaturesDetectorTests runs the detector over each fixture of the directory and compares the
+// features it detects with the golden output, reporting the unexpected and the missing ones. It
+// also verifies that the detector only depends on the files designated by GetRequiredFiles.
+func RunFeaturesDetectorTests(t *testing.T, detector detectors.FeaturesDetector, dir string) {
+	fixtures, err := loadFixtures(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, f := range fixtures {
+		f := f
+		t.Run(f.name, func(t *testing.T) {
+			detected, problems := checkFeaturesDetector(detector, f)
+			if *update {
+				writeGolden(t, f, detected)
+			} else {
+				var expected []Feature
+				if err := readGolden(f, &expected); err != nil {
+					t.Fatal(err)
+				}
+				problems = append(problems, diffFeatures(expected, detected)...)
+			}
+			for _, problem := range problems {
+				t.Error(problem)
+			}
+		})
+	}
+}
+
+// checkNamespaceDetector returns the namespace that the detector finds in the required files of
+// the fixture, and the problems found along the way.
+func checkNamespaceDetector(detector detectors.NamespaceDetector, f fixture) (*Namespace, []string) {
+	required, all, err := f.data(detector.GetRequiredFiles())
+	if err != nil {
+		return nil, []string{err.Error()}
+	}
+
+	detected := newNamespace(detector.Detect(required))
+	var problems []string
+	if fromAll := newNamespace(detector.Detect(all)); !reflect.DeepEqual(fromAll, detected) {
+		problems = append(problems, fmt.Sprintf("detected namespace %s from the required files but %s from the whole layer: %s",
+			describeNamespace(detected), describeNamespace(fromAll), undeclaredFiles(required, all)))
+	}
+	return detected, problems
+}
+
+// checkFeaturesDetector returns the sorted features that the detector finds in the required
+// files of the fixture, and the problems found along the way.
+func checkFeaturesDetector(detector detectors.FeaturesDetector, f fixture) ([]Feature, []string) {
+	required, all, err := f.data(detector.GetRequiredFiles())
+	if err != nil {
+		return nil, []string{err.Error()}
+	}
+
+	featureVersions, err := detector.Detect(required)
+	if err != nil {
+		return nil, []string{fmt.Sprintf("could not detect the features: %s", err)}
+	}
+	detected := newFeatures(featureVersions)
+
+	var problems []string
+	featureVersions, err = detector.Detect(all)
+	if err != nil {
+		problems = append(problems, fmt.Sprintf("could not detect the features of the whole layer: %s: %s", err, undeclaredFiles(required, all)))
+	} else if diff := diffFeatures(detected, newFeatures(featureVersions)); len(diff) > 0 {
+		problems = append(problems, fmt.Sprintf("the features detected from the whole layer differ from the ones of the required files: %s\n%s",
+			undeclaredFiles(required, all), strings.Join(diff, "\n")))
+	}
+	return detected, problems
+}
+
+func newNamespace(namespace *database.Namespace) *Namespace {
+	if namespace == nil {
+		return nil
+	}
+	return &Namespace{Name: namespace.Name, VersionFormat: string(namespace.VersionFormat)}
+}
+
+func describeNamespace(namespace *Namespace) string {
+	if namespace == nil {
+		return "none"
+	}
+	if namespace.VersionFormat == "" {
+		return fmt.Sprintf("%q", namespace.Name)
+	}
+	return fmt.Sprintf("%q (%s)", namespace.Name, namespace.VersionFormat)
+}
+
+// newFeatures returns the golden form of the feature versions, sorted by namespace, name and
+// version.
+func newFeatures(featureVersions []database.FeatureVersion) []Feature {
+	features := make([]Feature, 0, len(featureVersions))
+	for _, fv := range featureVersions {
+		features = append(features, Feature{
+			Name:          fv.Feature.Name,
+			Version:       fv.Version.String(),
+			Namespace:     fv.Feature.Namespace.Name,
+			VersionFormat: string(fv.Feature.Namespace.VersionFormat),
+		})
+	}
+	sort.Slice(features, func(i, j int) bool {
+		a, b := features[i], features[j]
+		if a.Namespace != b.Namespace {
+			return a.Namespace < b.Namespace
+		}
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+		return a.Version < b.Version
+	})
+	return features
+}
+
+// diffFeatures returns the messages that describe the features detected unexpectedly, those that
+// are missing and those detected more than once.
+func diffFeatures(expected, detected []Feature) []string {
+	count := make(map[Feature]int)
+	for _, f := range expected {
+		count[f]++
+	}
+	var unexpected, duplicated []string
+	seen := make(map[Feature]bool)
+	for _, f := range detected {
+		switch {
+		case count[f] > 0:
+			count[f]--
+		case seen[f]:
+			duplicated = append(duplicated, f.String())
+		default:
+			unexpected = append(unexpected, f.String())
+		}
+		seen[f] = true
+	}
+	var missing []string
+	for _, f := range expected {
+		if count[f] > 0 {
+			missing = append(missing, f.String())
+			count[f] = 0
+		}
+	}
+
+	var diff []string
+	for _, d := range []struct {
+		what     string
+		features []string
+	}{
+		{"unexpected features", unexpected},
+		{"missing features", missing},
+		{"features detected more than once", duplicated},
+	} {
+		if len(d.features) > 0 {
+			diff = append(diff, fmt.Sprintf("%s:\n\t%s", d.what, strings.Join(d.features, "\n\t")))
+		}
+	}
+	return diff
+}
+
+// undeclaredFiles describes the files of the layer that GetRequiredFiles doesn't designate, as
+// the detector depends on some of them.
+func undeclaredFiles(required, all map[string][]byte) string {
+	var files []string
+	for filename := range all {
+		if _, ok := required[filename]; !ok {
+			files = append(files, filename)
+		}
+	}
+	sort.Strings(files)
+	return fmt.Sprintf("the detector reads files that GetRequiredFiles doesn't designate, among %s", strings.Join(files, ", "))
+}
+
+// loadFixtures returns the fixtures of the directory, sorted by name.
+func loadFixtures(dir string) ([]fixture, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("could not list the fixtures: %s", err)
+	}
+
+	var fixtures []fixture
+	goldens := make(map[string]bool)
+	for _, entry := range entries {
+		name := entry.Name()
+		switch {
+		case entry.IsDir():
+		case strings.HasSuffix(name, ".json"):
+			goldens[strings.TrimSuffix(name, ".json")] = true
+			continue
+		case strings.HasSuffix(name, ".tar"):
+			name = strings.TrimSuffix(name, ".tar")
+		case strings.HasSuffix(name, ".tar.gz"):
+			name = strings.TrimSuffix(name, ".tar.gz")
+		default:
+			return nil, fmt.Errorf("%s is neither a layer nor a golden output", filepath.Join(dir, name))
+		}
+
+		fixtures = append(fixtures, fixture{
+			name:   name,
+			layer:  filepath.Join(dir, entry.Name()),
+			golden: filepath.Join(dir, name+".json"),
+		})
+	}
+
+	for _, f := range fixtures {
+		delete(goldens, f.name)
+	}
+	for name := range goldens {
+		return nil, fmt.Errorf("the golden output %s has no layer", filepath.Join(dir, name+".json"))
+	}
+
+	sort.Slice(fixtures, func(i, j int) bool { return fixtures[i].name < fixtures[j].name })
+	return fixtures, nil
+}
+
+// data extracts the layer of the fixture, as the worker does: the first map only holds the files
+// that the patterns designate, and the other holds every file of the layer.
+func (f fixture) data(toExtract []string) (required, all map[string][]byte, err error) {
+	var archive []byte
+	if info, err := os.Stat(f.layer); err != nil {
+		return nil, nil, err
+	} else if info.IsDir() {
+		archive, err = archiveDirectory(f.layer)
+		if err != nil {
+			return nil, nil, fmt.Errorf("could not archive %s: %s", f.layer, err)
+		}
+	} else if archive, err = ioutil.ReadFile(f.layer); err != nil {
+		return nil, nil, err
+	}
+
+	required, err = utils.SelectivelyExtractArchive(bytes.NewReader(archive), "", toExtract, utils.ExtractionLimits{})
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not extract %s: %s", f.layer, err)
+	}
+	all, err = utils.SelectivelyExtractArchive(bytes.NewReader(archive), "", []string{""}, utils.ExtractionLimits{})
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not extract %s: %s", f.layer, err)
+	}
+	return required, all, nil
+}
+
+// archiveDirectory returns a tar archive of the content of the directory, whose files keep their
+// mode, and whose symbolic links are stored as such.
+func archiveDirectory(dir string) ([]byte, error) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || path == dir {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+
+		var link string
+		if info.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(path); err != nil {
+				return err
+			}
+		}
+		hdr, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(rel)
+		if info.IsDir() {
+			hdr.Name += "/"
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		_, err = tw.Write(content)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func readGolden(f fixture, v interface{}) error {
+	content, err := ioutil.ReadFile(f.golden)
+	if err != nil {
+		return fmt.Errorf("could not read the golden output, run the tests with -update to create it: %s", err)
+	}
+	if err := json.Unmarshal(content, v); err != nil {
+		return fmt.Errorf("could not parse %s: %s", f.golden, err)
+	}
+	return nil
+}
+
+func writeGolden(t *testing.T, f fixture, v interface{}) {
+	content, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(f.golden, append(content, '\n'), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,141 @@
+// Copyright 2015 clair authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package testutil
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/coreos/clair/database"
+	"github.com/coreos/clair/utils/types"
+)
+
+// releaseDetector detects the namespace named in etc/release. The sloppy one also reads
+// usr/share/release/override without requiring it.
+type releaseDetector struct {
+	sloppy bool
+}
+
+func (d *releaseDetector) Detect(data map[string][]byte) *database.Namespace {
+	name := strings.TrimSpace(string(data["etc/release"]))
+	if override, ok := data["usr/share/release/override"]; ok && d.sloppy {
+		name = strings.TrimSpace(string(override))
+	}
+	if name == "" {
+		return nil
+	}
+	return &database.Namespace{Name: name, VersionFormat: types.DpkgVersionFormat}
+}
+
+func (d *releaseDetector) GetRequiredFiles() []string {
+	return []string{"etc/release"}
+}
+
+func writeFixtureFiles(t *testing.T, dir string, files map[string]string) {
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestLoadFixtures(t *testing.T) {
+	dir, err := ioutil.TempDir("", "clair-testutil")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// A layer stored as a directory and another one as an archive.
+	writeFixtureFiles(t, dir, map[string]string{
+		"debian/etc/release":       "debian:8\n",
+		"debian/var/lib/.wh.cache": "",
+		"debian.json":              `{"Name": "debian:8", "VersionFormat": "dpkg"}`,
+		"ubuntu.json":              `{"Name": "ubuntu:16.04", "VersionFormat": "dpkg"}`,
+	})
+	var archive bytes.Buffer
+	tw := tar.NewWriter(&archive)
+	for name, content := range map[string]string{"etc/release": "ubuntu:16.04\n", "usr/share/release/override": "ubuntu:18.04\n"} {
+		tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg})
+		tw.Write([]byte(content))
+	}
+	tw.Close()
+	if err := ioutil.WriteFile(filepath.Join(dir, "ubuntu.tar"), archive.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	fixtures, err := loadFixtures(dir)
+	if !assert.Nil(t, err) || !assert.Len(t, fixtures, 2) {
+		return
+	}
+	assert.Equal(t, "debian", fixtures[0].name)
+	assert.Equal(t, "ubuntu", fixtures[1].name)
+
+	required, all, err := fixtures[0].data([]string{"etc/release"})
+	if assert.Nil(t, err) {
+		assert.Equal(t, map[string][]byte{"etc/release": []byte("debian:8\n")}, required)
+		assert.Equal(t, map[string][]byte{"etc/release": []byte("debian:8\n"), "var/lib/.wh.cache": nil}, all)
+	}
+
+	// The namespace detected from the required files matches the golden outputs.
+	for _, f := range fixtures {
+		detected, problems := checkNamespaceDetector(&releaseDetector{}, f)
+		assert.Empty(t, problems)
+		var expected *Namespace
+		if assert.Nil(t, readGolden(f, &expected)) {
+			assert.Equal(t, expected, detected)
+		}
+	}
+
+	// The sloppy detector reads a file of the archive that it doesn't require.
+	_, problems := checkNamespaceDetector(&releaseDetector{sloppy: true}, fixtures[1])
+	if assert.Len(t, problems, 1) {
+		assert.Contains(t, problems[0], "usr/share/release/override")
+	}
+
+	// Golden outputs need a layer, and the other files are rejected.
+	writeFixtureFiles(t, dir, map[string]string{"alpine.json": "null"})
+	_, err = loadFixtures(dir)
+	assert.NotNil(t, err)
+	os.Remove(filepath.Join(dir, "alpine.json"))
+	writeFixtureFiles(t, dir, map[string]string{"README": ""})
+	_, err = loadFixtures(dir)
+	assert.NotNil(t, err)
+}
+
+func TestDiffFeatures(t *testing.T) {
+	zlib := Feature{Name: "zlib", Version: "1.2.8-r2"}
+	musl := Feature{Name: "musl", Version: "1.1.14-r10"}
+	rack := Feature{Name: "rack", Version: "2.0.4", Namespace: "ruby"}
+	openssl := Feature{Name: "openssl", Version: "1.0.2h-r1"}
+
+	assert.Empty(t, diffFeatures([]Feature{zlib, musl}, []Feature{musl, zlib}))
+	assert.Equal(t, []string{
+		"unexpected features:\n\track 2.0.4 (ruby)",
+		"missing features:\n\topenssl 1.0.2h-r1",
+		"features detected more than once:\n\tzlib 1.2.8-r2",
+	}, diffFeatures([]Feature{zlib, musl, openssl}, []Feature{musl, zlib, rack, zlib}))
+}
@@ -0,0 +1,191 @@
+// Copyright 2015 clair authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package worker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/coreos/clair/database"
+	cerrors "github.com/coreos/clair/utils/errors"
+	"github.com/coreos/clair/worker/detectors"
+)
+
+const (
+	// MediaTypeDockerManifest is the media type of the Docker image manifests, schema 2.
+	MediaTypeDockerManifest = "application/vnd.docker.distribution.manifest.v2+json"
+	// MediaTypeOCIManifest is the media type of the OCI image manifests.
+	MediaTypeOCIManifest = "application/vnd.oci.image.manifest.v1+json"
+
+	// manifestLayerFormat is the format of the layers listed by the manifests, which the Docker data
+	// detector reads, whatever their compression.
+	manifestLayerFormat = "Docker"
+)
+
+var (
+	// layerMediaTypes are the media types of the layers that can be analyzed. The foreign and
+	// non-distributable layers may be downloaded from the URLs of their descriptor.
+	layerMediaTypes = map[string]struct{}{
+		"application/vnd.docker.image.rootfs.diff.tar.gzip":            {},
+		"application/vnd.docker.image.rootfs.foreign.diff.tar.gzip":    {},
+		"application/vnd.oci.image.layer.v1.tar":                       {},
+		"application/vnd.oci.image.layer.v1.tar+gzip":                  {},
+		"application/vnd.oci.image.layer.v1.tar+zstd":                  {},
+		"application/vnd.oci.image.layer.nondistributable.v1.tar":      {},
+		"application/vnd.oci.image.layer.nondistributable.v1.tar+gzip": {},
+		"application/vnd.oci.image.layer.nondistributable.v1.tar+zstd": {},
+	}
+
+	// emptyLayerDigests are the digests of the layers without any file, which Docker adds for the
+	// instructions that don't change the filesystem: the 32 bytes gzipped empty tar archive, and the
+	// empty tar archive itself. They are shared by unrelated images, and therefore not stored.
+	emptyLayerDigests = map[string]struct{}{
+		"sha256:a3ed95caeb02ffe68cdd9fd84406680ae93d633cb16422d00e8a7c22955b46d4": {},
+		"sha256:5f70bf18a086007016e948b04aed3b82103a36bea41755b6cddfaf10ace3c6ef": {},
+	}
+
+	// repositoryRegexp matches the names of the repositories of a registry.
+	repositoryRegexp = regexp.MustCompile(`^[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*(?:/[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*)*$`)
+)
+
+// manifest is an OCI image manifest or a Docker image manifest, schema 2, which share the same
+// structure.
+type manifest struct {
+	SchemaVersion int          `json:"schemaVersion"`
+	MediaType     string       `json:"mediaType"`
+	Layers        []descriptor `json:"layers"`
+}
+
+// descriptor describes a blob of a manifest.
+type descriptor struct {
+	MediaType string   `json:"mediaType"`
+	Size      int64    `json:"size"`
+	Digest    string   `json:"digest"`
+	URLs      []string `json:"urls"`
+}
+
+// ManifestLayer is a layer listed by an image manifest. It is named by its digest.
+type ManifestLayer struct {
+	Name string
+
+	// Paths are the URLs the layer may be downloaded from, in order: the URLs of a foreign layer,
+	// and then its blob in the registry.
+	Paths []string
+}
+
+// ManifestLayerError is returned by ProcessManifest when a layer of the manifest could not be
+// processed, the layers that follow it being skipped.
+type ManifestLayerError struct {
+	Name string
+	Err  error
+}
+
+func (e *ManifestLayerError) Error() string {
+	return fmt.Sprintf("layer %s: %s", e.Name, e.Err)
+}
+
+// ParseManifest returns the layers of the image described by the given OCI image manifest or
+// Docker image manifest, schema 2, from the base layer to the leaf. The empty layers are left out.
+// The blobs are located in the given repository of the registry at registryURL, such as
+// "https://registry-1.docker.io" and "library/debian".
+func ParseManifest(content []byte, registryURL, repository string) ([]ManifestLayer, error) {
+	u, err := url.Parse(registryURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, cerrors.NewBadRequestError("the registry is not an HTTP(S) URL")
+	}
+	if !repositoryRegexp.MatchString(repository) {
+		return nil, cerrors.NewBadRequestError("the repository name is invalid")
+	}
+	blobsURL := strings.TrimSuffix(registryURL, "/") + "/v2/" + repository + "/blobs/"
+
+	var m manifest
+	if err := json.Unmarshal(content, &m); err != nil {
+		return nil, cerrors.NewBadRequestError("could not parse the manifest: " + err.Error())
+	}
+	if m.SchemaVersion != 2 || (m.MediaType != "" && m.MediaType != MediaTypeDockerManifest && m.MediaType != MediaTypeOCIManifest) {
+		return nil, cerrors.NewBadRequestError("the manifest is neither an OCI image manifest nor a Docker image manifest, schema 2")
+	}
+
+	var layers []ManifestLayer
+	for i, d := range m.Layers {
+		if !detectors.ValidDigest(d.Digest) {
+			return nil, cerrors.NewBadRequestError(fmt.Sprintf("layer %d does not have a sha256 digest", i))
+		}
+		if _, supported := layerMediaTypes[d.MediaType]; !supported {
+			return nil, cerrors.NewBadRequestError(fmt.Sprintf("layer %s has an unsupported media type: %q", d.Digest, d.MediaType))
+		}
+		if _, empty := emptyLayerDigests[d.Digest]; empty {
+			continue
+		}
+
+		layer := ManifestLayer{Name: d.Digest}
+		for _, u := range d.URLs {
+			if strings.HasPrefix(u, "http://") || strings.HasPrefix(u, "https://") {
+				layer.Paths = append(layer.Paths, u)
+			}
+		}
+		layer.Paths = append(layer.Paths, blobsURL+d.Digest)
+		layers = append(layers, layer)
+	}
+	if len(layers) == 0 {
+		return nil, cerrors.NewBadRequestError("the manifest does not have any layer")
+	}
+	return layers, nil
+}
+
+// ProcessManifest processes the layers of the image described by the given manifest, see
+// ParseManifest, from the base layer to the leaf. Their content is verified against their digest.
+// It returns the names of the layers, and stops at the first failure with a ManifestLayerError,
+// except ErrCouldNotFindNamespace, as the layer is stored nonetheless.
+//
+// The headers are only sent to the registry, not to the URLs of the foreign layers.
+func ProcessManifest(ctx context.Context, datastore database.Datastore, manifest []byte, registryURL, repository string, headers map[string]string) ([]string, error) {
+	layers, err := ParseManifest(manifest, registryURL, repository)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, len(layers))
+	for i, layer := range layers {
+		names[i] = layer.Name
+	}
+
+	var parentName string
+	for _, layer := range layers {
+		// Try the URLs of the layer in order, until one of them can be downloaded.
+		for i, path := range layer.Paths {
+			var pathHeaders map[string]string
+			if i == len(layer.Paths)-1 {
+				pathHeaders = headers
+			}
+
+			err = process(ctx, datastore, manifestLayerFormat, layer.Name, parentName, path, layer.Name, pathHeaders, nil)
+			if _, downloadErr := err.(*ErrCouldNotDownload); !downloadErr && err != detectors.ErrCouldNotFindLayer {
+				break
+			}
+		}
+		if err == ErrCouldNotFindNamespace {
+			log.Warningf("layer %s: %s", layer.Name, err)
+		} else if err != nil {
+			return names, &ManifestLayerError{Name: layer.Name, Err: err}
+		}
+		parentName = layer.Name
+	}
+	return names, nil
+}
@@ -0,0 +1,198 @@
+// Copyright 2015 clair authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package worker
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/coreos/clair/database"
+	cerrors "github.com/coreos/clair/utils/errors"
+	"github.com/coreos/clair/utils/types"
+	"github.com/coreos/clair/worker/detectors"
+)
+
+const (
+	testRegistryToken = "Bearer registry-token"
+	emptyLayerDigest  = "sha256:a3ed95caeb02ffe68cdd9fd84406680ae93d633cb16422d00e8a7c22955b46d4"
+)
+
+// newFakeRegistry serves the given blobs, by digest, in the test/app repository. It requires
+// testRegistryToken.
+func newFakeRegistry(blobs map[string][]byte) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != testRegistryToken {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		blob, ok := blobs[strings.TrimPrefix(r.URL.Path, "/v2/test/app/blobs/")]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write(blob)
+	}))
+}
+
+// loadTestBlob returns the content and the digest of the given layer of the DistUpgrade test data.
+func loadTestBlob(t *testing.T, name string) ([]byte, string) {
+	_, f, _, _ := runtime.Caller(0)
+	blob, err := ioutil.ReadFile(filepath.Join(filepath.Dir(f), "testdata", "DistUpgrade", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return blob, fmt.Sprintf("sha256:%x", sha256.Sum256(blob))
+}
+
+func newManifestDatastore() *mockDatastore {
+	datastore := newMockDatastore()
+	datastore.FctInsertLayer = func(ctx context.Context, layer database.Layer) error {
+		datastore.layers[layer.Name] = layer
+		return nil
+	}
+	datastore.FctFindLayer = func(ctx context.Context, name string, withFeatures, withVulnerabilities bool, minSeverity types.Priority) (database.Layer, error) {
+		if layer, exists := datastore.layers[name]; exists {
+			return layer, nil
+		}
+		return database.Layer{}, cerrors.ErrNotFound
+	}
+	return datastore
+}
+
+func testManifest(mediaType string, layers ...string) []byte {
+	return []byte(fmt.Sprintf(`{"schemaVersion": 2, "mediaType": %q, "config": {"mediaType": "application/vnd.oci.image.config.v1+json", "digest": "sha256:0123", "size": 2}, "layers": [%s]}`,
+		mediaType, strings.Join(layers, ",")))
+}
+
+func testDescriptor(mediaType, digest string, urls ...string) string {
+	d := fmt.Sprintf(`{"mediaType": %q, "digest": %q, "size": 1`, mediaType, digest)
+	if len(urls) > 0 {
+		d += `, "urls": ["` + strings.Join(urls, `", "`) + `"]`
+	}
+	return d + "}"
+}
+
+func TestProcessManifest(t *testing.T) {
+	blank, blankDigest := loadTestBlob(t, "blank.tar.gz")
+	wheezy, wheezyDigest := loadTestBlob(t, "wheezy.tar.gz")
+	registry := newFakeRegistry(map[string][]byte{blankDigest: blank, wheezyDigest: wheezy})
+	defer registry.Close()
+
+	for _, mediaType := range []string{MediaTypeDockerManifest, MediaTypeOCIManifest} {
+		layerMediaType := "application/vnd.docker.image.rootfs.diff.tar.gzip"
+		if mediaType == MediaTypeOCIManifest {
+			layerMediaType = "application/vnd.oci.image.layer.v1.tar+gzip"
+		}
+		manifest := testManifest(mediaType,
+			testDescriptor(layerMediaType, blankDigest),
+			testDescriptor(layerMediaType, emptyLayerDigest),
+			testDescriptor(layerMediaType, wheezyDigest),
+		)
+
+		// The layers are named by digest, the empty one being skipped.
+		datastore := newManifestDatastore()
+		names, err := ProcessManifest(context.Background(), datastore, manifest, registry.URL, "test/app", map[string]string{"Authorization": testRegistryToken})
+		assert.Nil(t, err, mediaType)
+		assert.Equal(t, []string{blankDigest, wheezyDigest}, names, mediaType)
+
+		top, err := datastore.FindLayer(context.Background(), wheezyDigest, false, false, types.Unknown)
+		if assert.Nil(t, err, mediaType) {
+			assert.Equal(t, "debian:7", top.Namespace.Name)
+			if assert.NotNil(t, top.Parent) {
+				assert.Equal(t, blankDigest, top.Parent.Name)
+			}
+		}
+		assert.NotContains(t, datastore.layers, emptyLayerDigest)
+	}
+}
+
+func TestProcessManifestForeignLayer(t *testing.T) {
+	blank, blankDigest := loadTestBlob(t, "blank.tar.gz")
+	wheezy, wheezyDigest := loadTestBlob(t, "wheezy.tar.gz")
+	registry := newFakeRegistry(map[string][]byte{wheezyDigest: wheezy})
+	defer registry.Close()
+
+	// The foreign layer is downloaded from its URL, without the credentials of the registry.
+	var foreignAuthorization string
+	foreign := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		foreignAuthorization = r.Header.Get("Authorization")
+		w.Write(blank)
+	}))
+	defer foreign.Close()
+
+	manifest := testManifest(MediaTypeDockerManifest,
+		testDescriptor("application/vnd.docker.image.rootfs.foreign.diff.tar.gzip", blankDigest, foreign.URL+"/base.tar.gz"),
+		testDescriptor("application/vnd.docker.image.rootfs.diff.tar.gzip", wheezyDigest),
+	)
+
+	datastore := newManifestDatastore()
+	_, err := ProcessManifest(context.Background(), datastore, manifest, registry.URL, "test/app", map[string]string{"Authorization": testRegistryToken})
+	assert.Nil(t, err)
+	assert.Empty(t, foreignAuthorization)
+	assert.Contains(t, datastore.layers, blankDigest)
+	assert.Contains(t, datastore.layers, wheezyDigest)
+}
+
+func TestProcessManifestDigestMismatch(t *testing.T) {
+	_, blankDigest := loadTestBlob(t, "blank.tar.gz")
+	wheezy, wheezyDigest := loadTestBlob(t, "wheezy.tar.gz")
+
+	// The registry serves the wrong content for the base layer.
+	registry := newFakeRegistry(map[string][]byte{blankDigest: wheezy, wheezyDigest: wheezy})
+	defer registry.Close()
+
+	manifest := testManifest(MediaTypeOCIManifest,
+		testDescriptor("application/vnd.oci.image.layer.v1.tar+gzip", blankDigest),
+		testDescriptor("application/vnd.oci.image.layer.v1.tar+gzip", wheezyDigest),
+	)
+
+	datastore := newManifestDatastore()
+	names, err := ProcessManifest(context.Background(), datastore, manifest, registry.URL, "test/app", map[string]string{"Authorization": testRegistryToken})
+	assert.Equal(t, []string{blankDigest, wheezyDigest}, names)
+	assert.Equal(t, &ManifestLayerError{Name: blankDigest, Err: detectors.ErrDigestMismatch}, err)
+	assert.Empty(t, datastore.layers)
+}
+
+func TestParseManifestInvalid(t *testing.T) {
+	_, digest := loadTestBlob(t, "blank.tar.gz")
+	layer := testDescriptor("application/vnd.oci.image.layer.v1.tar+gzip", digest)
+
+	for _, test := range []struct {
+		manifest                []byte
+		registryURL, repository string
+	}{
+		{[]byte("not json"), "https://registry", "app"},
+		{testManifest("application/vnd.oci.image.index.v1+json", layer), "https://registry", "app"},
+		{testManifest(MediaTypeOCIManifest, testDescriptor("application/vnd.oci.image.layer.v1.tar+gzip", "sha512:0123")), "https://registry", "app"},
+		{testManifest(MediaTypeOCIManifest, testDescriptor("application/vnd.cncf.helm.chart.content.v1.tar+gzip", digest)), "https://registry", "app"},
+		{testManifest(MediaTypeOCIManifest, testDescriptor("application/vnd.oci.image.layer.v1.tar+gzip", emptyLayerDigest)), "https://registry", "app"},
+		{testManifest(MediaTypeOCIManifest, layer), "file:///registry", "app"},
+		{testManifest(MediaTypeOCIManifest, layer), "https://registry", "../app"},
+	} {
+		_, err := ParseManifest(test.manifest, test.registryURL, test.repository)
+		_, badRequest := err.(*cerrors.ErrBadRequest)
+		assert.True(t, badRequest, "%s %s %s", test.manifest, test.registryURL, test.repository)
+	}
+}
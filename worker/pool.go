@@ -0,0 +1,158 @@
+// Copyright 2015 clair authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package worker
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// DefaultConcurrency is the number of layers analyzed simultaneously, unless SetConcurrency
+	// is called.
+	DefaultConcurrency = 4
+
+	// DefaultQueueSize is the number of layers that may wait for their analysis, unless
+	// SetConcurrency is called.
+	DefaultQueueSize = 64
+)
+
+var (
+	// ErrQueueFull is the error that should be raised when a layer can't be analyzed because too
+	// many layers are already being analyzed or waiting for it.
+	ErrQueueFull = errors.New("worker: too many layers are being analyzed, retry later")
+
+	// analyses bounds the layers analyzed simultaneously.
+	analyses = newPool(DefaultConcurrency, DefaultQueueSize)
+
+	promQueuedLayers = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "clair_worker_queued_layers",
+		Help: "Number of layers waiting for their analysis.",
+	})
+
+	promAnalyzedLayers = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "clair_worker_analyzed_layers",
+		Help: "Number of layers being analyzed.",
+	})
+
+	promRejectedLayersTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "clair_worker_rejected_layers_total",
+		Help: "Number of layers whose analysis was refused because the queue was full.",
+	})
+
+	promStageDurationSeconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "clair_worker_stage_duration_seconds",
+		Help:    "Time spent by the layers in each stage of their processing: queue, extraction (which includes the download), detection and storage.",
+		Buckets: prometheus.ExponentialBuckets(0.01, 4, 10),
+	}, []string{"stage"})
+)
+
+func init() {
+	prometheus.MustRegister(promQueuedLayers)
+	prometheus.MustRegister(promAnalyzedLayers)
+	prometheus.MustRegister(promRejectedLayersTotal)
+	prometheus.MustRegister(promStageDurationSeconds)
+}
+
+// SetConcurrency sets the number of layers analyzed simultaneously, and the number of layers
+// that may wait for their turn, beyond which Process fails with ErrQueueFull. A zero value means
+// no limit. It must be called before any layer is processed.
+func SetConcurrency(concurrency, queueSize int) {
+	analyses = newPool(concurrency, queueSize)
+}
+
+// pool bounds the number of simultaneous analyses, which download and extract the layers, and of
+// the analyses waiting for their turn.
+type pool struct {
+	slots     chan struct{}
+	queueSize int
+
+	mu     sync.Mutex
+	queued int
+}
+
+func newPool(concurrency, queueSize int) *pool {
+	p := &pool{queueSize: queueSize}
+	if concurrency > 0 {
+		p.slots = make(chan struct{}, concurrency)
+	}
+	return p
+}
+
+// acquire waits for the turn of an analysis, which must call the returned function once it is
+// done. It fails with ErrQueueFull when too many analyses are waiting already, or with the error
+// of the context if it is done first.
+func (p *pool) acquire(ctx context.Context) (release func(), err error) {
+	start := time.Now()
+	release = func() {
+		if p.slots != nil {
+			<-p.slots
+		}
+		promAnalyzedLayers.Dec()
+	}
+
+	if p.slots == nil {
+		promAnalyzedLayers.Inc()
+		observeStage("queue", start)
+		return release, nil
+	}
+
+	// Start right away when possible.
+	select {
+	case p.slots <- struct{}{}:
+		promAnalyzedLayers.Inc()
+		observeStage("queue", start)
+		return release, nil
+	default:
+	}
+
+	// Otherwise, wait in the queue, if it isn't full.
+	p.mu.Lock()
+	if p.queueSize > 0 && p.queued >= p.queueSize {
+		p.mu.Unlock()
+		promRejectedLayersTotal.Inc()
+		return nil, ErrQueueFull
+	}
+	p.queued++
+	p.mu.Unlock()
+	promQueuedLayers.Inc()
+
+	defer func() {
+		p.mu.Lock()
+		p.queued--
+		p.mu.Unlock()
+		promQueuedLayers.Dec()
+		observeStage("queue", start)
+	}()
+
+	select {
+	case p.slots <- struct{}{}:
+		promAnalyzedLayers.Inc()
+		return release, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// queueLength returns the number of analyses waiting for their turn.
+func (p *pool) queueLength() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.queued
+}
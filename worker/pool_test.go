@@ -0,0 +1,171 @@
+// Copyright 2015 clair authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package worker
+
+import (
+	"context"
+	"io"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/coreos/clair/database"
+	"github.com/coreos/clair/utils"
+	cerrors "github.com/coreos/clair/utils/errors"
+	"github.com/coreos/clair/utils/types"
+	"github.com/coreos/clair/worker/detectors"
+)
+
+// poolDataDetector extracts the layers of the Pool format, which it holds until it is released,
+// while counting the simultaneous extractions.
+type poolDataDetector struct {
+	mu       sync.Mutex
+	current  int
+	max      int
+	started  chan struct{}
+	released chan struct{}
+}
+
+var poolDetector = &poolDataDetector{started: make(chan struct{}, 100), released: make(chan struct{})}
+
+func (d *poolDataDetector) Supported(path string, format string) bool {
+	return format == "Pool"
+}
+
+func (d *poolDataDetector) Detect(layerReader io.ReadCloser, toExtract []string, limits utils.ExtractionLimits) (map[string][]byte, error) {
+	d.mu.Lock()
+	d.current++
+	if d.current > d.max {
+		d.max = d.current
+	}
+	d.mu.Unlock()
+
+	d.started <- struct{}{}
+	<-d.released
+
+	d.mu.Lock()
+	d.current--
+	d.mu.Unlock()
+	return map[string][]byte{}, nil
+}
+
+func init() {
+	detectors.RegisterDataDetector("Pool", poolDetector)
+}
+
+func newPoolDatastore() database.Datastore {
+	var mu sync.Mutex
+	datastore := newMockDatastore()
+	datastore.FctInsertLayer = func(ctx context.Context, layer database.Layer) error {
+		mu.Lock()
+		defer mu.Unlock()
+		datastore.layers[layer.Name] = layer
+		return nil
+	}
+	datastore.FctFindLayer = func(ctx context.Context, name string, withFeatures, withVulnerabilities bool, minSeverity types.Priority) (database.Layer, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if layer, exists := datastore.layers[name]; exists {
+			return layer, nil
+		}
+		return database.Layer{}, cerrors.ErrNotFound
+	}
+	return datastore
+}
+
+func TestProcessConcurrency(t *testing.T) {
+	_, f, _, _ := runtime.Caller(0)
+	testDataPath := filepath.Join(filepath.Dir(f)) + "/testdata/DistUpgrade/"
+	datastore := newPoolDatastore()
+
+	SetConcurrency(2, 10)
+	defer SetConcurrency(DefaultConcurrency, DefaultQueueSize)
+
+	// Process more layers than the pool allows, and release them once the pool is full.
+	var wg sync.WaitGroup
+	errs := make([]error, 6)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = Process(context.Background(), datastore, "Pool", "layer"+strconv.Itoa(i), "", testDataPath+"blank.tar.gz", nil, []string{testDataPath})
+		}(i)
+	}
+	for range errs {
+		<-poolDetector.started
+		time.Sleep(10 * time.Millisecond)
+		poolDetector.released <- struct{}{}
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		assert.Nil(t, err)
+	}
+	assert.Equal(t, 2, poolDetector.max)
+}
+
+func TestProcessQueueFull(t *testing.T) {
+	_, f, _, _ := runtime.Caller(0)
+	testDataPath := filepath.Join(filepath.Dir(f)) + "/testdata/DistUpgrade/"
+	datastore := newPoolDatastore()
+
+	SetConcurrency(1, 1)
+	defer SetConcurrency(DefaultConcurrency, DefaultQueueSize)
+
+	process := func(name string, errs chan<- error) {
+		errs <- Process(context.Background(), datastore, "Pool", name, "", testDataPath+"blank.tar.gz", nil, []string{testDataPath})
+	}
+
+	// The first layer is analyzed and the second one waits.
+	errs := make(chan error, 2)
+	go process("analyzed", errs)
+	<-poolDetector.started
+	go process("queued", errs)
+	for analyses.queueLength() != 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// The third one is refused.
+	assert.Equal(t, ErrQueueFull, Process(context.Background(), datastore, "Pool", "refused", "", testDataPath+"blank.tar.gz", nil, []string{testDataPath}))
+
+	poolDetector.released <- struct{}{}
+	<-poolDetector.started
+	poolDetector.released <- struct{}{}
+	assert.Nil(t, <-errs)
+	assert.Nil(t, <-errs)
+}
+
+func TestPoolCanceled(t *testing.T) {
+	p := newPool(1, 1)
+	release, err := p.acquire(context.Background())
+	assert.Nil(t, err)
+
+	// An analysis that gives up waiting leaves the queue.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = p.acquire(ctx)
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.Equal(t, 0, p.queueLength())
+
+	release()
+	release, err = p.acquire(context.Background())
+	assert.Nil(t, err)
+	release()
+}
@@ -0,0 +1,173 @@
+// Copyright 2015 clair authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package worker
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/pborman/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/coreos/clair/config"
+	"github.com/coreos/clair/database"
+	"github.com/coreos/clair/utils"
+	cerrors "github.com/coreos/clair/utils/errors"
+)
+
+const (
+	reindexLockName            = "reindexer"
+	reindexLockDuration        = reindexRefreshLockDuration + time.Minute*2
+	reindexRefreshLockDuration = time.Minute * 8
+
+	// reindexPageSize is the number of outdated layers listed at once.
+	reindexPageSize = 100
+
+	// reindexQueueFullDelay is the time the reindexer waits when the worker pool is busy, before
+	// submitting the same layer again.
+	reindexQueueFullDelay = 10 * time.Second
+)
+
+var promReindexedLayersTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "clair_worker_reindexed_layers_total",
+	Help: "Number of layers analyzed by an older engine that the reindexer processed, by result: reindexed, stale or failed.",
+}, []string{"result"})
+
+func init() {
+	prometheus.MustRegister(promReindexedLayersTotal)
+}
+
+// RunReindexer analyzes again, at startup, the layers that an older engine analyzed, see Reindex.
+// Only the instance that holds the reindexer lock does it.
+func RunReindexer(config *config.WorkerConfig, localPaths []string, datastore database.Datastore, st *utils.Stopper) {
+	defer st.End()
+
+	// Do not run the reindexer if there is no config or if the rate is 0.
+	if config == nil || config.ReindexRate <= 0 {
+		log.Infof("reindexer service is disabled.")
+		return
+	}
+
+	ctx := context.Background()
+	whoAmI := uuid.New()
+	if hasLock, _ := datastore.Lock(ctx, reindexLockName, whoAmI, reindexLockDuration, false); !hasLock {
+		log.Info("reindexer lock is already taken, another instance reindexes the layers")
+		return
+	}
+	defer datastore.Unlock(ctx, reindexLockName, whoAmI)
+
+	// Refresh the lock until the layers are reindexed.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(reindexRefreshLockDuration):
+				datastore.Lock(ctx, reindexLockName, whoAmI, reindexLockDuration, true)
+			}
+		}
+	}()
+
+	log.Infof("reindexer service started. lock identifier: %s", whoAmI)
+	interval := time.Duration(float64(time.Second) / config.ReindexRate)
+	reindexed, stale, err := Reindex(ctx, datastore, interval, localPaths, st.Chan())
+	if err != nil {
+		log.Errorf("reindexer service failed after reindexing %d layers: %s", reindexed, err)
+		return
+	}
+	log.Infof("reindexer service stopped: %d layers reindexed, %d stale", reindexed, stale)
+}
+
+// Reindex processes again the layers that an older engine analyzed, from the parents to their
+// children, waiting for the given interval before each of them. It returns early if stop is
+// closed.
+//
+// The layers whose archive can't be retrieved or analyzed anymore, such as the ones analyzed
+// before their path was recorded, are marked as stale. The ones that fail for another reason are
+// left for the next run.
+func Reindex(ctx context.Context, datastore database.Datastore, interval time.Duration, localPaths []string, stop <-chan struct{}) (reindexed, stale int, err error) {
+	for startAfterID := 0; ; {
+		layers, err := datastore.ListOutdatedLayers(ctx, Version, reindexPageSize, startAfterID)
+		if err != nil || len(layers) == 0 {
+			return reindexed, stale, err
+		}
+
+		for _, layer := range layers {
+			startAfterID = layer.ID
+
+			select {
+			case <-stop:
+				return reindexed, stale, nil
+			case <-time.After(interval):
+			}
+
+			err := reindexLayer(ctx, datastore, layer, localPaths, stop)
+			switch {
+			case err == nil || err == ErrCouldNotFindNamespace:
+				log.Debugf("layer %s: reindexed", layer.Name)
+				promReindexedLayersTotal.WithLabelValues("reindexed").Inc()
+				reindexed++
+			case isArchiveError(err):
+				log.Warningf("layer %s: could not be reindexed, marking it as stale: %s", layer.Name, err)
+				if err := datastore.MarkLayerStale(ctx, layer.Name); err != nil && err != cerrors.ErrNotFound {
+					return reindexed, stale, err
+				}
+				promReindexedLayersTotal.WithLabelValues("stale").Inc()
+				stale++
+			default:
+				log.Errorf("layer %s: could not be reindexed: %s", layer.Name, err)
+				promReindexedLayersTotal.WithLabelValues("failed").Inc()
+			}
+		}
+	}
+}
+
+// reindexLayer processes an outdated layer again, waiting for the pool to accept it.
+func reindexLayer(ctx context.Context, datastore database.Datastore, layer database.Layer, localPaths []string, stop <-chan struct{}) error {
+	var parentName string
+	if layer.Parent != nil {
+		parentName = layer.Parent.Name
+	}
+
+	for {
+		err := Process(ctx, datastore, layer.Format, layer.Name, parentName, layer.Path, nil, localPaths)
+		if err != ErrQueueFull {
+			return err
+		}
+
+		select {
+		case <-stop:
+			return err
+		case <-time.After(reindexQueueFullDelay):
+		}
+	}
+}
+
+// isArchiveError returns whether the processing of a layer failed because of its archive, which
+// can't be retrieved or analyzed, rather than because of a transient failure.
+func isArchiveError(err error) bool {
+	switch err {
+	case utils.ErrCouldNotExtract, utils.ErrExtractedFileTooBig, utils.ErrLayerTooLarge:
+		return true
+	}
+	if downloadErr, ok := err.(*ErrCouldNotDownload); ok {
+		return downloadErr.StatusCode == http.StatusNotFound || downloadErr.StatusCode == http.StatusGone
+	}
+	_, badRequest := err.(*cerrors.ErrBadRequest)
+	return badRequest
+}
@@ -0,0 +1,110 @@
+// Copyright 2015 clair authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package worker
+
+import (
+	"context"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/coreos/clair/database"
+	cerrors "github.com/coreos/clair/utils/errors"
+	"github.com/coreos/clair/utils/types"
+)
+
+func TestReindex(t *testing.T) {
+	_, f, _, _ := runtime.Caller(0)
+	testDataPath := filepath.Join(filepath.Dir(f)) + "/testdata/DistUpgrade/"
+
+	// Create a mock datastore, holding layers analyzed by an older engine.
+	var inserted []string
+	datastore := newMockDatastore()
+	datastore.FctInsertLayer = func(ctx context.Context, layer database.Layer) error {
+		inserted = append(inserted, layer.Name)
+		datastore.layers[layer.Name] = layer
+		return nil
+	}
+	datastore.FctFindLayer = func(ctx context.Context, name string, withFeatures, withVulnerabilities bool, minSeverity types.Priority) (database.Layer, error) {
+		if layer, exists := datastore.layers[name]; exists {
+			return layer, nil
+		}
+		return database.Layer{}, cerrors.ErrNotFound
+	}
+	datastore.FctListOutdatedLayers = func(ctx context.Context, engineVersion, limit, startAfterID int) ([]database.Layer, error) {
+		var layers []database.Layer
+		for _, layer := range datastore.layers {
+			if layer.ID > startAfterID && layer.EngineVersion < engineVersion && !layer.Stale {
+				layers = append(layers, layer)
+			}
+		}
+		sort.Slice(layers, func(i, j int) bool { return layers[i].ID < layers[j].ID })
+		if len(layers) > limit {
+			layers = layers[:limit]
+		}
+		return layers, nil
+	}
+	datastore.FctMarkLayerStale = func(ctx context.Context, name string) error {
+		layer, exists := datastore.layers[name]
+		if !exists {
+			return cerrors.ErrNotFound
+		}
+		layer.Stale = true
+		datastore.layers[name] = layer
+		return nil
+	}
+
+	base := database.Layer{Model: database.Model{ID: 1}, Name: "base", EngineVersion: Version - 1, Path: testDataPath + "blank.tar.gz", Format: "Docker"}
+	datastore.layers["base"] = base
+	datastore.layers["gone"] = database.Layer{Model: database.Model{ID: 2}, Name: "gone", EngineVersion: Version - 1, Format: "Docker"}
+	datastore.layers["child"] = database.Layer{Model: database.Model{ID: 3}, Name: "child", EngineVersion: Version - 1, Parent: &base, Path: testDataPath + "wheezy.tar.gz", Format: "Docker"}
+	datastore.layers["current"] = database.Layer{Model: database.Model{ID: 4}, Name: "current", EngineVersion: Version, Path: testDataPath + "jessie.tar.gz", Format: "Docker"}
+
+	reindexed, stale, err := Reindex(context.Background(), datastore, time.Millisecond, []string{testDataPath}, make(chan struct{}))
+	assert.Nil(t, err)
+	assert.Equal(t, 2, reindexed)
+	assert.Equal(t, 1, stale)
+
+	// The parent is analyzed before its child, and the current layer is left untouched.
+	assert.Equal(t, []string{"base", "child"}, inserted)
+	assert.Equal(t, Version, datastore.layers["child"].EngineVersion)
+	assert.Equal(t, "debian:7", datastore.layers["child"].Namespace.Name)
+	assert.True(t, datastore.layers["gone"].Stale)
+	assert.False(t, datastore.layers["current"].Stale)
+
+	// A second run has nothing left to do.
+	inserted = nil
+	reindexed, stale, err = Reindex(context.Background(), datastore, time.Millisecond, []string{testDataPath}, make(chan struct{}))
+	assert.Nil(t, err)
+	assert.Zero(t, reindexed+stale)
+	assert.Empty(t, inserted)
+}
+
+func TestReindexStopped(t *testing.T) {
+	datastore := newMockDatastore()
+	datastore.FctListOutdatedLayers = func(ctx context.Context, engineVersion, limit, startAfterID int) ([]database.Layer, error) {
+		return []database.Layer{{Model: database.Model{ID: startAfterID + 1}, Name: "layer"}}, nil
+	}
+
+	stop := make(chan struct{})
+	close(stop)
+	reindexed, stale, err := Reindex(context.Background(), datastore, time.Hour, nil, stop)
+	assert.Nil(t, err)
+	assert.Zero(t, reindexed+stale)
+}
@@ -17,11 +17,17 @@
 package worker
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
 	"github.com/coreos/pkg/capnslog"
 
 	"github.com/coreos/clair/database"
 	"github.com/coreos/clair/utils"
 	cerrors "github.com/coreos/clair/utils/errors"
+	"github.com/coreos/clair/utils/types"
 	"github.com/coreos/clair/worker/detectors"
 )
 
@@ -29,28 +35,70 @@ const (
 	// Version (integer) represents the worker version.
 	// Increased each time the engine changes.
 	Version = 2
-
-	// maxFileSize is the maximum size of a single file we should extract.
-	maxFileSize = 200 * 1024 * 1024 // 200 MiB
 )
 
 var (
 	log = capnslog.NewPackageLogger("github.com/coreos/clair", "worker")
 
-	// ErrUnsupported is the error that should be raised when an OS or package
-	// manager is not supported.
-	ErrUnsupported = cerrors.NewBadRequestError("worker: OS and/or package manager are not supported")
+	// ErrUnsupportedImageFormat is the error that should be raised when no data detector reads the
+	// format of a layer.
+	ErrUnsupportedImageFormat = cerrors.NewBadRequestError("worker: image format is not supported")
+
+	// ErrCouldNotFindNamespace is the error that should be raised when features have been detected
+	// in a layer whose OS and ecosystem are unknown. The layer is stored nonetheless, without those
+	// features, so that its children can be processed.
+	ErrCouldNotFindNamespace = errors.New("worker: OS and/or package manager are not supported, the layer has been stored without their features")
 
 	// ErrParentUnknown is the error that should be raised when a parent layer
 	// has yet to be processed for the current layer.
 	ErrParentUnknown = cerrors.NewBadRequestError("worker: parent layer is unknown, it must be processed first")
+
+	// extractionLimits bounds the files extracted from the layers.
+	extractionLimits = DefaultExtractionLimits
+
+	// maxLayerTreeDepth bounds the number of layers of an ancestry, see SetMaxLayerTreeDepth.
+	maxLayerTreeDepth = database.DefaultMaxLayerTreeDepth
 )
 
-// Process detects the Namespace of a layer, the features it adds/removes, and
+// ErrCouldNotDownload is the error that is raised when a layer could not be downloaded, along with
+// the status the server answered with.
+type ErrCouldNotDownload = detectors.ErrCouldNotDownload
+
+// DefaultExtractionLimits are the limits of the extraction of the layers, unless
+// SetExtractionLimits is called.
+var DefaultExtractionLimits = utils.ExtractionLimits{
+	MaxFileSize:                 200 * 1024 * 1024, // 200 MiB
+	MaxExtractedSize:            512 * 1024 * 1024, // 512 MiB
+	MaxPatternMatches:           10000,
+	MaxExecutableSize:           64 * 1024 * 1024,  // 64 MiB
+	MaxExtractedExecutablesSize: 256 * 1024 * 1024, // 256 MiB
+}
+
+// SetExtractionLimits sets the limits of the extraction of the layers. It must be called before
+// any layer is processed.
+func SetExtractionLimits(limits utils.ExtractionLimits) {
+	extractionLimits = limits
+}
+
+// SetMaxLayerTreeDepth sets the maximum number of layers that can be stacked on top of each other,
+// beyond which Process fails with ErrLayerTreeTooDeep before analyzing the layer. A zero value
+// means no limit, other than the datastore's. It must be called before any layer is processed.
+func SetMaxLayerTreeDepth(depth int) {
+	maxLayerTreeDepth = depth
+}
+
+// Process detects the Namespaces of a layer, the features it adds/removes, and
 // then stores everything in the database.
-// TODO(Quentin-M): We could have a goroutine that looks for layers that have been analyzed with an
-// older engine version and that processes them.
-func Process(datastore database.Datastore, imageFormat, name, parentName, path string, headers map[string]string) error {
+// The layer is read from the local filesystem only if its path lies within one of the localPaths
+// directories, see detectors.DetectData.
+// The analyses of the layers share a pool, see SetConcurrency: Process waits for the turn of the
+// layer, and fails with ErrQueueFull when too many layers are waiting already.
+func Process(ctx context.Context, datastore database.Datastore, imageFormat, name, parentName, path string, headers map[string]string, localPaths []string) error {
+	return process(ctx, datastore, imageFormat, name, parentName, path, "", headers, localPaths)
+}
+
+// process is Process for a layer whose content must match the given digest, unless it is empty.
+func process(ctx context.Context, datastore database.Datastore, imageFormat, name, parentName, path, digest string, headers map[string]string, localPaths []string) error {
 	// Verify parameters.
 	if name == "" {
 		return cerrors.NewBadRequestError("could not process a layer which does not have a name")
@@ -64,11 +112,31 @@ func Process(datastore database.Datastore, imageFormat, name, parentName, path s
 		return cerrors.NewBadRequestError("could not process a layer which does not have a format")
 	}
 
+	if parentName == name {
+		return cerrors.NewBadRequestError("could not process a layer which is its own parent")
+	}
+
+	if !detectors.SupportedFormat(path, imageFormat) {
+		return ErrUnsupportedImageFormat
+	}
+
+	// The layer and its parent are read from the primary database, as a read replica may not have
+	// the layers that were just processed, and what is read determines what is written.
+	ctx = database.ContextWithPrimary(ctx)
+
+	// The logs mention the API request that triggered the processing, if any.
+	logName := name
+	if requestID := utils.RequestIDFromContext(ctx); requestID != "" {
+		logName = fmt.Sprintf("%s (request %s)", name, requestID)
+	}
+
 	log.Debugf("layer %s: processing (Location: %s, Engine version: %d, Parent: %s, Format: %s)",
-		name, utils.CleanURL(path), Version, parentName, imageFormat)
+		logName, utils.CleanURL(path), Version, parentName, imageFormat)
+
+	processedBy := DetectorNames()
 
 	// Check to see if the layer is already in the database.
-	layer, err := datastore.FindLayer(name, false, false)
+	layer, err := datastore.FindLayer(ctx, name, false, false, types.Unknown)
 	if err != nil && err != cerrors.ErrNotFound {
 		return err
 	}
@@ -79,52 +147,110 @@ func Process(datastore database.Datastore, imageFormat, name, parentName, path s
 
 		// Retrieve the parent if it has one.
 		// We need to get it with its Features in order to diff them.
-		if parentName != "" {
-			parent, err := datastore.FindLayer(parentName, true, false)
-			if err != nil && err != cerrors.ErrNotFound {
-				return err
-			}
-			if err == cerrors.ErrNotFound {
-				log.Warningf("layer %s: the parent layer (%s) is unknown. it must be processed first", name,
-					parentName)
-				return ErrParentUnknown
-			}
-			layer.Parent = &parent
+		if layer.Parent, err = findParent(ctx, datastore, logName, parentName); err != nil {
+			return err
 		}
 	} else {
-		// The layer is already in the database, check if we need to update it.
-		if layer.EngineVersion >= Version {
+		// The layer is already in the database, check if we need to update it: either the engine
+		// changed, or detectors have been added since it was processed.
+		if layer.EngineVersion > Version || layer.EngineVersion == Version && layer.IsProcessedBy(processedBy) {
 			log.Debugf(`layer %s: layer content has already been processed in the past with engine %d.
-        Current engine is %d. skipping analysis`, name, layer.EngineVersion, Version)
+        Current engine is %d. skipping analysis`, logName, layer.EngineVersion, Version)
 			return nil
 		}
 
-		log.Debugf(`layer %s: layer content has been analyzed in the past with engine %d. Current
-      engine is %d. analyzing again`, name, layer.EngineVersion, Version)
+		log.Debugf(`layer %s: layer content has been analyzed in the past with engine %d and detectors %v.
+      Current engine is %d. analyzing again`, logName, layer.EngineVersion, layer.ProcessedBy, Version)
+		layer.EngineVersion = Version
+
+		// Retrieve the parent again with its Features in order to diff them. The parent given in
+		// the request, if any, replaces the one the layer had.
+		if parentName == "" && layer.Parent != nil {
+			parentName = layer.Parent.Name
+		}
+		if layer.Parent, err = findParent(ctx, datastore, logName, parentName); err != nil {
+			return err
+		}
+	}
+
+	// Refuse to stack the layer on a chain that is already as deep as allowed, before downloading it.
+	if layer.Parent != nil && maxLayerTreeDepth > 0 && layer.Parent.Depth >= maxLayerTreeDepth {
+		log.Warningf("layer %s: the parent layer (%s) already has %d layers in its ancestry", logName,
+			layer.Parent.Name, layer.Parent.Depth)
+		return &database.ErrLayerTreeTooDeep{Layer: name, MaxDepth: maxLayerTreeDepth}
 	}
+	layer.ProcessedBy = processedBy
+	layer.Path, layer.Format = path, imageFormat
 
-	// Analyze the content.
-	layer.Namespace, layer.Features, err = detectContent(imageFormat, name, path, headers, layer.Parent)
+	// Analyze the content, once the pool allows it.
+	release, err := analyses.acquire(ctx)
 	if err != nil {
+		if err == ErrQueueFull {
+			log.Warningf("layer %s: too many layers are waiting for their analysis", logName)
+		}
+		return err
+	}
+	layer.Namespace, layer.Namespaces, layer.Features, err = detectContent(imageFormat, logName, path, digest, headers, localPaths, layer.Parent)
+	release()
+	if err != nil && err != ErrCouldNotFindNamespace {
 		return err
 	}
 
-	return datastore.InsertLayer(layer)
+	// The layer is stored even if some of its features could not be, which err then reports.
+	defer observeStage("storage", time.Now())
+	if insertErr := datastore.InsertLayer(ctx, layer); insertErr != nil {
+		return insertErr
+	}
+	return err
 }
 
-// detectContent downloads a layer's archive and extracts its Namespace and Features.
-func detectContent(imageFormat, name, path string, headers map[string]string, parent *database.Layer) (namespace *database.Namespace, featureVersions []database.FeatureVersion, err error) {
-	data, err := detectors.DetectData(imageFormat, path, headers, append(detectors.GetRequiredFilesFeatures(), detectors.GetRequiredFilesNamespace()...), maxFileSize)
+// findParent returns the parent layer with the given name, if any, along with its Features.
+func findParent(ctx context.Context, datastore database.Datastore, logName, parentName string) (*database.Layer, error) {
+	if parentName == "" {
+		return nil, nil
+	}
+
+	parent, err := datastore.FindLayer(ctx, parentName, true, false, types.Unknown)
+	if err == cerrors.ErrNotFound {
+		log.Warningf("layer %s: the parent layer (%s) is unknown. it must be processed first", logName,
+			parentName)
+		return nil, ErrParentUnknown
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &parent, nil
+}
+
+// observeStage records the duration of a stage of the processing of a layer, which started at the
+// given time.
+func observeStage(stage string, start time.Time) {
+	promStageDurationSeconds.WithLabelValues(stage).Observe(time.Since(start).Seconds())
+}
+
+// DetectorNames returns the names of every enabled detector, which are recorded on the layers
+// they process.
+func DetectorNames() []string {
+	return append(detectors.ListEnabledNamespaceDetectors(), detectors.ListEnabledFeaturesDetectors()...)
+}
+
+// detectContent downloads a layer's archive and extracts its Namespaces, the primary one, and its
+// Features.
+func detectContent(imageFormat, name, path, digest string, headers map[string]string, localPaths []string, parent *database.Layer) (namespace *database.Namespace, namespaces []database.Namespace, featureVersions []database.FeatureVersion, err error) {
+	start := time.Now()
+	data, err := detectors.DetectVerifiedData(imageFormat, path, digest, headers, localPaths, append(detectors.GetRequiredFilesFeatures(), detectors.GetRequiredFilesNamespace()...), extractionLimits)
 	if err != nil {
 		log.Errorf("layer %s: failed to extract data from %s: %s", name, utils.CleanURL(path), err)
 		return
 	}
+	observeStage("extraction", start)
+	defer observeStage("detection", time.Now())
 
-	// Detect namespace.
-	namespace = detectNamespace(name, data, parent)
+	// Detect namespaces.
+	namespace, namespaces = detectNamespaces(name, data, parent)
 
 	// Detect features.
-	featureVersions, err = detectFeatureVersions(name, data, namespace, parent)
+	featureVersions, err = detectFeatureVersions(name, data, namespace, namespaces, parent)
 	if err != nil {
 		return
 	}
@@ -135,44 +261,54 @@ func detectContent(imageFormat, name, path string, headers map[string]string, pa
 	return
 }
 
-func detectNamespace(name string, data map[string][]byte, parent *database.Layer) (namespace *database.Namespace) {
-	// Use registered detectors to get the Namespace.
-	namespace = detectors.DetectNamespace(data)
-	if namespace != nil {
-		log.Debugf("layer %s: detected namespace %q", name, namespace.Name)
-		return
+// detectNamespaces returns the namespaces detected in the layer, followed by the namespaces of
+// its parent whose OS or ecosystem hasn't been detected again. The primary namespace is the first
+// one that names an OS, or the first one if none does, and is listed first.
+func detectNamespaces(name string, data map[string][]byte, parent *database.Layer) (namespace *database.Namespace, namespaces []database.Namespace) {
+	// Use registered detectors to get the Namespaces.
+	detected := make(map[string]struct{})
+	for _, n := range detectors.DetectNamespaces(data) {
+		log.Debugf("layer %s: detected namespace %q", name, n.Name)
+		detected[n.Prefix()] = struct{}{}
+		namespaces = append(namespaces, n)
 	}
 
-	// Use the parent's Namespace.
+	// Use the parent's Namespaces that are not overridden.
 	if parent != nil {
-		namespace = parent.Namespace
-		if namespace != nil {
-			log.Debugf("layer %s: detected namespace %q (from parent)", name, namespace.Name)
-			return
+		for _, n := range parent.ListNamespaces() {
+			if _, ok := detected[n.Prefix()]; !ok {
+				log.Debugf("layer %s: detected namespace %q (from parent)", name, n.Name)
+				namespaces = append(namespaces, n)
+			}
 		}
 	}
 
+	// Move the primary Namespace first, as FindLayer returns it.
+	if len(namespaces) > 0 {
+		var primary int
+		for i := range namespaces {
+			if _, ok := database.VersionFormatsMapping[namespaces[i].Prefix()]; ok {
+				primary = i
+				break
+			}
+		}
+		namespaces = append(append([]database.Namespace{namespaces[primary]}, namespaces[:primary]...), namespaces[primary+1:]...)
+		namespace = &namespaces[0]
+	}
+
 	return
 }
 
-func detectFeatureVersions(name string, data map[string][]byte, namespace *database.Namespace, parent *database.Layer) (features []database.FeatureVersion, err error) {
+func detectFeatureVersions(name string, data map[string][]byte, namespace *database.Namespace, namespaces []database.Namespace, parent *database.Layer) (features []database.FeatureVersion, err error) {
 	// TODO(Quentin-M): We need to pass the parent image to DetectFeatures because it's possible that
 	// some detectors would need it in order to produce the entire feature list (if they can only
 	// detect a diff). Also, we should probably pass the detected namespace so detectors could
 	// make their own decision.
-	features, err = detectors.DetectFeatures(data)
+	detections, err := detectors.DetectFeaturesByDetector(data)
 	if err != nil {
 		return
 	}
-
-	// If there are no FeatureVersions, use parent's FeatureVersions if possible.
-	// TODO(Quentin-M): We eventually want to give the choice to each detectors to use none/some of
-	// their parent's FeatureVersions. It would be useful for detectors that can't find their entire
-	// result using one Layer.
-	if len(features) == 0 && parent != nil {
-		features = parent.Features
-		return
-	}
+	features = detectors.MergeDetectedFeatures(detections)
 
 	// Build a map of the namespaces for each FeatureVersion in our parent layer.
 	parentFeatureNamespaces := make(map[string]database.Namespace)
@@ -182,29 +318,91 @@ func detectFeatureVersions(name string, data map[string][]byte, namespace *datab
 		}
 	}
 
-	// Ensure that each FeatureVersion has an associated Namespace.
-	for i, feature := range features {
+	// Build a map of the namespaces of the layer, for the FeatureVersions that name their own.
+	layerNamespaces := make(map[string]database.Namespace, len(namespaces))
+	for _, n := range namespaces {
+		layerNamespaces[n.Name] = n
+	}
+
+	// Ensure that each FeatureVersion has an associated Namespace, leaving out the ones that can't
+	// have any.
+	namespaced := features[:0]
+	for _, feature := range features {
 		if feature.Feature.Namespace.Name != "" {
-			// There is a Namespace associated.
+			// There is a Namespace associated, which may be one of the layer.
+			if layerNamespace, ok := layerNamespaces[feature.Feature.Namespace.Name]; ok {
+				feature.Feature.Namespace = layerNamespace
+			}
+		} else if parentFeatureNamespace, ok := parentFeatureNamespaces[feature.Feature.Name+":"+feature.Version.String()]; ok {
+			// The FeatureVersion is present in the parent layer; associate with their Namespace.
+			feature.Feature.Namespace = parentFeatureNamespace
+		} else if namespace != nil {
+			// The primary Namespace of the layer is known; associate it.
+			feature.Feature.Namespace = *namespace
+		} else {
+			log.Warningf("layer %s: Layer's namespace is unknown but non-namespaced feature %s has been detected", name, feature.Feature.Name)
+			err = ErrCouldNotFindNamespace
 			continue
 		}
+		namespaced = append(namespaced, feature)
+	}
+
+	// Complete the FeatureVersions with the ones of the parent that the layer didn't replace.
+	namespaced = append(namespaced, inheritedFeatureVersions(name, detections, parent)...)
+
+	return namespaced, err
+}
+
+// inheritedFeatureVersions returns the FeatureVersions of the parent layer that are kept by the
+// layer. The detectors that are not NamespacedFeaturesDetectors read the package databases of the
+// OS, which list every installed package: the OS packages of the parent are kept only if they
+// didn't find anything. The other detectors only find the packages that the layer installs: the
+// packages of the parent are kept unless the layer installs a package with the same name.
+// The packages whose files the layer deletes have been removed as well, and so have all the
+// FeatureVersions of an ecosystem when the deleted files may belong to any of its packages.
+func inheritedFeatureVersions(name string, detections []detectors.DetectedFeatures, parent *database.Layer) []database.FeatureVersion {
+	if parent == nil {
+		return nil
+	}
+
+	// Find the ecosystems that the layer replaces or deletes, and the packages it installs or
+	// deletes.
+	replaced := make(map[string]bool)
+	overridden := make(map[string]struct{})
+	for _, detection := range detections {
+		if detection.Ecosystem == "" {
+			replaced[""] = replaced[""] || len(detection.FeatureVersions) > 0
+		} else {
+			if _, ok := replaced[detection.Ecosystem]; !ok {
+				replaced[detection.Ecosystem] = false
+			}
+			for _, feature := range detection.FeatureVersions {
+				overridden[detection.Ecosystem+":"+feature.Feature.Name] = struct{}{}
+			}
+			for _, feature := range detection.DeletedFeatures {
+				overridden[detection.Ecosystem+":"+feature] = struct{}{}
+			}
+		}
+		if detection.Deleted && !replaced[detection.Ecosystem] {
+			log.Debugf("layer %s: the files of %s have been deleted, not inheriting its features from the parent layer", name, detection.Detector)
+			replaced[detection.Ecosystem] = true
+		}
+	}
 
-		if parentFeatureNamespace, ok := parentFeatureNamespaces[feature.Feature.Name+":"+feature.Version.String()]; ok {
-			// The FeatureVersion is present in the parent layer; associate with their Namespace.
-			features[i].Feature.Namespace = parentFeatureNamespace
+	var features []database.FeatureVersion
+	for _, feature := range parent.Features {
+		// The FeatureVersions that are not in the Namespace of an ecosystem are the OS packages.
+		ecosystem := feature.Feature.Namespace.Name
+		if _, ok := replaced[ecosystem]; !ok {
+			ecosystem = ""
+		}
+		if replaced[ecosystem] {
 			continue
 		}
-
-		if namespace != nil {
-			// The Namespace has been detected in this layer; associate it.
-			features[i].Feature.Namespace = *namespace
+		if _, ok := overridden[ecosystem+":"+feature.Feature.Name]; ok {
 			continue
 		}
-
-		log.Warningf("layer %s: Layer's namespace is unknown but non-namespaced features have been detected", name)
-		err = ErrUnsupported
-		return
+		features = append(features, feature)
 	}
-
-	return
+	return features
 }
@@ -15,8 +15,16 @@
 package worker
 
 import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"path/filepath"
 	"runtime"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -24,10 +32,15 @@ import (
 	"github.com/coreos/clair/database"
 	cerrors "github.com/coreos/clair/utils/errors"
 	"github.com/coreos/clair/utils/types"
+	"github.com/coreos/clair/worker/detectors"
 
 	// Register the required detectors.
 	_ "github.com/coreos/clair/worker/detectors/data/docker"
 	_ "github.com/coreos/clair/worker/detectors/feature/dpkg"
+	_ "github.com/coreos/clair/worker/detectors/feature/gem"
+	_ "github.com/coreos/clair/worker/detectors/feature/gobinary"
+	_ "github.com/coreos/clair/worker/detectors/feature/npm"
+	_ "github.com/coreos/clair/worker/detectors/feature/pip"
 	_ "github.com/coreos/clair/worker/detectors/namespace/aptsources"
 	_ "github.com/coreos/clair/worker/detectors/namespace/osrelease"
 )
@@ -49,11 +62,11 @@ func TestProcessWithDistUpgrade(t *testing.T) {
 
 	// Create a mock datastore.
 	datastore := newMockDatastore()
-	datastore.FctInsertLayer = func(layer database.Layer) error {
+	datastore.FctInsertLayer = func(ctx context.Context, layer database.Layer) error {
 		datastore.layers[layer.Name] = layer
 		return nil
 	}
-	datastore.FctFindLayer = func(name string, withFeatures, withVulnerabilities bool) (database.Layer, error) {
+	datastore.FctFindLayer = func(ctx context.Context, name string, withFeatures, withVulnerabilities bool, minSeverity types.Priority) (database.Layer, error) {
 		if layer, exists := datastore.layers[name]; exists {
 			return layer, nil
 		}
@@ -78,18 +91,19 @@ func TestProcessWithDistUpgrade(t *testing.T) {
 	// wheezy.tar: FROM debian:wheezy
 	// jessie.tar: RUN sed -i "s/precise/trusty/" /etc/apt/sources.list && apt-get update &&
 	//             apt-get -y dist-upgrade
-	assert.Nil(t, Process(datastore, "Docker", "blank", "", testDataPath+"blank.tar.gz", nil))
-	assert.Nil(t, Process(datastore, "Docker", "wheezy", "blank", testDataPath+"wheezy.tar.gz", nil))
-	assert.Nil(t, Process(datastore, "Docker", "jessie", "wheezy", testDataPath+"jessie.tar.gz", nil))
+	assert.Nil(t, Process(context.Background(), datastore, "Docker", "blank", "", testDataPath+"blank.tar.gz", nil, []string{testDataPath}))
+	assert.Nil(t, Process(context.Background(), datastore, "Docker", "wheezy", "blank", testDataPath+"wheezy.tar.gz", nil, []string{testDataPath}))
+	assert.Nil(t, Process(context.Background(), datastore, "Docker", "jessie", "wheezy", testDataPath+"jessie.tar.gz", nil, []string{testDataPath}))
 
 	// Ensure that the 'wheezy' layer has the expected namespace and features.
 	wheezy, ok := datastore.layers["wheezy"]
 	if assert.True(t, ok, "layer 'wheezy' not processed") {
 		assert.Equal(t, "debian:7", wheezy.Namespace.Name)
+		assert.Equal(t, types.DpkgVersionFormat, wheezy.Namespace.VersionFormat)
 		assert.Len(t, wheezy.Features, 52)
 
 		for _, nufv := range nonUpgradedFeatureVersions {
-			nufv.Feature.Namespace.Name = "debian:7"
+			nufv.Feature.Namespace = database.Namespace{Name: "debian:7", VersionFormat: types.DpkgVersionFormat}
 			assert.Contains(t, wheezy.Features, nufv)
 		}
 	}
@@ -101,12 +115,526 @@ func TestProcessWithDistUpgrade(t *testing.T) {
 		assert.Len(t, jessie.Features, 74)
 
 		for _, nufv := range nonUpgradedFeatureVersions {
-			nufv.Feature.Namespace.Name = "debian:7"
+			nufv.Feature.Namespace = database.Namespace{Name: "debian:7", VersionFormat: types.DpkgVersionFormat}
 			assert.Contains(t, jessie.Features, nufv)
 		}
 		for _, nufv := range nonUpgradedFeatureVersions {
-			nufv.Feature.Namespace.Name = "debian:8"
+			nufv.Feature.Namespace = database.Namespace{Name: "debian:8", VersionFormat: types.DpkgVersionFormat}
 			assert.NotContains(t, jessie.Features, nufv)
 		}
 	}
 }
+
+type noopFeaturesDetector struct{}
+
+func (noopFeaturesDetector) Detect(map[string][]byte) ([]database.FeatureVersion, error) {
+	return nil, nil
+}
+
+func (noopFeaturesDetector) GetRequiredFiles() []string {
+	return nil
+}
+
+func TestProcessWithNewDetector(t *testing.T) {
+	_, f, _, _ := runtime.Caller(0)
+	testDataPath := filepath.Join(filepath.Dir(f)) + "/testdata/DistUpgrade/"
+
+	// Create a mock datastore, which counts the insertions.
+	datastore := newMockDatastore()
+	var inserted int
+	datastore.FctInsertLayer = func(ctx context.Context, layer database.Layer) error {
+		inserted++
+		datastore.layers[layer.Name] = layer
+		return nil
+	}
+	datastore.FctFindLayer = func(ctx context.Context, name string, withFeatures, withVulnerabilities bool, minSeverity types.Priority) (database.Layer, error) {
+		if layer, exists := datastore.layers[name]; exists {
+			return layer, nil
+		}
+		return database.Layer{}, cerrors.ErrNotFound
+	}
+
+	assert.Nil(t, Process(context.Background(), datastore, "Docker", "blank", "", testDataPath+"blank.tar.gz", nil, []string{testDataPath}))
+	assert.Nil(t, Process(context.Background(), datastore, "Docker", "wheezy", "blank", testDataPath+"wheezy.tar.gz", nil, []string{testDataPath}))
+	assert.Equal(t, 2, inserted)
+	assert.Contains(t, datastore.layers["wheezy"].ProcessedBy, "dpkg")
+	assert.NotContains(t, datastore.layers["wheezy"].ProcessedBy, "noop")
+
+	// The layer is up to date.
+	assert.Nil(t, Process(context.Background(), datastore, "Docker", "wheezy", "blank", testDataPath+"wheezy.tar.gz", nil, []string{testDataPath}))
+	assert.Equal(t, 2, inserted)
+
+	// The layer is processed again once a new detector is available, and keeps its content.
+	detectors.RegisterFeaturesDetector("noop", noopFeaturesDetector{})
+	assert.Nil(t, Process(context.Background(), datastore, "Docker", "wheezy", "blank", testDataPath+"wheezy.tar.gz", nil, []string{testDataPath}))
+	assert.Equal(t, 3, inserted)
+
+	wheezy := datastore.layers["wheezy"]
+	assert.Contains(t, wheezy.ProcessedBy, "noop")
+	assert.Equal(t, Version, wheezy.EngineVersion)
+	assert.Equal(t, "debian:7", wheezy.Namespace.Name)
+	assert.Len(t, wheezy.Features, 52)
+}
+
+// testLockNamespaceDetector detects the namespace of the language packages listed in the
+// app/test.lock files.
+type testLockNamespaceDetector struct{}
+
+func (testLockNamespaceDetector) Detect(data map[string][]byte) *database.Namespace {
+	if _, ok := data["app/test.lock"]; ok {
+		return &database.Namespace{Name: "testlang:1"}
+	}
+	return nil
+}
+
+func (testLockNamespaceDetector) GetRequiredFiles() []string {
+	return []string{"app/test.lock"}
+}
+
+// testLockFeaturesDetector lists the language packages of the app/test.lock files, which are in
+// their own namespace.
+type testLockFeaturesDetector struct{}
+
+func (testLockFeaturesDetector) Detect(data map[string][]byte) ([]database.FeatureVersion, error) {
+	var features []database.FeatureVersion
+	scanner := bufio.NewScanner(bytes.NewReader(data["app/test.lock"]))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		features = append(features, database.FeatureVersion{
+			Feature: database.Feature{Name: fields[0], Namespace: database.Namespace{Name: "testlang:1"}},
+			Version: types.NewVersionUnsafe(fields[1]),
+		})
+	}
+	return features, scanner.Err()
+}
+
+func (testLockFeaturesDetector) GetRequiredFiles() []string {
+	return []string{"app/test.lock"}
+}
+
+func init() {
+	detectors.RegisterNamespaceDetector("test-lock", testLockNamespaceDetector{})
+	detectors.RegisterFeaturesDetector("test-lock", testLockFeaturesDetector{})
+}
+
+func TestProcessWithMixedContent(t *testing.T) {
+	_, f, _, _ := runtime.Caller(0)
+	testDataPath := filepath.Join(filepath.Dir(f)) + "/testdata/"
+
+	datastore := newMockDatastore()
+	datastore.FctInsertLayer = func(ctx context.Context, layer database.Layer) error {
+		datastore.layers[layer.Name] = layer
+		return nil
+	}
+	datastore.FctFindLayer = func(ctx context.Context, name string, withFeatures, withVulnerabilities bool, minSeverity types.Priority) (database.Layer, error) {
+		if layer, exists := datastore.layers[name]; exists {
+			return layer, nil
+		}
+		return database.Layer{}, cerrors.ErrNotFound
+	}
+
+	// mixed.tar.gz: Debian packages, along with language packages listed in app/test.lock.
+	// blank.tar.gz: no content.
+	assert.Nil(t, Process(context.Background(), datastore, "Docker", "mixed", "", testDataPath+"MixedContent/mixed.tar.gz", nil, []string{testDataPath}))
+	assert.Nil(t, Process(context.Background(), datastore, "Docker", "blank", "mixed", testDataPath+"DistUpgrade/blank.tar.gz", nil, []string{testDataPath}))
+
+	debian := database.Namespace{Name: "debian:8", VersionFormat: types.DpkgVersionFormat}
+	testlang := database.Namespace{Name: "testlang:1"}
+
+	// Both namespaces are detected, the OS one being the primary namespace even though the
+	// language one has been detected first. Each feature keeps its own namespace.
+	for _, name := range []string{"mixed", "blank"} {
+		layer, ok := datastore.layers[name]
+		if !assert.True(t, ok, "layer '%s' not processed", name) {
+			continue
+		}
+
+		if assert.NotNil(t, layer.Namespace, name) {
+			assert.Equal(t, debian, *layer.Namespace, name)
+		}
+		assert.Equal(t, []database.Namespace{debian, testlang}, layer.Namespaces, name)
+
+		if assert.Len(t, layer.Features, 4, name) {
+			namespaces := make(map[string]database.Namespace)
+			for _, feature := range layer.Features {
+				namespaces[feature.Feature.Name] = feature.Feature.Namespace
+			}
+			assert.Equal(t, map[string]database.Namespace{
+				"openssl": debian,
+				"zlib":    debian,
+				"leftpad": testlang,
+				"request": testlang,
+			}, namespaces, name)
+		}
+	}
+}
+
+func TestProcessWithWhiteout(t *testing.T) {
+	_, f, _, _ := runtime.Caller(0)
+	testDataPath := filepath.Join(filepath.Dir(f)) + "/testdata/"
+
+	datastore := newMockDatastore()
+	datastore.FctInsertLayer = func(ctx context.Context, layer database.Layer) error {
+		datastore.layers[layer.Name] = layer
+		return nil
+	}
+	datastore.FctFindLayer = func(ctx context.Context, name string, withFeatures, withVulnerabilities bool, minSeverity types.Priority) (database.Layer, error) {
+		if layer, exists := datastore.layers[name]; exists {
+			return layer, nil
+		}
+		return database.Layer{}, cerrors.ErrNotFound
+	}
+
+	// wheezy.tar.gz: FROM debian:wheezy
+	// whiteout.tar.gz: RUN rm /var/lib/dpkg/status (aufs whiteout)
+	// opaque.tar.gz: RUN rm -r /var/lib/dpkg && mkdir /var/lib/dpkg (overlay opaque directory)
+	// blank.tar.gz: no content.
+	assert.Nil(t, Process(context.Background(), datastore, "Docker", "wheezy", "", testDataPath+"DistUpgrade/wheezy.tar.gz", nil, []string{testDataPath}))
+	assert.Nil(t, Process(context.Background(), datastore, "Docker", "whiteout", "wheezy", testDataPath+"Whiteout/whiteout.tar.gz", nil, []string{testDataPath}))
+	assert.Nil(t, Process(context.Background(), datastore, "Docker", "opaque", "wheezy", testDataPath+"Whiteout/opaque.tar.gz", nil, []string{testDataPath}))
+	assert.Nil(t, Process(context.Background(), datastore, "Docker", "blank", "wheezy", testDataPath+"DistUpgrade/blank.tar.gz", nil, []string{testDataPath}))
+
+	assert.Len(t, datastore.layers["wheezy"].Features, 52)
+	assert.Len(t, datastore.layers["blank"].Features, 52)
+
+	// The features of the parent layer are not inherited once the status file is deleted, but the
+	// namespace is.
+	for _, name := range []string{"whiteout", "opaque"} {
+		layer, ok := datastore.layers[name]
+		if assert.True(t, ok, "layer '%s' not processed", name) {
+			assert.Empty(t, layer.Features, name)
+			if assert.NotNil(t, layer.Namespace, name) {
+				assert.Equal(t, "debian:7", layer.Namespace.Name, name)
+			}
+		}
+	}
+}
+
+// newLayersServer returns a server that serves a layer archive, made of the given files, for each
+// of the given paths. The files are executable.
+func newLayersServer(t *testing.T, layers map[string]map[string]string) *httptest.Server {
+	archives := make(map[string][]byte, len(layers))
+	for path, files := range layers {
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		for name, content := range files {
+			assert.Nil(t, tw.WriteHeader(&tar.Header{Name: name, Mode: 0755, Size: int64(len(content))}))
+			tw.Write([]byte(content))
+		}
+		assert.Nil(t, tw.Close())
+		archives["/"+path] = buf.Bytes()
+	}
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		archive, ok := archives[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(archive)
+	}))
+}
+
+func TestProcessWithLanguagePackages(t *testing.T) {
+	server := newLayersServer(t, map[string]map[string]string{
+		"debian": {
+			"etc/os-release":      "ID=debian\nVERSION_ID=\"8\"\n",
+			"var/lib/dpkg/status": "Package: openssl\nStatus: install ok installed\nVersion: 1.0.1\n",
+		},
+		"flask": {
+			"usr/lib/python3/site-packages/Flask-1.0.dist-info/METADATA": "Metadata-Version: 2.1\nName: Flask\nVersion: 1.0\n",
+		},
+		"requests": {
+			"usr/lib/python3/site-packages/requests-2.20.0.dist-info/METADATA": "Metadata-Version: 2.1\nName: requests\nVersion: 2.20.0\n",
+		},
+		"flask-upgrade": {
+			"usr/lib/python3/site-packages/.wh.Flask-1.0.dist-info":      "",
+			"usr/lib/python3/site-packages/Flask-1.1.dist-info/METADATA": "Metadata-Version: 2.1\nName: Flask\nVersion: 1.1\n",
+		},
+		"flask-uninstall": {
+			"usr/lib/python3/site-packages/.wh.Flask-1.0.dist-info": "",
+		},
+		"express": {
+			"app/node_modules/express/package.json": `{"name": "express", "version": "4.16.0"}`,
+		},
+		"rack": {
+			"usr/local/bundle/specifications/rack-2.0.6.gemspec":  "",
+			"usr/local/bundle/specifications/rake-12.3.1.gemspec": "",
+		},
+		"gem-uninstall": {
+			"usr/local/bundle/specifications/.wh.rack-2.0.6.gemspec": "",
+		},
+		"dpkg-purge": {
+			"var/lib/dpkg/.wh.status": "",
+		},
+	})
+	defer server.Close()
+
+	datastore := newMockDatastore()
+	datastore.FctInsertLayer = func(ctx context.Context, layer database.Layer) error {
+		datastore.layers[layer.Name] = layer
+		return nil
+	}
+	datastore.FctFindLayer = func(ctx context.Context, name string, withFeatures, withVulnerabilities bool, minSeverity types.Priority) (database.Layer, error) {
+		// A read replica may not have the parent layers yet.
+		assert.True(t, database.PrimaryFromContext(ctx), name)
+		if layer, exists := datastore.layers[name]; exists {
+			return layer, nil
+		}
+		return database.Layer{}, cerrors.ErrNotFound
+	}
+
+	// Each layer only contains the packages that it installs.
+	for _, layer := range []struct{ name, parent string }{
+		{"debian", ""},
+		{"flask", "debian"},
+		{"requests", "flask"},
+		{"flask-upgrade", "requests"},
+		{"flask-uninstall", "requests"},
+		{"express", "requests"},
+		{"rack", "express"},
+		{"gem-uninstall", "rack"},
+		{"dpkg-purge", "rack"},
+	} {
+		assert.Nil(t, Process(context.Background(), datastore, "Docker", layer.name, layer.parent, server.URL+"/"+layer.name, nil, nil), layer.name)
+	}
+
+	// The layers that only install language packages keep the OS packages of their parent, and add
+	// their language packages to the ones of their parent, replacing the ones with the same name.
+	// Deleting the files of a package only removes that package, and deleting the package database
+	// of the OS only removes the OS packages.
+	for name, expected := range map[string][]string{
+		"debian":          {"debian:8 openssl 1.0.1"},
+		"flask":           {"python flask 1.0", "debian:8 openssl 1.0.1"},
+		"requests":        {"python requests 2.20.0", "python flask 1.0", "debian:8 openssl 1.0.1"},
+		"flask-upgrade":   {"python flask 1.1", "python requests 2.20.0", "debian:8 openssl 1.0.1"},
+		"flask-uninstall": {"python requests 2.20.0", "debian:8 openssl 1.0.1"},
+		"express":         {"npm express 4.16.0", "python requests 2.20.0", "python flask 1.0", "debian:8 openssl 1.0.1"},
+		"rack":            {"ruby rack 2.0.6", "ruby rake 12.3.1", "npm express 4.16.0", "python requests 2.20.0", "python flask 1.0", "debian:8 openssl 1.0.1"},
+		"gem-uninstall":   {"ruby rake 12.3.1", "npm express 4.16.0", "python requests 2.20.0", "python flask 1.0", "debian:8 openssl 1.0.1"},
+		"dpkg-purge":      {"ruby rack 2.0.6", "ruby rake 12.3.1", "npm express 4.16.0", "python requests 2.20.0", "python flask 1.0"},
+	} {
+		var features []string
+		for _, feature := range datastore.layers[name].Features {
+			features = append(features, feature.Feature.Namespace.Name+" "+feature.Feature.Name+" "+feature.Version.String())
+		}
+		assert.Equal(t, expected, features, name)
+	}
+}
+
+func TestProcessWithGoBinary(t *testing.T) {
+	_, f, _, _ := runtime.Caller(0)
+	hello, err := ioutil.ReadFile(filepath.Join(filepath.Dir(f), "detectors/feature/gobinary/testdata/layers/executables/usr/local/bin/hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// hello: COPY --from=build /hello /usr/local/bin/hello
+	server := newLayersServer(t, map[string]map[string]string{
+		"debian": {
+			"etc/os-release":      "ID=debian\nVERSION_ID=\"8\"\n",
+			"var/lib/dpkg/status": "Package: openssl\nStatus: install ok installed\nVersion: 1.0.1\n",
+		},
+		"hello": {
+			"usr/local/bin/hello": string(hello),
+		},
+	})
+	defer server.Close()
+
+	datastore := newMockDatastore()
+	datastore.FctInsertLayer = func(ctx context.Context, layer database.Layer) error {
+		datastore.layers[layer.Name] = layer
+		return nil
+	}
+	datastore.FctFindLayer = func(ctx context.Context, name string, withFeatures, withVulnerabilities bool, minSeverity types.Priority) (database.Layer, error) {
+		if layer, exists := datastore.layers[name]; exists {
+			return layer, nil
+		}
+		return database.Layer{}, cerrors.ErrNotFound
+	}
+
+	assert.Nil(t, Process(context.Background(), datastore, "Docker", "debian", "", server.URL+"/debian", nil, nil))
+	assert.Nil(t, Process(context.Background(), datastore, "Docker", "hello", "debian", server.URL+"/hello", nil, nil))
+
+	// The modules of the executable are added to the OS packages of the parent.
+	var features []string
+	for _, feature := range datastore.layers["hello"].Features {
+		features = append(features, feature.Feature.Namespace.Name+" "+feature.Feature.Name+" "+feature.Version.String())
+	}
+	assert.Equal(t, []string{"go stdlib 1.27.1", "go github.com/example/greeting 1.2.3", "debian:8 openssl 1.0.1"}, features)
+}
+
+func TestProcessWithDistroless(t *testing.T) {
+	_, f, _, _ := runtime.Caller(0)
+	testDataPath := filepath.Join(filepath.Dir(f)) + "/testdata/"
+
+	datastore := newMockDatastore()
+	datastore.FctInsertLayer = func(ctx context.Context, layer database.Layer) error {
+		datastore.layers[layer.Name] = layer
+		return nil
+	}
+	datastore.FctFindLayer = func(ctx context.Context, name string, withFeatures, withVulnerabilities bool, minSeverity types.Priority) (database.Layer, error) {
+		if layer, exists := datastore.layers[name]; exists {
+			return layer, nil
+		}
+		return database.Layer{}, cerrors.ErrNotFound
+	}
+
+	// distroless.tar.gz: a distroless base image, whose packages are listed in
+	// var/lib/dpkg/status.d/<package> files.
+	assert.Nil(t, Process(context.Background(), datastore, "Docker", "distroless", "", testDataPath+"Distroless/distroless.tar.gz", nil, []string{testDataPath}))
+
+	layer, ok := datastore.layers["distroless"]
+	if assert.True(t, ok, "layer 'distroless' not processed") {
+		if assert.NotNil(t, layer.Namespace) {
+			assert.Equal(t, "debian:9", layer.Namespace.Name)
+		}
+
+		versions := make(map[string]string)
+		for _, feature := range layer.Features {
+			assert.Equal(t, "debian:9", feature.Feature.Namespace.Name)
+			versions[feature.Feature.Name] = feature.Version.String()
+		}
+		assert.Equal(t, map[string]string{
+			"base-files": "9.9+deb9u5",
+			"glibc":      "2.24-11+deb9u3",
+			"openssl":    "1.1.0f-3+deb9u2",
+			"tzdata":     "2018e-0+deb9u1",
+		}, versions)
+	}
+}
+
+func TestProcessWithDeepLayerTree(t *testing.T) {
+	_, f, _, _ := runtime.Caller(0)
+	testDataPath := filepath.Join(filepath.Dir(f)) + "/testdata/DistUpgrade/"
+
+	SetMaxLayerTreeDepth(3)
+	defer SetMaxLayerTreeDepth(database.DefaultMaxLayerTreeDepth)
+
+	// The datastore computes the depth of the layers, as it does when their features are retrieved.
+	datastore := newMockDatastore()
+	datastore.FctInsertLayer = func(ctx context.Context, layer database.Layer) error {
+		layer.Depth = 1
+		if layer.Parent != nil {
+			layer.Depth += layer.Parent.Depth
+		}
+		datastore.layers[layer.Name] = layer
+		return nil
+	}
+	datastore.FctFindLayer = func(ctx context.Context, name string, withFeatures, withVulnerabilities bool, minSeverity types.Priority) (database.Layer, error) {
+		if layer, exists := datastore.layers[name]; exists {
+			return layer, nil
+		}
+		return database.Layer{}, cerrors.ErrNotFound
+	}
+
+	var parentName string
+	for _, name := range []string{"base", "middle", "top"} {
+		assert.Nil(t, Process(context.Background(), datastore, "Docker", name, parentName, testDataPath+"blank.tar.gz", nil, []string{testDataPath}))
+		parentName = name
+	}
+
+	err := Process(context.Background(), datastore, "Docker", "too-deep", "top", testDataPath+"blank.tar.gz", nil, []string{testDataPath})
+	assert.Equal(t, &database.ErrLayerTreeTooDeep{Layer: "too-deep", MaxDepth: 3}, err)
+	assert.NotContains(t, datastore.layers, "too-deep")
+}
+
+func TestProcessWithNewParent(t *testing.T) {
+	_, f, _, _ := runtime.Caller(0)
+	testDataPath := filepath.Join(filepath.Dir(f)) + "/testdata/DistUpgrade/"
+
+	datastore := newMockDatastore()
+	datastore.FctInsertLayer = func(ctx context.Context, layer database.Layer) error {
+		datastore.layers[layer.Name] = layer
+		return nil
+	}
+	datastore.FctFindLayer = func(ctx context.Context, name string, withFeatures, withVulnerabilities bool, minSeverity types.Priority) (database.Layer, error) {
+		if layer, exists := datastore.layers[name]; exists {
+			return layer, nil
+		}
+		return database.Layer{}, cerrors.ErrNotFound
+	}
+
+	// outdate marks the layer as processed by a previous engine, so that it is processed again.
+	outdate := func(name string) {
+		layer := datastore.layers[name]
+		layer.EngineVersion = Version - 1
+		datastore.layers[name] = layer
+	}
+
+	assert.Nil(t, Process(context.Background(), datastore, "Docker", "blank", "", testDataPath+"blank.tar.gz", nil, []string{testDataPath}))
+	assert.Nil(t, Process(context.Background(), datastore, "Docker", "other", "", testDataPath+"blank.tar.gz", nil, []string{testDataPath}))
+	assert.Nil(t, Process(context.Background(), datastore, "Docker", "wheezy", "blank", testDataPath+"wheezy.tar.gz", nil, []string{testDataPath}))
+
+	// The layer keeps its parent when the request doesn't give any.
+	outdate("wheezy")
+	assert.Nil(t, Process(context.Background(), datastore, "Docker", "wheezy", "", testDataPath+"wheezy.tar.gz", nil, []string{testDataPath}))
+	if assert.NotNil(t, datastore.layers["wheezy"].Parent) {
+		assert.Equal(t, "blank", datastore.layers["wheezy"].Parent.Name)
+	}
+
+	// The parent of the request must be known, and can't be the layer itself.
+	outdate("wheezy")
+	assert.Equal(t, ErrParentUnknown, Process(context.Background(), datastore, "Docker", "wheezy", "unknown", testDataPath+"wheezy.tar.gz", nil, []string{testDataPath}))
+	assert.IsType(t, &cerrors.ErrBadRequest{}, Process(context.Background(), datastore, "Docker", "wheezy", "wheezy", testDataPath+"wheezy.tar.gz", nil, []string{testDataPath}))
+
+	// The parent of the request replaces the one of the layer.
+	assert.Nil(t, Process(context.Background(), datastore, "Docker", "wheezy", "other", testDataPath+"wheezy.tar.gz", nil, []string{testDataPath}))
+	wheezy := datastore.layers["wheezy"]
+	if assert.NotNil(t, wheezy.Parent) {
+		assert.Equal(t, "other", wheezy.Parent.Name)
+	}
+	assert.Equal(t, Version, wheezy.EngineVersion)
+	assert.Len(t, wheezy.Features, 52)
+}
+
+func TestProcessErrors(t *testing.T) {
+	// The server serves a layer with packages but without OS, and nothing else.
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	status := "Package: openssl\nStatus: install ok installed\nVersion: 1.0.1\n"
+	assert.Nil(t, tw.WriteHeader(&tar.Header{Name: "var/lib/dpkg/status", Mode: 0644, Size: int64(len(status))}))
+	tw.Write([]byte(status))
+	assert.Nil(t, tw.Close())
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/no-namespace" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(buf.Bytes())
+	}))
+	defer server.Close()
+
+	datastore := newMockDatastore()
+	datastore.FctInsertLayer = func(ctx context.Context, layer database.Layer) error {
+		datastore.layers[layer.Name] = layer
+		return nil
+	}
+	datastore.FctFindLayer = func(ctx context.Context, name string, withFeatures, withVulnerabilities bool, minSeverity types.Priority) (database.Layer, error) {
+		if layer, exists := datastore.layers[name]; exists {
+			return layer, nil
+		}
+		return database.Layer{}, cerrors.ErrNotFound
+	}
+
+	err := Process(context.Background(), datastore, "Unknown", "layer", "", server.URL+"/no-namespace", nil, nil)
+	assert.Equal(t, ErrUnsupportedImageFormat, err)
+
+	err = Process(context.Background(), datastore, "Docker", "layer", "unknown", server.URL+"/no-namespace", nil, nil)
+	assert.Equal(t, ErrParentUnknown, err)
+
+	err = Process(context.Background(), datastore, "Docker", "layer", "", server.URL+"/missing", nil, nil)
+	assert.Equal(t, &ErrCouldNotDownload{StatusCode: http.StatusNotFound}, err)
+	assert.Empty(t, datastore.layers)
+
+	// The layer whose namespace is unknown is stored without its features.
+	err = Process(context.Background(), datastore, "Docker", "layer", "", server.URL+"/no-namespace", nil, nil)
+	assert.Equal(t, ErrCouldNotFindNamespace, err)
+	if layer, ok := datastore.layers["layer"]; assert.True(t, ok) {
+		assert.Nil(t, layer.Namespace)
+		assert.Empty(t, layer.Features)
+	}
+}